@@ -0,0 +1,511 @@
+// Package captureclient implements the producer side of the gateway's IPC
+// protocol, so capture services can feed encoded frames to the WebRTC
+// gateway without reimplementing the message framing.
+//
+// A typical producer:
+//
+//	c, err := captureclient.Dial(ctx, captureclient.Config{
+//		SocketPath: captureclient.DefaultSocketPath,
+//		Reconnect:  true,
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	c.SendMetadata(ctx, captureclient.Metadata{VideoCodec: "h264", VideoWidth: 1920, VideoHeight: 1080, VideoFPS: 60})
+//	for frame := range encoded {
+//		if err := c.SendVideo(ctx, frame); err != nil {
+//			return err
+//		}
+//	}
+//
+// Messages are queued and written by a background goroutine. When the
+// gateway falls behind and the queue fills, sends block (the default) or,
+// with DropDeltas, delta frames are dropped until the next keyframe. Video
+// and audio frames carry sequence numbers, counting frames dropped here too,
+// so the gateway can tell the producer's drops from its own.
+//
+// The gateway may also command the encoder over the same socket: set
+// Config.Control to change bitrate, GOP length or resolution, force
+// keyframes, start and stop capture, or switch scene, source and facecam
+// picture-in-picture on request.
+//
+// Each connection opens with a hello advertising the protocol version,
+// Config.Codecs and the client's features; the gateway answers with what
+// they share, reported by Negotiation and Config.OnNegotiated.
+//
+// ReturnReader covers the opposite direction: audio viewers send back to the
+// host over the gateway's return channel socket.
+package captureclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrClosed is returned by sends after Close
+var ErrClosed = errors.New("captureclient: client closed")
+
+// Config configures a client
+type Config struct {
+	SocketPath string // Gateway IPC socket, or \\.\pipe\ path on Windows
+
+	// QueueSize is the number of messages buffered ahead of the socket,
+	// default 8
+	QueueSize int
+
+	// WriteTimeout bounds each socket write, default 2s. A gateway that
+	// stops reading for this long counts as disconnected.
+	WriteTimeout time.Duration
+
+	// DropDeltas drops non-keyframe video when the queue is full, and every
+	// following delta frame until the next keyframe, instead of blocking.
+	// Metadata, keyframes and audio always block.
+	DropDeltas bool
+
+	// Reconnect redials after a write failure instead of failing every later
+	// send. Queued delta frames are discarded until the next keyframe and the
+	// latest metadata is re-sent first.
+	Reconnect bool
+
+	// ReconnectDelay is the wait between dial attempts, default 1s
+	ReconnectDelay time.Duration
+
+	// Control applies encoder commands from the gateway. When nil, commands
+	// are answered with an error.
+	Control ControlFunc
+
+	// Software names the producer in its hello, e.g. "capture-service/2.1"
+	Software string
+
+	// Codecs are the video codecs the producer can send, most preferred
+	// first. The gateway answers with those it accepts; empty leaves the
+	// codec unnegotiated.
+	Codecs []string
+
+	// Checksums adds a CRC-32 of each video and audio payload to its
+	// header, so the gateway discards frames corrupted on the way
+	Checksums bool
+
+	// Capture names the capture API in the hello, e.g. CaptureScreenCaptureKit
+	Capture string
+
+	// PixelFormats are the encoder inputs the producer can use, most
+	// preferred first, e.g. PixelFormatNV12. The gateway picks one, reported
+	// in Negotiation.PixelFormat; 10-bit formats only when it is configured
+	// for them.
+	PixelFormats []string
+
+	// OnNegotiated is called with the gateway's answer to the hello on
+	// each connection. It runs on the client's reader goroutine.
+	OnNegotiated func(Negotiation)
+}
+
+// Stats are client counters
+type Stats struct {
+	Sent       uint64 // Messages written
+	Dropped    uint64 // Video frames dropped for backpressure or a reconnect
+	Bytes      uint64 // Bytes written
+	Reconnects uint64
+	Connected  bool
+}
+
+// message is a queued, fully encoded IPC message
+type message struct {
+	header   []byte
+	payload  []byte
+	video    bool
+	keyframe bool
+}
+
+// Client sends frames to the gateway over a Unix socket. Its methods are
+// safe for concurrent use, but frames should be sent from one goroutine to
+// keep them in order.
+type Client struct {
+	cfg Config
+
+	queue  chan message
+	closed chan struct{}
+	done   chan struct{}
+
+	mu          sync.Mutex
+	conn        net.Conn
+	err         error        // Terminal write error when not reconnecting
+	metadata    *message     // Latest metadata, re-sent on reconnect
+	skipDelta   bool         // Dropping new video until the next keyframe
+	negotiation *Negotiation // Gateway's answer on the current connection
+	closeOnce   sync.Once
+
+	// awaitKey drops queued delta frames after a reconnect; owned by the
+	// writer
+	awaitKey bool
+
+	// Sequence numbers of the last video and audio frame offered
+	videoSeq atomic.Uint64
+	audioSeq atomic.Uint64
+
+	// Statistics
+	sent       atomic.Uint64
+	dropped    atomic.Uint64
+	bytes      atomic.Uint64
+	reconnects atomic.Uint64
+	connected  atomic.Bool
+}
+
+// Dial connects to the gateway and starts the writer
+func Dial(ctx context.Context, cfg Config) (*Client, error) {
+	// Apply defaults for zero values
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 8
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = 2 * time.Second
+	}
+	if cfg.ReconnectDelay <= 0 {
+		cfg.ReconnectDelay = time.Second
+	}
+	if cfg.SocketPath == "" {
+		return nil, errors.New("captureclient: SocketPath is required")
+	}
+
+	conn, err := dial(ctx, cfg.SocketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		cfg:    cfg,
+		queue:  make(chan message, cfg.QueueSize),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+		conn:   conn,
+	}
+	hello, err := c.hello()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := c.write(hello); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("captureclient: send hello: %w", err)
+	}
+	c.connected.Store(true)
+	if msg, ok := c.announcement(); ok {
+		c.queue <- msg
+	}
+
+	go c.readLoop(conn)
+	go c.writeLoop()
+
+	return c, nil
+}
+
+// SendMetadata queues stream metadata; it blocks while the queue is full
+func (c *Client) SendMetadata(ctx context.Context, meta Metadata) error {
+	header, err := encodeHeader(messageTypeMetadata, meta, 0)
+	if err != nil {
+		return err
+	}
+	msg := message{header: header}
+
+	c.mu.Lock()
+	c.metadata = &msg
+	c.mu.Unlock()
+
+	return c.enqueue(ctx, msg)
+}
+
+// SendVideo queues a video frame. The frame's data must not be modified
+// until the message is written; pass a copy if the buffer is reused.
+func (c *Client) SendVideo(ctx context.Context, frame VideoFrame) error {
+	header, err := encodeHeader(messageTypeVideo, videoHeader{
+		PTS:      frame.PTS,
+		DTS:      frame.DTS,
+		Keyframe: frame.Keyframe,
+		Width:    frame.Width,
+		Height:   frame.Height,
+		Codec:    frame.Codec,
+		Seq:      c.videoSeq.Add(1),
+		CRC32:    checksum(c.cfg.Checksums, frame.Data),
+	}, len(frame.Data))
+	if err != nil {
+		return err
+	}
+	msg := message{header: header, payload: frame.Data, video: true, keyframe: frame.Keyframe}
+
+	c.mu.Lock()
+	if frame.Keyframe {
+		c.skipDelta = false
+	}
+	skip := c.skipDelta
+	c.mu.Unlock()
+	if skip {
+		c.dropped.Add(1)
+		return nil
+	}
+
+	if c.cfg.DropDeltas && !frame.Keyframe {
+		if err := c.checkOpen(); err != nil {
+			return err
+		}
+		select {
+		case c.queue <- msg:
+			return nil
+		default:
+			c.mu.Lock()
+			c.skipDelta = true
+			c.mu.Unlock()
+			c.dropped.Add(1)
+			return nil
+		}
+	}
+
+	return c.enqueue(ctx, msg)
+}
+
+// SendAudio queues PCM audio; it blocks while the queue is full
+func (c *Client) SendAudio(ctx context.Context, frame AudioFrame) error {
+	header, err := encodeHeader(messageTypeAudio, audioHeader{
+		PTS:         frame.PTS,
+		SampleRate:  frame.SampleRate,
+		Channels:    frame.Channels,
+		SampleCount: frame.SampleCount,
+		Source:      frame.Source,
+		Seq:         c.audioSeq.Add(1),
+		CRC32:       checksum(c.cfg.Checksums, frame.Data),
+	}, len(frame.Data))
+	if err != nil {
+		return err
+	}
+	return c.enqueue(ctx, message{header: header, payload: frame.Data})
+}
+
+// SendText queues a timed caption; it blocks while the queue is full
+func (c *Client) SendText(ctx context.Context, frame TextFrame) error {
+	header, err := encodeHeader(messageTypeText, textHeader{
+		PTS:        frame.PTS,
+		DurationMs: frame.Duration.Milliseconds(),
+		Text:       frame.Text,
+		Speaker:    frame.Speaker,
+		Language:   frame.Language,
+	}, 0)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(ctx, message{header: header})
+}
+
+// SendGameInfo queues a game info update; it blocks while the queue is full
+func (c *Client) SendGameInfo(ctx context.Context, info GameInfo) error {
+	header, err := encodeHeader(messageTypeGameInfo, info, 0)
+	if err != nil {
+		return err
+	}
+	return c.enqueue(ctx, message{header: header})
+}
+
+// Stats returns the client counters
+func (c *Client) Stats() Stats {
+	return Stats{
+		Sent:       c.sent.Load(),
+		Dropped:    c.dropped.Load(),
+		Bytes:      c.bytes.Load(),
+		Reconnects: c.reconnects.Load(),
+		Connected:  c.connected.Load(),
+	}
+}
+
+// Close writes any queued messages, waiting at most WriteTimeout for each,
+// and closes the connection
+func (c *Client) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	<-c.done
+	c.connected.Store(false)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		err := c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+// checkOpen returns ErrClosed after Close, or the error that ended the
+// connection when not reconnecting
+func (c *Client) checkOpen() error {
+	select {
+	case <-c.closed:
+		return ErrClosed
+	case <-c.done:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.err != nil {
+			return c.err
+		}
+		return ErrClosed
+	default:
+		return nil
+	}
+}
+
+// enqueue waits for queue space
+func (c *Client) enqueue(ctx context.Context, msg message) error {
+	if err := c.checkOpen(); err != nil {
+		return err
+	}
+	select {
+	case c.queue <- msg:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.closed:
+		return ErrClosed
+	case <-c.done:
+		return c.checkOpen()
+	}
+}
+
+// writeLoop writes queued messages until Close, or until a write fails
+// when not reconnecting
+func (c *Client) writeLoop() {
+	defer close(c.done)
+
+	for {
+		select {
+		case msg := <-c.queue:
+			if msg.video {
+				if msg.keyframe {
+					c.awaitKey = false
+				} else if c.awaitKey {
+					c.dropped.Add(1)
+					continue
+				}
+			}
+			if !c.writeOrReconnect(msg) {
+				return
+			}
+		case <-c.closed:
+			// Flush what is already queued
+			for {
+				select {
+				case msg := <-c.queue:
+					if err := c.write(msg); err != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// writeOrReconnect writes msg, redialling on failure when configured.
+// Returns false when the writer should stop.
+func (c *Client) writeOrReconnect(msg message) bool {
+	err := c.write(msg)
+	if err == nil {
+		return true
+	}
+	c.connected.Store(false)
+
+	if !c.cfg.Reconnect {
+		c.mu.Lock()
+		c.err = fmt.Errorf("captureclient: write failed: %w", err)
+		c.mu.Unlock()
+		return false
+	}
+
+	for {
+		select {
+		case <-c.closed:
+			return false
+		case <-time.After(c.cfg.ReconnectDelay):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.cfg.WriteTimeout)
+		conn, err := dial(ctx, c.cfg.SocketPath)
+		cancel()
+		if err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		if c.conn != nil {
+			c.conn.Close()
+		}
+		c.conn = conn
+		c.negotiation = nil
+		meta := c.metadata
+		c.mu.Unlock()
+
+		// The gateway lost the reference frames; wait for a keyframe
+		c.awaitKey = true
+		c.reconnects.Add(1)
+		c.connected.Store(true)
+
+		go c.readLoop(conn)
+
+		if hello, err := c.hello(); err == nil {
+			if err := c.write(hello); err != nil {
+				c.connected.Store(false)
+				continue
+			}
+		}
+		if meta != nil {
+			if err := c.write(*meta); err != nil {
+				c.connected.Store(false)
+				continue
+			}
+		}
+		if msg, ok := c.announcement(); ok {
+			if err := c.write(msg); err != nil {
+				c.connected.Store(false)
+				continue
+			}
+		}
+		return true
+	}
+}
+
+// write sends one message on the current connection
+func (c *Client) write(msg message) error {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return net.ErrClosed
+	}
+
+	if err := conn.SetWriteDeadline(time.Now().Add(c.cfg.WriteTimeout)); err != nil {
+		return err
+	}
+	bufs := net.Buffers{msg.header}
+	if len(msg.payload) > 0 {
+		bufs = append(bufs, msg.payload)
+	}
+	n, err := bufs.WriteTo(conn)
+	c.bytes.Add(uint64(n))
+	if err != nil {
+		return err
+	}
+	c.sent.Add(1)
+	return nil
+}
+
+// dial connects to the gateway socket or pipe
+func dial(ctx context.Context, path string) (net.Conn, error) {
+	conn, err := connect(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("captureclient: connect to %s: %w", path, err)
+	}
+	return conn, nil
+}
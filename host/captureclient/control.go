@@ -0,0 +1,176 @@
+package captureclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+)
+
+// Action is what a gateway command asks the capture service to do
+type Action string
+
+// Actions the gateway sends
+const (
+	ActionStatus        Action = "status"         // Report settings without changing them
+	ActionKeyframe      Action = "keyframe"       // Encode the next picture as an IDR
+	ActionSetBitrate    Action = "set_bitrate"    // Command.BitrateKbps
+	ActionSetGOP        Action = "set_gop"        // Command.GOPFrames
+	ActionSetResolution Action = "set_resolution" // Command.Width and Height
+	ActionStartCapture  Action = "start_capture"
+	ActionStopCapture   Action = "stop_capture"
+	ActionSwitchScene   Action = "switch_scene"  // Command.Scene
+	ActionSwitchSource  Action = "switch_source" // Command.Source
+	ActionSetPiP        Action = "set_pip"       // Command.PiP
+
+	// Screen capture, e.g. ScreenCaptureKit's minimumFrameInterval and
+	// showsCursor
+	ActionSetFrameRate Action = "set_frame_rate" // Command.FPS
+	ActionSetCursor    Action = "set_cursor"     // Command.Cursor
+
+	// Sent to 10-bit producers while a viewer decodes only 8-bit, and
+	// again to restore 10-bit once it has left
+	ActionSetBitDepth Action = "set_bit_depth" // Command.BitDepth
+)
+
+// Command is an encoder command from the gateway. Unknown actions should be
+// answered with an error so newer gateways fail fast.
+type Command struct {
+	Action      Action `json:"action"`
+	BitrateKbps int    `json:"bitrate_kbps,omitempty"`
+	GOPFrames   int    `json:"gop_frames,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Scene       string `json:"scene,omitempty"`
+	Source      string `json:"source,omitempty"`
+	PiP         *bool  `json:"pip,omitempty"` // Facecam picture-in-picture on or off
+	FPS         int    `json:"fps,omitempty"`
+	Cursor      *bool  `json:"cursor,omitempty"` // Mouse pointer drawn or not
+	BitDepth    int    `json:"bit_depth,omitempty"`
+}
+
+// State is the encoder configuration after a command
+type State struct {
+	BitrateKbps int    `json:"bitrate_kbps,omitempty"`
+	GOPFrames   int    `json:"gop_frames,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Capturing   bool   `json:"capturing"`
+	Scene       string `json:"scene,omitempty"`  // Active scene, for producers that have them
+	Source      string `json:"source,omitempty"` // Active input
+	PiP         bool   `json:"pip"`              // Facecam shown
+	FPS         int    `json:"fps,omitempty"`    // Capture frame rate
+	Cursor      *bool  `json:"cursor,omitempty"` // Mouse pointer drawn, for screen capture
+	BitDepth    int    `json:"bit_depth,omitempty"`
+}
+
+// ControlFunc applies a gateway command. It runs on the client's reader
+// goroutine, so it should return promptly; later commands wait for it.
+type ControlFunc func(cmd Command) (State, error)
+
+// commandHeader is the JSON header of a control message
+type commandHeader struct {
+	ID uint64 `json:"id"`
+	Command
+}
+
+// replyHeader is the JSON header of a control reply. ID 0 reports state
+// unasked, which tells the gateway that commands are accepted.
+type replyHeader struct {
+	ID    uint64 `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	State
+}
+
+// readLoop reads commands and heartbeats from conn until it fails, which
+// happens when the connection is closed or replaced. Other message types
+// are skipped.
+func (c *Client) readLoop(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		var head [5]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint32(head[1:])
+		if length > maxMessageSize {
+			return
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		if end := bytes.IndexByte(body, 0); end >= 0 {
+			body = body[:end]
+		}
+		switch messageType(head[0]) {
+		case messageTypeControl:
+		case messageTypePing:
+			c.answerPing(body)
+			continue
+		case messageTypeHello:
+			c.handleHello(body)
+			continue
+		default:
+			continue
+		}
+
+		var cmd commandHeader
+		if err := json.Unmarshal(body, &cmd); err != nil {
+			continue
+		}
+		reply := replyHeader{ID: cmd.ID, Error: "control is not supported"}
+		if c.cfg.Control != nil {
+			state, err := c.cfg.Control(cmd.Command)
+			reply = replyHeader{ID: cmd.ID, OK: err == nil, State: state}
+			if err != nil {
+				reply.Error = err.Error()
+			}
+		}
+		header, err := encodeHeader(messageTypeControlReply, reply, 0)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.cfg.WriteTimeout)
+		_ = c.enqueue(ctx, message{header: header})
+		cancel()
+	}
+}
+
+// answerPing queues a pong, so the gateway knows the producer is alive
+// even while it sends no frames. The pong waits behind frames already
+// queued, like a control reply.
+func (c *Client) answerPing(body []byte) {
+	var ping heartbeatHeader
+	if err := json.Unmarshal(body, &ping); err != nil {
+		return
+	}
+	header, err := encodeHeader(messageTypePong, ping, 0)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.cfg.WriteTimeout)
+	_ = c.enqueue(ctx, message{header: header})
+	cancel()
+}
+
+// announcement reports the current state unasked, telling the gateway
+// that commands are accepted. ok is false without a Control function.
+func (c *Client) announcement() (msg message, ok bool) {
+	if c.cfg.Control == nil {
+		return message{}, false
+	}
+	state, err := c.cfg.Control(Command{Action: ActionStatus})
+	if err != nil {
+		return message{}, false
+	}
+	header, err := encodeHeader(messageTypeControlReply, replyHeader{OK: true, State: state}, 0)
+	if err != nil {
+		return message{}, false
+	}
+	return message{header: header}, true
+}
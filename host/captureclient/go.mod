@@ -0,0 +1,5 @@
+module github.com/zachmartin/gaming-capture/host/captureclient
+
+go 1.21
+
+require golang.org/x/sys v0.27.0
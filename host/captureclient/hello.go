@@ -0,0 +1,118 @@
+package captureclient
+
+import (
+	"encoding/json"
+	"slices"
+)
+
+// ProtocolVersion is the IPC protocol version the client speaks. Gateways
+// that predate the hello exchange ignore it and never answer.
+const ProtocolVersion = 1
+
+// Features a producer may offer in its hello
+const (
+	FeatureControl   = "control"   // Answers encoder commands; offered when Config.Control is set
+	FeatureHeartbeat = "heartbeat" // Answers pings
+	FeatureText      = "text"      // Sends timed text
+	FeatureGameInfo  = "game_info" // Sends game info
+)
+
+// Capture APIs for Config.Capture
+const (
+	CaptureScreenCaptureKit = "screencapturekit"
+	CaptureAVFoundation     = "avfoundation"
+)
+
+// Pixel formats for Config.PixelFormats
+const (
+	PixelFormatNV12 = "nv12" // 8-bit 4:2:0 biplanar; CoreVideo 420v and 420f
+	PixelFormatBGRA = "bgra" // 8-bit BGRA, ScreenCaptureKit's default
+	PixelFormatP010 = "p010" // 10-bit 4:2:0 biplanar; for HEVC, AV1 or VP9, when the gateway enables 10-bit
+)
+
+// helloHeader is the JSON header of a hello message, sent first on every
+// connection and answered by the gateway
+type helloHeader struct {
+	Version    int      `json:"version"`
+	MinVersion int      `json:"min_version"`
+	Software   string   `json:"software,omitempty"`
+	Codecs     []string `json:"codecs,omitempty"`
+	Features   []string `json:"features,omitempty"`
+	Error      string   `json:"error,omitempty"`
+
+	Capture      string   `json:"capture,omitempty"`
+	PixelFormats []string `json:"pixel_formats,omitempty"`
+	PixelFormat  string   `json:"pixel_format,omitempty"`
+}
+
+// Negotiation is the gateway's answer to the client's hello
+type Negotiation struct {
+	Version  int      // Protocol version in use
+	Codecs   []string // Codecs both sides accept, in the gateway's order of preference
+	Features []string // Features both sides support
+
+	// PixelFormat is the encoder input the gateway chose from
+	// Config.PixelFormats; empty when none were offered. With
+	// PixelFormatP010, Codecs holds only codecs with a 10-bit profile.
+	PixelFormat string
+
+	// Error is set when the gateway refused the connection, which it then
+	// closes
+	Error string
+}
+
+// Has reports whether a feature was negotiated
+func (n Negotiation) Has(feature string) bool {
+	return slices.Contains(n.Features, feature)
+}
+
+// hello builds the client's hello
+func (c *Client) hello() (message, error) {
+	features := []string{FeatureHeartbeat, FeatureText, FeatureGameInfo}
+	if c.cfg.Control != nil {
+		features = append(features, FeatureControl)
+	}
+	header, err := encodeHeader(messageTypeHello, helloHeader{
+		Version:    ProtocolVersion,
+		MinVersion: ProtocolVersion,
+		Software:   c.cfg.Software,
+		Codecs:     c.cfg.Codecs,
+		Features:   features,
+
+		Capture:      c.cfg.Capture,
+		PixelFormats: c.cfg.PixelFormats,
+	}, 0)
+	if err != nil {
+		return message{}, err
+	}
+	return message{header: header}, nil
+}
+
+// handleHello records the gateway's answer
+func (c *Client) handleHello(body []byte) {
+	var h helloHeader
+	if err := json.Unmarshal(body, &h); err != nil {
+		return
+	}
+	n := Negotiation{Version: h.Version, Codecs: h.Codecs, Features: h.Features, PixelFormat: h.PixelFormat, Error: h.Error}
+
+	c.mu.Lock()
+	c.negotiation = &n
+	c.mu.Unlock()
+
+	if c.cfg.OnNegotiated != nil {
+		c.cfg.OnNegotiated(n)
+	}
+}
+
+// Negotiation returns the gateway's answer to the hello on the current
+// connection. ok is false until it arrives, and always with gateways that
+// predate the exchange.
+func (c *Client) Negotiation() (n Negotiation, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.negotiation == nil {
+		return Negotiation{}, false
+	}
+	return *c.negotiation, true
+}
@@ -0,0 +1,206 @@
+package captureclient
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// messageType is the first byte of every IPC message
+type messageType byte
+
+const (
+	messageTypeVideo    messageType = 0x01
+	messageTypeAudio    messageType = 0x02
+	messageTypeMetadata messageType = 0x03
+
+	// messageTypeReturnAudio is sent by the gateway on the return channel
+	messageTypeReturnAudio messageType = 0x04
+
+	messageTypeText     messageType = 0x05
+	messageTypeGameInfo messageType = 0x06
+
+	// messageTypeControl is sent by the gateway on the capture socket;
+	// messageTypeControlReply answers it
+	messageTypeControl      messageType = 0x07
+	messageTypeControlReply messageType = 0x08
+
+	// messageTypePing is a heartbeat from the gateway; messageTypePong
+	// answers it with the same sequence number
+	messageTypePing messageType = 0x09
+	messageTypePong messageType = 0x0A
+
+	// messageTypeHello opens every connection, and the gateway answers it
+	messageTypeHello messageType = 0x0B
+)
+
+// maxMessageSize is the largest message the gateway accepts
+const maxMessageSize = 100 * 1024 * 1024
+
+// VideoFrame is one encoded access unit
+type VideoFrame struct {
+	PTS      int64  // Presentation timestamp in nanoseconds
+	DTS      int64  // Decode timestamp in nanoseconds
+	Keyframe bool   // Independently decodable; must carry parameter sets
+	Width    int    // Coded width in pixels
+	Height   int    // Coded height in pixels
+	Codec    string // "h264", "hevc", "av1" or "vp9"
+	Data     []byte // Annex-B or length-prefixed NAL units, or OBUs
+}
+
+// AudioFrame is a block of interleaved 16-bit PCM samples
+type AudioFrame struct {
+	PTS         int64 // Presentation timestamp in nanoseconds
+	SampleRate  int   // e.g. 48000
+	Channels    int   // e.g. 2 for stereo
+	SampleCount int   // Samples per channel
+	Data        []byte
+	Source      string // Input name, e.g. "game" or "mic", for the gateway's mixer; empty for the main mix
+}
+
+// TextFrame is a timed caption, e.g. speech-to-text of voice chat
+type TextFrame struct {
+	PTS      int64         // Presentation timestamp in nanoseconds, on the video clock
+	Duration time.Duration // How long the text is shown
+	Text     string
+	Speaker  string // Optional speaker label
+	Language string // Optional BCP 47 tag, e.g. "en"
+}
+
+// GameInfo describes what is being played, for viewer overlays. Send it
+// when the game or scene changes and about once a second with fresh counters.
+type GameInfo struct {
+	Game        string             `json:"game,omitempty"`
+	Scene       string             `json:"scene,omitempty"`
+	FPS         float64            `json:"fps,omitempty"`
+	FrameTimeMs float64            `json:"frame_time_ms,omitempty"`
+	CPUPercent  float64            `json:"cpu_percent,omitempty"`
+	GPUPercent  float64            `json:"gpu_percent,omitempty"`
+	Counters    map[string]float64 `json:"counters,omitempty"`
+}
+
+// Metadata describes the stream. Send it after connecting and whenever the
+// stream changes; the client re-sends the latest copy after reconnecting.
+type Metadata struct {
+	VideoWidth    int    `json:"video_width"`
+	VideoHeight   int    `json:"video_height"`
+	VideoCodec    string `json:"video_codec"`
+	VideoFPS      int    `json:"video_fps"`
+	AudioRate     int    `json:"audio_sample_rate"`
+	AudioChannels int    `json:"audio_channels"`
+
+	// VideoFormat is the NAL framing: "annexb", "avcc", or empty to let the
+	// gateway detect it
+	VideoFormat string `json:"video_format,omitempty"`
+
+	// VideoCodecConfig is the avcC/hvcC record for length-prefixed streams
+	VideoCodecConfig []byte `json:"video_codec_config,omitempty"`
+
+	// Color is the video's color space, passed through to viewers
+	Color *ColorSpace `json:"color,omitempty"`
+
+	// HDR is the HDR10 metadata of a PQ or HLG stream, written into
+	// recordings and sent to viewers that can tone-map
+	HDR *HDRMetadata `json:"hdr,omitempty"`
+
+	// Rotation turns the picture clockwise for display: 0, 90, 180 or 270
+	// degrees, e.g. for a handheld captured in portrait
+	Rotation int `json:"rotation,omitempty"`
+}
+
+// ColorSpace describes how the video's samples map to colors, using the
+// names of the WebCodecs VideoColorSpace. ScreenCaptureKit's Display P3,
+// for example, is {"smpte432", "iec61966-2-1", "bt709", false}.
+type ColorSpace struct {
+	Primaries string `json:"primaries,omitempty"` // e.g. "bt709", "bt2020", "smpte432"
+	Transfer  string `json:"transfer,omitempty"`  // e.g. "bt709", "iec61966-2-1", "pq", "hlg"
+	Matrix    string `json:"matrix,omitempty"`    // e.g. "rgb", "bt709", "bt2020-ncl"
+	FullRange bool   `json:"full_range,omitempty"`
+}
+
+// HDRMetadata is HDR10 static metadata: the mastering display's color
+// volume (SMPTE ST 2086) as CIE 1931 xy and cd/m², and the content light
+// levels (CTA-861.3). On macOS both come attached to HDR pixel buffers.
+type HDRMetadata struct {
+	Primaries    [3][2]float64 `json:"primaries"`   // Red, green and blue
+	WhitePoint   [2]float64    `json:"white_point"` // D65 is {0.3127, 0.329}
+	MaxLuminance float64       `json:"max_luminance"`
+	MinLuminance float64       `json:"min_luminance"`
+	MaxCLL       int           `json:"max_cll,omitempty"`
+	MaxFALL      int           `json:"max_fall,omitempty"`
+}
+
+// videoHeader is the JSON header of a video message
+type videoHeader struct {
+	PTS      int64  `json:"pts"`
+	DTS      int64  `json:"dts"`
+	Keyframe bool   `json:"keyframe"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	Codec    string `json:"codec"`
+
+	// Seq numbers every frame offered, sent or dropped; CRC32 is set with
+	// Config.Checksums
+	Seq   uint64  `json:"seq,omitempty"`
+	CRC32 *uint32 `json:"crc32,omitempty"`
+}
+
+// audioHeader is the JSON header of an audio message
+type audioHeader struct {
+	PTS         int64  `json:"pts"`
+	SampleRate  int    `json:"sample_rate"`
+	Channels    int    `json:"channels"`
+	SampleCount int    `json:"sample_count"`
+	Source      string `json:"source,omitempty"`
+
+	Seq   uint64  `json:"seq,omitempty"`
+	CRC32 *uint32 `json:"crc32,omitempty"`
+}
+
+// textHeader is the JSON header of a text message; the text travels in it
+type textHeader struct {
+	PTS        int64  `json:"pts"`
+	DurationMs int64  `json:"duration_ms"`
+	Text       string `json:"text"`
+	Speaker    string `json:"speaker,omitempty"`
+	Language   string `json:"language,omitempty"`
+}
+
+// checksum returns the CRC-32 of a payload for its header, or nil when
+// checksums are off
+func checksum(on bool, payload []byte) *uint32 {
+	if !on {
+		return nil
+	}
+	sum := crc32.ChecksumIEEE(payload)
+	return &sum
+}
+
+// heartbeatHeader is the JSON header of a ping or pong
+type heartbeatHeader struct {
+	Seq uint64 `json:"seq"`
+}
+
+// encodeHeader builds everything in a message up to the payload:
+// [1 byte type] [4 bytes length, big-endian] [JSON] [0x00]. The length
+// covers the JSON, its terminator and the payload.
+func encodeHeader(t messageType, header any, payloadLen int) ([]byte, error) {
+	js, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("captureclient: encode header: %w", err)
+	}
+
+	total := len(js) + 1 + payloadLen
+	if total > maxMessageSize {
+		return nil, fmt.Errorf("captureclient: message of %d bytes exceeds the %d byte limit", total, maxMessageSize)
+	}
+
+	buf := make([]byte, 0, 5+len(js)+1)
+	buf = append(buf, byte(t))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(total))
+	buf = append(buf, js...)
+	buf = append(buf, 0)
+	return buf, nil
+}
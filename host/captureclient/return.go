@@ -0,0 +1,81 @@
+package captureclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// ReturnAudio is one audio packet a viewer sent to the host, such as a co-op
+// partner's microphone. Data is the packet as received, Opus for WebRTC
+// viewers.
+type ReturnAudio struct {
+	PeerID     string `json:"peer_id"`
+	PTS        int64  `json:"pts"` // Nanoseconds since the viewer's track started
+	Codec      string `json:"codec"`
+	SampleRate int    `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+	Data       []byte `json:"-"`
+}
+
+// ReturnReader reads viewer audio from the gateway's return channel socket
+// (GATEWAY_RETURN_SOCKET_PATH). The gateway drops packets while no reader
+// is connected, so there is nothing to catch up on after reconnecting.
+type ReturnReader struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// DialReturn connects to the gateway's return channel socket
+func DialReturn(ctx context.Context, socketPath string) (*ReturnReader, error) {
+	conn, err := connect(ctx, socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("captureclient: dial return channel: %w", err)
+	}
+	return &ReturnReader{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Read blocks until the next audio packet arrives. Unknown message types
+// are skipped so newer gateways can add them.
+func (rr *ReturnReader) Read() (ReturnAudio, error) {
+	for {
+		var head [5]byte
+		if _, err := io.ReadFull(rr.r, head[:]); err != nil {
+			return ReturnAudio{}, err
+		}
+		length := binary.BigEndian.Uint32(head[1:])
+		if length > maxMessageSize {
+			return ReturnAudio{}, fmt.Errorf("captureclient: return message of %d bytes exceeds the %d byte limit", length, maxMessageSize)
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(rr.r, body); err != nil {
+			return ReturnAudio{}, err
+		}
+		if messageType(head[0]) != messageTypeReturnAudio {
+			continue
+		}
+
+		end := bytes.IndexByte(body, 0)
+		if end < 0 {
+			return ReturnAudio{}, errors.New("captureclient: return message has no header terminator")
+		}
+
+		var pkt ReturnAudio
+		if err := json.Unmarshal(body[:end], &pkt); err != nil {
+			return ReturnAudio{}, fmt.Errorf("captureclient: decode return header: %w", err)
+		}
+		pkt.Data = body[end+1:]
+		return pkt, nil
+	}
+}
+
+// Close disconnects from the gateway
+func (rr *ReturnReader) Close() error {
+	return rr.conn.Close()
+}
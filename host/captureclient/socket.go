@@ -0,0 +1,25 @@
+package captureclient
+
+import (
+	"context"
+	"net"
+	"strings"
+)
+
+// pipePrefix starts the path of a local Windows named pipe
+const pipePrefix = `\\.\pipe\`
+
+// isPipePath reports whether path names a Windows named pipe rather than a
+// Unix socket
+func isPipePath(path string) bool {
+	return len(path) > len(pipePrefix) && strings.EqualFold(path[:len(pipePrefix)], pipePrefix)
+}
+
+// connect opens the gateway socket or pipe at path
+func connect(ctx context.Context, path string) (net.Conn, error) {
+	if isPipePath(path) {
+		return dialPipe(ctx, path)
+	}
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", path)
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package captureclient
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// DefaultSocketPath is the gateway's default IPC socket
+const DefaultSocketPath = "/tmp/elgato_stream.sock"
+
+// dialPipe fails; named pipes are a Windows feature
+func dialPipe(ctx context.Context, path string) (net.Conn, error) {
+	return nil, errors.New("named pipes are only supported on Windows")
+}
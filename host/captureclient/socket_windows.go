@@ -0,0 +1,204 @@
+//go:build windows
+
+package captureclient
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// DefaultSocketPath is the gateway's default IPC pipe
+const DefaultSocketPath = `\\.\pipe\elgato_stream`
+
+// pipeAddr is the address of a named pipe
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// dialPipe opens the gateway's named pipe, waiting while every instance is
+// taken. The gateway may identify the client but not impersonate it.
+func dialPipe(ctx context.Context, path string) (net.Conn, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		h, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil, windows.OPEN_EXISTING,
+			windows.FILE_FLAG_OVERLAPPED|windows.SECURITY_SQOS_PRESENT|windows.SECURITY_IDENTIFICATION, 0)
+		if err == nil {
+			conn, err := newPipeConn(h, path)
+			if err != nil {
+				windows.CloseHandle(h)
+				return nil, err
+			}
+			return conn, nil
+		}
+		if err != windows.ERROR_PIPE_BUSY {
+			return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr(path), Err: os.NewSyscallError("CreateFile", err)}
+		}
+
+		// The gateway creates the next instance as soon as one is taken
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// pipeIO is one direction of a pipeConn
+type pipeIO struct {
+	mu       sync.Mutex // One operation at a time
+	o        windows.Overlapped
+	ev       windows.Handle
+	deadline atomic.Int64 // Unix nanoseconds; 0 for none
+}
+
+// pipeConn is a connected named pipe. Reads and writes are overlapped, so
+// they run concurrently, and each waits at most until the deadline set
+// when it starts.
+type pipeConn struct {
+	h      windows.Handle
+	addr   pipeAddr
+	rd     pipeIO
+	wr     pipeIO
+	closed atomic.Bool
+}
+
+// newPipeConn wraps a connected pipe handle
+func newPipeConn(h windows.Handle, path string) (*pipeConn, error) {
+	c := &pipeConn{h: h, addr: pipeAddr(path)}
+	var err error
+	if c.rd.ev, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+		return nil, err
+	}
+	if c.wr.ev, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+		windows.CloseHandle(c.rd.ev)
+		return nil, err
+	}
+	return c, nil
+}
+
+// do runs one overlapped read or write
+func (c *pipeConn) do(op *pipeIO, b []byte, f func(windows.Handle, []byte, *uint32, *windows.Overlapped) error) (int, error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	wait := uint32(windows.INFINITE)
+	if d := op.deadline.Load(); d != 0 {
+		left := time.Until(time.Unix(0, d))
+		if left <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		wait = uint32(min(left.Milliseconds()+1, windows.INFINITE-1))
+	}
+
+	op.o = windows.Overlapped{HEvent: op.ev}
+	var n uint32
+	err := f(c.h, b, &n, &op.o)
+	timedOut := false
+	if err == windows.ERROR_IO_PENDING {
+		// Close may have missed this operation when it cancelled
+		if c.closed.Load() {
+			windows.CancelIoEx(c.h, &op.o)
+		}
+		if ev, _ := windows.WaitForSingleObject(op.ev, wait); ev == uint32(windows.WAIT_TIMEOUT) {
+			windows.CancelIoEx(c.h, &op.o)
+			timedOut = true
+		}
+		err = windows.GetOverlappedResult(c.h, &op.o, &n, true)
+	}
+	switch {
+	case err == nil:
+		return int(n), nil
+	case err == windows.ERROR_OPERATION_ABORTED && c.closed.Load():
+		return int(n), net.ErrClosed
+	case err == windows.ERROR_OPERATION_ABORTED && timedOut:
+		return int(n), os.ErrDeadlineExceeded
+	default:
+		return int(n), err
+	}
+}
+
+// Read reads from the pipe; a closed gateway end reads as io.EOF
+func (c *pipeConn) Read(b []byte) (int, error) {
+	n, err := c.do(&c.rd, b, windows.ReadFile)
+	switch {
+	case err == windows.ERROR_BROKEN_PIPE || err == windows.ERROR_PIPE_NOT_CONNECTED:
+		return n, io.EOF
+	case err == nil && n == 0 && len(b) > 0:
+		return 0, io.EOF
+	case err != nil && err != net.ErrClosed && err != os.ErrDeadlineExceeded:
+		return n, os.NewSyscallError("ReadFile", err)
+	}
+	return n, err
+}
+
+// Write writes all of b to the pipe
+func (c *pipeConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := c.do(&c.wr, b[written:], windows.WriteFile)
+		written += n
+		if err != nil {
+			if err != net.ErrClosed && err != os.ErrDeadlineExceeded {
+				err = os.NewSyscallError("WriteFile", err)
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close closes the pipe, cancelling pending reads and writes
+func (c *pipeConn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return net.ErrClosed
+	}
+	windows.CancelIoEx(c.h, nil)
+
+	// Wait for cancelled operations before freeing their handles
+	c.rd.mu.Lock()
+	defer c.rd.mu.Unlock()
+	c.wr.mu.Lock()
+	defer c.wr.mu.Unlock()
+	windows.CloseHandle(c.rd.ev)
+	windows.CloseHandle(c.wr.ev)
+	return windows.CloseHandle(c.h)
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.rd.deadline.Store(deadlineNanos(t))
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.wr.deadline.Store(deadlineNanos(t))
+	return nil
+}
+
+// deadlineNanos converts a deadline for pipeIO; the zero time is none
+func deadlineNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
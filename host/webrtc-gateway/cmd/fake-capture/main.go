@@ -0,0 +1,375 @@
+// Command fake-capture stands in for the capture service. It connects to
+// the gateway's IPC socket and sends a synthetic test pattern, or replays a
+// recorded .ts, .h264 or .h265 file in real time, so the gateway can be
+// developed and tested in CI without capture hardware.
+//
+//	fake-capture                                  # 1280x720 bouncing pattern
+//	fake-capture -input match.ts -audio           # replay a recording with a tone
+//	fake-capture -input clip.h264 -fps 60 -loop=false
+//
+// Recordings loop by default, on a continuous clock. The gateway's encoder
+// commands are answered: keyframes are encoded on request for the pattern,
+// and stop and start capture pause and resume sending.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"math"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/captureclient"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+)
+
+func main() {
+	var cfg sourceConfig
+	socket := flag.String("socket", captureclient.DefaultSocketPath, "gateway IPC socket or pipe")
+	flag.StringVar(&cfg.Input, "input", "", "recording to replay (.ts, .h264, .h265); empty sends a test pattern")
+	flag.IntVar(&cfg.FrameRate, "fps", 30, "frame rate of the pattern and of .h264/.h265 input")
+	flag.StringVar(&cfg.Pattern, "pattern", "bounce", "test pattern")
+	flag.StringVar(&cfg.Encoder, "encoder", "auto", "H.264 encoder backend for the pattern (auto, nvenc, vaapi, x264, or pcm for uncompressed)")
+	flag.IntVar(&cfg.Width, "width", 1280, "pattern width")
+	flag.IntVar(&cfg.Height, "height", 720, "pattern height")
+	loop := flag.Bool("loop", true, "replay the input in a loop")
+	audio := flag.Bool("audio", false, "send a 440 Hz stereo tone")
+	checksums := flag.Bool("checksums", false, "send a CRC-32 of each frame payload")
+	flag.IntVar(&cfg.Rotation, "rotation", 0, "clockwise display rotation to declare (0, 90, 180, 270)")
+	verbose := flag.Bool("v", false, "debug logging")
+	flag.Parse()
+
+	level := zerolog.InfoLevel
+	if *verbose {
+		level = zerolog.DebugLevel
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.TimeOnly}).
+		Level(level).With().Timestamp().Logger()
+
+	if cfg.FrameRate <= 0 {
+		logger.Fatal().Int("fps", cfg.FrameRate).Msg("Frame rate must be positive")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	r, err := newReplayer(cfg, *loop, *audio, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to open input")
+	}
+	defer r.close()
+
+	client, err := dial(ctx, captureclient.Config{
+		SocketPath: *socket,
+		DropDeltas: true,
+		Reconnect:  true,
+		Control:    r.control,
+		Checksums:  *checksums,
+		Software:   "fake-capture",
+		Codecs:     []string{r.src.codec()},
+		OnNegotiated: func(n captureclient.Negotiation) {
+			if n.Error != "" {
+				logger.Error().Str("error", n.Error).Msg("Gateway refused the stream")
+			}
+		},
+	}, logger)
+	if err != nil {
+		return // Interrupted
+	}
+	defer client.Close()
+
+	if err := client.SendMetadata(ctx, r.metadata()); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to send metadata")
+	}
+	logger.Info().Str("socket", *socket).Str("input", r.name()).Msg("Connected to gateway")
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	if *audio {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sendTone(ctx, client, r)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		logStats(ctx, client, logger)
+	}()
+
+	if err := r.run(ctx, client, start); err != nil && ctx.Err() == nil {
+		logger.Error().Err(err).Msg("Replay failed")
+	}
+	cancel()
+	wg.Wait()
+}
+
+// dial connects to the gateway, waiting for it to come up
+func dial(ctx context.Context, cfg captureclient.Config, logger zerolog.Logger) (*captureclient.Client, error) {
+	for {
+		client, err := captureclient.Dial(ctx, cfg)
+		if err == nil {
+			return client, nil
+		}
+		logger.Info().Err(err).Msg("Waiting for gateway")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// replayer sends a source's access units at their recorded pace
+type replayer struct {
+	cfg    sourceConfig
+	loop   bool
+	audio  bool
+	logger zerolog.Logger
+
+	mu        sync.Mutex
+	src       source
+	capturing bool
+
+	first  accessUnit // Peeked to describe the stream
+	params bitstream.Params
+}
+
+func newReplayer(cfg sourceConfig, loop, audio bool, logger zerolog.Logger) (*replayer, error) {
+	src, err := openSource(cfg)
+	if err != nil {
+		return nil, err
+	}
+	first, err := src.next()
+	if err != nil {
+		src.close()
+		return nil, err
+	}
+	r := &replayer{cfg: cfg, loop: loop, audio: audio, logger: logger, src: src, capturing: true, first: first}
+
+	// A recording describes itself in its first parameter sets
+	if p, ok, err := bitstream.FindParams(src.codec(), first.data); ok && err == nil {
+		r.params = p
+	} else {
+		r.params = bitstream.Params{Width: cfg.Width, Height: cfg.Height, FPS: float64(cfg.FrameRate)}
+	}
+	if r.params.FPS == 0 {
+		r.params.FPS = float64(cfg.FrameRate)
+	}
+	return r, nil
+}
+
+// name describes the input for logs
+func (r *replayer) name() string {
+	if r.cfg.Input == "" {
+		return "pattern:" + r.cfg.Pattern
+	}
+	return r.cfg.Input
+}
+
+// metadata describes the stream to the gateway
+func (r *replayer) metadata() captureclient.Metadata {
+	meta := captureclient.Metadata{
+		VideoWidth:  r.params.Width,
+		VideoHeight: r.params.Height,
+		VideoCodec:  r.src.codec(),
+		VideoFPS:    int(math.Round(r.params.FPS)),
+		VideoFormat: "annexb",
+		Rotation:    r.cfg.Rotation,
+	}
+	if r.audio {
+		meta.AudioRate = toneRate
+		meta.AudioChannels = toneChannels
+	}
+	return meta
+}
+
+// run sends access units, each when its decode time comes due, until ctx
+// is done or the input ends without looping
+func (r *replayer) run(ctx context.Context, client *captureclient.Client, start time.Time) error {
+	au := r.first
+	base := au.dts   // Source time sent at start
+	var offset int64 // Added to source times for the loops so far
+	var last int64   // Last decode time sent, on the output clock
+
+	for {
+		dts := au.dts - base + offset
+		if wait := time.Until(start.Add(time.Duration(dts))); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(wait):
+			}
+		}
+		last = dts
+
+		r.mu.Lock()
+		capturing := r.capturing
+		r.mu.Unlock()
+		if capturing {
+			pts := au.pts - base + offset
+			if err := client.SendVideo(ctx, captureclient.VideoFrame{
+				PTS:      pts,
+				DTS:      dts,
+				Keyframe: au.keyframe,
+				Width:    r.params.Width,
+				Height:   r.params.Height,
+				Codec:    r.src.codec(),
+				Data:     au.data,
+			}); err != nil {
+				return err
+			}
+		}
+
+		next, err := r.src.next()
+		if errors.Is(err, io.EOF) && r.loop {
+			r.logger.Debug().Msg("Input ended, looping")
+			next, err = r.restart()
+			if err == nil {
+				// Continue one frame interval after the last frame sent
+				offset = last + int64(time.Second)/int64(r.cfg.FrameRate) - (next.dts - base)
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			r.logger.Info().Msg("Input ended")
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		au = next
+	}
+}
+
+// restart reopens the source and returns its first access unit
+func (r *replayer) restart() (accessUnit, error) {
+	src, err := openSource(r.cfg)
+	if err != nil {
+		return accessUnit{}, err
+	}
+	r.mu.Lock()
+	r.src.close()
+	r.src = src
+	r.mu.Unlock()
+	return src.next()
+}
+
+// control answers the gateway's encoder commands
+func (r *replayer) control(cmd captureclient.Command) (captureclient.State, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch cmd.Action {
+	case captureclient.ActionStatus:
+	case captureclient.ActionKeyframe:
+		k, ok := r.src.(keyframer)
+		if !ok {
+			return r.state(), errors.New("a recording has keyframes only where it was encoded with them")
+		}
+		k.forceKeyframe()
+	case captureclient.ActionStartCapture:
+		r.capturing = true
+	case captureclient.ActionStopCapture:
+		r.capturing = false
+	default:
+		return r.state(), errors.New("not supported by fake-capture")
+	}
+	r.logger.Debug().Str("action", string(cmd.Action)).Msg("Gateway command")
+	return r.state(), nil
+}
+
+// state reports the stream settings. Caller holds mu.
+func (r *replayer) state() captureclient.State {
+	return captureclient.State{
+		Width:     r.params.Width,
+		Height:    r.params.Height,
+		Capturing: r.capturing,
+		Source:    r.name(),
+	}
+}
+
+// close closes the current source
+func (r *replayer) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.src.close()
+}
+
+// Tone parameters
+const (
+	toneRate     = 48000
+	toneChannels = 2
+	toneHz       = 440
+	toneBlock    = 10 * time.Millisecond
+)
+
+// sendTone sends a sine tone in real time; its timestamps count from the
+// start, as the video's do
+func sendTone(ctx context.Context, client *captureclient.Client, r *replayer) {
+	samples := int(toneRate * toneBlock / time.Second)
+	ticker := time.NewTicker(toneBlock)
+	defer ticker.Stop()
+
+	for n := 0; ; n++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		r.mu.Lock()
+		capturing := r.capturing
+		r.mu.Unlock()
+		if !capturing {
+			continue
+		}
+
+		data := make([]byte, 0, samples*toneChannels*2)
+		for i := 0; i < samples; i++ {
+			t := float64(n*samples+i) / toneRate
+			v := int16(math.Sin(2*math.Pi*toneHz*t) * 0.25 * math.MaxInt16)
+			for c := 0; c < toneChannels; c++ {
+				data = append(data, byte(v), byte(v>>8))
+			}
+		}
+		if err := client.SendAudio(ctx, captureclient.AudioFrame{
+			PTS:         int64(n) * int64(toneBlock),
+			SampleRate:  toneRate,
+			Channels:    toneChannels,
+			SampleCount: samples,
+			Data:        data,
+		}); err != nil {
+			return
+		}
+	}
+}
+
+// logStats logs the client's counters every 10 seconds
+func logStats(ctx context.Context, client *captureclient.Client, logger zerolog.Logger) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s := client.Stats()
+			logger.Info().
+				Uint64("sent", s.Sent).
+				Uint64("dropped", s.Dropped).
+				Uint64("bytes", s.Bytes).
+				Uint64("reconnects", s.Reconnects).
+				Bool("connected", s.Connected).
+				Msg("Producer statistics")
+		}
+	}
+}
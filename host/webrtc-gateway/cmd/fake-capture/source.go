@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/encoder"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/mpegts"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/pattern"
+)
+
+// accessUnit is one encoded picture in Annex-B form
+type accessUnit struct {
+	pts      int64 // Nanoseconds, on the source's own clock
+	dts      int64
+	keyframe bool
+	data     []byte
+}
+
+// source yields access units in decode order
+type source interface {
+	// next returns the next access unit, or io.EOF at the end of the input
+	next() (accessUnit, error)
+
+	// codec returns "h264" or "hevc"
+	codec() string
+
+	close() error
+}
+
+// keyframer is implemented by sources that can encode a keyframe on demand
+type keyframer interface {
+	forceKeyframe()
+}
+
+// sourceConfig selects and configures a source
+type sourceConfig struct {
+	Input     string // Recording to replay; empty generates a pattern
+	FrameRate int    // Of generated video, and of elementary streams, which carry no timestamps
+
+	// Generated video
+	Pattern string
+	Encoder string
+	Width   int
+	Height  int
+
+	// Rotation is declared in the metadata; the pictures are not turned
+	Rotation int
+}
+
+// openSource opens the configured source from the start
+func openSource(cfg sourceConfig) (source, error) {
+	if cfg.Input == "" {
+		return newPatternSource(cfg)
+	}
+	switch strings.ToLower(filepath.Ext(cfg.Input)) {
+	case ".ts", ".m2ts", ".mts":
+		return newTSSource(cfg.Input)
+	case ".h264", ".264", ".avc":
+		return newElementarySource(cfg.Input, "h264", cfg.FrameRate)
+	case ".h265", ".265", ".hevc":
+		return newElementarySource(cfg.Input, "hevc", cfg.FrameRate)
+	default:
+		return nil, fmt.Errorf("unsupported input %s: want .ts, .h264 or .h265", cfg.Input)
+	}
+}
+
+// patternSource encodes a synthetic test pattern, without end
+type patternSource struct {
+	pat      pattern.Pattern
+	enc      encoder.Encoder
+	img      *image.YCbCr
+	interval int64
+	n        uint64
+}
+
+func newPatternSource(cfg sourceConfig) (*patternSource, error) {
+	pat, err := pattern.New(cfg.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encoder.New(encoder.Config{
+		Backend:   cfg.Encoder,
+		Width:     cfg.Width,
+		Height:    cfg.Height,
+		FrameRate: cfg.FrameRate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &patternSource{
+		pat:      pat,
+		enc:      enc,
+		img:      image.NewYCbCr(image.Rect(0, 0, cfg.Width, cfg.Height), image.YCbCrSubsampleRatio420),
+		interval: int64(time.Second) / int64(cfg.FrameRate),
+	}, nil
+}
+
+func (s *patternSource) next() (accessUnit, error) {
+	pts := int64(s.n) * s.interval
+	s.pat.Render(s.img, s.n, time.Now())
+	s.n++
+	frame, err := s.enc.Encode(s.img, pts)
+	if err != nil {
+		return accessUnit{}, err
+	}
+	return accessUnit{pts: pts, dts: pts, keyframe: frame.IsKeyframe, data: frame.Data}, nil
+}
+
+func (s *patternSource) codec() string  { return "h264" }
+func (s *patternSource) close() error   { return s.enc.Close() }
+func (s *patternSource) forceKeyframe() { s.enc.ForceKeyframe() }
+
+// tsSource replays the video of an MPEG transport stream recording
+type tsSource struct {
+	file *os.File
+	dmx  *mpegts.Demuxer
+}
+
+func newTSSource(path string) (*tsSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &tsSource{file: f, dmx: mpegts.NewDemuxer(f)}, nil
+}
+
+func (s *tsSource) next() (accessUnit, error) {
+	frame, err := s.dmx.ReadFrame()
+	if err != nil {
+		return accessUnit{}, err
+	}
+	return accessUnit{pts: frame.PTS, dts: frame.DTS, keyframe: frame.Keyframe, data: frame.Data}, nil
+}
+
+func (s *tsSource) codec() string { return s.dmx.Codec() }
+func (s *tsSource) close() error  { return s.file.Close() }
+
+// elementarySource replays a raw Annex-B H.264 or H.265 stream, timed at a
+// fixed frame rate
+type elementarySource struct {
+	nals     [][]byte
+	pos      int
+	hevc     bool
+	interval int64
+	n        int64
+}
+
+func newElementarySource(path, codec string, fps int) (*elementarySource, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	nals := bitstream.SplitAnnexB(data)
+	if len(nals) == 0 {
+		return nil, fmt.Errorf("%s has no NAL units", path)
+	}
+	return &elementarySource{
+		nals:     nals,
+		hevc:     codec == "hevc",
+		interval: int64(time.Second) / int64(fps),
+	}, nil
+}
+
+// next groups NAL units into the next access unit. A picture starts with
+// its first slice, or with the parameter sets, SEI or delimiter ahead of it.
+func (s *elementarySource) next() (accessUnit, error) {
+	var au [][]byte
+	keyframe, vcl := false, false
+	for ; s.pos < len(s.nals); s.pos++ {
+		nal := s.nals[s.pos]
+		isVCL, first, key := s.classify(nal)
+		if vcl && (!isVCL || first) {
+			break
+		}
+		au = append(au, nal)
+		vcl = vcl || isVCL
+		keyframe = keyframe || key
+	}
+	if len(au) == 0 {
+		return accessUnit{}, io.EOF
+	}
+	pts := s.n * s.interval
+	s.n++
+	return accessUnit{pts: pts, dts: pts, keyframe: keyframe, data: bitstream.JoinAnnexB(au)}, nil
+}
+
+// classify reports whether nal is a slice, whether it is the first slice of
+// a picture, and whether it belongs to a keyframe
+func (s *elementarySource) classify(nal []byte) (vcl, first, keyframe bool) {
+	if s.hevc {
+		t := bitstream.H265NALType(nal)
+		if t >= 32 || len(nal) < 3 {
+			return false, false, false
+		}
+		// first_slice_segment_in_pic_flag; types 16 to 21 are IRAP pictures
+		return true, nal[2]&0x80 != 0, t >= 16 && t <= 21
+	}
+	t := nal[0] & 0x1F
+	if (t != 1 && t != 5) || len(nal) < 2 {
+		return false, false, false
+	}
+	// first_mb_in_slice is ue(v); a leading 1 bit codes 0
+	return true, nal[1]&0x80 != 0, t == 5
+}
+
+func (s *elementarySource) codec() string {
+	if s.hevc {
+		return "hevc"
+	}
+	return "h264"
+}
+
+func (s *elementarySource) close() error { return nil }
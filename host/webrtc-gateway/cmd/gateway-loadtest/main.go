@@ -0,0 +1,198 @@
+// Command gateway-loadtest soak-tests a running gateway. It feeds a
+// synthetic H.264 stream into the IPC socket as the capture service would,
+// connects many WebRTC viewers, injects faults on both sides, and reports
+// end-to-end frame loss and latency, so performance changes can be
+// compared run against run.
+//
+//	gateway-loadtest -viewers 50 -duration 10m -loss 0.02 -churn 2m
+//
+// Each frame carries an SEI message with its sequence number and capture
+// time, which viewers read back: a gap in sequence numbers is a missed
+// frame, and capture to arrival is the latency. Run it on the gateway's
+// host so both ends share a clock.
+//
+// Faults:
+//   - producer: -jitter delays frames, -stall-every pauses sending,
+//     -restart-every reconnects with a fresh clock
+//   - viewers: -loss drops received packets in bursts of -loss-burst, ahead
+//     of NACK so the gateway repairs them; -churn makes viewers leave and
+//     rejoin
+//
+// The exit status is 1 when the run breaks -max-missed or -max-p99.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/captureclient"
+)
+
+func main() {
+	var (
+		pcfg producerConfig
+		vcfg viewerConfig
+		loss lossFactory
+	)
+	flag.StringVar(&pcfg.SocketPath, "socket", captureclient.DefaultSocketPath, "gateway IPC socket or pipe")
+	flag.IntVar(&pcfg.Width, "width", 320, "video width")
+	flag.IntVar(&pcfg.Height, "height", 180, "video height")
+	flag.IntVar(&pcfg.FrameRate, "fps", 30, "video frame rate")
+	flag.StringVar(&pcfg.Pattern, "pattern", "bounce", "test pattern")
+	flag.StringVar(&pcfg.Encoder, "encoder", "auto", "H.264 encoder backend (auto, nvenc, vaapi, x264, or pcm for uncompressed)")
+	flag.DurationVar(&pcfg.Jitter, "jitter", 0, "delay each frame by up to this long")
+	flag.DurationVar(&pcfg.StallEvery, "stall-every", 0, "pause the producer this often")
+	flag.DurationVar(&pcfg.StallFor, "stall-for", 5*time.Second, "length of each producer pause")
+	flag.DurationVar(&pcfg.RestartEvery, "restart-every", 0, "reconnect the producer this often")
+
+	flag.StringVar(&vcfg.URL, "url", "http://localhost:8080/webrtc/offer", "signaling endpoint")
+	flag.BoolVar(&vcfg.WHEP, "whep", false, "the endpoint speaks WHEP rather than JSON offers")
+	flag.StringVar(&vcfg.Token, "token", "", "bearer token for signaling")
+	flag.DurationVar(&vcfg.Timeout, "timeout", 10*time.Second, "signaling and first-frame timeout")
+	flag.DurationVar(&vcfg.Churn, "churn", 0, "mean viewer session length; 0 keeps viewers for the whole run")
+	flag.DurationVar(&vcfg.Rejoin, "rejoin", time.Second, "wait before a viewer rejoins")
+	flag.Float64Var(&loss.Rate, "loss", 0, "fraction of received RTP packets to drop")
+	flag.Float64Var(&loss.Burst, "loss-burst", 1, "mean length of a loss burst, in packets")
+	viewers := flag.Int("viewers", 10, "number of viewers")
+	ramp := flag.Duration("ramp", 100*time.Millisecond, "delay between viewers joining")
+
+	duration := flag.Duration("duration", time.Minute, "run length; 0 runs until interrupted")
+	interval := flag.Duration("report", 5*time.Second, "report interval")
+	jsonOut := flag.Bool("json", false, "print the final report as JSON")
+	maxMissed := flag.Float64("max-missed", 0, "fail when more than this fraction of frames is missed; 0 disables")
+	maxP99 := flag.Duration("max-p99", 0, "fail when the p99 latency is higher; 0 disables")
+	verbose := flag.Bool("v", false, "debug logging")
+	flag.Parse()
+
+	level := zerolog.InfoLevel
+	if *verbose {
+		level = zerolog.DebugLevel
+	}
+	logger := zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr, TimeFormat: time.TimeOnly}).
+		Level(level).With().Timestamp().Logger()
+
+	if loss.Rate < 0 || loss.Rate >= 1 {
+		logger.Fatal().Float64("loss", loss.Rate).Msg("Loss must be at least 0 and below 1")
+	}
+	if pcfg.FrameRate <= 0 || *viewers < 0 {
+		logger.Fatal().Msg("Frame rate must be positive and viewers not negative")
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+
+	stats := newCollector()
+	loss.stats = stats
+	api, err := newAPI(&loss)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to set up WebRTC")
+	}
+
+	var wg sync.WaitGroup
+	p, err := newProducer(pcfg, stats, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create producer")
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.run(ctx)
+	}()
+
+	client := &http.Client{Timeout: vcfg.Timeout}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < *viewers; i++ {
+			v := &viewer{
+				id:     i,
+				cfg:    vcfg,
+				api:    api,
+				client: client,
+				stats:  stats,
+				logger: logger.With().Int("viewer", i).Logger(),
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v.run(ctx)
+			}()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(*ramp):
+			}
+		}
+	}()
+
+	logger.Info().Int("viewers", *viewers).Str("url", vcfg.URL).Dur("duration", *duration).Msg("Load test running")
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-ticker.C:
+			fmt.Println(stats.report(false))
+		}
+	}
+	wg.Wait()
+
+	final := stats.report(true)
+	if *jsonOut {
+		out, _ := json.MarshalIndent(final, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Println("final:", final)
+	}
+
+	failed := false
+	if *maxMissed > 0 && final.MissedRatio > *maxMissed {
+		logger.Error().Float64("missed", final.MissedRatio).Float64("max", *maxMissed).Msg("Too many frames missed")
+		failed = true
+	}
+	if *maxP99 > 0 && time.Duration(final.LatencyP99Ms)*time.Millisecond > *maxP99 {
+		logger.Error().Int64("p99_ms", final.LatencyP99Ms).Dur("max", *maxP99).Msg("Latency too high")
+		failed = true
+	}
+	if final.Joins == 0 && *viewers > 0 {
+		logger.Error().Msg("No viewer received any frames")
+		failed = true
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// newAPI builds the viewers' WebRTC stack with the default interceptors
+// behind the loss simulation
+func newAPI(loss *lossFactory) (*webrtc.API, error) {
+	m := &webrtc.MediaEngine{}
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	registry := &interceptor.Registry{}
+	registry.Add(loss)
+	if err := webrtc.RegisterDefaultInterceptors(m, registry); err != nil {
+		return nil, err
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(registry)), nil
+}
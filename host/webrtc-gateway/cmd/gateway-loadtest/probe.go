@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+)
+
+// probeUUID marks the load test's SEI messages. It has no zero bytes, and
+// the text after it none either, so the message never needs emulation
+// prevention.
+var probeUUID = []byte("gateway-loadtest")
+
+// probe is the stamp a viewer reads back from a frame
+type probe struct {
+	seq      uint64    // Frame number since the producer started
+	captured time.Time // When the producer captured it
+}
+
+// stamp inserts an SEI user data message carrying p ahead of the first
+// slice of an Annex-B H.264 access unit, after any parameter sets
+func stamp(au []byte, p probe) []byte {
+	text := fmt.Appendf(nil, "%d:%d", p.seq, p.captured.UnixNano())
+
+	sei := []byte{0x06, 0x05} // SEI, user_data_unregistered
+	for size := len(probeUUID) + len(text); ; size -= 255 {
+		if size < 255 {
+			sei = append(sei, byte(size))
+			break
+		}
+		sei = append(sei, 0xFF)
+	}
+	sei = append(sei, probeUUID...)
+	sei = append(sei, text...)
+	sei = append(sei, 0x80) // rbsp_trailing_bits
+
+	nals := bitstream.SplitAnnexB(au)
+	out := make([][]byte, 0, len(nals)+1)
+	inserted := false
+	for _, nal := range nals {
+		if t := nal[0] & 0x1F; !inserted && (t == 1 || t == 5) {
+			out = append(out, sei)
+			inserted = true
+		}
+		out = append(out, nal)
+	}
+	if !inserted {
+		out = append(out, sei)
+	}
+	return bitstream.JoinAnnexB(out)
+}
+
+// readProbe finds the stamp in an Annex-B access unit
+func readProbe(au []byte) (probe, bool) {
+	for _, nal := range bitstream.SplitAnnexB(au) {
+		if nal[0]&0x1F != 6 || len(nal) < 2 || nal[1] != 0x05 {
+			continue
+		}
+		body := nal[2:]
+		for len(body) > 0 && body[0] == 0xFF {
+			body = body[1:]
+		}
+		if len(body) < 1 {
+			continue
+		}
+		body = bytes.TrimSuffix(body[1:], []byte{0x80})
+		if !bytes.HasPrefix(body, probeUUID) {
+			continue
+		}
+
+		var seq uint64
+		var ns int64
+		if _, err := fmt.Sscanf(string(body[len(probeUUID):]), "%d:%d", &seq, &ns); err != nil {
+			return probe{}, false
+		}
+		return probe{seq: seq, captured: time.Unix(0, ns)}, true
+	}
+	return probe{}, false
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"image"
+	"math/rand"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/captureclient"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/encoder"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/pattern"
+)
+
+// producerConfig configures the fake capture service
+type producerConfig struct {
+	SocketPath string
+	Width      int
+	Height     int
+	FrameRate  int
+	Pattern    string
+	Encoder    string
+
+	// Jitter delays each frame by up to this long after capture, as a
+	// busy capture host would
+	Jitter time.Duration
+
+	// StallEvery and StallFor pause sending, as a hung encoder would
+	StallEvery time.Duration
+	StallFor   time.Duration
+
+	// RestartEvery drops the IPC connection and reconnects with a fresh
+	// clock, as a restarted capture service would
+	RestartEvery time.Duration
+}
+
+// producer feeds a synthetic H.264 stream into the gateway's IPC socket,
+// stamping every frame with its sequence number and capture time
+type producer struct {
+	cfg    producerConfig
+	stats  *collector
+	logger zerolog.Logger
+
+	enc encoder.Encoder
+	pat pattern.Pattern
+	img *image.YCbCr
+	seq uint64
+
+	// dropped counts frames the IPC client dropped in earlier sessions
+	dropped uint64
+}
+
+func newProducer(cfg producerConfig, stats *collector, logger zerolog.Logger) (*producer, error) {
+	pat, err := pattern.New(cfg.Pattern)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encoder.New(encoder.Config{
+		Backend:   cfg.Encoder,
+		Width:     cfg.Width,
+		Height:    cfg.Height,
+		FrameRate: cfg.FrameRate,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &producer{
+		cfg:    cfg,
+		stats:  stats,
+		logger: logger.With().Str("component", "producer").Logger(),
+		enc:    enc,
+		pat:    pat,
+		img:    image.NewYCbCr(image.Rect(0, 0, cfg.Width, cfg.Height), image.YCbCrSubsampleRatio420),
+	}, nil
+}
+
+// run produces until ctx is done, reconnecting whenever the session ends
+func (p *producer) run(ctx context.Context) {
+	defer p.enc.Close()
+	p.logger.Info().
+		Str("encoder", p.enc.Name()).
+		Str("pattern", p.pat.Name()).
+		Int("width", p.cfg.Width).
+		Int("height", p.cfg.Height).
+		Int("fps", p.cfg.FrameRate).
+		Msg("Producer starting")
+
+	for first := true; ; first = false {
+		if !first {
+			p.stats.restarted()
+		}
+		if err := p.session(ctx); err != nil && ctx.Err() == nil {
+			p.logger.Warn().Err(err).Msg("Producer session ended")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// session connects and sends frames until ctx is done, the connection
+// fails or the restart interval ends
+func (p *producer) session(ctx context.Context) error {
+	client, err := captureclient.Dial(ctx, captureclient.Config{
+		SocketPath: p.cfg.SocketPath,
+		Software:   "gateway-loadtest",
+		Codecs:     []string{"h264"},
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		p.dropped += client.Stats().Dropped
+		client.Close()
+	}()
+
+	if err := client.SendMetadata(ctx, captureclient.Metadata{
+		VideoWidth:  p.cfg.Width,
+		VideoHeight: p.cfg.Height,
+		VideoCodec:  "h264",
+		VideoFPS:    p.cfg.FrameRate,
+		VideoFormat: "annexb",
+	}); err != nil {
+		return err
+	}
+	p.logger.Info().Str("socket", p.cfg.SocketPath).Msg("Producer connected")
+
+	// A restarted producer starts on a new clock and with a keyframe
+	p.enc.ForceKeyframe()
+	start := time.Now()
+	var restart <-chan time.Time
+	if p.cfg.RestartEvery > 0 {
+		restart = time.After(p.cfg.RestartEvery)
+	}
+	nextStall := start.Add(p.cfg.StallEvery)
+
+	ticker := time.NewTicker(time.Second / time.Duration(p.cfg.FrameRate))
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-restart:
+			p.logger.Info().Msg("Restarting producer")
+			return nil
+		case now = <-ticker.C:
+		}
+
+		if p.cfg.StallEvery > 0 && now.After(nextStall) {
+			p.stats.stalled()
+			p.logger.Info().Dur("for", p.cfg.StallFor).Msg("Stalling producer")
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(p.cfg.StallFor):
+			}
+			nextStall = time.Now().Add(p.cfg.StallEvery)
+
+			// Skip the tick that came due during the pause
+			select {
+			case <-ticker.C:
+			default:
+			}
+			continue
+		}
+
+		p.pat.Render(p.img, p.seq, now)
+		pts := now.Sub(start).Nanoseconds()
+		encoded, err := p.enc.Encode(p.img, pts)
+		if err != nil {
+			return err
+		}
+		data := stamp(encoded.Data, probe{seq: p.seq, captured: now})
+		p.seq++
+
+		if p.cfg.Jitter > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(p.cfg.Jitter))))
+		}
+		if err := client.SendVideo(ctx, captureclient.VideoFrame{
+			PTS:      pts,
+			DTS:      pts,
+			Keyframe: encoded.IsKeyframe,
+			Width:    p.cfg.Width,
+			Height:   p.cfg.Height,
+			Codec:    "h264",
+			Data:     data,
+		}); err != nil {
+			return err
+		}
+		p.stats.produce(p.dropped + client.Stats().Dropped)
+	}
+}
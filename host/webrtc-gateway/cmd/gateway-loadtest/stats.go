@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// histogramMax is the longest latency told apart; longer ones count as it
+const histogramMax = 10 * time.Second
+
+// histogram counts durations in 1ms buckets
+type histogram struct {
+	counts [histogramMax/time.Millisecond + 1]uint64
+	n      uint64
+	max    time.Duration
+}
+
+func (h *histogram) add(d time.Duration) {
+	i := min(max(d, 0), histogramMax) / time.Millisecond
+	h.counts[i]++
+	h.n++
+	h.max = max(h.max, d)
+}
+
+// quantile returns the duration below which a fraction q of samples fall
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(h.n))
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen > rank {
+			return time.Duration(i) * time.Millisecond
+		}
+	}
+	return histogramMax
+}
+
+func (h *histogram) reset() {
+	*h = histogram{}
+}
+
+// Report is a snapshot of the run, printed every report interval and as
+// the final result
+type Report struct {
+	ElapsedS float64 `json:"elapsed_s"`
+
+	// Producer
+	Produced         uint64 `json:"produced"`
+	ProducerDropped  uint64 `json:"producer_dropped"` // Dropped by the IPC client for backpressure
+	ProducerStalls   uint64 `json:"producer_stalls"`
+	ProducerRestarts uint64 `json:"producer_restarts"`
+
+	// Viewers
+	Viewers      int    `json:"viewers"` // Receiving now
+	Joins        uint64 `json:"joins"`
+	JoinFailures uint64 `json:"join_failures"`
+	Disconnects  uint64 `json:"disconnects"` // Sessions lost, not ended by churn
+	JoinP95Ms    int64  `json:"join_p95_ms"` // Offer to first frame
+
+	// Frames across all viewers
+	Received     uint64  `json:"received"`
+	Missed       uint64  `json:"missed"` // Sequence gaps within a session
+	MissedRatio  float64 `json:"missed_ratio"`
+	InjectedLoss uint64  `json:"injected_loss"` // RTP packets dropped on purpose
+
+	// End-to-end latency, capture to viewer, over the report interval or,
+	// in the final report, the whole run
+	LatencyP50Ms int64 `json:"latency_p50_ms"`
+	LatencyP95Ms int64 `json:"latency_p95_ms"`
+	LatencyP99Ms int64 `json:"latency_p99_ms"`
+	LatencyMaxMs int64 `json:"latency_max_ms"`
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("t=%.0fs produced=%d viewers=%d joins=%d failed=%d lost=%d received=%d missed=%d (%.3f%%) latency p50=%dms p95=%dms p99=%dms max=%dms",
+		r.ElapsedS, r.Produced, r.Viewers, r.Joins, r.JoinFailures, r.Disconnects,
+		r.Received, r.Missed, r.MissedRatio*100,
+		r.LatencyP50Ms, r.LatencyP95Ms, r.LatencyP99Ms, r.LatencyMaxMs)
+}
+
+// collector gathers counters from the producer and all viewers
+type collector struct {
+	start time.Time
+
+	mu               sync.Mutex
+	produced         uint64
+	producerDropped  uint64
+	producerStalls   uint64
+	producerRestarts uint64
+	viewers          int
+	joins            uint64
+	joinFailures     uint64
+	disconnects      uint64
+	received         uint64
+	missed           uint64
+	injectedLoss     uint64
+	joinTimes        histogram
+	latency          histogram // Whole run
+	window           histogram // Since the last interval report
+}
+
+func newCollector() *collector {
+	return &collector{start: time.Now()}
+}
+
+// frame records a frame received by a viewer after missed frames since its
+// previous one
+func (c *collector) frame(latency time.Duration, missed uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.received++
+	c.missed += missed
+	c.latency.add(latency)
+	c.window.add(latency)
+}
+
+// joined records a viewer receiving its first frame
+func (c *collector) joined(took time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.joins++
+	c.viewers++
+	c.joinTimes.add(took)
+}
+
+// left records a receiving viewer's session ending; lost when it was not
+// ended on purpose
+func (c *collector) left(lost bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.viewers--
+	if lost {
+		c.disconnects++
+	}
+}
+
+// joinFailed records a viewer that never received a frame
+func (c *collector) joinFailed() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.joinFailures++
+}
+
+// produce records a frame sent, and the IPC client's drop count
+func (c *collector) produce(dropped uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.produced++
+	c.producerDropped = dropped
+}
+
+// stalled records the producer pausing
+func (c *collector) stalled() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.producerStalls++
+}
+
+// restarted records the producer reconnecting
+func (c *collector) restarted() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.producerRestarts++
+}
+
+// injected records a packet dropped by the loss simulation
+func (c *collector) injected() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.injectedLoss++
+}
+
+// report returns a snapshot. An interval report covers the latency since
+// the previous one; the final report covers the whole run.
+func (c *collector) report(final bool) Report {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := Report{
+		ElapsedS:         time.Since(c.start).Seconds(),
+		Produced:         c.produced,
+		ProducerDropped:  c.producerDropped,
+		ProducerStalls:   c.producerStalls,
+		ProducerRestarts: c.producerRestarts,
+		Viewers:          c.viewers,
+		Joins:            c.joins,
+		JoinFailures:     c.joinFailures,
+		Disconnects:      c.disconnects,
+		JoinP95Ms:        c.joinTimes.quantile(0.95).Milliseconds(),
+		Received:         c.received,
+		Missed:           c.missed,
+		InjectedLoss:     c.injectedLoss,
+	}
+	if total := c.received + c.missed; total > 0 {
+		r.MissedRatio = float64(c.missed) / float64(total)
+	}
+
+	h := &c.window
+	if final {
+		h = &c.latency
+	}
+	r.LatencyP50Ms = h.quantile(0.50).Milliseconds()
+	r.LatencyP95Ms = h.quantile(0.95).Milliseconds()
+	r.LatencyP99Ms = h.quantile(0.99).Milliseconds()
+	r.LatencyMaxMs = h.max.Milliseconds()
+	c.window.reset()
+	return r
+}
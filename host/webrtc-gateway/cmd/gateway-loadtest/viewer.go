@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+	"github.com/rs/zerolog"
+)
+
+// viewerConfig configures the synthetic viewers
+type viewerConfig struct {
+	URL     string // Signaling endpoint
+	WHEP    bool   // URL takes a WHEP application/sdp offer rather than JSON
+	Token   string // Bearer token, if signaling requires one
+	Timeout time.Duration
+
+	// Churn is the mean session length; sessions end at exponentially
+	// distributed times and the viewer rejoins after Rejoin. 0 keeps every
+	// viewer for the whole run.
+	Churn  time.Duration
+	Rejoin time.Duration
+}
+
+// errSessionOver ends a session that reached its churn lifetime
+var errSessionOver = errors.New("session lifetime over")
+
+// viewer is one synthetic WebRTC viewer, joining and leaving as configured
+type viewer struct {
+	id     int
+	cfg    viewerConfig
+	api    *webrtc.API
+	client *http.Client
+	stats  *collector
+	logger zerolog.Logger
+}
+
+// run joins, and rejoins after every session, until ctx is done
+func (v *viewer) run(ctx context.Context) {
+	for {
+		err := v.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if !errors.Is(err, errSessionOver) {
+			v.logger.Debug().Err(err).Msg("Viewer session ended")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(v.cfg.Rejoin):
+		}
+	}
+}
+
+// session negotiates, receives until the connection fails, ctx is done or
+// the session's lifetime ends, and records how it went
+func (v *viewer) session(ctx context.Context) error {
+	if v.cfg.Churn > 0 {
+		lifetime := time.Duration(rand.ExpFloat64() * float64(v.cfg.Churn))
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, lifetime, errSessionOver)
+		defer cancel()
+	}
+
+	began := time.Now()
+	pc, track, teardown, err := v.join(ctx)
+	if err != nil {
+		if context.Cause(ctx) != errSessionOver {
+			v.stats.joinFailed()
+		}
+		return err
+	}
+	defer pc.Close()
+	defer teardown()
+
+	err = v.receive(ctx, pc, track, began)
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+// join negotiates a session and waits for the video track
+func (v *viewer) join(ctx context.Context) (*webrtc.PeerConnection, *webrtc.TrackRemote, func(), error) {
+	pc, err := v.api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fail := func(err error) (*webrtc.PeerConnection, *webrtc.TrackRemote, func(), error) {
+		pc.Close()
+		return nil, nil, nil, err
+	}
+
+	tracks := make(chan *webrtc.TrackRemote, 1)
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeVideo {
+			// Drain audio so it does not back up
+			go func() {
+				for {
+					if _, _, err := track.ReadRTP(); err != nil {
+						return
+					}
+				}
+			}()
+			return
+		}
+		select {
+		case tracks <- track:
+		default:
+		}
+	})
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if _, err := pc.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+			return fail(err)
+		}
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return fail(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return fail(err)
+	}
+	select {
+	case <-gathered:
+	case <-time.After(v.cfg.Timeout):
+		return fail(errors.New("ICE gathering timed out"))
+	case <-ctx.Done():
+		return fail(context.Cause(ctx))
+	}
+
+	answer, resource, err := v.signal(ctx, pc.LocalDescription().SDP)
+	if err != nil {
+		return fail(err)
+	}
+	teardown := func() {
+		if resource != "" {
+			v.teardown(resource)
+		}
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		teardown()
+		return fail(err)
+	}
+
+	select {
+	case track := <-tracks:
+		if mime := track.Codec().MimeType; !strings.EqualFold(mime, webrtc.MimeTypeH264) {
+			teardown()
+			return fail(fmt.Errorf("unsupported codec %s", mime))
+		}
+		return pc, track, teardown, nil
+	case <-time.After(v.cfg.Timeout):
+		teardown()
+		return fail(errors.New("no video track received"))
+	case <-ctx.Done():
+		teardown()
+		return fail(context.Cause(ctx))
+	}
+}
+
+// signal sends the offer and returns the answer and, for WHEP, the session
+// resource URL
+func (v *viewer) signal(ctx context.Context, offer string) (answer, resource string, err error) {
+	body, contentType := []byte(offer), "application/sdp"
+	if !v.cfg.WHEP {
+		body, _ = json.Marshal(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+		contentType = "application/json"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if v.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+v.cfg.Token)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	reply, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("signaling returned %s: %s", resp.Status, bytes.TrimSpace(reply))
+	}
+
+	if v.cfg.WHEP {
+		if loc := resp.Header.Get("Location"); loc != "" {
+			if u, err := resp.Request.URL.Parse(loc); err == nil {
+				resource = u.String()
+			}
+		}
+		return string(reply), resource, nil
+	}
+	var desc webrtc.SessionDescription
+	if err := json.Unmarshal(reply, &desc); err != nil {
+		return "", "", fmt.Errorf("invalid answer: %w", err)
+	}
+	return desc.SDP, "", nil
+}
+
+// teardown deletes a WHEP session resource
+func (v *viewer) teardown(resource string) {
+	ctx, cancel := context.WithTimeout(context.Background(), v.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, resource, nil)
+	if err != nil {
+		return
+	}
+	if v.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+v.cfg.Token)
+	}
+	if resp, err := v.client.Do(req); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// receive reads frames until the connection fails or ctx is done, counting
+// latency and sequence gaps. A viewer that never gets a frame counts as a
+// failed join.
+func (v *viewer) receive(ctx context.Context, pc *webrtc.PeerConnection, track *webrtc.TrackRemote, began time.Time) error {
+	// Unblock reads when the session ends or the connection fails
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stop()
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateDisconnected {
+			pc.Close()
+		}
+	})
+
+	builder := samplebuilder.New(512, &codecs.H264Packet{}, track.Codec().ClockRate)
+	receiving := false
+	var last uint64
+	var lastPLI time.Time
+	defer func() {
+		if receiving {
+			v.stats.left(ctx.Err() == nil)
+		} else if ctx.Err() == nil {
+			v.stats.joinFailed()
+		}
+	}()
+
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return err
+		}
+		builder.Push(pkt)
+
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			// Ask for a keyframe when NACKs did not recover a loss, as a
+			// browser would
+			if sample.PrevDroppedPackets > 0 && time.Since(lastPLI) > 500*time.Millisecond {
+				lastPLI = time.Now()
+				pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(track.SSRC())}})
+			}
+
+			p, ok := readProbe(sample.Data)
+			if !ok {
+				continue
+			}
+			now := time.Now()
+			if !receiving {
+				receiving = true
+				v.stats.joined(now.Sub(began))
+				v.stats.frame(now.Sub(p.captured), 0)
+			} else if p.seq > last {
+				v.stats.frame(now.Sub(p.captured), p.seq-last-1)
+			} else {
+				// Reordered; already counted missed
+				v.stats.frame(now.Sub(p.captured), 0)
+			}
+			last = p.seq
+		}
+	}
+}
+
+// lossFactory makes interceptors that drop received RTP packets ahead of
+// the NACK generator, so the gateway sees and repairs the loss as it would
+// on a lossy network. Losses come in bursts of Burst packets on average
+// (a Gilbert model), and make up Rate of all packets.
+type lossFactory struct {
+	Rate  float64
+	Burst float64
+	stats *collector
+}
+
+// NewInterceptor implements interceptor.Factory
+func (f *lossFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &lossInterceptor{factory: f}, nil
+}
+
+type lossInterceptor struct {
+	interceptor.NoOp
+	factory *lossFactory
+
+	mu     sync.Mutex
+	losing bool
+}
+
+// BindRemoteStream drops packets read from the stream
+func (l *lossInterceptor) BindRemoteStream(_ *interceptor.StreamInfo, reader interceptor.RTPReader) interceptor.RTPReader {
+	return interceptor.RTPReaderFunc(func(b []byte, a interceptor.Attributes) (int, interceptor.Attributes, error) {
+		for {
+			n, attrs, err := reader.Read(b, a)
+			if err != nil || !l.drop() {
+				return n, attrs, err
+			}
+			l.factory.stats.injected()
+		}
+	})
+}
+
+// drop decides the fate of the next packet
+func (l *lossInterceptor) drop() bool {
+	f := l.factory
+	if f.Rate <= 0 {
+		return false
+	}
+	burst := max(f.Burst, 1)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.losing {
+		l.losing = rand.Float64() >= 1/burst
+	} else {
+		l.losing = rand.Float64() < f.Rate/(burst*(1-f.Rate))
+	}
+	return l.losing
+}
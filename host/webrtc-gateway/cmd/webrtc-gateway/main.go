@@ -3,21 +3,84 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"image"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/pion/interceptor"
 	"github.com/pion/webrtc/v4"
-	"github.com/pion/webrtc/v4/pkg/media"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/access"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/admin"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/auth"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/banlist"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/bitdepth"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/captions"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/cluster"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/commands"
 	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/config"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/director"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/discovery"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/drain"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/encoder"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/events"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/gameinfo"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/gop"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/highlight"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/httpsec"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/icenet"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/invite"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/markers"
 	mediapkg "github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/audio"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/avsync"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/failover"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/pacer"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/pattern"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/rtsp"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/svc"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/v4l2"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/whep"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/multicast"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/ndi"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/negotiation"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/overlay"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/peerid"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/peerstate"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/presence"
+	previewpkg "github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/preview"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/qrcode"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/quality"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/reaper"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/recording"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/replay"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/resources"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/screenshot"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/sessionlog"
 	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/signaling"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/stats"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/storage"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/supervisor"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/systemd"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/timeshift"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/tracing"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/transcode"
 	webrtcpkg "github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/webrtc"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/whip"
 )
 
 func main() {
@@ -33,219 +96,2517 @@ func main() {
 	}
 
 	// Setup logging
-	logger := setupLogging(cfg)
+	logger, closeLog, err := setupLogging(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error setting up logging: %v\n", err)
+		os.Exit(1)
+	}
+	defer closeLog()
 
 	// Log configuration summary
 	logger.Info().
 		Str("listen_addr", cfg.HTTPListenAddr).
 		Str("video_codec", cfg.VideoCodec).
 		Bool("synthetic", cfg.UseSynthetic).
+		Bool("v4l2", cfg.UseV4L2).
 		Int("max_bitrate_kbps", cfg.MaxBitrateKbps).
 		Msg("Configuration loaded")
 
-	// Create WebRTC PeerManager
-	logger.Info().Msg("Creating WebRTC peer manager...")
-	peerConfig := webrtcpkg.PeerConfig{
-		VideoCodec:     cfg.VideoCodec,
-		AudioCodec:     "opus",
-		MaxBitrateKbps: cfg.MaxBitrateKbps,
-		ICEServers:     []webrtc.ICEServer{}, // Empty for local testing
-	}
+	// Sockets handed over by systemd socket activation, by FileDescriptorName=
+	activated, err := systemd.Listeners()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to use socket-activated listeners")
+	}
+
+	// Set up tracing
+	var shutdownTracing func(context.Context) error
+	if cfg.TracingEndpoint != "" {
+		shutdownTracing, err = tracing.Setup(context.Background(), tracing.Config{
+			Endpoint:    cfg.TracingEndpoint,
+			Insecure:    cfg.TracingInsecure,
+			SampleRatio: cfg.TracingSampleRatio,
+			ServiceName: "webrtc-gateway",
+		})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to set up tracing")
+		}
+		logger.Info().
+			Str("endpoint", cfg.TracingEndpoint).
+			Float64("sample_ratio", cfg.TracingSampleRatio).
+			Msg("Tracing enabled")
+	}
+
+	// Create event bus and webhook delivery
+	bus := events.NewBus(logger)
+	webhookSink := createWebhookSink(cfg, bus, logger)
+
+	// ICE ports, NAT addresses and TURN servers, shared by every peer
+	iceTransport := createICETransport(cfg, logger)
+
+	// Create WebRTC PeerManager
+	logger.Info().Msg("Creating WebRTC peer manager...")
+	// With codec detection the track starts as H.264 and follows the stream
+	videoCodec := cfg.VideoCodec
+	if videoCodec == mediapkg.CodecAuto {
+		videoCodec = "h264"
+	}
+	peerConfig := webrtcpkg.PeerConfig{
+		VideoCodec:     videoCodec,
+		AudioCodec:     "opus",
+		MaxBitrateKbps: cfg.MaxBitrateKbps,
+		ICEServers:     iceTransport.ICEServers(), // Empty unless TURN is configured
+	}
+
+	peerManager, err := webrtcpkg.NewPeerManager(peerConfig, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create peer manager")
+	}
+
+	// Apply ICE settings before any peer exists
+	if ss, ok := any(peerManager).(interface{ SetSettingEngine(webrtc.SettingEngine) }); ok {
+		ss.SetSettingEngine(iceTransport.SettingEngine())
+	} else if info := iceTransport.Info(); info.UDPPort != 0 || info.PortMin != 0 || len(info.NAT1To1IPs) > 0 || info.TCPPort != 0 {
+		logger.Warn().Msg("Peer manager does not accept ICE settings; port, NAT and ICE-TCP settings are not applied")
+	}
+	if cfg.ICEIPv6 == icenet.IPv6Prefer {
+		if fs, ok := any(peerManager).(interface{ SetSDPFilter(func(string) string) }); ok {
+			fs.SetSDPFilter(iceTransport.AdjustSDP)
+		} else {
+			logger.Warn().Msg("Peer manager cannot rewrite local descriptions; IPv6 candidates are not preferred")
+		}
+	}
+
+	// Spread keyframes over a few milliseconds instead of bursting them
+	var videoPacer *pacer.Pacer
+	if cfg.PacingFactor > 0 {
+		if is, ok := any(peerManager).(interface{ AddInterceptor(interceptor.Factory) }); ok {
+			videoPacer = pacer.New(pacer.Config{
+				RateKbps: int(float64(cfg.MaxBitrateKbps) * cfg.PacingFactor),
+			}, logger)
+			is.AddInterceptor(videoPacer)
+		} else {
+			logger.Warn().Msg("Peer manager does not accept interceptors; keyframes are not paced")
+		}
+	}
+
+	// Sender reports map audio and video to capture time, for lip sync
+	avClock := avsync.NewClock()
+	var senderReports *avsync.SenderReports
+	if rs, ok := any(peerManager).(interface{ SetSenderReports(interceptor.Factory) }); ok {
+		senderReports = avsync.NewSenderReports(avClock, time.Second, logger)
+		rs.SetSenderReports(senderReports)
+	} else {
+		logger.Warn().Msg("Peer manager cannot replace its sender reports; audio and video are aligned by write time")
+	}
+
+	// Follow each peer through its connection lifecycle for status displays
+	peerStates := createPeerStates(peerManager, bus, logger)
+
+	// Who is watching, for the viewer presence API
+	viewers := createPresence(cfg, logger)
+
+	// Score peer connections; poor peers are limited to lower layers
+	qualityMonitor := quality.NewMonitor(quality.Config{
+		MaxFPS:         float64(cfg.MaxOutputFPS),
+		DegradedMaxFPS: float64(cfg.DegradedMaxOutputFPS),
+	}, logger)
+	qualityMonitor.SetOnChange(func(c quality.Change) {
+		peerStates.SetDegraded(c.PeerID, c.Level == quality.LevelPoor)
+		bus.Publish(events.PeerQuality, map[string]any{
+			"peer_id": c.PeerID,
+			"from":    string(c.From),
+			"level":   string(c.Level),
+			"score":   c.Score,
+		})
+	})
+
+	// Republish a designated viewer's video to the others, when the peer
+	// manager can receive and send a second video track
+	coHost := createCoHost(peerManager, bus, logger)
+
+	// Route viewer data channel commands to the features that own them;
+	// handlers are registered as those features start
+	router := commands.NewRouter(logger)
+	var timeshifter *timeshift.Controller
+
+	// Keyframe interval management, when the source takes encoder commands
+	var gopControl *gop.Controller
+
+	// 8-bit fallback of a 10-bit stream, and whether a viewer decodes 10-bit
+	var bitDepth *bitdepth.Controller
+	var peerHighBitDepth func(peerID string) bool
+
+	// Remote production control for viewers given the director role
+	var directorCtl *director.Director
+
+	// Long recordings, which note the viewers present
+	var recorder *recording.Recorder
+
+	// Moments users mark, which clips and recordings carry as chapters
+	var markerStore *markers.Store
+
+	// Which audio mix each viewer hears, when several are offered
+	var audioMixes *audio.Selector
+
+	// Share load and sessions with other instances in cluster mode
+	var member *cluster.Cluster
+	if cfg.ClusterRedisURL != "" {
+		member, err = cluster.New(cluster.Config{
+			RedisURL:     cfg.ClusterRedisURL,
+			AdvertiseURL: cfg.ClusterAdvertiseURL,
+		}, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to configure cluster")
+		}
+	}
+
+	// Tracks each peer asked for during signaling; peers that did not ask get
+	// everything
+	subscriptions := mediapkg.NewSubscriptions()
+
+	// Invite links minted on the admin API; signaling redeems them before
+	// creating a peer
+	invites := invite.NewStore(invite.Config{
+		BaseURL:  cfg.InviteBaseURL,
+		Required: cfg.InvitesRequired,
+	}, logger)
+
+	// Banned IPs and identities, enforced by signaling middleware and kept
+	// across restarts when a path is configured
+	bans, err := banlist.Open(banlist.Config{Path: cfg.BanListPath}, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to load ban list")
+	}
+
+	// Record each peer's signaling for diagnosing failed connections
+	var sessionLog *sessionlog.Recorder
+	if cfg.SessionLogDir != "" {
+		sessionLog, err = sessionlog.New(sessionlog.Config{
+			Dir:         cfg.SessionLogDir,
+			MaxSessions: cfg.SessionLogMax,
+		}, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to open session log")
+		}
+		logger.Info().Str("dir", cfg.SessionLogDir).Msg("Signaling session recording enabled")
+	}
+
+	// Renegotiate connected sessions over the data channel, so tracks can
+	// be added or removed without viewers reconnecting
+	var negotiator *negotiation.Negotiator
+	if np, ok := any(peerManager).(negotiation.Peers); ok {
+		negotiator = negotiation.New(np, logger)
+		if sessionLog != nil {
+			negotiator.SetOnDescription(func(peerID string, desc webrtc.SessionDescription, local bool) {
+				dir := sessionlog.Remote
+				if local {
+					dir = sessionlog.Local
+				}
+				sessionLog.Record(peerID, sessionlog.Kind(desc.Type.String()), dir, desc.SDP)
+			})
+		}
+		router.Handle(negotiation.MessageType, negotiator.HandleMessage)
+	}
+
+	// Set up peer connection callbacks
+	var peerIDs *peerid.Resolver
+	var idleReaper *reaper.Reaper
+	peerManager.SetOnPeerConnected(func(peerID string) {
+		if peerIDs != nil {
+			peerIDs.Connected(peerID)
+		}
+		if idleReaper != nil {
+			idleReaper.PeerConnected(peerID)
+		}
+		inviteID := invites.InviteFor(peerID)
+		logger.Info().Str("peer_id", peerID).Str("invite_id", inviteID).Msg("Peer connected")
+		bus.Publish(events.PeerJoined, map[string]any{"peer_id": peerID, "invite_id": inviteID})
+		peerStates.PeerConnected(peerID)
+		// The gateway serves one stream; a stream registry would name it
+		viewers.Join(peerID, access.DefaultStream, peerAddress(peerManager, peerID))
+		if sessionLog != nil {
+			sessionLog.Record(peerID, sessionlog.KindPeer, "", "connected")
+		}
+		if coHost != nil {
+			coHost.PeerJoined(peerID)
+		}
+		if gopControl != nil {
+			gopControl.PeerJoined()
+		}
+		if bitDepth != nil {
+			bitDepth.PeerJoined(peerID, peerHighBitDepth(peerID))
+		}
+		if recorder != nil {
+			recorder.PeerJoined(peerID)
+		}
+		if negotiator != nil {
+			if err := negotiator.Attach(peerID); err != nil {
+				logger.Warn().Err(err).Str("peer_id", peerID).Msg("Peer cannot be renegotiated")
+			}
+		}
+		if member != nil {
+			if err := member.ClaimSession(peerID); err != nil {
+				logger.Warn().Err(err).Str("peer_id", peerID).Msg("Failed to record session in cluster")
+			}
+		}
+	})
+	peerManager.SetOnPeerDisconnected(func(peerID string) {
+		logger.Info().Str("peer_id", peerID).Msg("Peer disconnected")
+		peerStates.PeerDisconnected(peerID)
+		viewers.Leave(peerID)
+		if peerIDs != nil {
+			peerIDs.Disconnected(peerID)
+		}
+		if idleReaper != nil {
+			idleReaper.PeerDisconnected(peerID)
+		}
+		qualityMonitor.Remove(peerID)
+		subscriptions.Remove(peerID)
+		invites.Remove(peerID)
+		if sessionLog != nil {
+			sessionLog.Record(peerID, sessionlog.KindPeer, "", "disconnected")
+			sessionLog.End(peerID)
+		}
+		if coHost != nil {
+			coHost.RemovePeer(peerID)
+		}
+		if timeshifter != nil {
+			timeshifter.Remove(peerID)
+		}
+		if directorCtl != nil {
+			directorCtl.RemovePeer(peerID)
+		}
+		if bitDepth != nil {
+			bitDepth.RemovePeer(peerID)
+		}
+		if audioMixes != nil {
+			audioMixes.RemovePeer(peerID)
+		}
+		if recorder != nil {
+			recorder.PeerLeft(peerID)
+		}
+		if markerStore != nil {
+			markerStore.RemovePeer(peerID)
+		}
+		if negotiator != nil {
+			negotiator.RemovePeer(peerID)
+		}
+		if member != nil {
+			if err := member.ReleaseSession(peerID); err != nil {
+				logger.Warn().Err(err).Str("peer_id", peerID).Msg("Failed to release session in cluster")
+			}
+		}
+		bus.Publish(events.PeerLeft, map[string]any{"peer_id": peerID})
+	})
+
+	logger.Info().Msg("Peer manager created")
+
+	// Burn overlays into video the gateway encodes itself
+	drawOverlay := createOverlay(cfg, peerManager, logger)
+
+	// Time each pipeline stage against the frame interval, to find what
+	// makes the stream stutter
+	var budget *mediapkg.FrameBudget
+	if cfg.FrameBudget {
+		budget = mediapkg.NewFrameBudget(mediapkg.FrameBudgetConfig{
+			Budget: time.Duration(cfg.FrameBudgetMs) * time.Millisecond,
+		}, logger)
+	}
+
+	// Create video source: a failover chain, direct V4L2 capture, or the
+	// pipeline (IPC/synthetic)
+	var (
+		source mediapkg.FrameSource
+		chain  *failover.Source
+	)
+	switch {
+	case len(cfg.Sources) > 0:
+		chain = createFailoverSource(cfg, drawOverlay, budget, logger)
+		chain.SetOnSwitch(func(e failover.SwitchEvent) {
+			bus.Publish(events.SourceSwitched, map[string]any{
+				"from":   e.From,
+				"to":     e.To,
+				"reason": e.Reason,
+			})
+		})
+		source = chain
+	case cfg.UseV4L2:
+		source = createV4L2Source(cfg, drawOverlay, budget, logger)
+	case cfg.UseSynthetic && cfg.SyntheticPatternName != "":
+		source = createPatternSource(cfg, drawOverlay, budget, logger)
+	case cfg.IPCReplayFile != "":
+		source = createReplaySource(cfg, logger)
+	default:
+		source = createPipeline(cfg, logger)
+	}
+	if cs, ok := any(source).(interface{ SetOnConnectionChange(func(bool)) }); ok {
+		cs.SetOnConnectionChange(func(connected bool) {
+			if connected {
+				bus.Publish(events.IPCConnected, nil)
+			} else {
+				bus.Publish(events.IPCDisconnected, nil)
+			}
+		})
+	}
+
+	// Create HTTP Signaling Server
+	logger.Info().Msg("Creating signaling server...")
+	serverConfig := signaling.ServerConfig{
+		ListenAddr:     cfg.HTTPListenAddr,
+		AllowedOrigins: cfg.AllowedOrigins,
+		ReadTimeout:    30 * time.Second,
+		WriteTimeout:   30 * time.Second,
+	}
+	httpServer := signaling.NewServer(serverConfig, peerManager, logger)
+	if member != nil {
+		if cs, ok := any(httpServer).(interface{ SetCluster(*cluster.Cluster) }); ok {
+			cs.SetCluster(member)
+		} else {
+			logger.Warn().Msg("Signaling server cannot route viewers between instances; cluster membership is advisory")
+		}
+	}
+	if ss, ok := any(httpServer).(interface {
+		SetSubscriptions(*mediapkg.Subscriptions)
+	}); ok {
+		ss.SetSubscriptions(subscriptions)
+	}
+	if is, ok := any(httpServer).(interface{ SetInvites(*invite.Store) }); ok {
+		is.SetInvites(invites)
+	} else if cfg.InvitesRequired {
+		logger.Fatal().Msg("Signaling server cannot check invites; unset GATEWAY_INVITES_REQUIRED")
+	}
+	// A reconnecting viewer may ask for its previous peer ID back; the
+	// policy decides what becomes of the session still holding it
+	if pp, ok := any(peerManager).(peerid.Peers); ok {
+		policy, err := peerid.ParsePolicy(cfg.DuplicatePeerPolicy)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Invalid duplicate peer policy")
+		}
+		peerIDs = peerid.New(policy, pp, logger)
+		if rs, ok := any(httpServer).(interface{ SetPeerIDResolver(*peerid.Resolver) }); ok {
+			rs.SetPeerIDResolver(peerIDs)
+		} else {
+			logger.Warn().Msg("Signaling server always assigns fresh peer IDs; GATEWAY_DUPLICATE_PEER_POLICY has no effect")
+		}
+	}
+	if negotiator != nil {
+		// Viewers whose data channel is not open yet renegotiate over signaling
+		if ns, ok := any(httpServer).(interface{ SetNegotiator(*negotiation.Negotiator) }); ok {
+			ns.SetNegotiator(negotiator)
+		}
+	}
+	if servers := iceTransport.ICEServers(); len(servers) > 0 {
+		// Viewers behind UDP-blocking firewalls need the relay too
+		if is, ok := any(httpServer).(interface{ SetICEServers([]webrtc.ICEServer) }); ok {
+			is.SetICEServers(servers)
+		}
+	}
+	if sessionLog != nil {
+		// The peer manager sees state transitions and local candidates, the
+		// signaling server the remote descriptions; either may record
+		recording := false
+		for _, target := range []any{peerManager, httpServer} {
+			if rs, ok := target.(interface {
+				SetSessionRecorder(*sessionlog.Recorder)
+			}); ok {
+				rs.SetSessionRecorder(sessionLog)
+				recording = true
+			}
+		}
+		if !recording {
+			logger.Warn().Msg("Neither signaling nor the peer manager record sessions; only peer lifecycle is recorded")
+		}
+	}
+	// Signaling serves HTTPS with its own certificate, independent of admin
+	if cfg.HTTPTLS() {
+		tlsConfig, err := loadTLSConfig(cfg.HTTPTLSCertFile, cfg.HTTPTLSKeyFile)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to load signaling TLS certificate")
+		}
+		if ts, ok := any(httpServer).(interface{ SetTLSConfig(*tls.Config) }); ok {
+			ts.SetTLSConfig(tlsConfig)
+		} else {
+			logger.Fatal().Msg("Signaling server cannot serve HTTPS; unset GATEWAY_HTTP_TLS_CERT")
+		}
+	}
+	// Require viewers to sign in when an OIDC provider is configured
+	var authenticator *auth.Authenticator
+	if cfg.OIDCIssuer != "" {
+		authenticator, err = auth.New(auth.Config{
+			Issuer:        cfg.OIDCIssuer,
+			ClientID:      cfg.OIDCClientID,
+			ClientSecret:  cfg.OIDCClientSecret,
+			RedirectURL:   cfg.OIDCRedirectURL,
+			AllowedUsers:  cfg.OIDCAllowedUsers,
+			AllowAnyUser:  cfg.OIDCAllowAnyUser,
+			Controllers:   cfg.OIDCControllers,
+			SessionSecret: []byte(cfg.SessionSecret),
+		}, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to configure viewer sign-in")
+		}
+		if as, ok := any(httpServer).(interface{ SetAuthenticator(*auth.Authenticator) }); ok {
+			as.SetAuthenticator(authenticator)
+		} else {
+			logger.Fatal().Msg("Signaling server does not support viewer sign-in; unset GATEWAY_OIDC_ISSUER")
+		}
+		logger.Info().Str("issuer", cfg.OIDCIssuer).Msg("Viewer sign-in enabled")
+	}
+
+	// Per-stream passwords, tokens and user allowlists on signaling
+	streamAccess, err := access.New(access.Config{
+		Policies: streamPolicies(cfg),
+		Streams:  []string{access.DefaultStream}, // Every viewer joins the one stream
+		Paths:    []string{"/webrtc/", "/whep"},
+	}, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Invalid stream access policy")
+	}
+
+	// Request logging for both servers; installed even when disabled so the
+	// admin API can switch it on
+	accessLog, err := logging.NewAccessLog(logging.AccessConfig{
+		AccessSettings: logging.AccessSettings{
+			Enabled:    cfg.AccessLog,
+			SampleRate: cfg.AccessLogSampleRate,
+			SlowMs:     cfg.AccessLogSlowMs,
+		},
+		QuietPaths: []string{"/webrtc/health"},
+	}, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Invalid access log settings")
+	}
+
+	// Banned viewers are turned away before the security headers, so they
+	// see nothing of the portal. Access checks run after them, so browsers
+	// can read the reason a stream refused them. The access log sees every
+	// request, refused or not, and every request, offers and answers
+	// included, gets a server span in a new trace linked to the client's.
+	if ms, ok := any(httpServer).(interface {
+		SetMiddleware(func(http.Handler) http.Handler)
+	}); ok {
+		secure := securityMiddleware(cfg)
+		identify := viewerIdentities(authenticator)
+		ms.SetMiddleware(func(next http.Handler) http.Handler {
+			return tracing.PublicMiddleware("signaling",
+				accessLog.Middleware("signaling", bans.Middleware(identify, secure(streamAccess.Middleware(identify, next)))))
+		})
+	} else if needs := middlewareSettings(cfg); len(needs) > 0 {
+		// Without the middleware these would silently not apply, letting in
+		// banned viewers and refused origins
+		logger.Fatal().Strs("settings", needs).Msg("Signaling server does not accept HTTP middleware; unset the settings that need it")
+	} else {
+		logger.Warn().Msg("Signaling server does not accept HTTP middleware; default CORS and security headers and request tracing are not applied")
+	}
+
+	// Create main context for graceful shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Start webhook delivery before anything can publish
+	if webhookSink != nil {
+		if err := webhookSink.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start webhook sink")
+		}
+	}
+
+	// Start video source
+	logger.Info().Msg("Starting video source...")
+	if err := source.Start(ctx); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to start video source")
+	}
+	logger.Info().Msg("Video source started")
+
+	// Launch the capture service now that its socket is listening
+	var capture *supervisor.Supervisor
+	if len(cfg.CaptureCommand) > 0 {
+		capture = createSupervisor(cfg, bus, logger)
+		if err := capture.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start capture service")
+		}
+	}
+
+	// Start video distribution
+	latency := mediapkg.NewLatencyTracker(0)
+	inspector := createStreamInspector(cfg, logger)
+
+	// Negotiate the stream's real codec parameters; a 10-bit VP9 stream is
+	// profile 2 and must not be offered as profile 0
+	if vf, ok := any(peerManager).(interface{ SetVideoFmtp(string) }); ok {
+		inspector.SetOnChange(func(p bitstream.Params) { vf.SetVideoFmtp(p.Fmtp) })
+	} else if cfg.VideoCodec == "vp9" {
+		logger.Warn().Msg("Peer manager cannot update the video fmtp; VP9 is offered as profile 0")
+	}
+
+	// Send the declared color space in the color space header extension, so
+	// capable viewers show HDR and wide-gamut captures as mastered
+	cs, canSignal := any(peerManager).(interface{ SetVideoColorSpace(ext []byte) })
+	inspector.SetOnColorChange(func(c *mediapkg.ColorSpace, hdr *mediapkg.HDRMetadata) {
+		if canSignal {
+			cs.SetVideoColorSpace(mediapkg.ColorSpaceExtension(c, hdr))
+		} else if c.IsHDR() {
+			logger.Warn().Str("transfer", c.Transfer).Msg("Peer manager cannot signal the color space; HDR looks washed out in viewers")
+		}
+	})
+
+	// Send the display rotation in the video orientation header extension,
+	// so portrait and handheld captures are shown upright
+	vo, canRotate := any(peerManager).(interface{ SetVideoRotation(rotation int) })
+	inspector.SetOnRotationChange(func(rotation int) {
+		if canRotate {
+			vo.SetVideoRotation(rotation)
+		} else if rotation != 0 {
+			logger.Warn().Int("rotation", rotation).Msg("Peer manager cannot signal the video orientation; viewers see the picture sideways")
+		}
+	})
+	// Watch disk space, memory and CPU so the gateway degrades rather than
+	// failing when the host runs short
+	var resourceMonitor *resources.Monitor
+	if cfg.ResourceCheckSec > 0 {
+		diskPaths := []string{cfg.RecordingDir, cfg.ReplaySpoolDir}
+		if cfg.ReplaySeconds > 0 {
+			diskPaths = append(diskPaths, cfg.ClipDir)
+		}
+		resourceMonitor = resources.New(resources.Config{
+			Interval:              time.Duration(cfg.ResourceCheckSec) * time.Second,
+			DiskPaths:             diskPaths,
+			DiskWarnBytes:         uint64(cfg.DiskWarnMB) << 20,
+			DiskCriticalBytes:     uint64(cfg.DiskCriticalMB) << 20,
+			MemoryWarnPercent:     float64(cfg.MemoryWarnPercent),
+			MemoryCriticalPercent: float64(cfg.MemoryCriticalPercent),
+			CPUWarnPercent:        float64(cfg.CPUWarnPercent),
+			CPUCriticalPercent:    float64(cfg.CPUCriticalPercent),
+		}, logger)
+	}
+
+	codecs := createCodecDetector(cfg, videoCodec, peerManager, logger)
+	distributor := createDistributor(cfg, source, peerManager, latency, avClock, qualityMonitor, resourceMonitor, budget, inspector, subscriptions, codecs, logger)
+	distributor.AddTap(codecs.Observe)
+
+	// Publish to a CDN over WHIP alongside the local viewers
+	var whipEgress *whip.Egress
+	if cfg.WHIPURL != "" {
+		requester, _ := source.(mediapkg.KeyframeRequester)
+		at, hasAudio := any(peerManager).(interface {
+			AddAudioTap(fn func(data []byte, duration time.Duration))
+		})
+		whipEgress = whip.New(whip.Config{
+			URL:        cfg.WHIPURL,
+			Token:      cfg.WHIPToken,
+			ICEServers: iceTransport.ICEServers(),
+			Audio:      hasAudio,
+		}, requester, logger)
+		if hasAudio {
+			at.AddAudioTap(whipEgress.WriteAudio)
+		} else {
+			logger.Warn().Msg("Peer manager does not expose encoded audio; WHIP egress carries video only")
+		}
+		distributor.AddTap(whipEgress.Observe)
+		if err := whipEgress.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start WHIP egress")
+		}
+	}
+
+	// Offer the stream to production tools on the LAN as an NDI source
+	var ndiSender *ndi.Sender
+	if cfg.NDIName != "" {
+		requester, _ := source.(mediapkg.KeyframeRequester)
+		ndiSender, err = ndi.New(ndi.Config{
+			Name:   cfg.NDIName,
+			Groups: cfg.NDIGroups,
+		}, requester, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create NDI source")
+		}
+		distributor.AddTap(ndiSender.Observe)
+		if err := ndiSender.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start NDI source")
+		}
+	}
+
+	// Send the stream to set-top boxes and players on the LAN as multicast
+	// MPEG-TS, needing no signaling
+	var multicastSender *multicast.Sender
+	if cfg.MulticastAddr != "" {
+		requester, _ := source.(mediapkg.KeyframeRequester)
+		at, hasAudio := any(peerManager).(interface {
+			AddAudioTap(fn func(data []byte, duration time.Duration))
+		})
+		multicastSender, err = multicast.New(multicast.Config{
+			Addr:      cfg.MulticastAddr,
+			Interface: cfg.MulticastInterface,
+			TTL:       cfg.MulticastTTL,
+			RawUDP:    cfg.MulticastFormat == "udp",
+			Audio:     hasAudio,
+		}, requester, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create multicast output")
+		}
+		if hasAudio {
+			at.AddAudioTap(multicastSender.WriteAudio)
+		} else {
+			logger.Warn().Msg("Peer manager does not expose encoded audio; multicast carries video only")
+		}
+		distributor.AddTap(multicastSender.Observe)
+		if err := multicastSender.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start multicast output")
+		}
+	}
+
+	// Produce renditions in external worker processes, so heavy encoding
+	// never competes with the gateway for its own threads
+	var renditions []*transcode.Rendition
+	if len(cfg.TranscodeRenditions) > 0 {
+		requester, _ := source.(mediapkg.KeyframeRequester)
+		configs, err := transcode.ParseRenditions(cfg.TranscodeRenditions)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Invalid transcode renditions")
+		}
+		for _, rc := range configs {
+			rc.Command = cfg.TranscodeCommand
+			r, err := transcode.New(rc, requester, logger)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("Failed to create rendition")
+			}
+			distributor.AddTap(r.Observe)
+			if err := r.Start(ctx); err != nil {
+				logger.Fatal().Err(err).Str("rendition", rc.Name).Msg("Failed to start transcode worker")
+			}
+			renditions = append(renditions, r)
+		}
+	}
+
+	// Keep the last moments of the stream for clips
+	var replayBuffer *replay.Buffer
+	if cfg.ReplaySeconds > 0 {
+		replayBuffer, err = replay.NewBuffer(replay.Config{
+			Dir:      cfg.ClipDir,
+			Window:   time.Duration(cfg.ReplaySeconds) * time.Second,
+			MaxBytes: int64(cfg.ReplayMaxMB) << 20,
+			SpoolDir: cfg.ReplaySpoolDir,
+		}, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create replay buffer")
+		}
+		distributor.AddTap(replayBuffer.Observe)
+		logger.Info().Int("seconds", cfg.ReplaySeconds).Str("dir", cfg.ClipDir).Msg("Replay buffer enabled")
+	}
+
+	// Record the stream to disk on request or on a schedule
+	if cfg.RecordingDir != "" {
+		requester, _ := source.(mediapkg.KeyframeRequester)
+		recorder, err = recording.New(recording.Config{
+			Dir:             cfg.RecordingDir,
+			SegmentDuration: time.Duration(cfg.RecordingSegmentSec) * time.Second,
+			MaxBytes:        int64(cfg.RecordingMaxDiskMB) << 20,
+		}, requester, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create recorder")
+		}
+		recorder.SetOnEvent(func(rec recording.Recording) {
+			data := map[string]any{"recording_id": rec.ID, "name": rec.Name, "schedule_id": rec.ScheduleID}
+			if rec.Active {
+				bus.Publish(events.RecordingStarted, data)
+				return
+			}
+			data["reason"] = rec.StopReason
+			data["duration_sec"] = rec.DurationSec
+			data["bytes"] = rec.Bytes
+			bus.Publish(events.RecordingStopped, data)
+		})
+		distributor.AddTap(recorder.Observe)
+		recorder.Start(ctx)
+		logger.Info().Str("dir", cfg.RecordingDir).Int("max_disk_mb", cfg.RecordingMaxDiskMB).Msg("Recording enabled")
+	}
+
+	// Report resources running short, and stop recording before its disk
+	// fills rather than losing segments to write errors. Directories exist
+	// by now, so the first check can measure them.
+	if resourceMonitor != nil {
+		if recorder != nil {
+			recorder.SetAdmission(func() error { return resourceMonitor.CheckDisk(cfg.RecordingDir) })
+		}
+		resourceMonitor.SetOnChange(func(c resources.Change) {
+			data := map[string]any{
+				"resource":     string(c.Kind),
+				"level":        string(c.Level),
+				"from":         string(c.From),
+				"used_percent": c.UsedPercent,
+			}
+			if c.Kind == resources.KindDisk {
+				data["path"] = c.Path
+				data["free_mb"] = c.FreeBytes >> 20
+			}
+			if c.Level == resources.LevelOK {
+				bus.Publish(events.ResourceRecovered, data)
+			} else {
+				bus.Publish(events.ResourceLow, data)
+			}
+
+			if recorder != nil && c.Kind == resources.KindDisk && c.Level == resources.LevelCritical &&
+				resourceMonitor.Level(resources.KindDisk, cfg.RecordingDir) == resources.LevelCritical {
+				if rec, err := recorder.StopActive(recording.StopLowDisk); err == nil {
+					logger.Warn().Str("recording_id", rec.ID).Uint64("free_mb", c.FreeBytes>>20).Msg("Stopped recording: disk space is critically low")
+				}
+			}
+		})
+		resourceMonitor.Start(ctx)
+		logger.Info().Int("interval_sec", cfg.ResourceCheckSec).Str("level", string(resourceMonitor.Status().Level)).Msg("Resource monitor started")
+	}
+
+	// Let users mark moments to find again in clips and recordings
+	if replayBuffer != nil || recorder != nil {
+		markerStore = markers.New(markers.Config{}, logger)
+		markerStore.SetOnAdd(func(m markers.Marker) {
+			bus.Publish(events.MarkerAdded, map[string]any{"marker_id": m.ID, "label": m.Label, "peer_id": m.PeerID})
+		})
+		distributor.AddTap(markerStore.Observe)
+		if replayBuffer != nil {
+			replayBuffer.SetChapters(markerStore)
+		}
+		if recorder != nil {
+			recorder.SetChapters(markerStore)
+		}
+		if cfg.ViewerMarkers {
+			router.Handle(markers.MessageType, markerStore.HandleMessage)
+		}
+	}
+
+	// Clip highlights on their own, marking each moment in the clip
+	var highlights *highlight.Detector
+	if len(cfg.HighlightAnalyzers) > 0 {
+		highlights = highlight.New(highlight.Config{
+			PreRoll:  time.Duration(cfg.HighlightPreSec) * time.Second,
+			PostRoll: time.Duration(cfg.HighlightPostSec) * time.Second,
+			Cooldown: time.Duration(cfg.HighlightCooldownSec) * time.Second,
+		}, replayBuffer, logger)
+		for _, name := range cfg.HighlightAnalyzers {
+			switch name {
+			case "audio":
+				highlights.Add(highlight.NewAudioSpike(highlight.AudioSpikeConfig{}))
+			case "scene":
+				highlights.Add(highlight.NewSceneChange(highlight.SceneChangeConfig{}))
+			}
+		}
+		if markerStore != nil {
+			highlights.SetOnTrigger(func(t highlight.Trigger) {
+				if _, err := markerStore.Add(t.Reason, ""); err != nil {
+					logger.Debug().Err(err).Msg("Failed to mark highlight")
+				}
+			})
+		}
+		highlights.SetOnHighlight(func(h highlight.Highlight) {
+			if h.ClipID == "" {
+				return
+			}
+			reasons := make([]string, len(h.Triggers))
+			for i, t := range h.Triggers {
+				reasons[i] = t.Reason
+			}
+			bus.Publish(events.HighlightClipped, map[string]any{"highlight_id": h.ID, "clip_id": h.ClipID, "reasons": reasons})
+		})
+		distributor.AddTap(highlights.ObserveVideo)
+		logger.Info().Strs("analyzers", cfg.HighlightAnalyzers).Msg("Highlight detection enabled")
+	}
+
+	// Upload clips and finished recording files to object storage
+	var uploader *storage.Uploader
+	if cfg.UploadBucket != "" {
+		backend, err := storage.NewS3(storage.S3Config{
+			Endpoint:        cfg.UploadEndpoint,
+			Region:          cfg.UploadRegion,
+			Bucket:          cfg.UploadBucket,
+			AccessKeyID:     cfg.UploadAccessKeyID,
+			SecretAccessKey: cfg.UploadSecretAccessKey,
+			SessionToken:    cfg.UploadSessionToken,
+			PathStyle:       cfg.UploadPathStyle,
+		})
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to configure upload storage")
+		}
+		uploader, err = storage.New(storage.Config{
+			Backend:     backend,
+			Prefix:      cfg.UploadPrefix,
+			StatePath:   cfg.UploadStatePath,
+			ExpireAfter: time.Duration(cfg.UploadExpireDays) * 24 * time.Hour,
+		}, logger)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to create uploader")
+		}
+		if replayBuffer != nil {
+			replayBuffer.SetOnSave(func(clip replay.Clip, path string) {
+				uploader.Upload("clips/"+clip.ID+".mp4", path, "video/mp4")
+			})
+		}
+		if recorder != nil {
+			recorder.SetOnFile(func(id, file, path string) {
+				contentType := "video/mp4"
+				if strings.HasSuffix(file, ".json") {
+					contentType = "application/json"
+				}
+				uploader.Upload("recordings/"+id+"/"+file, path, contentType)
+			})
+		}
+		uploader.Start(ctx)
+		logger.Info().Str("bucket", cfg.UploadBucket).Str("prefix", cfg.UploadPrefix).Msg("Uploads enabled")
+	}
+
+	// Save what a crashed run left in the replay spool, now that saved
+	// clips reach the uploader
+	if replayBuffer != nil && cfg.ReplaySpoolDir != "" {
+		go func() {
+			clip, err := replayBuffer.Recover()
+			switch {
+			case err == nil:
+				logger.Warn().Str("clip_id", clip.ID).Msg("Recovered the replay buffer of a previous run that did not exit cleanly")
+			case !errors.Is(err, replay.ErrEmpty):
+				logger.Error().Err(err).Msg("Failed to recover replay spool")
+			}
+		}()
+	}
+
+	// Push the keyframe interval to the capture service, shortening it
+	// while many viewers join
+	if ec, ok := source.(mediapkg.EncoderController); ok {
+		gopControl = gop.New(gop.Config{
+			Interval:      time.Duration(cfg.KeyframeIntervalMs) * time.Millisecond,
+			BurstPeers:    cfg.JoinBurstPeers,
+			BurstInterval: time.Duration(cfg.JoinBurstGOPMs) * time.Millisecond,
+		}, ec, logger)
+		distributor.AddTap(gopControl.Observe)
+		if err := gopControl.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start keyframe interval control")
+		}
+	} else if cfg.KeyframeIntervalMs > 0 {
+		logger.Warn().Msg("Source does not take encoder commands; GATEWAY_KEYFRAME_INTERVAL_MS is ignored")
+	}
+
+	// Ask the capture service for 8-bit while a viewer cannot decode 10-bit
+	if cfg.HighBitDepth {
+		ec, canCommand := source.(mediapkg.EncoderController)
+		pf, canRead := any(peerManager).(interface{ RemoteVideoFmtps(peerID string) []string })
+		switch {
+		case !canCommand:
+			logger.Warn().Msg("Source does not take encoder commands; 8-bit viewers of a 10-bit stream see nothing")
+		case !canRead:
+			logger.Warn().Msg("Peer manager cannot report viewers' video fmtp; 8-bit viewers of a 10-bit stream see nothing")
+		default:
+			peerHighBitDepth = func(peerID string) bool {
+				return bitdepth.Supports(codecs.Codec(), pf.RemoteVideoFmtps(peerID))
+			}
+			bitDepth = bitdepth.New(bitdepth.Config{}, ec, logger)
+			distributor.AddTap(bitDepth.Observe)
+			if err := bitDepth.Start(ctx); err != nil {
+				logger.Fatal().Err(err).Msg("Failed to start bit depth control")
+			}
+		}
+	}
+
+	// Let viewers pause and rewind within the replay buffer
+	if cfg.Timeshift {
+		pw, ok := any(peerManager).(timeshift.PeerWriter)
+		if !ok {
+			logger.Fatal().Msg("Peer manager cannot write to viewers individually; unset GATEWAY_TIMESHIFT")
+		}
+		timeshifter = timeshift.New(replayBuffer, distributor, pw, logger)
+		router.Handle(timeshift.MessageType, timeshifter.HandleMessage)
+		logger.Info().Int("seconds", cfg.ReplaySeconds).Msg("Timeshift enabled")
+	}
+	// Relay the running game and its counters for viewer overlays
+	var gameInfo *gameinfo.Tracker
+	if gs, ok := source.(interface {
+		GameInfo() <-chan mediapkg.GameInfo
+	}); ok {
+		broadcaster, _ := any(peerManager).(gameinfo.Broadcaster)
+		gameInfo = gameinfo.New(gameinfo.Config{}, gs.GameInfo(), broadcaster, logger)
+		gameInfo.SetOnChange(func(from, to mediapkg.GameInfo) {
+			bus.Publish(events.GameChanged, map[string]any{"game": to.Game, "scene": to.Scene, "previous_game": from.Game})
+			if recorder != nil {
+				recorder.SetGame(to.Game)
+			}
+		})
+		router.Handle(gameinfo.MessageType, gameInfo.HandleMessage)
+		if err := gameInfo.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start game info tracker")
+		}
+	}
+	// Let directors switch scenes and sources over their data channel
+	if ec, ok := source.(mediapkg.EncoderController); ok {
+		directorCtl = director.New(director.Config{Token: cfg.DirectorToken}, ec, logger)
+		directorCtl.SetOnCommand(func(peerID string, cmd mediapkg.ControlCommand) {
+			data := map[string]any{"peer_id": peerID, "action": string(cmd.Action)}
+			switch {
+			case cmd.Scene != "":
+				data["scene"] = cmd.Scene
+			case cmd.Source != "":
+				data["source"] = cmd.Source
+			case cmd.PiP != nil:
+				data["pip"] = *cmd.PiP
+			}
+			bus.Publish(events.DirectorCommand, data)
+		})
+		router.Handle(director.MessageType, directorCtl.HandleMessage)
+	} else if cfg.DirectorToken != "" {
+		logger.Warn().Msg("Source does not take encoder commands; GATEWAY_DIRECTOR_TOKEN has no effect")
+	}
+	if dm, ok := any(peerManager).(interface {
+		SetOnDataChannelMessage(func(peerID string, data []byte) []byte)
+	}); ok {
+		dm.SetOnDataChannelMessage(router.Dispatch)
+	} else if len(router.Stats().Types) > 0 {
+		logger.Warn().Strs("types", router.Stats().Types).Msg("Peer manager does not deliver data channel messages; viewer commands are unavailable")
+	}
+
+	// Keep the latest keyframe for /api/screenshot
+	var screenshots *screenshot.Service
+	if cfg.AdminListenAddr != "" {
+		requester, _ := source.(mediapkg.KeyframeRequester)
+		screenshots = screenshot.New(screenshot.Config{Decoder: cfg.ScreenshotDecoder}, requester, logger)
+		distributor.AddTap(screenshots.Observe)
+	}
+
+	// Render the low frame rate preview for dashboards
+	var preview *previewpkg.Service
+	if cfg.AdminListenAddr != "" && cfg.PreviewFPS > 0 {
+		preview = previewpkg.New(previewpkg.Config{
+			FPS:     cfg.PreviewFPS,
+			Width:   cfg.PreviewWidth,
+			Decoder: cfg.ScreenshotDecoder,
+		}, logger)
+		distributor.AddTap(preview.Observe)
+	}
+	distributor.SetOnEvent(func(e mediapkg.DistributorEvent) {
+		switch e {
+		case mediapkg.DistributorLive:
+			bus.Publish(events.StreamStarted, nil)
+		case mediapkg.DistributorOffline:
+			bus.Publish(events.StreamStopped, map[string]any{"reason": "source_offline"})
+		case mediapkg.DistributorPaused:
+			bus.Publish(events.StreamPaused, nil)
+		case mediapkg.DistributorResumed:
+			bus.Publish(events.StreamResumed, nil)
+		}
+	})
+	if err := distributor.Start(ctx); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to start video distribution")
+	}
+
+	// Route audio from sources that carry it: stereo for peers, source
+	// channels for outputs that keep surround
+	var audioRouter *audio.Router
+	var audioMixer *audio.Mixer
+	if as, ok := source.(interface {
+		AudioFrames() <-chan mediapkg.AudioFrame
+	}); ok {
+		frames := as.AudioFrames()
+		if len(cfg.AudioSources) > 0 {
+			// Mix tagged inputs such as game audio and a microphone first
+			audioMixer = createAudioMixer(cfg, frames, logger)
+			if err := audioMixer.Start(ctx); err != nil {
+				logger.Fatal().Err(err).Msg("Failed to start audio mixer")
+			}
+			frames = audioMixer.Output()
+			audioMixes = createMixSelector(cfg, audioMixer, peerManager, logger)
+			if audioMixes != nil {
+				router.Handle(audio.MixMessageType, audioMixes.HandleMessage)
+				if ms, ok := any(httpServer).(interface{ SetAudioMixSelector(*audio.Selector) }); ok {
+					ms.SetAudioMixSelector(audioMixes)
+				}
+			}
+		}
+		audioRouter = createAudioRouter(cfg, frames, peerManager, avClock, logger)
+		if highlights != nil {
+			// Judge loudness at the source level, before normalization
+			audioRouter.AddSink(audio.OutputPassthrough, highlights.ObserveAudio)
+		}
+		if ndiSender != nil {
+			// NDI carries surround, so production tools get the source layout
+			audioRouter.AddSink(audio.OutputPassthrough, ndiSender.ObserveAudio)
+		}
+		if err := audioRouter.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start audio router")
+		}
+	}
+
+	// Forward timed text from sources that carry it to viewers' data
+	// channels, keeping recent cues for WebVTT
+	var captionTrack *captions.Track
+	if ts, ok := source.(interface {
+		TextFrames() <-chan mediapkg.TextFrame
+	}); ok {
+		broadcaster, ok := any(peerManager).(captions.Broadcaster)
+		if !ok {
+			logger.Warn().Msg("Peer manager cannot broadcast data channel messages; captions are only served as WebVTT")
+		}
+		captionTrack = captions.New(captions.Config{}, ts.TextFrames(), broadcaster, logger)
+		if err := captionTrack.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start captions")
+		}
+	}
+
+	// Carry viewer microphones back to the host
+	var returnChannel *mediapkg.ReturnChannel
+	if cfg.ReturnSocketPath != "" {
+		returnChannel = createReturnChannel(cfg, peerManager, logger)
+		if err := returnChannel.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start return channel")
+		}
+	}
+
+	// Start the stall watchdog
+	var watchdog *mediapkg.Watchdog
+	if cfg.WatchdogStallMs > 0 {
+		watchdog = createWatchdog(cfg, source, distributor, bus, logger)
+		if err := watchdog.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start watchdog")
+		}
+	}
+
+	// Close viewers whose media path died while ICE and DTLS linger
+	if cfg.PeerIdleTimeoutSec > 0 {
+		idleReaper = createReaper(cfg, peerManager, distributor, logger)
+		if idleReaper != nil {
+			go idleReaper.Run(ctx)
+		}
+	}
+
+	// Start stats history recording
+	var (
+		statsStore    *stats.Store
+		statsRecorder *stats.Recorder
+	)
+	if cfg.StatsDBPath != "" {
+		statsStore, err = stats.OpenStore(cfg.StatsDBPath, time.Duration(cfg.StatsRetentionHours)*time.Hour)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("Failed to open stats database")
+		}
+		statsRecorder = stats.NewRecorder(statsStore, statsProbe(source, distributor, peerManager, latency, qualityMonitor), logger)
+		statsRecorder.Start(ctx)
+		logger.Info().Str("path", cfg.StatsDBPath).Msg("Stats history enabled")
+	}
+
+	// Start admin server
+	var adminServer *admin.Server
+	if cfg.AdminListenAddr != "" {
+		adminOpts := []admin.Option{admin.WithPauser(distributor), admin.WithLatency(latency), admin.WithPeerQuality(qualityMonitor), admin.WithPeerStates(peerStates), admin.WithInvites(invites),
+			admin.WithConnectQR(connectURL(cfg), time.Duration(cfg.QRInviteTTLSec)*time.Second, cfg.QRInviteMaxUses),
+			admin.WithBans(bans, kickFunc(peerManager, logger)), admin.WithPresence(viewers),
+			admin.WithEvents(bus, gatewayStatus(source, distributor, peerManager, resourceMonitor, budget)), admin.WithAccessLog(accessLog), admin.WithDashboard()}
+		if sessionLog != nil {
+			adminOpts = append(adminOpts, admin.WithSessionLog(sessionLog))
+		}
+		if replayBuffer != nil {
+			adminOpts = append(adminOpts, admin.WithClips(replayBuffer))
+		}
+		if recorder != nil {
+			adminOpts = append(adminOpts, admin.WithRecordings(recorder))
+		}
+		if markerStore != nil {
+			adminOpts = append(adminOpts, admin.WithMarkers(markerStore))
+		}
+		if highlights != nil {
+			adminOpts = append(adminOpts, admin.WithHighlights(highlights, slices.Contains(cfg.HighlightAnalyzers, "webhook")))
+		}
+		if uploader != nil {
+			adminOpts = append(adminOpts, admin.WithUploads(uploader, time.Duration(cfg.UploadURLTTLSec)*time.Second))
+		}
+		if screenshots != nil {
+			adminOpts = append(adminOpts, admin.WithScreenshots(screenshots))
+		}
+		if preview != nil {
+			adminOpts = append(adminOpts, admin.WithPreview(preview))
+		}
+		if captionTrack != nil {
+			adminOpts = append(adminOpts, admin.WithCaptions(captionTrack))
+		}
+		if ec, ok := source.(mediapkg.EncoderController); ok {
+			adminOpts = append(adminOpts, admin.WithEncoderControl(ec))
+		}
+		if gopControl != nil {
+			adminOpts = append(adminOpts, admin.WithGOP(gopControl))
+		}
+		if audioMixer != nil {
+			adminOpts = append(adminOpts, admin.WithAudioMixer(audioMixer))
+		}
+		if directorCtl != nil {
+			adminOpts = append(adminOpts, admin.WithDirector(directorCtl))
+		}
+		if statsStore != nil {
+			adminOpts = append(adminOpts, admin.WithStatsHistory(statsStore))
+		}
+		if coHost != nil {
+			adminOpts = append(adminOpts, admin.WithCoHost(coHost))
+		}
+		writeTimeout := 30 * time.Second
+		if cfg.AdminDebug {
+			adminOpts = append(adminOpts, debugStateOptions(source, chain, distributor, peerManager, subscriptions, bus, latency, watchdog, inspector)...)
+			adminOpts = append(adminOpts, admin.WithState("video_codec", func() any { return codecs.Stats() }))
+			if capture != nil {
+				adminOpts = append(adminOpts, admin.WithState("capture", func() any { return capture.Status() }))
+			}
+			if audioRouter != nil {
+				adminOpts = append(adminOpts, admin.WithState("audio", func() any { return audioRouter.Stats() }))
+			}
+			if audioMixer != nil {
+				adminOpts = append(adminOpts, admin.WithState("audio_mixer", func() any { return audioMixer.Stats() }))
+			}
+			if audioMixes != nil {
+				adminOpts = append(adminOpts, admin.WithState("audio_mixes", func() any { return audioMixes.Stats() }))
+			}
+			if returnChannel != nil {
+				adminOpts = append(adminOpts, admin.WithState("return_channel", func() any { return returnChannel.Stats() }))
+			}
+			if coHost != nil {
+				adminOpts = append(adminOpts, admin.WithState("cohost", func() any { return coHost.Stats() }))
+			}
+			if member != nil {
+				adminOpts = append(adminOpts, admin.WithState("cluster", func() any { return member.Stats() }))
+			}
+			adminOpts = append(adminOpts, admin.WithState("ice", func() any { return iceTransport.Info() }))
+			adminOpts = append(adminOpts, admin.WithState("invites", func() any {
+				return map[string]any{"stats": invites.Stats(), "peers": invites.Attribution()}
+			}))
+			adminOpts = append(adminOpts, admin.WithState("bans", func() any { return bans.Stats() }))
+			adminOpts = append(adminOpts, admin.WithState("stream_access", func() any { return streamAccess.Stats() }))
+			adminOpts = append(adminOpts, admin.WithState("presence", func() any { return viewers.Stats() }))
+			adminOpts = append(adminOpts, admin.WithState("access_log", func() any { return accessLog.Stats() }))
+			if peerIDs != nil {
+				adminOpts = append(adminOpts, admin.WithState("peer_ids", func() any { return peerIDs.Stats() }))
+			}
+			if idleReaper != nil {
+				adminOpts = append(adminOpts, admin.WithState("reaper", func() any { return idleReaper.Stats() }))
+			}
+			if senderReports != nil {
+				adminOpts = append(adminOpts, admin.WithState("av_sync", func() any { return senderReports.Stats() }))
+			}
+			if videoPacer != nil {
+				adminOpts = append(adminOpts, admin.WithState("pacer", func() any { return videoPacer.Stats() }))
+			}
+			if authenticator != nil {
+				adminOpts = append(adminOpts, admin.WithState("auth", func() any { return authenticator.Stats() }))
+			}
+			if sessionLog != nil {
+				adminOpts = append(adminOpts, admin.WithState("session_log", func() any { return sessionLog.Stats() }))
+			}
+			if replayBuffer != nil {
+				adminOpts = append(adminOpts, admin.WithState("replay", func() any { return replayBuffer.Stats() }))
+			}
+			if recorder != nil {
+				adminOpts = append(adminOpts, admin.WithState("recordings", func() any { return recorder.Stats() }))
+			}
+			if markerStore != nil {
+				adminOpts = append(adminOpts, admin.WithState("markers", func() any { return markerStore.Stats() }))
+			}
+			if highlights != nil {
+				adminOpts = append(adminOpts, admin.WithState("highlights", func() any { return highlights.Stats() }))
+			}
+			if whipEgress != nil {
+				adminOpts = append(adminOpts, admin.WithState("whip_egress", func() any { return whipEgress.Stats() }))
+			}
+			if ndiSender != nil {
+				adminOpts = append(adminOpts, admin.WithState("ndi", func() any { return ndiSender.Stats() }))
+			}
+			if multicastSender != nil {
+				adminOpts = append(adminOpts, admin.WithState("multicast", func() any { return multicastSender.Stats() }))
+			}
+			if len(renditions) > 0 {
+				adminOpts = append(adminOpts, admin.WithState("renditions", func() any {
+					stats := make([]transcode.Stats, 0, len(renditions))
+					for _, r := range renditions {
+						stats = append(stats, r.Stats())
+					}
+					return stats
+				}))
+			}
+			if uploader != nil {
+				adminOpts = append(adminOpts, admin.WithState("uploads", func() any { return uploader.Stats() }))
+			}
+			if screenshots != nil {
+				adminOpts = append(adminOpts, admin.WithState("screenshot", func() any { return screenshots.Stats() }))
+			}
+			if preview != nil {
+				adminOpts = append(adminOpts, admin.WithState("preview", func() any { return preview.Stats() }))
+			}
+			if captionTrack != nil {
+				adminOpts = append(adminOpts, admin.WithState("captions", func() any { return captionTrack.Stats() }))
+			}
+			if cs, ok := source.(interface{ ControlStats() mediapkg.ControlStats }); ok {
+				adminOpts = append(adminOpts, admin.WithState("encoder_control", func() any { return cs.ControlStats() }))
+			}
+			if hs, ok := source.(interface {
+				HeartbeatStats() mediapkg.HeartbeatStats
+			}); ok {
+				adminOpts = append(adminOpts, admin.WithState("producer", func() any { return hs.HeartbeatStats() }))
+			}
+			if rs, ok := source.(interface{ ResyncStats() mediapkg.ResyncStats }); ok {
+				adminOpts = append(adminOpts, admin.WithState("ipc_resync", func() any { return rs.ResyncStats() }))
+			}
+			if ns, ok := source.(interface {
+				Negotiation() (mediapkg.Negotiation, bool)
+			}); ok {
+				adminOpts = append(adminOpts, admin.WithState("producer_protocol", func() any {
+					if n, ok := ns.Negotiation(); ok {
+						return n
+					}
+					return nil
+				}))
+			}
+			if ts, ok := source.(interface{ TimelineStats() mediapkg.TimelineStats }); ok {
+				adminOpts = append(adminOpts, admin.WithState("timeline", func() any { return ts.TimelineStats() }))
+			}
+			if gopControl != nil {
+				adminOpts = append(adminOpts, admin.WithState("gop", func() any { return gopControl.Status() }))
+			}
+			if bitDepth != nil {
+				adminOpts = append(adminOpts, admin.WithState("bit_depth", func() any { return bitDepth.Status() }))
+			}
+			if negotiator != nil {
+				adminOpts = append(adminOpts, admin.WithState("negotiation", func() any { return negotiator.Stats() }))
+			}
+			if directorCtl != nil {
+				adminOpts = append(adminOpts, admin.WithState("director", func() any { return directorCtl.Stats() }))
+			}
+			if gameInfo != nil {
+				adminOpts = append(adminOpts, admin.WithState("game_info", func() any { return gameInfo.Stats() }))
+			}
+			adminOpts = append(adminOpts, admin.WithState("commands", func() any { return router.Stats() }))
+			if timeshifter != nil {
+				adminOpts = append(adminOpts, admin.WithState("timeshift", func() any { return timeshifter.Stats() }))
+			}
+			// CPU profiles and traces stream for 30s by default
+			writeTimeout = 2 * time.Minute
+		}
+		var adminTLS *tls.Config
+		if cfg.AdminTLS() {
+			adminTLS, err = loadTLSConfig(cfg.AdminTLSCertFile, cfg.AdminTLSKeyFile)
+			if err != nil {
+				logger.Fatal().Err(err).Msg("Failed to load admin TLS certificate")
+			}
+		}
+		if cfg.AdminToken == "" && !loopbackAddr(cfg.AdminListenAddr) {
+			logger.Warn().Str("listen_addr", cfg.AdminListenAddr).Msg("Admin server is reachable beyond loopback without GATEWAY_ADMIN_TOKEN")
+		}
+		adminServer = admin.NewServer(admin.ServerConfig{
+			ListenAddr:   cfg.AdminListenAddr,
+			ReadTimeout:  30 * time.Second,
+			WriteTimeout: writeTimeout,
+			Listener:     activated["admin"],
+			TLSConfig:    adminTLS,
+			Token:        cfg.AdminToken,
+		}, logger, adminOpts...)
+		delete(activated, "admin")
+		if err := adminServer.Start(); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to start admin server")
+		}
+	}
+
+	// Join the cluster once this instance can serve viewers
+	if member != nil {
+		member.SetLoad(func() cluster.Load {
+			return cluster.Load{Peers: peerManager.GetConnectedPeerCount(), Live: distributor.Stats().Live}
+		})
+		if err := member.Start(ctx); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to join cluster")
+		}
+	}
+
+	// Start HTTP server
+	logger.Info().Msg("Starting HTTP signaling server...")
+	if err := httpServer.Start(); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to start HTTP server")
+	}
+
+	// The signaling server and pipeline listen for themselves, so other
+	// activated sockets cannot be used yet
+	for name, l := range activated {
+		logger.Warn().Str("name", name).Str("addr", l.Addr().String()).Msg("Ignoring socket-activated listener")
+		l.Close()
+	}
+
+	// Let LAN clients discover the signaling server
+	advertiser := createAdvertiser(cfg, logger)
+	if advertiser != nil {
+		if err := advertiser.Start(ctx); err != nil {
+			logger.Warn().Err(err).Msg("Failed to advertise on the local network")
+			advertiser = nil
+		}
+	}
+
+	// Print ready message
+	printReadyMessage(cfg)
+	if cfg.ConnectQR {
+		printConnectQR(cfg, invites, logger)
+	}
+
+	// Tell systemd startup is complete and keep its watchdog fed
+	if ok, err := systemd.Ready("Serving on " + cfg.HTTPListenAddr); err != nil {
+		logger.Warn().Err(err).Msg("Failed to notify systemd")
+	} else if ok {
+		logger.Info().Msg("Notified systemd of readiness")
+	}
+	go systemd.RunWatchdog(ctx, nil)
+
+	// Wait for shutdown signal
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigChan
+
+	logger.Info().Str("signal", sig.String()).Msg("Received shutdown signal")
+	systemd.Stopping()
+
+	// Withdraw the LAN advertisement and leave the cluster first so no more
+	// viewers are sent here
+	if advertiser != nil {
+		advertiser.Stop()
+	}
+	if member != nil {
+		if err := member.Stop(); err != nil {
+			logger.Error().Err(err).Msg("Error leaving cluster")
+		}
+	}
+
+	// Create shutdown context with timeout
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+
+	// Stop HTTP server first so no new viewers can join
+	logger.Info().Msg("Shutting down HTTP server...")
+	if err := httpServer.Stop(shutdownCtx); err != nil {
+		logger.Error().Err(err).Msg("Error stopping HTTP server")
+	}
+	logger.Info().Msg("HTTP server stopped")
+
+	// Give connected viewers the drain window; a second signal skips it
+	drainPeers(cfg, peerManager, sigChan, logger)
+
+	if adminServer != nil {
+		if err := adminServer.Stop(shutdownCtx); err != nil {
+			logger.Error().Err(err).Msg("Error stopping admin server")
+		}
+	}
+
+	// Announce shutdown and let webhooks drain while the context is live
+	bus.Publish(events.StreamStopped, map[string]any{"reason": "shutdown"})
+	if webhookSink != nil {
+		if err := webhookSink.Stop(shutdownCtx); err != nil {
+			logger.Error().Err(err).Msg("Error stopping webhook sink")
+		}
+	}
+
+	// Stop the watchdog first so it cannot restart the source mid-shutdown
+	if watchdog != nil {
+		watchdog.Stop()
+	}
+
+	// Stop timeshift players before the peers they write to close
+	if timeshifter != nil {
+		timeshifter.Close()
+	}
+
+	// Stop the capture service before its socket goes away
+	if capture != nil {
+		capture.Stop()
+	}
+
+	// Cancel main context to stop video source
+	cancel()
+	distributor.Stop()
+
+	// Clip a pending highlight from what was buffered
+	if highlights != nil {
+		highlights.Stop()
+	}
+	if whipEgress != nil {
+		whipEgress.Stop()
+	}
+	if ndiSender != nil {
+		ndiSender.Stop()
+	}
+	if multicastSender != nil {
+		multicastSender.Stop()
+	}
+	for _, r := range renditions {
+		r.Stop()
+	}
+
+	// Finish the recording once no more frames arrive
+	if recorder != nil {
+		recorder.Stop()
+	}
+	// A clean exit leaves nothing in the replay spool to recover
+	if replayBuffer != nil {
+		replayBuffer.Close()
+	}
+	if uploader != nil {
+		uploader.Stop()
+	}
+	if audioMixer != nil {
+		audioMixer.Stop()
+	}
+	if audioRouter != nil {
+		audioRouter.Stop()
+	}
+	if captionTrack != nil {
+		captionTrack.Stop()
+	}
+	if gameInfo != nil {
+		gameInfo.Stop()
+	}
+	if gopControl != nil {
+		gopControl.Stop()
+	}
+	if bitDepth != nil {
+		bitDepth.Stop()
+	}
+	if returnChannel != nil {
+		returnChannel.Stop()
+	}
+
+	// Record the final partial minute
+	if statsRecorder != nil {
+		statsRecorder.Stop()
+		if err := statsStore.Close(); err != nil {
+			logger.Error().Err(err).Msg("Error closing stats database")
+		}
+	}
+
+	// Stop video source
+	logger.Info().Msg("Stopping video source...")
+	if err := source.Stop(); err != nil {
+		logger.Error().Err(err).Msg("Error stopping video source")
+	}
+	logger.Info().Msg("Video source stopped")
+
+	// Close peer manager
+	logger.Info().Msg("Closing peer manager...")
+	if err := peerManager.Close(); err != nil {
+		logger.Error().Err(err).Msg("Error closing peer manager")
+	}
+	logger.Info().Msg("Peer manager closed")
+
+	if err := iceTransport.Close(); err != nil {
+		logger.Error().Err(err).Msg("Error closing ICE sockets")
+	}
+	if sessionLog != nil {
+		sessionLog.Close()
+	}
+	if screenshots != nil {
+		screenshots.Close()
+	}
+	if preview != nil {
+		preview.Close()
+	}
+
+	// Flush buffered spans
+	if shutdownTracing != nil {
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			logger.Error().Err(err).Msg("Error flushing traces")
+		}
+	}
+
+	logger.Info().Msg("Shutdown complete")
+}
+
+// setupLogging configures zerolog based on config. The returned function
+// closes the log file, if any.
+func setupLogging(cfg *config.Config) (zerolog.Logger, func(), error) {
+	// Stdout is pretty-printed for humans unless JSON is requested
+	var output io.Writer = os.Stdout
+	if cfg.LogFormat == "console" {
+		output = zerolog.ConsoleWriter{
+			Out:        os.Stdout,
+			TimeFormat: time.RFC3339,
+		}
+	}
+
+	// The log file is always JSON so it can be shipped as-is
+	closeLog := func() {}
+	if cfg.LogFile != "" {
+		file, err := logging.OpenRotatingFile(cfg.LogFile, int64(cfg.LogMaxSizeMB)<<20, cfg.LogMaxBackups)
+		if err != nil {
+			return zerolog.Logger{}, nil, err
+		}
+		output = zerolog.MultiLevelWriter(output, file)
+		closeLog = func() { file.Close() }
+	}
+
+	// Set log level
+	var level zerolog.Level
+	switch cfg.LogLevel {
+	case "debug":
+		level = zerolog.DebugLevel
+	case "info":
+		level = zerolog.InfoLevel
+	case "warn":
+		level = zerolog.WarnLevel
+	case "error":
+		level = zerolog.ErrorLevel
+	default:
+		level = zerolog.InfoLevel
+	}
+
+	zerolog.SetGlobalLevel(level)
+
+	// Create logger with timestamp
+	logger := zerolog.New(output).
+		With().
+		Timestamp().
+		Str("service", "webrtc-gateway").
+		Logger()
+
+	// Set as global logger
+	log.Logger = logger
+
+	return logger, closeLog, nil
+}
+
+// createPipeline builds the media pipeline for IPC or synthetic input
+func createPipeline(cfg *config.Config, logger zerolog.Logger) *mediapkg.Pipeline {
+	var pipelineOpts []mediapkg.PipelineOption
+	if cfg.UseSynthetic {
+		logger.Info().Msg("Creating media pipeline (synthetic mode)...")
+		syntheticConfig := mediapkg.SyntheticConfig{
+			Width:     cfg.SyntheticWidth,
+			Height:    cfg.SyntheticHeight,
+			FrameRate: cfg.SyntheticFPS,
+			Pattern:   mediapkg.PatternType(cfg.SyntheticPattern),
+		}
+		pipelineOpts = append(pipelineOpts, mediapkg.WithSyntheticVideo(syntheticConfig))
+	} else {
+		logger.Info().Msg("Creating media pipeline (IPC mode)...")
+	}
+
+	pipeline := mediapkg.NewPipeline(cfg, logger, pipelineOpts...)
+
+	if cfg.UseSynthetic {
+		logger.Info().
+			Int("width", cfg.SyntheticWidth).
+			Int("height", cfg.SyntheticHeight).
+			Int("fps", cfg.SyntheticFPS).
+			Str("pattern", mediapkg.PatternType(cfg.SyntheticPattern).String()).
+			Msg("Pipeline created")
+	} else {
+		logger.Info().
+			Str("socket", cfg.IPCSocketPath).
+			Msg("Pipeline created")
+	}
+
+	return pipeline
+}
+
+// createReplaySource builds an IPC consumer fed from a recorded tap file
+// instead of the socket
+func createReplaySource(cfg *config.Config, logger zerolog.Logger) *mediapkg.IPCConsumer {
+	logger.Info().Msg("Creating IPC replay source...")
+	listener, err := mediapkg.NewReplayListener(cfg.IPCReplayFile, cfg.IPCReplayLoop, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Str("path", cfg.IPCReplayFile).Msg("Failed to open IPC replay")
+	}
+
+	ipcConfig := mediapkg.DefaultIPCConsumerConfig()
+	ipcConfig.SocketPath = cfg.IPCReplayFile
+	ipcConfig.Listener = listener
+	ipcConfig.ReadTimeout = time.Duration(cfg.IPCReadTimeoutMs) * time.Millisecond
+	ipcConfig.HeartbeatInterval = time.Duration(cfg.IPCHeartbeatMs) * time.Millisecond
+	if cfg.IPCHeartbeatMs == 0 {
+		ipcConfig.HeartbeatInterval = -1
+	}
+	ipcConfig.MaxMissedHeartbeats = cfg.IPCMaxMissedHeartbeats
+	ipcConfig.HighBitDepth = cfg.HighBitDepth
+	if cfg.VideoCodec != "auto" {
+		ipcConfig.Codecs = []string{cfg.VideoCodec}
+	}
+	consumer := mediapkg.NewIPCConsumer(ipcConfig, logger)
+
+	logger.Info().
+		Str("path", cfg.IPCReplayFile).
+		Bool("loop", cfg.IPCReplayLoop).
+		Msg("IPC replay source created")
+
+	return consumer
+}
+
+// createV4L2Source builds a direct V4L2 capture source
+func createV4L2Source(cfg *config.Config, drawOverlay func(*image.YCbCr, int64), budget *mediapkg.FrameBudget, logger zerolog.Logger) *v4l2.Source {
+	logger.Info().Msg("Creating V4L2 capture source...")
+	v4l2Config := v4l2.DefaultConfig()
+	v4l2Config.Device = cfg.V4L2Device
+	v4l2Config.Width = cfg.V4L2Width
+	v4l2Config.Height = cfg.V4L2Height
+	v4l2Config.FrameRate = cfg.V4L2FPS
+	v4l2Config.PixelFormat = v4l2.PixelFormat(cfg.V4L2PixelFormat)
+	v4l2Config.Budget = budget
+	if !v4l2Config.PixelFormat.IsEncoded() {
+		v4l2Config.Encoder = &encoder.Config{
+			Backend:     cfg.EncoderBackend,
+			Device:      cfg.EncoderDevice,
+			BitrateKbps: cfg.MaxBitrateKbps,
+			Overlay:     drawOverlay,
+		}
+		v4l2Config.MinFrameRate = cfg.V4L2MinFPS
+	} else if cfg.V4L2MinFPS > 0 {
+		logger.Warn().Int("min_fps", cfg.V4L2MinFPS).Msg("V4L2 H.264 capture cannot be repeated; ignoring the minimum frame rate")
+	}
+	source := v4l2.NewSource(v4l2Config, logger)
+
+	logger.Info().
+		Str("device", cfg.V4L2Device).
+		Int("width", cfg.V4L2Width).
+		Int("height", cfg.V4L2Height).
+		Int("fps", cfg.V4L2FPS).
+		Str("pixel_format", cfg.V4L2PixelFormat).
+		Str("encoder", cfg.EncoderBackend).
+		Interface("encoder_backends", encoder.Probe(cfg.EncoderDevice)).
+		Msg("V4L2 source created")
+
+	return source
+}
+
+// createFailoverSource builds the configured failover chain. Each entry is
+// created as it would be on its own.
+func createFailoverSource(cfg *config.Config, drawOverlay func(*image.YCbCr, int64), budget *mediapkg.FrameBudget, logger zerolog.Logger) *failover.Source {
+	logger.Info().Strs("sources", cfg.Sources).Msg("Creating failover source chain...")
+
+	entries := make([]failover.Entry, 0, len(cfg.Sources))
+	for _, name := range cfg.Sources {
+		var source mediapkg.FrameSource
+		switch name {
+		case "ipc":
+			if cfg.IPCReplayFile != "" {
+				source = createReplaySource(cfg, logger)
+				break
+			}
+			ipcCfg := *cfg
+			ipcCfg.UseSynthetic = false
+			source = createPipeline(&ipcCfg, logger)
+		case "rtsp":
+			source = rtsp.NewSource(rtsp.Config{URL: cfg.RTSPURL}, logger)
+		case "relay":
+			source = whep.NewSource(whep.Config{URL: cfg.RelayURL, Token: cfg.RelayToken}, logger)
+		case "v4l2":
+			source = createV4L2Source(cfg, drawOverlay, budget, logger)
+		case "synthetic":
+			if cfg.SyntheticPatternName != "" {
+				source = createPatternSource(cfg, drawOverlay, budget, logger)
+			} else {
+				syntheticCfg := *cfg
+				syntheticCfg.UseSynthetic = true
+				source = createPipeline(&syntheticCfg, logger)
+			}
+		}
+		entries = append(entries, failover.Entry{Name: name, Source: source})
+	}
+
+	source := failover.New(failover.Config{
+		Timeout:       time.Duration(cfg.FailoverTimeoutMs) * time.Millisecond,
+		FailbackDelay: time.Duration(cfg.FailbackDelayMs) * time.Millisecond,
+	}, entries, logger)
+
+	return source
+}
+
+// createOverlay builds the overlay drawn by gateway encoders, or returns nil
+// when none is configured
+func createOverlay(cfg *config.Config, peers interface{ GetConnectedPeerCount() int }, logger zerolog.Logger) func(*image.YCbCr, int64) {
+	overlayCfg := overlay.Config{
+		Text:     cfg.OverlayText,
+		Image:    cfg.OverlayImage,
+		Live:     cfg.OverlayLive,
+		Viewers:  cfg.OverlayViewers,
+		Position: cfg.OverlayPosition,
+	}
+	if !overlayCfg.Enabled() {
+		return nil
+	}
+	o, err := overlay.New(overlayCfg, peers.GetConnectedPeerCount)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create overlay")
+	}
+
+	// Encoded sources are forwarded as they arrive, with nothing to draw on
+	encodes := cfg.UseSynthetic && cfg.SyntheticPatternName != "" ||
+		cfg.UseV4L2 && !v4l2.PixelFormat(cfg.V4L2PixelFormat).IsEncoded()
+	for _, name := range cfg.Sources {
+		encodes = encodes || name == "v4l2" || name == "synthetic"
+	}
+	if !encodes {
+		logger.Warn().Msg("Overlays only apply to video the gateway encodes (synthetic patterns, raw V4L2); the current source is forwarded unchanged")
+	}
+	logger.Info().Str("position", cfg.OverlayPosition).Bool("live", cfg.OverlayLive).
+		Bool("viewers", cfg.OverlayViewers).Bool("text", cfg.OverlayText != "").
+		Bool("image", cfg.OverlayImage != "").Msg("Overlay enabled")
+	return o.Draw
+}
+
+// createPatternSource builds a gateway-rendered synthetic source
+func createPatternSource(cfg *config.Config, drawOverlay func(*image.YCbCr, int64), budget *mediapkg.FrameBudget, logger zerolog.Logger) *pattern.Source {
+	logger.Info().Msg("Creating pattern source (synthetic mode)...")
+
+	sourceConfig := pattern.SourceConfig{
+		Width:     cfg.SyntheticWidth,
+		Height:    cfg.SyntheticHeight,
+		FrameRate: cfg.SyntheticFPS,
+		Encoder: encoder.Config{
+			Backend:     cfg.EncoderBackend,
+			Device:      cfg.EncoderDevice,
+			BitrateKbps: cfg.MaxBitrateKbps,
+			Overlay:     drawOverlay,
+		},
+		Budget: budget,
+	}
+	p, err := pattern.New(cfg.SyntheticPatternName)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create synthetic pattern")
+	}
+	source := pattern.NewSource(sourceConfig, p, logger)
+
+	logger.Info().
+		Int("width", cfg.SyntheticWidth).
+		Int("height", cfg.SyntheticHeight).
+		Int("fps", cfg.SyntheticFPS).
+		Str("pattern", cfg.SyntheticPatternName).
+		Str("encoder", cfg.EncoderBackend).
+		Interface("encoder_backends", encoder.Probe(cfg.EncoderDevice)).
+		Msg("Pattern source created")
+
+	return source
+}
+
+// debugStateOptions enables the admin debug endpoints with a state section
+// for each major component
+func debugStateOptions(source mediapkg.FrameSource, chain *failover.Source, dist *mediapkg.Distributor, pm *webrtcpkg.PeerManager, subs *mediapkg.Subscriptions, bus *events.Bus, latency *mediapkg.LatencyTracker, watchdog *mediapkg.Watchdog, inspector *mediapkg.StreamInspector) []admin.Option {
+	opts := []admin.Option{
+		admin.WithDebug(),
+		admin.WithState("source", func() any {
+			frames := source.VideoFrameChannel()
+			state := map[string]any{
+				"type":           fmt.Sprintf("%T", source),
+				"queue_depth":    len(frames),
+				"queue_capacity": cap(frames),
+			}
+			if st, ok := source.(interface{ Stats() (uint64, uint64) }); ok {
+				state["frames"], state["dropped"] = st.Stats()
+			}
+			return state
+		}),
+		admin.WithState("distributor", func() any { return dist.Stats() }),
+		admin.WithState("pipeline", func() any { return pipelineStats(source, dist) }),
+		admin.WithState("peer_queues", func() any { return dist.PeerQueues() }),
+		admin.WithState("latency", func() any { return latency.Stats() }),
+		admin.WithState("stream", func() any {
+			params, ok := inspector.Params()
+			if !ok {
+				return nil
+			}
+			return map[string]any{"params": params, "color": inspector.Color(), "hdr": inspector.HDR(), "rotation": inspector.Rotation(), "mismatches": inspector.Mismatches()}
+		}),
+		admin.WithState("peers", func() any {
+			return map[string]any{
+				"connected":     pm.GetConnectedPeerCount(),
+				"subscriptions": subs.Snapshot(),
+			}
+		}),
+		admin.WithState("events", func() any {
+			return map[string]any{"published": bus.Published()}
+		}),
+	}
+	if watchdog != nil {
+		opts = append(opts, admin.WithState("watchdog", func() any { return watchdog.Stats() }))
+	}
+	if chain != nil {
+		opts = append(opts, admin.WithState("failover", func() any {
+			return map[string]any{"active": chain.Active(), "sources": chain.Status()}
+		}))
+	}
+	return opts
+}
+
+// gatewayStatus reports pipeline state, IPC connectivity, the peer count,
+// and when watched, host resources and per-stage frame timings, for
+// /api/status and the admin event feed
+func gatewayStatus(source mediapkg.FrameSource, dist *mediapkg.Distributor, pm *webrtcpkg.PeerManager, guard *resources.Monitor, budget *mediapkg.FrameBudget) func() any {
+	return func() any {
+		stats := dist.Stats()
+		status := map[string]any{
+			"pipeline": map[string]any{
+				"live":          stats.Live,
+				"paused":        stats.Paused,
+				"offline":       stats.Offline,
+				"last_frame_at": dist.LastFrameAt().UTC(),
+				"bytes":         stats.Bytes,
+			},
+			"stages": pipelineStats(source, dist),
+			"peers":  pm.GetConnectedPeerCount(),
+		}
+		if ic, ok := source.(interface{ IsConnected() bool }); ok {
+			status["ipc"] = map[string]any{"connected": ic.IsConnected()}
+		}
+		if guard != nil {
+			status["resources"] = guard.Status()
+		}
+		if budget != nil {
+			status["frame_budget"] = budget.Stats()
+		}
+		return status
+	}
+}
+
+// createWatchdog watches the distributor's frame arrivals and maps stalls
+// and restarts onto the event bus
+func createWatchdog(cfg *config.Config, source mediapkg.FrameSource, dist *mediapkg.Distributor, bus *events.Bus, logger zerolog.Logger) *mediapkg.Watchdog {
+	watchdog := mediapkg.NewWatchdog(mediapkg.WatchdogConfig{
+		StallTimeout: time.Duration(cfg.WatchdogStallMs) * time.Millisecond,
+		RestartAfter: time.Duration(cfg.WatchdogRestartMs) * time.Millisecond,
+	}, source, dist.LastFrameAt, logger)
+
+	watchdog.SetOnEvent(func(e mediapkg.WatchdogEvent) {
+		data := map[string]any{"stalled_ms": e.StalledFor.Milliseconds()}
+		switch e.Type {
+		case mediapkg.WatchdogStalled:
+			bus.Publish(events.SourceStalled, data)
+		case mediapkg.WatchdogRecovered:
+			data["restarts"] = e.Restarts
+			bus.Publish(events.SourceRecovered, data)
+		case mediapkg.WatchdogRestarted, mediapkg.WatchdogRestartFailed:
+			data["attempt"] = e.Restarts
+			data["ok"] = e.Err == nil
+			if e.Err != nil {
+				data["error"] = e.Err.Error()
+			}
+			bus.Publish(events.SourceRestarted, data)
+		}
+	})
+
+	return watchdog
+}
+
+// drainPeers notifies viewers of the shutdown and waits for them to leave,
+// up to the configured window
+func drainPeers(cfg *config.Config, pm *webrtcpkg.PeerManager, sigChan <-chan os.Signal, logger zerolog.Logger) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-sigChan:
+			logger.Warn().Msg("Second shutdown signal, skipping peer drain")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	peerManager, err := webrtcpkg.NewPeerManager(peerConfig, logger)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to create peer manager")
+	result := drain.Drain(ctx, drain.Config{
+		Window: time.Duration(cfg.DrainWindowMs) * time.Millisecond,
+	}, pm, logger)
+	if result.Initial > 0 {
+		logger.Info().
+			Int("peers", result.Initial).
+			Int("remaining", result.Remaining).
+			Dur("elapsed", result.Elapsed).
+			Msg("Peer drain finished")
 	}
+}
 
-	// Set up peer connection callbacks
-	peerManager.SetOnPeerConnected(func(peerID string) {
-		logger.Info().Str("peer_id", peerID).Msg("Peer connected")
-	})
-	peerManager.SetOnPeerDisconnected(func(peerID string) {
-		logger.Info().Str("peer_id", peerID).Msg("Peer disconnected")
+// createSupervisor runs the configured capture service command and maps its
+// lifecycle onto the event bus
+func createSupervisor(cfg *config.Config, bus *events.Bus, logger zerolog.Logger) *supervisor.Supervisor {
+	capture := supervisor.New(supervisor.Config{
+		Command:      cfg.CaptureCommand[0],
+		Args:         cfg.CaptureCommand[1:],
+		Env:          []string{"IPC_SOCKET_PATH=" + cfg.IPCSocketPath}, // Read by the capture service
+		RestartDelay: time.Duration(cfg.CaptureBackoffMs) * time.Millisecond,
+	}, logger)
+
+	capture.SetOnEvent(func(e supervisor.Event) {
+		switch e.Type {
+		case supervisor.EventStarted:
+			bus.Publish(events.CaptureStarted, map[string]any{"pid": e.PID, "restarts": e.Restarts})
+		case supervisor.EventExited, supervisor.EventStartFailed:
+			data := map[string]any{"exit_code": e.ExitCode, "uptime_ms": e.Uptime.Milliseconds()}
+			if e.Err != nil {
+				data["error"] = e.Err.Error()
+			}
+			bus.Publish(events.CaptureExited, data)
+		}
 	})
 
-	logger.Info().Msg("Peer manager created")
+	return capture
+}
 
-	// Create Pipeline
-	var pipelineOpts []mediapkg.PipelineOption
-	if cfg.UseSynthetic {
-		logger.Info().Msg("Creating media pipeline (synthetic mode)...")
-		syntheticConfig := mediapkg.SyntheticConfig{
-			Width:     cfg.SyntheticWidth,
-			Height:    cfg.SyntheticHeight,
-			FrameRate: cfg.SyntheticFPS,
-			Pattern:   mediapkg.PatternType(cfg.SyntheticPattern),
+// statsProbe reads the counters recorded in stats history, with peer RTT
+// averaged over the peers the quality monitor has measured
+func statsProbe(source mediapkg.FrameSource, dist *mediapkg.Distributor, pm *webrtcpkg.PeerManager, latency *mediapkg.LatencyTracker, qm *quality.Monitor) stats.Probe {
+	return func() stats.Counters {
+		ds := dist.Stats()
+		g2g := latency.Stats().GlassToGlass
+		c := stats.Counters{
+			Frames:       ds.Forwarded,
+			Bytes:        ds.Bytes,
+			Withheld:     ds.Withheld,
+			Peers:        pm.GetConnectedPeerCount(),
+			LatencyP50Ms: g2g.P50,
+			LatencyP95Ms: g2g.P95,
+			LatencyP99Ms: g2g.P99,
 		}
-		pipelineOpts = append(pipelineOpts, mediapkg.WithSyntheticVideo(syntheticConfig))
-	} else {
-		logger.Info().Msg("Creating media pipeline (IPC mode)...")
+		video := pipelineStats(source, dist).Video
+		c.Dropped, c.ProducerDropped = video.Dropped, video.ProducerDropped
+
+		// Peers without an RTT measurement yet are left out of the mean
+		var rttSum float64
+		var rttN int
+		for _, pq := range qm.Snapshot() {
+			if pq.Last.RTTMs > 0 {
+				rttSum += pq.Last.RTTMs
+				rttN++
+			}
+		}
+		if rttN > 0 {
+			c.RTTMs = rttSum / float64(rttN)
+		}
+		return c
 	}
+}
 
-	pipeline := mediapkg.NewPipeline(cfg, logger, pipelineOpts...)
+// pipelineStats gathers per-stage counters: ingest from sources that report
+// it, like the IPC consumer, or else from the source's frame counters and
+// channel, and distribution from the distributor
+func pipelineStats(source mediapkg.FrameSource, dist *mediapkg.Distributor) mediapkg.PipelineStats {
+	stats := mediapkg.PipelineStats{Distribution: dist.StageStats()}
+	if is, ok := source.(interface {
+		IngestStats() (mediapkg.StageStats, mediapkg.StageStats)
+	}); ok {
+		video, audio := is.IngestStats()
+		stats.Video, stats.Audio = video, &audio
+		return stats
+	}
 
-	if cfg.UseSynthetic {
-		logger.Info().
-			Int("width", cfg.SyntheticWidth).
-			Int("height", cfg.SyntheticHeight).
-			Int("fps", cfg.SyntheticFPS).
-			Str("pattern", mediapkg.PatternType(cfg.SyntheticPattern).String()).
-			Msg("Pipeline created")
-	} else {
-		logger.Info().
-			Str("socket", cfg.IPCSocketPath).
-			Msg("Pipeline created")
+	frames := source.VideoFrameChannel()
+	stats.Video = mediapkg.StageStats{
+		QueueDepth:     len(frames),
+		QueueCapacity:  cap(frames),
+		LastFrameAgeMs: -1,
+	}
+	if st, ok := source.(interface{ Stats() (uint64, uint64) }); ok {
+		stats.Video.Frames, stats.Video.Dropped = st.Stats()
 	}
+	if dup, ok := source.(interface {
+		Duplicated() uint64
+		NominalFPS() float64
+	}); ok {
+		stats.Video.Duplicated, stats.Video.NominalFPS = dup.Duplicated(), dup.NominalFPS()
+	}
+	return stats
+}
 
-	// Create HTTP Signaling Server
-	logger.Info().Msg("Creating signaling server...")
-	serverConfig := signaling.ServerConfig{
-		ListenAddr:     cfg.HTTPListenAddr,
-		AllowedOrigins: cfg.AllowedOrigins,
-		ReadTimeout:    30 * time.Second,
-		WriteTimeout:   30 * time.Second,
+// createWebhookSink builds webhook delivery, or returns nil if no webhooks
+// are configured
+func createWebhookSink(cfg *config.Config, bus *events.Bus, logger zerolog.Logger) *events.WebhookSink {
+	if len(cfg.WebhookURLs) == 0 {
+		return nil
 	}
-	httpServer := signaling.NewServer(serverConfig, peerManager, logger)
 
-	// Create main context for graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	types := make([]events.Type, 0, len(cfg.WebhookEvents))
+	for _, name := range cfg.WebhookEvents {
+		t, err := events.ParseType(name)
+		if err != nil {
+			logger.Fatal().Err(err).Interface("available", events.Types).Msg("Invalid webhook event filter")
+		}
+		types = append(types, t)
+	}
+
+	return events.NewWebhookSink(events.WebhookConfig{
+		URLs:   cfg.WebhookURLs,
+		Secret: cfg.WebhookSecret,
+		Types:  types,
+	}, bus, logger)
+}
 
-	// Start Pipeline
-	logger.Info().Msg("Starting pipeline...")
-	if err := pipeline.Start(ctx); err != nil {
-		logger.Fatal().Err(err).Msg("Failed to start pipeline")
+// createAdvertiser builds the mDNS advertisement of the signaling server,
+// or returns nil if it is disabled or the server is not reachable from the
+// network
+func createAdvertiser(cfg *config.Config, logger zerolog.Logger) *discovery.Advertiser {
+	if !cfg.MDNS {
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(cfg.HTTPListenAddr)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		logger.Info().Msg("Signaling server listens on loopback; not advertising on the local network")
+		return nil
+	}
+	port, err := net.LookupPort("tcp", portStr)
+	if err != nil {
+		return nil
 	}
-	logger.Info().Msg("Pipeline started")
 
-	// Start video distribution goroutine
-	startVideoDistribution(ctx, pipeline, peerManager, logger)
+	// Clients read these to build the signaling URL and know what to expect
+	txt := []string{"v=1", "proto=http", "path=/"}
+	if cfg.OIDCIssuer != "" {
+		txt = append(txt, "auth=oidc")
+	}
+	if cfg.InvitesRequired {
+		txt = append(txt, "invite=required")
+	}
+	txt = append(txt, "codec="+cfg.VideoCodec)
 
-	// Start HTTP server
-	logger.Info().Msg("Starting HTTP signaling server...")
-	if err := httpServer.Start(); err != nil {
-		logger.Fatal().Err(err).Msg("Failed to start HTTP server")
+	advertiser, err := discovery.New(discovery.Config{
+		Port:     port,
+		Instance: cfg.MDNSName,
+		TXT:      txt,
+		IPv6:     cfg.ICEIPv6 != icenet.IPv6Disable,
+	}, logger)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Cannot advertise on the local network")
+		return nil
 	}
+	return advertiser
+}
 
-	// Print ready message
-	printReadyMessage(cfg)
+// createICETransport opens the shared ICE sockets and validates the ICE
+// network settings
+func createICETransport(cfg *config.Config, logger zerolog.Logger) *icenet.Transport {
+	transport, err := icenet.New(icenet.Config{
+		UDPPort:          cfg.ICEUDPPort,
+		PortMin:          uint16(cfg.ICEPortMin),
+		PortMax:          uint16(cfg.ICEPortMax),
+		NAT1To1IPs:       cfg.NAT1To1IPs,
+		NAT1To1Candidate: cfg.NAT1To1Candidate,
+		TCPPort:          cfg.ICETCPPort,
+		TURNURLs:         cfg.TURNURLs,
+		TURNUsername:     cfg.TURNUsername,
+		TURNCredential:   cfg.TURNCredential,
+		IPv6:             cfg.ICEIPv6,
+	}, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to configure ICE networking")
+	}
+	return transport
+}
 
-	// Wait for shutdown signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigChan
+// loadTLSConfig loads a PEM certificate chain and key for a listener.
+// Renewed certificates take effect on restart.
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
 
-	logger.Info().Str("signal", sig.String()).Msg("Received shutdown signal")
+// loopbackAddr reports whether a listen address only accepts local
+// connections
+func loopbackAddr(listenAddr string) bool {
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
 
-	// Create shutdown context with timeout
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer shutdownCancel()
+// securityMiddleware builds the signaling server's CORS and security
+// header layer from the config
+func securityMiddleware(cfg *config.Config) func(http.Handler) http.Handler {
+	sec := httpsec.Config{
+		CORS:       httpsec.CORSPolicy{AllowedOrigins: cfg.AllowedOrigins},
+		Headers:    httpsec.DefaultHeaders(),
+		HSTSMaxAge: time.Duration(cfg.HSTSMaxAgeSec) * time.Second,
+	}
+	for prefix, origins := range cfg.CORSRoutes {
+		sec.Routes = append(sec.Routes, httpsec.Route{
+			Prefix: prefix,
+			Policy: httpsec.CORSPolicy{AllowedOrigins: origins},
+		})
+	}
+	switch cfg.CSP {
+	case "":
+	case "off":
+		delete(sec.Headers, "Content-Security-Policy")
+	default:
+		sec.Headers["Content-Security-Policy"] = cfg.CSP
+	}
+	for name, value := range cfg.SecurityHeaders {
+		sec.Headers[http.CanonicalHeaderKey(name)] = value
+	}
 
-	// Stop HTTP server first
-	logger.Info().Msg("Shutting down HTTP server...")
-	if err := httpServer.Stop(shutdownCtx); err != nil {
-		logger.Error().Err(err).Msg("Error stopping HTTP server")
+	return func(next http.Handler) http.Handler {
+		return httpsec.Middleware(sec, next)
 	}
-	logger.Info().Msg("HTTP server stopped")
+}
 
-	// Cancel main context to stop pipeline
-	cancel()
+// middlewareSettings lists the configured settings that are enforced by the
+// signaling server's HTTP middleware. The ban API counts whenever the admin
+// server is on, since bans made through it are enforced there too.
+func middlewareSettings(cfg *config.Config) []string {
+	var needs []string
+	if len(cfg.StreamAccess) > 0 {
+		needs = append(needs, "GATEWAY_STREAM_ACCESS")
+	}
+	if cfg.BanListPath != "" {
+		needs = append(needs, "GATEWAY_BAN_LIST_PATH")
+	}
+	if cfg.AdminListenAddr != "" {
+		needs = append(needs, "GATEWAY_ADMIN_LISTEN_ADDR (ban API)")
+	}
+	if cfg.AccessLog {
+		needs = append(needs, "GATEWAY_ACCESS_LOG")
+	}
+	if len(cfg.CORSRoutes) > 0 {
+		needs = append(needs, "GATEWAY_CORS_ROUTES")
+	}
+	if len(cfg.SecurityHeaders) > 0 {
+		needs = append(needs, "GATEWAY_SECURITY_HEADERS")
+	}
+	if cfg.CSP != "" {
+		needs = append(needs, "GATEWAY_CSP")
+	}
+	if cfg.HSTSMaxAgeSec > 0 {
+		needs = append(needs, "GATEWAY_HSTS_MAX_AGE_SEC")
+	}
+	return needs
+}
+
+// streamPolicies converts the configured stream access policies
+func streamPolicies(cfg *config.Config) map[string]access.Policy {
+	policies := make(map[string]access.Policy, len(cfg.StreamAccess))
+	for stream, p := range cfg.StreamAccess {
+		policies[stream] = access.Policy{
+			Mode:     access.Mode(p.Mode),
+			Password: p.Password,
+			Tokens:   p.Tokens,
+			Users:    p.Users,
+		}
+	}
+	return policies
+}
 
-	// Stop pipeline
-	logger.Info().Msg("Stopping pipeline...")
-	if err := pipeline.Stop(); err != nil {
-		logger.Error().Err(err).Msg("Error stopping pipeline")
+// viewerIdentities returns the signed-in identities of a signaling request
+// for the ban list and stream access, or nil without viewer sign-in
+func viewerIdentities(a *auth.Authenticator) func(*http.Request) []string {
+	if a == nil {
+		return nil
+	}
+	return func(r *http.Request) []string {
+		u := a.UserFromRequest(r)
+		if u == nil {
+			return nil
+		}
+		return []string{u.Subject, u.Email}
 	}
-	logger.Info().Msg("Pipeline stopped")
+}
 
-	// Close peer manager
-	logger.Info().Msg("Closing peer manager...")
-	if err := peerManager.Close(); err != nil {
-		logger.Error().Err(err).Msg("Error closing peer manager")
+// kickFunc disconnects a peer by closing its peer connection; the peer
+// manager's disconnect callback cleans up after it. It returns nil when the
+// peer manager does not expose peer connections.
+func kickFunc(peerManager any, logger zerolog.Logger) admin.KickFunc {
+	np, ok := peerManager.(negotiation.Peers)
+	if !ok {
+		logger.Warn().Msg("Peer manager does not expose peer connections; peers cannot be kicked")
+		return nil
 	}
-	logger.Info().Msg("Peer manager closed")
+	return func(peerID string) bool {
+		pc, ok := np.PeerConnection(peerID)
+		if !ok {
+			return false
+		}
+		if err := pc.Close(); err != nil {
+			logger.Warn().Err(err).Str("peer_id", peerID).Msg("Failed to close kicked peer")
+		}
+		logger.Info().Str("peer_id", peerID).Msg("Peer kicked")
+		return true
+	}
+}
 
-	logger.Info().Msg("Shutdown complete")
+// createStreamInspector checks the stream's parameter sets against the
+// configured codec and, for sources the gateway configures itself, the
+// configured resolution and frame rate
+func createStreamInspector(cfg *config.Config, logger zerolog.Logger) *mediapkg.StreamInspector {
+	inspector := mediapkg.NewStreamInspector(logger)
+
+	expected := mediapkg.StreamMetadata{VideoCodec: cfg.VideoCodec}
+	if cfg.VideoCodec == mediapkg.CodecAuto {
+		expected.VideoCodec = "" // Any codec is expected
+	}
+	switch {
+	case len(cfg.Sources) > 0:
+		// Chained sources may legitimately differ from each other
+	case cfg.UseV4L2:
+		expected.VideoWidth = cfg.V4L2Width
+		expected.VideoHeight = cfg.V4L2Height
+		expected.VideoFPS = cfg.V4L2FPS
+	case cfg.UseSynthetic:
+		expected.VideoWidth = cfg.SyntheticWidth
+		expected.VideoHeight = cfg.SyntheticHeight
+		expected.VideoFPS = cfg.SyntheticFPS
+	}
+	inspector.SetExpected(expected)
+
+	return inspector
 }
 
-// setupLogging configures zerolog based on config
-func setupLogging(cfg *config.Config) zerolog.Logger {
-	// Configure console output with pretty formatting
-	output := zerolog.ConsoleWriter{
-		Out:        os.Stdout,
-		TimeFormat: time.RFC3339,
+// createAudioRouter routes source audio, downmixed to stereo, to the peer
+// manager when it accepts PCM audio, recording write times on clock
+func createAudioRouter(cfg *config.Config, frames <-chan mediapkg.AudioFrame, pm *webrtcpkg.PeerManager, clock *avsync.Clock, logger zerolog.Logger) *audio.Router {
+	// Validated by config
+	mode, _ := audio.ParseMode(cfg.AudioDownmix)
+
+	router := audio.NewRouter(audio.RouterConfig{Downmix: mode, Loudness: loudnessConfig(cfg)}, frames, logger)
+	if aw, ok := any(pm).(interface {
+		WriteAudioFrame(mediapkg.AudioFrame) error
+	}); ok {
+		router.AddSink(audio.OutputStereo, func(frame mediapkg.AudioFrame) {
+			clock.Observe(avsync.Audio, frame.PTS, time.Now())
+			if err := aw.WriteAudioFrame(frame); err != nil {
+				logger.Debug().Err(err).Msg("Error writing audio frame")
+			}
+		})
 	}
+	return router
+}
 
-	// Set log level
-	var level zerolog.Level
-	switch cfg.LogLevel {
-	case "debug":
-		level = zerolog.DebugLevel
-	case "info":
-		level = zerolog.InfoLevel
-	case "warn":
-		level = zerolog.WarnLevel
-	case "error":
-		level = zerolog.ErrorLevel
-	default:
-		level = zerolog.InfoLevel
+// loudnessConfig returns the viewer audio normalization settings
+func loudnessConfig(cfg *config.Config) audio.LoudnessConfig {
+	return audio.LoudnessConfig{
+		TargetLUFS: float64(cfg.LoudnessTarget),
+		CeilingDB:  float64(cfg.LimiterCeilingDB),
 	}
+}
 
-	zerolog.SetGlobalLevel(level)
+// createAudioMixer mixes the audio inputs named in the config
+func createAudioMixer(cfg *config.Config, frames <-chan mediapkg.AudioFrame, logger zerolog.Logger) *audio.Mixer {
+	// Validated by config
+	sources, _ := audio.ParseMixSources(cfg.AudioSources)
 
-	// Create logger with timestamp
-	logger := zerolog.New(output).
-		With().
-		Timestamp().
-		Str("service", "webrtc-gateway").
-		Logger()
+	mixes, _ := audio.ParseMixes(cfg.AudioMixes)
 
-	// Set as global logger
-	log.Logger = logger
+	return audio.NewMixer(audio.MixerConfig{
+		Sources:         sources,
+		Mixes:           mixes,
+		DuckSource:      cfg.AudioDuckSource,
+		DuckDB:          float64(cfg.AudioDuckDB),
+		DuckThresholdDB: float64(cfg.AudioDuckThreshDB),
+	}, frames, logger)
+}
+
+// createMixSelector lets viewers choose between the mixer's mixes, when
+// there is more than one and the peer manager can carry them
+func createMixSelector(cfg *config.Config, mixer *audio.Mixer, pm *webrtcpkg.PeerManager, logger zerolog.Logger) *audio.Selector {
+	mixes := mixer.Mixes()
+	if len(mixes) < 2 {
+		return nil
+	}
+	tw, ok := any(pm).(audio.MixTrackWriter)
+	if !ok {
+		logger.Warn().Strs("mixes", mixes).Msg("Peer manager cannot carry several audio mixes; viewers hear the default")
+		return nil
+	}
+
+	// Mixes keep the clock source's layout; fold each to stereo for WebRTC
+	// and level it like the default mix
+	downmixers := make(map[string]*audio.Downmixer)
+	levels := make(map[string]*audio.Normalizer)
+	for _, mix := range mixes[1:] {
+		downmixers[mix] = audio.NewDownmixer(audio.ModeITU)
+		if cfg.LoudnessTarget != 0 {
+			levels[mix] = audio.NewNormalizer(loudnessConfig(cfg))
+		}
+	}
+	mixer.SetMixSink(func(mix string, frame mediapkg.AudioFrame) {
+		stereo, err := downmixers[mix].Downmix(frame)
+		if err != nil {
+			return
+		}
+		if level := levels[mix]; level != nil {
+			if stereo, err = level.Process(stereo); err != nil {
+				return
+			}
+		}
+		if err := tw.WriteMixAudioFrame(mix, stereo); err != nil {
+			logger.Debug().Err(err).Str("mix", mix).Msg("Error writing audio mix frame")
+		}
+	})
+	return audio.NewSelector(mixes, tw, logger)
+}
+
+// createCoHost returns a co-host relay, or nil when the peer manager cannot
+// receive video from viewers or publish a second track
+func createCoHost(pm *webrtcpkg.PeerManager, bus *events.Bus, logger zerolog.Logger) *mediapkg.CoHost {
+	receiver, ok := any(pm).(mediapkg.CoHostReceiver)
+	if !ok {
+		return nil
+	}
+	publisher, ok := any(pm).(mediapkg.CoHostPublisher)
+	if !ok {
+		return nil
+	}
+
+	coHost := mediapkg.NewCoHost(receiver, publisher, logger)
+	coHost.SetOnChange(func(from, to string) {
+		bus.Publish(events.CoHostChanged, map[string]any{"from": from, "to": to})
+	})
+	return coHost
+}
 
-	return logger
+// createReturnChannel forwards audio that viewers send to the host, when the
+// peer manager accepts audio from viewers
+func createReturnChannel(cfg *config.Config, pm *webrtcpkg.PeerManager, logger zerolog.Logger) *mediapkg.ReturnChannel {
+	rc := mediapkg.NewReturnChannel(mediapkg.ReturnChannelConfig{SocketPath: cfg.ReturnSocketPath}, logger)
+	if src, ok := any(pm).(mediapkg.ReturnAudioSource); ok {
+		src.SetOnReturnAudio(rc.WriteAudio)
+	} else {
+		logger.Warn().Msg("Peer manager does not accept viewer audio; return channel will stay silent")
+	}
+	return rc
 }
 
-// startVideoDistribution connects pipeline output to peer manager
-// This runs in a goroutine and writes samples to all connected peers
-func startVideoDistribution(ctx context.Context, pipeline *mediapkg.Pipeline, pm *webrtcpkg.PeerManager, logger zerolog.Logger) {
+// createPeerStates tracks peer lifecycles and publishes each change. Peer
+// managers that do not report transitions still give connect and close.
+func createPeerStates(pm *webrtcpkg.PeerManager, bus *events.Bus, logger zerolog.Logger) *peerstate.Machine {
+	states := peerstate.New(logger)
+	if r, ok := any(pm).(peerstate.Reporter); ok {
+		states.Attach(r)
+	} else {
+		logger.Debug().Msg("Peer manager does not report connection transitions; peer states are connected and closed only")
+	}
+
+	changes, _ := states.Subscribe(256)
 	go func() {
-		frameChan := pipeline.VideoFrameChannel()
-		if frameChan == nil {
-			logger.Warn().Msg("No video frame channel available")
-			return
+		for ev := range changes {
+			bus.Publish(events.PeerState, map[string]any{
+				"peer_id":  ev.PeerID,
+				"state":    string(ev.State),
+				"previous": string(ev.Previous),
+				"reason":   ev.Reason,
+			})
 		}
+	}()
+	return states
+}
 
-		logger.Debug().Msg("Video distribution started")
-		frameDuration := time.Second / 30 // Default to 30fps duration
+// createReaper closes peers that stop sending RTCP while live media is sent
+// to them. It returns nil when the peer manager does not report RTCP or
+// expose peer connections.
+func createReaper(cfg *config.Config, pm *webrtcpkg.PeerManager, dist *mediapkg.Distributor, logger zerolog.Logger) *reaper.Reaper {
+	reporter, reports := any(pm).(reaper.RTCPReporter)
+	peers, exposes := any(pm).(reaper.Peers)
+	if !reports || !exposes {
+		logger.Warn().Msg("Peer manager does not report viewer RTCP; idle peers are not reaped")
+		return nil
+	}
+	r := reaper.New(reaper.Config{
+		Timeout: time.Duration(cfg.PeerIdleTimeoutSec) * time.Second,
+		Sending: func() bool { return dist.Stats().Live },
+	}, peers, logger)
+	r.Attach(reporter)
+	return r
+}
 
-		for {
-			select {
-			case <-ctx.Done():
-				logger.Debug().Msg("Video distribution stopped")
-				return
-			case frame, ok := <-frameChan:
-				if !ok {
-					logger.Debug().Msg("Video frame channel closed")
-					return
-				}
+// createPresence tracks each stream's viewers, locating them by the
+// configured networks when there are any
+func createPresence(cfg *config.Config, logger zerolog.Logger) *presence.Tracker {
+	if len(cfg.ViewerLocations) == 0 {
+		return presence.New(nil, logger)
+	}
+	networks, err := presence.ParseNetworks(cfg.ViewerLocations)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Invalid GATEWAY_VIEWER_LOCATIONS")
+	}
+	return presence.New(networks, logger)
+}
 
-				// Convert VideoFrame to media.Sample
-				sample := media.Sample{
-					Data:     frame.Data,
-					Duration: frameDuration,
-				}
+// peerAddress returns the remote address of a peer's selected candidate
+// pair, or "" when the peer manager does not expose peer connections
+func peerAddress(pm any, peerID string) string {
+	np, ok := pm.(negotiation.Peers)
+	if !ok {
+		return ""
+	}
+	pc, ok := np.PeerConnection(peerID)
+	if !ok {
+		return ""
+	}
+	for _, sender := range pc.GetSenders() {
+		transport := sender.Transport()
+		if transport == nil {
+			continue
+		}
+		pair, err := transport.ICETransport().GetSelectedCandidatePair()
+		if err == nil && pair != nil && pair.Remote != nil {
+			return pair.Remote.Address
+		}
+	}
+	return ""
+}
 
-				// Write to all connected peers
-				if err := pm.WriteVideoSample(sample); err != nil {
-					// Only log if we have connected peers
-					if pm.GetConnectedPeerCount() > 0 {
-						logger.Debug().Err(err).Msg("Error writing video sample")
-					}
-				}
+// createCodecDetector follows the stream's codec. With GATEWAY_VIDEO_CODEC
+// set to auto the video track is switched to match; otherwise a stream in
+// another codec is reported.
+func createCodecDetector(cfg *config.Config, initial string, pm *webrtcpkg.PeerManager, logger zerolog.Logger) *mediapkg.CodecDetector {
+	var tracks mediapkg.VideoCodecSetter
+	if cs, ok := any(pm).(mediapkg.VideoCodecSetter); ok {
+		tracks = cs
+	} else if cfg.VideoCodec == mediapkg.CodecAuto {
+		logger.Warn().Msg("Peer manager cannot change the video codec; the track stays H.264 and other codecs are reported as mismatches")
+	}
+	return mediapkg.NewCodecDetector(cfg.VideoCodec, initial, tracks, logger)
+}
+
+// createDistributor connects video source output to the peer manager, with
+// slates for pauses and source outages when the outgoing codec is H.264, and
+// per-peer layer limits for scalable video driven by connection quality and,
+// when the host is overloaded, capped at the base spatial layer. Peers that
+// subscribed without video are skipped. Taps and writes to peers are timed
+// against the frame budget when there is one.
+func createDistributor(cfg *config.Config, source mediapkg.FrameSource, pm *webrtcpkg.PeerManager, latency *mediapkg.LatencyTracker, clock *avsync.Clock, qm *quality.Monitor, guard *resources.Monitor, budget *mediapkg.FrameBudget, inspector *mediapkg.StreamInspector, subs *mediapkg.Subscriptions, codecs *mediapkg.CodecDetector, logger zerolog.Logger) *mediapkg.Distributor {
+	distConfig := mediapkg.DistributorConfig{
+		SourceTimeout: time.Duration(cfg.SourceTimeoutMs) * time.Millisecond,
+		Latency:       latency,
+		Clock:         clock,
+		Budget:        budget,
+		Inspector:     inspector,
+		LayerLimits:   qm.Limits,
+		Tracks:        subs.Tracks,
+	}
+	if guard != nil {
+		distConfig.LayerLimits = func(peerID string) svc.Limits {
+			limits := qm.Limits(peerID)
+			if guard.Overloaded() {
+				limits.MaxSpatial = 0
 			}
+			return limits
 		}
-	}()
+	}
+	if cfg.VideoCodec == "h264" || cfg.VideoCodec == mediapkg.CodecAuto {
+		// Slates are a couple of forced keyframes, which a hardware encoder
+		// only produces by restarting, so they are encoded in software
+		slateBackend := cfg.EncoderBackend
+		if slateBackend != "x264" && slateBackend != "pcm" {
+			slateBackend = "pcm"
+			if slices.Contains(encoder.Backends(), "x264") {
+				slateBackend = "x264"
+			}
+		}
+		distConfig.Slate = func(text string, width, height int) ([]mediapkg.VideoFrame, error) {
+			if codec := codecs.Codec(); codec != "h264" {
+				return nil, fmt.Errorf("slates are H.264; the video track is %s", codec)
+			}
+			return pattern.EncodeStill(pattern.NewSlate(text), encoder.Config{
+				Backend:     slateBackend,
+				Width:       width,
+				Height:      height,
+				BitrateKbps: cfg.MaxBitrateKbps,
+			}, 2)
+		}
+	}
+
+	return mediapkg.NewDistributor(distConfig, source, pm, logger)
 }
 
 // printBanner prints startup banner with ASCII art
@@ -261,37 +2622,124 @@ func printBanner() {
 
 // printReadyMessage prints the server ready message with connection info
 func printReadyMessage(cfg *config.Config) {
-	// Determine display address
-	addr := cfg.HTTPListenAddr
-	if addr[0] == ':' {
-		addr = "0.0.0.0" + addr
+	// Determine display addresses; wildcard listeners are shown with each
+	// local address so the URL can be typed on the headset
+	scheme := urlScheme(cfg.HTTPTLS())
+	addrs := displayAddrs(cfg.HTTPListenAddr)
+	addr := addrs[0]
+	var moreAddrs string
+	for _, a := range addrs[1:] {
+		moreAddrs += fmt.Sprintf("\n                      %s://%s", scheme, a)
 	}
 
 	var syntheticInfo string
 	if cfg.UseSynthetic {
+		patternName := mediapkg.PatternType(cfg.SyntheticPattern).String()
+		if cfg.SyntheticPatternName != "" {
+			patternName = cfg.SyntheticPatternName
+		}
 		syntheticInfo = fmt.Sprintf("%dx%d @ %dfps (%s)",
 			cfg.SyntheticWidth,
 			cfg.SyntheticHeight,
 			cfg.SyntheticFPS,
-			mediapkg.PatternType(cfg.SyntheticPattern).String())
+			patternName)
+	} else if len(cfg.Sources) > 0 {
+		syntheticInfo = fmt.Sprintf("disabled (failover: %s)", strings.Join(cfg.Sources, " -> "))
+	} else if cfg.UseV4L2 {
+		syntheticInfo = fmt.Sprintf("disabled (V4L2 mode: %s)", cfg.V4L2Device)
 	} else {
 		syntheticInfo = "disabled (IPC mode)"
 	}
 
+	adminInfo := "disabled"
+	if cfg.AdminListenAddr != "" {
+		adminInfo = urlScheme(cfg.AdminTLS()) + "://" + displayAddrs(cfg.AdminListenAddr)[0] + "/admin"
+	}
+
 	readyMsg := fmt.Sprintf(`
 
 ═══════════════════════════════════════════════════════════════
   Server ready!
   
-  Signaling endpoint: http://%s
-  Health check:       http://%s/webrtc/health
+  Signaling endpoint: %s://%s%s
+  Health check:       %s://%s/webrtc/health
+  Admin API:          %s
   
   Synthetic video:    %s
   
   Press Ctrl+C to stop
 ═══════════════════════════════════════════════════════════════
 
-`, addr, addr, syntheticInfo)
+`, scheme, addr, moreAddrs, scheme, addr, adminInfo, syntheticInfo)
 
 	fmt.Print(readyMsg)
 }
+
+// printConnectQR prints a QR code joining with a fresh invite, so a phone or
+// handheld can connect in one scan
+func printConnectQR(cfg *config.Config, invites *invite.Store, logger zerolog.Logger) {
+	inv, err := invites.Create("qr", time.Duration(cfg.QRInviteTTLSec)*time.Second, cfg.QRInviteMaxUses)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Failed to create QR invite")
+		return
+	}
+	link := invite.Link(connectURL(cfg), inv.Token)
+	code, err := qrcode.Encode(link, qrcode.Medium)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Failed to encode QR code")
+		return
+	}
+	fmt.Printf("  Scan to join (expires %s):\n\n%s\n  %s\n\n", inv.ExpiresAt.Format("15:04"), code.Text(), link)
+}
+
+// connectURL is the URL viewers open to join: the invite base URL, or the
+// signaling server at this machine's first address
+func connectURL(cfg *config.Config) string {
+	if cfg.InviteBaseURL != "" {
+		return cfg.InviteBaseURL
+	}
+	return urlScheme(cfg.HTTPTLS()) + "://" + displayAddrs(cfg.HTTPListenAddr)[0] + "/"
+}
+
+// urlScheme is the scheme of a listener's URLs
+func urlScheme(secure bool) string {
+	if secure {
+		return "https"
+	}
+	return "http"
+}
+
+// displayAddrs returns host:port forms of a listen address for display.
+// IPv6 hosts are bracketed. A wildcard host expands to the machine's
+// non-loopback addresses (IPv4 first), falling back to localhost.
+func displayAddrs(listenAddr string) []string {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return []string{listenAddr}
+	}
+	ip := net.ParseIP(host)
+	if host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return []string{net.JoinHostPort(host, port)}
+	}
+
+	// "" and "::" accept both families; "0.0.0.0" accepts IPv4 only
+	ipv4Only := ip != nil && ip.To4() != nil
+	var v4, v6 []string
+	ifaceAddrs, _ := net.InterfaceAddrs()
+	for _, a := range ifaceAddrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() != nil {
+			v4 = append(v4, net.JoinHostPort(ipnet.IP.String(), port))
+		} else if !ipv4Only {
+			v6 = append(v6, net.JoinHostPort(ipnet.IP.String(), port))
+		}
+	}
+	addrs := append(v4, v6...)
+	if len(addrs) == 0 {
+		addrs = []string{net.JoinHostPort("localhost", port)}
+	}
+	return addrs
+}
@@ -0,0 +1,287 @@
+// Package access enforces per-stream access policies on signaling. Each
+// stream is public, protected by a shared password, limited to holders of
+// one of a set of tokens, or limited to an allowlist of signed-in users.
+//
+// Viewers name the stream with the "stream" query parameter, defaulting to
+// DefaultStream, and present a password or token as the "key" query
+// parameter or the X-Stream-Key header. Streams the gateway does not serve
+// are refused, and once any policy is set, so are served streams without
+// one. Only signaling paths are checked, so the viewer portal itself still
+// loads and can ask for the password.
+package access
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+// Errors returned by Check
+var (
+	ErrKeyRequired   = errors.New("stream requires a password or token")
+	ErrInvalidKey    = errors.New("invalid stream password or token")
+	ErrSignInNeeded  = errors.New("stream requires sign-in")
+	ErrNotAllowed    = errors.New("user may not watch this stream")
+	ErrNoPolicy      = errors.New("stream has no access policy")
+	ErrUnknownStream = errors.New("no such stream")
+)
+
+// Request parameters naming the stream and carrying its key
+const (
+	StreamParam = "stream"
+	KeyParam    = "key"
+	KeyHeader   = "X-Stream-Key"
+)
+
+// DefaultStream is the stream of requests that do not name one
+const DefaultStream = "main"
+
+// AnyStream is the policy key applied to streams without their own policy
+const AnyStream = "*"
+
+// Mode is how a stream is protected
+type Mode string
+
+const (
+	ModePublic   Mode = "public"   // Anyone may watch
+	ModePassword Mode = "password" // Viewers need the shared password
+	ModeToken    Mode = "token"    // Viewers need one of the tokens
+	ModeUsers    Mode = "users"    // Viewers must be signed in and allowlisted
+)
+
+// Policy protects one stream
+type Policy struct {
+	Mode     Mode
+	Password string   // For ModePassword
+	Tokens   []string // For ModeToken
+	Users    []string // Emails or subjects, for ModeUsers
+}
+
+// Config configures the checker
+type Config struct {
+	// Policies by stream ID; AnyStream covers the rest. Streams without a
+	// policy are public while no policy is set, and refused once any is.
+	Policies map[string]Policy
+
+	// Streams are the IDs of the streams the gateway serves, default
+	// DefaultStream alone. Requests naming any other stream are refused.
+	Streams []string
+
+	// Paths are the signaling path prefixes checked, e.g. "/webrtc/"
+	Paths []string
+}
+
+// Stats are access counters
+type Stats struct {
+	Streams  map[string]Mode `json:"streams"`
+	Admitted uint64          `json:"admitted"`
+	Rejected uint64          `json:"rejected"`
+}
+
+// policy is a Policy prepared for checking; secrets are kept hashed
+type policy struct {
+	mode     Mode
+	password [sha256.Size]byte
+	tokens   [][sha256.Size]byte
+	users    map[string]bool
+}
+
+// Checker applies the policies to signaling requests
+type Checker struct {
+	logger   zerolog.Logger
+	policies map[string]*policy
+	streams  map[string]bool
+	paths    []string
+
+	// Statistics
+	admitted atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// New validates the policies and creates a checker
+func New(cfg Config, logger zerolog.Logger) (*Checker, error) {
+	c := &Checker{
+		logger:   logger.With().Str("component", "access").Logger(),
+		policies: make(map[string]*policy, len(cfg.Policies)),
+		streams:  make(map[string]bool, len(cfg.Streams)),
+		paths:    cfg.Paths,
+	}
+	if len(cfg.Streams) == 0 {
+		cfg.Streams = []string{DefaultStream}
+	}
+	for _, stream := range cfg.Streams {
+		c.streams[stream] = true
+	}
+	for stream, p := range cfg.Policies {
+		prepared, err := prepare(p)
+		if err != nil {
+			return nil, fmt.Errorf("stream %q: %w", stream, err)
+		}
+		c.policies[stream] = prepared
+	}
+	return c, nil
+}
+
+// Check decides whether a viewer may watch stream. key is the password or
+// token presented, identities those of the signed-in user, if any.
+func (c *Checker) Check(stream, key string, identities ...string) error {
+	if !c.streams[stream] {
+		return ErrUnknownStream
+	}
+	p, ok := c.policies[stream]
+	if !ok {
+		p = c.policies[AnyStream]
+	}
+	if p == nil {
+		if len(c.policies) > 0 {
+			return ErrNoPolicy
+		}
+		return nil
+	}
+
+	switch p.mode {
+	case ModePassword:
+		if key == "" {
+			return ErrKeyRequired
+		}
+		sum := sha256.Sum256([]byte(key))
+		if subtle.ConstantTimeCompare(sum[:], p.password[:]) != 1 {
+			return ErrInvalidKey
+		}
+	case ModeToken:
+		if key == "" {
+			return ErrKeyRequired
+		}
+		sum := sha256.Sum256([]byte(key))
+		match := 0
+		for _, t := range p.tokens {
+			match |= subtle.ConstantTimeCompare(sum[:], t[:])
+		}
+		if match != 1 {
+			return ErrInvalidKey
+		}
+	case ModeUsers:
+		if len(identities) == 0 {
+			return ErrSignInNeeded
+		}
+		allowed := false
+		for _, id := range identities {
+			if id != "" && p.users[strings.ToLower(id)] {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return ErrNotAllowed
+		}
+	}
+	return nil
+}
+
+// Middleware checks requests on the configured paths before next sees
+// them: 401 for a missing or wrong key or sign-in, 403 for a user not on
+// the allowlist or a stream without a policy, 404 for a stream the gateway
+// does not serve. identify returns the identities of the request's user; it
+// may be nil.
+func (c *Checker) Middleware(identify func(*http.Request) []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || !c.covers(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		stream := r.URL.Query().Get(StreamParam)
+		if stream == "" {
+			stream = DefaultStream
+		}
+		key := r.Header.Get(KeyHeader)
+		if key == "" {
+			key = r.URL.Query().Get(KeyParam)
+		}
+		var ids []string
+		if identify != nil {
+			ids = identify(r)
+		}
+
+		err := c.Check(stream, key, ids...)
+		if err != nil {
+			c.rejected.Add(1)
+			c.logger.Info().Err(err).Str("stream", stream).Str("remote_addr", r.RemoteAddr).Msg("Viewer refused")
+			status := http.StatusUnauthorized
+			switch {
+			case errors.Is(err, ErrNotAllowed), errors.Is(err, ErrNoPolicy):
+				status = http.StatusForbidden
+			case errors.Is(err, ErrUnknownStream):
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		c.admitted.Add(1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Stats returns each protected stream's mode and access counters
+func (c *Checker) Stats() Stats {
+	streams := make(map[string]Mode, len(c.policies))
+	for stream, p := range c.policies {
+		streams[stream] = p.mode
+	}
+	return Stats{
+		Streams:  streams,
+		Admitted: c.admitted.Load(),
+		Rejected: c.rejected.Load(),
+	}
+}
+
+// covers reports whether path is a checked signaling path
+func (c *Checker) covers(path string) bool {
+	for _, prefix := range c.paths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepare validates p and hashes its secrets
+func prepare(p Policy) (*policy, error) {
+	prepared := &policy{mode: p.Mode}
+	switch p.Mode {
+	case ModePublic, "":
+		prepared.mode = ModePublic
+	case ModePassword:
+		if p.Password == "" {
+			return nil, errors.New("password mode needs a password")
+		}
+		prepared.password = sha256.Sum256([]byte(p.Password))
+	case ModeToken:
+		for _, t := range p.Tokens {
+			if t = strings.TrimSpace(t); t != "" {
+				prepared.tokens = append(prepared.tokens, sha256.Sum256([]byte(t)))
+			}
+		}
+		if len(prepared.tokens) == 0 {
+			return nil, errors.New("token mode needs at least one token")
+		}
+	case ModeUsers:
+		prepared.users = make(map[string]bool, len(p.Users))
+		for _, u := range p.Users {
+			if u = strings.TrimSpace(u); u != "" {
+				prepared.users[strings.ToLower(u)] = true
+			}
+		}
+		if len(prepared.users) == 0 {
+			return nil, errors.New("users mode needs at least one user")
+		}
+	default:
+		return nil, fmt.Errorf("mode must be %q, %q, %q or %q", ModePublic, ModePassword, ModeToken, ModeUsers)
+	}
+	return prepared, nil
+}
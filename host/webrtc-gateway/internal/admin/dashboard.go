@@ -0,0 +1,75 @@
+package admin
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// dashboardFiles is the single-page admin dashboard. It only calls the
+// admin API, and hides the panels of features that are not enabled.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// WithDashboard serves the admin dashboard at /dashboard/
+func WithDashboard() Option {
+	return func(s *Server) {
+		s.dashboard = true
+	}
+}
+
+// dashboardFeatures tells the dashboard which panels and buttons to show
+type dashboardFeatures struct {
+	Pause      bool `json:"pause"`
+	Encoder    bool `json:"encoder"`
+	Clips      bool `json:"clips"`
+	Markers    bool `json:"markers"`
+	Preview    bool `json:"preview"`
+	Screenshot bool `json:"screenshot"`
+	Bans       bool `json:"bans"`
+	Kick       bool `json:"kick"`
+	Viewers    bool `json:"viewers"`
+	PeerStates bool `json:"peer_states"`
+	Events     bool `json:"events"`
+}
+
+// dashboardRoutes registers the dashboard and redirects / to it
+func (s *Server) dashboardRoutes() {
+	s.router.HandleFunc("/dashboard/features.json", s.handleDashboardFeatures).Methods(http.MethodGet)
+
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err) // The embedded directory always exists
+	}
+	static := http.StripPrefix("/dashboard/", http.FileServer(http.FS(files)))
+	s.router.PathPrefix("/dashboard/").Handler(revalidate(static)).Methods(http.MethodGet)
+	s.router.Handle("/dashboard", http.RedirectHandler("/dashboard/", http.StatusMovedPermanently)).Methods(http.MethodGet)
+	s.router.Handle("/", http.RedirectHandler("/dashboard/", http.StatusFound)).Methods(http.MethodGet)
+}
+
+// revalidate makes browsers check dashboard files again, so an upgraded
+// gateway is not served a stale page
+func revalidate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleDashboardFeatures lists the admin features this gateway enables
+func (s *Server) handleDashboardFeatures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, dashboardFeatures{
+		Pause:      s.pauser != nil,
+		Encoder:    s.encoder != nil,
+		Clips:      s.clips != nil,
+		Markers:    s.markers != nil,
+		Preview:    s.preview != nil,
+		Screenshot: s.screenshots != nil,
+		Bans:       s.bans != nil,
+		Kick:       s.kick != nil,
+		Viewers:    s.presence != nil,
+		PeerStates: s.peerStates != nil,
+		Events:     s.events != nil && s.status != nil,
+	})
+}
@@ -0,0 +1,402 @@
+// Admin dashboard: polls the admin API and follows /api/events. Panels for
+// features the gateway was started without are hidden.
+"use strict";
+
+const STREAM = "main";
+const POLL_MS = 2000;
+const GRAPH_SAMPLES = 150; // Five minutes at POLL_MS
+const MAX_EVENTS = 200;
+
+// Event types published on the gateway's event bus
+const EVENT_TYPES = [
+  "stream.started", "stream.stopped", "stream.paused", "stream.resumed",
+  "peer.joined", "peer.left", "peer.quality", "peer.state",
+  "recording.started", "recording.stopped", "marker.added", "highlight.clipped",
+  "source.switched", "source.stalled", "source.recovered", "source.restarted",
+  "capture.started", "capture.exited", "cohost.changed", "game.changed",
+  "director.command", "ipc.connected", "ipc.disconnected",
+  "resource.low", "resource.recovered",
+];
+
+const $ = (id) => document.getElementById(id);
+
+const state = {
+  features: {},
+  paused: false,
+  lastBytes: null,
+  lastTime: null,
+  bitrate: [],
+};
+
+// api calls the admin API and returns the decoded JSON body, or null for
+// an empty one. Errors carry the response status.
+async function api(method, path, body) {
+  const opts = { method, headers: {} };
+  if (body !== undefined) {
+    opts.headers["Content-Type"] = "application/json";
+    opts.body = JSON.stringify(body);
+  }
+  const resp = await fetch(path, opts);
+  if (!resp.ok) {
+    const err = new Error((await resp.text()).trim() || resp.statusText);
+    err.status = resp.status;
+    throw err;
+  }
+  const type = resp.headers.get("Content-Type") || "";
+  return type.startsWith("application/json") ? resp.json() : null;
+}
+
+function say(text) {
+  $("message").textContent = text;
+}
+
+async function detectFeatures() {
+  state.features = await api("GET", "/dashboard/features.json");
+
+  for (const el of document.querySelectorAll("[data-feature]")) {
+    el.hidden = !state.features[el.dataset.feature];
+  }
+  if (state.features.preview) {
+    $("preview-panel").hidden = false;
+    $("preview").src = "/api/preview.mjpeg";
+  } else if (state.features.screenshot) {
+    $("preview-panel").hidden = false;
+    refreshScreenshot();
+    setInterval(refreshScreenshot, 10000);
+  }
+}
+
+function refreshScreenshot() {
+  $("preview").src = "/api/screenshot?format=jpeg&quality=60&t=" + Date.now();
+}
+
+// Status badges and bitrate
+
+function showStatus(status) {
+  const p = status.pipeline || {};
+  const badge = $("status");
+  if (p.paused) {
+    badge.textContent = "paused";
+    badge.className = "badge fair";
+  } else if (p.live) {
+    badge.textContent = "live";
+    badge.className = "badge good";
+  } else {
+    badge.textContent = "offline";
+    badge.className = "badge poor";
+  }
+  state.paused = !!p.paused;
+  $("pause").textContent = state.paused ? "Resume" : "Pause";
+
+  if (status.ipc) {
+    const ipc = $("ipc");
+    ipc.hidden = false;
+    ipc.textContent = status.ipc.connected ? "capture connected" : "capture disconnected";
+    ipc.className = "badge " + (status.ipc.connected ? "good" : "poor");
+  }
+
+  if (status.stages) {
+    const stages = [["Video in", status.stages.video], ["Audio in", status.stages.audio], ["To peers", status.stages.distribution]];
+    $("stages").replaceChildren(...stages.filter(([, s]) => s).map(([name, s]) => stageRow(name, s)));
+  }
+
+  if (status.frame_budget) {
+    const b = status.frame_budget;
+    $("budget-panel").hidden = false;
+    $("budget").textContent = b.budget_us ? (b.budget_us / 1000).toFixed(1) + " ms" : "";
+    $("budget-stages").replaceChildren(...b.stages.map(budgetRow));
+  }
+}
+
+function budgetRow(s) {
+  const row = document.createElement("tr");
+  const cells = [
+    s.stage,
+    (s.mean_us / 1000).toFixed(2) + " ms",
+    (s.peak_us / 1000).toFixed(2) + " ms",
+    s.budget_percent.toFixed(0) + "%",
+    s.over_budget,
+  ];
+  for (const text of cells) {
+    const td = document.createElement("td");
+    td.textContent = text;
+    row.append(td);
+  }
+  if (s.budget_percent >= 100) {
+    row.children[3].className = "poor";
+  } else if (s.budget_percent >= 50) {
+    row.children[3].className = "fair";
+  }
+  return row;
+}
+
+function stageRow(name, s) {
+  const row = document.createElement("tr");
+  const cells = [
+    name,
+    s.fps.toFixed(1),
+    formatKbps(s.bitrate_kbps),
+    s.frames,
+    s.dropped,
+    s.queue_capacity ? s.queue_depth + " / " + s.queue_capacity : s.queue_depth,
+    s.last_frame_age_ms < 0 ? "never" : (s.last_frame_age_ms / 1000).toFixed(1) + " s ago",
+  ];
+  for (const text of cells) {
+    const td = document.createElement("td");
+    td.textContent = text;
+    row.append(td);
+  }
+  if (s.dropped > 0) {
+    row.children[4].className = "poor";
+  }
+  if (s.pressure) {
+    row.children[5].className = "poor";
+    row.children[5].title = "Under pressure since " + new Date(s.pressure.since).toLocaleTimeString();
+  }
+  return row;
+}
+
+async function pollStatus() {
+  let status;
+  try {
+    status = await api("GET", "/api/status");
+  } catch {
+    $("status").textContent = "unreachable";
+    $("status").className = "badge poor";
+    return;
+  }
+  showStatus(status);
+
+  const bytes = (status.pipeline || {}).bytes;
+  const now = performance.now();
+  if (typeof bytes === "number" && state.lastBytes !== null && bytes >= state.lastBytes) {
+    const kbps = ((bytes - state.lastBytes) * 8) / (now - state.lastTime);
+    state.bitrate.push(kbps);
+    if (state.bitrate.length > GRAPH_SAMPLES) {
+      state.bitrate.shift();
+    }
+    $("bitrate").textContent = formatKbps(kbps);
+    drawGraph();
+  }
+  state.lastBytes = bytes;
+  state.lastTime = now;
+}
+
+function formatKbps(kbps) {
+  return kbps >= 1000 ? (kbps / 1000).toFixed(1) + " Mbps" : Math.round(kbps) + " kbps";
+}
+
+function drawGraph() {
+  const canvas = $("graph");
+  const ctx = canvas.getContext("2d");
+  const w = canvas.width;
+  const h = canvas.height;
+  ctx.clearRect(0, 0, w, h);
+
+  const max = Math.max(1000, ...state.bitrate) * 1.1;
+  ctx.strokeStyle = "#2c333d";
+  ctx.fillStyle = "#8b94a3";
+  ctx.font = "11px system-ui";
+  for (let i = 1; i <= 3; i++) {
+    const y = h - (h * i) / 4;
+    ctx.beginPath();
+    ctx.moveTo(0, y);
+    ctx.lineTo(w, y);
+    ctx.stroke();
+    ctx.fillText(formatKbps((max * i) / 4), 4, y - 3);
+  }
+
+  ctx.strokeStyle = "#58a6ff";
+  ctx.lineWidth = 2;
+  ctx.beginPath();
+  state.bitrate.forEach((kbps, i) => {
+    const x = (w * i) / (GRAPH_SAMPLES - 1);
+    const y = h - (h * kbps) / max;
+    if (i === 0) {
+      ctx.moveTo(x, y);
+    } else {
+      ctx.lineTo(x, y);
+    }
+  });
+  ctx.stroke();
+}
+
+// Viewer table
+
+async function pollViewers() {
+  let viewers;
+  let states = {};
+  try {
+    viewers = await api("GET", "/api/streams/" + STREAM + "/viewers");
+  } catch {
+    return;
+  }
+  if (state.features.peer_states) {
+    try {
+      states = (await api("GET", "/api/stats/peers/states")).peers || {};
+    } catch {
+      // Shown without states
+    }
+  }
+
+  $("viewer-count").textContent = viewers.count;
+  const body = $("viewers");
+  body.replaceChildren(...viewers.viewers.map((v) => viewerRow(v, states[v.peer_id])));
+}
+
+function viewerRow(v, peerState) {
+  const row = document.createElement("tr");
+  const q = v.quality;
+  const cells = [
+    v.peer_id,
+    new Date(v.joined_at).toLocaleTimeString(),
+    v.location || v.address || "",
+    peerState || "",
+    q ? q.level + " (" + q.score.toFixed(1) + ")" : "",
+    q ? Math.round(q.last.rtt_ms) + " ms" : "",
+    q ? (q.last.loss * 100).toFixed(1) + "%" : "",
+  ];
+  for (const text of cells) {
+    const td = document.createElement("td");
+    td.textContent = text;
+    row.append(td);
+  }
+  if (q) {
+    row.children[4].className = q.level;
+  }
+
+  const actions = document.createElement("td");
+  actions.className = "actions";
+  if (state.features.kick) {
+    actions.append(button("Kick", () => kick(v.peer_id)));
+  }
+  if (state.features.bans && v.address) {
+    const banButton = button("Ban IP", () => ban(v.peer_id, v.address));
+    banButton.className = "danger";
+    actions.append(banButton);
+  }
+  row.append(actions);
+  return row;
+}
+
+function button(label, onClick) {
+  const b = document.createElement("button");
+  b.textContent = label;
+  b.addEventListener("click", onClick);
+  return b;
+}
+
+async function kick(peerID) {
+  try {
+    await api("POST", "/api/peers/" + encodeURIComponent(peerID) + "/kick");
+    say("Kicked " + peerID);
+  } catch (err) {
+    say("Kick failed: " + err.message);
+  }
+  pollViewers();
+}
+
+async function ban(peerID, address) {
+  const reason = prompt("Ban " + address + "? Reason (optional):");
+  if (reason === null) {
+    return;
+  }
+  try {
+    // The ban also disconnects the viewer when peers can be kicked
+    const peer = state.features.kick ? peerID : "";
+    await api("POST", "/api/bans", { ip: address, reason, peer_id: peer });
+    say("Banned " + address);
+  } catch (err) {
+    say("Ban failed: " + err.message);
+  }
+  pollViewers();
+}
+
+// Controls
+
+$("keyframe").addEventListener("click", async () => {
+  try {
+    await api("POST", "/api/encoder", { action: "keyframe" });
+    say("Keyframe requested");
+  } catch (err) {
+    say("Keyframe failed: " + err.message);
+  }
+});
+
+$("pause").addEventListener("click", async () => {
+  try {
+    const resp = await api("POST", state.paused ? "/admin/resume" : "/admin/pause");
+    state.paused = resp.paused;
+    $("pause").textContent = state.paused ? "Resume" : "Pause";
+    say(state.paused ? "Stream paused" : "Stream resumed");
+  } catch (err) {
+    say("Failed: " + err.message);
+  }
+});
+
+$("clip").addEventListener("click", async () => {
+  try {
+    const clip = await api("POST", "/api/clips");
+    say("Saved clip " + clip.id);
+  } catch (err) {
+    say("Saving clip failed: " + err.message);
+  }
+});
+
+$("marker").addEventListener("click", async () => {
+  try {
+    const marker = await api("POST", "/api/markers");
+    say("Dropped marker " + marker.id);
+  } catch (err) {
+    say("Dropping marker failed: " + err.message);
+  }
+});
+
+// Event feed
+
+function followEvents() {
+  const feed = new EventSource("/api/events");
+  feed.addEventListener("status", (e) => showStatus(JSON.parse(e.data)));
+  for (const type of EVENT_TYPES) {
+    feed.addEventListener(type, (e) => {
+      const ev = JSON.parse(e.data);
+      logEvent(ev);
+      if (type === "peer.joined" || type === "peer.left") {
+        pollViewers();
+      }
+    });
+  }
+}
+
+function logEvent(ev) {
+  const li = document.createElement("li");
+  const time = document.createElement("time");
+  time.textContent = new Date(ev.time).toLocaleTimeString();
+  li.append(time, ev.type + (ev.data ? " " + JSON.stringify(ev.data) : ""));
+
+  const list = $("events");
+  list.prepend(li);
+  while (list.children.length > MAX_EVENTS) {
+    list.lastChild.remove();
+  }
+}
+
+async function start() {
+  try {
+    await detectFeatures();
+  } catch (err) {
+    say("Gateway unreachable: " + err.message);
+    return;
+  }
+  if (state.features.events) {
+    followEvents();
+    pollStatus();
+    setInterval(pollStatus, POLL_MS);
+  }
+  if (state.features.viewers) {
+    pollViewers();
+    setInterval(pollViewers, POLL_MS);
+  }
+}
+
+start();
@@ -0,0 +1,59 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// processStart is reported as uptime in /debug/state
+var processStart = time.Now()
+
+// debugRoutes registers profiling and state dump endpoints. These expose
+// internals and cost CPU while profiling, so they are opt-in.
+func (s *Server) debugRoutes() {
+	// pprof.Index serves the named profiles and links relative to
+	// /debug/pprof/, so it must be mounted there
+	s.router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	s.router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	s.router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	s.router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	s.router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+
+	s.router.HandleFunc("/debug/state", s.handleState).Methods(http.MethodGet)
+}
+
+// runtimeState is the built-in section of /debug/state
+type runtimeState struct {
+	Goroutines    int     `json:"goroutines"`
+	GOMAXPROCS    int     `json:"gomaxprocs"`
+	HeapAllocMB   float64 `json:"heap_alloc_mb"`
+	HeapObjects   uint64  `json:"heap_objects"`
+	NumGC         uint32  `json:"num_gc"`
+	LastGCPauseUs uint64  `json:"last_gc_pause_us"`
+	Uptime        string  `json:"uptime"`
+}
+
+// handleState dumps runtime statistics and every registered state section
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	state := map[string]any{
+		"runtime": runtimeState{
+			Goroutines:    runtime.NumGoroutine(),
+			GOMAXPROCS:    runtime.GOMAXPROCS(0),
+			HeapAllocMB:   float64(mem.HeapAlloc) / (1 << 20),
+			HeapObjects:   mem.HeapObjects,
+			NumGC:         mem.NumGC,
+			LastGCPauseUs: mem.PauseNs[(mem.NumGC+255)%256] / 1000,
+			Uptime:        time.Since(processStart).Round(time.Second).String(),
+		},
+	}
+	for name, fn := range s.state {
+		state[name] = fn()
+	}
+
+	writeJSON(w, http.StatusOK, state)
+}
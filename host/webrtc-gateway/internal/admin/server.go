@@ -0,0 +1,2029 @@
+// Package admin provides the operator-facing HTTP API of the WebRTC Gateway.
+// It listens separately from the signaling server so it can be bound to
+// loopback or a private network.
+package admin
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/banlist"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/events"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/gop"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/highlight"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/invite"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/markers"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/audio"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/peerstate"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/presence"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/qrcode"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/quality"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/recording"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/replay"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/screenshot"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/sessionlog"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/stats"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/storage"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/tracing"
+)
+
+// ServerConfig configures the admin HTTP server
+type ServerConfig struct {
+	ListenAddr   string
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Listener, when set, is served instead of listening on ListenAddr,
+	// e.g. a socket passed by systemd
+	Listener net.Listener
+
+	// TLSConfig, when set, serves HTTPS with its certificates
+	TLSConfig *tls.Config
+
+	// Token, when set, is required on every request as a bearer token or
+	// as the password of HTTP basic auth, so the dashboard can prompt for it.
+	// Without it, only requests addressed to a loopback name or the listen
+	// address are served, so other sites cannot reach the API through DNS
+	// rebinding.
+	Token string
+}
+
+// Pauser pauses and resumes media forwarding.
+// media.Distributor satisfies it.
+type Pauser interface {
+	Pause()
+	Resume()
+	Paused() bool
+}
+
+// Option configures optional admin server features
+type Option func(*Server)
+
+// WithPauser enables the pause/resume endpoints
+func WithPauser(p Pauser) Option {
+	return func(s *Server) {
+		s.pauser = p
+	}
+}
+
+// CoHostController designates the viewer whose video is republished.
+// media.CoHost satisfies it.
+type CoHostController interface {
+	Peer() string
+	SetPeer(peerID string)
+}
+
+// WithCoHost enables the co-host endpoints
+func WithCoHost(c CoHostController) Option {
+	return func(s *Server) {
+		s.cohost = c
+	}
+}
+
+// InviteManager mints and revokes invite links.
+// invite.Store satisfies it.
+type InviteManager interface {
+	Create(label string, ttl time.Duration, maxUses int) (invite.Invite, error)
+	List() []invite.Invite
+	Revoke(id string) bool
+	InviteFor(peerID string) string
+}
+
+// WithInvites enables /api/invites
+func WithInvites(m InviteManager) Option {
+	return func(s *Server) {
+		s.invites = m
+	}
+}
+
+// WithConnectQR enables /connect/qr, which mints an invite for each request
+// and returns it as a QR code linking to connectURL. It needs WithInvites.
+func WithConnectQR(connectURL string, ttl time.Duration, maxUses int) Option {
+	return func(s *Server) {
+		s.connectURL = connectURL
+		s.qrTTL = ttl
+		s.qrMaxUses = maxUses
+	}
+}
+
+// BanManager bans viewers by IP or identity.
+// banlist.List satisfies it.
+type BanManager interface {
+	Add(kind banlist.Kind, value, reason string, ttl time.Duration) (banlist.Ban, error)
+	List() []banlist.Ban
+	Remove(id string) (bool, error)
+}
+
+// KickFunc disconnects a connected peer; it reports false if there is no
+// such peer
+type KickFunc func(peerID string) bool
+
+// WithBans enables /api/bans. kick, when not nil, lets a ban disconnect
+// the offending peer and enables /api/peers/{peer_id}/kick.
+func WithBans(m BanManager, kick KickFunc) Option {
+	return func(s *Server) {
+		s.bans = m
+		s.kick = kick
+	}
+}
+
+// SessionLog reads recorded signaling sessions.
+// sessionlog.Recorder satisfies it.
+type SessionLog interface {
+	List() ([]sessionlog.Summary, error)
+	Get(id string) (*sessionlog.Session, error)
+}
+
+// WithSessionLog enables /api/debug/sessions
+func WithSessionLog(l SessionLog) Option {
+	return func(s *Server) {
+		s.sessions = l
+	}
+}
+
+// ClipSaver saves and serves replay buffer clips.
+// replay.Buffer satisfies it.
+type ClipSaver interface {
+	Save(d time.Duration) (replay.Clip, error)
+	Clips() ([]replay.Clip, error)
+	Path(id string) (string, error)
+	Markers(id string) ([]replay.Marker, error)
+	Delete(id string) error
+}
+
+// WithClips enables /api/clips
+func WithClips(c ClipSaver) Option {
+	return func(s *Server) {
+		s.clips = c
+	}
+}
+
+// MarkerStore drops and lists markers for clips and recordings.
+// markers.Store satisfies it.
+type MarkerStore interface {
+	Add(label, peerID string) (markers.Marker, error)
+	List() []markers.Marker
+	Delete(id string) error
+}
+
+// WithMarkers enables /api/markers
+func WithMarkers(m MarkerStore) Option {
+	return func(s *Server) {
+		s.markers = m
+	}
+}
+
+// HighlightDetector lists highlight clips and takes game events.
+// highlight.Detector satisfies it.
+type HighlightDetector interface {
+	Trigger(t highlight.Trigger) (highlight.Highlight, error)
+	Highlights() []highlight.Highlight
+}
+
+// WithHighlights enables /api/highlights. webhook also lets game
+// integrations POST events there to clip.
+func WithHighlights(h HighlightDetector, webhook bool) Option {
+	return func(s *Server) {
+		s.highlights = h
+		s.webhook = webhook
+	}
+}
+
+// Recorder starts, schedules and serves recordings.
+// recording.Recorder satisfies it.
+type Recorder interface {
+	StartRecording(name string, d time.Duration) (recording.Recording, error)
+	StopRecording(id string) (recording.Recording, error)
+	Recordings() []recording.Recording
+	Get(id string) (recording.Recording, error)
+	Delete(id string) error
+	SegmentPath(id string, index int) (string, error)
+	Schedules() []recording.Schedule
+	AddSchedule(s recording.Schedule) (recording.Schedule, error)
+	RemoveSchedule(id string) error
+}
+
+// WithRecordings enables /api/recordings
+func WithRecordings(r Recorder) Option {
+	return func(s *Server) {
+		s.recordings = r
+	}
+}
+
+// Uploads lists uploaded clips and recordings and signs URLs for them.
+// storage.Uploader satisfies it.
+type Uploads interface {
+	Objects() []storage.Object
+	Get(key string) (storage.Object, error)
+	SignedURL(key string, ttl time.Duration) (string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// WithUploads enables /api/uploads. urlTTL is how long signed URLs are
+// valid unless a request asks otherwise.
+func WithUploads(u Uploads, urlTTL time.Duration) Option {
+	return func(s *Server) {
+		s.uploads = u
+		s.uploadTTL = urlTTL
+	}
+}
+
+// Screenshotter decodes the current game picture.
+// screenshot.Service satisfies it.
+type Screenshotter interface {
+	Capture(ctx context.Context, maxAge time.Duration) (screenshot.Screenshot, error)
+}
+
+// WithScreenshots enables /api/screenshot
+func WithScreenshots(c Screenshotter) Option {
+	return func(s *Server) {
+		s.screenshots = c
+	}
+}
+
+// PreviewSource serves the low frame rate preview.
+// preview.Service satisfies it.
+type PreviewSource interface {
+	Subscribe() (frames <-chan []byte, cancel func())
+	Latest() ([]byte, error)
+}
+
+// WithPreview enables /api/preview.mjpeg and /api/preview.jpg
+func WithPreview(p PreviewSource) Option {
+	return func(s *Server) {
+		s.preview = p
+	}
+}
+
+// CaptionSource serves recent captions.
+// captions.Track satisfies it.
+type CaptionSource interface {
+	WriteWebVTT(w io.Writer) error
+}
+
+// WithCaptions enables /api/captions.vtt
+func WithCaptions(c CaptionSource) Option {
+	return func(s *Server) {
+		s.captions = c
+	}
+}
+
+// EncoderControl commands the capture service's encoder.
+// media.IPCConsumer satisfies it.
+type EncoderControl interface {
+	Control(ctx context.Context, cmd media.ControlCommand) (media.ControlReply, error)
+}
+
+// WithEncoderControl enables /api/encoder
+func WithEncoderControl(c EncoderControl) Option {
+	return func(s *Server) {
+		s.encoder = c
+	}
+}
+
+// GOPController manages the capture service's keyframe interval.
+// gop.Controller satisfies it.
+type GOPController interface {
+	Status() gop.Status
+	SetInterval(d time.Duration) error
+}
+
+// WithGOP enables /api/encoder/gop
+func WithGOP(g GOPController) Option {
+	return func(s *Server) {
+		s.gop = g
+	}
+}
+
+// DirectorManager grants and revokes the director role, which lets a
+// viewer switch scenes and sources. director.Director satisfies it.
+type DirectorManager interface {
+	Directors() []string
+	Grant(peerID string)
+	Revoke(peerID string) bool
+}
+
+// WithDirector enables /api/directors
+func WithDirector(d DirectorManager) Option {
+	return func(s *Server) {
+		s.director = d
+	}
+}
+
+// AudioMixer adjusts the inputs mixed into the stream's audio.
+// audio.Mixer satisfies it.
+type AudioMixer interface {
+	Sources() []audio.SourceStatus
+	SetGain(name string, db float64) error
+	SetMuted(name string, muted bool) error
+}
+
+// WithAudioMixer enables /api/audio/mix
+func WithAudioMixer(m AudioMixer) Option {
+	return func(s *Server) {
+		s.mixer = m
+	}
+}
+
+// StatsHistory returns recorded per-minute stats.
+// stats.Store satisfies it.
+type StatsHistory interface {
+	Range(since, until time.Time) ([]stats.Minute, error)
+}
+
+// WithStatsHistory enables /api/stats/history
+func WithStatsHistory(h StatsHistory) Option {
+	return func(s *Server) {
+		s.history = h
+	}
+}
+
+// LatencyReporter reports pipeline latency percentiles.
+// media.LatencyTracker satisfies it.
+type LatencyReporter interface {
+	Stats() media.LatencyStats
+}
+
+// WithLatency enables /api/stats/latency
+func WithLatency(l LatencyReporter) Option {
+	return func(s *Server) {
+		s.latency = l
+	}
+}
+
+// PeerQualityReporter reports per-peer connection quality.
+// quality.Monitor satisfies it.
+type PeerQualityReporter interface {
+	Snapshot() []quality.PeerQuality
+}
+
+// WithPeerQuality enables /api/stats/peers
+func WithPeerQuality(q PeerQualityReporter) Option {
+	return func(s *Server) {
+		s.quality = q
+	}
+}
+
+// PeerStateReporter reports each peer's connection lifecycle state.
+// peerstate.Machine satisfies it.
+type PeerStateReporter interface {
+	States() map[string]peerstate.State
+}
+
+// WithPeerStates enables /api/stats/peers/states
+func WithPeerStates(p PeerStateReporter) Option {
+	return func(s *Server) {
+		s.peerStates = p
+	}
+}
+
+// PresenceTracker lists and streams each stream's viewers.
+// presence.Tracker satisfies it.
+type PresenceTracker interface {
+	Viewers(stream string) []presence.Viewer
+	Subscribe(stream string, bufferSize int) ([]presence.Viewer, <-chan presence.Event, func())
+}
+
+// WithPresence enables /api/streams/{id}/viewers and its event feed
+func WithPresence(p PresenceTracker) Option {
+	return func(s *Server) {
+		s.presence = p
+	}
+}
+
+// EventSource streams gateway events.
+// events.Bus satisfies it.
+type EventSource interface {
+	Subscribe(bufferSize int, types ...events.Type) (<-chan events.Event, func())
+}
+
+// WithEvents enables /api/events and /api/status. status returns the
+// gateway status served by /api/status and sent as the feed's first event;
+// the result is encoded as JSON.
+func WithEvents(src EventSource, status func() any) Option {
+	return func(s *Server) {
+		s.events = src
+		s.status = status
+	}
+}
+
+// AccessLog logs HTTP requests and is reconfigured at runtime.
+// logging.AccessLog satisfies it.
+type AccessLog interface {
+	Middleware(component string, next http.Handler) http.Handler
+	Stats() logging.AccessStats
+	Update(logging.AccessSettings) error
+}
+
+// WithAccessLog logs admin requests and enables /api/logging/access, which
+// also controls the signaling server's access log when shared with it
+func WithAccessLog(a AccessLog) Option {
+	return func(s *Server) {
+		s.accessLog = a
+	}
+}
+
+// StateFunc returns one section of the /debug/state dump; the result is
+// encoded as JSON
+type StateFunc func() any
+
+// WithDebug enables /debug/pprof and /debug/state
+func WithDebug() Option {
+	return func(s *Server) {
+		s.debug = true
+	}
+}
+
+// WithState adds a named section to /debug/state
+func WithState(name string, fn StateFunc) Option {
+	return func(s *Server) {
+		if s.state == nil {
+			s.state = make(map[string]StateFunc)
+		}
+		s.state[name] = fn
+	}
+}
+
+// Server is the admin HTTP server
+type Server struct {
+	cfg    ServerConfig
+	logger zerolog.Logger
+	router *mux.Router
+	server *http.Server
+
+	pauser      Pauser
+	cohost      CoHostController
+	invites     InviteManager
+	bans        BanManager
+	kick        KickFunc
+	sessions    SessionLog
+	clips       ClipSaver
+	recordings  Recorder
+	markers     MarkerStore
+	highlights  HighlightDetector
+	webhook     bool
+	uploads     Uploads
+	uploadTTL   time.Duration
+	screenshots Screenshotter
+	preview     PreviewSource
+	captions    CaptionSource
+	encoder     EncoderControl
+	gop         GOPController
+	director    DirectorManager
+	mixer       AudioMixer
+	history     StatsHistory
+	latency     LatencyReporter
+	quality     PeerQualityReporter
+	peerStates  PeerStateReporter
+	presence    PresenceTracker
+	events      EventSource
+	status      func() any
+	accessLog   AccessLog
+	dashboard   bool
+	debug       bool
+	state       map[string]StateFunc
+
+	connectURL string
+	qrTTL      time.Duration
+	qrMaxUses  int
+
+	mu      sync.Mutex
+	running bool
+}
+
+// NewServer creates an admin server; endpoints for features not supplied via
+// options are not registered
+func NewServer(cfg ServerConfig, logger zerolog.Logger, opts ...Option) *Server {
+	s := &Server{
+		cfg:    cfg,
+		logger: logger.With().Str("component", "admin_server").Logger(),
+		router: mux.NewRouter(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.routes()
+
+	var handler http.Handler = s.router
+	if cfg.Token != "" {
+		handler = requireToken(cfg.Token, handler)
+	} else {
+		handler = requireLocalHost(cfg, handler)
+	}
+	handler = refuseCrossSite(handler)
+	if s.accessLog != nil {
+		// Outermost, so refused requests are logged too
+		handler = s.accessLog.Middleware("admin", handler)
+	}
+	s.server = &http.Server{
+		Addr:         cfg.ListenAddr,
+		Handler:      tracing.Middleware("admin", handler),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		TLSConfig:    cfg.TLSConfig,
+	}
+
+	return s
+}
+
+// routes registers all admin endpoints
+func (s *Server) routes() {
+	api := s.router.PathPrefix("/admin").Subrouter()
+
+	if s.pauser != nil {
+		api.HandleFunc("/pause", s.handlePauseStatus).Methods(http.MethodGet)
+		api.HandleFunc("/pause", s.handlePause).Methods(http.MethodPost)
+		api.HandleFunc("/resume", s.handleResume).Methods(http.MethodPost)
+	}
+
+	if s.cohost != nil {
+		api.HandleFunc("/cohost", s.handleCoHostStatus).Methods(http.MethodGet)
+		api.HandleFunc("/cohost", s.handleSetCoHost).Methods(http.MethodPut)
+		api.HandleFunc("/cohost", s.handleClearCoHost).Methods(http.MethodDelete)
+	}
+
+	if s.invites != nil {
+		s.router.HandleFunc("/api/invites", s.handleListInvites).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/invites", s.handleCreateInvite).Methods(http.MethodPost)
+		s.router.HandleFunc("/api/invites/{id}", s.handleRevokeInvite).Methods(http.MethodDelete)
+		if s.connectURL != "" {
+			s.router.HandleFunc("/connect/qr", s.handleConnectQR).Methods(http.MethodGet)
+		}
+	}
+
+	if s.bans != nil {
+		s.router.HandleFunc("/api/bans", s.handleListBans).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/bans", s.handleCreateBan).Methods(http.MethodPost)
+		s.router.HandleFunc("/api/bans/{id}", s.handleRemoveBan).Methods(http.MethodDelete)
+		if s.kick != nil {
+			s.router.HandleFunc("/api/peers/{peer_id}/kick", s.handleKickPeer).Methods(http.MethodPost)
+		}
+	}
+
+	if s.sessions != nil {
+		s.router.HandleFunc("/api/debug/sessions", s.handleListSessions).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/debug/sessions/{id}", s.handleGetSession).Methods(http.MethodGet)
+	}
+
+	if s.clips != nil {
+		s.router.HandleFunc("/api/clips", s.handleListClips).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/clips", s.handleSaveClip).Methods(http.MethodPost)
+		s.router.HandleFunc("/api/clips/{id}", s.handleGetClip).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/clips/{id}", s.handleDeleteClip).Methods(http.MethodDelete)
+		s.router.HandleFunc("/api/clips/{id}/markers", s.handleClipMarkers).Methods(http.MethodGet)
+	}
+
+	if s.markers != nil {
+		s.router.HandleFunc("/api/markers", s.handleListMarkers).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/markers", s.handleAddMarker).Methods(http.MethodPost)
+		s.router.HandleFunc("/api/markers/{id}", s.handleDeleteMarker).Methods(http.MethodDelete)
+	}
+
+	if s.highlights != nil {
+		s.router.HandleFunc("/api/highlights", s.handleListHighlights).Methods(http.MethodGet)
+		if s.webhook {
+			s.router.HandleFunc("/api/highlights", s.handleHighlightEvent).Methods(http.MethodPost)
+		}
+	}
+
+	if s.recordings != nil {
+		// Schedules first, so "schedules" is not taken for a recording ID
+		s.router.HandleFunc("/api/recordings/schedules", s.handleListSchedules).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/recordings/schedules", s.handleAddSchedule).Methods(http.MethodPost)
+		s.router.HandleFunc("/api/recordings/schedules/{id}", s.handleRemoveSchedule).Methods(http.MethodDelete)
+		s.router.HandleFunc("/api/recordings", s.handleListRecordings).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/recordings", s.handleStartRecording).Methods(http.MethodPost)
+		s.router.HandleFunc("/api/recordings/{id}", s.handleGetRecording).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/recordings/{id}", s.handleDeleteRecording).Methods(http.MethodDelete)
+		s.router.HandleFunc("/api/recordings/{id}/stop", s.handleStopRecording).Methods(http.MethodPost)
+		s.router.HandleFunc("/api/recordings/{id}/segments/{n:[0-9]+}", s.handleGetSegment).Methods(http.MethodGet)
+	}
+
+	if s.uploads != nil {
+		// Keys are paths such as recordings/<id>/segment-0001.mp4
+		s.router.HandleFunc("/api/uploads", s.handleListUploads).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/uploads/{key:.+}", s.handleGetUpload).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/uploads/{key:.+}", s.handleDeleteUpload).Methods(http.MethodDelete)
+	}
+
+	if s.screenshots != nil {
+		s.router.HandleFunc("/api/screenshot", s.handleScreenshot).Methods(http.MethodGet)
+	}
+	if s.preview != nil {
+		s.router.HandleFunc("/api/preview.mjpeg", s.handlePreviewStream).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/preview.jpg", s.handlePreviewFrame).Methods(http.MethodGet)
+	}
+
+	if s.captions != nil {
+		s.router.HandleFunc("/api/captions.vtt", s.handleCaptions).Methods(http.MethodGet)
+	}
+
+	if s.encoder != nil {
+		s.router.HandleFunc("/api/encoder", s.handleEncoderStatus).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/encoder", s.handleEncoderCommand).Methods(http.MethodPost)
+	}
+
+	if s.gop != nil {
+		s.router.HandleFunc("/api/encoder/gop", s.handleGOPStatus).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/encoder/gop", s.handleSetGOP).Methods(http.MethodPut)
+	}
+
+	if s.director != nil {
+		s.router.HandleFunc("/api/directors", s.handleListDirectors).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/directors", s.handleGrantDirector).Methods(http.MethodPost)
+		s.router.HandleFunc("/api/directors/{peer_id}", s.handleRevokeDirector).Methods(http.MethodDelete)
+	}
+
+	if s.mixer != nil {
+		s.router.HandleFunc("/api/audio/mix", s.handleAudioMix).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/audio/mix/{source}", s.handleSetAudioSource).Methods(http.MethodPatch)
+	}
+
+	if s.history != nil {
+		s.router.HandleFunc("/api/stats/history", s.handleStatsHistory).Methods(http.MethodGet)
+	}
+	if s.latency != nil {
+		s.router.HandleFunc("/api/stats/latency", s.handleLatency).Methods(http.MethodGet)
+	}
+	if s.quality != nil {
+		s.router.HandleFunc("/api/stats/peers", s.handlePeerQuality).Methods(http.MethodGet)
+	}
+	if s.peerStates != nil {
+		s.router.HandleFunc("/api/stats/peers/states", s.handlePeerStates).Methods(http.MethodGet)
+	}
+
+	if s.events != nil {
+		s.router.HandleFunc("/api/events", s.handleEvents).Methods(http.MethodGet)
+		if s.status != nil {
+			s.router.HandleFunc("/api/status", s.handleStatus).Methods(http.MethodGet)
+		}
+	}
+
+	if s.presence != nil {
+		s.router.HandleFunc("/api/streams/{id}/viewers", s.handleViewers).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/streams/{id}/viewers/events", s.handleViewerEvents).Methods(http.MethodGet)
+	}
+
+	if s.accessLog != nil {
+		s.router.HandleFunc("/api/logging/access", s.handleAccessLogStatus).Methods(http.MethodGet)
+		s.router.HandleFunc("/api/logging/access", s.handleSetAccessLog).Methods(http.MethodPatch)
+	}
+
+	if s.dashboard {
+		s.dashboardRoutes()
+	}
+
+	if s.debug {
+		s.debugRoutes()
+	}
+}
+
+// Start begins serving in the background; returns once the listener is bound
+func (s *Server) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return errors.New("admin server already started")
+	}
+
+	listener := s.cfg.Listener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", s.cfg.ListenAddr)
+		if err != nil {
+			return err
+		}
+	}
+	s.running = true
+
+	go func() {
+		var err error
+		if s.cfg.TLSConfig != nil {
+			err = s.server.ServeTLS(listener, "", "")
+		} else {
+			err = s.server.Serve(listener)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error().Err(err).Msg("Admin server error")
+		}
+	}()
+
+	s.logger.Info().
+		Str("listen_addr", listener.Addr().String()).
+		Bool("tls", s.cfg.TLSConfig != nil).
+		Bool("token", s.cfg.Token != "").
+		Msg("Admin server listening")
+
+	return nil
+}
+
+// Stop gracefully shuts down the server
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.running {
+		return nil
+	}
+	s.running = false
+
+	return s.server.Shutdown(ctx)
+}
+
+// pauseResponse is the body of all pause endpoints
+type pauseResponse struct {
+	Paused bool `json:"paused"`
+}
+
+// handlePauseStatus reports whether forwarding is paused
+func (s *Server) handlePauseStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, pauseResponse{Paused: s.pauser.Paused()})
+}
+
+// handlePause pauses forwarding; idempotent
+func (s *Server) handlePause(w http.ResponseWriter, r *http.Request) {
+	s.pauser.Pause()
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Msg("Pause requested")
+	writeJSON(w, http.StatusOK, pauseResponse{Paused: s.pauser.Paused()})
+}
+
+// handleResume resumes forwarding; idempotent
+func (s *Server) handleResume(w http.ResponseWriter, r *http.Request) {
+	s.pauser.Resume()
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Msg("Resume requested")
+	writeJSON(w, http.StatusOK, pauseResponse{Paused: s.pauser.Paused()})
+}
+
+// coHostRequest is the body of PUT /admin/cohost, POST /api/directors and
+// of every co-host response
+type coHostRequest struct {
+	PeerID string `json:"peer_id"`
+}
+
+// handleCoHostStatus reports the designated co-host; peer_id is empty if
+// there is none
+func (s *Server) handleCoHostStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, coHostRequest{PeerID: s.cohost.Peer()})
+}
+
+// handleSetCoHost makes a viewer the co-host, replacing any other
+func (s *Server) handleSetCoHost(w http.ResponseWriter, r *http.Request) {
+	var req coHostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PeerID == "" {
+		http.Error(w, "body must be {\"peer_id\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	s.cohost.SetPeer(req.PeerID)
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("peer_id", req.PeerID).Msg("Co-host set")
+	writeJSON(w, http.StatusOK, coHostRequest{PeerID: s.cohost.Peer()})
+}
+
+// handleClearCoHost stops republishing co-host video; idempotent
+func (s *Server) handleClearCoHost(w http.ResponseWriter, r *http.Request) {
+	s.cohost.SetPeer("")
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Msg("Co-host cleared")
+	writeJSON(w, http.StatusOK, coHostRequest{})
+}
+
+// createInviteRequest is the body of POST /api/invites; zero values take
+// the defaults
+type createInviteRequest struct {
+	Label      string `json:"label"`
+	TTLSeconds int    `json:"ttl_seconds"`
+	MaxUses    int    `json:"max_uses"`
+}
+
+// handleListInvites lists invites without their tokens
+func (s *Server) handleListInvites(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.invites.List())
+}
+
+// handleCreateInvite mints an invite; the response is the only place its
+// token and URL appear
+func (s *Server) handleCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req createInviteRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TTLSeconds < 0 {
+			http.Error(w, "body must be {\"label\": \"...\", \"ttl_seconds\": N, \"max_uses\": N}", http.StatusBadRequest)
+			return
+		}
+	}
+	inv, err := s.invites.Create(req.Label, time.Duration(req.TTLSeconds)*time.Second, req.MaxUses)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("invite_id", inv.ID).Msg("Invite created")
+	writeJSON(w, http.StatusCreated, inv)
+}
+
+// handleRevokeInvite stops an invite admitting new peers
+func (s *Server) handleRevokeInvite(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if !s.invites.Revoke(id) {
+		http.Error(w, "invite not found", http.StatusNotFound)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("invite_id", id).Msg("Invite revoked")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleConnectQR mints a short-lived invite and returns its join link as a
+// QR code: a PNG by default, or text for a terminal with ?format=text
+func (s *Server) handleConnectQR(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "png" && format != "text" {
+		http.Error(w, "format must be png or text", http.StatusBadRequest)
+		return
+	}
+
+	inv, err := s.invites.Create("qr", s.qrTTL, s.qrMaxUses)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to create QR invite")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	link := invite.Link(s.connectURL, inv.Token)
+	code, err := qrcode.Encode(link, qrcode.Medium)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("invite_id", inv.ID).Msg("QR invite created")
+
+	// Every response carries a fresh token, so nothing may cache it
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Invite-Id", inv.ID)
+	h.Set("X-Invite-Expires", inv.ExpiresAt.UTC().Format(time.RFC3339))
+	if format == "text" {
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, code.Text()+link+"\n")
+		return
+	}
+	h.Set("Content-Type", "image/png")
+	_ = png.Encode(w, code.Image(8))
+}
+
+// createBanRequest is the body of POST /api/bans. Exactly one of IP and
+// Identity is set; PeerID, when set, is disconnected as well.
+type createBanRequest struct {
+	IP         string `json:"ip"`       // Address or CIDR network
+	Identity   string `json:"identity"` // Signed-in subject or email
+	Reason     string `json:"reason"`
+	TTLSeconds int    `json:"ttl_seconds"` // 0 is permanent
+	PeerID     string `json:"peer_id"`
+}
+
+// createBanResponse is the body of a successful POST /api/bans
+type createBanResponse struct {
+	banlist.Ban
+	Kicked bool `json:"kicked,omitempty"`
+}
+
+// handleListBans lists bans, newest first
+func (s *Server) handleListBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.bans.List())
+}
+
+// handleCreateBan bans an IP or identity from signaling and optionally
+// disconnects a peer that used it
+func (s *Server) handleCreateBan(w http.ResponseWriter, r *http.Request) {
+	var req createBanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TTLSeconds < 0 || (req.IP == "") == (req.Identity == "") {
+		http.Error(w, "body must be {\"ip\": \"...\"} or {\"identity\": \"...\"}, with optional reason, ttl_seconds and peer_id", http.StatusBadRequest)
+		return
+	}
+	if req.PeerID != "" && s.kick == nil {
+		http.Error(w, "peers cannot be disconnected", http.StatusNotImplemented)
+		return
+	}
+
+	kind, value := banlist.KindIP, req.IP
+	if req.Identity != "" {
+		kind, value = banlist.KindIdentity, req.Identity
+	}
+	ban, err := s.bans.Add(kind, value, req.Reason, time.Duration(req.TTLSeconds)*time.Second)
+	if errors.Is(err, banlist.ErrNotSaved) {
+		// The ban applies until restart
+		http.Error(w, "ban added but not saved", http.StatusInternalServerError)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp := createBanResponse{Ban: ban}
+	if req.PeerID != "" {
+		resp.Kicked = s.kick(req.PeerID)
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("ban_id", ban.ID).Str("value", ban.Value).
+		Bool("kicked", resp.Kicked).Msg("Ban added")
+	writeJSON(w, http.StatusCreated, resp)
+}
+
+// handleRemoveBan lifts a ban
+func (s *Server) handleRemoveBan(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	ok, err := s.bans.Remove(id)
+	if !ok {
+		http.Error(w, "ban not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		// The ban is lifted until restart
+		http.Error(w, "ban lifted but not saved", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("ban_id", id).Msg("Ban removed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleKickPeer disconnects a peer without banning it; it may reconnect
+func (s *Server) handleKickPeer(w http.ResponseWriter, r *http.Request) {
+	peerID := mux.Vars(r)["peer_id"]
+	if !s.kick(peerID) {
+		http.Error(w, "peer not found", http.StatusNotFound)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("peer_id", peerID).Msg("Peer kicked")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleListSessions lists recorded signaling sessions, newest first
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	list, err := s.sessions.List()
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to list recorded sessions")
+		http.Error(w, "failed to list recorded sessions", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleGetSession returns one recorded session with all its events
+func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	sess, err := s.sessions.Get(mux.Vars(r)["id"])
+	if errors.Is(err, sessionlog.ErrNotFound) {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to read recorded session")
+		http.Error(w, "failed to read recorded session", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, sess)
+}
+
+type saveClipRequest struct {
+	Seconds int `json:"seconds"`
+}
+
+// handleListClips lists saved clips, newest first
+func (s *Server) handleListClips(w http.ResponseWriter, r *http.Request) {
+	clips, err := s.clips.Clips()
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to list clips")
+		http.Error(w, "failed to list clips", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, clips)
+}
+
+// handleSaveClip saves the last N seconds of the stream, or the whole
+// replay buffer when seconds is omitted
+func (s *Server) handleSaveClip(w http.ResponseWriter, r *http.Request) {
+	var req saveClipRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Seconds < 0 {
+			http.Error(w, "body must be {\"seconds\": N}", http.StatusBadRequest)
+			return
+		}
+	}
+	clip, err := s.clips.Save(time.Duration(req.Seconds) * time.Second)
+	if errors.Is(err, replay.ErrEmpty) {
+		http.Error(w, "nothing buffered yet", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to save clip", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("clip_id", clip.ID).Msg("Clip saved")
+	w.Header().Set("Location", "/api/clips/"+clip.ID)
+	writeJSON(w, http.StatusCreated, clip)
+}
+
+// handleGetClip downloads a clip
+func (s *Server) handleGetClip(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	path, err := s.clips.Path(id)
+	if err != nil {
+		http.Error(w, "clip not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+id+`.mp4"`)
+	http.ServeFile(w, r, path)
+}
+
+// handleDeleteClip removes a clip
+func (s *Server) handleDeleteClip(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.clips.Delete(id); err != nil {
+		http.Error(w, "clip not found", http.StatusNotFound)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("clip_id", id).Msg("Clip deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleClipMarkers lists the chapters of a clip, for jumping to the
+// moments marked in it
+func (s *Server) handleClipMarkers(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	list, err := s.clips.Markers(id)
+	if errors.Is(err, replay.ErrNotFound) {
+		http.Error(w, "clip not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Str("clip_id", id).Msg("Failed to read clip markers")
+		http.Error(w, "failed to read clip markers", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+type addMarkerRequest struct {
+	Label string `json:"label"`
+}
+
+// handleListMarkers lists recent markers, oldest first
+func (s *Server) handleListMarkers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.markers.List())
+}
+
+// handleAddMarker drops a marker at the current point of the stream
+func (s *Server) handleAddMarker(w http.ResponseWriter, r *http.Request) {
+	var req addMarkerRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "body must be {\"label\": \"...\"}", http.StatusBadRequest)
+			return
+		}
+	}
+	m, err := s.markers.Add(req.Label, "")
+	if errors.Is(err, markers.ErrNoStream) {
+		http.Error(w, "no video to mark yet", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "failed to add marker", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("marker_id", m.ID).Msg("Marker added")
+	writeJSON(w, http.StatusCreated, m)
+}
+
+// handleDeleteMarker removes a marker; clips and recordings already
+// written keep it
+func (s *Server) handleDeleteMarker(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.markers.Delete(id); err != nil {
+		http.Error(w, "marker not found", http.StatusNotFound)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("marker_id", id).Msg("Marker deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// highlightEvent is a game event reported by an integration, such as
+// {"event": "ace", "label": "Ace on B site", "score": 0.9}
+type highlightEvent struct {
+	Event string  `json:"event"`
+	Label string  `json:"label"`
+	Score float64 `json:"score"`
+}
+
+// handleListHighlights lists recent highlights, oldest first
+func (s *Server) handleListHighlights(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.highlights.Highlights())
+}
+
+// handleHighlightEvent clips a game event. The clip is saved after the
+// post-roll, so the response only names the highlight it joins.
+func (s *Server) handleHighlightEvent(w http.ResponseWriter, r *http.Request) {
+	var req highlightEvent
+	if err := json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&req); err != nil ||
+		(req.Event == "" && req.Label == "") || req.Score < 0 || req.Score > 1 {
+		http.Error(w, "body must be {\"event\": \"...\", \"label\": \"...\", \"score\": 0-1}", http.StatusBadRequest)
+		return
+	}
+	reason := req.Label
+	if reason == "" {
+		reason = req.Event
+	}
+	h, err := s.highlights.Trigger(highlight.Trigger{Analyzer: "webhook", Reason: reason, Score: req.Score})
+	switch {
+	case errors.Is(err, highlight.ErrTooSoon):
+		http.Error(w, "too soon after the last highlight", http.StatusTooManyRequests)
+		return
+	case err != nil:
+		http.Error(w, "highlight detection stopped", http.StatusServiceUnavailable)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("highlight_id", h.ID).Str("event", req.Event).Msg("Highlight event received")
+	writeJSON(w, http.StatusAccepted, h)
+}
+
+type startRecordingRequest struct {
+	Name        string `json:"name"`
+	DurationSec int    `json:"duration_sec"`
+}
+
+// handleListRecordings lists recordings, newest first
+func (s *Server) handleListRecordings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.recordings.Recordings())
+}
+
+// handleStartRecording starts a recording, running until stopped or for
+// duration_sec when given
+func (s *Server) handleStartRecording(w http.ResponseWriter, r *http.Request) {
+	var req startRecordingRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.DurationSec < 0 {
+			http.Error(w, "body must be {\"name\": \"...\", \"duration_sec\": N}", http.StatusBadRequest)
+			return
+		}
+	}
+	rec, err := s.recordings.StartRecording(req.Name, time.Duration(req.DurationSec)*time.Second)
+	if errors.Is(err, recording.ErrActive) {
+		http.Error(w, "a recording is already in progress", http.StatusConflict)
+		return
+	}
+	if errors.Is(err, recording.ErrRefused) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to start recording")
+		http.Error(w, "failed to start recording", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("recording_id", rec.ID).Msg("Recording started")
+	w.Header().Set("Location", "/api/recordings/"+rec.ID)
+	writeJSON(w, http.StatusCreated, rec)
+}
+
+// handleGetRecording describes a recording and its segments
+func (s *Server) handleGetRecording(w http.ResponseWriter, r *http.Request) {
+	rec, err := s.recordings.Get(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// handleStopRecording stops the active recording
+func (s *Server) handleStopRecording(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	rec, err := s.recordings.StopRecording(id)
+	switch {
+	case errors.Is(err, recording.ErrNotFound):
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return
+	case errors.Is(err, recording.ErrNotActive):
+		http.Error(w, "recording is not in progress", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "failed to stop recording", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("recording_id", id).Msg("Recording stopped")
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// handleDeleteRecording removes a finished recording and its segments
+func (s *Server) handleDeleteRecording(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := s.recordings.Delete(id)
+	switch {
+	case errors.Is(err, recording.ErrNotFound):
+		http.Error(w, "recording not found", http.StatusNotFound)
+		return
+	case errors.Is(err, recording.ErrActive):
+		http.Error(w, "recording is in progress", http.StatusConflict)
+		return
+	case err != nil:
+		s.logger.Error().Err(err).Str("recording_id", id).Msg("Failed to delete recording")
+		http.Error(w, "failed to delete recording", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("recording_id", id).Msg("Recording deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleGetSegment downloads a segment of a recording, numbered from 0 as
+// in its description
+func (s *Server) handleGetSegment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	n, err := strconv.Atoi(vars["n"])
+	if err != nil {
+		http.Error(w, "segment not found", http.StatusNotFound)
+		return
+	}
+	path, err := s.recordings.SegmentPath(vars["id"], n)
+	if err != nil {
+		http.Error(w, "segment not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+vars["id"]+"-"+strconv.Itoa(n+1)+`.mp4"`)
+	http.ServeFile(w, r, path)
+}
+
+// handleListSchedules lists recording schedules, soonest first
+func (s *Server) handleListSchedules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.recordings.Schedules())
+}
+
+// handleAddSchedule schedules a recording. The body is a recording.Schedule
+// without its ID.
+func (s *Server) handleAddSchedule(w http.ResponseWriter, r *http.Request) {
+	var req recording.Schedule
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid schedule", http.StatusBadRequest)
+		return
+	}
+	sched, err := s.recordings.AddSchedule(req)
+	if errors.Is(err, recording.ErrInvalidSchedule) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to add recording schedule")
+		http.Error(w, "failed to add schedule", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("schedule_id", sched.ID).Msg("Recording scheduled")
+	w.Header().Set("Location", "/api/recordings/schedules/"+sched.ID)
+	writeJSON(w, http.StatusCreated, sched)
+}
+
+// handleRemoveSchedule removes a recording schedule
+func (s *Server) handleRemoveSchedule(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	err := s.recordings.RemoveSchedule(id)
+	if errors.Is(err, recording.ErrNotFound) {
+		http.Error(w, "schedule not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to remove recording schedule")
+		http.Error(w, "failed to remove schedule", http.StatusInternalServerError)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("schedule_id", id).Msg("Recording schedule removed")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// uploadResponse is an uploaded object with a signed URL to fetch it
+type uploadResponse struct {
+	storage.Object
+	URL          string     `json:"url,omitempty"`
+	URLExpiresAt *time.Time `json:"url_expires_at,omitempty"`
+}
+
+// handleListUploads lists queued and uploaded objects, newest first
+func (s *Server) handleListUploads(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.uploads.Objects())
+}
+
+// handleGetUpload describes an object, with a signed URL once it is
+// uploaded. ?ttl_sec sets how long the URL is valid; ?redirect=true
+// redirects to it instead.
+func (s *Server) handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	q := r.URL.Query()
+	ttl := s.uploadTTL
+	if v := q.Get("ttl_sec"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 7*24*3600 {
+			http.Error(w, "ttl_sec must be between 1 and 604800", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(n) * time.Second
+	}
+
+	obj, err := s.uploads.Get(key)
+	if err != nil {
+		http.Error(w, "object not found", http.StatusNotFound)
+		return
+	}
+	resp := uploadResponse{Object: obj}
+	if obj.State == storage.StateUploaded {
+		url, err := s.uploads.SignedURL(key, ttl)
+		if err != nil {
+			s.logger.Error().Err(err).Str("key", key).Msg("Failed to sign upload URL")
+			http.Error(w, "failed to sign URL", http.StatusInternalServerError)
+			return
+		}
+		expires := time.Now().Add(ttl).UTC()
+		resp.URL, resp.URLExpiresAt = url, &expires
+	}
+
+	if q.Get("redirect") == "true" {
+		if resp.URL == "" {
+			http.Error(w, "object is not uploaded yet", http.StatusConflict)
+			return
+		}
+		s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("key", key).Msg("Redirecting to uploaded object")
+		http.Redirect(w, r, resp.URL, http.StatusFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handleDeleteUpload removes an object from the bucket, or from the upload
+// queue; the local file is kept
+func (s *Server) handleDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	err := s.uploads.Delete(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, "object not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Str("key", key).Msg("Failed to delete uploaded object")
+		http.Error(w, "failed to delete object", http.StatusBadGateway)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("key", key).Msg("Uploaded object deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleScreenshot returns the current game picture as a PNG, or a JPEG
+// with ?format=jpeg and an optional quality. ?max_age_ms sets how old the
+// keyframe may be before a fresh one is requested, default 1000.
+func (s *Server) handleScreenshot(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format != "" && format != "png" && format != "jpeg" && format != "jpg" {
+		http.Error(w, "format must be png or jpeg", http.StatusBadRequest)
+		return
+	}
+	quality := jpeg.DefaultQuality
+	if v := q.Get("quality"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			http.Error(w, "quality must be between 1 and 100", http.StatusBadRequest)
+			return
+		}
+		quality = n
+	}
+	maxAge := time.Second
+	if v := q.Get("max_age_ms"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "max_age_ms must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		maxAge = time.Duration(n) * time.Millisecond
+	}
+
+	shot, err := s.screenshots.Capture(r.Context(), maxAge)
+	if errors.Is(err, screenshot.ErrNoKeyframe) {
+		http.Error(w, "no video available", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to capture screenshot")
+		http.Error(w, "failed to capture screenshot", http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Cache-Control", "no-store")
+	h.Set("Last-Modified", shot.CapturedAt.UTC().Format(http.TimeFormat))
+	if format == "jpeg" || format == "jpg" {
+		h.Set("Content-Type", "image/jpeg")
+		_ = jpeg.Encode(w, shot.Image, &jpeg.Options{Quality: quality})
+		return
+	}
+	h.Set("Content-Type", "image/png")
+	_ = png.Encode(w, shot.Image)
+}
+
+// previewBoundary separates the parts of the MJPEG stream
+const previewBoundary = "preview-frame"
+
+// handlePreviewStream streams the preview as multipart MJPEG, which an
+// <img> element plays directly
+func (s *Server) handlePreviewStream(w http.ResponseWriter, r *http.Request) {
+	// The stream outlives the server write timeout
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	frames, cancel := s.preview.Subscribe()
+	defer cancel()
+
+	h := w.Header()
+	h.Set("Content-Type", "multipart/x-mixed-replace; boundary="+previewBoundary)
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	_ = rc.Flush()
+
+	for {
+		select {
+		case frame := <-frames:
+			part := "--" + previewBoundary + "\r\nContent-Type: image/jpeg\r\nContent-Length: " + strconv.Itoa(len(frame)) + "\r\n\r\n"
+			if _, err := io.WriteString(w, part); err != nil {
+				return
+			}
+			if _, err := w.Write(frame); err != nil {
+				return
+			}
+			if _, err := io.WriteString(w, "\r\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handlePreviewFrame returns the latest preview frame. Polling keeps the
+// preview rendering, so the first request after a quiet spell may get 503.
+func (s *Server) handlePreviewFrame(w http.ResponseWriter, r *http.Request) {
+	frame, err := s.preview.Latest()
+	if err != nil {
+		http.Error(w, "no preview available", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(frame)
+}
+
+// handleCaptions returns recent captions as WebVTT
+func (s *Server) handleCaptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := s.captions.WriteWebVTT(w); err != nil {
+		s.logger.Debug().Err(err).Msg("Failed to write captions")
+	}
+}
+
+// handleEncoderStatus asks the capture service for its encoder settings
+func (s *Server) handleEncoderStatus(w http.ResponseWriter, r *http.Request) {
+	s.encoderControl(w, r, media.ControlCommand{Action: media.ControlStatus})
+}
+
+// handleEncoderCommand sends a command such as
+// {"action": "set_bitrate", "bitrate_kbps": 6000} to the capture service
+func (s *Server) handleEncoderCommand(w http.ResponseWriter, r *http.Request) {
+	var cmd media.ControlCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		http.Error(w, "body must be {\"action\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	cmd.ID = 0
+	if err := cmd.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("action", string(cmd.Action)).Msg("Encoder command")
+	s.encoderControl(w, r, cmd)
+}
+
+// encoderControl sends cmd and writes the capture service's reply
+func (s *Server) encoderControl(w http.ResponseWriter, r *http.Request, cmd media.ControlCommand) {
+	reply, err := s.encoder.Control(r.Context(), cmd)
+	switch {
+	case errors.Is(err, media.ErrNoProducer), errors.Is(err, media.ErrControlTransport):
+		http.Error(w, "capture service is not connected or cannot take commands", http.StatusServiceUnavailable)
+	case errors.Is(err, media.ErrControlTimeout):
+		http.Error(w, "capture service did not answer", http.StatusGatewayTimeout)
+	case errors.Is(err, media.ErrControlFailed):
+		writeJSON(w, http.StatusBadGateway, reply)
+	case err != nil:
+		http.Error(w, "failed to send command", http.StatusInternalServerError)
+	default:
+		writeJSON(w, http.StatusOK, reply)
+	}
+}
+
+// gopRequest is the body of PUT /api/encoder/gop
+type gopRequest struct {
+	IntervalMs *int64 `json:"interval_ms"`
+}
+
+// handleGOPStatus reports the target and effective keyframe interval
+func (s *Server) handleGOPStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.gop.Status())
+}
+
+// handleSetGOP sets the target keyframe interval; 0 stops managing it
+func (s *Server) handleSetGOP(w http.ResponseWriter, r *http.Request) {
+	var req gopRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IntervalMs == nil {
+		http.Error(w, "body must be {\"interval_ms\": N}", http.StatusBadRequest)
+		return
+	}
+	if err := s.gop.SetInterval(time.Duration(*req.IntervalMs) * time.Millisecond); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Int64("interval_ms", *req.IntervalMs).Msg("Keyframe interval set")
+	writeJSON(w, http.StatusOK, s.gop.Status())
+}
+
+// accessLogRequest is the body of PATCH /api/logging/access; omitted
+// fields keep their value
+type accessLogRequest struct {
+	Enabled    *bool    `json:"enabled"`
+	SampleRate *float64 `json:"sample_rate"`
+	SlowMs     *int     `json:"slow_ms"`
+}
+
+// handleAccessLogStatus reports the access log settings and counters
+func (s *Server) handleAccessLogStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.accessLog.Stats())
+}
+
+// handleSetAccessLog turns the access log on or off and changes its
+// sampling without a restart
+func (s *Server) handleSetAccessLog(w http.ResponseWriter, r *http.Request) {
+	var req accessLogRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "body must be {\"enabled\": bool, \"sample_rate\": N, \"slow_ms\": N}", http.StatusBadRequest)
+		return
+	}
+	settings := s.accessLog.Stats().AccessSettings
+	if req.Enabled != nil {
+		settings.Enabled = *req.Enabled
+	}
+	if req.SampleRate != nil {
+		settings.SampleRate = *req.SampleRate
+	}
+	if req.SlowMs != nil {
+		settings.SlowMs = *req.SlowMs
+	}
+	if err := s.accessLog.Update(settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.logger.Info().
+		Str("remote_addr", r.RemoteAddr).
+		Bool("enabled", settings.Enabled).
+		Float64("sample_rate", settings.SampleRate).
+		Int("slow_ms", settings.SlowMs).
+		Msg("Access log settings changed")
+	writeJSON(w, http.StatusOK, s.accessLog.Stats())
+}
+
+// directorsResponse is the body of every /api/directors response
+type directorsResponse struct {
+	Directors []string `json:"directors"`
+}
+
+// handleListDirectors lists the peers holding the director role
+func (s *Server) handleListDirectors(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, directorsResponse{Directors: s.director.Directors()})
+}
+
+// handleGrantDirector makes a connected viewer a director; the role ends
+// when the viewer leaves
+func (s *Server) handleGrantDirector(w http.ResponseWriter, r *http.Request) {
+	var req coHostRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.PeerID == "" {
+		http.Error(w, "body must be {\"peer_id\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+	s.director.Grant(req.PeerID)
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("peer_id", req.PeerID).Msg("Director granted")
+	writeJSON(w, http.StatusOK, directorsResponse{Directors: s.director.Directors()})
+}
+
+// handleRevokeDirector takes the director role from a viewer
+func (s *Server) handleRevokeDirector(w http.ResponseWriter, r *http.Request) {
+	peerID := mux.Vars(r)["peer_id"]
+	if !s.director.Revoke(peerID) {
+		http.Error(w, "peer is not a director", http.StatusNotFound)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("peer_id", peerID).Msg("Director revoked")
+	writeJSON(w, http.StatusOK, directorsResponse{Directors: s.director.Directors()})
+}
+
+// audioSourceRequest is the body of PATCH /api/audio/mix/{source}; absent
+// fields are left unchanged
+type audioSourceRequest struct {
+	GainDB *float64 `json:"gain_db"`
+	Muted  *bool    `json:"muted"`
+}
+
+// handleAudioMix lists the mixer inputs with their levels
+func (s *Server) handleAudioMix(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.mixer.Sources())
+}
+
+// handleSetAudioSource changes an input's gain or mute
+func (s *Server) handleSetAudioSource(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["source"]
+	var req audioSourceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.GainDB == nil && req.Muted == nil) {
+		http.Error(w, "body must set gain_db or muted", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if req.GainDB != nil {
+		err = s.mixer.SetGain(name, *req.GainDB)
+	}
+	if err == nil && req.Muted != nil {
+		err = s.mixer.SetMuted(name, *req.Muted)
+	}
+	switch {
+	case errors.Is(err, audio.ErrUnknownSource):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.logger.Info().Str("remote_addr", r.RemoteAddr).Str("source", name).Msg("Audio source changed")
+	writeJSON(w, http.StatusOK, s.mixer.Sources())
+}
+
+// statsHistoryResponse is the body of /api/stats/history
+type statsHistoryResponse struct {
+	Since   time.Time      `json:"since"`
+	Until   time.Time      `json:"until"`
+	Minutes []stats.Minute `json:"minutes"`
+}
+
+// handleStatsHistory returns per-minute stats between since and until
+// (RFC 3339), defaulting to the last 24 hours
+func (s *Server) handleStatsHistory(w http.ResponseWriter, r *http.Request) {
+	until := time.Now().UTC()
+	since := until.Add(-24 * time.Hour)
+
+	q := r.URL.Query()
+	if v := q.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	if v := q.Get("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, "until must be an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+		until = t
+	}
+	if until.Before(since) {
+		http.Error(w, "until must not be before since", http.StatusBadRequest)
+		return
+	}
+
+	minutes, err := s.history.Range(since, until)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to read stats history")
+		http.Error(w, "failed to read stats history", http.StatusInternalServerError)
+		return
+	}
+	if minutes == nil {
+		minutes = []stats.Minute{}
+	}
+
+	writeJSON(w, http.StatusOK, statsHistoryResponse{Since: since, Until: until, Minutes: minutes})
+}
+
+// handleLatency returns capture, ingest, delivery and glass-to-glass latency
+// percentiles over the recent window
+func (s *Server) handleLatency(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.latency.Stats())
+}
+
+// peerStatesResponse is the body of /api/stats/peers/states
+type peerStatesResponse struct {
+	Peers map[string]peerstate.State `json:"peers"`
+}
+
+// handlePeerStates returns every peer's connection lifecycle state
+func (s *Server) handlePeerStates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, peerStatesResponse{Peers: s.peerStates.States()})
+}
+
+// sseKeepalive is how often event feeds send a comment so proxies keep an
+// idle connection open
+const sseKeepalive = 15 * time.Second
+
+// handleEvents streams gateway events as Server-Sent Events: a "status"
+// event with the current gateway status, then every event published, named
+// by its type and carrying its ID. ?types= limits the feed to a
+// comma-separated list of event types.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	var types []events.Type
+	if v := r.URL.Query().Get("types"); v != "" {
+		for _, name := range strings.Split(v, ",") {
+			t, err := events.ParseType(strings.TrimSpace(name))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			types = append(types, t)
+		}
+	}
+
+	// The feed outlives the server write timeout
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	// Subscribe before reading the status so no change falls in between
+	feed, cancel := s.events.Subscribe(256, types...)
+	defer cancel()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if s.status != nil {
+		if err := writeEvent(w, "status", s.status()); err != nil {
+			return
+		}
+	}
+	_ = rc.Flush()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev, ok := <-feed:
+			if !ok {
+				return
+			}
+			if _, err := io.WriteString(w, "id: "+ev.ID+"\n"); err != nil {
+				return
+			}
+			if err := writeEvent(w, string(ev.Type), ev); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// handleStatus returns the gateway status
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+// viewer is a presence.Viewer with its connection quality
+type viewer struct {
+	presence.Viewer
+	Quality *quality.PeerQuality `json:"quality,omitempty"`
+}
+
+// viewersResponse is the body of /api/streams/{id}/viewers and of the
+// snapshot event opening its feed
+type viewersResponse struct {
+	Stream  string   `json:"stream"`
+	Count   int      `json:"count"`
+	Viewers []viewer `json:"viewers"`
+}
+
+// handleViewers lists a stream's connected viewers, longest watching first
+func (s *Server) handleViewers(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["id"]
+	writeJSON(w, http.StatusOK, s.viewers(stream, s.presence.Viewers(stream)))
+}
+
+// handleViewerEvents streams a stream's viewers as Server-Sent Events: a
+// "snapshot" event with every current viewer, then a "joined" or "left"
+// event for each change
+func (s *Server) handleViewerEvents(w http.ResponseWriter, r *http.Request) {
+	stream := mux.Vars(r)["id"]
+
+	// The feed outlives the server write timeout
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	current, events, cancel := s.presence.Subscribe(stream, 64)
+	defer cancel()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeEvent(w, "snapshot", s.viewers(stream, current)); err != nil {
+		return
+	}
+	_ = rc.Flush()
+
+	keepalive := time.NewTicker(sseKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.Viewer.Stream != stream {
+				continue
+			}
+			if err := writeEvent(w, string(ev.Type), ev); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// viewers adds each viewer's connection quality, when known
+func (s *Server) viewers(stream string, list []presence.Viewer) viewersResponse {
+	var scores map[string]*quality.PeerQuality
+	if s.quality != nil {
+		snapshot := s.quality.Snapshot()
+		scores = make(map[string]*quality.PeerQuality, len(snapshot))
+		for i := range snapshot {
+			scores[snapshot[i].PeerID] = &snapshot[i]
+		}
+	}
+
+	resp := viewersResponse{Stream: stream, Count: len(list), Viewers: make([]viewer, len(list))}
+	for i, v := range list {
+		resp.Viewers[i] = viewer{Viewer: v, Quality: scores[v.PeerID]}
+	}
+	return resp
+}
+
+// peerQualityResponse is the body of /api/stats/peers
+type peerQualityResponse struct {
+	Peers []quality.PeerQuality `json:"peers"`
+
+	// Invites maps peers admitted by an invite to its ID
+	Invites map[string]string `json:"invites,omitempty"`
+}
+
+// handlePeerQuality returns every peer's quality score, worst first
+func (s *Server) handlePeerQuality(w http.ResponseWriter, r *http.Request) {
+	resp := peerQualityResponse{Peers: s.quality.Snapshot()}
+	if s.invites != nil {
+		for _, p := range resp.Peers {
+			if id := s.invites.InviteFor(p.PeerID); id != "" {
+				if resp.Invites == nil {
+					resp.Invites = make(map[string]string)
+				}
+				resp.Invites[p.PeerID] = id
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// writeEvent writes v as a Server-Sent Event named name
+func writeEvent(w io.Writer, name string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "event: "+name+"\ndata: "+string(data)+"\n\n")
+	return err
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// requireToken admits requests carrying token as a bearer token or as the
+// basic auth password; any user name is accepted. Others get 401 with a
+// basic auth challenge, so browsers ask for it.
+func requireToken(token string, next http.Handler) http.Handler {
+	want := sha256.Sum256([]byte(token))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			_, presented, _ = r.BasicAuth()
+		}
+		got := sha256.Sum256([]byte(presented))
+		if presented == "" || subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gateway admin", charset="UTF-8"`)
+			http.Error(w, "admin token required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireLocalHost admits requests whose Host is a loopback name or address
+// or the host the server listens on; others get 421. Pages on other sites
+// that rebind their name to loopback are refused this way.
+func requireLocalHost(cfg ServerConfig, next http.Handler) http.Handler {
+	hosts := map[string]bool{"localhost": true}
+	if host, _, err := net.SplitHostPort(cfg.ListenAddr); err == nil && host != "" {
+		hosts[strings.ToLower(host)] = true
+	}
+	if cfg.Listener != nil {
+		if host, _, err := net.SplitHostPort(cfg.Listener.Addr().String()); err == nil {
+			hosts[strings.ToLower(host)] = true
+		}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(strings.Trim(host, "[]"))
+		ip := net.ParseIP(host)
+		if !hosts[host] && !strings.HasSuffix(host, ".localhost") && (ip == nil || !ip.IsLoopback()) {
+			http.Error(w, "unknown host; set an admin token to serve other names", http.StatusMisdirectedRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refuseCrossSite refuses state-changing requests from pages on other
+// origins with 403, and JSON bodies sent without a JSON Content-Type with
+// 415, since browsers send those cross-site without asking first
+func refuseCrossSite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" {
+			u, err := url.Parse(origin)
+			if err != nil || !strings.EqualFold(u.Host, r.Host) {
+				http.Error(w, "cross-origin request refused", http.StatusForbidden)
+				return
+			}
+		}
+		if r.ContentLength != 0 {
+			mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if mediaType != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
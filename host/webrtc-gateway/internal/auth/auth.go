@@ -0,0 +1,466 @@
+// Package auth restricts the viewer portal to signed-in friends using an
+// OpenID Connect provider (Google, Authentik, Keycloak, ...).
+//
+// Viewers sign in through the authorization code flow with PKCE. The gateway
+// keeps no session store: the signed-in user is held in an HMAC-signed
+// cookie. Native clients that run the flow themselves may instead send the
+// provider's ID token as a bearer token.
+//
+// Every user has a role. Viewers may watch; controllers may also send input
+// to the game. Handlers behind Require read the user with UserFromContext.
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Role is what a signed-in user may do
+type Role string
+
+const (
+	// RoleViewer may watch the stream
+	RoleViewer Role = "viewer"
+
+	// RoleController may watch and send input to the game
+	RoleController Role = "controller"
+)
+
+// Cookie names
+const (
+	sessionCookie = "gateway_session"
+	stateCookie   = "gateway_oidc"
+)
+
+// stateTTL is how long a viewer has to complete sign-in at the provider
+const stateTTL = 10 * time.Minute
+
+// User is a signed-in viewer
+type User struct {
+	Subject string    `json:"sub"`
+	Email   string    `json:"email,omitempty"`
+	Name    string    `json:"name,omitempty"`
+	Role    Role      `json:"role"`
+	Expires time.Time `json:"exp"`
+}
+
+// CanControl reports whether the user may send input to the game
+func (u *User) CanControl() bool {
+	return u != nil && u.Role == RoleController
+}
+
+type userKey struct{}
+
+// UserFromContext returns the user set by Require, or nil
+func UserFromContext(ctx context.Context) *User {
+	u, _ := ctx.Value(userKey{}).(*User)
+	return u
+}
+
+// WithUser returns a context carrying u
+func WithUser(ctx context.Context, u *User) context.Context {
+	return context.WithValue(ctx, userKey{}, u)
+}
+
+// Config configures the authenticator
+type Config struct {
+	Issuer       string // OIDC issuer URL, e.g. "https://accounts.google.com"
+	ClientID     string
+	ClientSecret string // Empty for a public client (PKCE only)
+	RedirectURL  string // This gateway's /auth/callback as viewers reach it
+
+	// AllowedUsers are the emails or subjects allowed to watch. Controllers
+	// are always allowed; nobody else is unless AllowAnyUser is set.
+	AllowedUsers []string
+
+	// AllowAnyUser lets anyone the provider signs in watch, e.g. every
+	// Google account with a public issuer
+	AllowAnyUser bool
+
+	// Controllers are the emails or subjects given RoleController
+	Controllers []string
+
+	// SessionSecret signs session cookies. A random secret is generated when
+	// empty, which signs everyone out on restart.
+	SessionSecret []byte
+
+	SessionTTL time.Duration // Default 12h
+	Timeout    time.Duration // Provider request timeout, default 10s
+}
+
+// Stats are authentication counters
+type Stats struct {
+	Logins   uint64 `json:"logins"`   // Completed sign-ins
+	Denied   uint64 `json:"denied"`   // Users signed in at the provider but not allowed
+	Failures uint64 `json:"failures"` // Failed callbacks or invalid tokens
+	Rejected uint64 `json:"rejected"` // Requests without a valid session
+}
+
+// Authenticator runs the sign-in flow and guards handlers
+type Authenticator struct {
+	cfg      Config
+	logger   zerolog.Logger
+	provider *provider
+	secure   bool // Set the Secure flag on cookies
+
+	allowed     map[string]bool
+	controllers map[string]bool
+
+	// Statistics
+	logins   atomic.Uint64
+	denied   atomic.Uint64
+	failures atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// New creates an authenticator. The provider is contacted on first sign-in.
+func New(cfg Config, logger zerolog.Logger) (*Authenticator, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" {
+		return nil, errors.New("auth: issuer and client ID are required")
+	}
+	redirect, err := url.Parse(cfg.RedirectURL)
+	if err != nil || (redirect.Scheme != "http" && redirect.Scheme != "https") || redirect.Host == "" {
+		return nil, errors.New("auth: redirect URL must be an absolute http:// or https:// URL")
+	}
+
+	// Apply defaults for zero values
+	if cfg.SessionTTL <= 0 {
+		cfg.SessionTTL = 12 * time.Hour
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if len(cfg.SessionSecret) == 0 {
+		cfg.SessionSecret = make([]byte, 32)
+		if _, err := rand.Read(cfg.SessionSecret); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Authenticator{
+		cfg:         cfg,
+		logger:      logger.With().Str("component", "auth").Logger(),
+		provider:    newProvider(cfg.Issuer, cfg.ClientID, &http.Client{Timeout: cfg.Timeout}),
+		secure:      redirect.Scheme == "https",
+		allowed:     identitySet(cfg.AllowedUsers),
+		controllers: identitySet(cfg.Controllers),
+	}, nil
+}
+
+// Handler serves the sign-in endpoints:
+//
+//	GET  /auth/login     redirect to the provider (?return_to=/path)
+//	GET  /auth/callback  provider redirect target
+//	POST /auth/logout    clear the session
+//	GET  /auth/me        the signed-in user as JSON
+func (a *Authenticator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/login", a.handleLogin)
+	mux.HandleFunc("/auth/callback", a.handleCallback)
+	mux.HandleFunc("/auth/logout", a.handleLogout)
+	mux.HandleFunc("/auth/me", a.handleMe)
+	return mux
+}
+
+// Require rejects requests without a signed-in, allowed user and puts the
+// user in the request context. Browsers asking for a page are sent to sign
+// in; other requests get 401.
+func (a *Authenticator) Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := a.UserFromRequest(r)
+		if u == nil {
+			a.rejected.Add(1)
+			if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/auth/login?return_to="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gateway"`)
+			http.Error(w, "sign-in required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithUser(r.Context(), u)))
+	})
+}
+
+// UserFromRequest returns the user of a session cookie or bearer ID token,
+// or nil if there is none or it is invalid
+func (a *Authenticator) UserFromRequest(r *http.Request) *User {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		claims, err := a.provider.verify(r.Context(), strings.TrimSpace(token), "")
+		if err != nil {
+			a.logger.Debug().Err(err).Str("remote_addr", r.RemoteAddr).Msg("Invalid bearer token")
+			return nil
+		}
+		u, ok := a.authorize(claims)
+		if !ok {
+			return nil
+		}
+		return u
+	}
+
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	var u User
+	if !a.open(sessionCookie, c.Value, &u) || time.Now().After(u.Expires) || u.Subject == "" {
+		return nil
+	}
+	// Re-check roles so config changes apply to existing sessions
+	if !a.allowedIdentity(u.Subject, u.Email) {
+		return nil
+	}
+	u.Role = a.role(u.Subject, u.Email)
+	return &u
+}
+
+// Stats returns authentication counters
+func (a *Authenticator) Stats() Stats {
+	return Stats{
+		Logins:   a.logins.Load(),
+		Denied:   a.denied.Load(),
+		Failures: a.failures.Load(),
+		Rejected: a.rejected.Load(),
+	}
+}
+
+// loginState is held in a signed cookie between login and callback
+type loginState struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	ReturnTo string    `json:"return_to"`
+	Expires  time.Time `json:"exp"`
+}
+
+func (a *Authenticator) handleLogin(w http.ResponseWriter, r *http.Request) {
+	meta, err := a.provider.metadata(r.Context())
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Identity provider unavailable")
+		http.Error(w, "identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	st := loginState{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString() + randomString(),
+		ReturnTo: localPath(r.URL.Query().Get("return_to")),
+		Expires:  time.Now().Add(stateTTL),
+	}
+	a.setCookie(w, stateCookie, a.seal(stateCookie, st), "/auth/", stateTTL)
+
+	challenge := sha256.Sum256([]byte(st.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.cfg.ClientID},
+		"redirect_uri":          {a.cfg.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {st.State},
+		"nonce":                 {st.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, meta.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+func (a *Authenticator) handleCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		a.failures.Add(1)
+		a.logger.Warn().Str("error", e).Str("description", q.Get("error_description")).Msg("Sign-in refused by provider")
+		http.Error(w, "sign-in failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	var st loginState
+	c, err := r.Cookie(stateCookie)
+	if err != nil || !a.open(stateCookie, c.Value, &st) || time.Now().After(st.Expires) ||
+		!hmac.Equal([]byte(q.Get("state")), []byte(st.State)) {
+		a.failures.Add(1)
+		http.Error(w, "sign-in expired, please try again", http.StatusBadRequest)
+		return
+	}
+	a.setCookie(w, stateCookie, "", "/auth/", -1)
+
+	idToken, err := a.provider.exchange(r.Context(), q.Get("code"), st.Verifier, a.cfg.RedirectURL, a.cfg.ClientSecret)
+	if err != nil {
+		a.failures.Add(1)
+		a.logger.Error().Err(err).Msg("Code exchange failed")
+		http.Error(w, "sign-in failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := a.provider.verify(r.Context(), idToken, st.Nonce)
+	if err != nil {
+		a.failures.Add(1)
+		a.logger.Warn().Err(err).Msg("Invalid ID token")
+		http.Error(w, "sign-in failed", http.StatusUnauthorized)
+		return
+	}
+
+	u, ok := a.authorize(claims)
+	if !ok {
+		http.Error(w, "you are not on the guest list for this stream", http.StatusForbidden)
+		return
+	}
+	u.Expires = time.Now().Add(a.cfg.SessionTTL)
+	a.setCookie(w, sessionCookie, a.seal(sessionCookie, u), "/", a.cfg.SessionTTL)
+
+	a.logins.Add(1)
+	a.logger.Info().Str("sub", u.Subject).Str("email", u.Email).Str("role", string(u.Role)).Msg("User signed in")
+	http.Redirect(w, r, st.ReturnTo, http.StatusFound)
+}
+
+func (a *Authenticator) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	a.setCookie(w, sessionCookie, "", "/", -1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Authenticator) handleMe(w http.ResponseWriter, r *http.Request) {
+	u := a.UserFromRequest(r)
+	if u == nil {
+		http.Error(w, "not signed in", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(u)
+}
+
+// authorize maps verified claims to a user, or reports that the user is not
+// allowed
+func (a *Authenticator) authorize(claims *idClaims) (*User, bool) {
+	email := claims.Email
+	if claims.Verified == nil || !*claims.Verified {
+		// Emails the provider does not vouch for must not match the allow
+		// lists
+		email = ""
+	}
+	if claims.Subject == "" || !a.allowedIdentity(claims.Subject, email) {
+		a.denied.Add(1)
+		a.logger.Warn().Str("sub", claims.Subject).Str("email", claims.Email).Msg("User not allowed")
+		return nil, false
+	}
+
+	name := claims.Name
+	if name == "" {
+		name = claims.Username
+	}
+	return &User{
+		Subject: claims.Subject,
+		Email:   email,
+		Name:    name,
+		Role:    a.role(claims.Subject, email),
+		Expires: time.Unix(claims.Expiry, 0),
+	}, true
+}
+
+func (a *Authenticator) allowedIdentity(sub, email string) bool {
+	if a.cfg.AllowAnyUser {
+		return true
+	}
+	return matches(a.allowed, sub, email) || matches(a.controllers, sub, email)
+}
+
+func (a *Authenticator) role(sub, email string) Role {
+	if matches(a.controllers, sub, email) {
+		return RoleController
+	}
+	return RoleViewer
+}
+
+// seal signs v as base64url(JSON).base64url(HMAC-SHA256). The MAC covers
+// purpose, the name of the cookie v is for, so a login state cannot be
+// passed off as a session.
+func (a *Authenticator) seal(purpose string, v any) string {
+	b, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(a.sign(purpose, payload))
+}
+
+// open verifies and decodes a value made by seal for purpose
+func (a *Authenticator) open(purpose, value string, v any) bool {
+	payload, sig, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, a.sign(purpose, payload)) {
+		return false
+	}
+	return decodeSegment(payload, v) == nil
+}
+
+func (a *Authenticator) sign(purpose, payload string) []byte {
+	mac := hmac.New(sha256.New, a.cfg.SessionSecret)
+	mac.Write([]byte(purpose + "\x00" + payload))
+	return mac.Sum(nil)
+}
+
+// setCookie sets an HttpOnly cookie; a negative ttl deletes it
+func (a *Authenticator) setCookie(w http.ResponseWriter, name, value, path string, ttl time.Duration) {
+	maxAge := int(ttl / time.Second)
+	if ttl < 0 {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   a.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// identitySet lower-cases emails and subjects for matching
+func identitySet(list []string) map[string]bool {
+	set := make(map[string]bool, len(list))
+	for _, id := range list {
+		if id = strings.TrimSpace(id); id != "" {
+			set[strings.ToLower(id)] = true
+		}
+	}
+	return set
+}
+
+func matches(set map[string]bool, sub, email string) bool {
+	return set[strings.ToLower(sub)] || (email != "" && set[strings.ToLower(email)])
+}
+
+// localPath returns p if it is a path on this host, so return_to cannot
+// redirect elsewhere
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "/"
+	}
+	return p
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,431 @@
+// Package banlist keeps viewers out of the gateway: bans match an IP
+// address or network, or a signed-in identity (OIDC subject or email).
+// Signaling checks the list before serving a request, so a banned viewer
+// cannot create a peer even with a valid invite.
+//
+// When a path is configured the list is saved after every change and loaded
+// at startup, so bans survive restarts. Without one it is held in memory.
+package banlist
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Errors returned by the list
+var (
+	// ErrBanned is returned by Check for a banned viewer
+	ErrBanned = errors.New("banned")
+
+	// ErrNotSaved is returned when a change applies but could not be
+	// written to disk; it is lost on restart
+	ErrNotSaved = errors.New("ban list not saved")
+)
+
+// Kind is what a ban matches
+type Kind string
+
+const (
+	// KindIP matches an IP address or CIDR network
+	KindIP Kind = "ip"
+
+	// KindIdentity matches a signed-in user's subject or email
+	KindIdentity Kind = "identity"
+)
+
+// Config configures the ban list
+type Config struct {
+	// Path is the JSON file bans are saved to; empty keeps them in memory
+	Path string
+}
+
+// Ban is one entry on the list
+type Ban struct {
+	ID        string     `json:"id"`
+	Kind      Kind       `json:"kind"`
+	Value     string     `json:"value"` // Network in CIDR form, or lower-cased identity
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // Nil is permanent
+}
+
+// Stats are ban list counters
+type Stats struct {
+	Bans     int    `json:"bans"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// file is the on-disk format
+type file struct {
+	Bans []Ban `json:"bans"`
+}
+
+// List holds the bans and enforces them
+type List struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	mu         sync.Mutex
+	bans       map[string]*Ban // By ID
+	networks   map[string]netip.Prefix
+	identities map[string]*Ban // Lower-cased identity to its ban
+
+	// Statistics
+	rejected atomic.Uint64
+}
+
+// Open loads the ban list from cfg.Path, starting empty if the file does
+// not exist yet
+func Open(cfg Config, logger zerolog.Logger) (*List, error) {
+	l := &List{
+		cfg:        cfg,
+		logger:     logger.With().Str("component", "banlist").Logger(),
+		bans:       make(map[string]*Ban),
+		networks:   make(map[string]netip.Prefix),
+		identities: make(map[string]*Ban),
+	}
+	if cfg.Path == "" {
+		return l, nil
+	}
+
+	data, err := os.ReadFile(cfg.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", cfg.Path, err)
+	}
+	for i := range f.Bans {
+		b := f.Bans[i]
+		if err := l.index(&b); err != nil {
+			l.logger.Warn().Err(err).Str("ban_id", b.ID).Msg("Skipping invalid ban")
+		}
+	}
+	l.prune(time.Now())
+
+	l.logger.Info().Str("path", cfg.Path).Int("bans", len(l.bans)).Msg("Ban list loaded")
+	return l, nil
+}
+
+// Add bans value, an IP address, CIDR network or identity depending on
+// kind, for ttl (0 is permanent). Banning a value again replaces its
+// reason and expiry and keeps its ID. The ban applies even when
+// ErrNotSaved is returned.
+func (l *List) Add(kind Kind, value, reason string, ttl time.Duration) (Ban, error) {
+	if ttl < 0 {
+		return Ban{}, errors.New("ttl must not be negative")
+	}
+	value, err := normalize(kind, value)
+	if err != nil {
+		return Ban{}, err
+	}
+
+	now := time.Now()
+	b := &Ban{
+		ID:        randomID(),
+		Kind:      kind,
+		Value:     value,
+		Reason:    reason,
+		CreatedAt: now,
+	}
+	if ttl > 0 {
+		expires := now.Add(ttl)
+		b.ExpiresAt = &expires
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(now)
+	if old := l.find(kind, value); old != nil {
+		b.ID = old.ID
+		b.CreatedAt = old.CreatedAt
+	}
+	if err := l.index(b); err != nil {
+		return Ban{}, err
+	}
+
+	l.logger.Info().Str("ban_id", b.ID).Str("kind", string(kind)).Str("value", value).
+		Str("reason", reason).Msg("Ban added")
+	return *b, l.save()
+}
+
+// Remove lifts a ban. It reports false if there is no such ban.
+// ErrNotSaved is returned as for Add.
+func (l *List) Remove(id string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.bans[id]
+	if !ok {
+		return false, nil
+	}
+	l.unindex(b)
+
+	l.logger.Info().Str("ban_id", id).Str("value", b.Value).Msg("Ban removed")
+	return true, l.save()
+}
+
+// List returns all bans, newest first
+func (l *List) List() []Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune(time.Now())
+	list := make([]Ban, 0, len(l.bans))
+	for _, b := range l.bans {
+		list = append(list, *b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Check returns ErrBanned if addr, an IP address with or without a port,
+// or any of identities is banned
+func (l *List) Check(addr string, identities ...string) error {
+	l.mu.Lock()
+	b := l.match(addr, identities)
+	l.mu.Unlock()
+
+	if b == nil {
+		return nil
+	}
+	l.rejected.Add(1)
+	l.logger.Info().Str("remote_addr", addr).Str("ban_id", b.ID).Msg("Banned viewer rejected")
+	return ErrBanned
+}
+
+// Middleware rejects requests from banned viewers with 403 before next
+// sees them. identify returns the identities of the request's user, e.g.
+// the subject and email of its session; it may be nil.
+func (l *List) Middleware(identify func(*http.Request) []string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ids []string
+		if identify != nil {
+			ids = identify(r)
+		}
+		if errors.Is(l.Check(r.RemoteAddr, ids...), ErrBanned) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Stats returns ban list counters
+func (l *List) Stats() Stats {
+	l.mu.Lock()
+	n := len(l.bans)
+	l.mu.Unlock()
+	return Stats{
+		Bans:     n,
+		Rejected: l.rejected.Load(),
+	}
+}
+
+// match returns the unexpired ban matching addr or identities, or nil.
+// Caller holds mu.
+func (l *List) match(addr string, identities []string) *Ban {
+	now := time.Now()
+	for _, id := range identities {
+		if b, ok := l.identities[strings.ToLower(strings.TrimSpace(id))]; ok && !b.expired(now) {
+			return b
+		}
+	}
+	if len(l.networks) == 0 {
+		return nil
+	}
+	ip, ok := parseAddr(addr)
+	if !ok {
+		return nil
+	}
+	for id, network := range l.networks {
+		if b := l.bans[id]; network.Contains(ip) && !b.expired(now) {
+			return b
+		}
+	}
+	return nil
+}
+
+// find returns the ban of kind on value, or nil. Caller holds mu.
+func (l *List) find(kind Kind, value string) *Ban {
+	for _, b := range l.bans {
+		if b.Kind == kind && b.Value == value {
+			return b
+		}
+	}
+	return nil
+}
+
+// index adds b, replacing any ban with its ID. Caller holds mu.
+func (l *List) index(b *Ban) error {
+	value, err := normalize(b.Kind, b.Value)
+	if err != nil {
+		return err
+	}
+	var prefix netip.Prefix
+	if b.Kind == KindIP {
+		if prefix, err = netip.ParsePrefix(value); err != nil {
+			return fmt.Errorf("invalid network %q", value)
+		}
+	}
+	b.Value = value
+	if old, ok := l.bans[b.ID]; ok {
+		l.unindex(old)
+	}
+
+	switch b.Kind {
+	case KindIP:
+		l.networks[b.ID] = prefix
+	case KindIdentity:
+		l.identities[value] = b
+	}
+	l.bans[b.ID] = b
+	return nil
+}
+
+// unindex drops b. Caller holds mu.
+func (l *List) unindex(b *Ban) {
+	delete(l.bans, b.ID)
+	delete(l.networks, b.ID)
+	if l.identities[b.Value] == b {
+		delete(l.identities, b.Value)
+	}
+}
+
+// prune drops expired bans, saving the list if any were. Caller holds mu.
+func (l *List) prune(now time.Time) {
+	pruned := false
+	for _, b := range l.bans {
+		if b.expired(now) {
+			l.unindex(b)
+			pruned = true
+		}
+	}
+	if pruned {
+		_ = l.save()
+	}
+}
+
+// save writes the list to cfg.Path, wrapping failures in ErrNotSaved.
+// Caller holds mu.
+func (l *List) save() error {
+	if l.cfg.Path == "" {
+		return nil
+	}
+	if err := l.write(); err != nil {
+		l.logger.Error().Err(err).Str("path", l.cfg.Path).Msg("Failed to save ban list")
+		return fmt.Errorf("%w: %v", ErrNotSaved, err)
+	}
+	return nil
+}
+
+// write replaces cfg.Path through a temporary file, so a crash leaves the
+// previous list intact. Caller holds mu.
+func (l *List) write() error {
+	f := file{Bans: make([]Ban, 0, len(l.bans))}
+	for _, b := range l.bans {
+		f.Bans = append(f.Bans, *b)
+	}
+	sort.Slice(f.Bans, func(i, j int) bool { return f.Bans[i].CreatedAt.Before(f.Bans[j].CreatedAt) })
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.cfg.Path), ".banlist-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), l.cfg.Path)
+}
+
+func (b *Ban) expired(now time.Time) bool {
+	return b.ExpiresAt != nil && now.After(*b.ExpiresAt)
+}
+
+// normalize validates value for kind and returns its canonical form: a
+// CIDR network for IPs, lower case for identities
+func normalize(kind Kind, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", errors.New("value must not be empty")
+	}
+
+	switch kind {
+	case KindIP:
+		if strings.Contains(value, "/") {
+			prefix, err := netip.ParsePrefix(value)
+			if err != nil {
+				return "", fmt.Errorf("invalid network %q", value)
+			}
+			if prefix.Addr().Is4In6() {
+				// ::ffff:a.b.c.d/n covers IPv4 addresses, less the 96 bits
+				// of the mapping
+				if prefix.Bits() < 96 {
+					return "", fmt.Errorf("network %q is wider than the IPv4-mapped range", value)
+				}
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			if !prefix.IsValid() {
+				return "", fmt.Errorf("invalid network %q", value)
+			}
+			return prefix.Masked().String(), nil
+		}
+		ip, err := netip.ParseAddr(value)
+		if err != nil {
+			return "", fmt.Errorf("invalid IP address %q", value)
+		}
+		ip = ip.Unmap().WithZone("")
+		return netip.PrefixFrom(ip, ip.BitLen()).String(), nil
+	case KindIdentity:
+		return strings.ToLower(value), nil
+	default:
+		return "", fmt.Errorf("kind must be %q or %q", KindIP, KindIdentity)
+	}
+}
+
+// parseAddr parses the IP of a "host:port" or bare address
+func parseAddr(addr string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap().WithZone(""), true
+}
+
+func randomID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,297 @@
+// Package bitdepth keeps a 10-bit stream watchable by viewers that only
+// decode 8-bit. While one is connected, the capture service is asked over
+// the IPC control channel to encode 8-bit; a while after the last has
+// left, it is asked to go back to 10-bit.
+//
+// Whether a viewer decodes 10-bit is read from the fmtp lines of its offer:
+// HEVC Main 10 and VP9 profile 2 are listed separately, while AV1 Main
+// covers both depths.
+package bitdepth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+)
+
+// Config configures a controller
+type Config struct {
+	// Hold is how long 8-bit is kept after the last viewer that needs it
+	// leaves, so churn does not restart the encoder; default 30s
+	Hold time.Duration
+
+	// CheckInterval is how often the encoder is checked, default 2s
+	CheckInterval time.Duration
+}
+
+// Status describes the controller
+type Status struct {
+	Stream        int    `json:"stream"` // Bit depth of the stream; 0 until a keyframe is seen
+	Want          int    `json:"want"`   // What viewers allow; 0 leaves the producer's
+	EightBitPeers int    `json:"eight_bit_peers"`
+	Pushed        int    `json:"pushed"` // Last value pushed
+	Pushes        uint64 `json:"pushes"`
+	Errors        uint64 `json:"errors"`
+}
+
+// stateReporter is implemented by encoders that report their settings;
+// pushes are then repeated when a restarted producer forgets them
+type stateReporter interface {
+	ControlStats() media.ControlStats
+}
+
+// Controller asks the encoder for 8-bit while viewers need it
+type Controller struct {
+	cfg     Config
+	encoder media.EncoderController
+	logger  zerolog.Logger
+
+	mu        sync.Mutex
+	eightBit  map[string]bool // Viewers that decode only 8-bit
+	holdUntil time.Time       // 8-bit is kept until then after the last left
+	stream    int
+	high      int // Depth the stream had before it was pushed to 8-bit
+	pushed    int
+	running   bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+	wake      chan struct{}
+
+	// Statistics
+	pushes atomic.Uint64
+	errors atomic.Uint64
+}
+
+// New creates a controller commanding encoder
+func New(cfg Config, encoder media.EncoderController, logger zerolog.Logger) *Controller {
+	// Apply defaults for zero values
+	if cfg.Hold <= 0 {
+		cfg.Hold = 30 * time.Second
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = 2 * time.Second
+	}
+
+	return &Controller{
+		cfg:      cfg,
+		encoder:  encoder,
+		logger:   logger.With().Str("component", "bitdepth").Logger(),
+		eightBit: make(map[string]bool),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Supports reports whether a viewer whose offer carries fmtps for codec
+// decodes 10-bit video
+func Supports(codec string, fmtps []string) bool {
+	for _, fmtp := range fmtps {
+		params := make(map[string]string)
+		for _, kv := range strings.Split(fmtp, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+			params[k] = v
+		}
+		switch codec {
+		case "hevc", "vp9":
+			if params["profile-id"] == "2" {
+				return true
+			}
+		case "av1":
+			// Main (the default) and High carry 10-bit 4:2:0
+			if p := params["profile"]; p == "" || p == "0" || p == "1" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Start begins managing the bit depth in the background; returns
+// immediately
+func (c *Controller) Start(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running {
+		return errors.New("bit depth controller already started")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	c.running = true
+
+	go c.run(runCtx)
+
+	return nil
+}
+
+// Stop stops managing the bit depth and waits for the goroutine to exit
+func (c *Controller) Stop() error {
+	c.mu.Lock()
+	if !c.running {
+		c.mu.Unlock()
+		return nil
+	}
+	c.running = false
+	c.cancel()
+	done := c.done
+	c.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+// Observe reads the stream's bit depth from keyframes. It is a
+// media.Distributor tap.
+func (c *Controller) Observe(f media.VideoFrame) {
+	if !f.IsKeyframe {
+		return
+	}
+	p, ok, err := bitstream.FindParams(f.Codec, f.Data)
+	if !ok || err != nil || p.BitDepth == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	changed := p.BitDepth != c.stream
+	c.stream = p.BitDepth
+	if p.BitDepth > 8 {
+		c.high = p.BitDepth
+	}
+	c.mu.Unlock()
+	if changed {
+		c.poke()
+	}
+}
+
+// PeerJoined records a viewer and whether it decodes 10-bit
+func (c *Controller) PeerJoined(peerID string, highBitDepth bool) {
+	if highBitDepth {
+		return
+	}
+	c.mu.Lock()
+	c.eightBit[peerID] = true
+	stream := c.stream
+	c.mu.Unlock()
+
+	if stream > 8 {
+		c.logger.Info().Str("peer_id", peerID).Int("stream", stream).Msg("Viewer decodes only 8-bit, falling back")
+	}
+	c.poke()
+}
+
+// RemovePeer forgets a viewer
+func (c *Controller) RemovePeer(peerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.eightBit[peerID] {
+		delete(c.eightBit, peerID)
+		if len(c.eightBit) == 0 {
+			c.holdUntil = time.Now().Add(c.cfg.Hold)
+		}
+	}
+}
+
+// Status returns the controller state
+func (c *Controller) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Status{
+		Stream:        c.stream,
+		Want:          c.want(time.Now()),
+		EightBitPeers: len(c.eightBit),
+		Pushed:        c.pushed,
+		Pushes:        c.pushes.Load(),
+		Errors:        c.errors.Load(),
+	}
+}
+
+// want returns the bit depth to apply now, or 0 to leave the producer's.
+// Caller holds mu.
+func (c *Controller) want(now time.Time) int {
+	switch {
+	case len(c.eightBit) > 0 || now.Before(c.holdUntil):
+		if c.stream > 8 || c.pushed == 8 {
+			return 8
+		}
+	case c.pushed == 8 && c.high > 8:
+		return c.high // Restore what the producer chose
+	}
+	return 0
+}
+
+// poke makes the goroutine check the encoder now
+func (c *Controller) poke() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run is the goroutine that pushes changes
+func (c *Controller) run(ctx context.Context) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.wake:
+		}
+		c.check(ctx)
+	}
+}
+
+// check pushes the wanted bit depth when it differs from what was last
+// pushed, or from what the encoder reports
+func (c *Controller) check(ctx context.Context) {
+	var state *media.ControlReply
+	if sr, ok := c.encoder.(stateReporter); ok {
+		st := sr.ControlStats()
+		if !st.Supported {
+			return // The producer has not shown it takes commands
+		}
+		state = st.State
+	}
+
+	c.mu.Lock()
+	depth, pushed := c.want(time.Now()), c.pushed
+	c.mu.Unlock()
+	if depth == 0 {
+		return
+	}
+	stale := depth != pushed || (state != nil && state.BitDepth != 0 && state.BitDepth != depth)
+	if !stale {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := c.encoder.Control(ctx, media.ControlCommand{Action: media.ControlSetBitDepth, BitDepth: depth})
+	if err != nil {
+		c.errors.Add(1)
+		c.logger.Debug().Err(err).Int("bit_depth", depth).Msg("Failed to set bit depth")
+		return
+	}
+	c.pushes.Add(1)
+
+	c.mu.Lock()
+	c.pushed = depth
+	if depth > 8 {
+		c.pushed = 0 // The producer's own depth again; nothing to restore
+	}
+	c.mu.Unlock()
+	c.logger.Info().Int("bit_depth", depth).Msg("Encoder bit depth set")
+}
@@ -0,0 +1,300 @@
+// Package captions passes timed text from the capture host, such as
+// speech-to-text of voice chat, on to viewers. Each cue is sent on the data
+// channel as it arrives, and recent cues are kept so they can be served as
+// WebVTT.
+//
+// Cue times are the producer's PTS on the video clock, so the WebVTT output
+// carries an X-TIMESTAMP-MAP header and lines up with HLS segments cut from
+// the same stream.
+package captions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// MessageType is the data channel message type of a caption
+const MessageType = "caption"
+
+// Broadcaster sends a message on every viewer's data channel. The peer
+// manager satisfies it.
+type Broadcaster interface {
+	BroadcastMessage(data []byte) error
+}
+
+// Config configures a track
+type Config struct {
+	// Window is how long cues are kept for WebVTT, default 5 minutes
+	Window time.Duration
+
+	// MaxCues caps kept cues, default 1000
+	MaxCues int
+
+	// DefaultDuration is used for cues sent without one, default 3s
+	DefaultDuration time.Duration
+}
+
+// Cue is one timed caption
+type Cue struct {
+	Type       string `json:"type"`
+	PTSMs      int64  `json:"pts_ms"`
+	DurationMs int64  `json:"duration_ms"`
+	Text       string `json:"text"`
+	Speaker    string `json:"speaker,omitempty"`
+	Language   string `json:"lang,omitempty"`
+
+	start, end int64 // Nanoseconds on the cue clock
+	received   time.Time
+}
+
+// Stats are track counters
+type Stats struct {
+	Cues      int    `json:"cues"`
+	Received  uint64 `json:"received"`
+	Broadcast uint64 `json:"broadcast"`
+	Errors    uint64 `json:"errors"`
+}
+
+// Track keeps recent cues and forwards new ones to viewers
+type Track struct {
+	cfg         Config
+	frames      <-chan media.TextFrame
+	broadcaster Broadcaster
+	logger      zerolog.Logger
+
+	mu      sync.Mutex
+	cues    []Cue
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	// Clock for producers that send no PTS: receive time since the first cue
+	epoch time.Time
+
+	// Statistics
+	received  atomic.Uint64
+	broadcast atomic.Uint64
+	errors    atomic.Uint64
+}
+
+// New creates a track reading from frames. broadcaster may be nil, in which
+// case cues are only kept for WebVTT.
+func New(cfg Config, frames <-chan media.TextFrame, broadcaster Broadcaster, logger zerolog.Logger) *Track {
+	// Apply defaults for zero values
+	if cfg.Window <= 0 {
+		cfg.Window = 5 * time.Minute
+	}
+	if cfg.MaxCues <= 0 {
+		cfg.MaxCues = 1000
+	}
+	if cfg.DefaultDuration <= 0 {
+		cfg.DefaultDuration = 3 * time.Second
+	}
+
+	return &Track{
+		cfg:         cfg,
+		frames:      frames,
+		broadcaster: broadcaster,
+		logger:      logger.With().Str("component", "captions").Logger(),
+	}
+}
+
+// Start begins reading cues in the background; returns immediately
+func (t *Track) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.running {
+		return errors.New("captions already started")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	t.cancel = cancel
+	t.done = make(chan struct{})
+	t.running = true
+
+	go t.run(runCtx)
+
+	t.logger.Info().Bool("broadcast", t.broadcaster != nil).Msg("Captions started")
+
+	return nil
+}
+
+// Stop stops reading and waits for the goroutine to exit
+func (t *Track) Stop() error {
+	t.mu.Lock()
+	if !t.running {
+		t.mu.Unlock()
+		return nil
+	}
+	t.running = false
+	t.cancel()
+	done := t.done
+	t.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+// run is the reading goroutine
+func (t *Track) run(ctx context.Context) {
+	defer close(t.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case frame, ok := <-t.frames:
+			if !ok {
+				return
+			}
+			t.Add(frame)
+		}
+	}
+}
+
+// Add keeps a cue and sends it to viewers
+func (t *Track) Add(frame media.TextFrame) {
+	text := strings.TrimSpace(frame.Text)
+	if text == "" {
+		return
+	}
+	t.received.Add(1)
+
+	duration := frame.Duration
+	if duration <= 0 {
+		duration = t.cfg.DefaultDuration
+	}
+	received := frame.ReceivedAt
+	if received.IsZero() {
+		received = time.Now()
+	}
+
+	t.mu.Lock()
+	start := frame.PTS
+	if start <= 0 {
+		if t.epoch.IsZero() {
+			t.epoch = received
+		}
+		start = int64(received.Sub(t.epoch))
+	}
+	cue := Cue{
+		Type:       MessageType,
+		PTSMs:      start / int64(time.Millisecond),
+		DurationMs: duration.Milliseconds(),
+		Text:       text,
+		Speaker:    frame.Speaker,
+		Language:   frame.Language,
+		start:      start,
+		end:        start + int64(duration),
+		received:   received,
+	}
+	// A source restart moves the clock back; earlier cues no longer line up
+	if n := len(t.cues); n > 0 && start < t.cues[n-1].start {
+		t.cues = nil
+	}
+	t.cues = append(t.cues, cue)
+	t.prune(received)
+	t.mu.Unlock()
+
+	if t.broadcaster == nil {
+		return
+	}
+	data, _ := json.Marshal(cue)
+	if err := t.broadcaster.BroadcastMessage(data); err != nil {
+		t.errors.Add(1)
+		t.logger.Debug().Err(err).Msg("Failed to broadcast caption")
+		return
+	}
+	t.broadcast.Add(1)
+}
+
+// prune drops cues older than the window or beyond the cap. Caller holds
+// mu.
+func (t *Track) prune(now time.Time) {
+	drop := max(len(t.cues)-t.cfg.MaxCues, 0)
+	for drop < len(t.cues) && now.Sub(t.cues[drop].received) > t.cfg.Window {
+		drop++
+	}
+	if drop > 0 {
+		t.cues = append([]Cue(nil), t.cues[drop:]...)
+	}
+}
+
+// Cues returns the kept cues, oldest first
+func (t *Track) Cues() []Cue {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.prune(time.Now())
+	return append([]Cue(nil), t.cues...)
+}
+
+// WriteWebVTT writes the kept cues as a WebVTT file
+func (t *Track) WriteWebVTT(w io.Writer) error {
+	return WriteWebVTT(w, t.Cues())
+}
+
+// WriteWebVTT writes cues as a WebVTT file. Cue times are the PTS itself,
+// mapped to MPEG-TS time zero as HLS expects.
+func WriteWebVTT(w io.Writer, cues []Cue) error {
+	var b strings.Builder
+	b.WriteString("WEBVTT\nX-TIMESTAMP-MAP=MPEGTS:0,LOCAL:00:00:00.000\n")
+	for _, c := range cues {
+		fmt.Fprintf(&b, "\n%s --> %s\n", vttTime(c.start), vttTime(c.end))
+		text := escape(c.Text)
+		if c.Language != "" {
+			text = "<lang " + strings.Join(strings.Fields(escape(c.Language)), "") + ">" + text + "</lang>"
+		}
+		if c.Speaker != "" {
+			text = "<v " + strings.Join(strings.Fields(escape(c.Speaker)), " ") + ">" + text
+		}
+		b.WriteString(text)
+		b.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Stats returns track counters
+func (t *Track) Stats() Stats {
+	t.mu.Lock()
+	cues := len(t.cues)
+	t.mu.Unlock()
+	return Stats{
+		Cues:      cues,
+		Received:  t.received.Load(),
+		Broadcast: t.broadcast.Load(),
+		Errors:    t.errors.Load(),
+	}
+}
+
+// vttTime formats nanoseconds as hh:mm:ss.ttt
+func vttTime(ns int64) string {
+	ms := ns / int64(time.Millisecond)
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// escape makes text safe for a cue payload. Blank lines would end the cue,
+// so they are dropped.
+func escape(s string) string {
+	s = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	kept := lines[:0]
+	for _, l := range lines {
+		if l = strings.TrimSpace(l); l != "" {
+			kept = append(kept, l)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
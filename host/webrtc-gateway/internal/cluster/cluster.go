@@ -0,0 +1,558 @@
+// Package cluster lets several gateway instances share state through Redis,
+// so viewers can be load-balanced across instances behind one signaling URL.
+//
+// Each instance heartbeats its advertised URL and load into a shared hash and
+// records which instance owns each viewer session. Instances exchange
+// messages over Redis pub/sub: one channel per instance for directed
+// messages (e.g. a signaling request that reached the wrong instance) and
+// one broadcast channel.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+// Config configures cluster membership
+type Config struct {
+	RedisURL     string // redis://[[user]:password@]host[:port][/db]
+	AdvertiseURL string // Signaling URL viewers are sent to for this instance
+	InstanceID   string // Default <hostname>-<random>
+	Prefix       string // Key and channel prefix, default "gateway"
+
+	// HeartbeatInterval is how often load is published, default 2s. An
+	// instance missing three heartbeats is considered gone.
+	HeartbeatInterval time.Duration
+
+	Timeout time.Duration // Redis dial and command timeout, default 5s
+}
+
+// Load is what an instance reports about itself in each heartbeat
+type Load struct {
+	Peers int  `json:"peers"`
+	Live  bool `json:"live"` // The instance has live video for viewers
+}
+
+// Instance is one gateway in the cluster
+type Instance struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Load      Load      `json:"load"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Message is sent between instances
+type Message struct {
+	From   string          `json:"from"`
+	Type   string          `json:"type"`
+	PeerID string          `json:"peer_id,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// Stats are cluster counters
+type Stats struct {
+	InstanceID string     `json:"instance_id"`
+	Connected  bool       `json:"connected"`
+	Instances  []Instance `json:"instances"`
+	Sent       uint64     `json:"sent"`
+	Received   uint64     `json:"received"`
+	Errors     uint64     `json:"errors"`
+}
+
+// Cluster is this instance's membership in a gateway cluster
+type Cluster struct {
+	cfg    Config
+	opts   redisOptions
+	logger zerolog.Logger
+
+	// Command connection; redialled on the next command after an error
+	cmdMu sync.Mutex
+	cmd   *redisConn
+
+	mu        sync.Mutex
+	running   bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+	load      func() Load
+	onMessage func(Message)
+	instances []Instance
+	sessions  map[string]bool // Sessions claimed by this instance
+
+	connected atomic.Bool
+
+	// Statistics
+	sent     atomic.Uint64
+	received atomic.Uint64
+	errors   atomic.Uint64
+}
+
+// New creates a cluster member; Redis is contacted on Start
+func New(cfg Config, logger zerolog.Logger) (*Cluster, error) {
+	// Apply defaults for zero values
+	if cfg.InstanceID == "" {
+		host, _ := os.Hostname()
+		cfg.InstanceID = host + "-" + uuid.NewString()[:8]
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = "gateway"
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 2 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	opts, err := parseRedisURL(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+
+	return &Cluster{
+		cfg:      cfg,
+		opts:     opts,
+		logger:   logger.With().Str("component", "cluster").Str("instance_id", cfg.InstanceID).Logger(),
+		sessions: make(map[string]bool),
+	}, nil
+}
+
+// ID returns this instance's ID
+func (c *Cluster) ID() string {
+	return c.cfg.InstanceID
+}
+
+// SetLoad sets the function sampled for each heartbeat
+func (c *Cluster) SetLoad(fn func() Load) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.load = fn
+}
+
+// SetOnMessage sets a callback for messages sent to this instance or
+// broadcast by others. It runs on the subscriber goroutine and must not
+// block.
+func (c *Cluster) SetOnMessage(fn func(Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onMessage = fn
+}
+
+// Start joins the cluster; it fails if Redis cannot be reached
+func (c *Cluster) Start(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running {
+		return errors.New("cluster already started")
+	}
+	if _, err := c.do("PING"); err != nil {
+		return fmt.Errorf("failed to reach Redis: %w", err)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	c.running = true
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.heartbeatLoop(runCtx)
+	}()
+	go func() {
+		defer wg.Done()
+		c.subscribeLoop(runCtx)
+	}()
+	go func() {
+		wg.Wait()
+		close(c.done)
+	}()
+
+	c.logger.Info().
+		Str("redis", c.opts.addr).
+		Str("advertise_url", c.cfg.AdvertiseURL).
+		Msg("Joined cluster")
+
+	return nil
+}
+
+// Stop leaves the cluster, releasing this instance's sessions
+func (c *Cluster) Stop() error {
+	c.mu.Lock()
+	if !c.running {
+		c.mu.Unlock()
+		return nil
+	}
+	c.running = false
+	c.cancel()
+	done := c.done
+	sessions := make([]string, 0, len(c.sessions))
+	for id := range c.sessions {
+		sessions = append(sessions, id)
+	}
+	c.sessions = make(map[string]bool)
+	c.mu.Unlock()
+
+	<-done
+
+	var errs []error
+	if len(sessions) > 0 {
+		if _, err := c.do(append([]string{"HDEL", c.key("sessions")}, sessions...)...); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if _, err := c.do("HDEL", c.key("instances"), c.cfg.InstanceID); err != nil {
+		errs = append(errs, err)
+	}
+
+	c.cmdMu.Lock()
+	if c.cmd != nil {
+		c.cmd.Close()
+		c.cmd = nil
+	}
+	c.cmdMu.Unlock()
+
+	c.logger.Info().Msg("Left cluster")
+
+	return errors.Join(errs...)
+}
+
+// Instances returns the live instances as of the last heartbeat, by ID
+func (c *Cluster) Instances() []Instance {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Instance(nil), c.instances...)
+}
+
+// Pick returns the instance a new viewer should be sent to: the one with
+// the fewest peers among those with live video, preferring this instance on
+// a tie. ok is false when no instance is live.
+func (c *Cluster) Pick() (Instance, bool) {
+	var (
+		best Instance
+		ok   bool
+	)
+	for _, in := range c.Instances() {
+		if !in.Load.Live {
+			continue
+		}
+		if !ok || in.Load.Peers < best.Load.Peers ||
+			(in.Load.Peers == best.Load.Peers && in.ID == c.cfg.InstanceID) {
+			best, ok = in, true
+		}
+	}
+	return best, ok
+}
+
+// ClaimSession records this instance as the owner of a viewer session
+func (c *Cluster) ClaimSession(peerID string) error {
+	c.mu.Lock()
+	c.sessions[peerID] = true
+	c.mu.Unlock()
+	_, err := c.do("HSET", c.key("sessions"), peerID, c.cfg.InstanceID)
+	return err
+}
+
+// ReleaseSession forgets a session owned by this instance
+func (c *Cluster) ReleaseSession(peerID string) error {
+	c.mu.Lock()
+	owned := c.sessions[peerID]
+	delete(c.sessions, peerID)
+	c.mu.Unlock()
+	if !owned {
+		return nil
+	}
+	_, err := c.do("HDEL", c.key("sessions"), peerID)
+	return err
+}
+
+// SessionOwner returns the ID of the instance owning a session, or "" if
+// the session is unknown
+func (c *Cluster) SessionOwner(peerID string) (string, error) {
+	reply, err := c.do("HGET", c.key("sessions"), peerID)
+	if errors.Is(err, errNil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	owner, _ := reply.(string)
+	return owner, nil
+}
+
+// Send delivers msg to one instance
+func (c *Cluster) Send(instanceID string, msg Message) error {
+	return c.publish(c.key("instance", instanceID), msg)
+}
+
+// Broadcast delivers msg to every other instance
+func (c *Cluster) Broadcast(msg Message) error {
+	return c.publish(c.key("broadcast"), msg)
+}
+
+// Stats returns cluster counters and membership
+func (c *Cluster) Stats() Stats {
+	return Stats{
+		InstanceID: c.cfg.InstanceID,
+		Connected:  c.connected.Load(),
+		Instances:  c.Instances(),
+		Sent:       c.sent.Load(),
+		Received:   c.received.Load(),
+		Errors:     c.errors.Load(),
+	}
+}
+
+// publish sends msg on a channel, stamped with this instance's ID
+func (c *Cluster) publish(channel string, msg Message) error {
+	msg.From = c.cfg.InstanceID
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := c.do("PUBLISH", channel, string(data)); err != nil {
+		return err
+	}
+	c.sent.Add(1)
+	return nil
+}
+
+// key joins parts onto the configured prefix
+func (c *Cluster) key(parts ...string) string {
+	k := c.cfg.Prefix
+	for _, p := range parts {
+		k += ":" + p
+	}
+	return k
+}
+
+// do runs a command on the shared command connection
+func (c *Cluster) do(args ...string) (any, error) {
+	c.cmdMu.Lock()
+	defer c.cmdMu.Unlock()
+
+	if c.cmd == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), c.cfg.Timeout)
+		conn, err := dialRedis(ctx, c.opts, c.cfg.Timeout)
+		cancel()
+		if err != nil {
+			c.errors.Add(1)
+			return nil, err
+		}
+		c.cmd = conn
+	}
+
+	reply, err := c.cmd.do(args...)
+	var re redisError
+	if err != nil && !errors.Is(err, errNil) && !errors.As(err, &re) {
+		// The connection is in an unknown state; start over next time
+		c.cmd.Close()
+		c.cmd = nil
+		c.errors.Add(1)
+	}
+	return reply, err
+}
+
+// heartbeatLoop publishes this instance's load and refreshes membership
+func (c *Cluster) heartbeatLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.heartbeat(); err != nil {
+			c.logger.Warn().Err(err).Msg("Cluster heartbeat failed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// heartbeat writes this instance's entry and sessions and reads everyone
+// else's, removing entries and sessions of instances that stopped
+// heartbeating
+func (c *Cluster) heartbeat() error {
+	c.mu.Lock()
+	loadFn := c.load
+	c.mu.Unlock()
+
+	self := Instance{ID: c.cfg.InstanceID, URL: c.cfg.AdvertiseURL, UpdatedAt: time.Now().UTC()}
+	if loadFn != nil {
+		self.Load = loadFn()
+	}
+	data, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+	if _, err := c.do("HSET", c.key("instances"), self.ID, string(data)); err != nil {
+		return err
+	}
+	if err := c.reclaimSessions(); err != nil {
+		return err
+	}
+
+	reply, err := c.do("HGETALL", c.key("instances"))
+	if err != nil {
+		return err
+	}
+	fields := stringSlice(reply)
+
+	expiry := 3 * c.cfg.HeartbeatInterval
+	var (
+		instances []Instance
+		stale     []string
+	)
+	for i := 0; i+1 < len(fields); i += 2 {
+		var in Instance
+		if err := json.Unmarshal([]byte(fields[i+1]), &in); err != nil || time.Since(in.UpdatedAt) > expiry {
+			stale = append(stale, fields[i])
+			continue
+		}
+		instances = append(instances, in)
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+
+	if len(stale) > 0 {
+		c.logger.Info().Strs("instances", stale).Msg("Removing instances that stopped heartbeating")
+		if _, err := c.do(append([]string{"HDEL", c.key("instances")}, stale...)...); err != nil {
+			return err
+		}
+	}
+
+	c.mu.Lock()
+	c.instances = instances
+	c.mu.Unlock()
+	return c.pruneSessions(instances)
+}
+
+// reclaimSessions writes this instance's sessions again, so an instance
+// that was only late to heartbeat gets back the sessions pruned meanwhile
+func (c *Cluster) reclaimSessions() error {
+	// Held across the write, so a session released meanwhile is not
+	// written back after its release
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.sessions) == 0 {
+		return nil
+	}
+	args := []string{"HSET", c.key("sessions")}
+	for id := range c.sessions {
+		args = append(args, id, c.cfg.InstanceID)
+	}
+	_, err := c.do(args...)
+	return err
+}
+
+// pruneSessions forgets the sessions of instances other than live ones, so
+// viewers are not sent to a crashed instance and the hash does not grow
+// forever. Every heartbeat checks again, so a failed prune is retried, and
+// sessions of an instance wrongly thought gone are restored by its own next
+// heartbeat.
+func (c *Cluster) pruneSessions(live []Instance) error {
+	alive := make(map[string]bool, len(live)+1)
+	alive[c.cfg.InstanceID] = true
+	for _, in := range live {
+		alive[in.ID] = true
+	}
+	reply, err := c.do("HGETALL", c.key("sessions"))
+	if err != nil {
+		return err
+	}
+	fields := stringSlice(reply)
+	var orphaned []string
+	for i := 0; i+1 < len(fields); i += 2 {
+		if !alive[fields[i+1]] {
+			orphaned = append(orphaned, fields[i])
+		}
+	}
+	if len(orphaned) == 0 {
+		return nil
+	}
+	c.logger.Info().Int("sessions", len(orphaned)).Msg("Removing sessions of instances that stopped heartbeating")
+	_, err = c.do(append([]string{"HDEL", c.key("sessions")}, orphaned...)...)
+	return err
+}
+
+// subscribeLoop receives messages, resubscribing after connection loss
+func (c *Cluster) subscribeLoop(ctx context.Context) {
+	for {
+		err := c.subscribe(ctx)
+		c.connected.Store(false)
+		if ctx.Err() != nil {
+			return
+		}
+		c.errors.Add(1)
+		c.logger.Warn().Err(err).Msg("Cluster subscription lost")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.cfg.HeartbeatInterval):
+		}
+	}
+}
+
+// subscribe listens on this instance's channel and the broadcast channel
+// until the connection fails
+func (c *Cluster) subscribe(ctx context.Context) error {
+	conn, err := dialRedis(ctx, c.opts, c.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Unblock reads when stopping
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	own, broadcast := c.key("instance", c.cfg.InstanceID), c.key("broadcast")
+	if err := conn.send("SUBSCRIBE", own, broadcast); err != nil {
+		return err
+	}
+	c.connected.Store(true)
+
+	// Subscribed connections only carry pushes; no read deadline
+	if err := conn.conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+		push := stringSlice(reply)
+		if len(push) != 3 || push[0] != "message" {
+			continue // Subscription confirmations
+		}
+
+		var msg Message
+		if err := json.Unmarshal([]byte(push[2]), &msg); err != nil {
+			c.logger.Debug().Err(err).Msg("Ignoring malformed cluster message")
+			continue
+		}
+		if msg.From == c.cfg.InstanceID {
+			continue // Our own broadcast
+		}
+		c.received.Add(1)
+
+		c.mu.Lock()
+		fn := c.onMessage
+		c.mu.Unlock()
+		if fn != nil {
+			fn(msg)
+		}
+	}
+}
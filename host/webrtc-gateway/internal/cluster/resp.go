@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisError is an error reply from the server
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// errNil is returned for a nil bulk reply
+var errNil = errors.New("redis: nil")
+
+// redisConn is a minimal RESP2 client connection: enough for the handful of
+// commands the cluster uses, without pulling in a client library
+type redisConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// redisOptions are the connection settings parsed from a redis:// URL
+type redisOptions struct {
+	addr     string
+	username string
+	password string
+	db       int
+}
+
+// parseRedisURL parses redis://[[user]:password@]host[:port][/db]
+func parseRedisURL(raw string) (redisOptions, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redisOptions{}, err
+	}
+	if u.Scheme != "redis" {
+		return redisOptions{}, fmt.Errorf("unsupported scheme %q, want redis://", u.Scheme)
+	}
+
+	opts := redisOptions{addr: u.Host}
+	if u.Port() == "" {
+		opts.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		opts.username = u.User.Username()
+		opts.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if opts.db, err = strconv.Atoi(db); err != nil {
+			return redisOptions{}, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return opts, nil
+}
+
+// dialRedis connects, authenticates and selects the database
+func dialRedis(ctx context.Context, opts redisOptions, timeout time.Duration) (*redisConn, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", opts.addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+
+	if opts.password != "" {
+		args := []string{"AUTH", opts.password}
+		if opts.username != "" {
+			args = []string{"AUTH", opts.username, opts.password}
+		}
+		if _, err := c.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if opts.db != 0 {
+		if _, err := c.do("SELECT", strconv.Itoa(opts.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close closes the connection
+func (c *redisConn) Close() error {
+	return c.conn.Close()
+}
+
+// do sends a command and reads its reply
+func (c *redisConn) do(args ...string) (any, error) {
+	if err := c.send(args...); err != nil {
+		return nil, err
+	}
+	if err := c.conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// send writes a command as a RESP array of bulk strings
+func (c *redisConn) send(args ...string) error {
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b.WriteString("$" + strconv.Itoa(len(a)) + "\r\n" + a + "\r\n")
+	}
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write([]byte(b.String()))
+	return err
+}
+
+// read parses one reply. Strings come back as string, integers as int64,
+// arrays as []any; error replies are returned as errors.
+func (c *redisConn) read() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, errNil
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i], err = c.read()
+			if err != nil && !errors.Is(err, errNil) {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// stringSlice converts an array reply of strings
+func stringSlice(reply any) []string {
+	items, _ := reply.([]any)
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		s, _ := item.(string)
+		out = append(out, s)
+	}
+	return out
+}
@@ -0,0 +1,123 @@
+// Package commands dispatches the JSON messages viewers send on their data
+// channel. Every message carries a "type"; features register a handler for
+// the types they own and may answer with a reply sent back to that viewer.
+package commands
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrorType is the reply type for a message that failed
+const ErrorType = "error"
+
+// Handler handles one message from a viewer. A non-nil reply is sent back
+// to the viewer; an error is reported to it as an "error" message.
+type Handler func(peerID string, msg []byte) (reply any, err error)
+
+// Stats are router counters
+type Stats struct {
+	Types    []string `json:"types"`
+	Handled  uint64   `json:"handled"`
+	Unknown  uint64   `json:"unknown"`
+	Failed   uint64   `json:"failed"`
+	Rejected uint64   `json:"rejected"` // Not JSON or missing a type
+}
+
+// errorReply is sent when a handler fails
+type errorReply struct {
+	Type    string `json:"type"`
+	Request string `json:"request"`
+	Error   string `json:"error"`
+}
+
+// Router routes messages to handlers by type
+type Router struct {
+	logger zerolog.Logger
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+
+	// Statistics
+	handled  atomic.Uint64
+	unknown  atomic.Uint64
+	failed   atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// NewRouter creates a router with no handlers
+func NewRouter(logger zerolog.Logger) *Router {
+	return &Router{
+		logger:   logger.With().Str("component", "commands").Logger(),
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Handle registers h for messages of type typ, replacing any earlier one
+func (r *Router) Handle(typ string, h Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[typ] = h
+}
+
+// Dispatch handles a message from peerID and returns the encoded reply, or
+// nil when there is none. Unknown types are ignored, since other parts of
+// the gateway may own them.
+func (r *Router) Dispatch(peerID string, data []byte) []byte {
+	var envelope struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Type == "" {
+		r.rejected.Add(1)
+		return nil
+	}
+
+	r.mu.RLock()
+	h, ok := r.handlers[envelope.Type]
+	r.mu.RUnlock()
+	if !ok {
+		r.unknown.Add(1)
+		return nil
+	}
+
+	reply, err := h(peerID, data)
+	if err != nil {
+		r.failed.Add(1)
+		r.logger.Debug().Err(err).Str("peer_id", peerID).Str("type", envelope.Type).Msg("Command failed")
+		reply = errorReply{Type: ErrorType, Request: envelope.Type, Error: err.Error()}
+	} else {
+		r.handled.Add(1)
+	}
+	if reply == nil {
+		return nil
+	}
+	out, err := json.Marshal(reply)
+	if err != nil {
+		r.logger.Error().Err(err).Str("type", envelope.Type).Msg("Failed to encode command reply")
+		return nil
+	}
+	return out
+}
+
+// Stats returns router counters
+func (r *Router) Stats() Stats {
+	r.mu.RLock()
+	types := make([]string, 0, len(r.handlers))
+	for typ := range r.handlers {
+		types = append(types, typ)
+	}
+	r.mu.RUnlock()
+	sort.Strings(types)
+
+	return Stats{
+		Types:    types,
+		Handled:  r.handled.Load(),
+		Unknown:  r.unknown.Load(),
+		Failed:   r.failed.Load(),
+		Rejected: r.rejected.Load(),
+	}
+}
@@ -3,38 +3,252 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 )
 
 // Config holds all configuration for the WebRTC Gateway.
 type Config struct {
-	// IPCSocketPath is the Unix socket path for receiving encoded frames.
-	// Default: "/tmp/elgato_stream.sock"
+	// IPCSocketPath is the Unix socket path for receiving encoded frames,
+	// or on Windows a named pipe (\\.\pipe\name).
+	// Default: "/tmp/elgato_stream.sock", or \\.\pipe\elgato_stream on Windows
 	IPCSocketPath string
 
+	// IPCReadTimeoutMs is how long the gateway waits on a quiet producer
+	// before checking in, and how long a message it has begun may take to
+	// arrive in full before the producer is taken to be hung.
+	// Default: 5000
+	IPCReadTimeoutMs int
+
+	// IPCHeartbeatMs is how often the producer is pinged. A producer that
+	// answers pings is disconnected after IPCMaxMissedHeartbeats pings in a
+	// row go unanswered, telling a hung producer from an idle one. 0
+	// disables heartbeats.
+	// Default: 2000
+	IPCHeartbeatMs int
+
+	// IPCMaxMissedHeartbeats is how many pings in a row may go unanswered.
+	// Default: 3
+	IPCMaxMissedHeartbeats int
+
+	// IPCTapFile, when set, appends the raw byte stream of every producer
+	// connection to this file with arrival times, so a session can be
+	// replayed later with IPCReplayFile.
+	// Default: "" (disabled)
+	IPCTapFile string
+
+	// IPCTapMaxMB stops recording once the tap file reaches this size.
+	// Default: 1024
+	IPCTapMaxMB int
+
+	// IPCReplayFile replays a recorded tap file at its original pace in
+	// place of the IPC socket, wherever IPC input is used.
+	// Default: "" (listen on IPCSocketPath)
+	IPCReplayFile string
+
+	// IPCReplayLoop starts the replay over when the recording ends.
+	// Default: false
+	IPCReplayLoop bool
+
 	// HTTPListenAddr is the address for the HTTP signaling server.
 	// Default: ":8080"
 	HTTPListenAddr string
 
-	// AllowedOrigins specifies CORS allowed origins.
+	// HTTPTLSCertFile and HTTPTLSKeyFile serve signaling over HTTPS with
+	// this PEM certificate chain and key. Both or neither must be set.
+	// Default: "" (plain HTTP)
+	HTTPTLSCertFile string
+	HTTPTLSKeyFile  string
+
+	// AdminListenAddr is the address for the admin HTTP server (pause/resume
+	// and other operator controls). Keep it on loopback or a private network.
+	// Empty disables the admin server.
+	// Default: "127.0.0.1:8081"
+	AdminListenAddr string
+
+	// AdminTLSCertFile and AdminTLSKeyFile serve the admin API and dashboard
+	// over HTTPS, independently of signaling. Both or neither must be set.
+	// Default: "" (plain HTTP)
+	AdminTLSCertFile string
+	AdminTLSKeyFile  string
+
+	// AdminToken, when set, is required on every admin request as a bearer
+	// token or as the password of HTTP basic auth, which browsers prompt
+	// for. Set it whenever the admin server is reachable beyond loopback;
+	// without it, only requests addressed to loopback or AdminListenAddr's
+	// host are served.
+	// Default: ""
+	AdminToken string
+
+	// AdminDebug exposes /debug/pprof and /debug/state on the admin server.
+	// Default: false
+	AdminDebug bool
+
+	// SessionLogDir records each peer's offers, answers, candidates and
+	// connection states there as JSON, served at /api/debug/sessions on the
+	// admin server. Empty disables recording.
+	// Default: ""
+	SessionLogDir string
+
+	// SessionLogMax is how many recorded sessions are kept.
+	// Default: 200
+	SessionLogMax int
+
+	// AllowedOrigins specifies CORS allowed origins for routes without a
+	// policy in CORSRoutes. Entries may be exact origins, subdomain
+	// wildcards ("https://*.example.com") or "*".
 	// Default: ["*"]
 	AllowedOrigins []string
 
-	// VideoCodec specifies the video codec ("h264" or "hevc").
+	// CORSRoutes overrides AllowedOrigins by path prefix, e.g.
+	// {"/whep": ["*"], "/api": ["https://stream.example.com"]}; the longest
+	// matching prefix wins.
+	// Default: {}
+	CORSRoutes map[string][]string
+
+	// CSP is the Content-Security-Policy of signaling responses. Empty uses
+	// a policy suited to the bundled viewer portal; "off" sends none.
+	// Default: ""
+	CSP string
+
+	// HSTSMaxAgeSec enables Strict-Transport-Security on HTTPS requests.
+	// Default: 0 (disabled)
+	HSTSMaxAgeSec int
+
+	// SecurityHeaders adds or overrides response headers of the signaling
+	// server; an empty value removes one of the defaults.
+	// Default: {}
+	SecurityHeaders map[string]string
+
+	// MDNS advertises the signaling server on the local network as a
+	// _gaming-capture._tcp DNS-SD service so clients can discover it.
+	// Default: true
+	MDNS bool
+
+	// MDNSName is the advertised service name.
+	// Default: "" ("Gaming Capture on <hostname>")
+	MDNSName string
+
+	// ICEUDPPort multiplexes all viewers' ICE UDP traffic on one port, so
+	// port forwarding needs a single rule. 0 uses a port per viewer.
+	// Default: 0
+	ICEUDPPort int
+
+	// ICEPortMin and ICEPortMax limit the per-viewer UDP ports when
+	// ICEUDPPort is not set. 0 leaves them unrestricted.
+	// Default: 0
+	ICEPortMin int
+	ICEPortMax int
+
+	// NAT1To1IPs are public addresses of a 1:1 NAT (e.g. the router's WAN
+	// address with ICEUDPPort forwarded), as "public" or "public/private".
+	// Default: []
+	NAT1To1IPs []string
+
+	// NAT1To1Candidate is "host" to advertise NAT1To1IPs instead of local
+	// addresses, or "srflx" to advertise them in addition.
+	// Default: "host"
+	NAT1To1Candidate string
+
+	// ICETCPPort accepts ICE-TCP on this port for viewers whose networks
+	// block UDP. 0 disables ICE-TCP.
+	// Default: 0
+	ICETCPPort int
+
+	// TURNURLs are TURN servers for relay candidates; "turns:" URLs use
+	// TURN over TLS, e.g. "turns:turn.example.com:443?transport=tcp".
+	// Default: []
+	TURNURLs []string
+
+	// TURNUsername and TURNCredential authenticate with the TURN servers.
+	// Default: ""
+	TURNUsername   string
+	TURNCredential string
+
+	// ICEIPv6 controls IPv6 candidates: "enable" gathers IPv4 and IPv6,
+	// "prefer" also ranks IPv6 first, "disable" gathers IPv4 only.
+	// Default: "enable"
+	ICEIPv6 string
+
+	// VideoCodec specifies the video codec ("h264", "hevc" or "vp9"), or
+	// "auto" to follow the codec the producer sends. A fixed codec that the
+	// stream does not match is reported as an error.
 	// Default: "h264"
 	VideoCodec string
 
+	// HighBitDepth accepts 10-bit capture, streamed as HEVC Main 10 or VP9
+	// profile 2, so HDR keeps its gradients. While a viewer that decodes
+	// only 8-bit is connected, the producer is asked to encode 8-bit.
+	// Default: false
+	HighBitDepth bool
+
 	// MaxBitrateKbps is the maximum video bitrate in kbps.
 	// Default: 5000
 	MaxBitrateKbps int
 
+	// PacingFactor paces each viewer's video at this multiple of
+	// MaxBitrateKbps, spreading keyframes over a few milliseconds instead of
+	// sending them in one burst. 0 disables pacing.
+	// Default: 2.5
+	PacingFactor float64
+
+	// MaxOutputFPS caps the frame rate sent to viewers, e.g. 60 from a
+	// 120fps capture, by leaving out frames no other frame references:
+	// temporal layers of AV1 and VP9, non-reference frames of H.264.
+	// Keyframes are always sent. Streams without such frames, and HEVC, are
+	// sent at the full rate.
+	// Default: 0 (no cap)
+	MaxOutputFPS int
+
+	// DegradedMaxOutputFPS caps the frame rate further for viewers whose
+	// connection quality is fair or poor.
+	// Default: 0 (no cap)
+	DegradedMaxOutputFPS int
+
 	// LogLevel specifies logging verbosity ("debug", "info", "warn", "error").
 	// Default: "info"
 	LogLevel string
 
+	// LogFormat selects stdout log output: "console" (human-readable) or
+	// "json" (one JSON object per line, for log shippers).
+	// Default: "console"
+	LogFormat string
+
+	// LogFile additionally writes JSON logs to this file, rotated by size.
+	// Default: "" (stdout only)
+	LogFile string
+
+	// LogMaxSizeMB is the size at which LogFile is rotated.
+	// Default: 100
+	LogMaxSizeMB int
+
+	// LogMaxBackups is how many rotated log files are kept.
+	// Default: 5
+	LogMaxBackups int
+
+	// AccessLog logs every HTTP request to the signaling and admin servers:
+	// method, path, status, size, duration and peer ID. It can be toggled
+	// at runtime through the admin API.
+	// Default: false
+	AccessLog bool
+
+	// AccessLogSampleRate is the fraction of successful requests logged (0
+	// to 1). Failed and slow requests are always logged.
+	// Default: 1
+	AccessLogSampleRate float64
+
+	// AccessLogSlowMs is the duration above which a request is always
+	// logged and flagged as slow. 0 disables.
+	// Default: 1000
+	AccessLogSlowMs int
+
 	// UseSynthetic enables synthetic video generation instead of IPC input.
 	// Default: false
 	UseSynthetic bool
@@ -54,22 +268,771 @@ type Config struct {
 	// SyntheticPattern is the test pattern type (0=ColorBars, 1=Gradient, 2=Grid).
 	// Default: 0 (ColorBars)
 	SyntheticPattern int
+
+	// SyntheticPatternName selects a registered pattern rendered and encoded by
+	// the gateway itself ("timestamp", "bounce", "checkerboard", "noise", or a
+	// custom registration) instead of SyntheticPattern.
+	// Default: "" (use SyntheticPattern)
+	SyntheticPatternName string
+
+	// UseV4L2 enables direct capture from a V4L2 device instead of IPC input.
+	// Only supported on Linux.
+	// Default: false
+	UseV4L2 bool
+
+	// V4L2Device is the V4L2 device node to capture from.
+	// Default: "/dev/video0"
+	V4L2Device string
+
+	// V4L2Width is the requested capture width.
+	// Default: 1920
+	V4L2Width int
+
+	// V4L2Height is the requested capture height.
+	// Default: 1080
+	V4L2Height int
+
+	// V4L2FPS is the requested capture frame rate.
+	// Default: 60
+	V4L2FPS int
+
+	// V4L2PixelFormat is the requested capture format ("h264", "mjpeg", or "yuyv").
+	// Default: "h264"
+	V4L2PixelFormat string
+
+	// V4L2MinFPS is the lowest frame rate passed on from raw (mjpeg, yuyv)
+	// capture. When the device slows down, as webcams do in low light, the
+	// last picture is encoded again, so peers and recordings keep at least
+	// this rate. H.264 capture cannot be repeated without re-encoding and
+	// keeps the device's timing.
+	// Default: 0 (disabled)
+	V4L2MinFPS int
+
+	// Sources is an ordered failover chain of video sources ("ipc", "rtsp",
+	// "relay", "v4l2", "synthetic"), highest priority first. When set, it replaces
+	// UseSynthetic/UseV4L2 source selection.
+	// Default: [] (single source)
+	Sources []string
+
+	// RTSPURL is the RTSP stream pulled by the "rtsp" source.
+	// Default: ""
+	RTSPURL string
+
+	// RelayURL is the WHEP endpoint of an upstream gateway pulled by the
+	// "relay" source, for cascading one stream across several gateways.
+	// Default: ""
+	RelayURL string
+
+	// RelayToken is sent as a bearer token to RelayURL, if set.
+	// Default: ""
+	RelayToken string
+
+	// WHIPURL publishes the stream to this WHIP endpoint, such as a
+	// Cloudflare Stream or Dolby Millicast ingest URL, alongside the local
+	// viewers. Empty disables it.
+	// Default: ""
+	WHIPURL string
+
+	// WHIPToken is sent as a bearer token to WHIPURL, if set.
+	// Default: ""
+	WHIPToken string
+
+	// NDIName offers the stream as an NDI source with this name on the LAN,
+	// for OBS, vMix and other production tools. Requires a build with the
+	// ndi tag and the NDI SDK, and ffmpeg on PATH. Empty disables it.
+	// Default: ""
+	NDIName string
+
+	// NDIGroups limits the NDI source to these comma-separated groups.
+	// Empty is the public group.
+	// Default: ""
+	NDIGroups string
+
+	// MulticastAddr also sends the stream as MPEG-TS to this group and
+	// port, such as 239.255.0.1:5004, for set-top boxes and players on the
+	// LAN. Carries H.264 and H.265 only. Empty disables it.
+	// Default: ""
+	MulticastAddr string
+
+	// MulticastInterface is the network interface multicast is sent from.
+	// Empty follows the routing table.
+	// Default: ""
+	MulticastInterface string
+
+	// MulticastTTL is how many router hops multicast may cross; 1 keeps it
+	// on the local subnet.
+	// Default: 1
+	MulticastTTL int
+
+	// MulticastFormat is "rtp" for MPEG-TS over RTP or "udp" for bare
+	// MPEG-TS datagrams, which some set-top boxes expect.
+	// Default: "rtp"
+	MulticastFormat string
+
+	// FailoverTimeoutMs is how long a source in the chain may go without
+	// frames before it counts as unhealthy.
+	// Default: 2000
+	FailoverTimeoutMs int
+
+	// FailbackDelayMs is how long a higher-priority source must stay healthy
+	// before the chain switches back to it.
+	// Default: 5000
+	FailbackDelayMs int
+
+	// WebhookURLs receive a JSON POST for every gateway event (stream
+	// started/stopped, peer joined/left, source failover, ...).
+	// Default: [] (webhooks disabled)
+	WebhookURLs []string
+
+	// WebhookSecret signs webhook bodies with HMAC-SHA256 when set.
+	// Default: ""
+	WebhookSecret string
+
+	// WebhookEvents limits webhooks to the listed event types.
+	// Default: [] (all events)
+	WebhookEvents []string
+
+	// TracingEndpoint is the OTLP/HTTP collector (host:port) that receives
+	// OpenTelemetry traces. Empty disables tracing.
+	// Default: ""
+	TracingEndpoint string
+
+	// TracingInsecure sends traces over plain HTTP instead of HTTPS.
+	// Default: false
+	TracingInsecure bool
+
+	// TracingSampleRatio is the fraction of new traces recorded (0 to 1).
+	// Per-frame spans are numerous, so keep this low in production.
+	// Default: 0.01
+	TracingSampleRatio float64
+
+	// SourceTimeoutMs is how long the video source may go without delivering a
+	// frame before peers are switched to a "source offline" slate. 0 disables.
+	// Default: 2000
+	SourceTimeoutMs int
+
+	// WatchdogStallMs is how long the video source may go without delivering
+	// a frame before the watchdog logs diagnostics and requests a keyframe.
+	// 0 disables the watchdog.
+	// Default: 3000
+	WatchdogStallMs int
+
+	// WatchdogRestartMs restarts a stalled source after it has been stalled
+	// this long, repeating at the same interval. 0 disables restarts.
+	// Default: 0
+	WatchdogRestartMs int
+
+	// StatsDBPath is the database file for per-minute stats history, served
+	// at /api/stats/history on the admin server. Empty disables recording.
+	// Default: ""
+	StatsDBPath string
+
+	// StatsRetentionHours is how long stats history is kept.
+	// Default: 24
+	StatsRetentionHours int
+
+	// ReplaySeconds keeps that much of the stream in memory so the last
+	// moments can be saved as a clip via /api/clips. Zero disables the
+	// replay buffer.
+	// Default: 0
+	ReplaySeconds int
+
+	// ReplayMaxMB caps the memory held by the replay buffer, or its spool
+	// when ReplaySpoolDir is set.
+	// Default: 512
+	ReplayMaxMB int
+
+	// ReplaySpoolDir keeps the replay buffer's frames in files there rather
+	// than in memory, allowing buffers of gigabytes and up to an hour. Use a
+	// RAM disk such as /dev/shm/gaming-capture: frames are written as they
+	// arrive, and the spool outlives a crashed gateway, whose last moments
+	// are saved as a "-recovered" clip on the next start.
+	// Default: ""
+	ReplaySpoolDir string
+
+	// ClipDir is where saved clips are written.
+	// Default: "clips"
+	ClipDir string
+
+	// RecordingDir enables long recordings, started via /api/recordings or
+	// on a schedule, and is where they are written. Empty disables them.
+	// Default: ""
+	RecordingDir string
+
+	// RecordingMaxDiskMB is the disk budget for recordings; the oldest are
+	// deleted to stay under it. Zero is unlimited.
+	// Default: 0
+	RecordingMaxDiskMB int
+
+	// RecordingSegmentSec is how long each file of a recording runs.
+	// Default: 60
+	RecordingSegmentSec int
+
+	// ResourceCheckSec is how often disk space, memory and CPU are checked.
+	// Running low is reported as resource events and in /api/status;
+	// critically low disk space stops the recording and refuses new ones,
+	// and critical memory or CPU drops scalable video to its base layer.
+	// Zero disables the checks.
+	// Default: 5
+	ResourceCheckSec int
+
+	// DiskWarnMB and DiskCriticalMB are the free space thresholds for the
+	// recording, clip and replay spool directories. Zero disables one.
+	// Default: 4096 and 1024
+	DiskWarnMB     int
+	DiskCriticalMB int
+
+	// MemoryWarnPercent and MemoryCriticalPercent are the thresholds for
+	// system memory in use (Linux only). Zero disables one.
+	// Default: 90 and 95
+	MemoryWarnPercent     int
+	MemoryCriticalPercent int
+
+	// CPUWarnPercent and CPUCriticalPercent are the thresholds for CPU busy
+	// time across all cores (Linux only). Zero disables one.
+	// Default: 90 and 97
+	CPUWarnPercent     int
+	CPUCriticalPercent int
+
+	// FrameBudget times each pipeline stage per frame (source encoding,
+	// every distributor tap, writes to peers), warns when one takes longer
+	// than the budget, and labels CPU profiles by stage. Timings are in
+	// /api/status.
+	// Default: true
+	FrameBudget bool
+
+	// FrameBudgetMs is the time a stage may spend on a frame. Zero follows
+	// the stream's frame interval, e.g. 16.7ms at 60fps.
+	// Default: 0
+	FrameBudgetMs int
+
+	// ViewerMarkers lets viewers drop markers over the data channel, which
+	// clips and recordings carry as chapters. The admin API can always
+	// drop them while clips or recordings are enabled.
+	// Default: true
+	ViewerMarkers bool
+
+	// HighlightAnalyzers save clips on their own when they notice a
+	// highlight: "audio" for sudden loud moments, "scene" for cuts found
+	// from encoded frame sizes, and "webhook" for game events POSTed to
+	// /api/highlights. Needs ReplaySeconds. Empty disables detection.
+	// Default: [] (highlight clips disabled)
+	HighlightAnalyzers []string
+
+	// HighlightPreSec is how much of the stream before a highlight its
+	// clip keeps.
+	// Default: 20
+	HighlightPreSec int
+
+	// HighlightPostSec is how long after a highlight its clip is saved.
+	// Default: 5
+	HighlightPostSec int
+
+	// HighlightCooldownSec is the least time between highlight clips; zero
+	// uses HighlightPreSec, so clips do not overlap.
+	// Default: 0
+	HighlightCooldownSec int
+
+	// UploadBucket uploads saved clips and finished recording files to this
+	// S3-compatible bucket. Empty disables uploads.
+	// Default: ""
+	UploadBucket string
+
+	// UploadEndpoint is the storage service URL; for Google Cloud Storage,
+	// https://storage.googleapis.com with HMAC keys.
+	// Default: "" (https://s3.<UploadRegion>.amazonaws.com)
+	UploadEndpoint string
+
+	// UploadRegion is the region requests are signed for; "auto" for
+	// Google Cloud Storage.
+	// Default: "us-east-1"
+	UploadRegion string
+
+	// UploadAccessKeyID and UploadSecretAccessKey sign requests to the
+	// bucket; UploadSessionToken is set for temporary credentials.
+	// Default: ""
+	UploadAccessKeyID     string
+	UploadSecretAccessKey string
+	UploadSessionToken    string
+
+	// UploadPathStyle addresses the bucket in the URL path rather than the
+	// host name, as MinIO and most self-hosted servers need.
+	// Default: false
+	UploadPathStyle bool
+
+	// UploadPrefix is prepended to object keys, e.g. "gateway-1/".
+	// Default: ""
+	UploadPrefix string
+
+	// UploadStatePath is the file the upload queue is saved to, so uploads
+	// resume after a restart.
+	// Default: "" (the queue is held in memory and lost on restart)
+	UploadStatePath string
+
+	// UploadExpireDays deletes uploaded objects that many days after upload.
+	// Zero keeps them.
+	// Default: 0
+	UploadExpireDays int
+
+	// UploadURLTTLSec is how long signed download URLs from /api/uploads
+	// are valid, at most 7 days.
+	// Default: 3600
+	UploadURLTTLSec int
+
+	// Timeshift lets viewers pause and rewind within the replay buffer via
+	// data channel commands. Needs ReplaySeconds.
+	// Default: false
+	Timeshift bool
+
+	// ScreenshotDecoder selects how /api/screenshot decodes keyframes
+	// ("auto", "ffmpeg", or "pcm"). "auto" prefers ffmpeg when it is on
+	// PATH; "pcm" only decodes the raw output of the pcm encoder.
+	// Default: "auto"
+	ScreenshotDecoder string
+
+	// PreviewFPS is the frame rate of the MJPEG preview on the admin server
+	// (/api/preview.mjpeg). Zero disables the preview. Nothing is decoded
+	// while no one watches.
+	// Default: 2
+	PreviewFPS int
+
+	// PreviewWidth is the preview width in pixels.
+	// Default: 320
+	PreviewWidth int
+
+	// EncoderBackend selects the H.264 encoder for raw-frame sources: "nvenc"
+	// or "vaapi" on a GPU through ffmpeg, or "x264" in software. "auto"
+	// takes the first that works in that order, probing the GPU. "pcm" sends
+	// uncompressed macroblocks, for testing at small sizes, and is only used
+	// when named.
+	// Default: "auto"
+	EncoderBackend string
+
+	// EncoderDevice selects the GPU for hardware encoders: a VA-API render
+	// node such as /dev/dri/renderD129, or an NVENC GPU index. Empty uses
+	// the first.
+	// Default: ""
+	EncoderDevice string
+
+	// OverlayText is a watermark burned into video the gateway encodes
+	// (synthetic patterns, raw V4L2 capture). Empty draws none.
+	// Default: ""
+	OverlayText string
+
+	// OverlayImage is a PNG watermark, drawn with its alpha channel.
+	// Default: ""
+	OverlayImage string
+
+	// OverlayLive draws a LIVE badge.
+	// Default: false
+	OverlayLive bool
+
+	// OverlayViewers draws the number of connected viewers.
+	// Default: false
+	OverlayViewers bool
+
+	// OverlayPosition is the corner overlays are drawn in ("top-left",
+	// "top-right", "bottom-left", or "bottom-right").
+	// Default: "top-right"
+	OverlayPosition string
+
+	// KeyframeIntervalMs is the keyframe interval pushed to the capture
+	// service over the IPC control channel; also settable at runtime via
+	// /api/encoder/gop. Zero leaves the producer's own interval.
+	// Default: 0
+	KeyframeIntervalMs int
+
+	// JoinBurstPeers is how many viewers joining within 10s make the
+	// gateway shorten the keyframe interval for a while, so each newcomer
+	// waits less for a picture. Zero disables it.
+	// Default: 3
+	JoinBurstPeers int
+
+	// JoinBurstGOPMs is the keyframe interval during a join burst.
+	// Default: 500
+	JoinBurstGOPMs int
+
+	// DirectorToken lets a viewer claim the director role, which switches
+	// the capture service's scene and source, by sending it on the data
+	// channel. Empty means only the admin API grants the role.
+	// Default: ""
+	DirectorToken string
+
+	// CaptureCommand launches the capture service as a supervised child
+	// process: the executable followed by space-separated arguments. It is
+	// started after the IPC socket is listening with IPC_SOCKET_PATH set,
+	// restarted with backoff if it exits, and stopped with the gateway.
+	// Default: [] (not supervised)
+	CaptureCommand []string
+
+	// CaptureBackoffMs is the first restart delay after the capture
+	// service exits; it doubles on consecutive crashes up to 30s.
+	// Default: 1000
+	CaptureBackoffMs int
+
+	// TranscodeCommand launches a supervised worker, such as ffmpeg or
+	// gst-launch-1.0, per rendition: the executable followed by
+	// space-separated arguments. Workers read the stream as MPEG-TS on
+	// stdin and write their rendition as MPEG-TS on stdout, with its size
+	// and bitrate in GATEWAY_RENDITION_* variables.
+	// Default: [] (no renditions)
+	TranscodeCommand []string
+
+	// TranscodeRenditions are the renditions workers produce, as
+	// "name=WIDTHxHEIGHT[@KBPS]" entries, e.g. "360p=640x360@800".
+	// Default: []
+	TranscodeRenditions []string
+
+	// DrainWindowMs is how long connected viewers are given to leave on
+	// shutdown after being sent a "server_shutdown" notice. New viewers are
+	// refused meanwhile. 0 closes connections immediately.
+	// Default: 5000
+	DrainWindowMs int
+
+	// AudioDownmix selects how surround audio is folded to stereo for
+	// WebRTC: "itu" mixes centre and surrounds in at -3 dB and drops LFE,
+	// "front" keeps only front left and right. Recordings keep the source
+	// channels either way.
+	// Default: "itu"
+	AudioDownmix string
+
+	// AudioSources mixes several audio inputs the capture service tags,
+	// e.g. game audio and a microphone, as "name[:gain_db]" entries. The
+	// first sets the output timing and takes untagged audio. Empty passes
+	// the capture service's audio through unmixed.
+	// Default: []
+	AudioSources []string
+
+	// AudioMixes offers viewers a choice of mixes as "name=source+source"
+	// entries, e.g. "full=game+mic" and "game=game". The first is the
+	// default. Empty sends every viewer one mix of all sources.
+	// Default: []
+	AudioMixes []string
+
+	// AudioDuckSource is the mixed input that lowers the others while it
+	// is above AudioDuckThreshDB, e.g. "mic". Empty disables ducking.
+	// Default: ""
+	AudioDuckSource string
+
+	// AudioDuckDB is how far other inputs are lowered while ducking.
+	// Default: 12
+	AudioDuckDB int
+
+	// AudioDuckThreshDB is the level in dBFS that starts ducking.
+	// Default: -40
+	AudioDuckThreshDB int
+
+	// LoudnessTarget normalizes viewers' audio to this short-term loudness
+	// in LUFS, so switching titles does not change the level much. Zero
+	// disables normalization and the limiter. Recordings are unaffected.
+	// Default: 0
+	LoudnessTarget int
+
+	// LimiterCeilingDB is the peak level in dBFS the limiter holds
+	// normalized audio under.
+	// Default: -1
+	LimiterCeilingDB int
+
+	// ReturnSocketPath is the Unix socket or, on Windows, named pipe the
+	// host connects to for viewer microphone audio. Empty disables the
+	// return channel.
+	// Default: ""
+	ReturnSocketPath string
+
+	// ClusterRedisURL enables cluster mode: instances sharing this Redis
+	// (redis://[[user]:password@]host[:port][/db]) publish their load and
+	// viewer sessions so signaling can balance viewers across them.
+	// Default: "" (standalone)
+	ClusterRedisURL string
+
+	// ClusterAdvertiseURL is this instance's signaling URL as viewers reach
+	// it, e.g. "https://gw2.example.com"; required in cluster mode.
+	// Default: ""
+	ClusterAdvertiseURL string
+
+	// OIDCIssuer enables viewer sign-in with this OpenID Connect provider,
+	// e.g. "https://accounts.google.com". Empty leaves the portal open.
+	// Default: ""
+	OIDCIssuer string
+
+	// OIDCClientID is the gateway's client ID at the provider.
+	// Default: ""
+	OIDCClientID string
+
+	// OIDCClientSecret is the client secret; empty for a public client.
+	// Default: ""
+	OIDCClientSecret string
+
+	// OIDCRedirectURL is this gateway's /auth/callback as viewers reach it,
+	// registered at the provider.
+	// Default: ""
+	OIDCRedirectURL string
+
+	// OIDCAllowedUsers are the emails or subjects allowed to watch. With
+	// OIDCIssuer set, it or OIDCControllers must list someone unless
+	// OIDCAllowAnyUser is set.
+	// Default: []
+	OIDCAllowedUsers []string
+
+	// OIDCAllowAnyUser lets anyone the provider signs in watch, e.g. every
+	// Google account with https://accounts.google.com.
+	// Default: false
+	OIDCAllowAnyUser bool
+
+	// OIDCControllers are the emails or subjects allowed to send input to
+	// the game; they may always watch.
+	// Default: []
+	OIDCControllers []string
+
+	// SessionSecret signs viewer session cookies. Empty generates one at
+	// startup, which signs everyone out on restart.
+	// Default: ""
+	SessionSecret string
+
+	// InviteBaseURL is the viewer portal URL invite tokens are appended to
+	// in links minted by /api/invites, e.g. "https://stream.example.com/".
+	// Default: "" (links are returned as a bare query string)
+	InviteBaseURL string
+
+	// InvitesRequired rejects viewers without a valid invite link.
+	// Default: false (invites only attribute viewers)
+	InvitesRequired bool
+
+	// DuplicatePeerPolicy is what happens when a viewer offers with the
+	// peer ID of a connected session, usually a client reconnecting:
+	// "replace" closes the old session, "reject" refuses the new one with
+	// 409 Conflict, "suffix" keeps both and renames the new one.
+	// Default: "replace"
+	DuplicatePeerPolicy string
+
+	// PeerIdleTimeoutSec closes viewers that have sent no RTCP for this
+	// long while media was being sent to them: sessions whose ICE and DTLS
+	// linger after the viewer is gone. 0 disables.
+	// Default: 20
+	PeerIdleTimeoutSec int
+
+	// ConnectQR prints a QR code with a join link at startup. The admin
+	// server serves fresh ones at /connect/qr either way.
+	// Default: true
+	ConnectQR bool
+
+	// QRInviteTTLSec is the lifetime of invites minted for QR codes.
+	// Default: 600
+	QRInviteTTLSec int
+
+	// QRInviteMaxUses is how many viewers a QR code admits (0 is unlimited).
+	// Default: 1
+	QRInviteMaxUses int
+
+	// BanListPath is the file banned IPs and identities are saved to, so
+	// bans survive restarts.
+	// Default: "" (bans are held in memory and lost on restart)
+	BanListPath string
+
+	// StreamAccess protects streams by ID ("main" is the gateway's only
+	// stream, "*" any other), e.g. {"main": {"mode": "password", "password":
+	// "..."}}. Modes are public, password, token (with tokens) and users
+	// (with users, needs OIDCIssuer). Once any policy is set, streams
+	// without one are refused, and other stream IDs are never served.
+	// Default: {} (the stream is public)
+	StreamAccess map[string]StreamPolicy
+
+	// ViewerLocations names address ranges as "cidr=name" entries, e.g.
+	// "10.8.0.0/24=VPN", to show viewers' approximate location in the
+	// presence API; other addresses show as local network or internet.
+	// Default: [] (locations are not shown)
+	ViewerLocations []string
+}
+
+// StreamPolicy is the access policy of one stream
+type StreamPolicy struct {
+	Mode     string   `json:"mode"`
+	Password string   `json:"password,omitempty"`
+	Tokens   []string `json:"tokens,omitempty"`
+	Users    []string `json:"users,omitempty"`
+}
+
+// defaultIPCSocketPath is where capture services connect by default: a
+// named pipe on Windows, a Unix socket elsewhere.
+func defaultIPCSocketPath() string {
+	if runtime.GOOS == "windows" {
+		return `\\.\pipe\elgato_stream`
+	}
+	return "/tmp/elgato_stream.sock"
+}
+
+// isPipePath reports whether path names a Windows named pipe.
+func isPipePath(path string) bool {
+	return len(path) > 9 && strings.EqualFold(path[:9], `\\.\pipe\`)
 }
 
 // Default returns a Config with default values.
 func Default() *Config {
 	return &Config{
-		IPCSocketPath:    "/tmp/elgato_stream.sock",
-		HTTPListenAddr:   ":8080",
-		AllowedOrigins:   []string{"*"},
-		VideoCodec:       "h264",
-		MaxBitrateKbps:   5000,
-		LogLevel:         "info",
-		UseSynthetic:     false,
-		SyntheticWidth:   1280,
-		SyntheticHeight:  720,
-		SyntheticFPS:     30,
-		SyntheticPattern: 0,
+		IPCSocketPath:          defaultIPCSocketPath(),
+		IPCReadTimeoutMs:       5000,
+		IPCHeartbeatMs:         2000,
+		IPCMaxMissedHeartbeats: 3,
+		IPCTapMaxMB:            1024,
+		HTTPListenAddr:         ":8080",
+		HTTPTLSCertFile:        "",
+		HTTPTLSKeyFile:         "",
+		AdminListenAddr:        "127.0.0.1:8081",
+		AdminTLSCertFile:       "",
+		AdminTLSKeyFile:        "",
+		AdminToken:             "",
+		AdminDebug:             false,
+		SessionLogDir:          "",
+		SessionLogMax:          200,
+		AllowedOrigins:         []string{"*"},
+		CORSRoutes:             map[string][]string{},
+		CSP:                    "",
+		HSTSMaxAgeSec:          0,
+		SecurityHeaders:        map[string]string{},
+		MDNS:                   true,
+		MDNSName:               "",
+		ICEUDPPort:             0,
+		ICEPortMin:             0,
+		ICEPortMax:             0,
+		NAT1To1IPs:             []string{},
+		NAT1To1Candidate:       "host",
+		ICETCPPort:             0,
+		TURNURLs:               []string{},
+		TURNUsername:           "",
+		TURNCredential:         "",
+		ICEIPv6:                "enable",
+		VideoCodec:             "h264",
+		MaxBitrateKbps:         5000,
+		PacingFactor:           2.5,
+		MaxOutputFPS:           0,
+		DegradedMaxOutputFPS:   0,
+		LogLevel:               "info",
+		LogFormat:              "console",
+		LogFile:                "",
+		LogMaxSizeMB:           100,
+		LogMaxBackups:          5,
+		AccessLog:              false,
+		AccessLogSampleRate:    1,
+		AccessLogSlowMs:        1000,
+		UseSynthetic:           false,
+		SyntheticWidth:         1280,
+		SyntheticHeight:        720,
+		SyntheticFPS:           30,
+		SyntheticPattern:       0,
+		SyntheticPatternName:   "",
+		UseV4L2:                false,
+		V4L2Device:             "/dev/video0",
+		V4L2Width:              1920,
+		V4L2Height:             1080,
+		V4L2FPS:                60,
+		V4L2PixelFormat:        "h264",
+		V4L2MinFPS:             0,
+		Sources:                []string{},
+		RTSPURL:                "",
+		RelayURL:               "",
+		RelayToken:             "",
+		WHIPURL:                "",
+		WHIPToken:              "",
+		NDIName:                "",
+		NDIGroups:              "",
+		MulticastAddr:          "",
+		MulticastInterface:     "",
+		MulticastTTL:           1,
+		MulticastFormat:        "rtp",
+		FailoverTimeoutMs:      2000,
+		FailbackDelayMs:        5000,
+		TracingEndpoint:        "",
+		TracingInsecure:        false,
+		TracingSampleRatio:     0.01,
+		SourceTimeoutMs:        2000,
+		WebhookURLs:            []string{},
+		WebhookSecret:          "",
+		WebhookEvents:          []string{},
+		WatchdogStallMs:        3000,
+		WatchdogRestartMs:      0,
+		StatsDBPath:            "",
+		StatsRetentionHours:    24,
+		ReplaySeconds:          0,
+		ReplayMaxMB:            512,
+		ReplaySpoolDir:         "",
+		ClipDir:                "clips",
+		RecordingDir:           "",
+		RecordingMaxDiskMB:     0,
+		RecordingSegmentSec:    60,
+		ResourceCheckSec:       5,
+		DiskWarnMB:             4096,
+		DiskCriticalMB:         1024,
+		MemoryWarnPercent:      90,
+		MemoryCriticalPercent:  95,
+		CPUWarnPercent:         90,
+		CPUCriticalPercent:     97,
+		FrameBudget:            true,
+		FrameBudgetMs:          0,
+		ViewerMarkers:          true,
+		HighlightAnalyzers:     []string{},
+		HighlightPreSec:        20,
+		HighlightPostSec:       5,
+		HighlightCooldownSec:   0,
+		UploadBucket:           "",
+		UploadEndpoint:         "",
+		UploadRegion:           "us-east-1",
+		UploadAccessKeyID:      "",
+		UploadSecretAccessKey:  "",
+		UploadSessionToken:     "",
+		UploadPathStyle:        false,
+		UploadPrefix:           "",
+		UploadStatePath:        "",
+		UploadExpireDays:       0,
+		UploadURLTTLSec:        3600,
+		Timeshift:              false,
+		ScreenshotDecoder:      "auto",
+		PreviewFPS:             2,
+		PreviewWidth:           320,
+		EncoderBackend:         "auto",
+		EncoderDevice:          "",
+		OverlayText:            "",
+		OverlayImage:           "",
+		OverlayLive:            false,
+		OverlayViewers:         false,
+		OverlayPosition:        "top-right",
+		KeyframeIntervalMs:     0,
+		JoinBurstPeers:         3,
+		JoinBurstGOPMs:         500,
+		DirectorToken:          "",
+		CaptureCommand:         []string{},
+		CaptureBackoffMs:       1000,
+		TranscodeCommand:       []string{},
+		TranscodeRenditions:    []string{},
+		DrainWindowMs:          5000,
+		AudioDownmix:           "itu",
+		AudioSources:           []string{},
+		AudioMixes:             []string{},
+		AudioDuckSource:        "",
+		AudioDuckDB:            12,
+		AudioDuckThreshDB:      -40,
+		LoudnessTarget:         0,
+		LimiterCeilingDB:       -1,
+		ReturnSocketPath:       "",
+		ClusterRedisURL:        "",
+		ClusterAdvertiseURL:    "",
+		OIDCIssuer:             "",
+		OIDCClientID:           "",
+		OIDCClientSecret:       "",
+		OIDCRedirectURL:        "",
+		OIDCAllowedUsers:       []string{},
+		OIDCAllowAnyUser:       false,
+		OIDCControllers:        []string{},
+		SessionSecret:          "",
+		InviteBaseURL:          "",
+		InvitesRequired:        false,
+		DuplicatePeerPolicy:    "replace",
+		PeerIdleTimeoutSec:     20,
+		ConnectQR:              true,
+		QRInviteTTLSec:         600,
+		QRInviteMaxUses:        1,
+		BanListPath:            "",
+		StreamAccess:           map[string]StreamPolicy{},
+		ViewerLocations:        []string{},
 	}
 }
 
@@ -78,16 +1041,173 @@ func Default() *Config {
 //
 // Environment variables:
 //   - GATEWAY_IPC_SOCKET_PATH: Unix socket path
+//   - GATEWAY_IPC_READ_TIMEOUT_MS: Wait on a quiet producer, and limit on a message in progress
+//   - GATEWAY_IPC_HEARTBEAT_MS: Producer heartbeat interval (0 disables)
+//   - GATEWAY_IPC_MAX_MISSED_HEARTBEATS: Unanswered heartbeats before disconnecting the producer
+//   - GATEWAY_IPC_TAP: File producer streams are recorded to
+//   - GATEWAY_IPC_TAP_MAX_MB: Size at which recording stops
+//   - GATEWAY_IPC_REPLAY: Recorded tap file replayed instead of the IPC socket
+//   - GATEWAY_IPC_REPLAY_LOOP: Start the replay over when it ends (true/false)
 //   - GATEWAY_HTTP_LISTEN_ADDR: HTTP server listen address
+//   - GATEWAY_HTTP_TLS_CERT: PEM certificate chain serving signaling over HTTPS
+//   - GATEWAY_HTTP_TLS_KEY: PEM private key of GATEWAY_HTTP_TLS_CERT
+//   - GATEWAY_ADMIN_LISTEN_ADDR: Admin server listen address ("off" to disable)
+//   - GATEWAY_ADMIN_TLS_CERT: PEM certificate chain serving the admin server over HTTPS
+//   - GATEWAY_ADMIN_TLS_KEY: PEM private key of GATEWAY_ADMIN_TLS_CERT
+//   - GATEWAY_ADMIN_TOKEN: Token required on admin requests (bearer or basic auth password)
+//   - GATEWAY_ADMIN_DEBUG: Enable pprof and state dump on the admin server (true/false)
+//   - GATEWAY_SESSION_LOG_DIR: Directory recording per-peer signaling (enables)
+//   - GATEWAY_SESSION_LOG_MAX: Number of recorded sessions kept
 //   - GATEWAY_ALLOWED_ORIGINS: Comma-separated list of allowed CORS origins
-//   - GATEWAY_VIDEO_CODEC: Video codec (h264 or hevc)
+//   - GATEWAY_CORS_ROUTES: Per-route origins, e.g. "/whep=*;/api=https://a.example,https://b.example"
+//   - GATEWAY_CSP: Content-Security-Policy of signaling responses ("off" to disable)
+//   - GATEWAY_HSTS_MAX_AGE_SEC: Strict-Transport-Security max-age (0 disables)
+//   - GATEWAY_SECURITY_HEADERS: JSON object of extra or overriding response headers
+//   - GATEWAY_MDNS: Advertise the gateway on the LAN via mDNS/DNS-SD (true/false)
+//   - GATEWAY_MDNS_NAME: Advertised service name
+//   - GATEWAY_ICE_UDP_PORT: Single UDP port for all ICE traffic (0 disables the mux)
+//   - GATEWAY_ICE_PORT_MIN: Lowest per-viewer ICE UDP port
+//   - GATEWAY_ICE_PORT_MAX: Highest per-viewer ICE UDP port
+//   - GATEWAY_NAT_1TO1_IPS: Comma-separated public addresses of a 1:1 NAT
+//   - GATEWAY_NAT_1TO1_CANDIDATE: How NAT addresses are advertised (host, srflx)
+//   - GATEWAY_ICE_TCP_PORT: TCP port for ICE-TCP candidates (0 disables)
+//   - GATEWAY_TURN_URLS: Comma-separated TURN servers (turn: or turns: for TLS)
+//   - GATEWAY_TURN_USERNAME: TURN username
+//   - GATEWAY_TURN_CREDENTIAL: TURN password
+//   - GATEWAY_ICE_IPV6: IPv6 candidates (enable, prefer, disable)
+//   - GATEWAY_VIDEO_CODEC: Video codec (h264, hevc, vp9 or auto)
+//   - GATEWAY_HIGH_BIT_DEPTH: Accept 10-bit capture (true/false)
 //   - GATEWAY_MAX_BITRATE_KBPS: Maximum video bitrate in kbps
+//   - GATEWAY_PACING_FACTOR: Video pacing rate as a multiple of the maximum bitrate (0 disables)
+//   - GATEWAY_MAX_OUTPUT_FPS: Frame rate cap for viewers (0 = none)
+//   - GATEWAY_DEGRADED_MAX_OUTPUT_FPS: Frame rate cap for viewers with fair or poor quality (0 = none)
 //   - GATEWAY_LOG_LEVEL: Logging level (debug, info, warn, error)
+//   - GATEWAY_LOG_FORMAT: Stdout log format (console, json)
+//   - GATEWAY_LOG_FILE: Also write JSON logs to this file with rotation
+//   - GATEWAY_LOG_MAX_SIZE_MB: Log file size before rotation
+//   - GATEWAY_LOG_MAX_BACKUPS: Number of rotated log files kept
+//   - GATEWAY_ACCESS_LOG: Log every HTTP request (true/false)
+//   - GATEWAY_ACCESS_LOG_SAMPLE_RATE: Fraction of successful requests logged (0 to 1)
+//   - GATEWAY_ACCESS_LOG_SLOW_MS: Duration above which requests are always logged (0 disables)
 //   - GATEWAY_USE_SYNTHETIC: Enable synthetic video (true/false)
 //   - GATEWAY_SYNTHETIC_WIDTH: Synthetic video width
 //   - GATEWAY_SYNTHETIC_HEIGHT: Synthetic video height
 //   - GATEWAY_SYNTHETIC_FPS: Synthetic video frame rate
 //   - GATEWAY_SYNTHETIC_PATTERN: Synthetic video pattern (0=ColorBars, 1=Gradient, 2=Grid)
+//   - GATEWAY_SYNTHETIC_PATTERN_NAME: Gateway-rendered synthetic pattern (timestamp, bounce, checkerboard, noise)
+//   - GATEWAY_USE_V4L2: Enable direct V4L2 capture (true/false, Linux only)
+//   - GATEWAY_V4L2_DEVICE: V4L2 device node
+//   - GATEWAY_V4L2_WIDTH: V4L2 capture width
+//   - GATEWAY_V4L2_HEIGHT: V4L2 capture height
+//   - GATEWAY_V4L2_FPS: V4L2 capture frame rate
+//   - GATEWAY_V4L2_PIXEL_FORMAT: V4L2 capture format (h264, mjpeg, yuyv)
+//   - GATEWAY_V4L2_MIN_FPS: Minimum frame rate from raw V4L2 capture, repeating pictures (0 = off)
+//   - GATEWAY_SOURCES: Comma-separated failover chain (ipc, rtsp, relay, v4l2, synthetic)
+//   - GATEWAY_RTSP_URL: RTSP stream URL for the rtsp source
+//   - GATEWAY_RELAY_URL: Upstream WHEP endpoint for the relay source
+//   - GATEWAY_RELAY_TOKEN: Bearer token for the upstream WHEP endpoint
+//   - GATEWAY_WHIP_URL: WHIP endpoint the stream is also published to (enables)
+//   - GATEWAY_WHIP_TOKEN: Bearer token for the WHIP endpoint
+//   - GATEWAY_NDI_NAME: NDI source name the stream is offered under (enables)
+//   - GATEWAY_NDI_GROUPS: Comma-separated NDI groups for the source
+//   - GATEWAY_MULTICAST_ADDR: Group:port the stream is also sent to as MPEG-TS (enables)
+//   - GATEWAY_MULTICAST_INTERFACE: Network interface to send multicast from
+//   - GATEWAY_MULTICAST_TTL: Router hops multicast may cross (1 = local subnet)
+//   - GATEWAY_MULTICAST_FORMAT: MPEG-TS framing for multicast (rtp, udp)
+//   - GATEWAY_FAILOVER_TIMEOUT_MS: Frame gap before a chained source is unhealthy
+//   - GATEWAY_FAILBACK_DELAY_MS: Healthy time before failing back to a higher-priority source
+//   - GATEWAY_TRACING_ENDPOINT: OTLP/HTTP collector host:port (enables tracing)
+//   - GATEWAY_TRACING_INSECURE: Export traces over plain HTTP (true/false)
+//   - GATEWAY_TRACING_SAMPLE_RATIO: Fraction of traces recorded (0-1)
+//   - GATEWAY_SOURCE_TIMEOUT_MS: Frame gap before showing the offline slate (0 disables)
+//   - GATEWAY_WEBHOOK_URLS: Comma-separated webhook endpoints
+//   - GATEWAY_WEBHOOK_SECRET: HMAC-SHA256 key for signing webhook bodies
+//   - GATEWAY_WEBHOOK_EVENTS: Comma-separated event types to send (default all)
+//   - GATEWAY_WATCHDOG_STALL_MS: Frame gap before the watchdog reports a stall (0 disables)
+//   - GATEWAY_WATCHDOG_RESTART_MS: Stall time before restarting the source (0 disables)
+//   - GATEWAY_STATS_DB: Stats history database file (enables recording)
+//   - GATEWAY_STATS_RETENTION_HOURS: Hours of stats history kept
+//   - GATEWAY_REPLAY_SECONDS: Seconds of stream kept for clips (enables, e.g. 60)
+//   - GATEWAY_REPLAY_MAX_MB: Memory cap of the replay buffer
+//   - GATEWAY_REPLAY_SPOOL_DIR: Directory, ideally a RAM disk, holding the replay buffer instead of memory
+//   - GATEWAY_CLIP_DIR: Directory saved clips are written to
+//   - GATEWAY_RECORDING_DIR: Directory recordings are written to (enables)
+//   - GATEWAY_RECORDING_MAX_DISK_MB: Disk budget for recordings, 0 for unlimited
+//   - GATEWAY_RECORDING_SEGMENT_SEC: Length of each recording file
+//   - GATEWAY_RESOURCE_CHECK_SEC: Seconds between disk, memory and CPU checks, 0 to disable
+//   - GATEWAY_DISK_WARN_MB: Free disk space below which a warning is raised
+//   - GATEWAY_DISK_CRITICAL_MB: Free disk space below which recording stops
+//   - GATEWAY_MEMORY_WARN_PERCENT: Memory use above which a warning is raised
+//   - GATEWAY_MEMORY_CRITICAL_PERCENT: Memory use above which scalable video is cut to its base layer
+//   - GATEWAY_CPU_WARN_PERCENT: CPU use above which a warning is raised
+//   - GATEWAY_CPU_CRITICAL_PERCENT: CPU use above which scalable video is cut to its base layer
+//   - GATEWAY_FRAME_BUDGET: Time pipeline stages against the frame budget (true/false)
+//   - GATEWAY_FRAME_BUDGET_MS: Time a stage may spend per frame (0 follows the frame rate)
+//   - GATEWAY_VIEWER_MARKERS: Let viewers drop chapter markers over the data channel (true/false)
+//   - GATEWAY_HIGHLIGHT_ANALYZERS: Comma-separated highlight analyzers: audio, scene, webhook (enables)
+//   - GATEWAY_HIGHLIGHT_PRE_SEC: Seconds before a highlight kept in its clip
+//   - GATEWAY_HIGHLIGHT_POST_SEC: Seconds after a highlight before its clip is saved
+//   - GATEWAY_HIGHLIGHT_COOLDOWN_SEC: Least seconds between highlight clips (0 for the pre-roll)
+//   - GATEWAY_UPLOAD_BUCKET: S3-compatible bucket clips and recordings are uploaded to (enables)
+//   - GATEWAY_UPLOAD_ENDPOINT: Storage service URL (default AWS S3 in GATEWAY_UPLOAD_REGION)
+//   - GATEWAY_UPLOAD_REGION: Region requests are signed for
+//   - GATEWAY_UPLOAD_ACCESS_KEY_ID: Access key ID for the bucket
+//   - GATEWAY_UPLOAD_SECRET_ACCESS_KEY: Secret access key for the bucket
+//   - GATEWAY_UPLOAD_SESSION_TOKEN: Session token of temporary credentials
+//   - GATEWAY_UPLOAD_PATH_STYLE: Address the bucket in the URL path (true/false)
+//   - GATEWAY_UPLOAD_PREFIX: Prefix of object keys
+//   - GATEWAY_UPLOAD_STATE_PATH: File the upload queue is persisted to
+//   - GATEWAY_UPLOAD_EXPIRE_DAYS: Days after which uploaded objects are deleted, 0 to keep
+//   - GATEWAY_UPLOAD_URL_TTL_SEC: Lifetime of signed download URLs
+//   - GATEWAY_TIMESHIFT: Let viewers pause and rewind (true/false)
+//   - GATEWAY_SCREENSHOT_DECODER: Screenshot keyframe decoder (auto, ffmpeg, pcm)
+//   - GATEWAY_PREVIEW_FPS: MJPEG preview frame rate (0 disables)
+//   - GATEWAY_PREVIEW_WIDTH: MJPEG preview width in pixels
+//   - GATEWAY_ENCODER: Encoder backend for raw-frame sources (auto, nvenc, vaapi, x264, pcm)
+//   - GATEWAY_ENCODER_DEVICE: GPU for hardware encoders (VA-API render node or NVENC GPU index)
+//   - GATEWAY_OVERLAY_TEXT: Watermark text burned into gateway-encoded video
+//   - GATEWAY_OVERLAY_IMAGE: PNG watermark burned into gateway-encoded video
+//   - GATEWAY_OVERLAY_LIVE: Draw a LIVE badge (true/false)
+//   - GATEWAY_OVERLAY_VIEWERS: Draw the viewer count (true/false)
+//   - GATEWAY_OVERLAY_POSITION: Overlay corner (top-left, top-right, bottom-left, bottom-right)
+//   - GATEWAY_KEYFRAME_INTERVAL_MS: Keyframe interval pushed to the capture service (0 leaves it)
+//   - GATEWAY_JOIN_BURST_PEERS: Viewers joining within 10s that shorten the GOP (0 disables)
+//   - GATEWAY_JOIN_BURST_GOP_MS: Keyframe interval during a join burst
+//   - GATEWAY_DIRECTOR_TOKEN: Token a viewer sends to become director
+//   - GATEWAY_CAPTURE_COMMAND: Capture service command line to supervise
+//   - GATEWAY_CAPTURE_BACKOFF_MS: First restart delay after the capture service exits
+//   - GATEWAY_TRANSCODE_COMMAND: Transcode worker command line, run per rendition
+//   - GATEWAY_TRANSCODE_RENDITIONS: Comma-separated renditions, as name=WIDTHxHEIGHT[@KBPS]
+//   - GATEWAY_DRAIN_WINDOW_MS: Time viewers get to leave on shutdown (0 disables)
+//   - GATEWAY_AUDIO_DOWNMIX: Surround to stereo downmix for WebRTC (itu, front)
+//   - GATEWAY_AUDIO_SOURCES: Comma-separated audio inputs to mix, as name[:gain_db] (enables)
+//   - GATEWAY_AUDIO_MIXES: Comma-separated mixes viewers choose from, as name=source+source
+//   - GATEWAY_AUDIO_DUCK_SOURCE: Mixed input that ducks the others, e.g. mic
+//   - GATEWAY_AUDIO_DUCK_DB: Attenuation of other inputs while ducking
+//   - GATEWAY_AUDIO_DUCK_THRESHOLD_DB: Level in dBFS that starts ducking
+//   - GATEWAY_LOUDNESS_TARGET: Viewer audio loudness in LUFS, e.g. -16 (0 disables)
+//   - GATEWAY_LIMITER_CEILING_DB: Peak ceiling in dBFS for normalized audio
+//   - GATEWAY_RETURN_SOCKET_PATH: Unix socket for viewer audio to the host (enables)
+//   - GATEWAY_CLUSTER_REDIS_URL: Redis shared by cluster instances (enables cluster mode)
+//   - GATEWAY_CLUSTER_ADVERTISE_URL: This instance's signaling URL within the cluster
+//   - GATEWAY_OIDC_ISSUER: OpenID Connect issuer for viewer sign-in (enables)
+//   - GATEWAY_OIDC_CLIENT_ID: Client ID at the OIDC provider
+//   - GATEWAY_OIDC_CLIENT_SECRET: Client secret at the OIDC provider
+//   - GATEWAY_OIDC_REDIRECT_URL: This gateway's /auth/callback URL
+//   - GATEWAY_OIDC_ALLOWED_USERS: Comma-separated emails or subjects allowed to watch
+//   - GATEWAY_OIDC_ALLOW_ANY_USER: Let anyone the provider signs in watch (true/false)
+//   - GATEWAY_OIDC_CONTROLLERS: Comma-separated emails or subjects allowed to send input
+//   - GATEWAY_SESSION_SECRET: Key signing viewer session cookies
+//   - GATEWAY_INVITE_BASE_URL: Viewer portal URL used in invite links
+//   - GATEWAY_INVITES_REQUIRED: Reject viewers without a valid invite (true/false)
+//   - GATEWAY_DUPLICATE_PEER_POLICY: Handling of offers reusing a connected peer ID (replace, reject, suffix)
+//   - GATEWAY_PEER_IDLE_TIMEOUT_SEC: Close viewers silent on RTCP this long (0 disables)
+//   - GATEWAY_CONNECT_QR: Print a join QR code at startup (true/false)
+//   - GATEWAY_QR_INVITE_TTL_SEC: Lifetime of QR code invites
+//   - GATEWAY_QR_INVITE_MAX_USES: Viewers admitted per QR code (0 is unlimited)
+//   - GATEWAY_BAN_LIST_PATH: File the ban list is persisted to
+//   - GATEWAY_STREAM_ACCESS: JSON object of per-stream access policies
+//   - GATEWAY_VIEWER_LOCATIONS: Comma-separated cidr=name viewer locations
 func Load() (*Config, error) {
 	cfg := Default()
 
@@ -95,10 +1215,98 @@ func Load() (*Config, error) {
 		cfg.IPCSocketPath = val
 	}
 
+	if val := os.Getenv("GATEWAY_IPC_READ_TIMEOUT_MS"); val != "" {
+		ms, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_IPC_READ_TIMEOUT_MS must be a valid integer")
+		}
+		cfg.IPCReadTimeoutMs = ms
+	}
+
+	if val := os.Getenv("GATEWAY_IPC_HEARTBEAT_MS"); val != "" {
+		ms, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_IPC_HEARTBEAT_MS must be a valid integer")
+		}
+		cfg.IPCHeartbeatMs = ms
+	}
+
+	if val := os.Getenv("GATEWAY_IPC_MAX_MISSED_HEARTBEATS"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_IPC_MAX_MISSED_HEARTBEATS must be a valid integer")
+		}
+		cfg.IPCMaxMissedHeartbeats = n
+	}
+
+	if val := os.Getenv("GATEWAY_IPC_TAP"); val != "" {
+		cfg.IPCTapFile = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_IPC_TAP_MAX_MB"); val != "" {
+		maxMB, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_IPC_TAP_MAX_MB must be a valid integer")
+		}
+		cfg.IPCTapMaxMB = maxMB
+	}
+
+	if val := os.Getenv("GATEWAY_IPC_REPLAY"); val != "" {
+		cfg.IPCReplayFile = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_IPC_REPLAY_LOOP"); val != "" {
+		cfg.IPCReplayLoop = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
 	if val := os.Getenv("GATEWAY_HTTP_LISTEN_ADDR"); val != "" {
 		cfg.HTTPListenAddr = val
 	}
 
+	if val := os.Getenv("GATEWAY_HTTP_TLS_CERT"); val != "" {
+		cfg.HTTPTLSCertFile = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_HTTP_TLS_KEY"); val != "" {
+		cfg.HTTPTLSKeyFile = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_ADMIN_LISTEN_ADDR"); val != "" {
+		if strings.ToLower(strings.TrimSpace(val)) == "off" {
+			cfg.AdminListenAddr = ""
+		} else {
+			cfg.AdminListenAddr = val
+		}
+	}
+
+	if val := os.Getenv("GATEWAY_ADMIN_TLS_CERT"); val != "" {
+		cfg.AdminTLSCertFile = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_ADMIN_TLS_KEY"); val != "" {
+		cfg.AdminTLSKeyFile = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_ADMIN_TOKEN"); val != "" {
+		cfg.AdminToken = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_ADMIN_DEBUG"); val != "" {
+		cfg.AdminDebug = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_SESSION_LOG_DIR"); val != "" {
+		cfg.SessionLogDir = val
+	}
+
+	if val := os.Getenv("GATEWAY_SESSION_LOG_MAX"); val != "" {
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_SESSION_LOG_MAX must be a valid integer")
+		}
+		cfg.SessionLogMax = n
+	}
+
 	if val := os.Getenv("GATEWAY_ALLOWED_ORIGINS"); val != "" {
 		origins := strings.Split(val, ",")
 		cfg.AllowedOrigins = make([]string, 0, len(origins))
@@ -110,82 +1318,1003 @@ func Load() (*Config, error) {
 		}
 	}
 
-	if val := os.Getenv("GATEWAY_VIDEO_CODEC"); val != "" {
-		cfg.VideoCodec = strings.ToLower(strings.TrimSpace(val))
+	if val := os.Getenv("GATEWAY_CORS_ROUTES"); val != "" {
+		for _, entry := range strings.Split(val, ";") {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			prefix, origins, ok := strings.Cut(entry, "=")
+			if !ok {
+				return nil, errors.New("GATEWAY_CORS_ROUTES entries must be prefix=origin[,origin...]")
+			}
+			cfg.CORSRoutes[strings.TrimSpace(prefix)] = splitList(origins, false)
+		}
 	}
 
-	if val := os.Getenv("GATEWAY_MAX_BITRATE_KBPS"); val != "" {
-		bitrate, err := strconv.Atoi(val)
+	if val := os.Getenv("GATEWAY_CSP"); val != "" {
+		cfg.CSP = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_HSTS_MAX_AGE_SEC"); val != "" {
+		maxAge, err := strconv.Atoi(val)
 		if err != nil {
-			return nil, errors.New("GATEWAY_MAX_BITRATE_KBPS must be a valid integer")
+			return nil, errors.New("GATEWAY_HSTS_MAX_AGE_SEC must be a valid integer")
 		}
-		cfg.MaxBitrateKbps = bitrate
+		cfg.HSTSMaxAgeSec = maxAge
 	}
 
-	if val := os.Getenv("GATEWAY_LOG_LEVEL"); val != "" {
-		cfg.LogLevel = strings.ToLower(strings.TrimSpace(val))
+	if val := os.Getenv("GATEWAY_SECURITY_HEADERS"); val != "" {
+		if err := json.Unmarshal([]byte(val), &cfg.SecurityHeaders); err != nil {
+			return nil, errors.New("GATEWAY_SECURITY_HEADERS must be a JSON object of header names to values")
+		}
 	}
 
-	if val := os.Getenv("GATEWAY_USE_SYNTHETIC"); val != "" {
-		cfg.UseSynthetic = strings.ToLower(strings.TrimSpace(val)) == "true"
+	if val := os.Getenv("GATEWAY_MDNS"); val != "" {
+		cfg.MDNS = strings.ToLower(strings.TrimSpace(val)) == "true"
 	}
 
-	if val := os.Getenv("GATEWAY_SYNTHETIC_WIDTH"); val != "" {
-		width, err := strconv.Atoi(val)
+	if val := os.Getenv("GATEWAY_MDNS_NAME"); val != "" {
+		cfg.MDNSName = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_ICE_UDP_PORT"); val != "" {
+		port, err := strconv.Atoi(val)
 		if err != nil {
-			return nil, errors.New("GATEWAY_SYNTHETIC_WIDTH must be a valid integer")
+			return nil, errors.New("GATEWAY_ICE_UDP_PORT must be a valid integer")
 		}
-		cfg.SyntheticWidth = width
+		cfg.ICEUDPPort = port
 	}
 
-	if val := os.Getenv("GATEWAY_SYNTHETIC_HEIGHT"); val != "" {
-		height, err := strconv.Atoi(val)
+	if val := os.Getenv("GATEWAY_ICE_PORT_MIN"); val != "" {
+		port, err := strconv.Atoi(val)
 		if err != nil {
-			return nil, errors.New("GATEWAY_SYNTHETIC_HEIGHT must be a valid integer")
+			return nil, errors.New("GATEWAY_ICE_PORT_MIN must be a valid integer")
 		}
-		cfg.SyntheticHeight = height
+		cfg.ICEPortMin = port
 	}
 
-	if val := os.Getenv("GATEWAY_SYNTHETIC_FPS"); val != "" {
-		fps, err := strconv.Atoi(val)
+	if val := os.Getenv("GATEWAY_ICE_PORT_MAX"); val != "" {
+		port, err := strconv.Atoi(val)
 		if err != nil {
-			return nil, errors.New("GATEWAY_SYNTHETIC_FPS must be a valid integer")
+			return nil, errors.New("GATEWAY_ICE_PORT_MAX must be a valid integer")
 		}
-		cfg.SyntheticFPS = fps
+		cfg.ICEPortMax = port
 	}
 
-	if val := os.Getenv("GATEWAY_SYNTHETIC_PATTERN"); val != "" {
-		pattern, err := strconv.Atoi(val)
+	if val := os.Getenv("GATEWAY_NAT_1TO1_IPS"); val != "" {
+		cfg.NAT1To1IPs = splitList(val, false)
+	}
+
+	if val := os.Getenv("GATEWAY_NAT_1TO1_CANDIDATE"); val != "" {
+		cfg.NAT1To1Candidate = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_ICE_TCP_PORT"); val != "" {
+		port, err := strconv.Atoi(val)
 		if err != nil {
-			return nil, errors.New("GATEWAY_SYNTHETIC_PATTERN must be a valid integer")
+			return nil, errors.New("GATEWAY_ICE_TCP_PORT must be a valid integer")
 		}
-		cfg.SyntheticPattern = pattern
+		cfg.ICETCPPort = port
 	}
 
-	if err := cfg.Validate(); err != nil {
-		return nil, err
+	if val := os.Getenv("GATEWAY_TURN_URLS"); val != "" {
+		cfg.TURNURLs = splitList(val, false)
 	}
 
-	return cfg, nil
-}
+	if val := os.Getenv("GATEWAY_TURN_USERNAME"); val != "" {
+		cfg.TURNUsername = val
+	}
+
+	if val := os.Getenv("GATEWAY_TURN_CREDENTIAL"); val != "" {
+		cfg.TURNCredential = val
+	}
+
+	if val := os.Getenv("GATEWAY_ICE_IPV6"); val != "" {
+		cfg.ICEIPv6 = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_VIDEO_CODEC"); val != "" {
+		cfg.VideoCodec = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_HIGH_BIT_DEPTH"); val != "" {
+		cfg.HighBitDepth = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_MAX_BITRATE_KBPS"); val != "" {
+		bitrate, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_MAX_BITRATE_KBPS must be a valid integer")
+		}
+		cfg.MaxBitrateKbps = bitrate
+	}
+
+	if val := os.Getenv("GATEWAY_PACING_FACTOR"); val != "" {
+		factor, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if err != nil {
+			return nil, errors.New("GATEWAY_PACING_FACTOR must be a valid number")
+		}
+		cfg.PacingFactor = factor
+	}
+
+	if val := os.Getenv("GATEWAY_MAX_OUTPUT_FPS"); val != "" {
+		fps, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_MAX_OUTPUT_FPS must be a valid integer")
+		}
+		cfg.MaxOutputFPS = fps
+	}
+
+	if val := os.Getenv("GATEWAY_DEGRADED_MAX_OUTPUT_FPS"); val != "" {
+		fps, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_DEGRADED_MAX_OUTPUT_FPS must be a valid integer")
+		}
+		cfg.DegradedMaxOutputFPS = fps
+	}
+
+	if val := os.Getenv("GATEWAY_LOG_LEVEL"); val != "" {
+		cfg.LogLevel = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_LOG_FORMAT"); val != "" {
+		cfg.LogFormat = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_LOG_FILE"); val != "" {
+		cfg.LogFile = val
+	}
+
+	if val := os.Getenv("GATEWAY_LOG_MAX_SIZE_MB"); val != "" {
+		size, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_LOG_MAX_SIZE_MB must be a valid integer")
+		}
+		cfg.LogMaxSizeMB = size
+	}
+
+	if val := os.Getenv("GATEWAY_LOG_MAX_BACKUPS"); val != "" {
+		backups, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_LOG_MAX_BACKUPS must be a valid integer")
+		}
+		cfg.LogMaxBackups = backups
+	}
+
+	if val := os.Getenv("GATEWAY_ACCESS_LOG"); val != "" {
+		cfg.AccessLog = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_ACCESS_LOG_SAMPLE_RATE"); val != "" {
+		rate, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+		if err != nil {
+			return nil, errors.New("GATEWAY_ACCESS_LOG_SAMPLE_RATE must be a valid number")
+		}
+		cfg.AccessLogSampleRate = rate
+	}
+
+	if val := os.Getenv("GATEWAY_ACCESS_LOG_SLOW_MS"); val != "" {
+		ms, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_ACCESS_LOG_SLOW_MS must be a valid integer")
+		}
+		cfg.AccessLogSlowMs = ms
+	}
+
+	if val := os.Getenv("GATEWAY_USE_SYNTHETIC"); val != "" {
+		cfg.UseSynthetic = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_SYNTHETIC_WIDTH"); val != "" {
+		width, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_SYNTHETIC_WIDTH must be a valid integer")
+		}
+		cfg.SyntheticWidth = width
+	}
+
+	if val := os.Getenv("GATEWAY_SYNTHETIC_HEIGHT"); val != "" {
+		height, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_SYNTHETIC_HEIGHT must be a valid integer")
+		}
+		cfg.SyntheticHeight = height
+	}
+
+	if val := os.Getenv("GATEWAY_SYNTHETIC_FPS"); val != "" {
+		fps, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_SYNTHETIC_FPS must be a valid integer")
+		}
+		cfg.SyntheticFPS = fps
+	}
+
+	if val := os.Getenv("GATEWAY_SYNTHETIC_PATTERN"); val != "" {
+		pattern, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_SYNTHETIC_PATTERN must be a valid integer")
+		}
+		cfg.SyntheticPattern = pattern
+	}
+
+	if val := os.Getenv("GATEWAY_SYNTHETIC_PATTERN_NAME"); val != "" {
+		cfg.SyntheticPatternName = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_USE_V4L2"); val != "" {
+		cfg.UseV4L2 = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_V4L2_DEVICE"); val != "" {
+		cfg.V4L2Device = val
+	}
+
+	if val := os.Getenv("GATEWAY_V4L2_WIDTH"); val != "" {
+		width, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_V4L2_WIDTH must be a valid integer")
+		}
+		cfg.V4L2Width = width
+	}
+
+	if val := os.Getenv("GATEWAY_V4L2_HEIGHT"); val != "" {
+		height, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_V4L2_HEIGHT must be a valid integer")
+		}
+		cfg.V4L2Height = height
+	}
+
+	if val := os.Getenv("GATEWAY_V4L2_FPS"); val != "" {
+		fps, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_V4L2_FPS must be a valid integer")
+		}
+		cfg.V4L2FPS = fps
+	}
+
+	if val := os.Getenv("GATEWAY_V4L2_PIXEL_FORMAT"); val != "" {
+		cfg.V4L2PixelFormat = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_V4L2_MIN_FPS"); val != "" {
+		fps, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_V4L2_MIN_FPS must be a valid integer")
+		}
+		cfg.V4L2MinFPS = fps
+	}
+
+	if val := os.Getenv("GATEWAY_SOURCES"); val != "" {
+		cfg.Sources = splitList(val, true)
+	}
+
+	if val := os.Getenv("GATEWAY_RTSP_URL"); val != "" {
+		cfg.RTSPURL = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_RELAY_URL"); val != "" {
+		cfg.RelayURL = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_RELAY_TOKEN"); val != "" {
+		cfg.RelayToken = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_WHIP_URL"); val != "" {
+		cfg.WHIPURL = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_WHIP_TOKEN"); val != "" {
+		cfg.WHIPToken = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_NDI_NAME"); val != "" {
+		cfg.NDIName = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_NDI_GROUPS"); val != "" {
+		cfg.NDIGroups = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_MULTICAST_ADDR"); val != "" {
+		cfg.MulticastAddr = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_MULTICAST_INTERFACE"); val != "" {
+		cfg.MulticastInterface = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_MULTICAST_TTL"); val != "" {
+		ttl, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_MULTICAST_TTL must be a valid integer")
+		}
+		cfg.MulticastTTL = ttl
+	}
+
+	if val := os.Getenv("GATEWAY_MULTICAST_FORMAT"); val != "" {
+		cfg.MulticastFormat = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_FAILOVER_TIMEOUT_MS"); val != "" {
+		timeout, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_FAILOVER_TIMEOUT_MS must be a valid integer")
+		}
+		cfg.FailoverTimeoutMs = timeout
+	}
+
+	if val := os.Getenv("GATEWAY_FAILBACK_DELAY_MS"); val != "" {
+		delay, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_FAILBACK_DELAY_MS must be a valid integer")
+		}
+		cfg.FailbackDelayMs = delay
+	}
+
+	if val := os.Getenv("GATEWAY_TRACING_ENDPOINT"); val != "" {
+		cfg.TracingEndpoint = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_TRACING_INSECURE"); val != "" {
+		cfg.TracingInsecure = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_TRACING_SAMPLE_RATIO"); val != "" {
+		ratio, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, errors.New("GATEWAY_TRACING_SAMPLE_RATIO must be a valid number")
+		}
+		cfg.TracingSampleRatio = ratio
+	}
+
+	if val := os.Getenv("GATEWAY_SOURCE_TIMEOUT_MS"); val != "" {
+		timeout, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_SOURCE_TIMEOUT_MS must be a valid integer")
+		}
+		cfg.SourceTimeoutMs = timeout
+	}
+
+	if val := os.Getenv("GATEWAY_WEBHOOK_URLS"); val != "" {
+		cfg.WebhookURLs = splitList(val, false)
+	}
+
+	if val := os.Getenv("GATEWAY_WEBHOOK_SECRET"); val != "" {
+		cfg.WebhookSecret = val
+	}
+
+	if val := os.Getenv("GATEWAY_WEBHOOK_EVENTS"); val != "" {
+		cfg.WebhookEvents = splitList(val, true)
+	}
+
+	if val := os.Getenv("GATEWAY_WATCHDOG_STALL_MS"); val != "" {
+		stall, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_WATCHDOG_STALL_MS must be a valid integer")
+		}
+		cfg.WatchdogStallMs = stall
+	}
+
+	if val := os.Getenv("GATEWAY_WATCHDOG_RESTART_MS"); val != "" {
+		restart, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_WATCHDOG_RESTART_MS must be a valid integer")
+		}
+		cfg.WatchdogRestartMs = restart
+	}
+
+	if val := os.Getenv("GATEWAY_STATS_DB"); val != "" {
+		cfg.StatsDBPath = val
+	}
+
+	if val := os.Getenv("GATEWAY_STATS_RETENTION_HOURS"); val != "" {
+		hours, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_STATS_RETENTION_HOURS must be a valid integer")
+		}
+		cfg.StatsRetentionHours = hours
+	}
+
+	if val := os.Getenv("GATEWAY_REPLAY_SECONDS"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_REPLAY_SECONDS must be a valid integer")
+		}
+		cfg.ReplaySeconds = seconds
+	}
+
+	if val := os.Getenv("GATEWAY_REPLAY_MAX_MB"); val != "" {
+		mb, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_REPLAY_MAX_MB must be a valid integer")
+		}
+		cfg.ReplayMaxMB = mb
+	}
+
+	if val := os.Getenv("GATEWAY_REPLAY_SPOOL_DIR"); val != "" {
+		cfg.ReplaySpoolDir = val
+	}
+
+	if val := os.Getenv("GATEWAY_CLIP_DIR"); val != "" {
+		cfg.ClipDir = val
+	}
+
+	if val := os.Getenv("GATEWAY_RECORDING_DIR"); val != "" {
+		cfg.RecordingDir = val
+	}
+
+	if val := os.Getenv("GATEWAY_RECORDING_MAX_DISK_MB"); val != "" {
+		mb, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_RECORDING_MAX_DISK_MB must be a valid integer")
+		}
+		cfg.RecordingMaxDiskMB = mb
+	}
+
+	if val := os.Getenv("GATEWAY_RECORDING_SEGMENT_SEC"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_RECORDING_SEGMENT_SEC must be a valid integer")
+		}
+		cfg.RecordingSegmentSec = seconds
+	}
+
+	if val := os.Getenv("GATEWAY_RESOURCE_CHECK_SEC"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_RESOURCE_CHECK_SEC must be a valid integer")
+		}
+		cfg.ResourceCheckSec = seconds
+	}
+
+	if val := os.Getenv("GATEWAY_DISK_WARN_MB"); val != "" {
+		mb, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_DISK_WARN_MB must be a valid integer")
+		}
+		cfg.DiskWarnMB = mb
+	}
+
+	if val := os.Getenv("GATEWAY_DISK_CRITICAL_MB"); val != "" {
+		mb, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_DISK_CRITICAL_MB must be a valid integer")
+		}
+		cfg.DiskCriticalMB = mb
+	}
+
+	if val := os.Getenv("GATEWAY_MEMORY_WARN_PERCENT"); val != "" {
+		percent, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_MEMORY_WARN_PERCENT must be a valid integer")
+		}
+		cfg.MemoryWarnPercent = percent
+	}
+
+	if val := os.Getenv("GATEWAY_MEMORY_CRITICAL_PERCENT"); val != "" {
+		percent, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_MEMORY_CRITICAL_PERCENT must be a valid integer")
+		}
+		cfg.MemoryCriticalPercent = percent
+	}
+
+	if val := os.Getenv("GATEWAY_CPU_WARN_PERCENT"); val != "" {
+		percent, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_CPU_WARN_PERCENT must be a valid integer")
+		}
+		cfg.CPUWarnPercent = percent
+	}
+
+	if val := os.Getenv("GATEWAY_CPU_CRITICAL_PERCENT"); val != "" {
+		percent, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_CPU_CRITICAL_PERCENT must be a valid integer")
+		}
+		cfg.CPUCriticalPercent = percent
+	}
+
+	if val := os.Getenv("GATEWAY_FRAME_BUDGET"); val != "" {
+		cfg.FrameBudget = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_FRAME_BUDGET_MS"); val != "" {
+		ms, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_FRAME_BUDGET_MS must be a valid integer")
+		}
+		cfg.FrameBudgetMs = ms
+	}
+
+	if val := os.Getenv("GATEWAY_VIEWER_MARKERS"); val != "" {
+		cfg.ViewerMarkers = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_HIGHLIGHT_ANALYZERS"); val != "" {
+		cfg.HighlightAnalyzers = splitList(val, true)
+	}
+
+	if val := os.Getenv("GATEWAY_HIGHLIGHT_PRE_SEC"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_HIGHLIGHT_PRE_SEC must be a valid integer")
+		}
+		cfg.HighlightPreSec = seconds
+	}
+
+	if val := os.Getenv("GATEWAY_HIGHLIGHT_POST_SEC"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_HIGHLIGHT_POST_SEC must be a valid integer")
+		}
+		cfg.HighlightPostSec = seconds
+	}
+
+	if val := os.Getenv("GATEWAY_HIGHLIGHT_COOLDOWN_SEC"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_HIGHLIGHT_COOLDOWN_SEC must be a valid integer")
+		}
+		cfg.HighlightCooldownSec = seconds
+	}
+
+	if val := os.Getenv("GATEWAY_UPLOAD_BUCKET"); val != "" {
+		cfg.UploadBucket = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_UPLOAD_ENDPOINT"); val != "" {
+		cfg.UploadEndpoint = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_UPLOAD_REGION"); val != "" {
+		cfg.UploadRegion = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_UPLOAD_ACCESS_KEY_ID"); val != "" {
+		cfg.UploadAccessKeyID = val
+	}
+
+	if val := os.Getenv("GATEWAY_UPLOAD_SECRET_ACCESS_KEY"); val != "" {
+		cfg.UploadSecretAccessKey = val
+	}
+
+	if val := os.Getenv("GATEWAY_UPLOAD_SESSION_TOKEN"); val != "" {
+		cfg.UploadSessionToken = val
+	}
+
+	if val := os.Getenv("GATEWAY_UPLOAD_PATH_STYLE"); val != "" {
+		cfg.UploadPathStyle = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_UPLOAD_PREFIX"); val != "" {
+		cfg.UploadPrefix = val
+	}
+
+	if val := os.Getenv("GATEWAY_UPLOAD_STATE_PATH"); val != "" {
+		cfg.UploadStatePath = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_UPLOAD_EXPIRE_DAYS"); val != "" {
+		days, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_UPLOAD_EXPIRE_DAYS must be a valid integer")
+		}
+		cfg.UploadExpireDays = days
+	}
+
+	if val := os.Getenv("GATEWAY_UPLOAD_URL_TTL_SEC"); val != "" {
+		seconds, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_UPLOAD_URL_TTL_SEC must be a valid integer")
+		}
+		cfg.UploadURLTTLSec = seconds
+	}
+
+	if val := os.Getenv("GATEWAY_TIMESHIFT"); val != "" {
+		cfg.Timeshift = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_SCREENSHOT_DECODER"); val != "" {
+		cfg.ScreenshotDecoder = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_PREVIEW_FPS"); val != "" {
+		fps, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_PREVIEW_FPS must be a valid integer")
+		}
+		cfg.PreviewFPS = fps
+	}
+
+	if val := os.Getenv("GATEWAY_PREVIEW_WIDTH"); val != "" {
+		width, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_PREVIEW_WIDTH must be a valid integer")
+		}
+		cfg.PreviewWidth = width
+	}
+
+	if val := os.Getenv("GATEWAY_ENCODER"); val != "" {
+		cfg.EncoderBackend = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_ENCODER_DEVICE"); val != "" {
+		cfg.EncoderDevice = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_OVERLAY_TEXT"); val != "" {
+		cfg.OverlayText = val
+	}
+
+	if val := os.Getenv("GATEWAY_OVERLAY_IMAGE"); val != "" {
+		cfg.OverlayImage = val
+	}
+
+	if val := os.Getenv("GATEWAY_OVERLAY_LIVE"); val != "" {
+		cfg.OverlayLive = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_OVERLAY_VIEWERS"); val != "" {
+		cfg.OverlayViewers = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_OVERLAY_POSITION"); val != "" {
+		cfg.OverlayPosition = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_KEYFRAME_INTERVAL_MS"); val != "" {
+		ms, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_KEYFRAME_INTERVAL_MS must be a valid integer")
+		}
+		cfg.KeyframeIntervalMs = ms
+	}
+
+	if val := os.Getenv("GATEWAY_JOIN_BURST_PEERS"); val != "" {
+		peers, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_JOIN_BURST_PEERS must be a valid integer")
+		}
+		cfg.JoinBurstPeers = peers
+	}
+
+	if val := os.Getenv("GATEWAY_JOIN_BURST_GOP_MS"); val != "" {
+		ms, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_JOIN_BURST_GOP_MS must be a valid integer")
+		}
+		cfg.JoinBurstGOPMs = ms
+	}
+
+	if val := os.Getenv("GATEWAY_DIRECTOR_TOKEN"); val != "" {
+		cfg.DirectorToken = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_CAPTURE_COMMAND"); val != "" {
+		cfg.CaptureCommand = strings.Fields(val)
+	}
+
+	if val := os.Getenv("GATEWAY_CAPTURE_BACKOFF_MS"); val != "" {
+		delay, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_CAPTURE_BACKOFF_MS must be a valid integer")
+		}
+		cfg.CaptureBackoffMs = delay
+	}
+
+	if val := os.Getenv("GATEWAY_TRANSCODE_COMMAND"); val != "" {
+		cfg.TranscodeCommand = strings.Fields(val)
+	}
+
+	if val := os.Getenv("GATEWAY_TRANSCODE_RENDITIONS"); val != "" {
+		cfg.TranscodeRenditions = splitList(val, true)
+	}
+
+	if val := os.Getenv("GATEWAY_DRAIN_WINDOW_MS"); val != "" {
+		window, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_DRAIN_WINDOW_MS must be a valid integer")
+		}
+		cfg.DrainWindowMs = window
+	}
+
+	if val := os.Getenv("GATEWAY_AUDIO_DOWNMIX"); val != "" {
+		cfg.AudioDownmix = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_AUDIO_SOURCES"); val != "" {
+		cfg.AudioSources = splitList(val, true)
+	}
+
+	if val := os.Getenv("GATEWAY_AUDIO_MIXES"); val != "" {
+		cfg.AudioMixes = splitList(val, true)
+	}
+
+	if val := os.Getenv("GATEWAY_AUDIO_DUCK_SOURCE"); val != "" {
+		cfg.AudioDuckSource = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_AUDIO_DUCK_DB"); val != "" {
+		db, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_AUDIO_DUCK_DB must be a valid integer")
+		}
+		cfg.AudioDuckDB = db
+	}
+
+	if val := os.Getenv("GATEWAY_AUDIO_DUCK_THRESHOLD_DB"); val != "" {
+		db, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_AUDIO_DUCK_THRESHOLD_DB must be a valid integer")
+		}
+		cfg.AudioDuckThreshDB = db
+	}
+
+	if val := os.Getenv("GATEWAY_LOUDNESS_TARGET"); val != "" {
+		lufs, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_LOUDNESS_TARGET must be a valid integer")
+		}
+		cfg.LoudnessTarget = lufs
+	}
+
+	if val := os.Getenv("GATEWAY_LIMITER_CEILING_DB"); val != "" {
+		db, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_LIMITER_CEILING_DB must be a valid integer")
+		}
+		cfg.LimiterCeilingDB = db
+	}
+
+	if val := os.Getenv("GATEWAY_RETURN_SOCKET_PATH"); val != "" {
+		cfg.ReturnSocketPath = val
+	}
+
+	if val := os.Getenv("GATEWAY_CLUSTER_REDIS_URL"); val != "" {
+		cfg.ClusterRedisURL = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_CLUSTER_ADVERTISE_URL"); val != "" {
+		cfg.ClusterAdvertiseURL = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_OIDC_ISSUER"); val != "" {
+		cfg.OIDCIssuer = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_OIDC_CLIENT_ID"); val != "" {
+		cfg.OIDCClientID = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_OIDC_CLIENT_SECRET"); val != "" {
+		cfg.OIDCClientSecret = val
+	}
+
+	if val := os.Getenv("GATEWAY_OIDC_REDIRECT_URL"); val != "" {
+		cfg.OIDCRedirectURL = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_OIDC_ALLOWED_USERS"); val != "" {
+		cfg.OIDCAllowedUsers = splitList(val, true)
+	}
+
+	if val := os.Getenv("GATEWAY_OIDC_ALLOW_ANY_USER"); val != "" {
+		cfg.OIDCAllowAnyUser = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_OIDC_CONTROLLERS"); val != "" {
+		cfg.OIDCControllers = splitList(val, true)
+	}
+
+	if val := os.Getenv("GATEWAY_SESSION_SECRET"); val != "" {
+		cfg.SessionSecret = val
+	}
+
+	if val := os.Getenv("GATEWAY_INVITE_BASE_URL"); val != "" {
+		cfg.InviteBaseURL = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_INVITES_REQUIRED"); val != "" {
+		cfg.InvitesRequired = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_DUPLICATE_PEER_POLICY"); val != "" {
+		cfg.DuplicatePeerPolicy = strings.ToLower(strings.TrimSpace(val))
+	}
+
+	if val := os.Getenv("GATEWAY_PEER_IDLE_TIMEOUT_SEC"); val != "" {
+		sec, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_PEER_IDLE_TIMEOUT_SEC must be a valid integer")
+		}
+		cfg.PeerIdleTimeoutSec = sec
+	}
+
+	if val := os.Getenv("GATEWAY_CONNECT_QR"); val != "" {
+		cfg.ConnectQR = strings.ToLower(strings.TrimSpace(val)) == "true"
+	}
+
+	if val := os.Getenv("GATEWAY_QR_INVITE_TTL_SEC"); val != "" {
+		ttl, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_QR_INVITE_TTL_SEC must be a valid integer")
+		}
+		cfg.QRInviteTTLSec = ttl
+	}
+
+	if val := os.Getenv("GATEWAY_QR_INVITE_MAX_USES"); val != "" {
+		uses, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("GATEWAY_QR_INVITE_MAX_USES must be a valid integer")
+		}
+		cfg.QRInviteMaxUses = uses
+	}
+
+	if val := os.Getenv("GATEWAY_BAN_LIST_PATH"); val != "" {
+		cfg.BanListPath = strings.TrimSpace(val)
+	}
+
+	if val := os.Getenv("GATEWAY_STREAM_ACCESS"); val != "" {
+		if err := json.Unmarshal([]byte(val), &cfg.StreamAccess); err != nil {
+			return nil, errors.New("GATEWAY_STREAM_ACCESS must be a JSON object of stream policies")
+		}
+	}
+
+	if val := os.Getenv("GATEWAY_VIEWER_LOCATIONS"); val != "" {
+		cfg.ViewerLocations = splitList(val, false)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
 
 // Validate checks that the configuration values are valid.
 func (c *Config) Validate() error {
 	if c.IPCSocketPath == "" {
 		return errors.New("IPCSocketPath cannot be empty")
 	}
+	if isPipePath(c.IPCSocketPath) && runtime.GOOS != "windows" {
+		return errors.New("IPCSocketPath is a named pipe, which only Windows supports")
+	}
+
+	if c.IPCReadTimeoutMs < 100 {
+		return errors.New("IPCReadTimeoutMs must be at least 100")
+	}
+
+	if c.IPCHeartbeatMs < 0 || (c.IPCHeartbeatMs > 0 && c.IPCHeartbeatMs < 100) {
+		return errors.New("IPCHeartbeatMs must be 0 or at least 100")
+	}
+
+	if c.IPCHeartbeatMs > 0 && c.IPCMaxMissedHeartbeats < 1 {
+		return errors.New("IPCMaxMissedHeartbeats must be a positive integer")
+	}
+
+	if c.IPCTapFile != "" && c.IPCTapMaxMB <= 0 {
+		return errors.New("IPCTapMaxMB must be a positive integer")
+	}
+
+	if c.IPCReplayFile != "" {
+		if c.IPCReplayFile == c.IPCTapFile {
+			return errors.New("IPCReplayFile must differ from IPCTapFile")
+		}
+		if c.UseSynthetic || c.UseV4L2 || (len(c.Sources) > 0 && !c.HasSource("ipc")) {
+			return errors.New("IPCReplayFile requires IPC input")
+		}
+	}
 
 	if c.HTTPListenAddr == "" {
 		return errors.New("HTTPListenAddr cannot be empty")
 	}
 
+	if _, _, err := net.SplitHostPort(c.HTTPListenAddr); err != nil {
+		return errors.New("HTTPListenAddr must be host:port, with IPv6 hosts in brackets ([::1]:8080)")
+	}
+
+	if c.AdminListenAddr != "" && c.AdminListenAddr == c.HTTPListenAddr {
+		return errors.New("AdminListenAddr must differ from HTTPListenAddr")
+	}
+
+	if c.AdminListenAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdminListenAddr); err != nil {
+			return errors.New("AdminListenAddr must be host:port, with IPv6 hosts in brackets ([::1]:8081)")
+		}
+	}
+
+	if (c.HTTPTLSCertFile == "") != (c.HTTPTLSKeyFile == "") {
+		return errors.New("HTTPTLSCertFile and HTTPTLSKeyFile must be set together")
+	}
+
+	if (c.AdminTLSCertFile == "") != (c.AdminTLSKeyFile == "") {
+		return errors.New("AdminTLSCertFile and AdminTLSKeyFile must be set together")
+	}
+
+	if c.AdminToken != "" && len(c.AdminToken) < 16 {
+		return errors.New("AdminToken must be at least 16 characters")
+	}
+
 	if len(c.AllowedOrigins) == 0 {
 		return errors.New("AllowedOrigins cannot be empty")
 	}
 
-	validCodecs := map[string]bool{"h264": true, "hevc": true}
-	if !validCodecs[c.VideoCodec] {
-		return errors.New("VideoCodec must be 'h264' or 'hevc'")
+	for prefix, origins := range c.CORSRoutes {
+		if !strings.HasPrefix(prefix, "/") {
+			return errors.New("CORSRoutes prefixes must start with /")
+		}
+		if len(origins) == 0 {
+			return errors.New("CORSRoutes entries need at least one origin")
+		}
+	}
+
+	if c.HSTSMaxAgeSec < 0 {
+		return errors.New("HSTSMaxAgeSec cannot be negative")
+	}
+
+	for name := range c.SecurityHeaders {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return errors.New("SecurityHeaders names must be valid header names")
+		}
+	}
+
+	if c.ICEUDPPort < 0 || c.ICEUDPPort > 65535 {
+		return errors.New("ICEUDPPort must be between 0 and 65535")
+	}
+
+	if c.ICEPortMin != 0 || c.ICEPortMax != 0 {
+		if c.ICEPortMin < 1 || c.ICEPortMax > 65535 || c.ICEPortMin > c.ICEPortMax {
+			return errors.New("ICEPortMin and ICEPortMax must form a range within 1-65535")
+		}
+		if c.ICEUDPPort != 0 {
+			return errors.New("ICEPortMin and ICEPortMax cannot be used with ICEUDPPort")
+		}
+	}
+
+	for _, mapping := range c.NAT1To1IPs {
+		public, private, mapped := strings.Cut(mapping, "/")
+		if net.ParseIP(public) == nil || (mapped && net.ParseIP(private) == nil) {
+			return errors.New("NAT1To1IPs entries must be IP addresses, optionally as public/private")
+		}
+	}
+
+	if c.NAT1To1Candidate != "host" && c.NAT1To1Candidate != "srflx" {
+		return errors.New("NAT1To1Candidate must be 'host' or 'srflx'")
+	}
+
+	if len(c.MDNSName) > 63 {
+		return errors.New("MDNSName must be at most 63 bytes")
+	}
+
+	validIPv6 := map[string]bool{"enable": true, "prefer": true, "disable": true}
+	if !validIPv6[c.ICEIPv6] {
+		return errors.New("ICEIPv6 must be 'enable', 'prefer' or 'disable'")
+	}
+
+	if c.ICETCPPort < 0 || c.ICETCPPort > 65535 {
+		return errors.New("ICETCPPort must be between 0 and 65535")
+	}
+
+	for _, u := range c.TURNURLs {
+		if !strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") {
+			return errors.New("TURNURLs must be turn: or turns: URLs")
+		}
+	}
+
+	if len(c.TURNURLs) > 0 && (c.TURNUsername == "" || c.TURNCredential == "") {
+		return errors.New("TURNUsername and TURNCredential are required with TURNURLs")
+	}
+
+	validCodecs := map[string]bool{"h264": true, "hevc": true, "vp9": true, "auto": true}
+	if !validCodecs[c.VideoCodec] {
+		return errors.New("VideoCodec must be 'h264', 'hevc', 'vp9' or 'auto'")
+	}
+
+	if c.HighBitDepth && c.VideoCodec == "h264" {
+		return errors.New("HighBitDepth requires VideoCodec 'hevc', 'vp9' or 'auto'; browsers do not decode 10-bit H.264")
 	}
 
 	if c.MaxBitrateKbps <= 0 {
@@ -196,6 +2325,18 @@ func (c *Config) Validate() error {
 		return errors.New("MaxBitrateKbps exceeds maximum allowed value of 100000")
 	}
 
+	// Pacing at or below the bitrate would queue without bound
+	if c.PacingFactor != 0 && (c.PacingFactor < 1.2 || c.PacingFactor > 10) {
+		return errors.New("PacingFactor must be 0 or between 1.2 and 10")
+	}
+
+	if c.MaxOutputFPS < 0 || c.MaxOutputFPS > 240 {
+		return errors.New("MaxOutputFPS must be between 0 and 240")
+	}
+	if c.DegradedMaxOutputFPS < 0 || c.DegradedMaxOutputFPS > 240 {
+		return errors.New("DegradedMaxOutputFPS must be between 0 and 240")
+	}
+
 	validLogLevels := map[string]bool{
 		"debug": true,
 		"info":  true,
@@ -206,8 +2347,29 @@ func (c *Config) Validate() error {
 		return errors.New("LogLevel must be 'debug', 'info', 'warn', or 'error'")
 	}
 
+	if c.LogFormat != "console" && c.LogFormat != "json" {
+		return errors.New("LogFormat must be 'console' or 'json'")
+	}
+
+	if c.LogFile != "" {
+		if c.LogMaxSizeMB <= 0 {
+			return errors.New("LogMaxSizeMB must be a positive integer")
+		}
+		if c.LogMaxBackups < 0 {
+			return errors.New("LogMaxBackups cannot be negative")
+		}
+	}
+
+	if c.AccessLogSampleRate < 0 || c.AccessLogSampleRate > 1 {
+		return errors.New("AccessLogSampleRate must be between 0 and 1")
+	}
+
+	if c.AccessLogSlowMs < 0 {
+		return errors.New("AccessLogSlowMs cannot be negative")
+	}
+
 	// Validate synthetic config if enabled
-	if c.UseSynthetic {
+	if c.UseSynthetic || c.HasSource("synthetic") {
 		if c.SyntheticWidth <= 0 || c.SyntheticWidth > 7680 {
 			return errors.New("SyntheticWidth must be between 1 and 7680")
 		}
@@ -220,6 +2382,423 @@ func (c *Config) Validate() error {
 		if c.SyntheticPattern < 0 || c.SyntheticPattern > 2 {
 			return errors.New("SyntheticPattern must be 0 (ColorBars), 1 (Gradient), or 2 (Grid)")
 		}
+		if c.SyntheticPatternName != "" && !c.h264Codec() {
+			return errors.New("SyntheticPatternName requires VideoCodec 'h264' or 'auto'")
+		}
+	}
+
+	// Validate V4L2 config if enabled
+	if c.UseV4L2 || c.HasSource("v4l2") {
+		if c.UseSynthetic {
+			return errors.New("UseV4L2 and UseSynthetic cannot both be enabled")
+		}
+		if c.V4L2Device == "" {
+			return errors.New("V4L2Device cannot be empty")
+		}
+		if c.V4L2Width <= 0 || c.V4L2Width > 7680 {
+			return errors.New("V4L2Width must be between 1 and 7680")
+		}
+		if c.V4L2Height <= 0 || c.V4L2Height > 4320 {
+			return errors.New("V4L2Height must be between 1 and 4320")
+		}
+		if c.V4L2FPS <= 0 || c.V4L2FPS > 240 {
+			return errors.New("V4L2FPS must be between 1 and 240")
+		}
+		validFormats := map[string]bool{"h264": true, "mjpeg": true, "yuyv": true}
+		if !validFormats[c.V4L2PixelFormat] {
+			return errors.New("V4L2PixelFormat must be 'h264', 'mjpeg', or 'yuyv'")
+		}
+		if c.V4L2MinFPS < 0 || c.V4L2MinFPS > c.V4L2FPS {
+			return errors.New("V4L2MinFPS must be between 0 and V4L2FPS")
+		}
+		if !c.h264Codec() {
+			return errors.New("V4L2 capture requires VideoCodec 'h264' or 'auto'")
+		}
+	}
+
+	// Validate failover chain if configured
+	if len(c.Sources) > 0 {
+		if c.UseSynthetic || c.UseV4L2 {
+			return errors.New("Sources cannot be combined with UseSynthetic or UseV4L2")
+		}
+		validSources := map[string]bool{"ipc": true, "rtsp": true, "relay": true, "v4l2": true, "synthetic": true}
+		seen := make(map[string]bool, len(c.Sources))
+		for _, source := range c.Sources {
+			if !validSources[source] {
+				return errors.New("Sources entries must be 'ipc', 'rtsp', 'relay', 'v4l2', or 'synthetic'")
+			}
+			if seen[source] {
+				return errors.New("Sources cannot list a source more than once")
+			}
+			seen[source] = true
+		}
+		if c.FailoverTimeoutMs <= 0 {
+			return errors.New("FailoverTimeoutMs must be a positive integer")
+		}
+		if c.FailbackDelayMs <= 0 {
+			return errors.New("FailbackDelayMs must be a positive integer")
+		}
+	}
+
+	if c.HasSource("rtsp") {
+		if !strings.HasPrefix(c.RTSPURL, "rtsp://") {
+			return errors.New("RTSPURL must be an rtsp:// URL when the rtsp source is used")
+		}
+		if !c.h264Codec() {
+			return errors.New("RTSP source requires VideoCodec 'h264' or 'auto'")
+		}
+	}
+
+	if c.HasSource("relay") {
+		if !strings.HasPrefix(c.RelayURL, "http://") && !strings.HasPrefix(c.RelayURL, "https://") {
+			return errors.New("RelayURL must be an http:// or https:// URL when the relay source is used")
+		}
+		if !c.h264Codec() {
+			return errors.New("Relay source requires VideoCodec 'h264' or 'auto'")
+		}
+	}
+
+	if c.WHIPURL != "" {
+		if !strings.HasPrefix(c.WHIPURL, "http://") && !strings.HasPrefix(c.WHIPURL, "https://") {
+			return errors.New("WHIPURL must be an http:// or https:// URL")
+		}
+		if c.VideoCodec == "hevc" {
+			return errors.New("WHIPURL cannot carry VideoCodec 'hevc'")
+		}
+	}
+
+	if c.MulticastAddr != "" {
+		host, port, err := net.SplitHostPort(c.MulticastAddr)
+		if err != nil || net.ParseIP(host) == nil {
+			return errors.New("MulticastAddr must be an IP address and port, such as 239.255.0.1:5004")
+		}
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return errors.New("MulticastAddr port must be between 1 and 65535")
+		}
+		if c.MulticastTTL < 1 || c.MulticastTTL > 255 {
+			return errors.New("MulticastTTL must be between 1 and 255")
+		}
+		if c.MulticastFormat != "rtp" && c.MulticastFormat != "udp" {
+			return errors.New("MulticastFormat must be 'rtp' or 'udp'")
+		}
+		if c.VideoCodec == "vp9" {
+			return errors.New("MulticastAddr requires VideoCodec 'h264', 'hevc' or 'auto'")
+		}
+	}
+
+	for _, u := range c.WebhookURLs {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return errors.New("WebhookURLs entries must be http:// or https:// URLs")
+		}
+	}
+
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		return errors.New("TracingSampleRatio must be between 0 and 1")
+	}
+
+	if c.SourceTimeoutMs < 0 {
+		return errors.New("SourceTimeoutMs cannot be negative")
+	}
+
+	if c.WatchdogStallMs < 0 {
+		return errors.New("WatchdogStallMs cannot be negative")
+	}
+
+	if c.WatchdogRestartMs < 0 {
+		return errors.New("WatchdogRestartMs cannot be negative")
+	}
+
+	if c.StatsRetentionHours <= 0 {
+		return errors.New("StatsRetentionHours must be positive")
+	}
+
+	if c.ReplaySpoolDir == "" && (c.ReplaySeconds < 0 || c.ReplaySeconds > 600) {
+		return errors.New("ReplaySeconds must be between 0 and 600")
+	}
+	if c.ReplaySpoolDir != "" && (c.ReplaySeconds < 0 || c.ReplaySeconds > 3600) {
+		return errors.New("ReplaySeconds must be between 0 and 3600 with ReplaySpoolDir")
+	}
+
+	if c.ReplaySeconds > 0 {
+		if c.ReplayMaxMB <= 0 {
+			return errors.New("ReplayMaxMB must be positive")
+		}
+		if c.ClipDir == "" {
+			return errors.New("ClipDir must not be empty when the replay buffer is enabled")
+		}
+		if c.ReplaySpoolDir != "" && filepath.Clean(c.ReplaySpoolDir) == filepath.Clean(c.ClipDir) {
+			return errors.New("ReplaySpoolDir must differ from ClipDir")
+		}
+		if c.AdminListenAddr == "" && !c.Timeshift && len(c.HighlightAnalyzers) == 0 {
+			return errors.New("ReplaySeconds needs the admin server to save clips, Timeshift or HighlightAnalyzers")
+		}
+	}
+
+	if c.RecordingDir != "" {
+		if c.RecordingMaxDiskMB < 0 {
+			return errors.New("RecordingMaxDiskMB must not be negative")
+		}
+		if c.RecordingSegmentSec < 1 || c.RecordingSegmentSec > 3600 {
+			return errors.New("RecordingSegmentSec must be between 1 and 3600")
+		}
+		if c.AdminListenAddr == "" {
+			return errors.New("RecordingDir needs the admin server to manage recordings")
+		}
+	}
+
+	if c.ResourceCheckSec < 0 || c.ResourceCheckSec > 3600 {
+		return errors.New("ResourceCheckSec must be between 0 and 3600")
+	}
+	if c.ResourceCheckSec > 0 {
+		if c.DiskWarnMB < 0 || c.DiskCriticalMB < 0 {
+			return errors.New("DiskWarnMB and DiskCriticalMB must not be negative")
+		}
+		if c.DiskWarnMB > 0 && c.DiskCriticalMB > c.DiskWarnMB {
+			return errors.New("DiskCriticalMB must not exceed DiskWarnMB")
+		}
+		for _, p := range []int{c.MemoryWarnPercent, c.MemoryCriticalPercent, c.CPUWarnPercent, c.CPUCriticalPercent} {
+			if p < 0 || p > 100 {
+				return errors.New("memory and CPU thresholds must be between 0 and 100 percent")
+			}
+		}
+		if c.MemoryCriticalPercent > 0 && c.MemoryWarnPercent > c.MemoryCriticalPercent {
+			return errors.New("MemoryWarnPercent must not exceed MemoryCriticalPercent")
+		}
+		if c.CPUCriticalPercent > 0 && c.CPUWarnPercent > c.CPUCriticalPercent {
+			return errors.New("CPUWarnPercent must not exceed CPUCriticalPercent")
+		}
+	}
+
+	if c.FrameBudgetMs < 0 || c.FrameBudgetMs > 1000 {
+		return errors.New("FrameBudgetMs must be between 0 and 1000")
+	}
+
+	if len(c.HighlightAnalyzers) > 0 {
+		if c.ReplaySeconds == 0 {
+			return errors.New("HighlightAnalyzers needs ReplaySeconds to clip from")
+		}
+		for _, name := range c.HighlightAnalyzers {
+			switch name {
+			case "audio", "scene":
+			case "webhook":
+				if c.AdminListenAddr == "" {
+					return errors.New("the webhook highlight analyzer needs the admin server")
+				}
+			default:
+				return errors.New("HighlightAnalyzers entries must be audio, scene or webhook")
+			}
+		}
+		if c.HighlightPreSec < 1 || c.HighlightPostSec < 1 {
+			return errors.New("HighlightPreSec and HighlightPostSec must be positive")
+		}
+		if c.HighlightPreSec+c.HighlightPostSec > c.ReplaySeconds {
+			return errors.New("HighlightPreSec plus HighlightPostSec must fit in ReplaySeconds")
+		}
+		if c.HighlightCooldownSec < 0 {
+			return errors.New("HighlightCooldownSec cannot be negative")
+		}
+	}
+
+	if c.UploadBucket != "" {
+		if c.ReplaySeconds == 0 && c.RecordingDir == "" {
+			return errors.New("UploadBucket needs ReplaySeconds or RecordingDir, which produce the files uploaded")
+		}
+		if c.UploadAccessKeyID == "" || c.UploadSecretAccessKey == "" {
+			return errors.New("UploadBucket needs UploadAccessKeyID and UploadSecretAccessKey")
+		}
+		if c.UploadEndpoint != "" && !strings.HasPrefix(c.UploadEndpoint, "http://") && !strings.HasPrefix(c.UploadEndpoint, "https://") {
+			return errors.New("UploadEndpoint must be an http:// or https:// URL")
+		}
+		if c.UploadRegion == "" {
+			return errors.New("UploadRegion must not be empty")
+		}
+		if c.UploadExpireDays < 0 {
+			return errors.New("UploadExpireDays cannot be negative")
+		}
+		if c.UploadURLTTLSec < 1 || c.UploadURLTTLSec > 7*24*3600 {
+			return errors.New("UploadURLTTLSec must be between 1 and 604800")
+		}
+	}
+
+	if c.Timeshift && c.ReplaySeconds == 0 {
+		return errors.New("Timeshift needs the replay buffer; set ReplaySeconds")
+	}
+
+	validDecoders := map[string]bool{"auto": true, "ffmpeg": true, "pcm": true}
+	if !validDecoders[c.ScreenshotDecoder] {
+		return errors.New("ScreenshotDecoder must be 'auto', 'ffmpeg', or 'pcm'")
+	}
+
+	if c.PreviewFPS < 0 || c.PreviewFPS > 15 {
+		return errors.New("PreviewFPS must be between 0 and 15")
+	}
+
+	if c.PreviewFPS > 0 && (c.PreviewWidth < 16 || c.PreviewWidth > 1920) {
+		return errors.New("PreviewWidth must be between 16 and 1920")
+	}
+
+	validEncoders := map[string]bool{"auto": true, "nvenc": true, "vaapi": true, "x264": true, "pcm": true}
+	if !validEncoders[c.EncoderBackend] {
+		return errors.New("EncoderBackend must be 'auto', 'nvenc', 'vaapi', 'x264', or 'pcm'")
+	}
+
+	validPositions := map[string]bool{"top-left": true, "top-right": true, "bottom-left": true, "bottom-right": true}
+	if !validPositions[c.OverlayPosition] {
+		return errors.New("OverlayPosition must be 'top-left', 'top-right', 'bottom-left', or 'bottom-right'")
+	}
+
+	if c.KeyframeIntervalMs != 0 && (c.KeyframeIntervalMs < 100 || c.KeyframeIntervalMs > 60000) {
+		return errors.New("KeyframeIntervalMs must be 0 or between 100 and 60000")
+	}
+
+	if c.JoinBurstPeers < 0 {
+		return errors.New("JoinBurstPeers cannot be negative")
+	}
+	if c.JoinBurstPeers > 0 && (c.JoinBurstGOPMs < 100 || c.JoinBurstGOPMs > 10000) {
+		return errors.New("JoinBurstGOPMs must be between 100 and 10000")
+	}
+
+	if c.DirectorToken != "" && len(c.DirectorToken) < 16 {
+		return errors.New("DirectorToken must be at least 16 characters")
+	}
+
+	if c.CaptureBackoffMs <= 0 {
+		return errors.New("CaptureBackoffMs must be positive")
+	}
+
+	if len(c.TranscodeRenditions) > 0 && len(c.TranscodeCommand) == 0 {
+		return errors.New("TranscodeRenditions requires TranscodeCommand")
+	}
+
+	if c.DrainWindowMs < 0 {
+		return errors.New("DrainWindowMs cannot be negative")
+	}
+
+	validDownmixes := map[string]bool{"itu": true, "front": true}
+	if !validDownmixes[c.AudioDownmix] {
+		return errors.New("AudioDownmix must be 'itu' or 'front'")
+	}
+
+	mixed := make(map[string]bool)
+	for _, src := range c.AudioSources {
+		name, gain, hasGain := strings.Cut(src, ":")
+		if name == "" || mixed[name] {
+			return errors.New("AudioSources entries must have distinct names")
+		}
+		mixed[name] = true
+		if hasGain {
+			db, err := strconv.ParseFloat(strings.TrimSuffix(gain, "db"), 64)
+			if err != nil || db < -60 || db > 20 {
+				return errors.New("AudioSources gains must be between -60 and 20 dB")
+			}
+		}
+	}
+	if len(c.AudioMixes) > 0 && len(c.AudioSources) == 0 {
+		return errors.New("AudioMixes requires AudioSources")
+	}
+	mixNames := make(map[string]bool)
+	for _, mix := range c.AudioMixes {
+		name, sources, _ := strings.Cut(mix, "=")
+		if name == "" || mixNames[name] {
+			return errors.New("AudioMixes entries must have distinct names")
+		}
+		mixNames[name] = true
+		for _, src := range strings.Split(sources, "+") {
+			if src != "" && !mixed[src] {
+				return errors.New("AudioMixes may only use sources listed in AudioSources")
+			}
+		}
+	}
+	if c.AudioDuckSource != "" && !mixed[c.AudioDuckSource] {
+		return errors.New("AudioDuckSource must be one of AudioSources")
+	}
+	if c.AudioDuckDB < 1 || c.AudioDuckDB > 60 {
+		return errors.New("AudioDuckDB must be between 1 and 60")
+	}
+	if c.AudioDuckThreshDB < -90 || c.AudioDuckThreshDB > -1 {
+		return errors.New("AudioDuckThreshDB must be between -90 and -1")
+	}
+
+	if c.LoudnessTarget != 0 && (c.LoudnessTarget < -36 || c.LoudnessTarget > -10) {
+		return errors.New("LoudnessTarget must be 0 or between -36 and -10")
+	}
+	if c.LimiterCeilingDB < -12 || c.LimiterCeilingDB > -1 {
+		return errors.New("LimiterCeilingDB must be between -12 and -1")
+	}
+
+	if c.ReturnSocketPath != "" && c.ReturnSocketPath == c.IPCSocketPath {
+		return errors.New("ReturnSocketPath must differ from IPCSocketPath")
+	}
+	if isPipePath(c.ReturnSocketPath) && runtime.GOOS != "windows" {
+		return errors.New("ReturnSocketPath is a named pipe, which only Windows supports")
+	}
+
+	if c.ClusterRedisURL != "" {
+		if !strings.HasPrefix(c.ClusterRedisURL, "redis://") {
+			return errors.New("ClusterRedisURL must be a redis:// URL")
+		}
+		if !strings.HasPrefix(c.ClusterAdvertiseURL, "http://") && !strings.HasPrefix(c.ClusterAdvertiseURL, "https://") {
+			return errors.New("ClusterAdvertiseURL must be an http:// or https:// URL in cluster mode")
+		}
+	}
+
+	if c.OIDCIssuer != "" {
+		if !strings.HasPrefix(c.OIDCIssuer, "https://") && !strings.HasPrefix(c.OIDCIssuer, "http://") {
+			return errors.New("OIDCIssuer must be an http:// or https:// URL")
+		}
+		if c.OIDCClientID == "" {
+			return errors.New("OIDCClientID is required when OIDCIssuer is set")
+		}
+		if len(c.OIDCAllowedUsers) == 0 && len(c.OIDCControllers) == 0 && !c.OIDCAllowAnyUser {
+			return errors.New("OIDCAllowedUsers or OIDCControllers must list someone when OIDCIssuer is set; set OIDCAllowAnyUser to admit anyone the provider signs in")
+		}
+		if !strings.HasPrefix(c.OIDCRedirectURL, "http://") && !strings.HasPrefix(c.OIDCRedirectURL, "https://") {
+			return errors.New("OIDCRedirectURL must be an http:// or https:// URL when OIDCIssuer is set")
+		}
+		if c.SessionSecret != "" && len(c.SessionSecret) < 32 {
+			return errors.New("SessionSecret must be at least 32 characters")
+		}
+	}
+
+	if c.InviteBaseURL != "" && !strings.HasPrefix(c.InviteBaseURL, "http://") && !strings.HasPrefix(c.InviteBaseURL, "https://") {
+		return errors.New("InviteBaseURL must be an http:// or https:// URL")
+	}
+
+	if c.InvitesRequired && c.AdminListenAddr == "" {
+		return errors.New("InvitesRequired needs the admin server to mint invites")
+	}
+
+	switch c.DuplicatePeerPolicy {
+	case "replace", "reject", "suffix":
+	default:
+		return errors.New("DuplicatePeerPolicy must be 'replace', 'reject' or 'suffix'")
+	}
+
+	// Receivers report about once a second; shorter timeouts reap viewers
+	// on a brief network hiccup
+	if c.PeerIdleTimeoutSec != 0 && (c.PeerIdleTimeoutSec < 5 || c.PeerIdleTimeoutSec > 3600) {
+		return errors.New("PeerIdleTimeoutSec must be 0 or between 5 and 3600")
+	}
+
+	for stream, p := range c.StreamAccess {
+		if stream == "" {
+			return errors.New("StreamAccess stream IDs must not be empty")
+		}
+		if p.Mode == "users" && c.OIDCIssuer == "" {
+			return errors.New("StreamAccess mode users needs OIDCIssuer")
+		}
+	}
+
+	if c.QRInviteTTLSec <= 0 || c.QRInviteTTLSec > 30*24*3600 {
+		return errors.New("QRInviteTTLSec must be between 1 and 2592000 (30 days)")
+	}
+
+	if c.SessionLogMax <= 0 {
+		return errors.New("SessionLogMax must be positive")
+	}
+
+	if c.QRInviteMaxUses < 0 {
+		return errors.New("QRInviteMaxUses must not be negative")
 	}
 
 	return nil
@@ -235,6 +2814,38 @@ func (c *Config) IsSynthetic() bool {
 	return c.UseSynthetic
 }
 
+// HasSource returns true if the failover chain includes the named source.
+func (c *Config) HasSource(name string) bool {
+	for _, source := range c.Sources {
+		if source == name {
+			return true
+		}
+	}
+	return false
+}
+
+// h264Codec returns true if the video track carries H.264, as the sources
+// the gateway encodes or depacketizes itself require. Detection settles on
+// H.264 for them.
+func (c *Config) h264Codec() bool {
+	return c.VideoCodec == "h264" || c.VideoCodec == "auto"
+}
+
+// HTTPTLS returns true if signaling is served over HTTPS.
+func (c *Config) HTTPTLS() bool {
+	return c.HTTPTLSCertFile != ""
+}
+
+// AdminTLS returns true if the admin server is served over HTTPS.
+func (c *Config) AdminTLS() bool {
+	return c.AdminTLSCertFile != ""
+}
+
+// IsV4L2 returns true if direct V4L2 capture is enabled.
+func (c *Config) IsV4L2() bool {
+	return c.UseV4L2
+}
+
 // String returns a string representation of the config for logging purposes.
 // Sensitive values should be masked if any are added in the future.
 func (c *Config) String() string {
@@ -244,16 +2855,259 @@ func (c *Config) String() string {
 			"SyntheticWidth: " + strconv.Itoa(c.SyntheticWidth) + ", " +
 			"SyntheticHeight: " + strconv.Itoa(c.SyntheticHeight) + ", " +
 			"SyntheticFPS: " + strconv.Itoa(c.SyntheticFPS) + ", " +
-			"SyntheticPattern: " + strconv.Itoa(c.SyntheticPattern)
+			"SyntheticPattern: " + strconv.Itoa(c.SyntheticPattern) + ", " +
+			"SyntheticPatternName: " + c.SyntheticPatternName
+	}
+
+	v4l2Info := ""
+	if c.UseV4L2 {
+		v4l2Info = ", UseV4L2: true, " +
+			"V4L2Device: " + c.V4L2Device + ", " +
+			"V4L2Width: " + strconv.Itoa(c.V4L2Width) + ", " +
+			"V4L2Height: " + strconv.Itoa(c.V4L2Height) + ", " +
+			"V4L2FPS: " + strconv.Itoa(c.V4L2FPS) + ", " +
+			"V4L2PixelFormat: " + c.V4L2PixelFormat + ", " +
+			"V4L2MinFPS: " + strconv.Itoa(c.V4L2MinFPS) + ", " +
+			"EncoderBackend: " + c.EncoderBackend
+		if c.EncoderDevice != "" {
+			v4l2Info += ", EncoderDevice: " + c.EncoderDevice
+		}
+	}
+
+	sourcesInfo := ""
+	if len(c.Sources) > 0 {
+		sourcesInfo = ", Sources: [" + strings.Join(c.Sources, ", ") + "], " +
+			"FailoverTimeoutMs: " + strconv.Itoa(c.FailoverTimeoutMs) + ", " +
+			"FailbackDelayMs: " + strconv.Itoa(c.FailbackDelayMs)
+		if c.HasSource("rtsp") {
+			sourcesInfo += ", RTSPURL: " + redactURL(c.RTSPURL)
+		}
+		if c.HasSource("relay") {
+			sourcesInfo += ", RelayURL: " + redactURL(c.RelayURL)
+		}
+	}
+	if c.WHIPURL != "" {
+		sourcesInfo += ", WHIPURL: " + redactURL(c.WHIPURL)
+	}
+	if c.NDIName != "" {
+		sourcesInfo += ", NDIName: " + c.NDIName
+	}
+	if c.MulticastAddr != "" {
+		sourcesInfo += ", MulticastAddr: " + c.MulticastFormat + "://" + c.MulticastAddr
+	}
+
+	tracingInfo := ""
+	if c.TracingEndpoint != "" {
+		tracingInfo = ", TracingEndpoint: " + c.TracingEndpoint + ", " +
+			"TracingSampleRatio: " + strconv.FormatFloat(c.TracingSampleRatio, 'g', -1, 64)
+	}
+
+	webhookInfo := ""
+	if len(c.WebhookURLs) > 0 {
+		webhookInfo = ", WebhookURLs: " + strconv.Itoa(len(c.WebhookURLs))
+		if c.WebhookSecret != "" {
+			webhookInfo += ", WebhookSecret: ***"
+		}
+		if len(c.WebhookEvents) > 0 {
+			webhookInfo += ", WebhookEvents: [" + strings.Join(c.WebhookEvents, ", ") + "]"
+		}
+	}
+
+	listenInfo := ""
+	if c.HTTPTLS() {
+		listenInfo += ", HTTPTLSCertFile: " + c.HTTPTLSCertFile
+	}
+	if c.AdminTLS() {
+		listenInfo += ", AdminTLSCertFile: " + c.AdminTLSCertFile
+	}
+	if c.AdminToken != "" {
+		listenInfo += ", AdminToken: ***"
+	}
+
+	directorInfo := ""
+	if c.DirectorToken != "" {
+		directorInfo = ", DirectorToken: ***"
+	}
+
+	statsInfo := ""
+	if c.StatsDBPath != "" {
+		statsInfo = ", StatsDBPath: " + c.StatsDBPath + ", " +
+			"StatsRetentionHours: " + strconv.Itoa(c.StatsRetentionHours)
+	}
+	if c.ReplaySeconds > 0 {
+		statsInfo += ", ReplaySeconds: " + strconv.Itoa(c.ReplaySeconds) + ", ClipDir: " + c.ClipDir +
+			", Timeshift: " + strconv.FormatBool(c.Timeshift)
+	}
+	if c.ReplaySpoolDir != "" {
+		statsInfo += ", ReplaySpoolDir: " + c.ReplaySpoolDir
+	}
+	if len(c.HighlightAnalyzers) > 0 {
+		statsInfo += ", HighlightAnalyzers: " + strings.Join(c.HighlightAnalyzers, ",") +
+			", HighlightPreSec: " + strconv.Itoa(c.HighlightPreSec) + ", HighlightPostSec: " + strconv.Itoa(c.HighlightPostSec)
+	}
+	if c.RecordingDir != "" {
+		statsInfo += ", RecordingDir: " + c.RecordingDir +
+			", RecordingMaxDiskMB: " + strconv.Itoa(c.RecordingMaxDiskMB) +
+			", RecordingSegmentSec: " + strconv.Itoa(c.RecordingSegmentSec)
+	}
+	if c.ResourceCheckSec > 0 {
+		statsInfo += ", ResourceCheckSec: " + strconv.Itoa(c.ResourceCheckSec) +
+			", DiskWarnMB: " + strconv.Itoa(c.DiskWarnMB) + ", DiskCriticalMB: " + strconv.Itoa(c.DiskCriticalMB) +
+			", MemoryWarnPercent: " + strconv.Itoa(c.MemoryWarnPercent) + ", MemoryCriticalPercent: " + strconv.Itoa(c.MemoryCriticalPercent) +
+			", CPUWarnPercent: " + strconv.Itoa(c.CPUWarnPercent) + ", CPUCriticalPercent: " + strconv.Itoa(c.CPUCriticalPercent)
+	}
+	if c.FrameBudget {
+		statsInfo += ", FrameBudgetMs: " + strconv.Itoa(c.FrameBudgetMs)
+	}
+	if c.UploadBucket != "" {
+		statsInfo += ", UploadBucket: " + c.UploadBucket + ", UploadEndpoint: " + c.UploadEndpoint +
+			", UploadRegion: " + c.UploadRegion + ", UploadAccessKeyID: " + c.UploadAccessKeyID +
+			", UploadSecretAccessKey: ***, UploadPrefix: " + c.UploadPrefix +
+			", UploadExpireDays: " + strconv.Itoa(c.UploadExpireDays)
+	}
+
+	iceInfo := ", MDNS: " + strconv.FormatBool(c.MDNS) + ", ICEIPv6: " + c.ICEIPv6
+	if c.ICEUDPPort != 0 {
+		iceInfo += ", ICEUDPPort: " + strconv.Itoa(c.ICEUDPPort)
+	}
+	if c.ICEPortMin != 0 {
+		iceInfo += ", ICEPortMin: " + strconv.Itoa(c.ICEPortMin) + ", " +
+			"ICEPortMax: " + strconv.Itoa(c.ICEPortMax)
+	}
+	if len(c.NAT1To1IPs) > 0 {
+		iceInfo += ", NAT1To1IPs: [" + strings.Join(c.NAT1To1IPs, ", ") + "], " +
+			"NAT1To1Candidate: " + c.NAT1To1Candidate
+	}
+	if c.ICETCPPort != 0 {
+		iceInfo += ", ICETCPPort: " + strconv.Itoa(c.ICETCPPort)
+	}
+	if len(c.TURNURLs) > 0 {
+		iceInfo += ", TURNURLs: [" + strings.Join(c.TURNURLs, ", ") + "], " +
+			"TURNUsername: " + c.TURNUsername + ", TURNCredential: ***"
+	}
+
+	ipcInfo := ", IPCReadTimeoutMs: " + strconv.Itoa(c.IPCReadTimeoutMs) + ", " +
+		"IPCHeartbeatMs: " + strconv.Itoa(c.IPCHeartbeatMs) + ", " +
+		"IPCMaxMissedHeartbeats: " + strconv.Itoa(c.IPCMaxMissedHeartbeats)
+	if c.IPCTapFile != "" {
+		ipcInfo += ", IPCTapFile: " + c.IPCTapFile + ", " +
+			"IPCTapMaxMB: " + strconv.Itoa(c.IPCTapMaxMB)
+	}
+	if c.IPCReplayFile != "" {
+		ipcInfo += ", IPCReplayFile: " + c.IPCReplayFile + ", " +
+			"IPCReplayLoop: " + strconv.FormatBool(c.IPCReplayLoop)
+	}
+
+	returnInfo := ""
+	if c.ReturnSocketPath != "" {
+		returnInfo = ", ReturnSocketPath: " + c.ReturnSocketPath
+	}
+
+	clusterInfo := ""
+	if c.ClusterRedisURL != "" {
+		clusterInfo = ", ClusterRedisURL: " + redactURL(c.ClusterRedisURL) + ", " +
+			"ClusterAdvertiseURL: " + c.ClusterAdvertiseURL
+	}
+
+	oidcInfo := ""
+	if c.OIDCIssuer != "" {
+		oidcInfo = ", OIDCIssuer: " + c.OIDCIssuer + ", " +
+			"OIDCClientID: " + c.OIDCClientID + ", " +
+			"OIDCRedirectURL: " + c.OIDCRedirectURL + ", " +
+			"OIDCAllowedUsers: " + strconv.Itoa(len(c.OIDCAllowedUsers)) + ", " +
+			"OIDCControllers: " + strconv.Itoa(len(c.OIDCControllers))
+		if c.OIDCAllowAnyUser {
+			oidcInfo += ", OIDCAllowAnyUser: true"
+		}
+		if c.OIDCClientSecret != "" {
+			oidcInfo += ", OIDCClientSecret: ***"
+		}
+		if c.SessionSecret != "" {
+			oidcInfo += ", SessionSecret: ***"
+		}
+	}
+
+	captureInfo := ""
+	if len(c.CaptureCommand) > 0 {
+		captureInfo = ", CaptureCommand: " + strings.Join(c.CaptureCommand, " ") + ", " +
+			"CaptureBackoffMs: " + strconv.Itoa(c.CaptureBackoffMs)
+	}
+	if len(c.TranscodeRenditions) > 0 {
+		captureInfo += ", TranscodeCommand: " + strings.Join(c.TranscodeCommand, " ") +
+			", TranscodeRenditions: [" + strings.Join(c.TranscodeRenditions, ", ") + "]"
 	}
 
 	return "Config{" +
 		"IPCSocketPath: " + c.IPCSocketPath + ", " +
 		"HTTPListenAddr: " + c.HTTPListenAddr + ", " +
+		"AdminListenAddr: " + c.AdminListenAddr + ", " +
+		"AdminDebug: " + strconv.FormatBool(c.AdminDebug) + ", " +
+		"SessionLogDir: " + c.SessionLogDir + ", " +
 		"AllowedOrigins: [" + strings.Join(c.AllowedOrigins, ", ") + "], " +
+		"CORSRoutes: " + strconv.Itoa(len(c.CORSRoutes)) + ", " +
+		"HSTSMaxAgeSec: " + strconv.Itoa(c.HSTSMaxAgeSec) + ", " +
 		"VideoCodec: " + c.VideoCodec + ", " +
+		"HighBitDepth: " + strconv.FormatBool(c.HighBitDepth) + ", " +
 		"MaxBitrateKbps: " + strconv.Itoa(c.MaxBitrateKbps) + ", " +
-		"LogLevel: " + c.LogLevel +
+		"PacingFactor: " + strconv.FormatFloat(c.PacingFactor, 'g', -1, 64) + ", " +
+		"MaxOutputFPS: " + strconv.Itoa(c.MaxOutputFPS) + ", " +
+		"DegradedMaxOutputFPS: " + strconv.Itoa(c.DegradedMaxOutputFPS) + ", " +
+		"LogLevel: " + c.LogLevel + ", " +
+		"LogFormat: " + c.LogFormat + ", " +
+		"LogFile: " + c.LogFile + ", " +
+		"AccessLog: " + strconv.FormatBool(c.AccessLog) + ", " +
+		"SourceTimeoutMs: " + strconv.Itoa(c.SourceTimeoutMs) + ", " +
+		"WatchdogStallMs: " + strconv.Itoa(c.WatchdogStallMs) + ", " +
+		"WatchdogRestartMs: " + strconv.Itoa(c.WatchdogRestartMs) + ", " +
+		"DrainWindowMs: " + strconv.Itoa(c.DrainWindowMs) + ", " +
+		"AudioDownmix: " + c.AudioDownmix + ", " +
+		"AudioSources: [" + strings.Join(c.AudioSources, ", ") + "], " +
+		"AudioMixes: [" + strings.Join(c.AudioMixes, ", ") + "], " +
+		"LoudnessTarget: " + strconv.Itoa(c.LoudnessTarget) + ", " +
+		"KeyframeIntervalMs: " + strconv.Itoa(c.KeyframeIntervalMs) + ", " +
+		"JoinBurstPeers: " + strconv.Itoa(c.JoinBurstPeers) + ", " +
+		"InvitesRequired: " + strconv.FormatBool(c.InvitesRequired) + ", " +
+		"DuplicatePeerPolicy: " + c.DuplicatePeerPolicy + ", " +
+		"PeerIdleTimeoutSec: " + strconv.Itoa(c.PeerIdleTimeoutSec) + ", " +
+		"ConnectQR: " + strconv.FormatBool(c.ConnectQR) +
+		ipcInfo +
+		listenInfo +
+		iceInfo +
 		syntheticInfo +
+		v4l2Info +
+		sourcesInfo +
+		webhookInfo +
+		directorInfo +
+		tracingInfo +
+		statsInfo +
+		captureInfo +
+		returnInfo +
+		clusterInfo +
+		oidcInfo +
 		"}"
 }
+
+// redactURL masks any password in a URL.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "<invalid>"
+	}
+	return u.Redacted()
+}
+
+// splitList splits a comma-separated value, trimming and dropping empty entries.
+func splitList(val string, lower bool) []string {
+	parts := strings.Split(val, ",")
+	list := make([]string, 0, len(parts))
+	for _, part := range parts {
+		trimmed := strings.TrimSpace(part)
+		if lower {
+			trimmed = strings.ToLower(trimmed)
+		}
+		if trimmed != "" {
+			list = append(list, trimmed)
+		}
+	}
+	return list
+}
@@ -0,0 +1,100 @@
+// Package decoder turns single keyframes into pictures, for screenshots and
+// thumbnails. It does not decode whole streams.
+//
+// Backends register themselves by name. The pure-Go "pcm" backend is always
+// available but only decodes I_PCM pictures, such as those of the pcm
+// encoder and slates; "ffmpeg" decodes anything the ffmpeg binary on PATH
+// can.
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+)
+
+// ErrUnsupported is returned by backends for bitstreams they cannot decode
+var ErrUnsupported = errors.New("decoder: unsupported bitstream")
+
+// Decoder decodes keyframes
+type Decoder interface {
+	// Decode decodes an Annex-B keyframe access unit carrying its
+	// parameter sets
+	Decode(au []byte) (image.Image, error)
+
+	// Name returns the backend name
+	Name() string
+
+	// Close releases decoder resources
+	Close() error
+}
+
+// Config configures a decoder
+type Config struct {
+	Backend string // Backend name, "" or "auto" picks the best available
+	Codec   string // "h264" or "hevc"
+}
+
+// Factory creates a decoder for a backend; it fails if the backend cannot
+// run here or does not support the codec
+type Factory func(cfg Config) (Decoder, error)
+
+// preference lists backends from most to least preferred for "auto"
+var preference = []string{"ffmpeg", "pcm"}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]Factory)
+)
+
+// Register makes a backend available under name. It is meant to be called
+// from init functions.
+func Register(name string, factory Factory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[name] = factory
+}
+
+// Backends returns the names of all registered backends
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates a decoder using the configured backend. "auto" takes the
+// first preferred backend that can decode the codec.
+func New(cfg Config) (Decoder, error) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	if cfg.Backend != "" && cfg.Backend != "auto" {
+		factory, ok := backends[cfg.Backend]
+		if !ok {
+			return nil, fmt.Errorf("decoder backend %q not available (have %v)", cfg.Backend, Backends())
+		}
+		return factory(cfg)
+	}
+
+	var errs []error
+	for _, name := range preference {
+		factory, ok := backends[name]
+		if !ok {
+			continue
+		}
+		d, err := factory(cfg)
+		if err == nil {
+			return d, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, fmt.Errorf("no decoder for %s: %w", cfg.Codec, errors.Join(errs...))
+}
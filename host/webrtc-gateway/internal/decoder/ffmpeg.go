@@ -0,0 +1,75 @@
+package decoder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("ffmpeg", newFFmpegDecoder)
+}
+
+// ffmpegTimeout bounds one decode, including process startup
+const ffmpegTimeout = 10 * time.Second
+
+// ffmpegDecoder runs the ffmpeg binary once per keyframe. Process startup
+// dominates the cost, which is fine at screenshot rates.
+type ffmpegDecoder struct {
+	path   string
+	format string // ffmpeg demuxer name
+}
+
+func newFFmpegDecoder(cfg Config) (Decoder, error) {
+	format := map[string]string{"h264": "h264", "hevc": "hevc"}[cfg.Codec]
+	if format == "" {
+		return nil, fmt.Errorf("ffmpeg decoder: unsupported codec %q", cfg.Codec)
+	}
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errors.New("ffmpeg decoder: ffmpeg not found on PATH")
+	}
+	return &ffmpegDecoder{path: path, format: format}, nil
+}
+
+// Decode pipes the access unit through ffmpeg and reads back a PNG
+func (d *ffmpegDecoder) Decode(au []byte) (image.Image, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ffmpegTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, d.path,
+		"-hide_banner", "-loglevel", "error",
+		"-f", d.format, "-i", "pipe:0",
+		"-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "pipe:1")
+	cmd.Stdin = bytes.NewReader(au)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("ffmpeg decoder: %s", msg)
+	}
+	if stdout.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg decoder: %w", ErrUnsupported)
+	}
+	return png.Decode(&stdout)
+}
+
+// Name returns the backend name
+func (d *ffmpegDecoder) Name() string {
+	return "ffmpeg"
+}
+
+// Close releases nothing; each decode runs its own process
+func (d *ffmpegDecoder) Close() error {
+	return nil
+}
@@ -0,0 +1,328 @@
+package decoder
+
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+)
+
+func init() {
+	Register("pcm", newPCMDecoder)
+}
+
+// pcmDecoder decodes Baseline CAVLC H.264 pictures whose macroblocks are
+// all I_PCM, i.e. the output of the pcm encoder. Anything else is reported
+// as ErrUnsupported.
+type pcmDecoder struct{}
+
+func newPCMDecoder(cfg Config) (Decoder, error) {
+	if cfg.Codec != "h264" {
+		return nil, fmt.Errorf("pcm decoder: unsupported codec %q", cfg.Codec)
+	}
+	return pcmDecoder{}, nil
+}
+
+// pcmSPS holds the SPS fields slice headers depend on
+type pcmSPS struct {
+	mbWidth, mbHeight int
+	log2MaxFrameNum   int
+	pocType           uint32
+	log2MaxPOCLsb     int
+	crop              image.Rectangle
+}
+
+// pcmPPS holds the PPS fields slice headers depend on
+type pcmPPS struct {
+	bottomFieldPOC     bool
+	deblockingControl  bool
+	redundantPicCntPre bool
+}
+
+// Decode decodes every slice of the access unit
+func (pcmDecoder) Decode(au []byte) (image.Image, error) {
+	var (
+		sps *pcmSPS
+		pps *pcmPPS
+		img *image.YCbCr
+	)
+	for _, nal := range bitstream.SplitAnnexB(au) {
+		if len(nal) < 2 {
+			continue
+		}
+		switch nal[0] & 0x1F {
+		case bitstream.H264NALSPS:
+			s, err := parsePCMSPS(nal)
+			if err != nil {
+				return nil, err
+			}
+			sps = s
+		case bitstream.H264NALPPS:
+			p, err := parsePCMPPS(nal)
+			if err != nil {
+				return nil, err
+			}
+			pps = p
+		case 1, 5:
+			if sps == nil || pps == nil {
+				return nil, errors.New("pcm decoder: slice before parameter sets")
+			}
+			if img == nil {
+				img = image.NewYCbCr(image.Rect(0, 0, sps.mbWidth*16, sps.mbHeight*16), image.YCbCrSubsampleRatio420)
+			}
+			if err := decodePCMSlice(nal, sps, pps, img); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if img == nil {
+		return nil, errors.New("pcm decoder: no picture in access unit")
+	}
+	return img.SubImage(sps.crop), nil
+}
+
+// Name returns the backend name
+func (pcmDecoder) Name() string {
+	return "pcm"
+}
+
+// Close releases nothing; present to satisfy Decoder
+func (pcmDecoder) Close() error {
+	return nil
+}
+
+func parsePCMSPS(nal []byte) (*pcmSPS, error) {
+	full, err := bitstream.ParseH264SPS(nal)
+	if err != nil {
+		return nil, err
+	}
+	if full.ProfileIDC != 66 && full.ProfileIDC != 77 {
+		return nil, fmt.Errorf("pcm decoder: %w (profile %d)", ErrUnsupported, full.ProfileIDC)
+	}
+
+	r := newBitReader(nal[1:])
+	r.u(24) // profile, constraints, level
+	r.ue()  // seq_parameter_set_id
+	s := &pcmSPS{log2MaxFrameNum: int(r.ue()) + 4}
+	s.pocType = r.ue()
+	switch s.pocType {
+	case 0:
+		s.log2MaxPOCLsb = int(r.ue()) + 4
+	case 1:
+		return nil, fmt.Errorf("pcm decoder: %w (pic_order_cnt_type 1)", ErrUnsupported)
+	}
+	r.ue() // max_num_ref_frames
+	r.u(1) // gaps_in_frame_num_value_allowed_flag
+	s.mbWidth = int(r.ue()) + 1
+	s.mbHeight = int(r.ue()) + 1
+	if !r.flag() {
+		return nil, fmt.Errorf("pcm decoder: %w (interlaced)", ErrUnsupported)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// Cropping is applied by ParseH264SPS; the picture keeps its top-left
+	// corner for the left and top offsets the pcm encoder never sets
+	s.crop = image.Rect(0, 0, full.Width, full.Height)
+	return s, nil
+}
+
+func parsePCMPPS(nal []byte) (*pcmPPS, error) {
+	r := newBitReader(nal[1:])
+	r.ue() // pic_parameter_set_id
+	r.ue() // seq_parameter_set_id
+	if r.flag() {
+		return nil, fmt.Errorf("pcm decoder: %w (CABAC)", ErrUnsupported)
+	}
+	p := &pcmPPS{bottomFieldPOC: r.flag()}
+	if r.ue() != 0 {
+		return nil, fmt.Errorf("pcm decoder: %w (slice groups)", ErrUnsupported)
+	}
+	r.ue() // num_ref_idx_l0_default_active_minus1
+	r.ue() // num_ref_idx_l1_default_active_minus1
+	r.u(1) // weighted_pred_flag
+	r.u(2) // weighted_bipred_idc
+	r.se() // pic_init_qp_minus26
+	r.se() // pic_init_qs_minus26
+	r.se() // chroma_qp_index_offset
+	p.deblockingControl = r.flag()
+	r.u(1) // constrained_intra_pred_flag
+	p.redundantPicCntPre = r.flag()
+	if r.err != nil {
+		return nil, r.err
+	}
+	return p, nil
+}
+
+// decodePCMSlice parses an I slice header and copies its I_PCM macroblocks
+// into img
+func decodePCMSlice(nal []byte, sps *pcmSPS, pps *pcmPPS, img *image.YCbCr) error {
+	idr := nal[0]&0x1F == 5
+	refIDC := nal[0] >> 5 & 3
+	r := newBitReader(nal[1:])
+
+	mb := int(r.ue()) // first_mb_in_slice
+	if t := r.ue(); t != 2 && t != 7 {
+		return fmt.Errorf("pcm decoder: %w (slice type %d)", ErrUnsupported, t)
+	}
+	r.ue()                   // pic_parameter_set_id
+	r.u(sps.log2MaxFrameNum) // frame_num
+	if idr {
+		r.ue() // idr_pic_id
+	}
+	if sps.pocType == 0 {
+		r.u(sps.log2MaxPOCLsb) // pic_order_cnt_lsb
+		if pps.bottomFieldPOC {
+			r.se() // delta_pic_order_cnt_bottom
+		}
+	}
+	if pps.redundantPicCntPre {
+		r.ue() // redundant_pic_cnt
+	}
+	if refIDC != 0 {
+		if idr {
+			r.u(2) // no_output_of_prior_pics_flag, long_term_reference_flag
+		} else if r.flag() { // adaptive_ref_pic_marking_mode_flag
+			for op := r.ue(); op != 0 && r.err == nil; op = r.ue() {
+				if op == 1 || op == 3 {
+					r.ue()
+				}
+				if op == 2 || op == 3 || op == 6 || op == 4 {
+					r.ue()
+				}
+			}
+		}
+	}
+	r.se() // slice_qp_delta
+	if pps.deblockingControl {
+		if r.ue() != 1 { // disable_deblocking_filter_idc
+			r.se() // slice_alpha_c0_offset_div2
+			r.se() // slice_beta_offset_div2
+		}
+	}
+
+	total := sps.mbWidth * sps.mbHeight
+	for ; mb < total && r.more(); mb++ {
+		if t := r.ue(); t != 25 {
+			if r.err != nil {
+				break
+			}
+			return fmt.Errorf("pcm decoder: %w (mb_type %d)", ErrUnsupported, t)
+		}
+		r.align()
+		samples := r.bytes(384)
+		if samples == nil {
+			break
+		}
+		x0, y0 := mb%sps.mbWidth*16, mb/sps.mbWidth*16
+		for y := 0; y < 16; y++ {
+			copy(img.Y[img.YOffset(x0, y0+y):], samples[y*16:y*16+16])
+		}
+		for i, plane := range [][]byte{img.Cb, img.Cr} {
+			base := 256 + i*64
+			for y := 0; y < 8; y++ {
+				copy(plane[img.COffset(x0, y0+y*2):], samples[base+y*8:base+y*8+8])
+			}
+		}
+	}
+	return r.err
+}
+
+// bitReader reads an escaped NAL payload, removing emulation prevention
+// bytes first
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func newBitReader(escaped []byte) *bitReader {
+	data := make([]byte, 0, len(escaped))
+	zeros := 0
+	for _, b := range escaped {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		data = append(data, b)
+	}
+	return &bitReader{data: data}
+}
+
+func (r *bitReader) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = errors.New("pcm decoder: truncated")
+			return 0
+		}
+		v = v<<1 | uint32(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.u(1) == 1
+}
+
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for !r.flag() {
+		if r.err != nil || zeros > 31 {
+			r.err = errors.New("pcm decoder: invalid Exp-Golomb code")
+			return 0
+		}
+		zeros++
+	}
+	return (1<<zeros - 1) + r.u(zeros)
+}
+
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+func (r *bitReader) align() {
+	r.pos = (r.pos + 7) / 8 * 8
+}
+
+func (r *bitReader) bytes(n int) []byte {
+	start := r.pos / 8
+	if r.pos%8 != 0 || start+n > len(r.data) {
+		r.err = errors.New("pcm decoder: truncated")
+		return nil
+	}
+	r.pos += n * 8
+	return r.data[start : start+n]
+}
+
+// more reports whether slice data remains before the RBSP trailing bits
+func (r *bitReader) more() bool {
+	if r.err != nil {
+		return false
+	}
+	last := len(r.data) - 1
+	for last >= 0 && r.data[last] == 0 {
+		last--
+	}
+	if last < 0 {
+		return false
+	}
+	// The trailing stop bit is the lowest set bit of the last non-zero byte
+	stop := last*8 + 7
+	for b := r.data[last]; b&1 == 0; b >>= 1 {
+		stop--
+	}
+	return r.pos < stop
+}
@@ -0,0 +1,294 @@
+// Package director lets trusted viewers run the production remotely: switch
+// the capture service's scene or source and toggle the facecam
+// picture-in-picture from their data channel. Commands are forwarded over
+// the IPC control channel.
+//
+// Only directors may send commands. An operator grants the role to a
+// connected peer on the admin API, or a peer claims it by presenting the
+// configured director token.
+package director
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// MessageType is the data channel message type of director commands and
+// their replies
+const MessageType = "director"
+
+// Actions a director may send
+const (
+	ActionAuth         = "auth"          // Claim the role with Token
+	ActionStatus       = "status"        // Report the producer's scene, source and PiP
+	ActionSwitchScene  = "switch_scene"  // Scene
+	ActionSwitchSource = "switch_source" // Source
+	ActionSetPiP       = "set_pip"       // PiP
+)
+
+// Errors returned to viewers
+var (
+	ErrNotDirector = errors.New("not a director")
+	ErrBadToken    = errors.New("invalid director token")
+	ErrRateLimited = errors.New("too many director commands")
+)
+
+// Config configures a director
+type Config struct {
+	// Token lets a peer claim the role by sending it; empty means only the
+	// admin API grants it
+	Token string
+
+	// MinInterval is the least time between one director's commands,
+	// default 250ms
+	MinInterval time.Duration
+
+	// Timeout bounds each forwarded command, default 5s
+	Timeout time.Duration
+}
+
+// Message is a director's data channel command
+type Message struct {
+	Type   string `json:"type"`
+	Action string `json:"action"`
+	Token  string `json:"token,omitempty"`
+	Scene  string `json:"scene,omitempty"`
+	Source string `json:"source,omitempty"`
+	PiP    *bool  `json:"pip,omitempty"`
+}
+
+// Reply answers a command
+type Reply struct {
+	Type     string `json:"type"`
+	Action   string `json:"action"`
+	Director bool   `json:"director"`
+	Scene    string `json:"scene,omitempty"`
+	Source   string `json:"source,omitempty"`
+	PiP      bool   `json:"pip"`
+}
+
+// Stats are director counters
+type Stats struct {
+	Directors []string `json:"directors"`
+	Commands  uint64   `json:"commands"` // Forwarded and accepted by the producer
+	Denied    uint64   `json:"denied"`   // From peers who are not directors, or bad tokens
+	Failed    uint64   `json:"failed"`
+}
+
+// Director authorizes peers and forwards their commands
+type Director struct {
+	cfg     Config
+	encoder media.EncoderController
+	logger  zerolog.Logger
+
+	mu        sync.Mutex
+	directors map[string]bool
+	lastCmd   map[string]time.Time
+	onCommand func(peerID string, cmd media.ControlCommand)
+
+	// Statistics
+	commands atomic.Uint64
+	denied   atomic.Uint64
+	failed   atomic.Uint64
+}
+
+// New creates a director forwarding to encoder
+func New(cfg Config, encoder media.EncoderController, logger zerolog.Logger) *Director {
+	// Apply defaults for zero values
+	if cfg.MinInterval <= 0 {
+		cfg.MinInterval = 250 * time.Millisecond
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	return &Director{
+		cfg:       cfg,
+		encoder:   encoder,
+		logger:    logger.With().Str("component", "director").Logger(),
+		directors: make(map[string]bool),
+		lastCmd:   make(map[string]time.Time),
+	}
+}
+
+// SetOnCommand registers fn to be called after the producer accepts a
+// director's command
+func (d *Director) SetOnCommand(fn func(peerID string, cmd media.ControlCommand)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onCommand = fn
+}
+
+// Grant makes peerID a director
+func (d *Director) Grant(peerID string) {
+	d.mu.Lock()
+	d.directors[peerID] = true
+	d.mu.Unlock()
+	d.logger.Info().Str("peer_id", peerID).Msg("Director granted")
+}
+
+// Revoke takes the role from peerID; it reports false if the peer was not
+// a director
+func (d *Director) Revoke(peerID string) bool {
+	d.mu.Lock()
+	ok := d.directors[peerID]
+	delete(d.directors, peerID)
+	delete(d.lastCmd, peerID)
+	d.mu.Unlock()
+
+	if ok {
+		d.logger.Info().Str("peer_id", peerID).Msg("Director revoked")
+	}
+	return ok
+}
+
+// RemovePeer forgets a peer that left; the role does not survive a
+// reconnect
+func (d *Director) RemovePeer(peerID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.directors, peerID)
+	delete(d.lastCmd, peerID)
+}
+
+// IsDirector reports whether peerID holds the role
+func (d *Director) IsDirector(peerID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.directors[peerID]
+}
+
+// Directors lists the peers holding the role, sorted
+func (d *Director) Directors() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]string, 0, len(d.directors))
+	for peerID := range d.directors {
+		list = append(list, peerID)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// HandleMessage handles a director command from a viewer. It is a
+// commands.Handler.
+func (d *Director) HandleMessage(peerID string, msg []byte) (any, error) {
+	var m Message
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return nil, err
+	}
+
+	if m.Action == ActionAuth {
+		return d.auth(peerID, m.Token)
+	}
+	if !d.IsDirector(peerID) {
+		d.denied.Add(1)
+		return nil, ErrNotDirector
+	}
+
+	var cmd media.ControlCommand
+	switch m.Action {
+	case ActionStatus:
+		cmd = media.ControlCommand{Action: media.ControlStatus}
+	case ActionSwitchScene:
+		cmd = media.ControlCommand{Action: media.ControlSwitchScene, Scene: m.Scene}
+	case ActionSwitchSource:
+		cmd = media.ControlCommand{Action: media.ControlSwitchSource, Source: m.Source}
+	case ActionSetPiP:
+		cmd = media.ControlCommand{Action: media.ControlSetPiP, PiP: m.PiP}
+	default:
+		return nil, fmt.Errorf("unknown director action %q", m.Action)
+	}
+	if err := cmd.Validate(); err != nil {
+		return nil, err
+	}
+	if m.Action != ActionStatus && !d.allow(peerID) {
+		d.denied.Add(1)
+		return nil, ErrRateLimited
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.Timeout)
+	defer cancel()
+	state, err := d.encoder.Control(ctx, cmd)
+	if err != nil {
+		d.failed.Add(1)
+		d.logger.Warn().Err(err).Str("peer_id", peerID).Str("action", m.Action).Msg("Director command failed")
+		return nil, err
+	}
+
+	if m.Action != ActionStatus {
+		d.commands.Add(1)
+		d.logger.Info().Str("peer_id", peerID).Str("action", m.Action).
+			Str("scene", state.Scene).Str("source", state.Source).Bool("pip", state.PiP).
+			Msg("Director command applied")
+
+		d.mu.Lock()
+		onCommand := d.onCommand
+		d.mu.Unlock()
+		if onCommand != nil {
+			onCommand(peerID, cmd)
+		}
+	}
+	return d.reply(m.Action, state), nil
+}
+
+// auth grants the role to a peer presenting the configured token. Attempts
+// share the command rate limit, which slows guessing.
+func (d *Director) auth(peerID, token string) (any, error) {
+	if !d.allow(peerID) {
+		d.denied.Add(1)
+		return nil, ErrRateLimited
+	}
+	if d.cfg.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(d.cfg.Token)) != 1 {
+		d.denied.Add(1)
+		d.logger.Warn().Str("peer_id", peerID).Msg("Director token rejected")
+		return nil, ErrBadToken
+	}
+	d.Grant(peerID)
+	return d.reply(ActionAuth, media.ControlReply{}), nil
+}
+
+// allow applies MinInterval to a director's commands
+func (d *Director) allow(peerID string) bool {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.lastCmd[peerID]) < d.cfg.MinInterval {
+		return false
+	}
+	d.lastCmd[peerID] = now
+	return true
+}
+
+// reply builds the answer to action from the producer's state
+func (d *Director) reply(action string, state media.ControlReply) Reply {
+	return Reply{
+		Type:     MessageType,
+		Action:   action,
+		Director: true,
+		Scene:    state.Scene,
+		Source:   state.Source,
+		PiP:      state.PiP,
+	}
+}
+
+// Stats returns director counters
+func (d *Director) Stats() Stats {
+	return Stats{
+		Directors: d.Directors(),
+		Commands:  d.commands.Load(),
+		Denied:    d.denied.Load(),
+		Failed:    d.failed.Load(),
+	}
+}
@@ -0,0 +1,512 @@
+// Package discovery advertises the gateway on the local network with
+// multicast DNS service discovery (RFC 6762/6763), so client apps can find
+// the signaling URL by browsing for _gaming-capture._tcp instead of typing
+// an address.
+//
+// The responder answers PTR, SRV, TXT, A and AAAA queries for the service
+// only; it is not a general mDNS stack and does not probe for name
+// conflicts. It announces on start and sends a goodbye on stop.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ServiceType is the DNS-SD service type clients browse for
+const ServiceType = "_gaming-capture._tcp"
+
+const (
+	mdnsPort = 5353
+
+	// servicesName enumerates service types (RFC 6763 section 9)
+	servicesName = "_services._dns-sd._udp.local."
+
+	// cacheFlush marks records this host owns exclusively
+	cacheFlush = 1 << 15
+
+	// unicastResponse is the QU bit in a question's class
+	unicastResponse = 1 << 15
+
+	// legacyTTL caps TTLs in replies to one-shot (non-5353) queriers
+	legacyTTL = 10
+)
+
+var (
+	mdnsGroupV4 = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+	mdnsGroupV6 = &net.UDPAddr{IP: net.ParseIP("ff02::fb"), Port: mdnsPort}
+)
+
+// Config configures the advertisement
+type Config struct {
+	Port int // Signaling port
+
+	// Instance is the human-readable service name, default
+	// "Gaming Capture on <hostname>"
+	Instance string
+
+	// Hostname is the .local host name addresses are published under,
+	// default the machine's short host name
+	Hostname string
+
+	// TXT are key=value attributes, e.g. "path=/", "proto=https"
+	TXT []string
+
+	TTL  time.Duration // Record TTL, default 2 minutes
+	IPv6 bool          // Also listen and answer on IPv6
+}
+
+// Stats are responder counters
+type Stats struct {
+	Instance string `json:"instance"`
+	Queries  uint64 `json:"queries"`
+	Answers  uint64 `json:"answers"`
+}
+
+// Advertiser is an mDNS responder for the gateway's service
+type Advertiser struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	service  string // _gaming-capture._tcp.local.
+	instance string // <Instance>._gaming-capture._tcp.local.
+	host     string // <Hostname>.local.
+
+	mu      sync.Mutex
+	running bool
+	cancel  context.CancelFunc
+	conns   []*net.UDPConn
+	wg      sync.WaitGroup
+
+	// Statistics
+	queries atomic.Uint64
+	answers atomic.Uint64
+}
+
+// New creates an advertiser; nothing is sent until Start
+func New(cfg Config, logger zerolog.Logger) (*Advertiser, error) {
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return nil, fmt.Errorf("invalid port %d", cfg.Port)
+	}
+
+	// Apply defaults for zero values
+	if cfg.Hostname == "" {
+		name, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Hostname = name
+	}
+	cfg.Hostname = strings.TrimSuffix(strings.TrimSuffix(cfg.Hostname, "."), ".local")
+	cfg.Hostname, _, _ = strings.Cut(cfg.Hostname, ".")
+	if cfg.Instance == "" {
+		cfg.Instance = "Gaming Capture on " + cfg.Hostname
+	}
+	// Dots would split the instance label
+	cfg.Instance = strings.ReplaceAll(cfg.Instance, ".", "-")
+	if cfg.TTL <= 0 {
+		cfg.TTL = 2 * time.Minute
+	}
+
+	a := &Advertiser{
+		cfg:      cfg,
+		logger:   logger.With().Str("component", "discovery").Logger(),
+		service:  ServiceType + ".local.",
+		instance: cfg.Instance + "." + ServiceType + ".local.",
+		host:     cfg.Hostname + ".local.",
+	}
+	// Catch names the DNS encoder rejects (labels over 63 bytes) early
+	if _, err := a.records(false, 0); err != nil {
+		return nil, fmt.Errorf("invalid service name: %w", err)
+	}
+	return a, nil
+}
+
+// Start joins the mDNS groups, announces the service and answers queries
+func (a *Advertiser) Start(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.running {
+		return errors.New("advertiser already started")
+	}
+
+	conn4, err := net.ListenMulticastUDP("udp4", nil, mdnsGroupV4)
+	if err != nil {
+		return fmt.Errorf("failed to join mDNS group: %w", err)
+	}
+	a.conns = []*net.UDPConn{conn4}
+	if a.cfg.IPv6 {
+		if conn6, err := net.ListenMulticastUDP("udp6", nil, mdnsGroupV6); err != nil {
+			a.logger.Warn().Err(err).Msg("IPv6 mDNS unavailable; advertising on IPv4 only")
+		} else {
+			a.conns = append(a.conns, conn6)
+		}
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	a.cancel = cancel
+	a.running = true
+
+	for _, conn := range a.conns {
+		a.wg.Add(1)
+		go a.serve(runCtx, conn)
+	}
+	a.wg.Add(1)
+	go a.announce(runCtx)
+
+	a.logger.Info().
+		Str("instance", a.cfg.Instance).
+		Str("service", ServiceType).
+		Int("port", a.cfg.Port).
+		Msg("Advertising on the local network")
+
+	return nil
+}
+
+// Stop sends a goodbye so browsers drop the service, then leaves the groups
+func (a *Advertiser) Stop() error {
+	a.mu.Lock()
+	if !a.running {
+		a.mu.Unlock()
+		return nil
+	}
+	a.running = false
+	a.cancel()
+	conns := a.conns
+	a.mu.Unlock()
+
+	if msg, err := a.records(false, 0); err == nil {
+		a.multicast(conns, msg)
+	}
+	for _, conn := range conns {
+		conn.Close()
+	}
+	a.wg.Wait()
+	return nil
+}
+
+// Stats returns responder counters
+func (a *Advertiser) Stats() Stats {
+	return Stats{
+		Instance: a.cfg.Instance,
+		Queries:  a.queries.Load(),
+		Answers:  a.answers.Load(),
+	}
+}
+
+// announce sends unsolicited responses at 1s and 2s intervals (RFC 6762
+// section 8.3)
+func (a *Advertiser) announce(ctx context.Context) {
+	defer a.wg.Done()
+
+	delay := time.Second
+	for i := 0; i < 3; i++ {
+		if msg, err := a.records(false, uint32(a.cfg.TTL/time.Second)); err == nil {
+			a.mu.Lock()
+			conns := a.conns
+			a.mu.Unlock()
+			a.multicast(conns, msg)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+			delay *= 2
+		}
+	}
+}
+
+// serve answers queries arriving on one group
+func (a *Advertiser) serve(ctx context.Context, conn *net.UDPConn) {
+	defer a.wg.Done()
+
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			a.logger.Debug().Err(err).Msg("mDNS read error")
+			continue
+		}
+		a.handle(conn, src, buf[:n])
+	}
+}
+
+// handle answers one query if it asks about the service
+func (a *Advertiser) handle(conn *net.UDPConn, src *net.UDPAddr, packet []byte) {
+	var p dnsmessage.Parser
+	header, err := p.Start(packet)
+	if err != nil || header.Response {
+		return
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return
+	}
+
+	legacy := src.Port != mdnsPort
+	unicast := legacy
+	matched := make([]dnsmessage.Question, 0, len(questions))
+	for _, q := range questions {
+		if a.owns(q) {
+			matched = append(matched, q)
+			if uint16(q.Class)&unicastResponse != 0 {
+				unicast = true
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return
+	}
+	a.queries.Add(1)
+
+	ttl := uint32(a.cfg.TTL / time.Second)
+	var msg []byte
+	if legacy {
+		// One-shot queriers need the ID and question echoed, short TTLs
+		// and no cache-flush bits (RFC 6762 section 6.7)
+		if ttl > legacyTTL {
+			ttl = legacyTTL
+		}
+		msg, err = a.reply(header.ID, matched, ttl)
+	} else {
+		msg, err = a.records(matched[0].Type == dnsmessage.TypePTR && isServicesQuery(matched), ttl)
+	}
+	if err != nil {
+		a.logger.Debug().Err(err).Msg("Failed to build mDNS response")
+		return
+	}
+
+	if unicast {
+		_, err = conn.WriteToUDP(msg, src)
+	} else {
+		_, err = conn.WriteToUDP(msg, group(conn))
+	}
+	if err != nil {
+		a.logger.Debug().Err(err).Msg("Failed to send mDNS response")
+		return
+	}
+	a.answers.Add(1)
+}
+
+// owns reports whether q concerns a name this responder owns
+func (a *Advertiser) owns(q dnsmessage.Question) bool {
+	name := strings.ToLower(q.Name.String())
+	switch q.Type {
+	case dnsmessage.TypePTR:
+		return name == strings.ToLower(a.service) || name == servicesName
+	case dnsmessage.TypeSRV, dnsmessage.TypeTXT:
+		return name == strings.ToLower(a.instance)
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		return name == strings.ToLower(a.host)
+	case dnsmessage.TypeALL:
+		return name == strings.ToLower(a.instance) || name == strings.ToLower(a.host) ||
+			name == strings.ToLower(a.service)
+	}
+	return false
+}
+
+func isServicesQuery(qs []dnsmessage.Question) bool {
+	for _, q := range qs {
+		if strings.ToLower(q.Name.String()) != servicesName {
+			return false
+		}
+	}
+	return true
+}
+
+// records builds a full multicast response: the service PTR with SRV, TXT
+// and addresses as additional records, or just the service type when
+// servicesOnly is set. A zero ttl makes it a goodbye.
+func (a *Advertiser) records(servicesOnly bool, ttl uint32) ([]byte, error) {
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	if servicesOnly {
+		if err := a.servicePTR(&b, mustName(servicesName), ttl); err != nil {
+			return nil, err
+		}
+		return b.Finish()
+	}
+	if err := a.instancePTR(&b, ttl); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	if err := a.instanceRecords(&b, ttl, cacheFlush); err != nil {
+		return nil, err
+	}
+	if err := a.addressRecords(&b, ttl, cacheFlush); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// reply builds a legacy unicast response to the given questions
+func (a *Advertiser) reply(id uint16, questions []dnsmessage.Question, ttl uint32) ([]byte, error) {
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	for _, q := range questions {
+		q.Class &^= unicastResponse
+		if err := b.Question(q); err != nil {
+			return nil, err
+		}
+	}
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, q := range questions {
+		var err error
+		switch {
+		case q.Type == dnsmessage.TypePTR && strings.ToLower(q.Name.String()) == servicesName:
+			err = a.servicePTR(&b, mustName(servicesName), ttl)
+		case q.Type == dnsmessage.TypePTR:
+			err = a.instancePTR(&b, ttl)
+		case q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA:
+			err = a.addressRecords(&b, ttl, 0)
+		default:
+			err = a.instanceRecords(&b, ttl, 0)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+func (a *Advertiser) servicePTR(b *dnsmessage.Builder, name dnsmessage.Name, ttl uint32) error {
+	return b.PTRResource(
+		dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: ttl},
+		dnsmessage.PTRResource{PTR: mustName(a.service)},
+	)
+}
+
+func (a *Advertiser) instancePTR(b *dnsmessage.Builder, ttl uint32) error {
+	service, err := dnsmessage.NewName(a.service)
+	if err != nil {
+		return err
+	}
+	instance, err := dnsmessage.NewName(a.instance)
+	if err != nil {
+		return err
+	}
+	return b.PTRResource(
+		dnsmessage.ResourceHeader{Name: service, Class: dnsmessage.ClassINET, TTL: ttl},
+		dnsmessage.PTRResource{PTR: instance},
+	)
+}
+
+func (a *Advertiser) instanceRecords(b *dnsmessage.Builder, ttl uint32, flush dnsmessage.Class) error {
+	instance, err := dnsmessage.NewName(a.instance)
+	if err != nil {
+		return err
+	}
+	host, err := dnsmessage.NewName(a.host)
+	if err != nil {
+		return err
+	}
+	class := dnsmessage.ClassINET | flush
+	if err := b.SRVResource(
+		dnsmessage.ResourceHeader{Name: instance, Class: class, TTL: ttl},
+		dnsmessage.SRVResource{Target: host, Port: uint16(a.cfg.Port)},
+	); err != nil {
+		return err
+	}
+	txt := a.cfg.TXT
+	if len(txt) == 0 {
+		// An empty TXT record is a single empty string (RFC 6763 section 6.1)
+		txt = []string{""}
+	}
+	return b.TXTResource(
+		dnsmessage.ResourceHeader{Name: instance, Class: class, TTL: ttl},
+		dnsmessage.TXTResource{TXT: txt},
+	)
+}
+
+// addressRecords publishes the host's non-loopback addresses
+func (a *Advertiser) addressRecords(b *dnsmessage.Builder, ttl uint32, flush dnsmessage.Class) error {
+	host, err := dnsmessage.NewName(a.host)
+	if err != nil {
+		return err
+	}
+	class := dnsmessage.ClassINET | flush
+	for _, ip := range localAddrs(a.cfg.IPv6) {
+		hdr := dnsmessage.ResourceHeader{Name: host, Class: class, TTL: ttl}
+		if v4 := ip.To4(); v4 != nil {
+			var r dnsmessage.AResource
+			copy(r.A[:], v4)
+			err = b.AResource(hdr, r)
+		} else {
+			var r dnsmessage.AAAAResource
+			copy(r.AAAA[:], ip.To16())
+			err = b.AAAAResource(hdr, r)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// multicast sends msg to the group of each connection
+func (a *Advertiser) multicast(conns []*net.UDPConn, msg []byte) {
+	for _, conn := range conns {
+		if _, err := conn.WriteToUDP(msg, group(conn)); err != nil {
+			a.logger.Debug().Err(err).Msg("Failed to send mDNS announcement")
+		}
+	}
+}
+
+// group returns the multicast group a connection joined
+func group(conn *net.UDPConn) *net.UDPAddr {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil && addr.IP != nil {
+		return mdnsGroupV6
+	}
+	return mdnsGroupV4
+}
+
+// localAddrs lists usable unicast addresses, IPv4 first
+func localAddrs(ipv6 bool) []net.IP {
+	addrs, _ := net.InterfaceAddrs()
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipnet.IP.To4() == nil && !ipv6 {
+			continue
+		}
+		ips = append(ips, ipnet.IP)
+	}
+	sort.SliceStable(ips, func(i, j int) bool { return ips[i].To4() != nil && ips[j].To4() == nil })
+	return ips
+}
+
+func mustName(name string) dnsmessage.Name {
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
@@ -0,0 +1,105 @@
+// Package drain winds down viewer sessions on shutdown: viewers are told the
+// server is going away and given time to leave before connections close.
+package drain
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// NoticeType is the data channel message type announcing shutdown
+const NoticeType = "server_shutdown"
+
+// Notice is the data channel message sent to every viewer when draining
+// starts. Clients should show it and disconnect, or reconnect after
+// DrainMs to reach a restarted gateway.
+type Notice struct {
+	Type    string `json:"type"`
+	Reason  string `json:"reason"`
+	DrainMs int64  `json:"drain_ms"` // Time until remaining connections are closed
+}
+
+// PeerCounter reports connected viewers. The peer manager satisfies it.
+type PeerCounter interface {
+	GetConnectedPeerCount() int
+}
+
+// Broadcaster is implemented by peer managers that can send a message on
+// every viewer's data channel
+type Broadcaster interface {
+	BroadcastMessage(data []byte) error
+}
+
+// Config configures a drain
+type Config struct {
+	Window       time.Duration // How long viewers get to leave
+	Reason       string        // Reported to viewers, default "shutdown"
+	PollInterval time.Duration // Peer count check interval, default 250ms
+}
+
+// Result summarises a drain
+type Result struct {
+	Notified  bool          // The notice was broadcast
+	Initial   int           // Viewers connected when draining began
+	Remaining int           // Viewers still connected at the end
+	Elapsed   time.Duration // Time spent draining
+}
+
+// Drain broadcasts a shutdown notice, when peers supports it, and waits for
+// viewers to disconnect until the window passes or ctx is done. New viewers
+// must already be refused by the caller.
+func Drain(ctx context.Context, cfg Config, peers PeerCounter, logger zerolog.Logger) Result {
+	// Apply defaults for zero values
+	if cfg.Reason == "" {
+		cfg.Reason = "shutdown"
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 250 * time.Millisecond
+	}
+	logger = logger.With().Str("component", "drain").Logger()
+
+	start := time.Now()
+	result := Result{Initial: peers.GetConnectedPeerCount()}
+	result.Remaining = result.Initial
+	if result.Initial == 0 || cfg.Window <= 0 {
+		return result
+	}
+
+	if b, ok := peers.(Broadcaster); ok {
+		data, _ := json.Marshal(Notice{Type: NoticeType, Reason: cfg.Reason, DrainMs: cfg.Window.Milliseconds()})
+		if err := b.BroadcastMessage(data); err != nil {
+			logger.Warn().Err(err).Msg("Failed to send shutdown notice")
+		} else {
+			result.Notified = true
+		}
+	}
+
+	logger.Info().
+		Int("peers", result.Initial).
+		Dur("window", cfg.Window).
+		Bool("notified", result.Notified).
+		Msg("Draining peers")
+
+	deadline := time.NewTimer(cfg.Window)
+	defer deadline.Stop()
+	ticker := time.NewTicker(cfg.PollInterval)
+	defer ticker.Stop()
+
+wait:
+	for result.Remaining > 0 {
+		select {
+		case <-ctx.Done():
+			break wait
+		case <-deadline.C:
+			break wait
+		case <-ticker.C:
+			result.Remaining = peers.GetConnectedPeerCount()
+		}
+	}
+
+	result.Elapsed = time.Since(start)
+	return result
+}
@@ -0,0 +1,90 @@
+package encoder
+
+// bitWriter writes an H.264 RBSP bit by bit
+type bitWriter struct {
+	buf   []byte
+	cur   byte
+	nbits uint // bits used in cur
+}
+
+// writeBits writes the low n bits of v, most significant first
+func (w *bitWriter) writeBits(v uint32, n uint) {
+	for n > 0 {
+		n--
+		w.cur = w.cur<<1 | byte(v>>n&1)
+		w.nbits++
+		if w.nbits == 8 {
+			w.buf = append(w.buf, w.cur)
+			w.cur, w.nbits = 0, 0
+		}
+	}
+}
+
+// writeFlag writes a single-bit flag
+func (w *bitWriter) writeFlag(b bool) {
+	if b {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+}
+
+// writeUE writes an unsigned Exp-Golomb code
+func (w *bitWriter) writeUE(v uint32) {
+	v++
+	size := uint(0)
+	for t := v; t > 0; t >>= 1 {
+		size++
+	}
+	w.writeBits(0, size-1)
+	w.writeBits(v, size)
+}
+
+// writeSE writes a signed Exp-Golomb code
+func (w *bitWriter) writeSE(v int32) {
+	if v > 0 {
+		w.writeUE(uint32(2*v - 1))
+	} else {
+		w.writeUE(uint32(-2 * v))
+	}
+}
+
+// alignZero pads with zero bits to the next byte boundary
+func (w *bitWriter) alignZero() {
+	if w.nbits > 0 {
+		w.writeBits(0, 8-w.nbits)
+	}
+}
+
+// writeBytes appends whole bytes; the writer must be byte aligned
+func (w *bitWriter) writeBytes(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+// trailingBits writes rbsp_trailing_bits and returns the RBSP
+func (w *bitWriter) trailingBits() []byte {
+	w.writeBits(1, 1)
+	w.alignZero()
+	return w.buf
+}
+
+// appendNAL appends a start code, NAL header and escaped RBSP to dst
+func appendNAL(dst []byte, refIdc, nalType byte, rbsp []byte) []byte {
+	dst = append(dst, 0, 0, 0, 1, refIdc<<5|nalType)
+
+	// Insert emulation prevention bytes so the payload never contains a start code
+	zeros := 0
+	for _, b := range rbsp {
+		if zeros == 2 && b <= 3 {
+			dst = append(dst, 3)
+			zeros = 0
+		}
+		dst = append(dst, b)
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+	}
+	return dst
+}
@@ -0,0 +1,277 @@
+// Package encoder provides H.264 encoding for raw-frame sources (synthetic
+// patterns, V4L2 raw/MJPEG capture) behind a common Encoder interface.
+//
+// Backends register themselves by name. The pure-Go "pcm" backend is always
+// available, but sends uncompressed I_PCM macroblocks (about 1.5 Gbps at
+// 1080p60), so it is only used when asked for by name. "x264" is compiled
+// in with the x264 build tag and requires cgo and libx264. The hardware
+// backends "nvenc" and "vaapi" run the ffmpeg
+// binary on PATH and are only usable when it can open the GPU, which is
+// probed the first time each is asked for.
+package encoder
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+)
+
+// Frame is an encoded access unit in Annex B format
+type Frame struct {
+	Data       []byte // Annex B NAL units, SPS/PPS included on keyframes
+	IsKeyframe bool
+	PTS        int64 // presentation timestamp in nanoseconds
+}
+
+// Encoder turns raw 4:2:0 pictures into H.264 access units
+type Encoder interface {
+	// Encode encodes one picture. The image must match the configured size.
+	Encode(img *image.YCbCr, pts int64) (Frame, error)
+
+	// ForceKeyframe makes the next encoded picture an IDR
+	ForceKeyframe()
+
+	// Name returns the backend name
+	Name() string
+
+	// Close releases encoder resources
+	Close() error
+}
+
+// Config configures an encoder
+type Config struct {
+	Backend          string // Backend name, "" or "auto" picks the best available
+	Width            int
+	Height           int
+	FrameRate        int
+	BitrateKbps      int // Target bitrate; ignored by backends without rate control
+	KeyframeInterval int // Frames between IDRs, default 2 seconds worth
+
+	// Device selects the GPU for hardware backends: a render node such as
+	// /dev/dri/renderD129 for "vaapi", a GPU index for "nvenc". Empty uses
+	// the first.
+	Device string
+
+	// Overlay, when set, draws on each picture before it is encoded, e.g.
+	// a watermark. It may modify the picture in place.
+	Overlay func(img *image.YCbCr, pts int64)
+}
+
+// Factory creates an encoder for a backend; it fails if the backend cannot
+// run here
+type Factory func(cfg Config) (Encoder, error)
+
+// preference lists backends from most to least preferred for "auto". pcm is
+// not compressed video, so "auto" never picks it.
+var preference = []string{"nvenc", "vaapi", "x264"}
+
+// hardware lists the backends that encode on a GPU
+var hardware = map[string]bool{"nvenc": true, "vaapi": true}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]Factory)
+)
+
+// Register makes a backend available under name. It is meant to be called
+// from init functions.
+func Register(name string, factory Factory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[name] = factory
+}
+
+// Backends returns the names of all registered backends
+func Backends() []string {
+	return sortedNames(registered())
+}
+
+// registered returns a copy of the registered backends, so factories,
+// which may probe hardware for seconds, run without the lock
+func registered() map[string]Factory {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	factories := make(map[string]Factory, len(backends))
+	for name, factory := range backends {
+		factories[name] = factory
+	}
+	return factories
+}
+
+// sortedNames returns the names of factories in order
+func sortedNames(factories map[string]Factory) []string {
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates an encoder using the configured backend. "auto" takes the
+// first preferred backend that works, so a missing or busy GPU falls back
+// to software.
+func New(cfg Config) (Encoder, error) {
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, errors.New("encoder width and height must be positive")
+	}
+	if cfg.FrameRate <= 0 {
+		cfg.FrameRate = 30
+	}
+	if cfg.KeyframeInterval <= 0 {
+		cfg.KeyframeInterval = cfg.FrameRate * 2
+	}
+
+	factories := registered()
+	var enc Encoder
+	if cfg.Backend != "" && cfg.Backend != "auto" {
+		factory, ok := factories[cfg.Backend]
+		if !ok {
+			return nil, fmt.Errorf("encoder backend %q not available (have %v)", cfg.Backend, sortedNames(factories))
+		}
+		var err error
+		if enc, err = factory(cfg); err != nil {
+			return nil, err
+		}
+	} else {
+		var errs []error
+		for _, name := range preference {
+			factory, ok := factories[name]
+			if !ok {
+				continue
+			}
+			var err error
+			if enc, err = factory(cfg); err == nil {
+				break
+			}
+			errs = append(errs, err)
+		}
+		if enc == nil {
+			errs = append(errs, errors.New("build with the x264 tag or use a GPU with nvenc or vaapi; pcm sends uncompressed video and must be chosen by name"))
+			return nil, fmt.Errorf("no encoder available: %w", errors.Join(errs...))
+		}
+	}
+
+	if cfg.Overlay == nil {
+		return enc, nil
+	}
+	return overlaid{Encoder: enc, draw: cfg.Overlay}, nil
+}
+
+// Capability describes whether a backend can encode on this machine
+type Capability struct {
+	Backend  string `json:"backend"`
+	Hardware bool   `json:"hardware"`
+	Error    string `json:"error,omitempty"` // Why it cannot; empty when usable
+}
+
+// Probe tries every registered backend, most preferred first, with device
+// selecting the GPU as in Config. Hardware results are cached, so only the
+// first call waits for the GPU.
+func Probe(device string) []Capability {
+	names := Backends()
+	sort.SliceStable(names, func(i, j int) bool { return rank(names[i]) < rank(names[j]) })
+
+	caps := make([]Capability, 0, len(names))
+	for _, name := range names {
+		c := Capability{Backend: name, Hardware: hardware[name]}
+		enc, err := New(Config{Backend: name, Width: 320, Height: 240, Device: device})
+		if err != nil {
+			c.Error = err.Error()
+		} else {
+			enc.Close()
+		}
+		caps = append(caps, c)
+	}
+	return caps
+}
+
+// rank orders backends by preference, unknown ones last
+func rank(name string) int {
+	for i, p := range preference {
+		if p == name {
+			return i
+		}
+	}
+	return len(preference)
+}
+
+// overlaid applies Config.Overlay ahead of a backend
+type overlaid struct {
+	Encoder
+	draw func(img *image.YCbCr, pts int64)
+}
+
+func (e overlaid) Encode(img *image.YCbCr, pts int64) (Frame, error) {
+	e.draw(img, pts)
+	return e.Encoder.Encode(img, pts)
+}
+
+// ToI420 converts any image to a 4:2:0 YCbCr picture, reusing the input when
+// it already has the right layout.
+func ToI420(img image.Image) *image.YCbCr {
+	if ycc, ok := img.(*image.YCbCr); ok && ycc.SubsampleRatio == image.YCbCrSubsampleRatio420 {
+		return ycc
+	}
+
+	bounds := img.Bounds()
+	out := image.NewYCbCr(bounds, image.YCbCrSubsampleRatio420)
+
+	// Fast path for 4:2:2 (typical MJPEG output): average vertical chroma pairs
+	if ycc, ok := img.(*image.YCbCr); ok && ycc.SubsampleRatio == image.YCbCrSubsampleRatio422 {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			copy(out.Y[out.YOffset(bounds.Min.X, y):out.YOffset(bounds.Max.X-1, y)+1],
+				ycc.Y[ycc.YOffset(bounds.Min.X, y):ycc.YOffset(bounds.Max.X-1, y)+1])
+		}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y += 2 {
+			y2 := y + 1
+			if y2 >= bounds.Max.Y {
+				y2 = y
+			}
+			for x := bounds.Min.X; x < bounds.Max.X; x += 2 {
+				a, b := ycc.COffset(x, y), ycc.COffset(x, y2)
+				o := out.COffset(x, y)
+				out.Cb[o] = uint8((int(ycc.Cb[a]) + int(ycc.Cb[b]) + 1) / 2)
+				out.Cr[o] = uint8((int(ycc.Cr[a]) + int(ycc.Cr[b]) + 1) / 2)
+			}
+		}
+		return out
+	}
+
+	// Generic path through the color model
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			yy, cb, cr := RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			out.Y[out.YOffset(x, y)] = yy
+			if x%2 == 0 && y%2 == 0 {
+				o := out.COffset(x, y)
+				out.Cb[o] = cb
+				out.Cr[o] = cr
+			}
+		}
+	}
+	return out
+}
+
+// RGBToYCbCr converts using BT.601 limited range, as expected by most decoders
+func RGBToYCbCr(r, g, b uint8) (uint8, uint8, uint8) {
+	rf, gf, bf := float64(r), float64(g), float64(b)
+	y := 16 + 0.257*rf + 0.504*gf + 0.098*bf
+	cb := 128 - 0.148*rf - 0.291*gf + 0.439*bf
+	cr := 128 + 0.439*rf - 0.368*gf - 0.071*bf
+	return clamp8(y), clamp8(cb), clamp8(cr)
+}
+
+func clamp8(v float64) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
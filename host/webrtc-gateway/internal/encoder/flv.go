@@ -0,0 +1,100 @@
+package encoder
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+)
+
+// FLV framing, as written by ffmpeg's flv muxer. FLV is used to read
+// hardware encoders' output because each tag is one whole access unit with
+// its keyframe flag, so nothing has to wait for the next picture to find
+// where one ends.
+const (
+	flvTagVideo = 9
+
+	flvCodecAVC    = 7
+	flvFrameKey    = 1
+	flvAVCSequence = 0
+	flvAVCNALU     = 1
+)
+
+// flvReader reads H.264 access units from an FLV stream, converting them to
+// Annex-B with parameter sets ahead of every keyframe
+type flvReader struct {
+	r          *bufio.Reader
+	normalizer *bitstream.Normalizer
+	header     [11]byte
+	data       []byte
+}
+
+func newFLVReader(r io.Reader) *flvReader {
+	return &flvReader{r: bufio.NewReaderSize(r, 256<<10)}
+}
+
+// readHeader reads the file header and the first previous-tag size
+func (f *flvReader) readHeader() error {
+	var h [9]byte
+	if _, err := io.ReadFull(f.r, h[:]); err != nil {
+		return err
+	}
+	if string(h[0:3]) != "FLV" {
+		return errors.New("flv: bad signature")
+	}
+	skip := int(binary.BigEndian.Uint32(h[5:])) - len(h) + 4
+	if skip < 4 {
+		return errors.New("flv: bad header size")
+	}
+	_, err := f.r.Discard(skip)
+	return err
+}
+
+// next returns the next access unit, skipping metadata and other tags
+func (f *flvReader) next() (data []byte, keyframe bool, err error) {
+	for {
+		if _, err := io.ReadFull(f.r, f.header[:]); err != nil {
+			return nil, false, err
+		}
+		size := int(f.header[1])<<16 | int(f.header[2])<<8 | int(f.header[3])
+		if cap(f.data) < size+4 {
+			f.data = make([]byte, size+4)
+		}
+		f.data = f.data[:size+4] // With the trailing previous-tag size
+		if _, err := io.ReadFull(f.r, f.data); err != nil {
+			return nil, false, fmt.Errorf("flv: truncated tag: %w", err)
+		}
+		tag := f.data[:size]
+		if f.header[0]&0x1F != flvTagVideo || len(tag) < 5 {
+			continue
+		}
+		if tag[0]&0x0F != flvCodecAVC {
+			return nil, false, fmt.Errorf("flv: unexpected video codec %d", tag[0]&0x0F)
+		}
+
+		keyframe := tag[0]>>4 == flvFrameKey
+		payload := tag[5:]
+		switch tag[1] {
+		case flvAVCSequence:
+			n, err := bitstream.NewNormalizer("h264", bitstream.FormatAVCC, payload)
+			if err != nil {
+				return nil, false, fmt.Errorf("flv: %w", err)
+			}
+			f.normalizer = n
+		case flvAVCNALU:
+			if f.normalizer == nil {
+				return nil, false, errors.New("flv: access unit before the decoder configuration")
+			}
+			au, _, err := f.normalizer.Normalize(payload, keyframe)
+			if err != nil {
+				return nil, false, fmt.Errorf("flv: %w", err)
+			}
+			// Converting from length prefixes builds a new buffer, so the
+			// tag buffer can be reused
+			return au, keyframe, nil
+		}
+	}
+}
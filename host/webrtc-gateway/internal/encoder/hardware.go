@@ -0,0 +1,401 @@
+package encoder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	Register("nvenc", func(cfg Config) (Encoder, error) { return newHardwareEncoder("nvenc", cfg) })
+	Register("vaapi", func(cfg Config) (Encoder, error) { return newHardwareEncoder("vaapi", cfg) })
+}
+
+// Hardware encoders run ffmpeg with the GPU's H.264 encoder: NVENC on
+// NVIDIA cards, VA-API on Intel and AMD under Linux. Raw I420 pictures are
+// piped in and FLV read back, one tag per access unit.
+const (
+	// startTimeout bounds process startup and the first picture, which
+	// includes opening the GPU
+	startTimeout = 5 * time.Second
+
+	// restartDelay is how long a process that failed is left before the
+	// next picture starts another
+	restartDelay = time.Second
+
+	// defaultVAAPIDevice is the usual render node of the first GPU
+	defaultVAAPIDevice = "/dev/dri/renderD128"
+)
+
+// hardwareArgs returns the ffmpeg options placed before the input and the
+// encoder options after it, tuned for low latency: no B-frames and no
+// lookahead, so every picture comes out before the next goes in
+func hardwareArgs(name string, cfg Config) (global, codec []string) {
+	gop := strconv.Itoa(cfg.KeyframeInterval)
+	switch name {
+	case "nvenc":
+		codec = []string{"-c:v", "h264_nvenc", "-preset", "p1", "-tune", "ull",
+			"-zerolatency", "1", "-delay", "0", "-bf", "0", "-profile:v", "baseline", "-g", gop}
+		if cfg.Device != "" {
+			codec = append(codec, "-gpu", cfg.Device)
+		}
+		if cfg.BitrateKbps > 0 {
+			codec = append(codec, "-rc", "cbr")
+		}
+	case "vaapi":
+		device := cfg.Device
+		if device == "" {
+			device = defaultVAAPIDevice
+		}
+		global = []string{"-vaapi_device", device}
+		codec = []string{"-vf", "format=nv12,hwupload", "-c:v", "h264_vaapi",
+			"-profile:v", "constrained_baseline", "-bf", "0", "-async_depth", "1", "-g", gop}
+		if cfg.BitrateKbps > 0 {
+			codec = append(codec, "-rc_mode", "CBR")
+		}
+	}
+	if cfg.BitrateKbps > 0 {
+		rate := strconv.Itoa(cfg.BitrateKbps) + "k"
+		codec = append(codec, "-b:v", rate, "-maxrate", rate,
+			"-bufsize", strconv.Itoa(cfg.BitrateKbps/max(cfg.FrameRate, 1)*2)+"k")
+	}
+	return global, codec
+}
+
+var (
+	probesMu sync.Mutex
+	probes   = make(map[string]error) // By backend and device
+)
+
+// probe checks once per backend and device that ffmpeg can encode with
+// it, since ffmpeg lists its hardware encoders whether or not a GPU is
+// present
+func probe(path, name string, cfg Config) error {
+	key := name + "\x00" + cfg.Device
+	probesMu.Lock()
+	defer probesMu.Unlock()
+	if err, ok := probes[key]; ok {
+		return err
+	}
+
+	cfg.Width, cfg.Height, cfg.FrameRate, cfg.KeyframeInterval = 256, 144, 30, 30
+	err := func() error {
+		p, err := startProcess(path, name, cfg)
+		if err != nil {
+			return err
+		}
+		defer p.stop()
+		img := image.NewYCbCr(image.Rect(0, 0, cfg.Width, cfg.Height), image.YCbCrSubsampleRatio420)
+		var picture []byte
+		for i := 0; i < 2; i++ {
+			picture = packI420(picture, img)
+			if err := p.write(int64(i), picture); err != nil {
+				return err
+			}
+		}
+		select {
+		case f := <-p.out:
+			if !f.IsKeyframe {
+				return fmt.Errorf("%s: first picture was not a keyframe", name)
+			}
+			return nil
+		case <-p.done:
+			return p.err
+		case <-time.After(startTimeout):
+			return fmt.Errorf("%s: no output within %s", name, startTimeout)
+		}
+	}()
+	probes[key] = err
+	return err
+}
+
+// hardwareEncoder feeds an ffmpeg process. ffmpeg cannot be told to emit a
+// keyframe mid-stream, so a forced keyframe restarts the process, whose
+// first picture is always an IDR; that costs a few frames' time while the
+// GPU session reopens.
+type hardwareEncoder struct {
+	name  string
+	path  string
+	cfg   Config
+	frame time.Duration // How long to wait for a picture once running
+
+	mu            sync.Mutex
+	proc          *process
+	written       int // Pictures written to the current process
+	forceKeyframe bool
+	failedAt      time.Time
+	failure       error
+	picture       []byte
+	closed        bool
+}
+
+func newHardwareEncoder(name string, cfg Config) (Encoder, error) {
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, fmt.Errorf("%s encoder: ffmpeg not found on PATH", name)
+	}
+	if err := probe(path, name, cfg); err != nil {
+		return nil, fmt.Errorf("%s encoder unavailable: %w", name, err)
+	}
+	e := &hardwareEncoder{
+		name:  name,
+		path:  path,
+		cfg:   cfg,
+		frame: max(3*time.Second/time.Duration(cfg.FrameRate), 100*time.Millisecond),
+	}
+	if e.proc, err = startProcess(path, name, cfg); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Encode writes the picture and waits for the access unit it produces. When
+// the encoder falls behind, the picture's output is returned by a later
+// call and this one returns a frame without data.
+func (e *hardwareEncoder) Encode(img *image.YCbCr, pts int64) (Frame, error) {
+	if img.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return Frame{}, fmt.Errorf("%s encoder requires 4:2:0 input, got %v", e.name, img.SubsampleRatio)
+	}
+	if img.Rect.Dx() != e.cfg.Width || img.Rect.Dy() != e.cfg.Height {
+		return Frame{}, fmt.Errorf("%s encoder configured for %dx%d, got %dx%d",
+			e.name, e.cfg.Width, e.cfg.Height, img.Rect.Dx(), img.Rect.Dy())
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return Frame{}, fmt.Errorf("%s encoder closed", e.name)
+	}
+
+	if e.proc != nil && e.forceKeyframe && e.written > 0 {
+		e.proc.stop()
+		e.proc = nil
+	}
+	if e.proc == nil {
+		if e.failure != nil && time.Since(e.failedAt) < restartDelay {
+			return Frame{}, e.failure
+		}
+		p, err := startProcess(e.path, e.name, e.cfg)
+		if err != nil {
+			return Frame{}, e.fail(err)
+		}
+		e.proc, e.written, e.failure = p, 0, nil
+	}
+	e.forceKeyframe = false
+
+	e.picture = packI420(e.picture, img)
+	if err := e.proc.write(pts, e.picture); err != nil {
+		return Frame{}, e.fail(err)
+	}
+	e.written++
+
+	wait := e.frame
+	if e.written == 1 {
+		wait = startTimeout
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case f := <-e.proc.out:
+		return f, nil
+	case <-e.proc.done:
+		return Frame{}, e.fail(e.proc.err)
+	case <-timer.C:
+		return Frame{PTS: pts}, nil
+	}
+}
+
+// fail drops the current process, so a later picture starts another
+func (e *hardwareEncoder) fail(err error) error {
+	if e.proc != nil {
+		e.proc.stop()
+		e.proc = nil
+	}
+	e.failure, e.failedAt = err, time.Now()
+	return err
+}
+
+// ForceKeyframe makes the next encoded picture an IDR
+func (e *hardwareEncoder) ForceKeyframe() {
+	e.mu.Lock()
+	e.forceKeyframe = true
+	e.mu.Unlock()
+}
+
+// Name returns the backend name
+func (e *hardwareEncoder) Name() string {
+	return e.name
+}
+
+// Close stops the ffmpeg process
+func (e *hardwareEncoder) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+	if e.proc != nil {
+		e.proc.stop()
+		e.proc = nil
+	}
+	return nil
+}
+
+// process is one ffmpeg run. Access units come out in the order pictures
+// went in, so each is matched to its picture's timestamp.
+type process struct {
+	name   string
+	cancel context.CancelFunc
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+
+	mu      sync.Mutex
+	pending []int64 // Timestamps of pictures awaiting output
+
+	out  chan Frame
+	done chan struct{} // Closed once ffmpeg has exited
+	err  error         // Why it exited; set before done is closed
+}
+
+func startProcess(path, name string, cfg Config) (*process, error) {
+	global, codec := hardwareArgs(name, cfg)
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	args = append(args, global...)
+	args = append(args,
+		"-f", "rawvideo", "-pix_fmt", "yuv420p",
+		"-video_size", strconv.Itoa(cfg.Width)+"x"+strconv.Itoa(cfg.Height),
+		"-framerate", strconv.Itoa(cfg.FrameRate), "-i", "pipe:0")
+	args = append(args, codec...)
+	args = append(args, "-fps_mode", "passthrough", "-flush_packets", "1",
+		"-flvflags", "no_duration_filesize", "-f", "flv", "pipe:1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, path, args...)
+	p := &process{
+		name:   name,
+		cancel: cancel,
+		out:    make(chan Frame, 16),
+		done:   make(chan struct{}),
+	}
+	cmd.Stderr = &p.stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("%s: failed to start ffmpeg: %w", name, err)
+	}
+	p.stdin = stdin
+
+	go func() {
+		readErr := p.read(stdout)
+		waitErr := cmd.Wait()
+		if msg := strings.TrimSpace(p.stderr.String()); msg != "" {
+			p.err = fmt.Errorf("%s: %s", name, lastLine(msg))
+		} else if readErr != nil {
+			p.err = fmt.Errorf("%s: %w", name, readErr)
+		} else if waitErr != nil {
+			p.err = fmt.Errorf("%s: ffmpeg exited: %w", name, waitErr)
+		} else {
+			p.err = fmt.Errorf("%s: ffmpeg exited", name)
+		}
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// read hands each access unit to out, dropping it if nobody is waiting for
+// output any more
+func (p *process) read(stdout io.Reader) error {
+	r := newFLVReader(stdout)
+	if err := r.readHeader(); err != nil {
+		io.Copy(io.Discard, stdout)
+		return err
+	}
+	for {
+		data, keyframe, err := r.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			io.Copy(io.Discard, stdout)
+			return err
+		}
+		p.mu.Lock()
+		var pts int64
+		if len(p.pending) > 0 {
+			pts = p.pending[0]
+			p.pending = p.pending[1:]
+		}
+		p.mu.Unlock()
+		select {
+		case p.out <- Frame{Data: data, IsKeyframe: keyframe, PTS: pts}:
+		default:
+		}
+	}
+}
+
+// write sends one picture. ffmpeg reads pictures as they come, so a write
+// still blocked after startTimeout means it has hung and is killed.
+func (p *process) write(pts int64, picture []byte) error {
+	p.mu.Lock()
+	p.pending = append(p.pending, pts)
+	p.mu.Unlock()
+
+	watchdog := time.AfterFunc(startTimeout, p.cancel)
+	_, err := p.stdin.Write(picture)
+	watchdog.Stop()
+	if err != nil {
+		p.stop()
+		return p.err
+	}
+	return nil
+}
+
+// stop ends the process and waits for it to exit
+func (p *process) stop() {
+	p.stdin.Close()
+	p.cancel()
+	<-p.done
+}
+
+// packI420 lays the planes out back to back, as ffmpeg's rawvideo yuv420p
+// expects
+func packI420(dst []byte, img *image.YCbCr) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	cw, ch := (w+1)/2, (h+1)/2
+	dst = dst[:0]
+	for y := 0; y < h; y++ {
+		off := img.YOffset(img.Rect.Min.X, img.Rect.Min.Y+y)
+		dst = append(dst, img.Y[off:off+w]...)
+	}
+	for _, plane := range [][]byte{img.Cb, img.Cr} {
+		for y := 0; y < ch; y++ {
+			off := img.COffset(img.Rect.Min.X, img.Rect.Min.Y+2*y)
+			dst = append(dst, plane[off:off+cw]...)
+		}
+	}
+	return dst
+}
+
+// lastLine returns the last line of ffmpeg's error output, which is usually
+// the one explaining why it stopped
+func lastLine(s string) string {
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[i+1:]
+	}
+	return s
+}
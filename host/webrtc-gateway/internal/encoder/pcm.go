@@ -0,0 +1,215 @@
+package encoder
+
+import (
+	"fmt"
+	"image"
+	"sync"
+)
+
+func init() {
+	Register("pcm", newPCMEncoder)
+}
+
+// pcmEncoder is a dependency-free H.264 encoder that codes every macroblock as
+// I_PCM (raw samples). The output is a valid Constrained Baseline stream any
+// decoder accepts, but it is uncompressed (~12 bits/pixel), so it is only
+// practical for low resolutions, slates, and testing without libx264.
+type pcmEncoder struct {
+	width    int
+	height   int
+	mbWidth  int
+	mbHeight int
+
+	mu       sync.Mutex
+	headers  []byte // SPS + PPS NAL units, sent with every frame
+	idrPicID uint32
+	mb       [384]byte // 256 luma + 64 Cb + 64 Cr samples
+}
+
+// levelLimits maps level_idc to max frame size and throughput in macroblocks
+var levelLimits = []struct {
+	idc    uint32
+	maxFS  int
+	maxMBs int
+}{
+	{30, 1620, 40500},
+	{31, 3600, 108000},
+	{32, 5120, 216000},
+	{40, 8192, 245760},
+	{42, 8704, 522240},
+	{50, 22080, 589824},
+	{51, 36864, 983040},
+	{52, 36864, 2073600},
+}
+
+func newPCMEncoder(cfg Config) (Encoder, error) {
+	e := &pcmEncoder{
+		width:    cfg.Width,
+		height:   cfg.Height,
+		mbWidth:  (cfg.Width + 15) / 16,
+		mbHeight: (cfg.Height + 15) / 16,
+	}
+
+	level := levelLimits[len(levelLimits)-1].idc
+	frameMBs := e.mbWidth * e.mbHeight
+	for _, l := range levelLimits {
+		if frameMBs <= l.maxFS && frameMBs*cfg.FrameRate <= l.maxMBs {
+			level = l.idc
+			break
+		}
+	}
+
+	e.headers = appendNAL(nil, 3, 7, e.buildSPS(level))
+	e.headers = appendNAL(e.headers, 3, 8, e.buildPPS())
+	return e, nil
+}
+
+// buildSPS writes a Constrained Baseline SPS for the configured size
+func (e *pcmEncoder) buildSPS(level uint32) []byte {
+	var w bitWriter
+	w.writeBits(66, 8)    // profile_idc: Baseline
+	w.writeBits(0xC0, 8)  // constraint_set0_flag + constraint_set1_flag, reserved zero bits
+	w.writeBits(level, 8) // level_idc
+	w.writeUE(0)          // seq_parameter_set_id
+	w.writeUE(0)          // log2_max_frame_num_minus4
+	w.writeUE(2)          // pic_order_cnt_type
+	w.writeUE(0)          // max_num_ref_frames
+	w.writeFlag(false)    // gaps_in_frame_num_value_allowed_flag
+	w.writeUE(uint32(e.mbWidth - 1))
+	w.writeUE(uint32(e.mbHeight - 1))
+	w.writeFlag(true) // frame_mbs_only_flag
+	w.writeFlag(true) // direct_8x8_inference_flag
+
+	// Crop to the real size; crop units are 2 luma samples for 4:2:0 frames
+	cropRight := (e.mbWidth*16 - e.width) / 2
+	cropBottom := (e.mbHeight*16 - e.height) / 2
+	if cropRight > 0 || cropBottom > 0 {
+		w.writeFlag(true)
+		w.writeUE(0) // frame_crop_left_offset
+		w.writeUE(uint32(cropRight))
+		w.writeUE(0) // frame_crop_top_offset
+		w.writeUE(uint32(cropBottom))
+	} else {
+		w.writeFlag(false)
+	}
+
+	w.writeFlag(false) // vui_parameters_present_flag
+	return w.trailingBits()
+}
+
+// buildPPS writes a CAVLC PPS with deblocking control enabled
+func (e *pcmEncoder) buildPPS() []byte {
+	var w bitWriter
+	w.writeUE(0)       // pic_parameter_set_id
+	w.writeUE(0)       // seq_parameter_set_id
+	w.writeFlag(false) // entropy_coding_mode_flag (CAVLC)
+	w.writeFlag(false) // bottom_field_pic_order_in_frame_present_flag
+	w.writeUE(0)       // num_slice_groups_minus1
+	w.writeUE(0)       // num_ref_idx_l0_default_active_minus1
+	w.writeUE(0)       // num_ref_idx_l1_default_active_minus1
+	w.writeFlag(false) // weighted_pred_flag
+	w.writeBits(0, 2)  // weighted_bipred_idc
+	w.writeSE(0)       // pic_init_qp_minus26
+	w.writeSE(0)       // pic_init_qs_minus26
+	w.writeSE(0)       // chroma_qp_index_offset
+	w.writeFlag(true)  // deblocking_filter_control_present_flag
+	w.writeFlag(false) // constrained_intra_pred_flag
+	w.writeFlag(false) // redundant_pic_cnt_present_flag
+	return w.trailingBits()
+}
+
+// Encode codes the picture as a single IDR slice of I_PCM macroblocks
+func (e *pcmEncoder) Encode(img *image.YCbCr, pts int64) (Frame, error) {
+	if img.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return Frame{}, fmt.Errorf("pcm encoder requires 4:2:0 input, got %v", img.SubsampleRatio)
+	}
+	if img.Rect.Dx() != e.width || img.Rect.Dy() != e.height {
+		return Frame{}, fmt.Errorf("pcm encoder configured for %dx%d, got %dx%d",
+			e.width, e.height, img.Rect.Dx(), img.Rect.Dy())
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var w bitWriter
+	w.buf = make([]byte, 0, e.mbWidth*e.mbHeight*(len(e.mb)+1)+16)
+
+	// Slice header
+	w.writeUE(0)          // first_mb_in_slice
+	w.writeUE(7)          // slice_type: I (all slices in picture)
+	w.writeUE(0)          // pic_parameter_set_id
+	w.writeBits(0, 4)     // frame_num
+	w.writeUE(e.idrPicID) // idr_pic_id
+	w.writeFlag(false)    // no_output_of_prior_pics_flag
+	w.writeFlag(false)    // long_term_reference_flag
+	w.writeSE(0)          // slice_qp_delta
+	w.writeUE(1)          // disable_deblocking_filter_idc
+
+	// Consecutive IDR pictures must use different idr_pic_id values
+	e.idrPicID = (e.idrPicID + 1) % 2
+
+	// Slice data
+	for mbY := 0; mbY < e.mbHeight; mbY++ {
+		for mbX := 0; mbX < e.mbWidth; mbX++ {
+			w.writeUE(25) // mb_type: I_PCM
+			w.alignZero() // pcm_alignment_zero_bit
+			e.loadMacroblock(img, mbX, mbY)
+			w.writeBytes(e.mb[:])
+		}
+	}
+
+	data := make([]byte, 0, len(e.headers)+len(w.buf)+len(w.buf)/64+16)
+	data = append(data, e.headers...)
+	data = appendNAL(data, 3, 5, w.trailingBits())
+
+	return Frame{Data: data, IsKeyframe: true, PTS: pts}, nil
+}
+
+// loadMacroblock copies one macroblock's samples into e.mb, replicating edge
+// pixels for macroblocks that extend past the picture
+func (e *pcmEncoder) loadMacroblock(img *image.YCbCr, mbX, mbY int) {
+	minX, minY := img.Rect.Min.X, img.Rect.Min.Y
+	maxX, maxY := img.Rect.Max.X-1, img.Rect.Max.Y-1
+
+	i := 0
+	for y := 0; y < 16; y++ {
+		py := min(minY+mbY*16+y, maxY)
+		for x := 0; x < 16; x++ {
+			px := min(minX+mbX*16+x, maxX)
+			e.mb[i] = pcmSample(img.Y[img.YOffset(px, py)])
+			i++
+		}
+	}
+
+	for _, plane := range [][]byte{img.Cb, img.Cr} {
+		for y := 0; y < 8; y++ {
+			py := min(minY+mbY*16+y*2, maxY)
+			for x := 0; x < 8; x++ {
+				px := min(minX+mbX*16+x*2, maxX)
+				e.mb[i] = pcmSample(plane[img.COffset(px, py)])
+				i++
+			}
+		}
+	}
+}
+
+// ForceKeyframe is a no-op: every picture is an IDR
+func (e *pcmEncoder) ForceKeyframe() {}
+
+// Name returns the backend name
+func (e *pcmEncoder) Name() string {
+	return "pcm"
+}
+
+// Close releases nothing; present to satisfy Encoder
+func (e *pcmEncoder) Close() error {
+	return nil
+}
+
+// pcmSample avoids the value 0, which older decoders reject in PCM samples
+func pcmSample(v uint8) uint8 {
+	if v == 0 {
+		return 1
+	}
+	return v
+}
@@ -0,0 +1,168 @@
+//go:build x264 && cgo
+
+package encoder
+
+/*
+#cgo pkg-config: x264
+#include <stdint.h>
+#include <stdlib.h>
+#include <x264.h>
+
+// x264_encoder_open is a macro that embeds the build number, so cgo needs a wrapper
+static x264_t *gateway_x264_open(x264_param_t *param) {
+	return x264_encoder_open(param);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+	"unsafe"
+)
+
+func init() {
+	Register("x264", newX264Encoder)
+}
+
+// x264Encoder wraps libx264 tuned for low latency (zerolatency, no B-frames)
+type x264Encoder struct {
+	width  int
+	height int
+
+	mu            sync.Mutex
+	handle        *C.x264_t
+	picture       C.x264_picture_t
+	forceKeyframe bool
+}
+
+func newX264Encoder(cfg Config) (Encoder, error) {
+	var param C.x264_param_t
+
+	preset := C.CString("veryfast")
+	tune := C.CString("zerolatency")
+	defer C.free(unsafe.Pointer(preset))
+	defer C.free(unsafe.Pointer(tune))
+
+	if C.x264_param_default_preset(&param, preset, tune) < 0 {
+		return nil, errors.New("x264: invalid preset")
+	}
+
+	param.i_csp = C.X264_CSP_I420
+	param.i_width = C.int(cfg.Width)
+	param.i_height = C.int(cfg.Height)
+	param.i_fps_num = C.uint32_t(cfg.FrameRate)
+	param.i_fps_den = 1
+	param.i_keyint_max = C.int(cfg.KeyframeInterval)
+	param.b_repeat_headers = 1
+	param.b_annexb = 1
+	param.i_log_level = C.X264_LOG_ERROR
+
+	if cfg.BitrateKbps > 0 {
+		param.rc.i_rc_method = C.X264_RC_ABR
+		param.rc.i_bitrate = C.int(cfg.BitrateKbps)
+		param.rc.i_vbv_max_bitrate = C.int(cfg.BitrateKbps)
+		param.rc.i_vbv_buffer_size = C.int(cfg.BitrateKbps / max(cfg.FrameRate, 1) * 2)
+	}
+
+	profile := C.CString("baseline")
+	defer C.free(unsafe.Pointer(profile))
+	if C.x264_param_apply_profile(&param, profile) < 0 {
+		return nil, errors.New("x264: failed to apply baseline profile")
+	}
+
+	e := &x264Encoder{width: cfg.Width, height: cfg.Height}
+	if C.x264_picture_alloc(&e.picture, C.X264_CSP_I420, param.i_width, param.i_height) < 0 {
+		return nil, errors.New("x264: failed to allocate picture")
+	}
+
+	e.handle = C.gateway_x264_open(&param)
+	if e.handle == nil {
+		C.x264_picture_clean(&e.picture)
+		return nil, errors.New("x264: failed to open encoder")
+	}
+
+	return e, nil
+}
+
+// Encode copies the planes into the x264 picture and encodes it
+func (e *x264Encoder) Encode(img *image.YCbCr, pts int64) (Frame, error) {
+	if img.SubsampleRatio != image.YCbCrSubsampleRatio420 {
+		return Frame{}, fmt.Errorf("x264 encoder requires 4:2:0 input, got %v", img.SubsampleRatio)
+	}
+	if img.Rect.Dx() != e.width || img.Rect.Dy() != e.height {
+		return Frame{}, fmt.Errorf("x264 encoder configured for %dx%d, got %dx%d",
+			e.width, e.height, img.Rect.Dx(), img.Rect.Dy())
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.handle == nil {
+		return Frame{}, errors.New("x264 encoder closed")
+	}
+
+	copyPlane(&e.picture, 0, img.Y[img.YOffset(img.Rect.Min.X, img.Rect.Min.Y):], img.YStride, e.width, e.height)
+	cOff := img.COffset(img.Rect.Min.X, img.Rect.Min.Y)
+	copyPlane(&e.picture, 1, img.Cb[cOff:], img.CStride, (e.width+1)/2, (e.height+1)/2)
+	copyPlane(&e.picture, 2, img.Cr[cOff:], img.CStride, (e.width+1)/2, (e.height+1)/2)
+
+	e.picture.i_pts = C.int64_t(pts)
+	e.picture.i_type = C.X264_TYPE_AUTO
+	if e.forceKeyframe {
+		e.picture.i_type = C.X264_TYPE_IDR
+		e.forceKeyframe = false
+	}
+
+	var nals *C.x264_nal_t
+	var nalCount C.int
+	var out C.x264_picture_t
+	size := C.x264_encoder_encode(e.handle, &nals, &nalCount, &e.picture, &out)
+	if size < 0 {
+		return Frame{}, errors.New("x264: encode failed")
+	}
+	if size == 0 {
+		// Frame buffered by the encoder (should not happen with zerolatency)
+		return Frame{PTS: pts}, nil
+	}
+
+	// NAL payloads are laid out contiguously starting at the first NAL
+	data := C.GoBytes(unsafe.Pointer(nals.p_payload), size)
+	return Frame{Data: data, IsKeyframe: out.b_keyframe != 0, PTS: pts}, nil
+}
+
+// copyPlane copies a Go plane into the x264 picture plane honoring strides
+func copyPlane(pic *C.x264_picture_t, plane int, src []byte, srcStride, width, height int) {
+	dstStride := int(pic.img.i_stride[plane])
+	dst := unsafe.Slice((*byte)(unsafe.Pointer(pic.img.plane[plane])), dstStride*height)
+	for y := 0; y < height; y++ {
+		copy(dst[y*dstStride:y*dstStride+width], src[y*srcStride:y*srcStride+width])
+	}
+}
+
+// ForceKeyframe makes the next encoded picture an IDR
+func (e *x264Encoder) ForceKeyframe() {
+	e.mu.Lock()
+	e.forceKeyframe = true
+	e.mu.Unlock()
+}
+
+// Name returns the backend name
+func (e *x264Encoder) Name() string {
+	return "x264"
+}
+
+// Close releases the encoder and picture buffers
+func (e *x264Encoder) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.handle != nil {
+		C.x264_encoder_close(e.handle)
+		C.x264_picture_clean(&e.picture)
+		e.handle = nil
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+// Package events provides the gateway's internal event bus. Components
+// publish notable state changes; sinks such as webhooks subscribe to them.
+package events
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+// Type identifies the kind of event
+type Type string
+
+const (
+	StreamStarted     Type = "stream.started"     // Live video began reaching peers
+	StreamStopped     Type = "stream.stopped"     // Live video stopped (source offline or shutdown)
+	StreamPaused      Type = "stream.paused"      // An operator paused the stream
+	StreamResumed     Type = "stream.resumed"     // An operator resumed the stream
+	PeerJoined        Type = "peer.joined"        // A viewer connected
+	PeerLeft          Type = "peer.left"          // A viewer disconnected
+	PeerQuality       Type = "peer.quality"       // A viewer's connection quality level changed
+	PeerState         Type = "peer.state"         // A viewer's connection moved through its lifecycle
+	RecordingStarted  Type = "recording.started"  // A recording began
+	RecordingStopped  Type = "recording.stopped"  // A recording finished
+	MarkerAdded       Type = "marker.added"       // A marker was dropped for clips and recordings
+	HighlightClipped  Type = "highlight.clipped"  // A highlight was detected and saved as a clip
+	SourceSwitched    Type = "source.switched"    // The failover chain changed active source
+	SourceStalled     Type = "source.stalled"     // The video source stopped delivering frames
+	SourceRecovered   Type = "source.recovered"   // Frames resumed after a stall
+	SourceRestarted   Type = "source.restarted"   // The watchdog restarted a stalled source
+	CaptureStarted    Type = "capture.started"    // The supervised capture service was launched
+	CaptureExited     Type = "capture.exited"     // The supervised capture service exited unexpectedly
+	CoHostChanged     Type = "cohost.changed"     // A viewer was made co-host, or the co-host was cleared
+	GameChanged       Type = "game.changed"       // The host started another game or scene
+	DirectorCommand   Type = "director.command"   // A director switched scene or source, or toggled the facecam
+	IPCConnected      Type = "ipc.connected"      // The capture service connected to the IPC socket
+	IPCDisconnected   Type = "ipc.disconnected"   // The capture service disconnected from the IPC socket
+	ResourceLow       Type = "resource.low"       // Disk, memory or CPU crossed a warning or critical threshold
+	ResourceRecovered Type = "resource.recovered" // A resource went back below its thresholds
+)
+
+// Types lists every event type
+var Types = []Type{
+	StreamStarted, StreamStopped, StreamPaused, StreamResumed,
+	PeerJoined, PeerLeft, PeerQuality, PeerState, RecordingStarted, RecordingStopped, MarkerAdded, HighlightClipped,
+	SourceSwitched, SourceStalled, SourceRecovered, SourceRestarted, CaptureStarted, CaptureExited,
+	CoHostChanged, GameChanged, DirectorCommand, IPCConnected, IPCDisconnected, ResourceLow, ResourceRecovered,
+}
+
+// ParseType validates an event type name
+func ParseType(name string) (Type, error) {
+	for _, t := range Types {
+		if string(t) == name {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown event type %q", name)
+}
+
+// Event is a single notification
+type Event struct {
+	ID   string         `json:"id"`
+	Type Type           `json:"type"`
+	Time time.Time      `json:"time"`
+	Data map[string]any `json:"data,omitempty"`
+}
+
+// subscription is one subscriber's queue
+type subscription struct {
+	ch      chan Event
+	types   map[Type]bool // Empty means all types
+	dropped atomic.Uint64
+}
+
+// Bus fans events out to subscribers. Publishing never blocks: a subscriber
+// that falls behind loses events rather than stalling the publisher.
+type Bus struct {
+	logger zerolog.Logger
+
+	mu   sync.RWMutex
+	subs map[*subscription]struct{}
+
+	// Statistics
+	published atomic.Uint64
+}
+
+// NewBus creates an event bus
+func NewBus(logger zerolog.Logger) *Bus {
+	return &Bus{
+		logger: logger.With().Str("component", "event_bus").Logger(),
+		subs:   make(map[*subscription]struct{}),
+	}
+}
+
+// Subscribe returns a channel receiving events of the given types (all types
+// if none are given) and a function that ends the subscription
+func (b *Bus) Subscribe(bufferSize int, types ...Type) (<-chan Event, func()) {
+	if bufferSize <= 0 {
+		bufferSize = 64
+	}
+
+	sub := &subscription{ch: make(chan Event, bufferSize)}
+	if len(types) > 0 {
+		sub.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, sub)
+			b.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+
+	return sub.ch, cancel
+}
+
+// Publish sends an event of type t to all interested subscribers
+func (b *Bus) Publish(t Type, data map[string]any) {
+	event := Event{
+		ID:   uuid.NewString(),
+		Type: t,
+		Time: time.Now().UTC(),
+		Data: data,
+	}
+	b.published.Add(1)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for sub := range b.subs {
+		if sub.types != nil && !sub.types[t] {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			// Log the first drop and then every 100th to avoid flooding
+			if n := sub.dropped.Add(1); n == 1 || n%100 == 0 {
+				b.logger.Warn().
+					Str("event", string(t)).
+					Uint64("dropped", n).
+					Msg("Event subscriber full, dropping event")
+			}
+		}
+	}
+
+	b.logger.Debug().Str("event", string(t)).Interface("data", data).Msg("Event published")
+}
+
+// Published returns the number of events published
+func (b *Bus) Published() uint64 {
+	return b.published.Load()
+}
@@ -0,0 +1,197 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// WebhookConfig configures webhook delivery
+type WebhookConfig struct {
+	URLs       []string
+	Secret     string        // Optional HMAC-SHA256 signing key
+	Types      []Type        // Event types to deliver; empty means all
+	Timeout    time.Duration // Per-request timeout, default 5s
+	MaxRetries int           // Retries after the first attempt, default 3
+}
+
+// WebhookSink POSTs events as JSON to each configured URL. Every URL has its
+// own queue and goroutine, so a slow endpoint does not delay the others and
+// events reach each endpoint in order.
+//
+// Requests carry X-Gateway-Event and X-Gateway-Delivery headers, and when a
+// secret is set, X-Gateway-Signature: sha256=<hex HMAC of the body>.
+type WebhookSink struct {
+	cfg    WebhookConfig
+	bus    *Bus
+	client *http.Client
+	logger zerolog.Logger
+
+	mu      sync.Mutex
+	running bool
+	cancels []func()
+	wg      sync.WaitGroup
+
+	// Statistics
+	delivered atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// NewWebhookSink creates a sink delivering events from bus
+func NewWebhookSink(cfg WebhookConfig, bus *Bus, logger zerolog.Logger) *WebhookSink {
+	// Apply defaults for zero values
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 3
+	}
+
+	return &WebhookSink{
+		cfg:    cfg,
+		bus:    bus,
+		client: &http.Client{Timeout: cfg.Timeout},
+		logger: logger.With().Str("component", "webhook_sink").Logger(),
+	}
+}
+
+// Start subscribes to the bus and begins delivering; returns immediately
+func (w *WebhookSink) Start(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.running {
+		return errors.New("webhook sink already started")
+	}
+	w.running = true
+
+	for _, url := range w.cfg.URLs {
+		events, cancel := w.bus.Subscribe(256, w.cfg.Types...)
+		w.cancels = append(w.cancels, cancel)
+
+		w.wg.Add(1)
+		go func(url string) {
+			defer w.wg.Done()
+			w.deliverLoop(ctx, url, events)
+		}(url)
+	}
+
+	w.logger.Info().Int("endpoints", len(w.cfg.URLs)).Msg("Webhook sink started")
+
+	return nil
+}
+
+// Stop ends the subscriptions and waits for queued events to be delivered
+// or for ctx to expire
+func (w *WebhookSink) Stop(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.running {
+		w.mu.Unlock()
+		return nil
+	}
+	w.running = false
+	cancels := w.cancels
+	w.cancels = nil
+	w.mu.Unlock()
+
+	for _, cancel := range cancels {
+		cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	w.logger.Info().
+		Uint64("delivered", w.delivered.Load()).
+		Uint64("failed", w.failed.Load()).
+		Msg("Webhook sink stopped")
+
+	return nil
+}
+
+// deliverLoop sends events to one URL until the subscription closes
+func (w *WebhookSink) deliverLoop(ctx context.Context, url string, events <-chan Event) {
+	for event := range events {
+		if err := w.deliver(ctx, url, event); err != nil {
+			w.failed.Add(1)
+			w.logger.Warn().
+				Err(err).
+				Str("url", url).
+				Str("event", string(event.Type)).
+				Msg("Webhook delivery failed")
+			continue
+		}
+		w.delivered.Add(1)
+	}
+}
+
+// deliver POSTs one event, retrying with exponential backoff
+func (w *WebhookSink) deliver(ctx context.Context, url string, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	backoff := 500 * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, url, event, body)
+		if err == nil || attempt >= w.cfg.MaxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// post makes a single delivery attempt
+func (w *WebhookSink) post(ctx context.Context, url string, event Event, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gaming-capture-gateway")
+	req.Header.Set("X-Gateway-Event", string(event.Type))
+	req.Header.Set("X-Gateway-Delivery", event.ID)
+	if w.cfg.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.cfg.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Gateway-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
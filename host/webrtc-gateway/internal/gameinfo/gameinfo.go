@@ -0,0 +1,243 @@
+// Package gameinfo relays what the host is playing to viewers: the game,
+// the scene and performance counters a web overlay can render. Changes of
+// game or scene go out at once; counter updates are coalesced so a producer
+// sending every frame does not flood the data channels.
+package gameinfo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// MessageType is the data channel message type of an update, and of a
+// viewer's request for the current info
+const MessageType = "game_info"
+
+// Broadcaster sends a message on every viewer's data channel. The peer
+// manager satisfies it.
+type Broadcaster interface {
+	BroadcastMessage(data []byte) error
+}
+
+// Config configures a tracker
+type Config struct {
+	// Interval is the least time between counter updates, default 1s
+	Interval time.Duration
+}
+
+// Message is the data channel form of an update
+type Message struct {
+	Type string `json:"type"`
+	media.GameInfo
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Stats are tracker counters
+type Stats struct {
+	Game      string  `json:"game,omitempty"`
+	Scene     string  `json:"scene,omitempty"`
+	FPS       float64 `json:"fps,omitempty"`
+	Updates   uint64  `json:"updates"`
+	Broadcast uint64  `json:"broadcast"`
+	Coalesced uint64  `json:"coalesced"`
+	Errors    uint64  `json:"errors"`
+}
+
+// Tracker keeps the latest game info and forwards it to viewers
+type Tracker struct {
+	cfg         Config
+	updates     <-chan media.GameInfo
+	broadcaster Broadcaster
+	logger      zerolog.Logger
+
+	mu       sync.Mutex
+	current  media.GameInfo
+	pending  bool // current has not been broadcast yet
+	lastSent time.Time
+	onChange func(from, to media.GameInfo)
+	running  bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	// Statistics
+	updateCount atomic.Uint64
+	broadcast   atomic.Uint64
+	coalesced   atomic.Uint64
+	errors      atomic.Uint64
+}
+
+// New creates a tracker reading from updates. broadcaster may be nil, in
+// which case viewers only get the info by asking for it.
+func New(cfg Config, updates <-chan media.GameInfo, broadcaster Broadcaster, logger zerolog.Logger) *Tracker {
+	// Apply defaults for zero values
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second
+	}
+
+	return &Tracker{
+		cfg:         cfg,
+		updates:     updates,
+		broadcaster: broadcaster,
+		logger:      logger.With().Str("component", "game_info").Logger(),
+	}
+}
+
+// SetOnChange registers fn to be called when the game or scene changes
+func (t *Tracker) SetOnChange(fn func(from, to media.GameInfo)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.onChange = fn
+}
+
+// Start begins reading updates in the background; returns immediately
+func (t *Tracker) Start(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.running {
+		return errors.New("game info tracker already started")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	t.cancel = cancel
+	t.done = make(chan struct{})
+	t.running = true
+
+	go t.run(runCtx)
+
+	return nil
+}
+
+// Stop stops reading and waits for the goroutine to exit
+func (t *Tracker) Stop() error {
+	t.mu.Lock()
+	if !t.running {
+		t.mu.Unlock()
+		return nil
+	}
+	t.running = false
+	t.cancel()
+	done := t.done
+	t.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+// run is the reading goroutine. The ticker sends the last coalesced
+// update once the interval has passed.
+func (t *Tracker) run(ctx context.Context) {
+	defer close(t.done)
+
+	ticker := time.NewTicker(t.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case info, ok := <-t.updates:
+			if !ok {
+				return
+			}
+			t.Update(info)
+		case <-ticker.C:
+			t.flush(false)
+		}
+	}
+}
+
+// Update records new info. A change of game or scene is sent at once;
+// anything else waits for the interval.
+func (t *Tracker) Update(info media.GameInfo) {
+	if info.ReceivedAt.IsZero() {
+		info.ReceivedAt = time.Now()
+	}
+	t.updateCount.Add(1)
+
+	t.mu.Lock()
+	prev := t.current
+	changed := info.Game != prev.Game || info.Scene != prev.Scene
+	if t.pending {
+		t.coalesced.Add(1)
+	}
+	t.current, t.pending = info, true
+	onChange := t.onChange
+	t.mu.Unlock()
+
+	if changed {
+		t.logger.Info().Str("game", info.Game).Str("scene", info.Scene).Msg("Game changed")
+		if onChange != nil {
+			onChange(prev, info)
+		}
+	}
+	t.flush(changed)
+}
+
+// flush broadcasts the pending update if the interval has passed, or now
+// when force is set
+func (t *Tracker) flush(force bool) {
+	t.mu.Lock()
+	if !t.pending || t.broadcaster == nil ||
+		(!force && time.Since(t.lastSent) < t.cfg.Interval) {
+		t.mu.Unlock()
+		return
+	}
+	t.pending = false
+	t.lastSent = time.Now()
+	msg := t.message()
+	t.mu.Unlock()
+
+	data, _ := json.Marshal(msg)
+	if err := t.broadcaster.BroadcastMessage(data); err != nil {
+		t.errors.Add(1)
+		t.logger.Debug().Err(err).Msg("Failed to broadcast game info")
+		return
+	}
+	t.broadcast.Add(1)
+}
+
+// message builds the data channel form of the current info. Caller holds
+// mu.
+func (t *Tracker) message() Message {
+	return Message{Type: MessageType, GameInfo: t.current, UpdatedAt: t.current.ReceivedAt.UTC()}
+}
+
+// Current returns the latest info; ok is false before the first update
+func (t *Tracker) Current() (info media.GameInfo, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current, !t.current.ReceivedAt.IsZero()
+}
+
+// HandleMessage answers a viewer's request for the current info, so
+// overlays need not wait for the next update after joining. It is a
+// commands.Handler.
+func (t *Tracker) HandleMessage(peerID string, msg []byte) (any, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current.ReceivedAt.IsZero() {
+		return nil, errors.New("no game info yet")
+	}
+	return t.message(), nil
+}
+
+// Stats returns tracker counters
+func (t *Tracker) Stats() Stats {
+	t.mu.Lock()
+	st := Stats{Game: t.current.Game, Scene: t.current.Scene, FPS: t.current.FPS}
+	t.mu.Unlock()
+	st.Updates = t.updateCount.Load()
+	st.Broadcast = t.broadcast.Load()
+	st.Coalesced = t.coalesced.Load()
+	st.Errors = t.errors.Load()
+	return st
+}
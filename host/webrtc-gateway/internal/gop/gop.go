@@ -0,0 +1,337 @@
+// Package gop manages the capture service's keyframe interval. It pushes an
+// operator-chosen target over the IPC control channel and, when many viewers
+// join at once, shortens the interval for a while so each newcomer gets a
+// picture sooner without every join forcing its own keyframe.
+//
+// The control channel speaks in frames, so the frame rate is measured from
+// the stream itself.
+package gop
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Interval limits accepted by SetInterval
+const (
+	MinInterval = 100 * time.Millisecond
+	MaxInterval = time.Minute
+)
+
+// ErrInvalidInterval is returned by SetInterval for out of range values
+var ErrInvalidInterval = errors.New("interval must be 0 or between 100ms and 60s")
+
+// Config configures a controller
+type Config struct {
+	// Interval is the target keyframe interval; zero leaves the producer's
+	Interval time.Duration
+
+	// BurstPeers is how many joins within BurstWindow start a burst; zero
+	// disables bursts
+	BurstPeers int
+
+	// BurstWindow is the span joins are counted over, default 10s
+	BurstWindow time.Duration
+
+	// BurstInterval is the keyframe interval during a burst, default 500ms
+	BurstInterval time.Duration
+
+	// BurstHold is how long a burst lasts after the last join, default 15s
+	BurstHold time.Duration
+
+	// CheckInterval is how often the encoder is checked, default 1s
+	CheckInterval time.Duration
+}
+
+// Status describes the controller
+type Status struct {
+	TargetMs    int64      `json:"target_ms"`    // Zero leaves the producer's
+	EffectiveMs int64      `json:"effective_ms"` // Target, or the burst interval
+	Burst       bool       `json:"burst"`
+	BurstUntil  *time.Time `json:"burst_until,omitempty"`
+	FPS         float64    `json:"fps"`
+	GOPFrames   int        `json:"gop_frames"` // Last value pushed
+	Pushes      uint64     `json:"pushes"`
+	Errors      uint64     `json:"errors"`
+}
+
+// stateReporter is implemented by encoders that report their settings;
+// pushes are then repeated when a restarted producer forgets them
+type stateReporter interface {
+	ControlStats() media.ControlStats
+}
+
+// Controller pushes the keyframe interval to the encoder
+type Controller struct {
+	cfg     Config
+	encoder media.EncoderController
+	logger  zerolog.Logger
+
+	mu         sync.Mutex
+	target     time.Duration
+	joins      []time.Time
+	burstUntil time.Time
+	pushed     int // GOP frames last pushed
+	restore    int // Producer's own GOP frames, to restore after a burst
+	lastPTS    int64
+	frameDur   float64 // Smoothed frame duration in nanoseconds
+	running    bool
+	cancel     context.CancelFunc
+	done       chan struct{}
+	wake       chan struct{}
+
+	// Statistics
+	pushes atomic.Uint64
+	errors atomic.Uint64
+}
+
+// New creates a controller commanding encoder
+func New(cfg Config, encoder media.EncoderController, logger zerolog.Logger) *Controller {
+	// Apply defaults for zero values
+	if cfg.BurstWindow <= 0 {
+		cfg.BurstWindow = 10 * time.Second
+	}
+	if cfg.BurstInterval <= 0 {
+		cfg.BurstInterval = 500 * time.Millisecond
+	}
+	if cfg.BurstHold <= 0 {
+		cfg.BurstHold = 15 * time.Second
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = time.Second
+	}
+
+	return &Controller{
+		cfg:     cfg,
+		encoder: encoder,
+		logger:  logger.With().Str("component", "gop").Logger(),
+		target:  cfg.Interval,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// Start begins managing the interval in the background; returns immediately
+func (c *Controller) Start(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running {
+		return errors.New("gop controller already started")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	c.cancel = cancel
+	c.done = make(chan struct{})
+	c.running = true
+
+	go c.run(runCtx)
+
+	return nil
+}
+
+// Stop stops managing the interval and waits for the goroutine to exit
+func (c *Controller) Stop() error {
+	c.mu.Lock()
+	if !c.running {
+		c.mu.Unlock()
+		return nil
+	}
+	c.running = false
+	c.cancel()
+	done := c.done
+	c.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+// Observe measures the frame rate. It is a media.Distributor tap.
+func (c *Controller) Observe(f media.VideoFrame) {
+	ts := f.PTS
+	if ts <= 0 {
+		ts = f.ReceivedAt.UnixNano()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := float64(ts - c.lastPTS)
+	c.lastPTS = ts
+	if d <= 0 || d > float64(time.Second) {
+		return // First frame, a restart, or a stall
+	}
+	if c.frameDur == 0 {
+		c.frameDur = d
+	} else {
+		c.frameDur += (d - c.frameDur) / 30
+	}
+}
+
+// PeerJoined counts a join towards a burst
+func (c *Controller) PeerJoined() {
+	if c.cfg.BurstPeers <= 0 {
+		return
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	kept := c.joins[:0]
+	for _, t := range c.joins {
+		if now.Sub(t) < c.cfg.BurstWindow {
+			kept = append(kept, t)
+		}
+	}
+	c.joins = append(kept, now)
+	started := false
+	if len(c.joins) >= c.cfg.BurstPeers {
+		started = now.After(c.burstUntil)
+		c.burstUntil = now.Add(c.cfg.BurstHold)
+	}
+	c.mu.Unlock()
+
+	if started {
+		c.logger.Info().Int("joins", c.cfg.BurstPeers).Dur("interval", c.cfg.BurstInterval).Msg("Join burst, shortening keyframe interval")
+	}
+	c.poke()
+}
+
+// SetInterval changes the target interval; zero stops managing it, leaving
+// whatever was last pushed
+func (c *Controller) SetInterval(d time.Duration) error {
+	if d != 0 && (d < MinInterval || d > MaxInterval) {
+		return ErrInvalidInterval
+	}
+	c.mu.Lock()
+	c.target = d
+	c.mu.Unlock()
+	c.logger.Info().Dur("interval", d).Msg("Keyframe interval target set")
+	c.poke()
+	return nil
+}
+
+// Status returns the controller state
+func (c *Controller) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	effective, burst := c.effective(time.Now())
+	st := Status{
+		TargetMs:    c.target.Milliseconds(),
+		EffectiveMs: effective.Milliseconds(),
+		Burst:       burst,
+		GOPFrames:   c.pushed,
+		Pushes:      c.pushes.Load(),
+		Errors:      c.errors.Load(),
+	}
+	if burst {
+		until := c.burstUntil.UTC()
+		st.BurstUntil = &until
+	}
+	if c.frameDur > 0 {
+		st.FPS = math.Round(float64(time.Second)/c.frameDur*10) / 10
+	}
+	return st
+}
+
+// effective returns the interval to apply now. Caller holds mu.
+func (c *Controller) effective(now time.Time) (d time.Duration, burst bool) {
+	if now.Before(c.burstUntil) {
+		if c.target == 0 || c.cfg.BurstInterval < c.target {
+			return c.cfg.BurstInterval, true
+		}
+	}
+	return c.target, false
+}
+
+// poke makes the goroutine check the encoder now
+func (c *Controller) poke() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run is the goroutine that pushes changes
+func (c *Controller) run(ctx context.Context) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-c.wake:
+		}
+		c.check(ctx)
+	}
+}
+
+// check pushes the effective interval when it differs from what was last
+// pushed, or from what the encoder reports
+func (c *Controller) check(ctx context.Context) {
+	var state *media.ControlReply
+	if sr, ok := c.encoder.(stateReporter); ok {
+		st := sr.ControlStats()
+		if !st.Supported {
+			return // The producer has not shown it takes commands
+		}
+		state = st.State
+	}
+
+	c.mu.Lock()
+	interval, burst := c.effective(time.Now())
+	if burst && c.target == 0 && c.restore == 0 && state != nil {
+		c.restore = state.GOPFrames
+	}
+	frameDur, pushed, restore := c.frameDur, c.pushed, c.restore
+	c.mu.Unlock()
+
+	var frames int
+	switch {
+	case interval > 0 && frameDur > 0:
+		frames = max(int(math.Round(float64(interval)/frameDur)), 1)
+	case interval == 0 && restore > 0:
+		// A burst ended with no target: give the producer its own
+		// interval back
+		frames = restore
+	default:
+		return
+	}
+
+	stale := frames != pushed || (state != nil && state.GOPFrames != 0 && state.GOPFrames != frames)
+	if !stale {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	reply, err := c.encoder.Control(ctx, media.ControlCommand{Action: media.ControlSetGOP, GOPFrames: frames})
+	if err != nil {
+		c.errors.Add(1)
+		c.logger.Debug().Err(err).Int("gop_frames", frames).Msg("Failed to set keyframe interval")
+		return
+	}
+	c.pushes.Add(1)
+
+	c.mu.Lock()
+	c.pushed = frames
+	if interval == 0 {
+		c.restore = 0
+	}
+	c.mu.Unlock()
+
+	c.logger.Info().
+		Dur("interval", interval).
+		Int("gop_frames", frames).
+		Int("reported_gop_frames", reply.GOPFrames).
+		Msg("Keyframe interval set")
+}
@@ -0,0 +1,123 @@
+package highlight
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Level time constants: the short-term level follows a burst within a few
+// frames, the background level drifts over seconds
+const (
+	shortWindow = 300 * time.Millisecond
+	longWindow  = 10 * time.Second
+)
+
+// silenceDB is the level assumed for digital silence
+const silenceDB = -90
+
+// AudioSpikeConfig configures an AudioSpike
+type AudioSpikeConfig struct {
+	// ThresholdDB is how far the short-term level must rise above the
+	// background to trigger, default 15
+	ThresholdDB float64
+
+	// FloorDBFS is the least short-term level that triggers, default -35,
+	// so a cough on a silent stream is not a highlight
+	FloorDBFS float64
+
+	// Warmup is how much audio is heard before triggering, default 5s
+	Warmup time.Duration
+}
+
+// AudioSpike flags sudden loud moments, such as an explosion or the
+// streamer shouting, against the recent background level of the main mix
+type AudioSpike struct {
+	cfg AudioSpikeConfig
+
+	short float64 // Mean square level
+	long  float64 // Background level in dB, averaged in dB so a burst does not drag it up
+	heard time.Duration
+	armed bool
+}
+
+// NewAudioSpike creates an audio spike analyzer
+func NewAudioSpike(cfg AudioSpikeConfig) *AudioSpike {
+	// Apply defaults for zero values
+	if cfg.ThresholdDB <= 0 {
+		cfg.ThresholdDB = 15
+	}
+	if cfg.FloorDBFS == 0 {
+		cfg.FloorDBFS = -35
+	}
+	if cfg.Warmup <= 0 {
+		cfg.Warmup = 5 * time.Second
+	}
+	return &AudioSpike{cfg: cfg, armed: true}
+}
+
+// Name identifies the analyzer in triggers
+func (a *AudioSpike) Name() string { return "audio" }
+
+// AnalyzeAudio follows the level of the main mix and triggers when it
+// jumps. It rearms once the level has fallen halfway back.
+func (a *AudioSpike) AnalyzeAudio(f media.AudioFrame) (Trigger, bool) {
+	// Tagged inputs such as the microphone are judged as part of the mix
+	if f.Source != "" || f.SampleRate <= 0 || f.Channels <= 0 || f.SampleCount <= 0 {
+		return Trigger{}, false
+	}
+	n := f.SampleCount * f.Channels
+	if len(f.Data) < n*2 {
+		return Trigger{}, false
+	}
+	if f.Discontinuity {
+		a.heard = 0
+	}
+
+	var sum float64
+	for i := 0; i < n; i++ {
+		v := float64(int16(binary.LittleEndian.Uint16(f.Data[i*2:]))) / 32768
+		sum += v * v
+	}
+	ms := sum / float64(n)
+	d := time.Duration(f.SampleCount) * time.Second / time.Duration(f.SampleRate)
+	if a.heard == 0 {
+		a.short, a.long = ms, decibels(ms)
+	} else {
+		a.short += (ms - a.short) * smoothing(d, shortWindow)
+		a.long += (decibels(a.short) - a.long) * smoothing(d, longWindow)
+	}
+	a.heard += d
+
+	rise := decibels(a.short) - a.long
+	if !a.armed {
+		if rise < a.cfg.ThresholdDB/2 {
+			a.armed = true
+		}
+		return Trigger{}, false
+	}
+	if a.heard < a.cfg.Warmup || rise < a.cfg.ThresholdDB || decibels(a.short) < a.cfg.FloorDBFS {
+		return Trigger{}, false
+	}
+	a.armed = false
+	return Trigger{
+		Reason: fmt.Sprintf("audio spike %+.0f dB", rise),
+		Score:  math.Min(rise/(2*a.cfg.ThresholdDB), 1),
+	}, true
+}
+
+// smoothing is the weight of a sample lasting d in an exponential average
+// over window
+func smoothing(d, window time.Duration) float64 {
+	return 1 - math.Exp(-d.Seconds()/window.Seconds())
+}
+
+func decibels(ms float64) float64 {
+	if ms <= 0 {
+		return silenceDB
+	}
+	return math.Max(10*math.Log10(ms), silenceDB)
+}
@@ -0,0 +1,325 @@
+// Package highlight saves clips of the stream on its own when something
+// worth keeping happens. Analyzers watch the video and audio for moments
+// such as a burst of noise or a cut to a new scene, and game integrations
+// report events from outside; each trigger clips the replay buffer a few
+// seconds later, so the clip holds the lead-up and the moment itself.
+package highlight
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/replay"
+)
+
+// Errors returned by Trigger
+var (
+	ErrTooSoon = errors.New("too soon after the last highlight")
+	ErrStopped = errors.New("highlight detection stopped")
+)
+
+// Clipper saves the last stretch of the stream. replay.Buffer satisfies it.
+type Clipper interface {
+	Save(d time.Duration) (replay.Clip, error)
+}
+
+// Analyzer flags highlight moments. An analyzer also implements
+// VideoAnalyzer, AudioAnalyzer or both to be handed frames.
+type Analyzer interface {
+	Name() string
+}
+
+// VideoAnalyzer inspects encoded video frames. It is called on the
+// distributor goroutine and must not block.
+type VideoAnalyzer interface {
+	Analyzer
+	AnalyzeVideo(f media.VideoFrame) (Trigger, bool)
+}
+
+// AudioAnalyzer inspects PCM audio frames. It is called on the audio router
+// goroutine and must not block.
+type AudioAnalyzer interface {
+	Analyzer
+	AnalyzeAudio(f media.AudioFrame) (Trigger, bool)
+}
+
+// Config configures a detector
+type Config struct {
+	// PreRoll is how much of the stream before a trigger a clip keeps,
+	// default 20s
+	PreRoll time.Duration
+
+	// PostRoll is how long after a trigger the clip is saved, default 5s.
+	// Triggers in the meantime join the same clip.
+	PostRoll time.Duration
+
+	// Cooldown is the least time from saving a clip to the next trigger,
+	// default PreRoll so clips do not overlap
+	Cooldown time.Duration
+
+	// MaxHighlights is how many highlights are listed, default 100
+	MaxHighlights int
+}
+
+// Trigger is a reported highlight moment
+type Trigger struct {
+	Analyzer string    `json:"analyzer"` // Set by the detector for analyzers
+	Reason   string    `json:"reason"`
+	Score    float64   `json:"score,omitempty"` // Strength from 0 to 1, for ranking
+	Time     time.Time `json:"time"`            // Set by the detector
+}
+
+// Highlight is a clip saved for one or more triggers
+type Highlight struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Triggers []Trigger `json:"triggers"`
+	ClipID   string    `json:"clip_id,omitempty"` // Empty until saved
+	Error    string    `json:"error,omitempty"`
+}
+
+// Stats are detector counters
+type Stats struct {
+	Analyzers  []string `json:"analyzers"`
+	Highlights int      `json:"highlights"`
+	Triggers   uint64   `json:"triggers"`
+	Suppressed uint64   `json:"suppressed"` // Triggers during the cooldown
+	Clips      uint64   `json:"clips"`
+	Errors     uint64   `json:"errors"`
+}
+
+// Detector runs analyzers and clips the stream when they trigger
+type Detector struct {
+	cfg     Config
+	clipper Clipper
+	logger  zerolog.Logger
+
+	mu         sync.Mutex
+	video      []VideoAnalyzer
+	audio      []AudioAnalyzer
+	names      []string
+	highlights []Highlight // Oldest first
+	pending    *Highlight
+	timer      *time.Timer
+	lastClip   time.Time
+	stopped    bool
+	saving     sync.WaitGroup // Pending highlights not yet saved
+
+	onTrigger   func(Trigger)
+	onHighlight func(Highlight)
+
+	// Statistics
+	triggers   atomic.Uint64
+	suppressed atomic.Uint64
+	clips      atomic.Uint64
+	errors     atomic.Uint64
+}
+
+// New creates a detector saving clips through clipper
+func New(cfg Config, clipper Clipper, logger zerolog.Logger) *Detector {
+	// Apply defaults for zero values
+	if cfg.PreRoll <= 0 {
+		cfg.PreRoll = 20 * time.Second
+	}
+	if cfg.PostRoll <= 0 {
+		cfg.PostRoll = 5 * time.Second
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = cfg.PreRoll
+	}
+	if cfg.MaxHighlights <= 0 {
+		cfg.MaxHighlights = 100
+	}
+
+	return &Detector{
+		cfg:     cfg,
+		clipper: clipper,
+		logger:  logger.With().Str("component", "highlight").Logger(),
+	}
+}
+
+// Add registers an analyzer. It is handed frames from then on.
+func (d *Detector) Add(a Analyzer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if v, ok := a.(VideoAnalyzer); ok {
+		d.video = append(d.video, v)
+	}
+	if au, ok := a.(AudioAnalyzer); ok {
+		d.audio = append(d.audio, au)
+	}
+	d.names = append(d.names, a.Name())
+}
+
+// SetOnTrigger sets a callback for each trigger accepted, called without
+// locks held before the clip is saved
+func (d *Detector) SetOnTrigger(fn func(Trigger)) {
+	d.mu.Lock()
+	d.onTrigger = fn
+	d.mu.Unlock()
+}
+
+// SetOnHighlight sets a callback for each highlight once its clip is saved
+// or has failed, called without locks held
+func (d *Detector) SetOnHighlight(fn func(Highlight)) {
+	d.mu.Lock()
+	d.onHighlight = fn
+	d.mu.Unlock()
+}
+
+// ObserveVideo hands a frame to the video analyzers. It is a
+// media.Distributor tap.
+func (d *Detector) ObserveVideo(f media.VideoFrame) {
+	d.mu.Lock()
+	analyzers := d.video
+	d.mu.Unlock()
+	for _, a := range analyzers {
+		if t, ok := a.AnalyzeVideo(f); ok {
+			t.Analyzer = a.Name()
+			d.Trigger(t)
+		}
+	}
+}
+
+// ObserveAudio hands a frame to the audio analyzers. It is an audio.Sink.
+func (d *Detector) ObserveAudio(f media.AudioFrame) {
+	d.mu.Lock()
+	analyzers := d.audio
+	d.mu.Unlock()
+	for _, a := range analyzers {
+		if t, ok := a.AnalyzeAudio(f); ok {
+			t.Analyzer = a.Name()
+			d.Trigger(t)
+		}
+	}
+}
+
+// Trigger reports a highlight moment, such as a game event. The clip is
+// saved PostRoll later; a trigger while one is pending joins it.
+func (d *Detector) Trigger(t Trigger) (Highlight, error) {
+	t.Time = time.Now().UTC()
+
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return Highlight{}, ErrStopped
+	}
+	if d.pending == nil {
+		if !d.lastClip.IsZero() && time.Since(d.lastClip) < d.cfg.Cooldown {
+			d.mu.Unlock()
+			d.suppressed.Add(1)
+			d.logger.Debug().Str("analyzer", t.Analyzer).Str("reason", t.Reason).Msg("Highlight suppressed during cooldown")
+			return Highlight{}, ErrTooSoon
+		}
+		var b [6]byte
+		rand.Read(b[:])
+		d.pending = &Highlight{ID: "hl-" + hex.EncodeToString(b[:]), Time: t.Time}
+		d.saving.Add(1)
+		d.timer = time.AfterFunc(d.cfg.PostRoll, d.save)
+	}
+	d.pending.Triggers = append(d.pending.Triggers, t)
+	h := clone(*d.pending)
+	onTrigger := d.onTrigger
+	d.mu.Unlock()
+
+	d.triggers.Add(1)
+	d.logger.Info().Str("highlight_id", h.ID).Str("analyzer", t.Analyzer).Str("reason", t.Reason).
+		Float64("score", t.Score).Msg("Highlight triggered")
+	if onTrigger != nil {
+		onTrigger(t)
+	}
+	return h, nil
+}
+
+// save clips the pending highlight
+func (d *Detector) save() {
+	defer d.saving.Done()
+	d.mu.Lock()
+	h := d.pending
+	d.pending, d.timer = nil, nil
+	if h == nil {
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Unlock()
+
+	clip, err := d.clipper.Save(d.cfg.PreRoll + time.Since(h.Time))
+	if err != nil {
+		d.errors.Add(1)
+		h.Error = err.Error()
+		d.logger.Warn().Err(err).Str("highlight_id", h.ID).Msg("Failed to clip highlight")
+	} else {
+		d.clips.Add(1)
+		h.ClipID = clip.ID
+		d.logger.Info().Str("highlight_id", h.ID).Str("clip_id", clip.ID).Int("triggers", len(h.Triggers)).
+			Msg("Highlight clipped")
+	}
+
+	d.mu.Lock()
+	d.lastClip = time.Now()
+	d.highlights = append(d.highlights, *h)
+	if n := len(d.highlights) - d.cfg.MaxHighlights; n > 0 {
+		d.highlights = append([]Highlight(nil), d.highlights[n:]...)
+	}
+	onHighlight := d.onHighlight
+	d.mu.Unlock()
+
+	if onHighlight != nil {
+		onHighlight(clone(*h))
+	}
+}
+
+// Highlights lists recent highlights, oldest first. One still waiting for
+// its clip is last.
+func (d *Detector) Highlights() []Highlight {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	list := make([]Highlight, 0, len(d.highlights)+1)
+	for _, h := range d.highlights {
+		list = append(list, clone(h))
+	}
+	if d.pending != nil {
+		list = append(list, clone(*d.pending))
+	}
+	return list
+}
+
+// Stop saves a pending highlight at once and ignores later triggers
+func (d *Detector) Stop() {
+	d.mu.Lock()
+	d.stopped = true
+	pending := d.timer != nil && d.timer.Stop()
+	d.mu.Unlock()
+	if pending {
+		d.save()
+	}
+	d.saving.Wait()
+}
+
+// Stats returns detector counters
+func (d *Detector) Stats() Stats {
+	d.mu.Lock()
+	names := append([]string{}, d.names...)
+	n := len(d.highlights)
+	d.mu.Unlock()
+	return Stats{
+		Analyzers:  names,
+		Highlights: n,
+		Triggers:   d.triggers.Load(),
+		Suppressed: d.suppressed.Load(),
+		Clips:      d.clips.Load(),
+		Errors:     d.errors.Load(),
+	}
+}
+
+func clone(h Highlight) Highlight {
+	h.Triggers = append([]Trigger(nil), h.Triggers...)
+	return h
+}
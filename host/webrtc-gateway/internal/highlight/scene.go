@@ -0,0 +1,113 @@
+package highlight
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// sceneWarmup is how many inter frames are averaged before triggering
+const sceneWarmup = 30
+
+// SceneChangeConfig configures a SceneChange
+type SceneChangeConfig struct {
+	// Ratio is how many times the average size an inter frame must be to
+	// count as a new scene, default 4
+	Ratio float64
+
+	// KeyframeRatio is how much a keyframe may differ in size from the one
+	// before, either way, before its picture counts as a new scene,
+	// default 2
+	KeyframeRatio float64
+
+	// Hold is the least time between triggers, default 10s, as a cut is
+	// often followed by more
+	Hold time.Duration
+}
+
+// SceneChange flags cuts to a new scene from the sizes of encoded frames
+// alone, without decoding. An inter frame far larger than usual means the
+// encoder had little to predict it from; a keyframe far from the size of
+// the last one shows a different picture, as periodic keyframes of the
+// same scene come out alike.
+type SceneChange struct {
+	cfg SceneChangeConfig
+
+	avg      float64 // Average inter frame size
+	inter    int
+	keyframe int // Size of the last keyframe, zero before the first
+	last     time.Time
+}
+
+// NewSceneChange creates a scene change analyzer
+func NewSceneChange(cfg SceneChangeConfig) *SceneChange {
+	// Apply defaults for zero values
+	if cfg.Ratio <= 1 {
+		cfg.Ratio = 4
+	}
+	if cfg.KeyframeRatio <= 1 {
+		cfg.KeyframeRatio = 2
+	}
+	if cfg.Hold <= 0 {
+		cfg.Hold = 10 * time.Second
+	}
+	return &SceneChange{cfg: cfg}
+}
+
+// Name identifies the analyzer in triggers
+func (s *SceneChange) Name() string { return "scene" }
+
+// AnalyzeVideo compares a frame's size with those before it
+func (s *SceneChange) AnalyzeVideo(f media.VideoFrame) (Trigger, bool) {
+	size := len(f.Data)
+	if size == 0 {
+		return Trigger{}, false
+	}
+	if f.Discontinuity {
+		// Another stream joined; start over
+		s.avg, s.inter, s.keyframe = 0, 0, 0
+	}
+
+	var ratio float64
+	if f.IsKeyframe {
+		if s.keyframe > 0 {
+			ratio = float64(size) / float64(s.keyframe)
+			if ratio < 1 {
+				ratio = 1 / ratio
+			}
+			if ratio < s.cfg.KeyframeRatio {
+				ratio = 0
+			}
+		}
+		s.keyframe = size
+	} else {
+		if s.inter >= sceneWarmup && float64(size) >= s.avg*s.cfg.Ratio {
+			ratio = float64(size) / s.avg
+		}
+		s.inter++
+		s.avg += (float64(size) - s.avg) / float64(min(s.inter, sceneWarmup))
+	}
+	if ratio == 0 {
+		return Trigger{}, false
+	}
+
+	now := f.ReceivedAt
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if !s.last.IsZero() && now.Sub(s.last) < s.cfg.Hold {
+		return Trigger{}, false
+	}
+	s.last = now
+	kind := "frame"
+	if f.IsKeyframe {
+		kind = "keyframe"
+	}
+	// Cuts are common in play, so they rank below other triggers
+	return Trigger{
+		Reason: fmt.Sprintf("scene change (%s %.1fx)", kind, ratio),
+		Score:  math.Min(ratio/(4*s.cfg.Ratio), 0.5),
+	}, true
+}
@@ -0,0 +1,286 @@
+// Package httpsec is the HTTP hardening layer of the signaling server: CORS
+// with per-route policies and preflight handling, and security headers such
+// as the Content-Security-Policy on every response.
+package httpsec
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy is the cross-origin policy of a route
+type CORSPolicy struct {
+	// AllowedOrigins are exact origins ("https://stream.example.com"),
+	// subdomain wildcards ("https://*.example.com") or "*" for any
+	AllowedOrigins []string
+
+	AllowedMethods   []string // Default GET, POST, PATCH, DELETE, OPTIONS
+	AllowedHeaders   []string // Default Content-Type, Authorization, If-Match; "*" allows any
+	ExposedHeaders   []string // Default Location, ETag, Link
+	AllowCredentials bool     // Send Access-Control-Allow-Credentials
+	MaxAge           time.Duration
+}
+
+// Route applies a policy to paths starting with Prefix
+type Route struct {
+	Prefix string
+	Policy CORSPolicy
+}
+
+// Config configures the middleware
+type Config struct {
+	// CORS is the policy for paths not matched by Routes
+	CORS CORSPolicy
+
+	// Routes override CORS by path prefix; the longest match wins
+	Routes []Route
+
+	// Headers are set on every response. Use DefaultHeaders as a base; an
+	// empty value removes a header.
+	Headers map[string]string
+
+	// HSTSMaxAge enables Strict-Transport-Security on HTTPS requests
+	// (direct TLS or X-Forwarded-Proto: https). Zero disables it.
+	HSTSMaxAge time.Duration
+}
+
+// DefaultCSP allows the viewer portal to load its own scripts and media and
+// to connect back to the gateway, and forbids framing
+const DefaultCSP = "default-src 'self'; script-src 'self'; style-src 'self' 'unsafe-inline'; " +
+	"img-src 'self' data: blob:; media-src 'self' blob:; connect-src 'self'; " +
+	"frame-ancestors 'none'; base-uri 'self'; form-action 'self'"
+
+// DefaultHeaders returns the security headers set when none are configured
+func DefaultHeaders() map[string]string {
+	return map[string]string{
+		"Content-Security-Policy":    DefaultCSP,
+		"X-Content-Type-Options":     "nosniff",
+		"X-Frame-Options":            "DENY",
+		"Referrer-Policy":            "no-referrer",
+		"Cross-Origin-Opener-Policy": "same-origin",
+		// The portal may use the microphone for the return channel
+		"Permissions-Policy": "camera=(), geolocation=(), microphone=(self)",
+	}
+}
+
+// policy is a CORSPolicy prepared for matching
+type policy struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	suffixes    []string // Scheme plus domain suffix of wildcard origins, e.g. "https://" ".example.com"
+	schemes     []string
+	methods     map[string]bool
+	methodsHdr  string
+	anyHeader   bool
+	headers     map[string]bool
+	headersHdr  string
+	exposedHdr  string
+	credentials bool
+	maxAge      string
+}
+
+type route struct {
+	prefix string
+	policy *policy
+}
+
+// Middleware applies cfg to next
+func Middleware(cfg Config, next http.Handler) http.Handler {
+	def := newPolicy(cfg.CORS)
+	routes := make([]route, 0, len(cfg.Routes))
+	for _, r := range cfg.Routes {
+		routes = append(routes, route{prefix: r.Prefix, policy: newPolicy(r.Policy)})
+	}
+	sort.Slice(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+
+	headers := cfg.Headers
+	if headers == nil {
+		headers = DefaultHeaders()
+	}
+	hsts := ""
+	if cfg.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(cfg.HSTSMaxAge/time.Second))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		for name, value := range headers {
+			if value != "" {
+				h.Set(name, value)
+			}
+		}
+		if hsts != "" && (r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https") {
+			h.Set("Strict-Transport-Security", hsts)
+		}
+
+		p := def
+		for _, rt := range routes {
+			if strings.HasPrefix(r.URL.Path, rt.prefix) {
+				p = rt.policy
+				break
+			}
+		}
+
+		origin := r.Header.Get("Origin")
+		h.Add("Vary", "Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowed := p.allows(origin)
+
+		// Preflight
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			if !allowed || !p.methods[r.Header.Get("Access-Control-Request-Method")] {
+				http.Error(w, "cross-origin request not allowed", http.StatusForbidden)
+				return
+			}
+			p.setOrigin(h, origin)
+			h.Set("Access-Control-Allow-Methods", p.methodsHdr)
+			if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+				granted, ok := p.grantHeaders(reqHeaders)
+				if !ok {
+					http.Error(w, "cross-origin request header not allowed", http.StatusForbidden)
+					return
+				}
+				h.Set("Access-Control-Allow-Headers", granted)
+			}
+			if p.maxAge != "" {
+				h.Set("Access-Control-Max-Age", p.maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if !allowed {
+			// Let browsers read nothing, and refuse side effects outright
+			// so the policy also guards against cross-site request forgery
+			if !safeMethod(r.Method) {
+				http.Error(w, "cross-origin request not allowed", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p.setOrigin(h, origin)
+		if p.exposedHdr != "" {
+			h.Set("Access-Control-Expose-Headers", p.exposedHdr)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newPolicy applies defaults and indexes a policy
+func newPolicy(c CORSPolicy) *policy {
+	// Apply defaults for zero values
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete, http.MethodOptions}
+	}
+	if len(c.AllowedHeaders) == 0 {
+		c.AllowedHeaders = []string{"Content-Type", "Authorization", "If-Match"}
+	}
+	if c.ExposedHeaders == nil {
+		c.ExposedHeaders = []string{"Location", "ETag", "Link"}
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = 10 * time.Minute
+	}
+
+	p := &policy{
+		origins:     make(map[string]bool),
+		methods:     make(map[string]bool),
+		headers:     make(map[string]bool),
+		credentials: c.AllowCredentials,
+		exposedHdr:  strings.Join(c.ExposedHeaders, ", "),
+	}
+	if c.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(c.MaxAge / time.Second))
+	}
+	for _, o := range c.AllowedOrigins {
+		o = strings.ToLower(strings.TrimSuffix(o, "/"))
+		switch {
+		case o == "*":
+			p.anyOrigin = true
+		case strings.Contains(o, "://*."):
+			scheme, domain, _ := strings.Cut(o, "://*")
+			p.schemes = append(p.schemes, scheme+"://")
+			p.suffixes = append(p.suffixes, domain)
+		default:
+			p.origins[o] = true
+		}
+	}
+	methods := make([]string, 0, len(c.AllowedMethods))
+	for _, m := range c.AllowedMethods {
+		m = strings.ToUpper(m)
+		p.methods[m] = true
+		methods = append(methods, m)
+	}
+	p.methodsHdr = strings.Join(methods, ", ")
+	headers := make([]string, 0, len(c.AllowedHeaders))
+	for _, hd := range c.AllowedHeaders {
+		if hd == "*" {
+			p.anyHeader = true
+			continue
+		}
+		hd = http.CanonicalHeaderKey(hd)
+		p.headers[hd] = true
+		headers = append(headers, hd)
+	}
+	p.headersHdr = strings.Join(headers, ", ")
+	return p
+}
+
+// allows reports whether origin may make cross-origin requests
+func (p *policy) allows(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for i, suffix := range p.suffixes {
+		if strings.HasPrefix(origin, p.schemes[i]) && strings.HasSuffix(origin, suffix) &&
+			len(origin) > len(p.schemes[i])+len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// setOrigin echoes the origin, or "*" for a public policy without
+// credentials, which lets shared caches reuse the response
+func (p *policy) setOrigin(h http.Header, origin string) {
+	if p.anyOrigin && !p.credentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if p.credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// grantHeaders checks the headers a preflight asks for
+func (p *policy) grantHeaders(requested string) (string, bool) {
+	if p.anyHeader {
+		return requested, true
+	}
+	for _, hd := range strings.Split(requested, ",") {
+		hd = http.CanonicalHeaderKey(strings.TrimSpace(hd))
+		if hd != "" && !p.headers[hd] {
+			return "", false
+		}
+	}
+	return p.headersHdr, true
+}
+
+func safeMethod(m string) bool {
+	return m == http.MethodGet || m == http.MethodHead || m == http.MethodOptions
+}
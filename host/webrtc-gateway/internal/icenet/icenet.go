@@ -0,0 +1,336 @@
+// Package icenet configures how the gateway's ICE agents use the network:
+// which UDP ports they bind and which addresses they advertise. It builds
+// the pion SettingEngine the peer manager creates peer connections with, and
+// owns any shared sockets.
+//
+// With a UDP mux every viewer shares one port, so a home router needs a
+// single port-forwarding rule. Behind a 1:1 NAT the public address can be
+// advertised instead of, or alongside, the private one.
+//
+// For viewers behind firewalls that block UDP entirely, ICE-TCP accepts
+// passive TCP candidates on one port, and TURN servers (including
+// turns: URLs, TURN over TLS on 443 or 5349) provide relay candidates.
+//
+// Candidates are gathered on IPv4 and IPv6 by default. IPv6 can be
+// disabled, or preferred: pion has no address family preference, so
+// PreferIPv6 is applied by rewriting candidate priorities in local
+// descriptions with AdjustSDP.
+package icenet
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/stun/v3"
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog"
+)
+
+// Config configures ICE networking. The zero value leaves pion's defaults:
+// a random ephemeral port per peer and local addresses only.
+type Config struct {
+	// UDPPort multiplexes all ICE UDP traffic on this port. 0 disables the
+	// mux; PortMin and PortMax then limit the ephemeral ports used.
+	UDPPort int
+
+	PortMin uint16
+	PortMax uint16
+
+	// NAT1To1IPs are public addresses of a 1:1 NAT, either "public" or
+	// "public/private" to map one local address
+	NAT1To1IPs []string
+
+	// NAT1To1Candidate is "host" to advertise the public addresses in place
+	// of local ones, or "srflx" to add them as server reflexive candidates.
+	// Default "host".
+	NAT1To1Candidate string
+
+	// TCPPort accepts ICE-TCP connections on this port. 0 disables ICE-TCP.
+	TCPPort int
+
+	// TURNURLs are TURN servers used for relay candidates, e.g.
+	// "turn:turn.example.com:3478?transport=udp" or
+	// "turns:turn.example.com:5349?transport=tcp" for TURN over TLS
+	TURNURLs       []string
+	TURNUsername   string
+	TURNCredential string
+
+	// IPv6 is IPv6Enable (default), IPv6Prefer or IPv6Disable
+	IPv6 string
+}
+
+// IPv6 modes
+const (
+	IPv6Enable  = "enable"  // Gather IPv4 and IPv6 candidates
+	IPv6Prefer  = "prefer"  // Gather both and rank IPv6 first
+	IPv6Disable = "disable" // Gather IPv4 candidates only
+)
+
+// Info describes the active ICE networking setup
+type Info struct {
+	UDPPort          int      `json:"udp_port,omitempty"`
+	PortMin          uint16   `json:"port_min,omitempty"`
+	PortMax          uint16   `json:"port_max,omitempty"`
+	NAT1To1IPs       []string `json:"nat_1to1_ips,omitempty"`
+	NAT1To1Candidate string   `json:"nat_1to1_candidate,omitempty"`
+	TCPPort          int      `json:"tcp_port,omitempty"`
+	TURNURLs         []string `json:"turn_urls,omitempty"`
+	IPv6             string   `json:"ipv6"`
+}
+
+// Transport holds the ICE settings and the sockets shared by every peer
+// connection
+type Transport struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	mu      sync.Mutex
+	udpMux  *ice.MultiUDPMuxDefault
+	tcpMux  ice.TCPMux
+	setting webrtc.SettingEngine
+	closed  bool
+}
+
+// New validates cfg and opens any shared sockets; call Close on shutdown
+func New(cfg Config, logger zerolog.Logger) (*Transport, error) {
+	// Apply defaults for zero values
+	if cfg.NAT1To1Candidate == "" {
+		cfg.NAT1To1Candidate = "host"
+	}
+	if cfg.IPv6 == "" {
+		cfg.IPv6 = IPv6Enable
+	}
+
+	t := &Transport{
+		cfg:    cfg,
+		logger: logger.With().Str("component", "icenet").Logger(),
+	}
+
+	switch {
+	case cfg.UDPPort < 0 || cfg.UDPPort > 65535:
+		return nil, fmt.Errorf("invalid ICE UDP port %d", cfg.UDPPort)
+	case cfg.UDPPort != 0 && (cfg.PortMin != 0 || cfg.PortMax != 0):
+		return nil, errors.New("an ICE UDP mux port and an ephemeral port range are mutually exclusive")
+	case cfg.TCPPort < 0 || cfg.TCPPort > 65535:
+		return nil, fmt.Errorf("invalid ICE TCP port %d", cfg.TCPPort)
+	case cfg.IPv6 != IPv6Enable && cfg.IPv6 != IPv6Prefer && cfg.IPv6 != IPv6Disable:
+		return nil, fmt.Errorf("invalid IPv6 mode %q (want enable, prefer or disable)", cfg.IPv6)
+	}
+	ipv6 := cfg.IPv6 != IPv6Disable
+
+	for _, raw := range cfg.TURNURLs {
+		u, err := stun.ParseURI(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TURN URL %q: %w", raw, err)
+		}
+		if u.Scheme != stun.SchemeTypeTURN && u.Scheme != stun.SchemeTypeTURNS {
+			return nil, fmt.Errorf("TURN URL %q must use turn: or turns:", raw)
+		}
+	}
+	if len(cfg.TURNURLs) > 0 && (cfg.TURNUsername == "" || cfg.TURNCredential == "") {
+		return nil, errors.New("TURN servers need a username and credential")
+	}
+
+	if cfg.PortMin != 0 || cfg.PortMax != 0 {
+		if err := t.setting.SetEphemeralUDPPortRange(cfg.PortMin, cfg.PortMax); err != nil || cfg.PortMin == 0 {
+			return nil, fmt.Errorf("invalid ICE port range %d-%d", cfg.PortMin, cfg.PortMax)
+		}
+	}
+
+	if len(cfg.NAT1To1IPs) > 0 {
+		candidateType, err := parseCandidateType(cfg.NAT1To1Candidate)
+		if err != nil {
+			return nil, err
+		}
+		for _, mapping := range cfg.NAT1To1IPs {
+			if err := validateMapping(mapping); err != nil {
+				return nil, err
+			}
+		}
+		t.setting.SetNAT1To1IPs(cfg.NAT1To1IPs, candidateType)
+	}
+
+	networks := []webrtc.NetworkType{webrtc.NetworkTypeUDP4}
+	muxNetworks := []ice.NetworkType{ice.NetworkTypeUDP4}
+	if ipv6 {
+		networks = append(networks, webrtc.NetworkTypeUDP6)
+		muxNetworks = append(muxNetworks, ice.NetworkTypeUDP6)
+	}
+
+	if cfg.UDPPort != 0 {
+		mux, err := ice.NewMultiUDPMuxFromPort(cfg.UDPPort, ice.UDPMuxFromPortWithNetworks(muxNetworks...))
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on ICE UDP port %d: %w", cfg.UDPPort, err)
+		}
+		t.udpMux = mux
+		t.setting.SetICEUDPMux(mux)
+		t.logger.Info().Int("port", cfg.UDPPort).Msg("ICE UDP mux listening")
+	}
+
+	if cfg.TCPPort != 0 {
+		network := "tcp"
+		if !ipv6 {
+			network = "tcp4"
+		}
+		listener, err := net.Listen(network, fmt.Sprintf(":%d", cfg.TCPPort))
+		if err != nil {
+			t.Close()
+			return nil, fmt.Errorf("failed to listen on ICE TCP port %d: %w", cfg.TCPPort, err)
+		}
+		t.tcpMux = webrtc.NewICETCPMux(nil, listener, 8)
+		t.setting.SetICETCPMux(t.tcpMux)
+		networks = append(networks, webrtc.NetworkTypeTCP4)
+		if ipv6 {
+			networks = append(networks, webrtc.NetworkTypeTCP6)
+		}
+		t.logger.Info().Int("port", cfg.TCPPort).Msg("ICE-TCP listening")
+	}
+	t.setting.SetNetworkTypes(networks)
+
+	return t, nil
+}
+
+// ICEServers returns the TURN servers for the peer manager's configuration;
+// signaling may offer the same list to viewers
+func (t *Transport) ICEServers() []webrtc.ICEServer {
+	if len(t.cfg.TURNURLs) == 0 {
+		return []webrtc.ICEServer{}
+	}
+	return []webrtc.ICEServer{{
+		URLs:           t.cfg.TURNURLs,
+		Username:       t.cfg.TURNUsername,
+		Credential:     t.cfg.TURNCredential,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	}}
+}
+
+// SettingEngine returns the settings for new peer connections
+func (t *Transport) SettingEngine() webrtc.SettingEngine {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.setting
+}
+
+// Info describes the active setup
+func (t *Transport) Info() Info {
+	info := Info{
+		UDPPort:  t.cfg.UDPPort,
+		PortMin:  t.cfg.PortMin,
+		PortMax:  t.cfg.PortMax,
+		TCPPort:  t.cfg.TCPPort,
+		TURNURLs: t.cfg.TURNURLs,
+		IPv6:     t.cfg.IPv6,
+	}
+	if len(t.cfg.NAT1To1IPs) > 0 {
+		info.NAT1To1IPs = t.cfg.NAT1To1IPs
+		info.NAT1To1Candidate = t.cfg.NAT1To1Candidate
+	}
+	return info
+}
+
+// Close releases shared sockets; peer connections using them stop receiving
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+
+	var err error
+	if t.udpMux != nil {
+		err = t.udpMux.Close()
+	}
+	if t.tcpMux != nil {
+		if tcpErr := t.tcpMux.Close(); err == nil {
+			err = tcpErr
+		}
+	}
+	return err
+}
+
+// AdjustSDP applies address family preference to the candidates of a
+// local session description. It returns sdp unchanged unless IPv6 is
+// preferred; then IPv6 candidates get the highest local preference and
+// IPv4 candidates of the same type rank below them.
+func (t *Transport) AdjustSDP(sdp string) string {
+	if t.cfg.IPv6 != IPv6Prefer {
+		return sdp
+	}
+	lines := strings.Split(sdp, "\n")
+	for i, line := range lines {
+		if adjusted, ok := preferIPv6(line); ok {
+			lines[i] = adjusted
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// preferIPv6 rewrites the priority of one a=candidate line. The priority is
+// (2^24)*type preference + (2^8)*local preference + (256 - component); the
+// type preference is kept so relays still rank below direct paths.
+func preferIPv6(line string) (string, bool) {
+	body, ok := strings.CutPrefix(strings.TrimSuffix(line, "\r"), "a=candidate:")
+	if !ok {
+		return line, false
+	}
+	// foundation component transport priority address port typ ...
+	fields := strings.Fields(body)
+	if len(fields) < 8 {
+		return line, false
+	}
+	priority, err := strconv.ParseUint(fields[3], 10, 32)
+	if err != nil {
+		return line, false
+	}
+	ip := net.ParseIP(fields[4])
+	if ip == nil {
+		return line, false
+	}
+
+	typePref := priority >> 24
+	localPref := (priority >> 8) & 0xFFFF
+	component := priority & 0xFF
+	if ip.To4() == nil {
+		localPref = 0xFFFF
+	} else {
+		localPref /= 2
+	}
+	fields[3] = strconv.FormatUint(typePref<<24|localPref<<8|component, 10)
+
+	adjusted := "a=candidate:" + strings.Join(fields, " ")
+	if strings.HasSuffix(line, "\r") {
+		adjusted += "\r"
+	}
+	return adjusted, true
+}
+
+// parseCandidateType maps a NAT1To1Candidate name
+func parseCandidateType(name string) (webrtc.ICECandidateType, error) {
+	switch strings.ToLower(name) {
+	case "host":
+		return webrtc.ICECandidateTypeHost, nil
+	case "srflx":
+		return webrtc.ICECandidateTypeSrflx, nil
+	default:
+		return 0, fmt.Errorf("invalid NAT 1:1 candidate type %q (want host or srflx)", name)
+	}
+}
+
+// validateMapping checks a "public" or "public/private" address mapping
+func validateMapping(mapping string) error {
+	public, private, mapped := strings.Cut(mapping, "/")
+	if net.ParseIP(public) == nil {
+		return fmt.Errorf("invalid NAT 1:1 address %q", public)
+	}
+	if mapped && net.ParseIP(private) == nil {
+		return fmt.Errorf("invalid NAT 1:1 local address %q", private)
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+// Package invite mints shareable, time-limited invite links. Each invite has
+// a secret token embedded in its URL; signaling redeems the token before
+// creating a peer, and the peer is attributed to the invite for stats.
+//
+// Invites are held in memory and are lost on restart. Only a hash of each
+// token is kept, so a token is shown once, when the invite is created.
+package invite
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Errors returned by Admit
+var (
+	ErrRequired  = errors.New("an invite is required")
+	ErrInvalid   = errors.New("invite not found")
+	ErrExpired   = errors.New("invite expired")
+	ErrExhausted = errors.New("invite has no uses left")
+	ErrRevoked   = errors.New("invite revoked")
+)
+
+// QueryParam is the URL query parameter carrying the token
+const QueryParam = "invite"
+
+// expiredRetention is how long expired invites stay listed before removal
+const expiredRetention = 24 * time.Hour
+
+// Config configures the invite store
+type Config struct {
+	// BaseURL is the viewer portal URL the token is appended to, e.g.
+	// "https://stream.example.com/"
+	BaseURL string
+
+	// Required rejects peers without a valid invite; otherwise invites only
+	// attribute peers
+	Required bool
+
+	DefaultTTL time.Duration // Lifetime when none is requested, default 24h
+	MaxTTL     time.Duration // Longest lifetime allowed, default 30 days
+}
+
+// Invite is one invite link. Token and URL are only set in the result of
+// Create.
+type Invite struct {
+	ID        string    `json:"id"`
+	Label     string    `json:"label,omitempty"`
+	Token     string    `json:"token,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	MaxUses   int       `json:"max_uses"` // 0 is unlimited
+	Uses      int       `json:"uses"`
+	Peers     int       `json:"peers"` // Currently connected peers admitted by it
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// Stats are invite counters
+type Stats struct {
+	Invites  int    `json:"invites"`
+	Admitted uint64 `json:"admitted"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// entry is a stored invite
+type entry struct {
+	Invite
+	peers map[string]bool
+}
+
+// Store holds invites and which peers each admitted
+type Store struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	mu      sync.Mutex
+	byHash  map[string]*entry // Token hash to invite
+	byID    map[string]*entry
+	peerInv map[string]*entry // Peer to the invite that admitted it
+
+	// Statistics
+	admitted atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// NewStore creates an empty invite store
+func NewStore(cfg Config, logger zerolog.Logger) *Store {
+	// Apply defaults for zero values
+	if cfg.DefaultTTL <= 0 {
+		cfg.DefaultTTL = 24 * time.Hour
+	}
+	if cfg.MaxTTL <= 0 {
+		cfg.MaxTTL = 30 * 24 * time.Hour
+	}
+
+	return &Store{
+		cfg:     cfg,
+		logger:  logger.With().Str("component", "invites").Logger(),
+		byHash:  make(map[string]*entry),
+		byID:    make(map[string]*entry),
+		peerInv: make(map[string]*entry),
+	}
+}
+
+// Required reports whether peers need an invite
+func (s *Store) Required() bool {
+	return s.cfg.Required
+}
+
+// Create mints an invite valid for ttl (the default if zero) and maxUses
+// peers (0 for unlimited). The result carries the token and shareable URL.
+func (s *Store) Create(label string, ttl time.Duration, maxUses int) (Invite, error) {
+	if ttl <= 0 {
+		ttl = s.cfg.DefaultTTL
+	}
+	if ttl > s.cfg.MaxTTL {
+		return Invite{}, errors.New("ttl exceeds the maximum invite lifetime")
+	}
+	if maxUses < 0 {
+		return Invite{}, errors.New("max_uses must not be negative")
+	}
+
+	token := randomToken(24)
+	now := time.Now()
+	e := &entry{
+		Invite: Invite{
+			ID:        randomToken(6),
+			Label:     label,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+			MaxUses:   maxUses,
+		},
+		peers: make(map[string]bool),
+	}
+
+	s.mu.Lock()
+	s.prune(now)
+	s.byHash[hashToken(token)] = e
+	s.byID[e.ID] = e
+	s.mu.Unlock()
+
+	s.logger.Info().Str("invite_id", e.ID).Str("label", label).
+		Time("expires_at", e.ExpiresAt).Int("max_uses", maxUses).Msg("Invite created")
+
+	inv := e.Invite
+	inv.Token = token
+	inv.URL = s.link(token)
+	return inv, nil
+}
+
+// List returns all invites, newest first, without tokens
+func (s *Store) List() []Invite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.prune(time.Now())
+	list := make([]Invite, 0, len(s.byID))
+	for _, e := range s.byID {
+		list = append(list, e.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Revoke stops an invite admitting new peers; connected peers stay. It
+// reports false if there is no such invite.
+func (s *Store) Revoke(id string) bool {
+	s.mu.Lock()
+	e, ok := s.byID[id]
+	if ok {
+		e.Revoked = true
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.logger.Info().Str("invite_id", id).Msg("Invite revoked")
+	}
+	return ok
+}
+
+// Admit redeems token for peerID, consuming one use. An empty token is
+// accepted when invites are not required. Admitting the same peer again,
+// e.g. on renegotiation, does not consume another use.
+func (s *Store) Admit(token, peerID string) error {
+	err := s.admit(token, peerID)
+	if err != nil {
+		s.rejected.Add(1)
+		s.logger.Info().Err(err).Str("peer_id", peerID).Msg("Peer rejected")
+		return err
+	}
+	return nil
+}
+
+func (s *Store) admit(token, peerID string) error {
+	if token == "" {
+		if s.cfg.Required {
+			return ErrRequired
+		}
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.byHash[hashToken(token)]
+	switch {
+	case !ok:
+		return ErrInvalid
+	case e.Revoked:
+		return ErrRevoked
+	case time.Now().After(e.ExpiresAt):
+		return ErrExpired
+	case e.peers[peerID]:
+		// A peer reconnecting on its own invite does not use it again
+		return nil
+	case e.MaxUses > 0 && e.Uses >= e.MaxUses:
+		return ErrExhausted
+	}
+
+	e.Uses++
+	e.peers[peerID] = true
+	s.peerInv[peerID] = e
+	s.admitted.Add(1)
+	return nil
+}
+
+// InviteFor returns the ID of the invite that admitted peerID, or ""
+func (s *Store) InviteFor(peerID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.peerInv[peerID]; ok {
+		return e.ID
+	}
+	return ""
+}
+
+// Remove forgets a peer's attribution; call when a peer leaves. The use it
+// consumed is not returned.
+func (s *Store) Remove(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.peerInv[peerID]; ok {
+		delete(e.peers, peerID)
+		delete(s.peerInv, peerID)
+	}
+}
+
+// Attribution returns connected peers keyed by invite ID
+func (s *Store) Attribution() map[string][]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := make(map[string][]string)
+	for peerID, e := range s.peerInv {
+		out[e.ID] = append(out[e.ID], peerID)
+	}
+	for _, peers := range out {
+		sort.Strings(peers)
+	}
+	return out
+}
+
+// Stats returns invite counters
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	n := len(s.byID)
+	s.mu.Unlock()
+	return Stats{
+		Invites:  n,
+		Admitted: s.admitted.Load(),
+		Rejected: s.rejected.Load(),
+	}
+}
+
+// prune drops invites expired for longer than expiredRetention that no
+// connected peer still references. Caller holds mu.
+func (s *Store) prune(now time.Time) {
+	for hash, e := range s.byHash {
+		if len(e.peers) == 0 && now.Sub(e.ExpiresAt) > expiredRetention {
+			delete(s.byHash, hash)
+			delete(s.byID, e.ID)
+		}
+	}
+}
+
+// link builds the shareable URL for token
+func (s *Store) link(token string) string {
+	return Link(s.cfg.BaseURL, token)
+}
+
+// Link appends token to base, a viewer portal or signaling URL. An empty
+// base gives a bare query string.
+func Link(base, token string) string {
+	if base == "" {
+		return "?" + QueryParam + "=" + token
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return strings.TrimSuffix(base, "/") + "/?" + QueryParam + "=" + token
+	}
+	q := u.Query()
+	q.Set(QueryParam, token)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// snapshot copies the public fields. Caller holds mu.
+func (e *entry) snapshot() Invite {
+	inv := e.Invite
+	inv.Peers = len(e.peers)
+	return inv
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,202 @@
+package logging
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// PeerIDHeader carries a viewer's peer ID on signaling requests and on the
+// response to its offer
+const PeerIDHeader = "X-Peer-ID"
+
+// AccessSettings control the access log; they can be changed at runtime
+type AccessSettings struct {
+	Enabled bool `json:"enabled"`
+
+	// SampleRate is the fraction of successful requests logged (0 to 1).
+	// Failed and slow requests are always logged.
+	SampleRate float64 `json:"sample_rate"`
+
+	// SlowMs is the duration above which a request counts as slow; 0
+	// disables the distinction
+	SlowMs int `json:"slow_ms"`
+}
+
+// AccessConfig configures an access log
+type AccessConfig struct {
+	AccessSettings
+
+	// QuietPaths are path prefixes, such as health checks, logged only when
+	// they fail
+	QuietPaths []string
+}
+
+// AccessStats are access log counters
+type AccessStats struct {
+	AccessSettings
+	Logged  uint64 `json:"logged"`
+	Skipped uint64 `json:"skipped"` // Sampled out or on a quiet path
+}
+
+// AccessLog logs one structured line per HTTP request: method, path,
+// status, response size, duration and, when known, the peer ID
+type AccessLog struct {
+	logger     zerolog.Logger
+	quietPaths []string
+	settings   atomic.Pointer[AccessSettings]
+
+	// Statistics
+	logged  atomic.Uint64
+	skipped atomic.Uint64
+}
+
+// NewAccessLog creates an access log
+func NewAccessLog(cfg AccessConfig, logger zerolog.Logger) (*AccessLog, error) {
+	a := &AccessLog{
+		logger:     logger.With().Str("component", "access_log").Logger(),
+		quietPaths: cfg.QuietPaths,
+	}
+	if err := a.Update(cfg.AccessSettings); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Settings returns the current settings
+func (a *AccessLog) Settings() AccessSettings {
+	return *a.settings.Load()
+}
+
+// Update replaces the settings; requests in flight use the new ones
+func (a *AccessLog) Update(s AccessSettings) error {
+	if s.SampleRate < 0 || s.SampleRate > 1 {
+		return errors.New("sample rate must be between 0 and 1")
+	}
+	if s.SlowMs < 0 {
+		return errors.New("slow threshold cannot be negative")
+	}
+	a.settings.Store(&s)
+	return nil
+}
+
+// Stats returns the settings and counters
+func (a *AccessLog) Stats() AccessStats {
+	return AccessStats{
+		AccessSettings: a.Settings(),
+		Logged:         a.logged.Load(),
+		Skipped:        a.skipped.Load(),
+	}
+}
+
+// Middleware logs the requests next serves, tagged with component. It is
+// cheap while the log is disabled, so it can stay installed.
+func (a *AccessLog) Middleware(component string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.settings.Load().Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+
+		// Settings may have changed while the request was served
+		s := a.settings.Load()
+		if !s.Enabled {
+			a.skipped.Add(1)
+			return
+		}
+		failed := rec.status >= 400
+		slow := s.SlowMs > 0 && elapsed >= time.Duration(s.SlowMs)*time.Millisecond
+		if !failed && !slow && (a.quiet(r.URL.Path) || rand.Float64() >= s.SampleRate) {
+			a.skipped.Add(1)
+			return
+		}
+		a.logged.Add(1)
+
+		event := a.logger.Info()
+		if rec.status >= 500 {
+			event = a.logger.Warn()
+		}
+		event = event.
+			Str("server", component).
+			Str("method", r.Method).
+			Str("path", r.URL.Path).
+			Int("status", rec.status).
+			Int64("bytes", rec.bytes).
+			Float64("duration_ms", float64(elapsed.Microseconds())/1000).
+			Str("remote_addr", r.RemoteAddr)
+		if peerID := peerID(r, rec); peerID != "" {
+			event = event.Str("peer_id", peerID)
+		}
+		if slow {
+			event = event.Bool("slow", true)
+		}
+		event.Msg("HTTP request")
+	})
+}
+
+// quiet reports whether path is only logged on failure
+func (a *AccessLog) quiet(path string) bool {
+	for _, prefix := range a.quietPaths {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerID finds the viewer a request belongs to: sent by the viewer, or
+// assigned in the response to its offer
+func peerID(r *http.Request, rec *accessRecorder) string {
+	if id := r.Header.Get(PeerIDHeader); id != "" {
+		return id
+	}
+	if id := r.URL.Query().Get("peer_id"); id != "" {
+		return id
+	}
+	return rec.Header().Get(PeerIDHeader)
+}
+
+// accessRecorder captures the response status and size
+type accessRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (r *accessRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *accessRecorder) Write(p []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes through to the underlying writer for streaming responses
+func (r *accessRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (r *accessRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// SummaryWindow is how long a Summarizer counts repeats of a warning before
+// logging a summary line
+const SummaryWindow = 10 * time.Second
+
+// summaryBurst is a warning repeating within the current window
+type summaryBurst struct {
+	repeats uint64 // Occurrences since the last line logged
+	timer   *time.Timer
+}
+
+// Summarizer rate-limits repeated warnings, such as a frame dropped at
+// every frame of a stalled consumer. The first occurrence of a message is
+// logged as is; repeats within SummaryWindow are counted and logged as one
+// line, "N more in the last 10s", when the window ends. A burst ends after
+// a window without repeats, and the next occurrence is logged in full again.
+type Summarizer struct {
+	logger zerolog.Logger
+
+	mu     sync.Mutex
+	bursts map[string]*summaryBurst // By message
+
+	// Statistics
+	suppressed atomic.Uint64
+}
+
+// NewSummarizer creates a summarizer logging to logger
+func NewSummarizer(logger zerolog.Logger) *Summarizer {
+	return &Summarizer{
+		logger: logger,
+		bursts: make(map[string]*summaryBurst),
+	}
+}
+
+// Warn logs msg at warn level, or counts it toward the next summary. fields,
+// when set, adds fields to the line; it is not called for repeats.
+func (s *Summarizer) Warn(msg string, fields func(e *zerolog.Event)) {
+	s.mu.Lock()
+	if b, ok := s.bursts[msg]; ok {
+		b.repeats++
+		s.mu.Unlock()
+		s.suppressed.Add(1)
+		return
+	}
+	b := &summaryBurst{}
+	b.timer = time.AfterFunc(SummaryWindow, func() { s.summarize(msg, b) })
+	s.bursts[msg] = b
+	s.mu.Unlock()
+
+	ev := s.logger.Warn()
+	if fields != nil {
+		fields(ev)
+	}
+	ev.Msg(msg)
+}
+
+// Suppressed returns the number of warnings counted into summaries
+func (s *Summarizer) Suppressed() uint64 {
+	return s.suppressed.Load()
+}
+
+// summarize logs the repeats of msg in the window just ended, and ends the
+// burst when there were none
+func (s *Summarizer) summarize(msg string, b *summaryBurst) {
+	s.mu.Lock()
+	repeats := b.repeats
+	if repeats == 0 {
+		delete(s.bursts, msg)
+		s.mu.Unlock()
+		return
+	}
+	b.repeats = 0
+	b.timer.Reset(SummaryWindow)
+	s.mu.Unlock()
+
+	s.logger.Warn().
+		Uint64("repeats", repeats).
+		Dur("window", SummaryWindow).
+		Msgf("%s (%d more in the last %s)", msg, repeats, SummaryWindow)
+}
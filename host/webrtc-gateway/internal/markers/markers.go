@@ -0,0 +1,240 @@
+// Package markers records moments users flag during a session, such as a
+// clutch play to find again later. A marker is dropped through the admin
+// API or by a viewer's hotkey over the data channel, and is pinned to the
+// stream's own clock so clips and recordings cut from that stretch of the
+// stream carry it as a chapter.
+package markers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/mp4"
+)
+
+// MessageType is the data channel message type viewers drop a marker with:
+// {"type": "marker", "label": "..."}. The reply is the marker.
+const MessageType = "marker"
+
+// Errors returned by Store
+var (
+	ErrNoStream = errors.New("no video to mark yet")
+	ErrTooSoon  = errors.New("too soon after the last marker")
+	ErrNotFound = errors.New("marker not found")
+)
+
+// maxLabel is the longest label kept, in bytes
+const maxLabel = 100
+
+// Config configures a store
+type Config struct {
+	// MaxMarkers is how many markers are kept; the oldest are dropped.
+	// Default 1000.
+	MaxMarkers int
+
+	// Cooldown is the least time between a viewer's markers, default 2s;
+	// markers from the API are not limited
+	Cooldown time.Duration
+}
+
+// Marker is a flagged moment
+type Marker struct {
+	ID     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Label  string    `json:"label,omitempty"`
+	PeerID string    `json:"peer_id,omitempty"` // Empty when dropped through the API
+
+	ts int64 // Stream timestamp, as replay.Frame.TS
+}
+
+// Stats are store counters
+type Stats struct {
+	Markers  int    `json:"markers"`
+	Added    uint64 `json:"added"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// Store keeps recent markers
+type Store struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	// Timestamp of the newest frame, and when it arrived
+	lastTS atomic.Int64
+	lastAt atomic.Int64
+
+	mu      sync.Mutex
+	markers []Marker // Oldest first
+	last    map[string]time.Time
+	onAdd   func(Marker)
+
+	// Statistics
+	added    atomic.Uint64
+	rejected atomic.Uint64
+}
+
+// New creates an empty store
+func New(cfg Config, logger zerolog.Logger) *Store {
+	// Apply defaults for zero values
+	if cfg.MaxMarkers <= 0 {
+		cfg.MaxMarkers = 1000
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = 2 * time.Second
+	}
+
+	return &Store{
+		cfg:    cfg,
+		logger: logger.With().Str("component", "markers").Logger(),
+		last:   make(map[string]time.Time),
+	}
+}
+
+// Observe follows the stream's clock. It is a media.Distributor tap.
+func (s *Store) Observe(f media.VideoFrame) {
+	ts := f.PTS
+	if ts <= 0 {
+		ts = f.ReceivedAt.UnixNano()
+	}
+	s.lastTS.Store(ts)
+	s.lastAt.Store(f.ReceivedAt.UnixNano())
+}
+
+// SetOnAdd sets a callback for each marker added, called without locks
+// held
+func (s *Store) SetOnAdd(fn func(Marker)) {
+	s.mu.Lock()
+	s.onAdd = fn
+	s.mu.Unlock()
+}
+
+// Add drops a marker at the current point of the stream. peerID is the
+// viewer dropping it, or empty for the API.
+func (s *Store) Add(label, peerID string) (Marker, error) {
+	ts := s.lastTS.Load()
+	if ts == 0 {
+		s.rejected.Add(1)
+		return Marker{}, ErrNoStream
+	}
+	// Place the marker between frames when it comes while one is awaited
+	now := time.Now()
+	if at := s.lastAt.Load(); at > 0 {
+		ts += min(max(now.UnixNano()-at, 0), int64(time.Second))
+	}
+
+	label = strings.TrimSpace(label)
+	for len(label) > maxLabel {
+		_, size := utf8.DecodeLastRuneInString(label)
+		label = label[:len(label)-size]
+	}
+
+	var b [6]byte
+	rand.Read(b[:])
+	m := Marker{ID: "mark-" + hex.EncodeToString(b[:]), Time: now.UTC(), Label: label, PeerID: peerID, ts: ts}
+
+	s.mu.Lock()
+	if peerID != "" {
+		if last, ok := s.last[peerID]; ok && now.Sub(last) < s.cfg.Cooldown {
+			s.mu.Unlock()
+			s.rejected.Add(1)
+			return Marker{}, ErrTooSoon
+		}
+		s.last[peerID] = now
+	}
+	s.markers = append(s.markers, m)
+	if n := len(s.markers) - s.cfg.MaxMarkers; n > 0 {
+		s.markers = append([]Marker(nil), s.markers[n:]...)
+	}
+	onAdd := s.onAdd
+	s.mu.Unlock()
+
+	s.added.Add(1)
+	s.logger.Info().Str("marker_id", m.ID).Str("label", label).Str("peer_id", peerID).Msg("Marker added")
+	if onAdd != nil {
+		onAdd(m)
+	}
+	return m, nil
+}
+
+// List returns the markers kept, oldest first
+func (s *Store) List() []Marker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Marker(nil), s.markers...)
+}
+
+// Delete removes a marker, so clips saved after no longer carry it
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, m := range s.markers {
+		if m.ID == id {
+			s.markers = append(s.markers[:i:i], s.markers[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Chapters returns the markers between stream timestamps from and to as
+// chapters starting from from. Unlabelled markers are numbered.
+func (s *Store) Chapters(from, to int64) []mp4.Chapter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var chapters []mp4.Chapter
+	for _, m := range s.markers {
+		if m.ts < from || m.ts > to {
+			continue
+		}
+		title := m.Label
+		if title == "" {
+			title = fmt.Sprintf("Marker %d", len(chapters)+1)
+		}
+		chapters = append(chapters, mp4.Chapter{Start: time.Duration(m.ts - from), Title: title})
+	}
+	return chapters
+}
+
+// RemovePeer forgets a departed viewer's cooldown
+func (s *Store) RemovePeer(peerID string) {
+	s.mu.Lock()
+	delete(s.last, peerID)
+	s.mu.Unlock()
+}
+
+// HandleMessage drops a marker for a viewer. It is a commands.Handler.
+func (s *Store) HandleMessage(peerID string, msg []byte) (any, error) {
+	var req struct {
+		Label string `json:"label"`
+	}
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return nil, err
+	}
+	m, err := s.Add(req.Label, peerID)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Type string `json:"type"`
+		Marker
+	}{MessageType, m}, nil
+}
+
+// Stats returns store counters
+func (s *Store) Stats() Stats {
+	s.mu.Lock()
+	n := len(s.markers)
+	s.mu.Unlock()
+	return Stats{Markers: n, Added: s.added.Load(), Rejected: s.rejected.Load()}
+}
@@ -0,0 +1,200 @@
+// Package audio handles multichannel PCM from the capture service: mixing
+// of tagged sources such as game audio and a microphone, stereo downmixing
+// for WebRTC, which browsers play as at most two channels, and routing of
+// the untouched surround signal to outputs that keep it.
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Mode selects how channels beyond the front pair are folded into stereo
+type Mode int
+
+const (
+	// ModeITU mixes centre and surrounds into the front pair at -3 dB per
+	// ITU-R BS.775 and drops LFE, normalised so the mix cannot clip
+	ModeITU Mode = iota
+
+	// ModeFront keeps the front left and right channels and discards the rest
+	ModeFront
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeITU:
+		return "itu"
+	case ModeFront:
+		return "front"
+	default:
+		return fmt.Sprintf("Mode(%d)", int(m))
+	}
+}
+
+// ParseMode parses a downmix mode name; empty selects ModeITU
+func ParseMode(s string) (Mode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "itu":
+		return ModeITU, nil
+	case "front":
+		return ModeFront, nil
+	default:
+		return 0, fmt.Errorf("unknown downmix mode %q", s)
+	}
+}
+
+// minus3dB is the ITU-R BS.775 gain for centre and surround channels
+const minus3dB = 0.7071
+
+// Channel positions, in WAVE/SMPTE order as CoreAudio delivers them
+const (
+	posL = iota
+	posR
+	posC
+	posLFE
+	posLs
+	posRs
+	posLb
+	posRb
+)
+
+// layouts maps a channel count to the position of each channel
+var layouts = map[int][]int{
+	3: {posL, posR, posC},
+	4: {posL, posR, posLs, posRs},
+	5: {posL, posR, posC, posLs, posRs},
+	6: {posL, posR, posC, posLFE, posLs, posRs},
+	8: {posL, posR, posC, posLFE, posLs, posRs, posLb, posRb},
+}
+
+// LayoutName returns a display name for a channel count
+func LayoutName(channels int) string {
+	switch channels {
+	case 1:
+		return "mono"
+	case 2:
+		return "stereo"
+	case 6:
+		return "5.1"
+	case 8:
+		return "7.1"
+	default:
+		return fmt.Sprintf("%dch", channels)
+	}
+}
+
+// Downmixer converts interleaved 16-bit PCM of any channel count to stereo.
+// Mixing matrices are built once per channel count.
+type Downmixer struct {
+	mode     Mode
+	matrices map[int]*matrix
+}
+
+// matrix holds each input channel's gain into the left and right outputs
+type matrix struct {
+	left  []float64
+	right []float64
+}
+
+// NewDownmixer creates a downmixer using mode
+func NewDownmixer(mode Mode) *Downmixer {
+	return &Downmixer{mode: mode, matrices: make(map[int]*matrix)}
+}
+
+// Downmix returns frame as stereo. Stereo frames are returned unchanged and
+// mono is copied to both channels. Not safe for concurrent use.
+func (d *Downmixer) Downmix(frame media.AudioFrame) (media.AudioFrame, error) {
+	channels := frame.Channels
+	if channels < 1 {
+		return media.AudioFrame{}, errors.New("audio frame has no channels")
+	}
+	if channels == 2 {
+		return frame, nil
+	}
+
+	samples := len(frame.Data) / (2 * channels)
+	if samples*2*channels != len(frame.Data) {
+		return media.AudioFrame{}, fmt.Errorf("audio frame length %d is not a multiple of %d channels", len(frame.Data), channels)
+	}
+
+	m := d.matrix(channels)
+	out := make([]byte, samples*4)
+	in := frame.Data
+	for i := 0; i < samples; i++ {
+		var l, r float64
+		for ch := 0; ch < channels; ch++ {
+			v := float64(int16(binary.LittleEndian.Uint16(in[(i*channels+ch)*2:])))
+			l += v * m.left[ch]
+			r += v * m.right[ch]
+		}
+		binary.LittleEndian.PutUint16(out[i*4:], uint16(clamp16(l)))
+		binary.LittleEndian.PutUint16(out[i*4+2:], uint16(clamp16(r)))
+	}
+
+	frame.Channels = 2
+	frame.SampleCount = samples
+	frame.Data = out
+	return frame, nil
+}
+
+// matrix returns the mixing matrix for a channel count
+func (d *Downmixer) matrix(channels int) *matrix {
+	if m, ok := d.matrices[channels]; ok {
+		return m
+	}
+
+	m := &matrix{left: make([]float64, channels), right: make([]float64, channels)}
+	layout, known := layouts[channels]
+	switch {
+	case channels == 1:
+		m.left[0], m.right[0] = 1, 1
+	case d.mode == ModeFront || !known:
+		// Unknown layouts only have a dependable front pair
+		m.left[0], m.right[1] = 1, 1
+	default:
+		for ch, pos := range layout {
+			switch pos {
+			case posL:
+				m.left[ch] = 1
+			case posR:
+				m.right[ch] = 1
+			case posC:
+				m.left[ch], m.right[ch] = minus3dB, minus3dB
+			case posLs, posLb:
+				m.left[ch] = minus3dB
+			case posRs, posRb:
+				m.right[ch] = minus3dB
+			}
+		}
+		normalize(m.left)
+		normalize(m.right)
+	}
+
+	d.matrices[channels] = m
+	return m
+}
+
+// normalize scales gains to sum to one so a full-scale mix cannot clip
+func normalize(gains []float64) {
+	var sum float64
+	for _, g := range gains {
+		sum += g
+	}
+	if sum <= 1 {
+		return
+	}
+	for i := range gains {
+		gains[i] /= sum
+	}
+}
+
+// clamp16 rounds v to the int16 range
+func clamp16(v float64) int16 {
+	return int16(max(math.MinInt16, min(math.MaxInt16, math.Round(v))))
+}
@@ -0,0 +1,307 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Loudness measurement, after EBU R128 / ITU-R BS.1770
+const (
+	loudnessBlock  = 100 * time.Millisecond // Energy is summed per block
+	loudnessWindow = 30                     // Blocks in the short-term (3s) window
+	absoluteGate   = -70.0                  // LUFS below which audio counts as silence
+	relativeGate   = 20.0                   // dB under the target below which the gain holds
+)
+
+// Gain slew rates, in dB per second. Loud content is pulled down quickly so
+// a title switch does not blast viewers; quiet content is raised slowly.
+const (
+	gainFallRate = 10.0
+	gainRiseRate = 2.0
+)
+
+// LoudnessConfig configures loudness normalization
+type LoudnessConfig struct {
+	TargetLUFS float64       // Short-term loudness aimed for, e.g. -16
+	CeilingDB  float64       // Limiter ceiling in dBFS, default -1
+	MaxBoostDB float64       // Most gain applied to quiet audio, default 12
+	MaxCutDB   float64       // Most attenuation applied to loud audio, default 30
+	Lookahead  time.Duration // Limiter lookahead, default 5ms; delays the audio by as much
+}
+
+// LoudnessStats describe the normalizer
+type LoudnessStats struct {
+	TargetLUFS   float64 `json:"target_lufs"`
+	LoudnessLUFS float64 `json:"loudness_lufs"` // Short-term loudness of the input
+	GainDB       float64 `json:"gain_db"`       // Normalization gain
+	LimitingDB   float64 `json:"limiting_db"`   // Current limiter gain reduction
+	Limited      uint64  `json:"limited"`       // Frames the limiter reduced
+}
+
+// biquad is a second-order IIR section in direct form I
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// kWeighting returns the BS.1770 pre-filter (high shelf) and RLB high-pass
+// for a sample rate
+func kWeighting(rate int) (shelf, highpass biquad) {
+	fs := float64(rate)
+
+	f0, gain, q := 1681.974450955533, 3.999843853973347, 0.7071752369554196
+	k := math.Tan(math.Pi * f0 / fs)
+	vh := math.Pow(10, gain/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1 + k/q + k*k
+	shelf = biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+
+	f0, q = 38.13547087602444, 0.5003270373238773
+	k = math.Tan(math.Pi * f0 / fs)
+	a0 = 1 + k/q + k*k
+	highpass = biquad{
+		b0: 1, b1: -2, b2: 1,
+		a1: 2 * (k*k - 1) / a0,
+		a2: (1 - k/q + k*k) / a0,
+	}
+	return shelf, highpass
+}
+
+// gainNeed is the gain one sample needs to stay under the ceiling
+type gainNeed struct {
+	at   int64
+	gain float64
+}
+
+// Normalizer brings audio to a target loudness and limits its peaks. The
+// gain follows the short-term loudness slowly enough not to pump; the
+// limiter catches what the gain has not caught up with. Process is not safe
+// for concurrent use; Stats is.
+type Normalizer struct {
+	cfg LoudnessConfig
+
+	// Per-stream state, reset when the format changes
+	rate     int
+	channels int
+	filters  [][2]biquad // K-weighting per channel
+	blockLen int         // Samples per measurement block
+	blockPos int
+	blockSum float64
+	blocks   []float64 // Mean square of recent blocks, oldest first
+	gainDB   float64
+
+	// Limiter
+	delay   []float64 // Lookahead delay line, interleaved
+	delayAt int
+	delayN  int        // Lookahead in samples
+	needs   []gainNeed // Lowest gains needed within the lookahead, ascending in time and gain
+	clock   int64      // Samples processed
+	env     float64
+	attack  float64 // Per-sample attack coefficient
+	release float64 // Per-sample release coefficient
+
+	// Statistics, as float64 bits where fractional
+	loudness atomic.Uint64
+	gain     atomic.Uint64
+	limiting atomic.Uint64
+	limited  atomic.Uint64
+}
+
+// NewNormalizer creates a normalizer
+func NewNormalizer(cfg LoudnessConfig) *Normalizer {
+	// Apply defaults for zero values
+	if cfg.CeilingDB == 0 {
+		cfg.CeilingDB = -1
+	}
+	if cfg.MaxBoostDB <= 0 {
+		cfg.MaxBoostDB = 12
+	}
+	if cfg.MaxCutDB <= 0 {
+		cfg.MaxCutDB = 30
+	}
+	if cfg.Lookahead <= 0 {
+		cfg.Lookahead = 5 * time.Millisecond
+	}
+
+	n := &Normalizer{cfg: cfg}
+	n.loudness.Store(math.Float64bits(math.Inf(-1)))
+	return n
+}
+
+// Process normalizes one frame of 16-bit PCM. Output is delayed by the
+// lookahead, so the frame's PTS is moved back to match.
+func (n *Normalizer) Process(frame media.AudioFrame) (media.AudioFrame, error) {
+	channels := frame.Channels
+	if channels < 1 || len(frame.Data)%(2*channels) != 0 {
+		return media.AudioFrame{}, errors.New("malformed audio frame")
+	}
+	rate := frame.SampleRate
+	if rate <= 0 {
+		rate = 48000
+	}
+	if rate != n.rate || channels != n.channels {
+		n.reset(rate, channels)
+	}
+
+	samples := len(frame.Data) / (2 * channels)
+	out := make([]byte, len(frame.Data))
+	ceiling := dbToGain(n.cfg.CeilingDB) * 32767
+	reduced := false
+	minEnv := 1.0
+
+	for i := 0; i < samples; i++ {
+		// Measure the input
+		var energy float64
+		for ch := 0; ch < channels; ch++ {
+			x := float64(int16(binary.LittleEndian.Uint16(frame.Data[(i*channels+ch)*2:]))) / 32768
+			y := n.filters[ch][1].process(n.filters[ch][0].process(x))
+			energy += y * y
+		}
+		n.blockSum += energy
+		if n.blockPos++; n.blockPos == n.blockLen {
+			n.endBlock()
+		}
+
+		// Apply the gain and find what the limiter needs for this sample
+		g := dbToGain(n.gainDB)
+		var peak float64
+		at := n.delayAt * channels
+		for ch := 0; ch < channels; ch++ {
+			x := float64(int16(binary.LittleEndian.Uint16(frame.Data[(i*channels+ch)*2:]))) * g
+			delayed := n.delay[at+ch]
+			n.delay[at+ch] = x
+			peak = max(peak, math.Abs(x))
+			// The sample leaving the delay line is limited; the clamp
+			// catches what the envelope has not quite reached
+			binary.LittleEndian.PutUint16(out[(i*channels+ch)*2:], uint16(clamp16(max(-ceiling, min(ceiling, delayed*n.env)))))
+		}
+		n.delayAt = (n.delayAt + 1) % n.delayN
+
+		need := 1.0
+		if peak > ceiling {
+			need = ceiling / peak
+		}
+		lowest := n.lowest(need)
+
+		// The envelope falls towards the lowest gain needed within the
+		// lookahead, reaching it about when the peak leaves the delay
+		// line, and recovers slowly
+		if lowest < n.env {
+			n.env += (lowest - n.env) * n.attack
+		} else {
+			n.env += (lowest - n.env) * n.release
+		}
+		if n.env < 0.999 {
+			reduced = true
+		}
+		minEnv = min(minEnv, n.env)
+	}
+
+	if reduced {
+		n.limited.Add(1)
+	}
+	n.limiting.Store(math.Float64bits(-gainToDB(minEnv)))
+
+	frame.Data = out
+	frame.SampleCount = samples
+	frame.PTS -= int64(n.delayN) * int64(time.Second) / int64(rate)
+	return frame, nil
+}
+
+// Stats returns the normalizer state
+func (n *Normalizer) Stats() LoudnessStats {
+	loudness := math.Float64frombits(n.loudness.Load())
+	if math.IsInf(loudness, -1) {
+		loudness = absoluteGate
+	}
+	return LoudnessStats{
+		TargetLUFS:   n.cfg.TargetLUFS,
+		LoudnessLUFS: math.Round(loudness*10) / 10,
+		GainDB:       math.Round(math.Float64frombits(n.gain.Load())*10) / 10,
+		LimitingDB:   math.Round(math.Float64frombits(n.limiting.Load())*10) / 10,
+		Limited:      n.limited.Load(),
+	}
+}
+
+// endBlock closes a measurement block and moves the gain towards the
+// target
+func (n *Normalizer) endBlock() {
+	meanSquare := n.blockSum / float64(n.blockLen)
+	n.blockSum, n.blockPos = 0, 0
+	if len(n.blocks) == loudnessWindow {
+		n.blocks = append(n.blocks[:0], n.blocks[1:]...)
+	}
+	n.blocks = append(n.blocks, meanSquare)
+
+	var sum float64
+	for _, ms := range n.blocks {
+		sum += ms
+	}
+	loudness := -0.691 + 10*math.Log10(sum/float64(len(n.blocks)))
+	n.loudness.Store(math.Float64bits(loudness))
+
+	// Hold the gain through silence and quiet passages rather than
+	// boosting room noise
+	if loudness < absoluteGate || loudness < n.cfg.TargetLUFS-relativeGate {
+		return
+	}
+	want := max(-n.cfg.MaxCutDB, min(n.cfg.MaxBoostDB, n.cfg.TargetLUFS-loudness))
+	step := loudnessBlock.Seconds()
+	if want < n.gainDB {
+		n.gainDB = max(want, n.gainDB-gainFallRate*step)
+	} else {
+		n.gainDB = min(want, n.gainDB+gainRiseRate*step)
+	}
+	n.gain.Store(math.Float64bits(n.gainDB))
+}
+
+// reset starts measuring a new stream format. The gain is kept so a
+// format change does not jump the level.
+func (n *Normalizer) reset(rate, channels int) {
+	n.rate, n.channels = rate, channels
+	n.filters = make([][2]biquad, channels)
+	for ch := range n.filters {
+		shelf, highpass := kWeighting(rate)
+		n.filters[ch] = [2]biquad{shelf, highpass}
+	}
+	n.blockLen = int(int64(rate) * int64(loudnessBlock) / int64(time.Second))
+	n.blockPos, n.blockSum, n.blocks = 0, 0, nil
+
+	n.delayN = max(1, int(int64(rate)*int64(n.cfg.Lookahead)/int64(time.Second)))
+	n.delay = make([]float64, n.delayN*channels)
+	n.delayAt, n.needs, n.env = 0, nil, 1
+	n.attack = min(1, 4/float64(n.delayN))
+	n.release = 1 - math.Exp(-1/(0.05*float64(rate))) // 50ms
+}
+
+// lowest records the gain the newest sample needs and returns the lowest
+// needed by any sample still in the delay line
+func (n *Normalizer) lowest(need float64) float64 {
+	n.clock++
+	for len(n.needs) > 0 && n.needs[len(n.needs)-1].gain >= need {
+		n.needs = n.needs[:len(n.needs)-1]
+	}
+	n.needs = append(n.needs, gainNeed{at: n.clock, gain: need})
+	for n.needs[0].at <= n.clock-int64(n.delayN) {
+		n.needs = n.needs[1:]
+	}
+	return n.needs[0].gain
+}
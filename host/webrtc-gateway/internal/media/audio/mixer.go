@@ -0,0 +1,771 @@
+package audio
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Gain limits accepted by SetGain and ParseMixSources
+const (
+	MinGainDB = -60.0
+	MaxGainDB = 20.0
+)
+
+// maxMixInputs bounds the sources a producer can introduce by tagging frames
+const maxMixInputs = 8
+
+// Mixer timing
+const (
+	fallbackBlock = 20 * time.Millisecond  // Output block while the clock source is silent
+	clockTimeout  = 250 * time.Millisecond // Clock silence before the timer takes over
+	duckAttack    = 20 * time.Millisecond  // Time constant of the gain falling into a duck
+	duckRelease   = 250 * time.Millisecond // Time constant of the gain recovering
+)
+
+// Errors returned by Mixer setters
+var (
+	ErrUnknownSource = errors.New("unknown audio source")
+	ErrInvalidGain   = fmt.Errorf("gain must be between %g and %g dB", MinGainDB, MaxGainDB)
+)
+
+// MixSource configures one mixer input
+type MixSource struct {
+	Name   string
+	GainDB float64
+	Muted  bool
+}
+
+// ParseMixSources parses "name[:gain_db]" entries, e.g. "game" and "mic:-6"
+func ParseMixSources(list []string) ([]MixSource, error) {
+	sources := make([]MixSource, 0, len(list))
+	seen := make(map[string]bool)
+	for _, entry := range list {
+		name, gain, hasGain := strings.Cut(strings.TrimSpace(entry), ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			return nil, fmt.Errorf("audio source %q has no name", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("audio source %q is listed twice", name)
+		}
+		seen[name] = true
+
+		src := MixSource{Name: name}
+		if hasGain {
+			db, err := strconv.ParseFloat(strings.TrimSuffix(strings.ToLower(strings.TrimSpace(gain)), "db"), 64)
+			if err != nil {
+				return nil, fmt.Errorf("audio source %q has an invalid gain", name)
+			}
+			if db < MinGainDB || db > MaxGainDB {
+				return nil, fmt.Errorf("audio source %q: %w", name, ErrInvalidGain)
+			}
+			src.GainDB = db
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// Mix is a named combination of sources, e.g. game audio without the
+// microphone; viewers choose which mix they hear
+type Mix struct {
+	Name    string
+	Sources []string // Empty includes every source
+}
+
+// includes reports whether the mix has source
+func (x Mix) includes(source string) bool {
+	if len(x.Sources) == 0 {
+		return true
+	}
+	for _, s := range x.Sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseMixes parses "name=source+source" entries, e.g. "full=game+mic"
+// and "game=game"
+func ParseMixes(list []string) ([]Mix, error) {
+	mixes := make([]Mix, 0, len(list))
+	seen := make(map[string]bool)
+	for _, entry := range list {
+		name, sources, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			return nil, fmt.Errorf("audio mix %q has no name", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("audio mix %q is listed twice", name)
+		}
+		seen[name] = true
+
+		x := Mix{Name: name}
+		for _, src := range strings.Split(sources, "+") {
+			if src = strings.ToLower(strings.TrimSpace(src)); src != "" {
+				x.Sources = append(x.Sources, src)
+			}
+		}
+		mixes = append(mixes, x)
+	}
+	return mixes, nil
+}
+
+// MixSink receives the frames of every mix but the first. It runs on the
+// mixer goroutine and must not block.
+type MixSink func(mix string, frame media.AudioFrame)
+
+// MixerConfig configures a mixer
+type MixerConfig struct {
+	// Sources are the inputs. The first drives the output clock and keeps
+	// its channel layout; untagged frames belong to it. Others are folded
+	// into its front pair. Sources not listed are mixed in at unity gain
+	// when they appear.
+	Sources []MixSource
+
+	// Mixes are the combinations produced. The first goes to Output, the
+	// rest to the mix sink. Default is one mix of every source.
+	Mixes []Mix
+
+	// DuckSource is the input whose signal lowers the others, e.g. "mic";
+	// empty disables ducking
+	DuckSource string
+
+	DuckDB          float64       // Attenuation while ducking, default 12
+	DuckThresholdDB float64       // Level in dBFS that starts ducking, default -40
+	DuckHold        time.Duration // Time ducking lasts after the level falls, default 500ms
+
+	// MaxLatency is the most audio buffered per secondary source; older
+	// samples are dropped, default 200ms
+	MaxLatency time.Duration
+
+	// BufferSize is the output channel size, default 60
+	BufferSize int
+}
+
+// SourceStatus describes one mixer input
+type SourceStatus struct {
+	Name      string  `json:"name"`
+	GainDB    float64 `json:"gain_db"`
+	Muted     bool    `json:"muted"`
+	Clock     bool    `json:"clock,omitempty"` // Drives the output
+	LevelDB   float64 `json:"level_db"`        // Peak of the last frame, dBFS
+	Frames    uint64  `json:"frames"`
+	Dropped   uint64  `json:"dropped"`   // Samples discarded beyond MaxLatency
+	Underruns uint64  `json:"underruns"` // Output blocks padded with silence
+}
+
+// MixerStats are mixer counters
+type MixerStats struct {
+	Frames     uint64   `json:"frames"`   // Output frames
+	Fallback   uint64   `json:"fallback"` // Output frames timed by the mixer while the clock source was silent
+	Dropped    uint64   `json:"dropped"`  // Output frames dropped because the consumer fell behind
+	Errors     uint64   `json:"errors"`   // Malformed or unexpected input frames
+	Ducking    bool     `json:"ducking"`
+	DuckGainDB float64  `json:"duck_gain_db"`
+	SampleRate int      `json:"sample_rate"`
+	Mixes      []string `json:"mixes"`
+}
+
+// mixInput is the state of one source. Guarded by Mixer.mu.
+type mixInput struct {
+	MixSource
+	clock    bool
+	downmix  *Downmixer
+	resample resampler
+	fifo     []float32 // Stereo, interleaved, at the output rate
+	headPTS  int64     // PTS of the first buffered sample
+	levelDB  float64
+
+	frames    uint64
+	dropped   uint64
+	underruns uint64
+}
+
+// gain returns the input's linear gain
+func (in *mixInput) gain() float64 {
+	if in.Muted {
+		return 0
+	}
+	return dbToGain(in.GainDB)
+}
+
+// Mixer combines tagged audio sources, e.g. game audio and a microphone,
+// into one stream ahead of the router. The clock source's frames set the
+// output timing; other sources are resampled to its rate and buffered
+// until each clock frame takes a frame's worth. When the clock source goes
+// silent, the mixer times output itself so a lone microphone still plays.
+type Mixer struct {
+	cfg    MixerConfig
+	frames <-chan media.AudioFrame
+	out    chan media.AudioFrame
+	logger zerolog.Logger
+
+	mu        sync.Mutex
+	inputs    map[string]*mixInput
+	order     []string
+	clockName string
+	rate      int       // Output sample rate
+	lastClock time.Time // Arrival of the last clock frame
+	duckUntil time.Time
+	duckGain  float64
+	sink      MixSink
+	running   bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+
+	// Statistics
+	frameCount atomic.Uint64
+	fallback   atomic.Uint64
+	dropped    atomic.Uint64
+	errorCount atomic.Uint64
+}
+
+// NewMixer creates a mixer reading tagged frames from frames
+func NewMixer(cfg MixerConfig, frames <-chan media.AudioFrame, logger zerolog.Logger) *Mixer {
+	// Apply defaults for zero values
+	if cfg.DuckDB <= 0 {
+		cfg.DuckDB = 12
+	}
+	if cfg.DuckThresholdDB == 0 {
+		cfg.DuckThresholdDB = -40
+	}
+	if cfg.DuckHold <= 0 {
+		cfg.DuckHold = 500 * time.Millisecond
+	}
+	if cfg.MaxLatency <= 0 {
+		cfg.MaxLatency = 200 * time.Millisecond
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 60
+	}
+	if len(cfg.Sources) == 0 {
+		cfg.Sources = []MixSource{{Name: "main"}}
+	}
+	if len(cfg.Mixes) == 0 {
+		cfg.Mixes = []Mix{{Name: "main"}}
+	}
+
+	m := &Mixer{
+		cfg:       cfg,
+		frames:    frames,
+		out:       make(chan media.AudioFrame, cfg.BufferSize),
+		logger:    logger.With().Str("component", "audio_mixer").Logger(),
+		inputs:    make(map[string]*mixInput),
+		clockName: cfg.Sources[0].Name,
+		rate:      48000,
+		duckGain:  1,
+	}
+	for i, src := range cfg.Sources {
+		m.addInput(src, i == 0)
+	}
+	return m
+}
+
+// Output returns the frames of the first mix, for the router
+func (m *Mixer) Output() <-chan media.AudioFrame {
+	return m.out
+}
+
+// SetMixSink registers fn to receive the frames of the other mixes
+func (m *Mixer) SetMixSink(fn MixSink) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sink = fn
+}
+
+// Mixes returns the mix names, the default first
+func (m *Mixer) Mixes() []string {
+	names := make([]string, len(m.cfg.Mixes))
+	for i, x := range m.cfg.Mixes {
+		names[i] = x.Name
+	}
+	return names
+}
+
+// Start begins mixing in the background; returns immediately
+func (m *Mixer) Start(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.running {
+		return errors.New("audio mixer already started")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	m.cancel = cancel
+	m.done = make(chan struct{})
+	m.running = true
+
+	go m.run(runCtx)
+
+	m.logger.Info().Strs("sources", m.order).Str("clock", m.clockName).Str("duck_source", m.cfg.DuckSource).Msg("Audio mixer started")
+
+	return nil
+}
+
+// Stop stops mixing and waits for the goroutine to exit
+func (m *Mixer) Stop() error {
+	m.mu.Lock()
+	if !m.running {
+		m.mu.Unlock()
+		return nil
+	}
+	m.running = false
+	m.cancel()
+	done := m.done
+	m.mu.Unlock()
+
+	<-done
+	return nil
+}
+
+// SetGain changes a source's gain
+func (m *Mixer) SetGain(name string, db float64) error {
+	if db < MinGainDB || db > MaxGainDB || math.IsNaN(db) {
+		return ErrInvalidGain
+	}
+	m.mu.Lock()
+	in, ok := m.inputs[name]
+	if ok {
+		in.GainDB = db
+	}
+	m.mu.Unlock()
+	if !ok {
+		return ErrUnknownSource
+	}
+	m.logger.Info().Str("source", name).Float64("gain_db", db).Msg("Audio source gain set")
+	return nil
+}
+
+// SetMuted mutes or unmutes a source
+func (m *Mixer) SetMuted(name string, muted bool) error {
+	m.mu.Lock()
+	in, ok := m.inputs[name]
+	if ok {
+		in.Muted = muted
+	}
+	m.mu.Unlock()
+	if !ok {
+		return ErrUnknownSource
+	}
+	m.logger.Info().Str("source", name).Bool("muted", muted).Msg("Audio source mute set")
+	return nil
+}
+
+// Sources describes the inputs, clock source first
+func (m *Mixer) Sources() []SourceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]SourceStatus, 0, len(m.order))
+	for _, name := range m.order {
+		in := m.inputs[name]
+		list = append(list, SourceStatus{
+			Name:      in.Name,
+			GainDB:    in.GainDB,
+			Muted:     in.Muted,
+			Clock:     in.clock,
+			LevelDB:   math.Round(in.levelDB*10) / 10,
+			Frames:    in.frames,
+			Dropped:   in.dropped,
+			Underruns: in.underruns,
+		})
+	}
+	return list
+}
+
+// Stats returns mixer counters
+func (m *Mixer) Stats() MixerStats {
+	m.mu.Lock()
+	ducking := time.Now().Before(m.duckUntil)
+	duckGain, rate := m.duckGain, m.rate
+	m.mu.Unlock()
+	return MixerStats{
+		Frames:     m.frameCount.Load(),
+		Fallback:   m.fallback.Load(),
+		Dropped:    m.dropped.Load(),
+		Errors:     m.errorCount.Load(),
+		Ducking:    ducking,
+		DuckGainDB: math.Round(gainToDB(duckGain)*10) / 10,
+		SampleRate: rate,
+		Mixes:      m.Mixes(),
+	}
+}
+
+// run is the mixing goroutine
+func (m *Mixer) run(ctx context.Context) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(fallbackBlock)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case frame, ok := <-m.frames:
+			if !ok {
+				return
+			}
+			m.handle(frame)
+		case <-ticker.C:
+			m.tick()
+		}
+	}
+}
+
+// handle mixes a clock frame out, or buffers a secondary one
+func (m *Mixer) handle(frame media.AudioFrame) {
+	if frame.Channels < 1 || len(frame.Data)%(2*frame.Channels) != 0 {
+		m.errorCount.Add(1)
+		return
+	}
+
+	m.mu.Lock()
+	name := strings.ToLower(frame.Source)
+	if name == "" {
+		name = m.clockName
+	}
+	in, ok := m.inputs[name]
+	if !ok {
+		if len(m.inputs) >= maxMixInputs {
+			m.mu.Unlock()
+			m.errorCount.Add(1)
+			return
+		}
+		in = m.addInput(MixSource{Name: name}, false)
+		m.logger.Info().Str("source", name).Msg("New audio source, mixing at unity gain")
+	}
+	in.frames++
+	in.levelDB = peakDB(frame.Data)
+	if name == m.cfg.DuckSource && !in.Muted && in.levelDB+in.GainDB > m.cfg.DuckThresholdDB {
+		m.duckUntil = time.Now().Add(m.cfg.DuckHold)
+	}
+
+	var out []media.AudioFrame
+	if in.clock {
+		out = m.mixClock(in, frame)
+	} else if err := m.buffer(in, frame); err != nil {
+		m.errorCount.Add(1)
+		m.logger.Debug().Err(err).Str("source", name).Msg("Dropping malformed audio frame")
+	}
+	sink := m.sink
+	m.mu.Unlock()
+
+	m.emit(out, sink)
+}
+
+// mixClock adds the buffered secondary sources to a clock frame, once for
+// each mix. Caller holds mu.
+func (m *Mixer) mixClock(clock *mixInput, frame media.AudioFrame) []media.AudioFrame {
+	m.lastClock = time.Now()
+	if frame.SampleRate > 0 && frame.SampleRate != m.rate {
+		m.logger.Info().Int("from", m.rate).Int("to", frame.SampleRate).Msg("Audio mix sample rate changed")
+		m.rate = frame.SampleRate
+		for _, in := range m.inputs {
+			in.fifo, in.resample = in.fifo[:0], resampler{}
+		}
+	}
+
+	channels := frame.Channels
+	samples := len(frame.Data) / (2 * channels)
+	g0, g1 := m.duckRamp(samples)
+	blocks := m.takeSecondaries(samples)
+
+	clockGain := clock.gain()
+	frames := make([]media.AudioFrame, len(m.cfg.Mixes))
+	for n, x := range m.cfg.Mixes {
+		mix := make([]float64, samples*channels)
+		if x.includes(clock.Name) {
+			for i := 0; i < samples; i++ {
+				g := clockGain
+				if clock.Name != m.cfg.DuckSource {
+					g *= g0 + (g1-g0)*float64(i)/float64(samples)
+				}
+				for ch := 0; ch < channels; ch++ {
+					idx := i*channels + ch
+					mix[idx] = float64(int16(binary.LittleEndian.Uint16(frame.Data[idx*2:]))) * g
+				}
+			}
+		}
+		m.addSecondaries(mix, blocks, x, channels, samples, g0, g1)
+
+		out := frame
+		out.Source = ""
+		out.SampleCount = samples
+		out.Data = encodePCM(mix)
+		frames[n] = out
+	}
+	return frames
+}
+
+// tick times output from the secondary sources while the clock source is
+// silent
+func (m *Mixer) tick() {
+	m.mu.Lock()
+	if time.Since(m.lastClock) < clockTimeout {
+		m.mu.Unlock()
+		return
+	}
+	var pts int64
+	buffered := false
+	for _, name := range m.order {
+		if in := m.inputs[name]; !in.clock && len(in.fifo) > 0 {
+			pts, buffered = in.headPTS, true
+			break
+		}
+	}
+	if !buffered {
+		m.mu.Unlock()
+		return
+	}
+
+	samples := m.rate * int(fallbackBlock/time.Millisecond) / 1000
+	g0, g1 := m.duckRamp(samples)
+	blocks := m.takeSecondaries(samples)
+	frames := make([]media.AudioFrame, len(m.cfg.Mixes))
+	for n, x := range m.cfg.Mixes {
+		mix := make([]float64, samples*2)
+		m.addSecondaries(mix, blocks, x, 2, samples, g0, g1)
+		frames[n] = media.AudioFrame{
+			PTS:         pts,
+			SampleRate:  m.rate,
+			Channels:    2,
+			SampleCount: samples,
+			Data:        encodePCM(mix),
+			ReceivedAt:  time.Now(),
+		}
+	}
+	sink := m.sink
+	m.mu.Unlock()
+
+	m.fallback.Add(1)
+	m.emit(frames, sink)
+}
+
+// takeSecondaries takes a block of samples from every secondary source
+// that has audio buffered. Caller holds mu.
+func (m *Mixer) takeSecondaries(samples int) map[string][]float32 {
+	blocks := make(map[string][]float32, len(m.inputs))
+	for name, in := range m.inputs {
+		if in.clock {
+			continue
+		}
+		if block := in.take(samples, m.rate); block != nil {
+			blocks[name] = block
+		}
+	}
+	return blocks
+}
+
+// addSecondaries adds the blocks of the sources in x to the front pair of
+// mix, or to mono. Caller holds mu.
+func (m *Mixer) addSecondaries(mix []float64, blocks map[string][]float32, x Mix, channels, samples int, g0, g1 float64) {
+	for _, name := range m.order {
+		block, ok := blocks[name]
+		if !ok || !x.includes(name) {
+			continue
+		}
+		in := m.inputs[name]
+		gain := in.gain()
+		ducked := in.Name != m.cfg.DuckSource
+		for i := 0; i < samples; i++ {
+			g := gain
+			if ducked {
+				g *= g0 + (g1-g0)*float64(i)/float64(samples)
+			}
+			l, r := float64(block[i*2])*g, float64(block[i*2+1])*g
+			if channels == 1 {
+				mix[i] += (l + r) / 2
+			} else {
+				mix[i*channels] += l
+				mix[i*channels+1] += r
+			}
+		}
+	}
+}
+
+// duckRamp advances the duck gain over a block and returns its start and
+// end values. Caller holds mu.
+func (m *Mixer) duckRamp(samples int) (from, to float64) {
+	target, tau := 1.0, duckRelease
+	if m.cfg.DuckSource != "" && time.Now().Before(m.duckUntil) {
+		target, tau = dbToGain(-m.cfg.DuckDB), duckAttack
+	}
+	block := time.Duration(samples) * time.Second / time.Duration(m.rate)
+	from = m.duckGain
+	m.duckGain += (target - m.duckGain) * min(1, float64(block)/float64(tau))
+	return from, m.duckGain
+}
+
+// buffer appends a secondary frame to its input, as stereo at the output
+// rate. Caller holds mu.
+func (m *Mixer) buffer(in *mixInput, frame media.AudioFrame) error {
+	stereo, err := in.downmix.Downmix(frame)
+	if err != nil {
+		return err
+	}
+	samples := make([]float32, len(stereo.Data)/2)
+	for i := range samples {
+		samples[i] = float32(int16(binary.LittleEndian.Uint16(stereo.Data[i*2:])))
+	}
+	rate := frame.SampleRate
+	if rate <= 0 {
+		rate = m.rate
+	}
+	if in.resample.from != rate || in.resample.to != m.rate {
+		in.resample = resampler{from: rate, to: m.rate}
+	}
+
+	if len(in.fifo) == 0 {
+		in.headPTS = frame.PTS
+	}
+	in.fifo = in.resample.process(samples, in.fifo)
+
+	// Drop the oldest audio beyond MaxLatency
+	limit := int(int64(m.rate)*int64(m.cfg.MaxLatency)/int64(time.Second)) * 2
+	if excess := len(in.fifo) - limit; excess > 0 {
+		in.fifo = append(in.fifo[:0], in.fifo[excess:]...)
+		in.dropped += uint64(excess / 2)
+		in.headPTS += int64(excess/2) * int64(time.Second) / int64(m.rate)
+	}
+	return nil
+}
+
+// emit hands the first mix to the router without blocking, and the others
+// to the mix sink
+func (m *Mixer) emit(frames []media.AudioFrame, sink MixSink) {
+	if len(frames) == 0 {
+		return
+	}
+	select {
+	case m.out <- frames[0]:
+		m.frameCount.Add(1)
+	default:
+		m.dropped.Add(1)
+	}
+	if sink == nil {
+		return
+	}
+	for n, frame := range frames[1:] {
+		sink(m.cfg.Mixes[n+1].Name, frame)
+	}
+}
+
+// addInput registers a source. Caller holds mu, or is the constructor.
+func (m *Mixer) addInput(src MixSource, clock bool) *mixInput {
+	in := &mixInput{MixSource: src, clock: clock, downmix: NewDownmixer(ModeITU), levelDB: silenceDB}
+	m.inputs[src.Name] = in
+	m.order = append(m.order, src.Name)
+	return in
+}
+
+// take removes a block of stereo samples from the buffer, padding with
+// silence on underrun. It returns nil for a source with nothing buffered.
+func (in *mixInput) take(samples, rate int) []float32 {
+	if len(in.fifo) == 0 {
+		return nil
+	}
+	block := make([]float32, samples*2)
+	n := copy(block, in.fifo)
+	if n < len(block) {
+		in.underruns++
+	}
+	in.fifo = append(in.fifo[:0], in.fifo[n:]...)
+	in.headPTS += int64(n/2) * int64(time.Second) / int64(rate)
+	return block
+}
+
+// resampler converts interleaved stereo between sample rates by linear
+// interpolation, carrying its position across blocks
+type resampler struct {
+	from, to int
+	pos      float64    // Next output position, in input samples after prev
+	prev     [2]float32 // Last input sample of the previous block
+	primed   bool
+}
+
+// process appends in, resampled, to out
+func (r *resampler) process(in, out []float32) []float32 {
+	if r.from == r.to || r.from <= 0 || r.to <= 0 {
+		return append(out, in...)
+	}
+	n := len(in) / 2
+	if n == 0 {
+		return out
+	}
+	if !r.primed {
+		r.prev = [2]float32{in[0], in[1]}
+		r.pos, r.primed = 0, true
+	}
+
+	// Position -1 is prev; 0..n-1 are in
+	at := func(i, ch int) float32 {
+		if i < 0 {
+			return r.prev[ch]
+		}
+		return in[i*2+ch]
+	}
+	step := float64(r.from) / float64(r.to)
+	for r.pos < float64(n-1) {
+		i := int(math.Floor(r.pos))
+		frac := float32(r.pos - float64(i))
+		for ch := 0; ch < 2; ch++ {
+			a, b := at(i, ch), at(i+1, ch)
+			out = append(out, a+(b-a)*frac)
+		}
+		r.pos += step
+	}
+	r.pos -= float64(n)
+	r.prev = [2]float32{in[(n-1)*2], in[(n-1)*2+1]}
+	return out
+}
+
+// silenceDB is the level reported for digital silence
+const silenceDB = -96.0
+
+// peakDB returns the peak level of 16-bit PCM in dBFS
+func peakDB(data []byte) float64 {
+	var peak float64
+	for i := 0; i+1 < len(data); i += 2 {
+		peak = max(peak, math.Abs(float64(int16(binary.LittleEndian.Uint16(data[i:])))))
+	}
+	if peak == 0 {
+		return silenceDB
+	}
+	return max(silenceDB, 20*math.Log10(peak/32768))
+}
+
+// encodePCM converts mixed samples to 16-bit PCM, clipping at full scale
+func encodePCM(mix []float64) []byte {
+	out := make([]byte, len(mix)*2)
+	for i, v := range mix {
+		binary.LittleEndian.PutUint16(out[i*2:], uint16(clamp16(v)))
+	}
+	return out
+}
+
+func dbToGain(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+func gainToDB(g float64) float64 {
+	if g <= 0 {
+		return silenceDB
+	}
+	return 20 * math.Log10(g)
+}
@@ -0,0 +1,216 @@
+package audio
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Output is the channel layout a sink receives
+type Output int
+
+const (
+	// OutputStereo receives frames downmixed to two channels, for WebRTC
+	OutputStereo Output = iota
+
+	// OutputPassthrough receives frames with the source's channels
+	// untouched, for recordings that keep surround
+	OutputPassthrough
+)
+
+// Sink receives audio frames. It runs on the router goroutine and must not
+// block.
+type Sink func(frame media.AudioFrame)
+
+// RouterConfig configures an audio router
+type RouterConfig struct {
+	Downmix Mode // How frames are folded to stereo for OutputStereo sinks
+
+	// Loudness normalizes OutputStereo frames for viewers when its target
+	// is set; passthrough outputs keep the source level
+	Loudness LoudnessConfig
+}
+
+// RouterStats are router counters
+type RouterStats struct {
+	Frames    uint64 `json:"frames"`    // Frames received from the source
+	Downmixed uint64 `json:"downmixed"` // Frames folded to stereo
+	Errors    uint64 `json:"errors"`    // Malformed frames dropped
+	Channels  int    `json:"channels"`  // Channel count of the last frame
+	Layout    string `json:"layout"`    // Layout name of the last frame
+
+	Loudness *LoudnessStats `json:"loudness,omitempty"`
+}
+
+// Router reads frames from a source and hands each sink the layout it asked
+// for. Downmixing is done once per frame however many stereo sinks there are.
+type Router struct {
+	cfg    RouterConfig
+	frames <-chan media.AudioFrame
+	logger zerolog.Logger
+	mixer  *Downmixer
+	level  *Normalizer // nil without a loudness target
+
+	mu       sync.Mutex
+	running  bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+	stereo   []Sink
+	surround []Sink
+
+	// Statistics
+	frameCount atomic.Uint64
+	downmixed  atomic.Uint64
+	errorCount atomic.Uint64
+	channels   atomic.Int64
+}
+
+// NewRouter creates a router reading from frames
+func NewRouter(cfg RouterConfig, frames <-chan media.AudioFrame, logger zerolog.Logger) *Router {
+	r := &Router{
+		cfg:    cfg,
+		frames: frames,
+		logger: logger.With().Str("component", "audio_router").Logger(),
+		mixer:  NewDownmixer(cfg.Downmix),
+	}
+	if cfg.Loudness.TargetLUFS != 0 {
+		r.level = NewNormalizer(cfg.Loudness)
+	}
+	return r
+}
+
+// AddSink registers fn to receive frames in the given layout
+func (r *Router) AddSink(output Output, fn Sink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if output == OutputPassthrough {
+		r.surround = append(r.surround, fn)
+	} else {
+		r.stereo = append(r.stereo, fn)
+	}
+}
+
+// Start begins routing in the background; returns immediately
+func (r *Router) Start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running {
+		return errors.New("audio router already started")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.running = true
+
+	go r.run(runCtx)
+
+	r.logger.Info().Str("downmix", r.cfg.Downmix.String()).Float64("loudness_target", r.cfg.Loudness.TargetLUFS).Msg("Audio router started")
+
+	return nil
+}
+
+// Stop stops routing and waits for the goroutine to exit
+func (r *Router) Stop() error {
+	r.mu.Lock()
+	if !r.running {
+		r.mu.Unlock()
+		return nil
+	}
+	r.running = false
+	r.cancel()
+	done := r.done
+	r.mu.Unlock()
+
+	<-done
+
+	r.logger.Info().
+		Uint64("frames", r.frameCount.Load()).
+		Uint64("downmixed", r.downmixed.Load()).
+		Msg("Audio router stopped")
+
+	return nil
+}
+
+// Stats returns router counters
+func (r *Router) Stats() RouterStats {
+	channels := int(r.channels.Load())
+	stats := RouterStats{
+		Frames:    r.frameCount.Load(),
+		Downmixed: r.downmixed.Load(),
+		Errors:    r.errorCount.Load(),
+		Channels:  channels,
+	}
+	if channels > 0 {
+		stats.Layout = LayoutName(channels)
+	}
+	if r.level != nil {
+		level := r.level.Stats()
+		stats.Loudness = &level
+	}
+	return stats
+}
+
+// run is the routing goroutine
+func (r *Router) run(ctx context.Context) {
+	defer close(r.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case frame, ok := <-r.frames:
+			if !ok {
+				return
+			}
+			r.route(frame)
+		}
+	}
+}
+
+// route delivers one frame to every sink
+func (r *Router) route(frame media.AudioFrame) {
+	r.frameCount.Add(1)
+	if prev := r.channels.Swap(int64(frame.Channels)); prev != int64(frame.Channels) {
+		r.logger.Info().
+			Int("channels", frame.Channels).
+			Str("layout", LayoutName(frame.Channels)).
+			Msg("Audio channel layout changed")
+	}
+
+	r.mu.Lock()
+	stereo, surround := r.stereo, r.surround
+	r.mu.Unlock()
+
+	for _, fn := range surround {
+		fn(frame)
+	}
+
+	if len(stereo) == 0 {
+		return
+	}
+	mixed, err := r.mixer.Downmix(frame)
+	if err != nil {
+		r.errorCount.Add(1)
+		r.logger.Debug().Err(err).Msg("Dropping malformed audio frame")
+		return
+	}
+	if frame.Channels != 2 {
+		r.downmixed.Add(1)
+	}
+	if r.level != nil {
+		if mixed, err = r.level.Process(mixed); err != nil {
+			r.errorCount.Add(1)
+			return
+		}
+	}
+	for _, fn := range stereo {
+		fn(mixed)
+	}
+}
@@ -0,0 +1,165 @@
+package audio
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// MixMessageType is the data channel message type for choosing a mix:
+//
+//	{"type":"audio_mix","mix":"game"}
+//
+// A message without a mix reports the current one. Both are answered with
+// the viewer's mix and the mixes on offer.
+const MixMessageType = "audio_mix"
+
+// ErrUnknownMix is returned for a mix the mixer does not produce
+var ErrUnknownMix = errors.New("unknown audio mix")
+
+// MixTrackWriter is implemented by peer managers that carry each mix on its
+// own audio track and can switch a viewer's audio sender between them
+// without renegotiating. The default mix stays on the shared audio track.
+type MixTrackWriter interface {
+	WriteMixAudioFrame(mix string, frame media.AudioFrame) error
+	SetPeerMix(peerID, mix string) error
+}
+
+// mixMessage is a viewer's mix request, and the reply
+type mixMessage struct {
+	Type  string   `json:"type"`
+	Mix   string   `json:"mix,omitempty"`
+	Mixes []string `json:"mixes,omitempty"`
+}
+
+// SelectorStats are selector counters
+type SelectorStats struct {
+	Peers    map[string]int `json:"peers"` // Viewers per mix, default excluded
+	Switches uint64         `json:"switches"`
+	Errors   uint64         `json:"errors"`
+}
+
+// Selector tracks which mix each viewer hears
+type Selector struct {
+	mixes  []string
+	tracks MixTrackWriter
+	logger zerolog.Logger
+
+	mu    sync.Mutex
+	peers map[string]string // Viewers on a mix other than the default
+
+	// Statistics
+	switches atomic.Uint64
+	errors   atomic.Uint64
+}
+
+// NewSelector creates a selector between mixes, the first being the
+// default every viewer starts on
+func NewSelector(mixes []string, tracks MixTrackWriter, logger zerolog.Logger) *Selector {
+	return &Selector{
+		mixes:  mixes,
+		tracks: tracks,
+		logger: logger.With().Str("component", "audio_mix_selector").Logger(),
+		peers:  make(map[string]string),
+	}
+}
+
+// Select switches peerID to mix; an empty mix selects the default. The
+// signaling server calls it for a mix requested when the viewer connects.
+func (s *Selector) Select(peerID, mix string) error {
+	if mix == "" {
+		mix = s.mixes[0]
+	}
+	if !s.offers(mix) {
+		return ErrUnknownMix
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current(peerID) == mix {
+		return nil
+	}
+	if err := s.tracks.SetPeerMix(peerID, mix); err != nil {
+		s.errors.Add(1)
+		return err
+	}
+	if mix == s.mixes[0] {
+		delete(s.peers, peerID)
+	} else {
+		s.peers[peerID] = mix
+	}
+	s.switches.Add(1)
+	s.logger.Info().Str("peer_id", peerID).Str("mix", mix).Msg("Viewer audio mix selected")
+	return nil
+}
+
+// Mix returns the mix peerID hears
+func (s *Selector) Mix(peerID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current(peerID)
+}
+
+// Mixes returns the mixes on offer, the default first
+func (s *Selector) Mixes() []string {
+	return s.mixes
+}
+
+// RemovePeer forgets a viewer that left
+func (s *Selector) RemovePeer(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, peerID)
+}
+
+// HandleMessage handles a viewer's mix request. It is a commands.Handler.
+func (s *Selector) HandleMessage(peerID string, msg []byte) (any, error) {
+	var req mixMessage
+	if err := json.Unmarshal(msg, &req); err != nil {
+		return nil, err
+	}
+	if req.Mix != "" {
+		if err := s.Select(peerID, req.Mix); err != nil {
+			return nil, err
+		}
+	}
+	return mixMessage{Type: MixMessageType, Mix: s.Mix(peerID), Mixes: s.mixes}, nil
+}
+
+// Stats returns selector counters
+func (s *Selector) Stats() SelectorStats {
+	s.mu.Lock()
+	peers := make(map[string]int)
+	for _, mix := range s.peers {
+		peers[mix]++
+	}
+	s.mu.Unlock()
+	return SelectorStats{
+		Peers:    peers,
+		Switches: s.switches.Load(),
+		Errors:   s.errors.Load(),
+	}
+}
+
+// current returns peerID's mix. Caller holds mu.
+func (s *Selector) current(peerID string) string {
+	if mix, ok := s.peers[peerID]; ok {
+		return mix
+	}
+	return s.mixes[0]
+}
+
+// offers reports whether mix is produced
+func (s *Selector) offers(mix string) bool {
+	for _, m := range s.mixes {
+		if m == mix {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,310 @@
+// Package avsync aligns the sender reports of a viewer's audio and video.
+//
+// Browsers line up audio and video using each stream's RTCP sender reports,
+// which pair an RTP timestamp with a wall-clock (NTP) time. Pion's report
+// interceptor pairs them with the time a packet was written, so anything
+// that holds one kind back longer than the other, such as the audio mixer's
+// buffer or the loudness limiter's lookahead, shows up as lip sync error.
+// Here both kinds are instead mapped to the time their frames were
+// captured: audio and video PTS come from one producer clock, which the
+// Clock anchors to the gateway's wall clock.
+package avsync
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/rs/zerolog"
+)
+
+// Kind is the media kind of a stream
+type Kind int
+
+const (
+	Audio Kind = iota
+	Video
+)
+
+// Limits on what counts as one continuous producer timeline
+const (
+	// maxJump is the largest PTS step forward or back still taken as the
+	// same timeline; anything larger means the producer restarted its clock
+	maxJump = 10 * time.Second
+
+	// maxLag is the largest plausible delay between capture and write;
+	// a longer one means the producer's timeline was spliced, and the
+	// clock re-anchors on it
+	maxLag = 5 * time.Second
+)
+
+// Clock maps producer PTS onto gateway wall-clock time, and tracks how long
+// after capture each kind is currently being written
+type Clock struct {
+	mu       sync.Mutex
+	anchored bool
+	offset   int64    // Wall-clock minus PTS in nanoseconds, the smallest seen
+	lastPTS  [2]int64 // By kind
+	seen     [2]bool
+
+	lag [2]atomic.Int64 // Nanoseconds, by kind
+
+	// Statistics
+	reanchors atomic.Uint64
+}
+
+// NewClock creates a clock; it anchors on the first frame observed
+func NewClock() *Clock {
+	return &Clock{}
+}
+
+// Observe records that a frame of kind with pts (nanoseconds) is being
+// written to viewers at the given time
+func (c *Clock) Observe(kind Kind, pts int64, at time.Time) {
+	offset := at.UnixNano() - pts
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.seen[kind] {
+		jump := time.Duration(pts - c.lastPTS[kind])
+		if jump > maxJump || jump < -maxJump {
+			// A new timeline; frames of the other kind are judged against
+			// it once they follow
+			c.anchored = false
+			c.reanchors.Add(1)
+		}
+	}
+	c.lastPTS[kind] = pts
+	c.seen[kind] = true
+
+	// The least delayed frame defines capture time; delays are relative to
+	// it and equal for both kinds
+	if !c.anchored || offset < c.offset {
+		c.offset = offset
+		c.anchored = true
+	}
+	lag := offset - c.offset
+	if lag > int64(maxLag) {
+		c.offset, lag = offset, 0
+		c.reanchors.Add(1)
+	}
+	c.lag[kind].Store(lag)
+}
+
+// Lag returns how long after capture frames of kind are being written
+func (c *Clock) Lag(kind Kind) time.Duration {
+	return time.Duration(c.lag[kind].Load())
+}
+
+// Stats are sender report counters
+type Stats struct {
+	AudioLagMs float64 `json:"audio_lag_ms"`
+	VideoLagMs float64 `json:"video_lag_ms"`
+	Reanchors  uint64  `json:"reanchors"` // Producer clock restarts and timeline splices
+	Streams    int     `json:"streams"`
+	Reports    uint64  `json:"reports"` // Sender reports sent
+}
+
+// SenderReports creates interceptors that send RTCP sender reports mapping
+// each outgoing stream's RTP timestamps to capture time. It replaces pion's
+// report sender; registering both would send conflicting reports.
+type SenderReports struct {
+	clock    *Clock
+	interval time.Duration
+	logger   zerolog.Logger
+
+	streams atomic.Int64
+
+	// Statistics
+	reports atomic.Uint64
+}
+
+// NewSenderReports creates a sender report factory; interval defaults to 1s
+func NewSenderReports(clock *Clock, interval time.Duration, logger zerolog.Logger) *SenderReports {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &SenderReports{
+		clock:    clock,
+		interval: interval,
+		logger:   logger.With().Str("component", "avsync").Logger(),
+	}
+}
+
+// NewInterceptor implements interceptor.Factory
+func (s *SenderReports) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &reportInterceptor{
+		reports: s,
+		streams: make(map[uint32]*reportStream),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Stats returns the current lags and counters
+func (s *SenderReports) Stats() Stats {
+	return Stats{
+		AudioLagMs: float64(s.clock.Lag(Audio)) / float64(time.Millisecond),
+		VideoLagMs: float64(s.clock.Lag(Video)) / float64(time.Millisecond),
+		Reanchors:  s.clock.reanchors.Load(),
+		Streams:    int(s.streams.Load()),
+		Reports:    s.reports.Load(),
+	}
+}
+
+// reportInterceptor sends the sender reports of one peer connection
+type reportInterceptor struct {
+	interceptor.NoOp
+	reports *SenderReports
+
+	mu      sync.Mutex
+	streams map[uint32]*reportStream // By SSRC
+	started bool
+
+	closeOnce sync.Once
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// reportStream is one outgoing stream's RTP-to-capture-time mapping
+type reportStream struct {
+	ssrc      uint32
+	kind      Kind
+	clockRate float64
+
+	// Guarded by reportInterceptor.mu
+	timestamp uint32    // RTP timestamp of the latest frame
+	captured  time.Time // Its capture time on the gateway clock
+	mapped    bool
+	packets   uint32
+	octets    uint32
+}
+
+// BindRTCPWriter starts sending reports on the connection's RTCP writer
+func (i *reportInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if !i.started {
+		i.started = true
+		i.wg.Add(1)
+		go i.run(writer)
+	}
+	return writer
+}
+
+// BindLocalStream maps the timestamps of outgoing audio and video
+func (i *reportInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	var kind Kind
+	switch mime := strings.ToLower(info.MimeType); {
+	case strings.HasPrefix(mime, "audio/"):
+		kind = Audio
+	case strings.HasPrefix(mime, "video/"):
+		kind = Video
+	default:
+		return writer
+	}
+	if info.ClockRate == 0 {
+		return writer
+	}
+
+	s := &reportStream{ssrc: info.SSRC, kind: kind, clockRate: float64(info.ClockRate)}
+	i.mu.Lock()
+	if _, ok := i.streams[info.SSRC]; !ok {
+		i.reports.streams.Add(1)
+	}
+	i.streams[info.SSRC] = s
+	i.mu.Unlock()
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		i.mu.Lock()
+		if !s.mapped || header.Timestamp != s.timestamp {
+			// The first packet of a frame: it was captured as long ago as
+			// frames of its kind are currently held back
+			s.timestamp = header.Timestamp
+			s.captured = time.Now().Add(-i.reports.clock.Lag(s.kind))
+			s.mapped = true
+		}
+		s.packets++
+		s.octets += uint32(len(payload))
+		i.mu.Unlock()
+		return writer.Write(header, payload, attributes)
+	})
+}
+
+// UnbindLocalStream stops reporting on a stream
+func (i *reportInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if _, ok := i.streams[info.SSRC]; ok {
+		delete(i.streams, info.SSRC)
+		i.reports.streams.Add(-1)
+	}
+}
+
+// Close stops sending reports
+func (i *reportInterceptor) Close() error {
+	i.closeOnce.Do(func() {
+		close(i.done)
+		i.mu.Lock()
+		i.reports.streams.Add(-int64(len(i.streams)))
+		i.streams = make(map[uint32]*reportStream)
+		i.mu.Unlock()
+	})
+	i.wg.Wait()
+	return nil
+}
+
+// run sends a report for every mapped stream each interval
+func (i *reportInterceptor) run(writer interceptor.RTCPWriter) {
+	defer i.wg.Done()
+
+	ticker := time.NewTicker(i.reports.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.done:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var packets []rtcp.Packet
+		i.mu.Lock()
+		for _, s := range i.streams {
+			if !s.mapped {
+				continue
+			}
+			// The RTP timestamp a frame captured now would carry
+			elapsed := now.Sub(s.captured).Seconds() * s.clockRate
+			packets = append(packets, &rtcp.SenderReport{
+				SSRC:        s.ssrc,
+				NTPTime:     ntpTime(now),
+				RTPTime:     s.timestamp + uint32(int64(elapsed)),
+				PacketCount: s.packets,
+				OctetCount:  s.octets,
+			})
+		}
+		i.mu.Unlock()
+
+		if len(packets) == 0 {
+			continue
+		}
+		if _, err := writer.Write(packets, interceptor.Attributes{}); err != nil {
+			i.reports.logger.Debug().Err(err).Msg("Error sending sender reports")
+			continue
+		}
+		i.reports.reports.Add(uint64(len(packets)))
+	}
+}
+
+// ntpTime converts t to the 64-bit NTP format: seconds since 1900 and a
+// binary fraction
+func ntpTime(t time.Time) uint64 {
+	seconds := uint64(t.Unix()) + 2208988800
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
@@ -0,0 +1,31 @@
+package bitstream
+
+import "bytes"
+
+// SplitAnnexB returns the NAL units in an Annex-B byte stream, without start
+// codes
+func SplitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	for len(data) > 0 {
+		start := bytes.Index(data, []byte{0, 0, 1})
+		if start < 0 {
+			break
+		}
+		data = data[start+3:]
+
+		end := bytes.Index(data, []byte{0, 0, 1})
+		nal := data
+		if end >= 0 {
+			nal = data[:end]
+			data = data[end:]
+		} else {
+			data = nil
+		}
+		// Trailing zeros belong to the next 4-byte start code
+		nal = bytes.TrimRight(nal, "\x00")
+		if len(nal) > 0 {
+			nals = append(nals, nal)
+		}
+	}
+	return nals
+}
@@ -0,0 +1,182 @@
+package bitstream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// av1OBUSequenceHeader is the OBU type of an AV1 sequence header
+const av1OBUSequenceHeader = 1
+
+// AV1SequenceHeader holds the fields of an AV1 sequence header the gateway
+// uses
+type AV1SequenceHeader struct {
+	Profile  uint8 // seq_profile; 0 (Main) covers 8 and 10-bit 4:2:0
+	Level    uint8 // seq_level_idx of the first operating point
+	Tier     uint8
+	BitDepth uint8 // 8, 10 or 12
+	Mono     bool
+	Width    int     // Maximum frame width
+	Height   int     // Maximum frame height
+	FPS      float64 // From timing info with equal picture intervals; 0 if absent
+}
+
+// Fmtp returns an SDP fmtp line (AV1 RTP specification, section 7.2)
+func (h AV1SequenceHeader) Fmtp() string {
+	return fmt.Sprintf("profile=%d;level-idx=%d;tier=%d", h.Profile, h.Level, h.Tier)
+}
+
+// findAV1Params reads the sequence header in a low-overhead AV1 temporal
+// unit
+func findAV1Params(data []byte) (Params, bool, error) {
+	for len(data) > 0 {
+		header := data[0]
+		if header&0x80 != 0 {
+			return Params{}, false, errors.New("bitstream: AV1 forbidden bit set")
+		}
+		n := 1
+		if header&0x04 != 0 { // Extension header
+			n = 2
+		}
+		if len(data) < n {
+			return Params{}, false, errTruncated
+		}
+		end := len(data)
+		if header&0x02 != 0 {
+			size, sizeLen := leb128(data[n:])
+			if sizeLen == 0 || size > uint64(len(data)-n-sizeLen) {
+				return Params{}, false, errors.New("bitstream: AV1 OBU size exceeds data")
+			}
+			n += sizeLen
+			end = n + int(size)
+		}
+
+		if (header>>3)&0x0F == av1OBUSequenceHeader {
+			h, err := ParseAV1SequenceHeader(data[n:end])
+			if err != nil {
+				return Params{}, false, err
+			}
+			return Params{
+				Codec:    "av1",
+				Width:    h.Width,
+				Height:   h.Height,
+				FPS:      h.FPS,
+				Profile:  int(h.Profile),
+				Level:    int(h.Level),
+				BitDepth: int(h.BitDepth),
+				Fmtp:     h.Fmtp(),
+			}, true, nil
+		}
+		data = data[end:]
+	}
+	return Params{}, false, nil
+}
+
+// leb128 reads an unsigned LEB128 value; n is 0 when it is malformed
+func leb128(data []byte) (v uint64, n int) {
+	for i := 0; i < 8 && i < len(data); i++ {
+		v |= uint64(data[i]&0x7F) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// ParseAV1SequenceHeader parses the payload of a sequence header OBU
+func ParseAV1SequenceHeader(payload []byte) (AV1SequenceHeader, error) {
+	r := &bitReader{data: payload}
+	var h AV1SequenceHeader
+	h.Profile = uint8(r.u(3))
+	if h.Profile > 2 {
+		return AV1SequenceHeader{}, fmt.Errorf("bitstream: invalid AV1 profile %d", h.Profile)
+	}
+	r.u(1) // still_picture
+	reduced := r.flag()
+
+	if reduced {
+		h.Level = uint8(r.u(5))
+	} else {
+		decoderModel := false
+		bufferDelayLen := 0
+		if r.flag() { // timing_info_present_flag
+			unitsPerTick := r.u(32)
+			timeScale := r.u(32)
+			if r.flag() { // equal_picture_interval
+				ticks := r.uvlc() + 1
+				if unitsPerTick > 0 {
+					h.FPS = float64(timeScale) / (float64(unitsPerTick) * float64(ticks))
+				}
+			}
+			if decoderModel = r.flag(); decoderModel {
+				bufferDelayLen = int(r.u(5)) + 1
+				r.u(32) // num_units_in_decoding_tick
+				r.u(5)  // buffer_removal_time_length_minus_1
+				r.u(5)  // frame_presentation_time_length_minus_1
+			}
+		}
+		initialDisplayDelay := r.flag()
+		points := int(r.u(5)) + 1
+		for i := 0; i < points && r.err == nil; i++ {
+			r.u(12) // operating_point_idc
+			level := uint8(r.u(5))
+			tier := uint8(0)
+			if level > 7 {
+				tier = uint8(r.u(1))
+			}
+			if i == 0 {
+				h.Level, h.Tier = level, tier
+			}
+			if decoderModel && r.flag() {
+				r.skip(2*bufferDelayLen + 1) // Decoder and encoder buffer delays, low_delay_mode_flag
+			}
+			if initialDisplayDelay && r.flag() {
+				r.u(4)
+			}
+		}
+	}
+
+	widthBits := int(r.u(4)) + 1
+	heightBits := int(r.u(4)) + 1
+	h.Width = int(r.u(widthBits)) + 1
+	h.Height = int(r.u(heightBits)) + 1
+
+	if !reduced && r.flag() { // frame_id_numbers_present_flag
+		r.u(7) // delta_frame_id_length_minus_2, additional_frame_id_length_minus_1
+	}
+	r.u(3) // use_128x128_superblock, enable_filter_intra, enable_intra_edge_filter
+	if !reduced {
+		r.u(4) // enable_interintra_compound, masked_compound, warped_motion, dual_filter
+		orderHint := r.flag()
+		if orderHint {
+			r.u(2) // enable_jnt_comp, enable_ref_frame_mvs
+		}
+		screenContent := uint32(2)
+		if !r.flag() { // seq_choose_screen_content_tools
+			screenContent = r.u(1)
+		}
+		if screenContent > 0 && !r.flag() { // seq_choose_integer_mv
+			r.u(1)
+		}
+		if orderHint {
+			r.u(3)
+		}
+	}
+	r.u(3) // enable_superres, enable_cdef, enable_restoration
+
+	// color_config
+	h.BitDepth = 8
+	if r.flag() { // high_bitdepth
+		h.BitDepth = 10
+		if h.Profile == 2 && r.flag() {
+			h.BitDepth = 12
+		}
+	}
+	if h.Profile != 1 {
+		h.Mono = r.flag()
+	}
+	if r.err != nil {
+		return AV1SequenceHeader{}, r.err
+	}
+	return h, nil
+}
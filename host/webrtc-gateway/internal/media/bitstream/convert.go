@@ -0,0 +1,449 @@
+package bitstream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Format is the framing of NAL units within an access unit
+type Format int
+
+const (
+	// FormatUnknown means the framing has not been declared or detected
+	FormatUnknown Format = iota
+	// FormatAnnexB separates NAL units with 00 00 01 or 00 00 00 01 start
+	// codes, as carried by elementary streams and RTP depacketizers
+	FormatAnnexB
+	// FormatAVCC prefixes each NAL unit with its big-endian length, as in MP4
+	// samples. HEVC (HVCC) uses the same framing.
+	FormatAVCC
+)
+
+// String returns the format name
+func (f Format) String() string {
+	switch f {
+	case FormatAnnexB:
+		return "annexb"
+	case FormatAVCC:
+		return "avcc"
+	default:
+		return "auto"
+	}
+}
+
+// ParseFormat parses a format name; "" and "auto" mean detect per frame
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "", "auto":
+		return FormatUnknown, nil
+	case "annexb":
+		return FormatAnnexB, nil
+	case "avcc", "hvcc":
+		return FormatAVCC, nil
+	default:
+		return FormatUnknown, fmt.Errorf("bitstream: unknown format %q", s)
+	}
+}
+
+var annexBStartCode = []byte{0, 0, 0, 1}
+
+// DetectFormat guesses the framing of an access unit. Length prefixes are
+// tried first: a 3-byte start code is also a valid 4-byte length (256-511),
+// but a real Annex-B stream almost never parses as a chain of lengths that
+// exactly covers the buffer.
+func DetectFormat(data []byte, lengthSize int) Format {
+	if _, err := SplitAVCC(data, lengthSize); err == nil {
+		return FormatAVCC
+	}
+	if bytes.HasPrefix(data, []byte{0, 0, 1}) || bytes.HasPrefix(data, annexBStartCode) {
+		return FormatAnnexB
+	}
+	return FormatUnknown
+}
+
+// SplitAVCC returns the NAL units in a length-prefixed access unit.
+// lengthSize is 1, 2 or 4 bytes (default 4 when 0).
+func SplitAVCC(data []byte, lengthSize int) ([][]byte, error) {
+	if lengthSize == 0 {
+		lengthSize = 4
+	}
+	if lengthSize != 1 && lengthSize != 2 && lengthSize != 4 {
+		return nil, fmt.Errorf("bitstream: invalid NAL length size %d", lengthSize)
+	}
+	if len(data) == 0 {
+		return nil, errTruncated
+	}
+
+	var nals [][]byte
+	for len(data) > 0 {
+		if len(data) < lengthSize {
+			return nil, errTruncated
+		}
+		var n uint32
+		switch lengthSize {
+		case 1:
+			n = uint32(data[0])
+		case 2:
+			n = uint32(binary.BigEndian.Uint16(data))
+		case 4:
+			n = binary.BigEndian.Uint32(data)
+		}
+		data = data[lengthSize:]
+		if n == 0 || uint64(n) > uint64(len(data)) {
+			return nil, errTruncated
+		}
+		nal := data[:n]
+		// forbidden_zero_bit is the top bit of both H.264 and H.265 headers
+		if nal[0]&0x80 != 0 {
+			return nil, errors.New("bitstream: forbidden_zero_bit set")
+		}
+		nals = append(nals, nal)
+		data = data[n:]
+	}
+	return nals, nil
+}
+
+// JoinAnnexB concatenates NAL units with 4-byte start codes
+func JoinAnnexB(nals [][]byte) []byte {
+	size := 0
+	for _, nal := range nals {
+		size += len(annexBStartCode) + len(nal)
+	}
+	out := make([]byte, 0, size)
+	for _, nal := range nals {
+		out = append(out, annexBStartCode...)
+		out = append(out, nal...)
+	}
+	return out
+}
+
+// JoinAVCC concatenates NAL units with lengthSize-byte length prefixes
+func JoinAVCC(nals [][]byte, lengthSize int) ([]byte, error) {
+	if lengthSize == 0 {
+		lengthSize = 4
+	}
+	size := 0
+	for _, nal := range nals {
+		if uint64(len(nal)) >= 1<<(8*lengthSize) {
+			return nil, fmt.Errorf("bitstream: %d-byte NAL unit does not fit a %d-byte length", len(nal), lengthSize)
+		}
+		size += lengthSize + len(nal)
+	}
+
+	out := make([]byte, 0, size)
+	for _, nal := range nals {
+		switch lengthSize {
+		case 1:
+			out = append(out, byte(len(nal)))
+		case 2:
+			out = binary.BigEndian.AppendUint16(out, uint16(len(nal)))
+		case 4:
+			out = binary.BigEndian.AppendUint32(out, uint32(len(nal)))
+		default:
+			return nil, fmt.Errorf("bitstream: invalid NAL length size %d", lengthSize)
+		}
+		out = append(out, nal...)
+	}
+	return out, nil
+}
+
+// AVCCToAnnexB converts a length-prefixed access unit to Annex-B
+func AVCCToAnnexB(data []byte, lengthSize int) ([]byte, error) {
+	nals, err := SplitAVCC(data, lengthSize)
+	if err != nil {
+		return nil, err
+	}
+	return JoinAnnexB(nals), nil
+}
+
+// AnnexBToAVCC converts an Annex-B access unit to length-prefixed framing
+func AnnexBToAVCC(data []byte, lengthSize int) ([]byte, error) {
+	return JoinAVCC(SplitAnnexB(data), lengthSize)
+}
+
+// DecoderConfig is the content of an MP4 decoder configuration record
+// (avcC or hvcC) relevant to framing
+type DecoderConfig struct {
+	LengthSize    int      // NAL length prefix size in bytes
+	ParameterSets [][]byte // VPS/SPS/PPS NAL units, in record order
+}
+
+// ParseDecoderConfig parses an avcC ("h264") or hvcC ("hevc") record
+func ParseDecoderConfig(codec string, record []byte) (DecoderConfig, error) {
+	switch codec {
+	case "h264":
+		return parseAVCDecoderConfig(record)
+	case "hevc":
+		return parseHEVCDecoderConfig(record)
+	default:
+		return DecoderConfig{}, fmt.Errorf("bitstream: unsupported codec %q", codec)
+	}
+}
+
+// parseAVCDecoderConfig parses an AVCDecoderConfigurationRecord (ISO/IEC
+// 14496-15 5.3.3.1)
+func parseAVCDecoderConfig(b []byte) (DecoderConfig, error) {
+	if len(b) < 6 {
+		return DecoderConfig{}, errTruncated
+	}
+	if b[0] != 1 {
+		return DecoderConfig{}, fmt.Errorf("bitstream: unsupported avcC version %d", b[0])
+	}
+
+	cfg := DecoderConfig{LengthSize: int(b[4]&0x03) + 1}
+	r := recordReader{data: b[5:]}
+
+	numSPS := int(r.u8() & 0x1F)
+	for i := 0; i < numSPS; i++ {
+		cfg.ParameterSets = append(cfg.ParameterSets, r.nal())
+	}
+	numPPS := int(r.u8())
+	for i := 0; i < numPPS; i++ {
+		cfg.ParameterSets = append(cfg.ParameterSets, r.nal())
+	}
+	if r.err != nil {
+		return DecoderConfig{}, r.err
+	}
+	return cfg, nil
+}
+
+// parseHEVCDecoderConfig parses an HEVCDecoderConfigurationRecord (ISO/IEC
+// 14496-15 8.3.3.1)
+func parseHEVCDecoderConfig(b []byte) (DecoderConfig, error) {
+	if len(b) < 23 {
+		return DecoderConfig{}, errTruncated
+	}
+	if b[0] != 1 {
+		return DecoderConfig{}, fmt.Errorf("bitstream: unsupported hvcC version %d", b[0])
+	}
+
+	cfg := DecoderConfig{LengthSize: int(b[21]&0x03) + 1}
+	r := recordReader{data: b[22:]}
+
+	numArrays := int(r.u8())
+	for i := 0; i < numArrays; i++ {
+		r.u8() // array_completeness, NAL_unit_type
+		numNALs := int(r.u16())
+		for j := 0; j < numNALs; j++ {
+			cfg.ParameterSets = append(cfg.ParameterSets, r.nal())
+		}
+	}
+	if r.err != nil {
+		return DecoderConfig{}, r.err
+	}
+	return cfg, nil
+}
+
+// BuildDecoderConfig builds an avcC ("h264") or hvcC ("hevc") record with
+// 4-byte NAL lengths from the stream's parameter sets, for MP4 sample
+// entries. The first SPS supplies profile and level.
+func BuildDecoderConfig(codec string, paramSets [][]byte) ([]byte, error) {
+	switch codec {
+	case "h264":
+		return buildAVCDecoderConfig(paramSets)
+	case "hevc":
+		return buildHEVCDecoderConfig(paramSets)
+	default:
+		return nil, fmt.Errorf("bitstream: unsupported codec %q", codec)
+	}
+}
+
+func buildAVCDecoderConfig(paramSets [][]byte) ([]byte, error) {
+	var sps, pps [][]byte
+	for _, nal := range paramSets {
+		switch {
+		case len(nal) == 0:
+		case nal[0]&0x1F == H264NALSPS:
+			sps = append(sps, nal)
+		case nal[0]&0x1F == H264NALPPS:
+			pps = append(pps, nal)
+		}
+	}
+	if len(sps) == 0 || len(pps) == 0 || len(sps[0]) < 4 || len(sps) > 31 || len(pps) > 255 {
+		return nil, errors.New("bitstream: avcC needs an SPS and a PPS")
+	}
+
+	// Profile, constraint flags and level come straight from the SPS
+	b := []byte{1, sps[0][1], sps[0][2], sps[0][3], 0xFC | 3, 0xE0 | byte(len(sps))}
+	for _, nal := range sps {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(nal)))
+		b = append(b, nal...)
+	}
+	b = append(b, byte(len(pps)))
+	for _, nal := range pps {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(nal)))
+		b = append(b, nal...)
+	}
+	return b, nil
+}
+
+func buildHEVCDecoderConfig(paramSets [][]byte) ([]byte, error) {
+	arrays := map[int][][]byte{}
+	for _, nal := range paramSets {
+		switch t := H265NALType(nal); t {
+		case H265NALVPS, H265NALSPS, H265NALPPS:
+			arrays[t] = append(arrays[t], nal)
+		}
+	}
+	if len(arrays[H265NALVPS]) == 0 || len(arrays[H265NALSPS]) == 0 || len(arrays[H265NALPPS]) == 0 {
+		return nil, errors.New("bitstream: hvcC needs a VPS, an SPS and a PPS")
+	}
+	sps, err := ParseH265SPS(arrays[H265NALSPS][0])
+	if err != nil {
+		return nil, err
+	}
+
+	b := []byte{1}
+	b = append(b, sps.ProfileTierLevel[:]...)
+	b = append(b,
+		0xF0, 0x00, // min_spatial_segmentation_idc
+		0xFC,                        // parallelismType unknown
+		0xFC|sps.ChromaFormat&0x03,  // chroma_format_idc
+		0xF8|(sps.BitDepthLuma-8)&7, // bit_depth_luma_minus8
+		0xF8|(sps.BitDepthChroma-8)&7,
+		0x00, 0x00, // avgFrameRate unknown
+		0x0F, // numTemporalLayers 1, temporalIdNested, 4-byte lengths
+		3,    // numOfArrays
+	)
+	for _, t := range []int{H265NALVPS, H265NALSPS, H265NALPPS} {
+		b = append(b, 0x80|byte(t)) // array_completeness
+		b = binary.BigEndian.AppendUint16(b, uint16(len(arrays[t])))
+		for _, nal := range arrays[t] {
+			b = binary.BigEndian.AppendUint16(b, uint16(len(nal)))
+			b = append(b, nal...)
+		}
+	}
+	return b, nil
+}
+
+// recordReader reads fields of a decoder configuration record, remembering
+// the first error
+type recordReader struct {
+	data []byte
+	err  error
+}
+
+func (r *recordReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.data) < n {
+		r.err = errTruncated
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *recordReader) u8() uint8 {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *recordReader) u16() uint16 {
+	if b := r.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// nal reads a 16-bit length-prefixed NAL unit
+func (r *recordReader) nal() []byte {
+	n := int(r.u16())
+	return bytes.Clone(r.take(n))
+}
+
+// Normalizer converts a producer's access units to Annex-B, the form used
+// everywhere inside the gateway and expected by the RTP packetizers.
+// Length-prefixed producers usually carry parameter sets only in their
+// decoder configuration record, so those are re-inserted ahead of keyframes
+// that lack them.
+//
+// A Normalizer is not safe for concurrent use.
+type Normalizer struct {
+	codec  string
+	format Format // FormatUnknown detects per access unit
+	config DecoderConfig
+
+	// Statistics
+	converted uint64
+	inserted  uint64
+}
+
+// NewNormalizer creates a normalizer for codec ("h264" or "hevc"). format
+// fixes the input framing, or FormatUnknown to detect it per access unit.
+// record is the optional avcC/hvcC decoder configuration record.
+func NewNormalizer(codec string, format Format, record []byte) (*Normalizer, error) {
+	n := &Normalizer{codec: codec, format: format, config: DecoderConfig{LengthSize: 4}}
+	if len(record) > 0 {
+		cfg, err := ParseDecoderConfig(codec, record)
+		if err != nil {
+			return nil, err
+		}
+		n.config = cfg
+	}
+	return n, nil
+}
+
+// Normalize returns au in Annex-B form along with the framing it arrived in.
+// Annex-B input without missing parameter sets is returned unchanged.
+func (n *Normalizer) Normalize(au []byte, keyframe bool) ([]byte, Format, error) {
+	format := n.format
+	if format == FormatUnknown {
+		format = DetectFormat(au, n.config.LengthSize)
+	}
+
+	var nals [][]byte
+	switch format {
+	case FormatAnnexB:
+		if !keyframe || len(n.config.ParameterSets) == 0 {
+			return au, format, nil
+		}
+		nals = SplitAnnexB(au)
+	case FormatAVCC:
+		var err error
+		nals, err = SplitAVCC(au, n.config.LengthSize)
+		if err != nil {
+			return nil, format, err
+		}
+		n.converted++
+	default:
+		return nil, format, errors.New("bitstream: unrecognised access unit framing")
+	}
+
+	if keyframe && len(n.config.ParameterSets) > 0 && !n.hasParameterSets(nals) {
+		nals = append(append([][]byte(nil), n.config.ParameterSets...), nals...)
+		n.inserted++
+	} else if format == FormatAnnexB {
+		return au, format, nil
+	}
+	return JoinAnnexB(nals), format, nil
+}
+
+// Stats returns how many access units were converted from length-prefixed
+// framing and how many had parameter sets inserted
+func (n *Normalizer) Stats() (converted, inserted uint64) {
+	return n.converted, n.inserted
+}
+
+// hasParameterSets reports whether an access unit carries an SPS
+func (n *Normalizer) hasParameterSets(nals [][]byte) bool {
+	for _, nal := range nals {
+		switch n.codec {
+		case "h264":
+			if nal[0]&0x1F == H264NALSPS {
+				return true
+			}
+		case "hevc":
+			if H265NALType(nal) == H265NALSPS {
+				return true
+			}
+		}
+	}
+	return false
+}
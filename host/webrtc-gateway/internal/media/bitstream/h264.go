@@ -0,0 +1,198 @@
+package bitstream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// H.264 NAL unit types
+const (
+	H264NALSPS = 7
+	H264NALPPS = 8
+)
+
+// H264SPS holds the fields of an H.264 sequence parameter set the gateway
+// uses
+type H264SPS struct {
+	ProfileIDC  uint8
+	Constraints uint8 // constraint_set0..5 flags and reserved bits
+	LevelIDC    uint8
+	Width       int     // Display width after cropping
+	Height      int     // Display height after cropping
+	FPS         float64 // From VUI timing info; 0 if absent
+	BitDepth    uint8   // Luma bit depth; 8 below the High profiles
+}
+
+// ProfileLevelID returns the SDP profile-level-id (RFC 6184)
+func (s H264SPS) ProfileLevelID() string {
+	return fmt.Sprintf("%02x%02x%02x", s.ProfileIDC, s.Constraints, s.LevelIDC)
+}
+
+// Fmtp returns an SDP fmtp line for packetization mode 1
+func (s H264SPS) Fmtp() string {
+	return "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + s.ProfileLevelID()
+}
+
+// h264HighProfiles have chroma format and bit depth fields in the SPS
+var h264HighProfiles = map[uint8]bool{
+	100: true, 110: true, 122: true, 244: true, 44: true, 83: true,
+	86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true,
+}
+
+// ParseH264SPS parses an SPS NAL unit, including its header byte
+func ParseH264SPS(nal []byte) (H264SPS, error) {
+	if len(nal) < 4 || nal[0]&0x1F != H264NALSPS {
+		return H264SPS{}, errors.New("bitstream: not an H.264 SPS")
+	}
+
+	r := &bitReader{data: unescapeRBSP(nal[1:])}
+	s := H264SPS{BitDepth: 8}
+	s.ProfileIDC = uint8(r.u(8))
+	s.Constraints = uint8(r.u(8))
+	s.LevelIDC = uint8(r.u(8))
+	r.ue() // seq_parameter_set_id
+
+	chromaFormat := uint32(1)
+	separateColourPlane := false
+	if h264HighProfiles[s.ProfileIDC] {
+		chromaFormat = r.ue()
+		if chromaFormat == 3 {
+			separateColourPlane = r.flag()
+		}
+		s.BitDepth = uint8(r.ue()) + 8
+		r.ue()        // bit_depth_chroma_minus8
+		r.u(1)        // qpprime_y_zero_transform_bypass_flag
+		if r.flag() { // seq_scaling_matrix_present_flag
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.flag() {
+					size := 16
+					if i >= 6 {
+						size = 64
+					}
+					skipH264ScalingList(r, size)
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		r.u(1) // delta_pic_order_always_zero_flag
+		r.se() // offset_for_non_ref_pic
+		r.se() // offset_for_top_to_bottom_field
+		n := r.ue()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			r.se()
+		}
+	}
+	r.ue() // max_num_ref_frames
+	r.u(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMbsOnly := r.flag()
+	if !frameMbsOnly {
+		r.u(1) // mb_adaptive_frame_field_flag
+	}
+	r.u(1) // direct_8x8_inference_flag
+
+	frameHeightMul := 2
+	if frameMbsOnly {
+		frameHeightMul = 1
+	}
+	s.Width = widthMbs * 16
+	s.Height = heightMapUnits * 16 * frameHeightMul
+
+	if r.flag() { // frame_cropping_flag
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+
+		cropX, cropY := 1, frameHeightMul
+		if chromaFormat != 0 && !separateColourPlane {
+			subWidth, subHeight := 2, 2
+			switch chromaFormat {
+			case 2:
+				subHeight = 1
+			case 3:
+				subWidth, subHeight = 1, 1
+			}
+			cropX = subWidth
+			cropY = subHeight * frameHeightMul
+		}
+		s.Width -= cropX * (left + right)
+		s.Height -= cropY * (top + bottom)
+	}
+
+	if r.flag() { // vui_parameters_present_flag
+		s.FPS = parseH264VUITiming(r)
+	}
+
+	if r.err != nil {
+		return H264SPS{}, r.err
+	}
+	if s.Width <= 0 || s.Height <= 0 {
+		return H264SPS{}, errors.New("bitstream: invalid SPS dimensions")
+	}
+	return s, nil
+}
+
+// skipH264ScalingList skips a scaling_list() structure
+func skipH264ScalingList(r *bitReader, size int) {
+	last, next := int32(8), int32(8)
+	for i := 0; i < size && r.err == nil; i++ {
+		if next != 0 {
+			next = (last + r.se() + 256) % 256
+		}
+		if next != 0 {
+			last = next
+		}
+	}
+}
+
+// parseH264VUITiming reads VUI up to the timing info and returns the frame
+// rate, or 0 if not signalled
+func parseH264VUITiming(r *bitReader) float64 {
+	skipVUIHeader(r)
+
+	if !r.flag() { // timing_info_present_flag
+		return 0
+	}
+	unitsInTick := r.u(32)
+	timeScale := r.u(32)
+	if r.err != nil || unitsInTick == 0 {
+		return 0
+	}
+	// H.264 ticks are fields
+	return float64(timeScale) / float64(2*unitsInTick)
+}
+
+// skipVUIHeader skips the aspect ratio, overscan, video signal type and
+// chroma location fields common to H.264 and H.265 VUI
+func skipVUIHeader(r *bitReader) {
+	if r.flag() { // aspect_ratio_info_present_flag
+		if r.u(8) == 255 { // Extended_SAR
+			r.u(16)
+			r.u(16)
+		}
+	}
+	if r.flag() { // overscan_info_present_flag
+		r.u(1)
+	}
+	if r.flag() { // video_signal_type_present_flag
+		r.u(3) // video_format
+		r.u(1) // video_full_range_flag
+		if r.flag() {
+			r.u(24) // colour_primaries, transfer_characteristics, matrix_coefficients
+		}
+	}
+	if r.flag() { // chroma_loc_info_present_flag
+		r.ue()
+		r.ue()
+	}
+}
@@ -0,0 +1,271 @@
+package bitstream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// H.265 NAL unit types
+const (
+	H265NALVPS = 32
+	H265NALSPS = 33
+	H265NALPPS = 34
+)
+
+// H265SPS holds the fields of an H.265 sequence parameter set the gateway
+// uses
+type H265SPS struct {
+	ProfileSpace uint8
+	TierFlag     uint8
+	ProfileIDC   uint8
+	LevelIDC     uint8   // 30 times the level number, e.g. 93 for 3.1
+	Width        int     // Display width after the conformance window
+	Height       int     // Display height after the conformance window
+	FPS          float64 // From VUI timing info; 0 if absent
+
+	ChromaFormat   uint8 // chroma_format_idc; 1 is 4:2:0
+	BitDepthLuma   uint8
+	BitDepthChroma uint8
+
+	// ProfileTierLevel is the raw general profile_tier_level: profile,
+	// compatibility flags, constraint flags and level, as copied into hvcC
+	ProfileTierLevel [12]byte
+}
+
+// Fmtp returns an SDP fmtp line (RFC 7798)
+func (s H265SPS) Fmtp() string {
+	return fmt.Sprintf("profile-id=%d;tier-flag=%d;level-id=%d", s.ProfileIDC, s.TierFlag, s.LevelIDC)
+}
+
+// H265NALType returns the type of an H.265 NAL unit
+func H265NALType(nal []byte) int {
+	if len(nal) == 0 {
+		return -1
+	}
+	return int(nal[0]>>1) & 0x3F
+}
+
+// H265LayerID returns the nuh_layer_id of an H.265 NAL unit. Layers above
+// 0 are enhancement or auxiliary layers, such as an alpha channel.
+func H265LayerID(nal []byte) int {
+	if len(nal) < 2 {
+		return -1
+	}
+	return int(nal[0]&0x01)<<5 | int(nal[1]>>3)
+}
+
+// ParseH265SPS parses an SPS NAL unit, including its two-byte header
+func ParseH265SPS(nal []byte) (H265SPS, error) {
+	if len(nal) < 3 || H265NALType(nal) != H265NALSPS {
+		return H265SPS{}, errors.New("bitstream: not an H.265 SPS")
+	}
+
+	rbsp := unescapeRBSP(nal[2:])
+	r := &bitReader{data: rbsp}
+	var s H265SPS
+	if len(rbsp) >= 13 {
+		copy(s.ProfileTierLevel[:], rbsp[1:13])
+	}
+
+	r.u(4) // sps_video_parameter_set_id
+	maxSubLayers := int(r.u(3)) + 1
+	r.u(1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level(1, sps_max_sub_layers_minus1)
+	s.ProfileSpace = uint8(r.u(2))
+	s.TierFlag = uint8(r.u(1))
+	s.ProfileIDC = uint8(r.u(5))
+	r.skip(32) // general_profile_compatibility_flags
+	r.skip(48) // source flags and reserved constraint bits
+	s.LevelIDC = uint8(r.u(8))
+	subProfile := make([]bool, maxSubLayers-1)
+	subLevel := make([]bool, maxSubLayers-1)
+	for i := range subProfile {
+		subProfile[i] = r.flag()
+		subLevel[i] = r.flag()
+	}
+	if maxSubLayers > 1 {
+		for i := maxSubLayers - 1; i < 8; i++ {
+			r.u(2) // reserved_zero_2bits
+		}
+	}
+	for i := range subProfile {
+		if subProfile[i] {
+			r.skip(88)
+		}
+		if subLevel[i] {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	chromaFormat := r.ue()
+	s.ChromaFormat = uint8(chromaFormat)
+	if chromaFormat == 3 {
+		r.u(1) // separate_colour_plane_flag
+	}
+	s.Width = int(r.ue())
+	s.Height = int(r.ue())
+	if r.flag() { // conformance_window_flag
+		left, right, top, bottom := int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+		subWidth, subHeight := 1, 1
+		switch chromaFormat {
+		case 1:
+			subWidth, subHeight = 2, 2
+		case 2:
+			subWidth = 2
+		}
+		s.Width -= subWidth * (left + right)
+		s.Height -= subHeight * (top + bottom)
+	}
+
+	s.BitDepthLuma = uint8(r.ue()) + 8
+	s.BitDepthChroma = uint8(r.ue()) + 8
+	log2MaxPOCLsb := int(r.ue()) + 4
+	first := maxSubLayers - 1
+	if r.flag() { // sps_sub_layer_ordering_info_present_flag
+		first = 0
+	}
+	for i := first; i < maxSubLayers; i++ {
+		r.ue() // sps_max_dec_pic_buffering_minus1
+		r.ue() // sps_max_num_reorder_pics
+		r.ue() // sps_max_latency_increase_plus1
+	}
+	r.ue()        // log2_min_luma_coding_block_size_minus3
+	r.ue()        // log2_diff_max_min_luma_coding_block_size
+	r.ue()        // log2_min_luma_transform_block_size_minus2
+	r.ue()        // log2_diff_max_min_luma_transform_block_size
+	r.ue()        // max_transform_hierarchy_depth_inter
+	r.ue()        // max_transform_hierarchy_depth_intra
+	if r.flag() { // scaling_list_enabled_flag
+		if r.flag() { // sps_scaling_list_data_present_flag
+			skipH265ScalingListData(r)
+		}
+	}
+	r.u(1)        // amp_enabled_flag
+	r.u(1)        // sample_adaptive_offset_enabled_flag
+	if r.flag() { // pcm_enabled_flag
+		r.u(4)
+		r.u(4)
+		r.ue()
+		r.ue()
+		r.u(1)
+	}
+
+	numSets := int(r.ue())
+	if numSets > 64 {
+		return H265SPS{}, errors.New("bitstream: invalid num_short_term_ref_pic_sets")
+	}
+	deltaPOCs := make([]int, numSets)
+	for i := 0; i < numSets && r.err == nil; i++ {
+		deltaPOCs[i] = skipH265ShortTermRefPicSet(r, i, numSets, deltaPOCs)
+	}
+	if r.flag() { // long_term_ref_pics_present_flag
+		n := int(r.ue())
+		for i := 0; i < n && r.err == nil; i++ {
+			r.u(log2MaxPOCLsb)
+			r.u(1)
+		}
+	}
+	r.u(1) // sps_temporal_mvp_enabled_flag
+	r.u(1) // strong_intra_smoothing_enabled_flag
+
+	if r.flag() { // vui_parameters_present_flag
+		s.FPS = parseH265VUITiming(r)
+	}
+
+	if r.err != nil {
+		return H265SPS{}, r.err
+	}
+	if s.Width <= 0 || s.Height <= 0 {
+		return H265SPS{}, errors.New("bitstream: invalid SPS dimensions")
+	}
+	return s, nil
+}
+
+// skipH265ScalingListData skips scaling_list_data()
+func skipH265ScalingListData(r *bitReader) {
+	for sizeID := 0; sizeID < 4; sizeID++ {
+		step := 1
+		if sizeID == 3 {
+			step = 3
+		}
+		for matrixID := 0; matrixID < 6; matrixID += step {
+			if !r.flag() { // scaling_list_pred_mode_flag
+				r.ue() // scaling_list_pred_matrix_id_delta
+				continue
+			}
+			coefs := min(64, 1<<(4+(sizeID<<1)))
+			if sizeID > 1 {
+				r.se() // scaling_list_dc_coef_minus8
+			}
+			for i := 0; i < coefs && r.err == nil; i++ {
+				r.se()
+			}
+		}
+	}
+}
+
+// skipH265ShortTermRefPicSet skips st_ref_pic_set(idx) and returns its
+// NumDeltaPocs
+func skipH265ShortTermRefPicSet(r *bitReader, idx, numSets int, deltaPOCs []int) int {
+	if idx != 0 && r.flag() { // inter_ref_pic_set_prediction_flag
+		delta := 1
+		if idx == numSets {
+			delta = int(r.ue()) + 1
+		}
+		r.u(1) // delta_rps_sign
+		r.ue() // abs_delta_rps_minus1
+		ref := idx - delta
+		if ref < 0 {
+			r.err = errors.New("bitstream: invalid delta_idx")
+			return 0
+		}
+		n := 0
+		for j := 0; j <= deltaPOCs[ref] && r.err == nil; j++ {
+			used := r.flag()
+			if used || r.flag() { // use_delta_flag
+				n++
+			}
+		}
+		return n
+	}
+
+	negative := int(r.ue())
+	positive := int(r.ue())
+	if negative > 16 || positive > 16 {
+		r.err = errors.New("bitstream: invalid short-term ref pic set")
+		return 0
+	}
+	for i := 0; i < negative+positive && r.err == nil; i++ {
+		r.ue() // delta_poc_minus1
+		r.u(1) // used_by_curr_pic_flag
+	}
+	return negative + positive
+}
+
+// parseH265VUITiming reads VUI up to the timing info and returns the frame
+// rate, or 0 if not signalled
+func parseH265VUITiming(r *bitReader) float64 {
+	skipVUIHeader(r)
+
+	r.u(1)        // neutral_chroma_indication_flag
+	r.u(1)        // field_seq_flag
+	r.u(1)        // frame_field_info_present_flag
+	if r.flag() { // default_display_window_flag
+		r.ue()
+		r.ue()
+		r.ue()
+		r.ue()
+	}
+
+	if !r.flag() { // vui_timing_info_present_flag
+		return 0
+	}
+	unitsInTick := r.u(32)
+	timeScale := r.u(32)
+	if r.err != nil || unitsInTick == 0 {
+		return 0
+	}
+	return float64(timeScale) / float64(unitsInTick)
+}
@@ -0,0 +1,120 @@
+package bitstream
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+)
+
+// Params are stream properties read from a parameter set
+type Params struct {
+	Codec    string  `json:"codec"` // "h264", "hevc", "vp9" or "av1"
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	FPS      float64 `json:"fps,omitempty"` // 0 when the stream does not signal it
+	Profile  int     `json:"profile"`
+	Level    int     `json:"level"` // level_idc as coded; seq_level_idx for AV1
+	BitDepth int     `json:"bit_depth"`
+	Fmtp     string  `json:"fmtp"` // SDP fmtp parameters for the stream
+}
+
+// FindParams parses the first SPS in an Annex-B access unit, the header of
+// a VP9 keyframe, or the sequence header in an AV1 temporal unit. ok is
+// false when there is none, as in frames that are not keyframes.
+func FindParams(codec string, au []byte) (p Params, ok bool, err error) {
+	switch codec {
+	case "vp9":
+		return findVP9Params(au)
+	case "av1":
+		return findAV1Params(au)
+	}
+	for _, nal := range SplitAnnexB(au) {
+		switch codec {
+		case "h264":
+			if nal[0]&0x1F != H264NALSPS {
+				continue
+			}
+			sps, err := ParseH264SPS(nal)
+			if err != nil {
+				return Params{}, false, err
+			}
+			return Params{
+				Codec:    codec,
+				Width:    sps.Width,
+				Height:   sps.Height,
+				FPS:      sps.FPS,
+				Profile:  int(sps.ProfileIDC),
+				Level:    int(sps.LevelIDC),
+				BitDepth: int(sps.BitDepth),
+				Fmtp:     sps.Fmtp(),
+			}, true, nil
+		case "hevc":
+			if H265NALType(nal) != H265NALSPS {
+				continue
+			}
+			sps, err := ParseH265SPS(nal)
+			if err != nil {
+				return Params{}, false, err
+			}
+			return Params{
+				Codec:    codec,
+				Width:    sps.Width,
+				Height:   sps.Height,
+				FPS:      sps.FPS,
+				Profile:  int(sps.ProfileIDC),
+				Level:    int(sps.LevelIDC),
+				BitDepth: int(sps.BitDepthLuma),
+				Fmtp:     sps.Fmtp(),
+			}, true, nil
+		default:
+			return Params{}, false, fmt.Errorf("bitstream: unsupported codec %q", codec)
+		}
+	}
+	return Params{}, false, nil
+}
+
+// Mismatches compares p with declared stream properties and describes each
+// difference. Zero declared values are not checked.
+func (p Params) Mismatches(width, height int, fps float64) []string {
+	var out []string
+	if width > 0 && height > 0 && (p.Width != width || p.Height != height) {
+		out = append(out, fmt.Sprintf("resolution %dx%d, declared %dx%d", p.Width, p.Height, width, height))
+	}
+	// Allow for 59.94 vs 60 and similar
+	if fps > 0 && p.FPS > 0 && math.Abs(p.FPS-fps) > 0.5 {
+		out = append(out, fmt.Sprintf("frame rate %.2f, declared %.2f", p.FPS, fps))
+	}
+	return out
+}
+
+// DetectCodec identifies the codec of an Annex-B access unit or VP9 frame
+// from the parameter sets or keyframe header it carries. It returns "" when
+// the data does not say, as for most frames that are not keyframes.
+func DetectCodec(data []byte) string {
+	if bytes.HasPrefix(data, []byte{0, 0, 1}) || bytes.HasPrefix(data, annexBStartCode) {
+		for _, nal := range SplitAnnexB(data) {
+			// An HEVC parameter set header (layer 0, temporal ID 1) is a
+			// reserved H.264 NAL type, and an H.264 SPS a reserved HEVC one
+			if len(nal) > 2 && nal[0]&0x81 == 0 && nal[1] == 1 {
+				if H265NALType(nal) == H265NALSPS {
+					if _, err := ParseH265SPS(nal); err == nil {
+						return "hevc"
+					}
+				}
+			}
+			if nal[0]&0x9F == H264NALSPS {
+				if _, err := ParseH264SPS(nal); err == nil {
+					return "h264"
+				}
+			}
+		}
+		return ""
+	}
+
+	if frames, err := SplitVP9Superframe(data); err == nil {
+		if h, err := ParseVP9FrameHeader(frames[0]); err == nil && h.Keyframe {
+			return "vp9"
+		}
+	}
+	return ""
+}
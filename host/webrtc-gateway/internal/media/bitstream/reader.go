@@ -0,0 +1,104 @@
+// Package bitstream parses H.264 and H.265 parameter sets, VP9 frame
+// headers and AV1 sequence headers, so stream properties (resolution,
+// profile, level, bit depth, frame rate) can be taken from the bitstream
+// itself rather than from configuration. It also converts between
+// Annex-B and length-prefixed (AVCC/HVCC) NAL framing.
+package bitstream
+
+import "errors"
+
+var errTruncated = errors.New("bitstream: truncated")
+
+// unescapeRBSP removes emulation prevention bytes (00 00 03 -> 00 00)
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// bitReader reads big-endian bits and Exp-Golomb codes. Reads past the end
+// set err and return zero, so parsers can check once at the end.
+type bitReader struct {
+	data []byte
+	pos  int // Bit position
+	err  error
+}
+
+func (r *bitReader) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = errTruncated
+			return 0
+		}
+		bit := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) flag() bool {
+	return r.u(1) == 1
+}
+
+func (r *bitReader) skip(n int) {
+	for n > 0 && r.err == nil {
+		step := min(n, 32)
+		r.u(step)
+		n -= step
+	}
+}
+
+// ue reads an unsigned Exp-Golomb code
+func (r *bitReader) ue() uint32 {
+	zeros := 0
+	for !r.flag() {
+		if r.err != nil || zeros > 31 {
+			r.err = errTruncated
+			return 0
+		}
+		zeros++
+	}
+	if zeros == 0 {
+		return 0
+	}
+	return (1<<zeros - 1) + r.u(zeros)
+}
+
+// se reads a signed Exp-Golomb code
+func (r *bitReader) se() int32 {
+	v := r.ue()
+	if v%2 == 1 {
+		return int32(v/2 + 1)
+	}
+	return -int32(v / 2)
+}
+
+// uvlc reads an AV1 variable-length unsigned code
+func (r *bitReader) uvlc() uint32 {
+	zeros := 0
+	for !r.flag() {
+		if r.err != nil || zeros >= 32 {
+			r.err = errTruncated
+			return 0
+		}
+		zeros++
+	}
+	if zeros == 0 {
+		return 0
+	}
+	return (1<<zeros - 1) + r.u(zeros)
+}
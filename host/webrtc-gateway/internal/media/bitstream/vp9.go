@@ -0,0 +1,169 @@
+package bitstream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// vp9SyncCode starts every VP9 keyframe after the frame type flags
+const vp9SyncCode = 0x498342
+
+// VP9 color spaces
+const vp9ColorSpaceRGB = 7
+
+// VP9FrameHeader holds the fields of a VP9 uncompressed frame header the
+// gateway uses. Size and color fields are only present on keyframes.
+type VP9FrameHeader struct {
+	Profile      uint8
+	ShowExisting bool // Repeats an earlier frame; nothing else is coded
+	Keyframe     bool
+	ShowFrame    bool
+	BitDepth     uint8 // 8, 10 or 12
+	ColorSpace   uint8
+	FullRange    bool
+	Width        int // Render width
+	Height       int // Render height
+	CodedWidth   int
+	CodedHeight  int
+}
+
+// Fmtp returns an SDP fmtp line (RFC 9628)
+func (h VP9FrameHeader) Fmtp() string {
+	return fmt.Sprintf("profile-id=%d", h.Profile)
+}
+
+// ParseVP9FrameHeader parses the uncompressed header at the start of a VP9
+// frame. A superframe should be split first; its first frame is parsed
+// otherwise.
+func ParseVP9FrameHeader(frame []byte) (VP9FrameHeader, error) {
+	r := &bitReader{data: frame}
+	if r.u(2) != 2 {
+		return VP9FrameHeader{}, errors.New("bitstream: not a VP9 frame")
+	}
+
+	var h VP9FrameHeader
+	low := r.u(1)
+	h.Profile = uint8(r.u(1)<<1 | low)
+	if h.Profile == 3 {
+		r.skip(1)
+	}
+	if h.ShowExisting = r.flag(); h.ShowExisting {
+		r.skip(3)
+		return h, r.err
+	}
+	h.Keyframe = !r.flag()
+	h.ShowFrame = r.flag()
+	r.skip(1) // error_resilient_mode
+	if !h.Keyframe {
+		return h, r.err
+	}
+
+	if r.u(24) != vp9SyncCode {
+		if r.err != nil {
+			return VP9FrameHeader{}, r.err
+		}
+		return VP9FrameHeader{}, errors.New("bitstream: invalid VP9 sync code")
+	}
+
+	// color_config
+	h.BitDepth = 8
+	if h.Profile >= 2 {
+		h.BitDepth = 10
+		if r.flag() {
+			h.BitDepth = 12
+		}
+	}
+	h.ColorSpace = uint8(r.u(3))
+	if h.ColorSpace != vp9ColorSpaceRGB {
+		h.FullRange = r.flag()
+		if h.Profile == 1 || h.Profile == 3 {
+			r.skip(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else {
+		h.FullRange = true
+		if h.Profile == 1 || h.Profile == 3 {
+			r.skip(1)
+		}
+	}
+
+	// frame_size and render_size
+	h.CodedWidth = int(r.u(16)) + 1
+	h.CodedHeight = int(r.u(16)) + 1
+	h.Width, h.Height = h.CodedWidth, h.CodedHeight
+	if r.flag() {
+		h.Width = int(r.u(16)) + 1
+		h.Height = int(r.u(16)) + 1
+	}
+	if r.err != nil {
+		return VP9FrameHeader{}, r.err
+	}
+	return h, nil
+}
+
+// SplitVP9Superframe returns the frames in a VP9 superframe, or the whole
+// buffer when it has no superframe index. Scalable streams carry one
+// spatial layer per frame, lowest first.
+func SplitVP9Superframe(data []byte) ([][]byte, error) {
+	if len(data) == 0 {
+		return nil, errors.New("bitstream: empty VP9 frame")
+	}
+
+	marker := data[len(data)-1]
+	if marker&0xE0 != 0xC0 {
+		return [][]byte{data}, nil
+	}
+
+	frames := int(marker&0x07) + 1
+	sizeBytes := int((marker>>3)&0x03) + 1
+	indexSize := 2 + sizeBytes*frames
+	if len(data) < indexSize || data[len(data)-indexSize] != marker {
+		// Not a valid index; the byte belongs to the frame
+		return [][]byte{data}, nil
+	}
+
+	index := data[len(data)-indexSize+1 : len(data)-1]
+	payload := data[:len(data)-indexSize]
+	out := make([][]byte, 0, frames)
+	for i := 0; i < frames; i++ {
+		size := 0
+		for b := 0; b < sizeBytes; b++ {
+			size |= int(index[i*sizeBytes+b]) << (8 * b)
+		}
+		if size > len(payload) {
+			return nil, errors.New("bitstream: VP9 superframe index exceeds data")
+		}
+		out = append(out, payload[:size])
+		payload = payload[size:]
+	}
+	return out, nil
+}
+
+// findVP9Params reads the keyframe headers in a VP9 frame or superframe.
+// The largest layer gives the stream's resolution.
+func findVP9Params(data []byte) (p Params, ok bool, err error) {
+	frames, err := SplitVP9Superframe(data)
+	if err != nil {
+		return Params{}, false, err
+	}
+	for _, frame := range frames {
+		h, err := ParseVP9FrameHeader(frame)
+		if err != nil {
+			return Params{}, false, err
+		}
+		if !h.Keyframe || h.ShowExisting {
+			continue
+		}
+		if !ok || h.Width*h.Height > p.Width*p.Height {
+			p = Params{
+				Codec:    "vp9",
+				Width:    h.Width,
+				Height:   h.Height,
+				Profile:  int(h.Profile),
+				BitDepth: int(h.BitDepth),
+				Fmtp:     h.Fmtp(),
+			}
+			ok = true
+		}
+	}
+	return p, ok, nil
+}
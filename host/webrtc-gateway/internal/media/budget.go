@@ -0,0 +1,258 @@
+package media
+
+import (
+	"context"
+	"reflect"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// FrameBudgetConfig configures a FrameBudget
+type FrameBudgetConfig struct {
+	// Budget is the time a stage may spend on one frame. Zero follows the
+	// stream's frame interval, e.g. 16.7ms at 60fps.
+	Budget time.Duration
+
+	// ReportInterval is the least time between warnings about one stage
+	// going over budget, default 10s
+	ReportInterval time.Duration
+}
+
+// StageBudgetStats is the per-frame timing of one pipeline stage
+type StageBudgetStats struct {
+	Stage         string  `json:"stage"`
+	Frames        uint64  `json:"frames"`
+	MeanUs        int64   `json:"mean_us"`        // Moving average over about budgetWindow frames
+	PeakUs        int64   `json:"peak_us"`        // Longest in the last report interval or two
+	BudgetPercent float64 `json:"budget_percent"` // Mean as a share of the budget
+	OverBudget    uint64  `json:"over_budget"`    // Frames that took longer than the budget
+}
+
+// FrameBudgetStats is the timing of every stage against the frame budget
+type FrameBudgetStats struct {
+	BudgetUs int64              `json:"budget_us"` // 0 until the frame interval is known
+	Stages   []StageBudgetStats `json:"stages"`    // Most expensive first
+}
+
+// budgetWindow is about how many frames stage means are averaged over.
+// Frame gaps over maxBudgetInterval are pauses rather than a frame rate.
+const (
+	budgetWindow      = 32
+	maxBudgetInterval = 200 * time.Millisecond
+)
+
+// FrameBudget measures the time each pipeline stage spends per frame and
+// reports stages that take longer than a frame interval, the usual cause of
+// stutter. Stages also run with a pprof "stage" label, so CPU profiles from
+// /debug/pprof/profile can be split by stage with -tagfocus or -tags.
+type FrameBudget struct {
+	cfg    FrameBudgetConfig
+	logger zerolog.Logger
+
+	interval atomic.Int64 // Smoothed frame interval in nanoseconds
+
+	mu     sync.Mutex
+	stages map[string]*BudgetStage
+}
+
+// NewFrameBudget creates a frame budget
+func NewFrameBudget(cfg FrameBudgetConfig, logger zerolog.Logger) *FrameBudget {
+	// Apply defaults for zero values
+	if cfg.ReportInterval <= 0 {
+		cfg.ReportInterval = 10 * time.Second
+	}
+	return &FrameBudget{
+		cfg:    cfg,
+		logger: logger.With().Str("component", "frame_budget").Logger(),
+		stages: make(map[string]*BudgetStage),
+	}
+}
+
+// Stage returns the named stage, creating it on first use. A nil budget
+// returns a nil stage, which times nothing.
+func (b *FrameBudget) Stage(name string) *BudgetStage {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.stages[name]; ok {
+		return s
+	}
+	s := &BudgetStage{
+		budget: b,
+		name:   name,
+		labels: pprof.WithLabels(context.Background(), pprof.Labels("stage", name)),
+	}
+	b.stages[name] = s
+	return s
+}
+
+// Budget returns the time a stage may spend on a frame, zero while it is
+// not yet known
+func (b *FrameBudget) Budget() time.Duration {
+	if b.cfg.Budget > 0 {
+		return b.cfg.Budget
+	}
+	return time.Duration(b.interval.Load())
+}
+
+// observeInterval folds a frame interval into the budget. Variable frame
+// rate sources leave gaps when nothing changes on screen, so shorter
+// intervals are followed faster than longer ones, and pauses are ignored.
+func (b *FrameBudget) observeInterval(gap time.Duration) {
+	if b == nil || b.cfg.Budget > 0 || gap <= 0 || gap > maxBudgetInterval {
+		return
+	}
+	// Only the distribution goroutine writes the interval
+	prev := time.Duration(b.interval.Load())
+	switch {
+	case prev == 0:
+		prev = gap
+	case gap < prev:
+		prev += (gap - prev) / 4
+	default:
+		prev += (gap - prev) / budgetWindow
+	}
+	b.interval.Store(int64(prev))
+}
+
+// Stats returns every stage's timing, most expensive first
+func (b *FrameBudget) Stats() FrameBudgetStats {
+	budget := b.Budget()
+	b.mu.Lock()
+	stages := make([]*BudgetStage, 0, len(b.stages))
+	for _, s := range b.stages {
+		stages = append(stages, s)
+	}
+	b.mu.Unlock()
+
+	stats := FrameBudgetStats{BudgetUs: budget.Microseconds(), Stages: make([]StageBudgetStats, 0, len(stages))}
+	for _, s := range stages {
+		stats.Stages = append(stats.Stages, s.stats(budget))
+	}
+	sort.Slice(stats.Stages, func(i, j int) bool { return stats.Stages[i].MeanUs > stats.Stages[j].MeanUs })
+	return stats
+}
+
+// BudgetStage times one pipeline stage. Its methods do nothing on a nil
+// stage, so stages can be timed unconditionally.
+type BudgetStage struct {
+	budget *FrameBudget
+	name   string
+	labels context.Context // Carries the stage's pprof label
+
+	mu         sync.Mutex
+	frames     uint64
+	mean       float64 // Nanoseconds
+	peak       time.Duration
+	prevPeak   time.Duration // Peak of the previous report interval
+	peakSince  time.Time
+	over       uint64
+	unreported uint64 // Frames over budget since the last warning
+	reportedAt time.Time
+}
+
+// Begin starts timing a frame on the calling goroutine, which is labelled
+// with the stage until End. Stages timed this way must not nest.
+func (s *BudgetStage) Begin() time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	pprof.SetGoroutineLabels(s.labels)
+	return time.Now()
+}
+
+// End finishes timing a frame started with Begin
+func (s *BudgetStage) End(start time.Time) {
+	if s == nil {
+		return
+	}
+	took := time.Since(start)
+	pprof.SetGoroutineLabels(context.Background())
+	s.Observe(took)
+}
+
+// Observe records the time a frame took in the stage, for stages timed by
+// the caller
+func (s *BudgetStage) Observe(took time.Duration) {
+	if s == nil {
+		return
+	}
+	budget := s.budget.Budget()
+	now := time.Now()
+
+	s.mu.Lock()
+	s.frames++
+	weight := 1.0 / budgetWindow
+	if s.frames < budgetWindow {
+		weight = 1 / float64(s.frames)
+	}
+	s.mean += (float64(took) - s.mean) * weight
+	if now.Sub(s.peakSince) >= s.budget.cfg.ReportInterval {
+		s.prevPeak, s.peak, s.peakSince = s.peak, 0, now
+	}
+	s.peak = max(s.peak, took)
+
+	report := false
+	var count uint64
+	if budget > 0 && took > budget {
+		s.over++
+		s.unreported++
+		if now.Sub(s.reportedAt) >= s.budget.cfg.ReportInterval {
+			report, count = true, s.unreported
+			s.unreported, s.reportedAt = 0, now
+		}
+	}
+	mean := time.Duration(s.mean)
+	s.mu.Unlock()
+
+	if report {
+		s.budget.logger.Warn().
+			Str("stage", s.name).
+			Dur("took", took).
+			Dur("budget", budget).
+			Dur("mean", mean).
+			Uint64("frames_over", count).
+			Msg("Pipeline stage over its frame budget")
+	}
+}
+
+// stats returns the stage's timing against budget
+func (s *BudgetStage) stats(budget time.Duration) StageBudgetStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := StageBudgetStats{
+		Stage:      s.name,
+		Frames:     s.frames,
+		MeanUs:     time.Duration(s.mean).Microseconds(),
+		PeakUs:     max(s.peak, s.prevPeak).Microseconds(),
+		OverBudget: s.over,
+	}
+	if budget > 0 {
+		st.BudgetPercent = 100 * s.mean / float64(budget)
+	}
+	return st
+}
+
+// funcName names a function value after its package, type and method, e.g.
+// "recording.Recorder.Observe", for naming the stages of taps
+func funcName(fn any) string {
+	f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer())
+	if f == nil {
+		return "unknown"
+	}
+	name := f.Name()
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSuffix(name, "-fm") // Method values
+	return strings.NewReplacer("(*", "", ")", "").Replace(name)
+}
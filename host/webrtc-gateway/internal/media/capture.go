@@ -0,0 +1,56 @@
+package media
+
+import (
+	"errors"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+)
+
+// Capture APIs a producer may name in its hello
+const (
+	CaptureScreenCaptureKit = "screencapturekit" // macOS 12.3+, encoded with VideoToolbox
+	CaptureAVFoundation     = "avfoundation"     // macOS capture cards and cameras
+)
+
+// Pixel formats a producer may feed its encoder, offered in the hello. The
+// gateway picks one; the encoder converts anything else to it first.
+const (
+	PixelFormatNV12 = "nv12" // 8-bit 4:2:0 biplanar; CoreVideo 420v and 420f
+	PixelFormatBGRA = "bgra" // 8-bit BGRA, ScreenCaptureKit's default; the encoder subsamples to 4:2:0
+	PixelFormatP010 = "p010" // 10-bit 4:2:0 biplanar; CoreVideo x420. Accepted with HighBitDepth.
+)
+
+// gatewayPixelFormats are accepted in order of preference: 8-bit 4:2:0
+// output is the only kind every browser decodes
+var gatewayPixelFormats = []string{PixelFormatNV12, PixelFormatBGRA}
+
+// highBitDepthCodecs have a 10-bit profile browsers decode: HEVC Main 10,
+// AV1 Main and VP9 profile 2. No browser decodes 10-bit H.264.
+var highBitDepthCodecs = []string{"hevc", "av1", "vp9"}
+
+// pixelFormats are the formats accepted, in order of preference; 10-bit
+// comes first when it is enabled
+func pixelFormats(highBitDepth bool) []string {
+	if highBitDepth {
+		return append([]string{PixelFormatP010}, gatewayPixelFormats...)
+	}
+	return gatewayPixelFormats
+}
+
+// CodecHEVCAlpha is VideoToolbox's HEVC with an alpha channel. Browsers
+// decode only the base layer of HEVC over WebRTC, so it is always refused.
+const CodecHEVCAlpha = "hevc_alpha"
+
+// errHEVCAlpha rejects HEVC carrying an alpha or other extra layer
+var errHEVCAlpha = errors.New("HEVC with alpha or other extra layers is not supported; encode a single layer without kVTCompressionPropertyKey_TargetQualityForAlpha")
+
+// hasHEVCLayers reports whether an Annex-B HEVC access unit carries NAL
+// units above the base layer, as HEVC with alpha does
+func hasHEVCLayers(au []byte) bool {
+	for _, nal := range bitstream.SplitAnnexB(au) {
+		if bitstream.H265LayerID(nal) > 0 {
+			return true
+		}
+	}
+	return false
+}
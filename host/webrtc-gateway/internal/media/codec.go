@@ -0,0 +1,157 @@
+package media
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+)
+
+// CodecAuto is the configured codec that follows whatever the producer sends
+const CodecAuto = "auto"
+
+// VideoCodecSetter is implemented by peer managers that can change the
+// codec of the shared video track. Viewers who join afterwards negotiate
+// the new codec.
+type VideoCodecSetter interface {
+	SetVideoCodec(codec string) error
+}
+
+// CodecStats describe codec detection
+type CodecStats struct {
+	Configured string `json:"configured"`
+	Codec      string `json:"codec"`   // Codec of the video track
+	Stream     string `json:"stream"`  // Codec the stream was last seen carrying; empty until known
+	Changes    uint64 `json:"changes"` // Track reconfigurations
+	Mismatches uint64 `json:"mismatches"`
+}
+
+// CodecDetector follows the codec the stream carries, taken from each
+// frame's declared codec or, failing that, its parameter sets, and keeps the
+// video track in step with it. With a fixed configured codec, or a peer
+// manager that cannot switch codecs, a stream in another codec is a
+// mismatch viewers cannot decode, and is reported loudly.
+type CodecDetector struct {
+	configured string
+	tracks     VideoCodecSetter // Nil when the track codec is fixed
+	logger     zerolog.Logger
+
+	mu       sync.Mutex
+	codec    string // Codec of the video track
+	stream   string
+	onChange func(codec string)
+
+	// Statistics
+	changes    atomic.Uint64
+	mismatches atomic.Uint64
+}
+
+// NewCodecDetector creates a detector. With configured set to CodecAuto and
+// a tracks setter, the track follows the stream; initial is the codec the
+// track starts with.
+func NewCodecDetector(configured, initial string, tracks VideoCodecSetter, logger zerolog.Logger) *CodecDetector {
+	d := &CodecDetector{
+		configured: configured,
+		logger:     logger.With().Str("component", "codec_detector").Logger(),
+		codec:      initial,
+	}
+	if configured == CodecAuto {
+		d.tracks = tracks
+	}
+	return d
+}
+
+// SetOnChange sets a callback for when the track's codec changes. It runs
+// on the caller of Observe and must not block.
+func (d *CodecDetector) SetOnChange(fn func(codec string)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onChange = fn
+}
+
+// Codec returns the codec of the video track
+func (d *CodecDetector) Codec() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.codec
+}
+
+// Observe checks a frame's codec. It is a Distributor tap, so a change
+// reaches the track before the frame is written.
+func (d *CodecDetector) Observe(frame VideoFrame) {
+	codec := frame.Codec
+	if codec == "" {
+		if codec = bitstream.DetectCodec(frame.Data); codec == "" {
+			return
+		}
+	}
+
+	// Each change is handled once; a mismatch is not repeated every frame
+	d.mu.Lock()
+	if codec == d.stream {
+		d.mu.Unlock()
+		return
+	}
+	previous := d.stream
+	d.stream = codec
+	current := d.codec
+	d.mu.Unlock()
+
+	if codec == current {
+		if previous == "" {
+			d.logger.Info().Str("codec", codec).Msg("Video codec detected")
+		} else {
+			d.logger.Info().Str("codec", codec).Msg("Stream codec matches the video track again")
+		}
+		return
+	}
+
+	if d.tracks == nil {
+		d.mismatches.Add(1)
+		d.logger.Error().
+			Str("stream_codec", codec).
+			Str("track_codec", current).
+			Str("configured", d.configured).
+			Msg("Stream codec does not match the video track; viewers cannot decode it")
+		return
+	}
+
+	if err := d.tracks.SetVideoCodec(codec); err != nil {
+		d.mismatches.Add(1)
+		d.logger.Error().Err(err).
+			Str("stream_codec", codec).
+			Str("track_codec", current).
+			Msg("Failed to switch the video track to the stream codec; viewers cannot decode it")
+		return
+	}
+	d.changes.Add(1)
+
+	d.mu.Lock()
+	d.codec = codec
+	fn := d.onChange
+	d.mu.Unlock()
+
+	if previous == "" {
+		d.logger.Info().Str("codec", codec).Msg("Video codec detected")
+	} else {
+		d.logger.Warn().Str("from", current).Str("to", codec).Msg("Stream codec changed; viewers already connected must renegotiate")
+	}
+	if fn != nil {
+		fn(codec)
+	}
+}
+
+// Stats returns the detection state
+func (d *CodecDetector) Stats() CodecStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return CodecStats{
+		Configured: d.configured,
+		Codec:      d.codec,
+		Stream:     d.stream,
+		Changes:    d.changes.Load(),
+		Mismatches: d.mismatches.Load(),
+	}
+}
@@ -0,0 +1,199 @@
+package media
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/rs/zerolog"
+)
+
+// CoHostReceiver is implemented by peer managers that accept a video track
+// from viewers, such as a duo partner's camera or screen share
+type CoHostReceiver interface {
+	// SetOnPeerVideo sets a callback for each RTP packet received on a
+	// viewer's video track. It runs on the track's read goroutine and must
+	// not block.
+	SetOnPeerVideo(fn func(peerID string, pkt *rtp.Packet))
+
+	// RequestPeerKeyframe sends a PLI on the viewer's video track
+	RequestPeerKeyframe(peerID string) error
+}
+
+// CoHostPublisher is implemented by peer managers that can send a second
+// video track to every viewer
+type CoHostPublisher interface {
+	WriteCoHostRTP(pkt *rtp.Packet) error
+}
+
+// coHostKeyframeInterval limits PLIs sent to the co-host when viewers join
+const coHostKeyframeInterval = time.Second
+
+// CoHostStats are co-host relay counters
+type CoHostStats struct {
+	PeerID    string `json:"peer_id,omitempty"` // Designated co-host, if any
+	Forwarded uint64 `json:"forwarded"`         // Packets republished to viewers
+	Ignored   uint64 `json:"ignored"`           // Packets from viewers who are not the co-host
+	Errors    uint64 `json:"errors"`            // Failed writes
+	Keyframes uint64 `json:"keyframes"`         // Keyframes requested from the co-host
+}
+
+// CoHost republishes the video track of one designated viewer, the co-host,
+// to every viewer as a second stream. Packets are relayed without decoding.
+// Sequence numbers and timestamps are rewritten so the outgoing track stays
+// continuous when the co-host changes.
+type CoHost struct {
+	publisher CoHostPublisher
+	receiver  CoHostReceiver
+	logger    zerolog.Logger
+
+	mu          sync.Mutex
+	peerID      string
+	onChange    func(from, to string)
+	lastRequest time.Time
+
+	// Output continuity, guarded by mu
+	rebase   bool // Next packet starts a new input; recompute offsets
+	started  bool
+	seqDelta uint16
+	tsDelta  uint32
+	lastSeq  uint16
+	lastTS   uint32
+
+	// Statistics
+	forwarded atomic.Uint64
+	ignored   atomic.Uint64
+	errors    atomic.Uint64
+	keyframes atomic.Uint64
+}
+
+// NewCoHost creates a relay from receiver's viewer tracks to publisher
+func NewCoHost(receiver CoHostReceiver, publisher CoHostPublisher, logger zerolog.Logger) *CoHost {
+	c := &CoHost{
+		publisher: publisher,
+		receiver:  receiver,
+		logger:    logger.With().Str("component", "cohost").Logger(),
+	}
+	receiver.SetOnPeerVideo(c.handleVideo)
+	return c
+}
+
+// SetOnChange sets a callback invoked when the co-host changes; from or to
+// is empty when there was or is no co-host. It must not block.
+func (c *CoHost) SetOnChange(fn func(from, to string)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChange = fn
+}
+
+// Peer returns the designated co-host, or "" if there is none
+func (c *CoHost) Peer() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerID
+}
+
+// SetPeer designates peerID as the co-host; "" clears it
+func (c *CoHost) SetPeer(peerID string) {
+	c.mu.Lock()
+	from := c.peerID
+	if from == peerID {
+		c.mu.Unlock()
+		return
+	}
+	c.peerID = peerID
+	c.rebase = true
+	fn := c.onChange
+	c.mu.Unlock()
+
+	c.logger.Info().Str("from", from).Str("to", peerID).Msg("Co-host changed")
+	if peerID != "" {
+		c.requestKeyframe(peerID, true)
+	}
+	if fn != nil {
+		fn(from, peerID)
+	}
+}
+
+// RemovePeer clears the co-host if peerID is it; call when a peer leaves
+func (c *CoHost) RemovePeer(peerID string) {
+	c.mu.Lock()
+	current := c.peerID
+	c.mu.Unlock()
+	if current != "" && current == peerID {
+		c.SetPeer("")
+	}
+}
+
+// PeerJoined asks the co-host for a keyframe so a new viewer can start
+// decoding the second stream without waiting for the next one
+func (c *CoHost) PeerJoined(peerID string) {
+	if current := c.Peer(); current != "" && current != peerID {
+		c.requestKeyframe(current, false)
+	}
+}
+
+// Stats returns relay counters
+func (c *CoHost) Stats() CoHostStats {
+	return CoHostStats{
+		PeerID:    c.Peer(),
+		Forwarded: c.forwarded.Load(),
+		Ignored:   c.ignored.Load(),
+		Errors:    c.errors.Load(),
+		Keyframes: c.keyframes.Load(),
+	}
+}
+
+// handleVideo relays a packet if it came from the co-host
+func (c *CoHost) handleVideo(peerID string, pkt *rtp.Packet) {
+	c.mu.Lock()
+	if peerID == "" || peerID != c.peerID {
+		c.mu.Unlock()
+		c.ignored.Add(1)
+		return
+	}
+
+	if c.rebase {
+		c.rebase = false
+		if c.started {
+			// Continue one packet and one 60fps frame on from the last output
+			c.seqDelta = c.lastSeq + 1 - pkt.SequenceNumber
+			c.tsDelta = c.lastTS + 1500 - pkt.Timestamp
+		} else {
+			c.seqDelta, c.tsDelta = 0, 0
+		}
+	}
+	c.started = true
+
+	// Copy the header so the receiver's packet is left untouched
+	out := *pkt
+	out.Header.SequenceNumber = pkt.SequenceNumber + c.seqDelta
+	out.Header.Timestamp = pkt.Timestamp + c.tsDelta
+	c.lastSeq = out.Header.SequenceNumber
+	c.lastTS = out.Header.Timestamp
+	c.mu.Unlock()
+
+	if err := c.publisher.WriteCoHostRTP(&out); err != nil {
+		c.errors.Add(1)
+		c.logger.Debug().Err(err).Msg("Error writing co-host packet")
+		return
+	}
+	c.forwarded.Add(1)
+}
+
+// requestKeyframe sends a PLI to the co-host, rate-limited unless forced
+func (c *CoHost) requestKeyframe(peerID string, force bool) {
+	c.mu.Lock()
+	if !force && time.Since(c.lastRequest) < coHostKeyframeInterval {
+		c.mu.Unlock()
+		return
+	}
+	c.lastRequest = time.Now()
+	c.mu.Unlock()
+
+	c.keyframes.Add(1)
+	if err := c.receiver.RequestPeerKeyframe(peerID); err != nil {
+		c.logger.Debug().Err(err).Str("peer_id", peerID).Msg("Error requesting co-host keyframe")
+	}
+}
@@ -0,0 +1,103 @@
+package media
+
+import "encoding/binary"
+
+// ColorSpace describes how a stream's samples map to colors. Names are
+// those of the WebCodecs VideoColorSpace, so viewers can use them as they
+// are; e.g. Display P3 from ScreenCaptureKit is primaries "smpte432",
+// transfer "iec61966-2-1" and matrix "bt709".
+type ColorSpace struct {
+	Primaries string `json:"primaries,omitempty"` // "bt709", "bt470bg", "smpte170m", "bt2020", "smpte432"
+	Transfer  string `json:"transfer,omitempty"`  // "bt709", "smpte170m", "iec61966-2-1", "linear", "pq", "hlg"
+	Matrix    string `json:"matrix,omitempty"`    // "rgb", "bt709", "bt470bg", "smpte170m", "bt2020-ncl"
+	FullRange bool   `json:"full_range,omitempty"`
+}
+
+// HDRMetadata is HDR10 static metadata: the mastering display's color
+// volume (SMPTE ST 2086) and the content light levels (CTA-861.3).
+// Chromaticities are CIE 1931 xy and luminance is in cd/m².
+type HDRMetadata struct {
+	Primaries    [3][2]float64 `json:"primaries"`   // Red, green and blue
+	WhitePoint   [2]float64    `json:"white_point"` // D65 is {0.3127, 0.329}
+	MaxLuminance float64       `json:"max_luminance"`
+	MinLuminance float64       `json:"min_luminance"`
+	MaxCLL       int           `json:"max_cll,omitempty"`  // Brightest pixel in the content
+	MaxFALL      int           `json:"max_fall,omitempty"` // Brightest frame average
+}
+
+// H.273 code points for the WebCodecs names; 2 is unspecified
+var (
+	h273Primaries = map[string]uint8{"bt709": 1, "bt470m": 4, "bt470bg": 5, "smpte170m": 6, "smpte240m": 7, "film": 8, "bt2020": 9, "smpte431": 11, "smpte432": 12}
+	h273Transfer  = map[string]uint8{"bt709": 1, "smpte170m": 6, "smpte240m": 7, "linear": 8, "iec61966-2-1": 13, "pq": 16, "hlg": 18}
+	h273Matrix    = map[string]uint8{"rgb": 0, "bt709": 1, "bt470bg": 5, "smpte170m": 6, "smpte240m": 7, "bt2020-ncl": 9}
+)
+
+// H273 returns the color space as ISO/IEC 23091-2 (H.273) code points, as
+// MP4 colr boxes and codec VUI carry it. Unknown names are 2, unspecified.
+func (c ColorSpace) H273() (primaries, transfer, matrix uint8) {
+	code := func(m map[string]uint8, name string) uint8 {
+		if v, ok := m[name]; ok {
+			return v
+		}
+		return 2
+	}
+	return code(h273Primaries, c.Primaries), code(h273Transfer, c.Transfer), code(h273Matrix, c.Matrix)
+}
+
+// IsHDR reports whether the transfer is PQ or HLG
+func (c *ColorSpace) IsHDR() bool {
+	return c != nil && (c.Transfer == "pq" || c.Transfer == "hlg")
+}
+
+// Chromaticity returns an xy coordinate in the 0.00002 steps of ST 2086
+func Chromaticity(xy [2]float64) [2]uint16 {
+	return [2]uint16{uint16(fixed(xy[0], 50000, 0xFFFF)), uint16(fixed(xy[1], 50000, 0xFFFF))}
+}
+
+// Luminance returns cd/m² in the given steps per cd/m², saturating at limit
+func Luminance(v, steps float64, limit uint32) uint32 {
+	return fixed(v, steps, float64(limit))
+}
+
+// fixed scales v to a fixed-point count, clamped to [0, limit]
+func fixed(v, scale, limit float64) uint32 {
+	v = v*scale + 0.5
+	switch {
+	case v < 0:
+		return 0
+	case v > limit:
+		return uint32(limit)
+	}
+	return uint32(v)
+}
+
+// ColorSpaceExtensionURI is the RTP header extension that carries the color
+// space to WebRTC viewers; it is negotiated with an SDP extmap
+const ColorSpaceExtensionURI = "http://www.webrtc.org/experiments/rtp-hdrext/color-space"
+
+// ColorSpaceExtension builds the payload of the color space header
+// extension: 4 bytes, or 28 with HDR metadata. It returns nil when c is nil.
+func ColorSpaceExtension(c *ColorSpace, hdr *HDRMetadata) []byte {
+	if c == nil {
+		return nil
+	}
+	p, t, m := c.H273()
+	rng := byte(1) // Limited
+	if c.FullRange {
+		rng = 2
+	}
+	b := []byte{p, t, m, rng << 4} // Chroma siting unspecified
+	if hdr == nil {
+		return b
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(Luminance(hdr.MaxLuminance, 1, 0xFFFF)))
+	b = binary.BigEndian.AppendUint16(b, uint16(Luminance(hdr.MinLuminance, 10000, 0xFFFF)))
+	for _, xy := range append(hdr.Primaries[:], hdr.WhitePoint) {
+		c := Chromaticity(xy)
+		b = binary.BigEndian.AppendUint16(b, c[0])
+		b = binary.BigEndian.AppendUint16(b, c[1])
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(min(max(hdr.MaxCLL, 0), 0xFFFF)))
+	b = binary.BigEndian.AppendUint16(b, uint16(min(max(hdr.MaxFALL, 0), 0xFFFF)))
+	return b
+}
@@ -0,0 +1,319 @@
+package media
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ControlAction is what a control command asks the capture service to do
+type ControlAction string
+
+// Control actions
+const (
+	ControlStatus        ControlAction = "status"         // Report settings without changing them
+	ControlKeyframe      ControlAction = "keyframe"       // Encode the next picture as an IDR
+	ControlSetBitrate    ControlAction = "set_bitrate"    // BitrateKbps
+	ControlSetGOP        ControlAction = "set_gop"        // GOPFrames
+	ControlSetResolution ControlAction = "set_resolution" // Width and Height
+	ControlStartCapture  ControlAction = "start_capture"
+	ControlStopCapture   ControlAction = "stop_capture"
+	ControlSwitchScene   ControlAction = "switch_scene"  // Scene
+	ControlSwitchSource  ControlAction = "switch_source" // Source
+	ControlSetPiP        ControlAction = "set_pip"       // PiP
+
+	// Screen capture, e.g. ScreenCaptureKit producers
+	ControlSetFrameRate ControlAction = "set_frame_rate" // FPS
+	ControlSetCursor    ControlAction = "set_cursor"     // Cursor
+
+	// 8-bit fallback for 10-bit streams, e.g. for viewers without HEVC
+	// Main 10
+	ControlSetBitDepth ControlAction = "set_bit_depth" // BitDepth
+)
+
+// maxControlName is the longest scene or source name a command may carry
+const maxControlName = 128
+
+// Errors returned by IPCConsumer.Control
+var (
+	ErrNoProducer       = errors.New("no capture service connected")
+	ErrControlTimeout   = errors.New("capture service did not answer the control command")
+	ErrControlFailed    = errors.New("capture service rejected the control command")
+	ErrControlTransport = errors.New("control channel is not available on this connection")
+)
+
+// controlTimeout bounds a command when the caller's context has no deadline
+const controlTimeout = 5 * time.Second
+
+// ControlCommand is sent to the capture service as a MessageTypeControl
+// message on the capture socket
+type ControlCommand struct {
+	ID          uint64        `json:"id"` // Assigned by Control
+	Action      ControlAction `json:"action"`
+	BitrateKbps int           `json:"bitrate_kbps,omitempty"`
+	GOPFrames   int           `json:"gop_frames,omitempty"`
+	Width       int           `json:"width,omitempty"`
+	Height      int           `json:"height,omitempty"`
+	Scene       string        `json:"scene,omitempty"`
+	Source      string        `json:"source,omitempty"`
+	PiP         *bool         `json:"pip,omitempty"` // Facecam picture-in-picture
+	FPS         int           `json:"fps,omitempty"`
+	Cursor      *bool         `json:"cursor,omitempty"` // Mouse pointer drawn into screen capture
+	BitDepth    int           `json:"bit_depth,omitempty"`
+}
+
+// Validate checks that the command carries what its action needs
+func (c ControlCommand) Validate() error {
+	switch c.Action {
+	case ControlStatus, ControlKeyframe, ControlStartCapture, ControlStopCapture:
+	case ControlSetBitrate:
+		if c.BitrateKbps < 100 || c.BitrateKbps > 500000 {
+			return errors.New("bitrate_kbps must be between 100 and 500000")
+		}
+	case ControlSetGOP:
+		if c.GOPFrames < 1 || c.GOPFrames > 3600 {
+			return errors.New("gop_frames must be between 1 and 3600")
+		}
+	case ControlSetResolution:
+		if c.Width < 16 || c.Height < 16 || c.Width > 7680 || c.Height > 4320 || c.Width%2 != 0 || c.Height%2 != 0 {
+			return errors.New("width and height must be even and between 16x16 and 7680x4320")
+		}
+	case ControlSwitchScene:
+		if c.Scene == "" || len(c.Scene) > maxControlName {
+			return fmt.Errorf("scene must be 1 to %d bytes", maxControlName)
+		}
+	case ControlSwitchSource:
+		if c.Source == "" || len(c.Source) > maxControlName {
+			return fmt.Errorf("source must be 1 to %d bytes", maxControlName)
+		}
+	case ControlSetPiP:
+		if c.PiP == nil {
+			return errors.New("pip must be true or false")
+		}
+	case ControlSetFrameRate:
+		if c.FPS < 1 || c.FPS > 240 {
+			return errors.New("fps must be between 1 and 240")
+		}
+	case ControlSetCursor:
+		if c.Cursor == nil {
+			return errors.New("cursor must be true or false")
+		}
+	case ControlSetBitDepth:
+		if c.BitDepth != 8 && c.BitDepth != 10 {
+			return errors.New("bit_depth must be 8 or 10")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", c.Action)
+	}
+	return nil
+}
+
+// ControlReply is the capture service's MessageTypeControlReply answer. A
+// reply with ID 0 is an unsolicited state report, which producers send on
+// connecting to announce that they accept commands.
+type ControlReply struct {
+	ID    uint64 `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+
+	// Settings in effect after the command, as far as the producer knows
+	BitrateKbps int    `json:"bitrate_kbps,omitempty"`
+	GOPFrames   int    `json:"gop_frames,omitempty"`
+	Width       int    `json:"width,omitempty"`
+	Height      int    `json:"height,omitempty"`
+	Capturing   bool   `json:"capturing"`
+	Scene       string `json:"scene,omitempty"`
+	Source      string `json:"source,omitempty"`
+	PiP         bool   `json:"pip"`
+	FPS         int    `json:"fps,omitempty"`
+	Cursor      *bool  `json:"cursor,omitempty"` // For producers that capture the screen
+	BitDepth    int    `json:"bit_depth,omitempty"`
+}
+
+// EncoderController commands the capture service's encoder. The IPC
+// consumer satisfies it.
+type EncoderController interface {
+	Control(ctx context.Context, cmd ControlCommand) (ControlReply, error)
+}
+
+// ControlStats are control channel counters
+type ControlStats struct {
+	Supported bool          `json:"supported"` // The producer has accepted a command on this connection
+	State     *ControlReply `json:"state,omitempty"`
+	Sent      uint64        `json:"sent"`
+	Failed    uint64        `json:"failed"`
+	TimedOut  uint64        `json:"timed_out"`
+}
+
+// Control sends cmd to the capture service and waits for its answer. A
+// producer that never reads the socket (older capture services, or a plain
+// MPEG-TS push) makes this time out.
+func (c *IPCConsumer) Control(ctx context.Context, cmd ControlCommand) (ControlReply, error) {
+	if err := cmd.Validate(); err != nil {
+		return ControlReply{}, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, controlTimeout)
+		defer cancel()
+	}
+
+	cmd.ID = c.controlID.Add(1)
+	reply := make(chan ControlReply, 1)
+	c.ctlMu.Lock()
+	if c.controlPending == nil {
+		c.controlPending = make(map[uint64]chan ControlReply)
+	}
+	c.controlPending[cmd.ID] = reply
+	c.ctlMu.Unlock()
+	defer func() {
+		c.ctlMu.Lock()
+		delete(c.controlPending, cmd.ID)
+		c.ctlMu.Unlock()
+	}()
+
+	if err := c.writeControl(cmd); err != nil {
+		c.controlFailed.Add(1)
+		return ControlReply{}, err
+	}
+
+	select {
+	case r := <-reply:
+		if !r.OK {
+			c.controlFailed.Add(1)
+			if r.Error == "" {
+				return r, ErrControlFailed
+			}
+			return r, fmt.Errorf("%w: %s", ErrControlFailed, r.Error)
+		}
+		return r, nil
+	case <-ctx.Done():
+		c.controlTimedOut.Add(1)
+		return ControlReply{}, ErrControlTimeout
+	}
+}
+
+// ForceKeyframe asks the capture service for an IDR without waiting for the
+// answer. It does nothing until the producer has shown it reads commands.
+func (c *IPCConsumer) ForceKeyframe() {
+	if !c.controlSupported.Load() || !c.keyframeQueued.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer c.keyframeQueued.Store(false)
+		cmd := ControlCommand{ID: c.controlID.Add(1), Action: ControlKeyframe}
+		if err := c.writeControl(cmd); err != nil {
+			c.controlFailed.Add(1)
+			c.logger.Debug().Err(err).Msg("Failed to request keyframe from capture service")
+		}
+	}()
+}
+
+// ControlStats returns control channel counters
+func (c *IPCConsumer) ControlStats() ControlStats {
+	st := ControlStats{
+		Supported: c.controlSupported.Load(),
+		Sent:      c.controlSent.Load(),
+		Failed:    c.controlFailed.Load(),
+		TimedOut:  c.controlTimedOut.Load(),
+	}
+	c.ctlMu.Lock()
+	if c.controlState != nil {
+		state := *c.controlState
+		st.State = &state
+	}
+	c.ctlMu.Unlock()
+	return st
+}
+
+// writeControl writes a command to the current connection
+func (c *IPCConsumer) writeControl(cmd ControlCommand) error {
+	c.mu.RLock()
+	conn := c.conn
+	c.mu.RUnlock()
+	if conn == nil {
+		return ErrNoProducer
+	}
+	if n := c.negotiated(); n != nil && !n.Has(FeatureControl) {
+		return ErrControlTransport
+	}
+	if err := c.writeMessage(conn, MessageTypeControl, cmd); err != nil {
+		return err
+	}
+	c.controlSent.Add(1)
+	return nil
+}
+
+// writeMessage writes a message to the producer on conn. A write that
+// times out part way leaves the producer mid-message, so nothing more is
+// written on that connection afterwards.
+func (c *IPCConsumer) writeMessage(conn net.Conn, t MessageType, v any) error {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, 0, 5+len(js)+1)
+	msg = append(msg, byte(t))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(js)+1))
+	msg = append(msg, js...)
+	msg = append(msg, 0)
+
+	c.ctlMu.Lock()
+	unusable := c.controlBroken == conn || c.controlTS
+	c.ctlMu.Unlock()
+	if unusable {
+		return ErrControlTransport
+	}
+
+	c.ctlWriteMu.Lock()
+	defer c.ctlWriteMu.Unlock()
+	if err := conn.SetWriteDeadline(time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		c.ctlMu.Lock()
+		c.controlBroken = conn
+		c.ctlMu.Unlock()
+		return fmt.Errorf("%w: %v", ErrControlTransport, err)
+	}
+	return nil
+}
+
+// handleControlReply delivers a reply to the waiting Control call, or
+// records an unsolicited state report
+func (c *IPCConsumer) handleControlReply(jsonData []byte) {
+	var r ControlReply
+	if err := json.Unmarshal(jsonData, &r); err != nil {
+		c.logger.Warn().Err(err).Msg("Failed to parse control reply")
+		return
+	}
+	if r.OK && !c.controlSupported.Swap(true) {
+		c.logger.Info().Msg("Capture service accepts control commands")
+	}
+
+	c.ctlMu.Lock()
+	defer c.ctlMu.Unlock()
+	if r.OK {
+		state := r
+		state.ID = 0
+		c.controlState = &state
+	}
+	if ch, ok := c.controlPending[r.ID]; ok && r.ID != 0 {
+		ch <- r
+		delete(c.controlPending, r.ID)
+	}
+}
+
+// resetControl forgets what the previous producer supported. ts marks a
+// plain MPEG-TS connection, which cannot carry commands.
+func (c *IPCConsumer) resetControl(ts bool) {
+	c.controlSupported.Store(false)
+	c.ctlMu.Lock()
+	c.controlState = nil
+	c.controlTS = ts
+	c.ctlMu.Unlock()
+}
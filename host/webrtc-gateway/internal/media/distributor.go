@@ -0,0 +1,765 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/avsync"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/tracing"
+)
+
+// distributorTracer traces sample writes to peers
+var distributorTracer = tracing.Tracer("distributor")
+
+// SampleWriter delivers media samples to connected peers.
+// webrtc.PeerManager satisfies it.
+type SampleWriter interface {
+	WriteVideoSample(sample media.Sample) error
+	GetConnectedPeerCount() int
+}
+
+// KeyframeRequester is implemented by sources that can produce an IDR on
+// demand rather than waiting for the next scheduled one
+type KeyframeRequester interface {
+	ForceKeyframe()
+}
+
+// ConnectionReporter is implemented by sources that know whether their
+// producer is attached (e.g. the IPC consumer), letting the distributor show
+// the offline slate without waiting out the frame timeout
+type ConnectionReporter interface {
+	IsConnected() bool
+}
+
+// SlateFunc encodes a still card showing text at the given size. The returned
+// frames are keyframes and are sent in rotation while the slate is up.
+type SlateFunc func(text string, width, height int) ([]VideoFrame, error)
+
+// Slate texts
+const (
+	SlatePaused  = "PAUSED"
+	SlateOffline = "SOURCE OFFLINE"
+)
+
+// Slates are rendered no larger than this; they are static, and raw-coded
+// slates from the software encoder grow with picture area
+const (
+	maxSlateWidth  = 640
+	maxSlateHeight = 360
+)
+
+// DistributorEvent is a change in what peers are being sent
+type DistributorEvent string
+
+const (
+	DistributorLive    DistributorEvent = "live"    // Live video started flowing to peers
+	DistributorOffline DistributorEvent = "offline" // The source went offline
+	DistributorPaused  DistributorEvent = "paused"  // Pause was called
+	DistributorResumed DistributorEvent = "resumed" // Resume was called
+)
+
+// DistributorConfig configures a Distributor
+type DistributorConfig struct {
+	FrameDuration time.Duration    // Sample duration for live frames without a usable PTS gap, default 1/30s
+	MaxFrameGap   time.Duration    // Longest PTS gap taken as a frame's duration, default 5s
+	SlateInterval time.Duration    // Slate resend interval, default 1s
+	Slate         SlateFunc        // Optional; without it, pausing just holds the last picture
+	SourceTimeout time.Duration    // Frame gap after which the source counts as offline; zero disables
+	Latency       *LatencyTracker  // Optional; records receive and write times of live frames
+	Inspector     *StreamInspector // Optional; reads parameter sets from live keyframes
+	Clock         *avsync.Clock    // Optional; records when live frames are written, for sender reports
+	Budget        *FrameBudget     // Optional; times each tap and the write to peers against the frame interval
+
+	// LayerLimits enables per-peer layer selection for AV1, VP9 with
+	// producer-signalled layers, and H.264 (dropping non-reference frames)
+	// when the writer implements PeerSampleWriter, including frame rate caps.
+	// Other streams are sent to all peers unchanged.
+	LayerLimits LayerLimitFunc
+
+	// PeerQueueSize is the depth of each peer's sample queue, default 8.
+	// When the writer implements PeerSampleWriter, every peer is written by
+	// its own goroutine, and a peer whose queue fills skips to the next
+	// keyframe instead of stalling the others.
+	PeerQueueSize int
+
+	// Tracks returns the tracks a peer subscribes to. Peers without video
+	// are not sent samples; this needs a PeerSampleWriter. Nil sends video
+	// to every peer.
+	Tracks func(peerID string) Tracks
+}
+
+// DistributorStats is a snapshot of distribution counters
+type DistributorStats struct {
+	Forwarded   uint64 `json:"forwarded"`    // Live frames written to peers
+	Bytes       uint64 `json:"bytes"`        // Bytes of live frames written to peers
+	Withheld    uint64 `json:"withheld"`     // Live frames not forwarded (paused or awaiting keyframe)
+	SlateFrames uint64 `json:"slate_frames"` // Slate frames written to peers
+	PeerDropped uint64 `json:"peer_dropped"` // Samples dropped from full per-peer queues
+	Paused      bool   `json:"paused"`
+	Offline     bool   `json:"offline"`
+	Live        bool   `json:"live"` // Live frames are reaching peers
+}
+
+// Distributor forwards frames from a FrameSource to peers, and can pause
+// forwarding without disconnecting anyone. While paused, or while the source
+// is offline, peers are sent a slate instead of a frozen picture.
+type Distributor struct {
+	cfg    DistributorConfig
+	source FrameSource
+	writer SampleWriter
+	logger zerolog.Logger
+
+	mu           sync.Mutex
+	paused       bool
+	pausedAt     time.Time
+	waitKeyframe bool
+	offline      bool
+	live         bool // Live frames have been forwarded since the last outage
+	lastFrameAt  time.Time
+	onEvent      func(DistributorEvent)
+	taps         []distributorTap
+
+	// keyframeRequested is set once an IDR has been requested to end an outage
+	keyframeRequested bool
+	width             int // Size of the most recent live frame, used to size slates
+	height            int
+	running           bool
+	cancel            context.CancelFunc
+	done              chan struct{}
+
+	// Slate state, owned by the distribution goroutine
+	slateFrames []VideoFrame
+	slateKey    string
+	slateNext   int
+
+	// Per-peer layer selection, owned by the distribution goroutine
+	layers map[string]*layeredPeer
+
+	// PTS of the previous live frame and the part of an RTP tick not yet
+	// stamped, owned by the distribution goroutine
+	lastPTS   int64
+	hasPTS    bool
+	tickCarry int64
+
+	// Per-peer queues; nil when the writer cannot address peers
+	fanout *fanout
+
+	// kick wakes the distribution goroutine to send a slate immediately
+	kick chan struct{}
+
+	// Budget stages for whole frames and for writes to peers; nil without
+	// a frame budget
+	frameStage *BudgetStage
+	writeStage *BudgetStage
+
+	// Statistics
+	forwarded  atomic.Uint64
+	bytes      atomic.Uint64
+	withheld   atomic.Uint64
+	slatesSent atomic.Uint64
+	meter      rateMeter
+	timing     frameTiming
+}
+
+// NewDistributor creates a distributor from source to writer
+func NewDistributor(cfg DistributorConfig, source FrameSource, writer SampleWriter, logger zerolog.Logger) *Distributor {
+	// Apply defaults for zero values
+	if cfg.FrameDuration <= 0 {
+		cfg.FrameDuration = time.Second / 30
+	}
+	if cfg.MaxFrameGap <= 0 {
+		cfg.MaxFrameGap = 5 * time.Second
+	}
+	if cfg.SlateInterval <= 0 {
+		cfg.SlateInterval = time.Second
+	}
+	if cfg.PeerQueueSize <= 0 {
+		cfg.PeerQueueSize = 8
+	}
+
+	d := &Distributor{
+		cfg:    cfg,
+		source: source,
+		writer: writer,
+		logger: logger.With().Str("component", "distributor").Logger(),
+		kick:   make(chan struct{}, 1),
+	}
+	if cfg.Budget != nil {
+		d.frameStage = cfg.Budget.Stage("distributor")
+		d.writeStage = cfg.Budget.Stage("distributor.write")
+	}
+	if pw, ok := writer.(PeerSampleWriter); ok {
+		d.fanout = newFanout(pw, cfg.PeerQueueSize, d.requestKeyframe, d.logger)
+	}
+	return d
+}
+
+// distributorTap is a registered tap and the budget stage timing it
+type distributorTap struct {
+	fn    func(VideoFrame)
+	stage *BudgetStage
+}
+
+// AddTap registers fn to see every live frame from the source, whether or
+// not it is forwarded to peers, e.g. for the replay buffer. Taps run on the
+// distribution goroutine and must not block. With a frame budget, each tap
+// is timed as a stage named after fn, e.g. "tap recording.Recorder.Observe".
+func (d *Distributor) AddTap(fn func(VideoFrame)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	tap := distributorTap{fn: fn}
+	if d.cfg.Budget != nil {
+		name := "tap " + funcName(fn)
+		// Several instances of one type, such as renditions, each get a stage
+		for i, n := 2, name; ; i++ {
+			taken := false
+			for _, t := range d.taps {
+				taken = taken || t.stage.name == n
+			}
+			if !taken {
+				name = n
+				break
+			}
+			n = fmt.Sprintf("%s #%d", name, i)
+		}
+		tap.stage = d.cfg.Budget.Stage(name)
+	}
+	d.taps = append(d.taps, tap)
+}
+
+// SetOnEvent sets a callback for distribution state changes. It runs on the
+// calling goroutine and must not block.
+func (d *Distributor) SetOnEvent(fn func(DistributorEvent)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.onEvent = fn
+}
+
+// Start begins forwarding frames; returns immediately
+func (d *Distributor) Start(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.running {
+		return errors.New("distributor already started")
+	}
+
+	frameChan := d.source.VideoFrameChannel()
+	if frameChan == nil {
+		return errors.New("no video frame channel available")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	d.cancel = cancel
+	d.done = make(chan struct{})
+	d.running = true
+
+	// Count the source as offline if it produces nothing within the timeout
+	d.lastFrameAt = time.Now()
+
+	go d.run(runCtx, frameChan)
+
+	return nil
+}
+
+// Stop stops forwarding and waits for the distribution goroutine to exit
+func (d *Distributor) Stop() {
+	d.mu.Lock()
+	if !d.running {
+		d.mu.Unlock()
+		return
+	}
+	d.running = false
+	d.cancel()
+	done := d.done
+	d.mu.Unlock()
+
+	<-done
+}
+
+// Pause stops forwarding live media. Peers stay connected and are shown the
+// paused slate until Resume is called.
+func (d *Distributor) Pause() {
+	d.mu.Lock()
+	if d.paused {
+		d.mu.Unlock()
+		return
+	}
+	d.paused = true
+	d.pausedAt = time.Now()
+	d.mu.Unlock()
+
+	d.kickSlate()
+
+	d.logger.Info().Msg("Video distribution paused")
+	d.emit(DistributorPaused)
+}
+
+// Resume restarts forwarding live media from the next keyframe
+func (d *Distributor) Resume() {
+	d.mu.Lock()
+	if !d.paused {
+		d.mu.Unlock()
+		return
+	}
+	d.paused = false
+	d.waitKeyframe = true
+	pausedFor := time.Since(d.pausedAt)
+	d.mu.Unlock()
+
+	// Peers' decoders hold the slate now; ask for a fresh IDR rather than
+	// waiting out the source's GOP
+	d.requestKeyframe()
+
+	d.logger.Info().Dur("paused_for", pausedFor).Msg("Video distribution resumed")
+	d.emit(DistributorResumed)
+}
+
+// Paused reports whether live forwarding is paused
+func (d *Distributor) Paused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.paused
+}
+
+// Offline reports whether the source is considered offline
+func (d *Distributor) Offline() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.offline
+}
+
+// LastFrameAt returns when the source last delivered a frame, or when
+// distribution started if it has not yet
+func (d *Distributor) LastFrameAt() time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastFrameAt
+}
+
+// Stats returns a snapshot of distribution counters
+func (d *Distributor) Stats() DistributorStats {
+	d.mu.Lock()
+	paused, offline, live := d.paused, d.offline, d.live
+	d.mu.Unlock()
+
+	return DistributorStats{
+		Forwarded:   d.forwarded.Load(),
+		Bytes:       d.bytes.Load(),
+		Withheld:    d.withheld.Load(),
+		SlateFrames: d.slatesSent.Load(),
+		PeerDropped: d.peerDropped(),
+		Paused:      paused,
+		Offline:     offline,
+		Live:        live && !paused,
+	}
+}
+
+// StageStats returns the distribution stage: live frames written to peers,
+// samples dropped from per-peer queues and the samples queued across them
+func (d *Distributor) StageStats() StageStats {
+	s := StageStats{
+		Frames:  d.forwarded.Load(),
+		Dropped: d.peerDropped(),
+	}
+	if d.fanout != nil {
+		for _, q := range d.fanout.stats() {
+			s.QueueDepth += q.Queued
+		}
+	}
+	d.meter.fill(&s, time.Now())
+	d.timing.fill(&s)
+	if d.cfg.Inspector != nil {
+		if params, ok := d.cfg.Inspector.Params(); ok {
+			s.NominalFPS = params.FPS
+		}
+	}
+	return s
+}
+
+// PeerQueues returns per-peer queue counters, or nil when peers are not
+// written individually
+func (d *Distributor) PeerQueues() []PeerQueueStats {
+	if d.fanout == nil {
+		return nil
+	}
+	return d.fanout.stats()
+}
+
+// DetachPeer stops sending live video to a peer, so another producer (such
+// as timeshift playback) can write to it through the PeerSampleWriter. It
+// fails when peers are not written individually or the peer is unknown.
+func (d *Distributor) DetachPeer(peerID string) error {
+	if d.fanout == nil {
+		return errors.New("peers are not written individually")
+	}
+	if !d.fanout.detach(peerID) {
+		return fmt.Errorf("peer %s not found", peerID)
+	}
+	return nil
+}
+
+// AttachPeer resumes live video for a detached peer, starting at the next
+// keyframe
+func (d *Distributor) AttachPeer(peerID string) {
+	if d.fanout != nil {
+		d.fanout.attach(peerID)
+	}
+}
+
+// videoPeers returns the peers subscribed to video
+func (d *Distributor) videoPeers() []string {
+	ids := d.fanout.writer.PeerIDs()
+	if d.cfg.Tracks == nil {
+		return ids
+	}
+	video := ids[:0:0]
+	for _, id := range ids {
+		if d.cfg.Tracks(id).Video() {
+			video = append(video, id)
+		}
+	}
+	return video
+}
+
+// peerDropped returns the total samples dropped from per-peer queues
+func (d *Distributor) peerDropped() uint64 {
+	if d.fanout == nil {
+		return 0
+	}
+	return d.fanout.dropped.Load()
+}
+
+// run is the distribution goroutine
+func (d *Distributor) run(ctx context.Context, frameChan <-chan VideoFrame) {
+	defer close(d.done)
+	if d.fanout != nil {
+		// Stop peer writers, after flushing, once nothing more can be queued
+		defer d.fanout.close()
+	}
+
+	ticker := time.NewTicker(d.cfg.SlateInterval)
+	defer ticker.Stop()
+
+	d.logger.Debug().Msg("Video distribution started")
+
+	for {
+		select {
+		case <-ctx.Done():
+			d.logger.Debug().Msg("Video distribution stopped")
+			return
+		case <-d.kick:
+			d.writeSlate()
+		case <-ticker.C:
+			d.checkSource()
+			d.writeSlate()
+		case frame, ok := <-frameChan:
+			if !ok {
+				d.logger.Debug().Msg("Video frame channel closed")
+				return
+			}
+			d.handleFrame(frame)
+		}
+	}
+}
+
+// handleFrame forwards a live frame unless distribution is paused, the
+// source is offline, or peers are waiting for a keyframe
+func (d *Distributor) handleFrame(frame VideoFrame) {
+	if d.frameStage != nil {
+		// The whole frame, taps and all, is one stage of its own
+		start := time.Now()
+		defer func() { d.frameStage.Observe(time.Since(start)) }()
+	}
+	if d.cfg.Inspector != nil {
+		d.cfg.Inspector.Observe(frame)
+	}
+	if frame.Discontinuity && d.cfg.Latency != nil {
+		d.cfg.Latency.Discontinuity()
+	}
+
+	d.mu.Lock()
+	d.lastFrameAt = time.Now()
+	if frame.Width > 0 && frame.Height > 0 {
+		d.width, d.height = frame.Width, frame.Height
+	}
+
+	// The offline slate stays up until the source can be joined cleanly
+	recovered := false
+	if d.offline && frame.IsKeyframe {
+		d.offline = false
+		recovered = true
+	}
+	requestKeyframe := d.offline && !d.keyframeRequested
+	if requestKeyframe {
+		d.keyframeRequested = true
+	}
+
+	forward := !d.paused && !d.offline && (!d.waitKeyframe || frame.IsKeyframe)
+	if forward {
+		d.waitKeyframe = false
+	}
+	wentLive := forward && !d.live
+	if wentLive {
+		d.live = true
+	}
+	taps := d.taps
+	d.mu.Unlock()
+
+	for _, tap := range taps {
+		start := tap.stage.Begin()
+		tap.fn(frame)
+		tap.stage.End(start)
+	}
+
+	if recovered {
+		d.logger.Info().Msg("Video source back online")
+	}
+	if requestKeyframe {
+		d.requestKeyframe()
+	}
+	if wentLive {
+		d.emit(DistributorLive)
+	}
+
+	if !forward {
+		d.withheld.Add(1)
+		return
+	}
+
+	// Continue the frame's trace from ingest, if it has one
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), frame.Trace)
+	_, span := distributorTracer.Start(ctx, "distributor.write_sample", trace.WithAttributes(
+		attribute.Int("frame.size", len(frame.Data)),
+		attribute.Bool("frame.keyframe", frame.IsKeyframe),
+	))
+	if !frame.ReceivedAt.IsZero() {
+		span.SetAttributes(attribute.Int64("frame.queue_us", time.Since(frame.ReceivedAt).Microseconds()))
+	}
+	if d.cfg.Clock != nil {
+		d.cfg.Clock.Observe(avsync.Video, frame.PTS, time.Now())
+	}
+	var err error
+	interval := d.frameInterval(frame)
+	start := d.writeStage.Begin()
+	if d.layered(frame) {
+		err = d.writeLayered(frame, interval)
+	} else {
+		err = d.write(frame.Data, interval, frame.IsKeyframe)
+	}
+	d.writeStage.End(start)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+
+	if d.cfg.Latency != nil {
+		d.cfg.Latency.ObserveWrite(frame.PTS, frame.ReceivedAt, time.Now())
+	}
+
+	d.forwarded.Add(1)
+	d.bytes.Add(uint64(len(frame.Data)))
+	d.meter.add(time.Now(), len(frame.Data))
+	d.timing.add(frame)
+}
+
+// videoClockRate is the RTP clock rate of every video codec
+const videoClockRate = 90000
+
+// frameInterval returns the sample duration of a live frame: its PTS gap to
+// the previous live frame, so RTP timestamps follow capture timing rather
+// than an assumed frame rate. Variable frame rate sources, such as a game
+// capture that only sends frames when the screen changes, keep their
+// timing even across gaps of several seconds. The gap is whole 90kHz
+// ticks, with the rest carried to the next frame so rounding cannot drift.
+// Gaps that are not plausible frame intervals, across a discontinuity or
+// longer than MaxFrameGap, fall back to FrameDuration.
+func (d *Distributor) frameInterval(frame VideoFrame) time.Duration {
+	gap := time.Duration(frame.PTS - d.lastPTS)
+	valid := d.hasPTS && !frame.Discontinuity && gap > 0 && gap <= d.cfg.MaxFrameGap
+	d.lastPTS, d.hasPTS = frame.PTS, true
+	if !valid {
+		d.tickCarry = 0
+		return d.cfg.FrameDuration
+	}
+	d.cfg.Budget.observeInterval(gap)
+
+	scaled := int64(gap)*videoClockRate + d.tickCarry
+	ticks := scaled / int64(time.Second)
+	d.tickCarry = scaled % int64(time.Second)
+	if ticks == 0 {
+		return d.cfg.FrameDuration
+	}
+	// Round up, since the track truncates the duration back to ticks
+	return time.Duration((ticks*int64(time.Second) + videoClockRate - 1) / videoClockRate)
+}
+
+// checkSource marks the source offline when its producer has detached or it
+// has stopped delivering frames
+func (d *Distributor) checkSource() {
+	if d.cfg.SourceTimeout <= 0 {
+		return
+	}
+
+	disconnected := false
+	if cr, ok := d.source.(ConnectionReporter); ok {
+		disconnected = !cr.IsConnected()
+	}
+
+	d.mu.Lock()
+	if d.offline {
+		d.mu.Unlock()
+		return
+	}
+	gap := time.Since(d.lastFrameAt)
+	if !disconnected && gap < d.cfg.SourceTimeout {
+		d.mu.Unlock()
+		return
+	}
+	d.offline = true
+	d.keyframeRequested = false
+	wasLive := d.live
+	d.live = false
+	d.mu.Unlock()
+
+	d.logger.Warn().
+		Bool("disconnected", disconnected).
+		Dur("since_last_frame", gap).
+		Msg("Video source offline, showing slate")
+	if wasLive {
+		d.emit(DistributorOffline)
+	}
+}
+
+// writeSlate sends the next slate frame if distribution is paused or the
+// source is offline
+func (d *Distributor) writeSlate() {
+	d.mu.Lock()
+	paused, offline := d.paused, d.offline
+	width, height := d.width, d.height
+	d.mu.Unlock()
+
+	if (!paused && !offline) || d.cfg.Slate == nil {
+		return
+	}
+
+	text := SlateOffline
+	if paused {
+		text = SlatePaused
+	}
+
+	frames := d.slate(text, width, height)
+	if len(frames) == 0 {
+		return
+	}
+
+	frame := frames[d.slateNext%len(frames)]
+	d.slateNext++
+	d.write(frame.Data, d.cfg.SlateInterval, true)
+	d.slatesSent.Add(1)
+
+	// The slate's durations cover the time it was up; the next live frame
+	// must not count it again
+	d.hasPTS = false
+}
+
+// slate returns the encoded slate for text, re-encoding when the text or the
+// source size changes
+func (d *Distributor) slate(text string, width, height int) []VideoFrame {
+	width, height = slateSize(width, height)
+	key := fmt.Sprintf("%s@%dx%d", text, width, height)
+	if key == d.slateKey {
+		return d.slateFrames
+	}
+
+	frames, err := d.cfg.Slate(text, width, height)
+	if err != nil {
+		d.logger.Warn().Err(err).Str("slate", text).Msg("Failed to render slate")
+	}
+
+	// Cache failures too, so a broken encoder is not retried every tick
+	d.slateKey = key
+	d.slateFrames = frames
+	d.slateNext = 0
+	return frames
+}
+
+// emit notifies the event callback
+func (d *Distributor) emit(event DistributorEvent) {
+	d.mu.Lock()
+	fn := d.onEvent
+	d.mu.Unlock()
+	if fn != nil {
+		fn(event)
+	}
+}
+
+// kickSlate wakes the distribution goroutine to send a slate immediately
+func (d *Distributor) kickSlate() {
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+}
+
+// requestKeyframe asks the source for an IDR if it supports it
+func (d *Distributor) requestKeyframe() {
+	if kr, ok := d.source.(KeyframeRequester); ok {
+		kr.ForceKeyframe()
+	}
+}
+
+// write sends one sample to all connected peers, through their queues when
+// peers are written individually
+func (d *Distributor) write(data []byte, duration time.Duration, keyframe bool) error {
+	sample := media.Sample{
+		Data:     data,
+		Duration: duration,
+	}
+
+	if d.fanout != nil {
+		ids := d.videoPeers()
+		d.fanout.sync(ids)
+		for _, id := range ids {
+			d.fanout.send(id, sample, keyframe)
+		}
+		return nil
+	}
+
+	err := d.writer.WriteVideoSample(sample)
+	if err != nil {
+		// Only log if we have connected peers
+		if d.writer.GetConnectedPeerCount() > 0 {
+			d.logger.Debug().Err(err).Msg("Error writing video sample")
+		}
+	}
+	return err
+}
+
+// slateSize fits the source aspect ratio within the maximum slate size,
+// defaulting to 16:9 before any frame has been seen
+func slateSize(width, height int) (int, int) {
+	if width <= 0 || height <= 0 {
+		return maxSlateWidth, maxSlateHeight
+	}
+	if width > maxSlateWidth {
+		height = height * maxSlateWidth / width
+		width = maxSlateWidth
+	}
+	if height > maxSlateHeight {
+		width = width * maxSlateHeight / height
+		height = maxSlateHeight
+	}
+	// Keep dimensions even for 4:2:0
+	return max(2, width&^1), max(2, height&^1)
+}
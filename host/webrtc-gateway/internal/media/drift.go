@@ -0,0 +1,105 @@
+package media
+
+import (
+	"math"
+	"time"
+)
+
+// Drift estimation parameters
+const (
+	// driftBucket is the span of producer time over which the least
+	// delayed frame is taken; the minimum filters out queueing jitter
+	driftBucket = int64(10 * time.Second)
+
+	// driftBuckets is how many buckets the skew is fitted over
+	driftBuckets = 60
+
+	// driftMinBuckets must be filled before a skew is trusted
+	driftMinBuckets = 6
+
+	// driftMaxPPM bounds plausible skew; crystal oscillators are within a
+	// few hundred parts per million, anything beyond is a measurement fault
+	driftMaxPPM = 1000
+)
+
+// driftSample is the least delayed frame of one bucket
+type driftSample struct {
+	ts     int64 // Producer time, nanoseconds
+	offset int64 // Receive time minus producer time
+}
+
+// driftEstimator estimates how fast the producer's clock runs against the
+// gateway's from the receive times of its frames. Frames arrive as they are
+// captured, so receive-minus-capture offsets are the network and queueing
+// delay plus a term growing with the skew between the clocks. The least
+// delayed frame of each bucket tracks that term, and a least-squares line
+// through the buckets gives the skew.
+type driftEstimator struct {
+	samples []driftSample // Completed buckets, oldest first
+	current driftSample
+	active  bool // current holds a bucket in progress
+}
+
+// observe records a frame at producer time ts received at receivedAt. It
+// returns true when a bucket completed and the estimate may have changed.
+func (e *driftEstimator) observe(ts int64, receivedAt time.Time) bool {
+	if receivedAt.IsZero() {
+		return false
+	}
+	offset := receivedAt.UnixNano() - ts
+
+	if !e.active {
+		e.current = driftSample{ts: ts, offset: offset}
+		e.active = true
+		return false
+	}
+	if ts-e.current.ts < driftBucket {
+		if offset < e.current.offset {
+			e.current.offset = offset
+		}
+		return false
+	}
+
+	e.samples = append(e.samples, e.current)
+	if len(e.samples) > driftBuckets {
+		e.samples = e.samples[1:]
+	}
+	e.current = driftSample{ts: ts, offset: offset}
+	return true
+}
+
+// skew returns the producer clock's skew, the seconds the gateway's clock
+// gains per producer second, once enough buckets have been seen
+func (e *driftEstimator) skew() (float64, bool) {
+	n := len(e.samples)
+	if n < driftMinBuckets {
+		return 0, false
+	}
+
+	// Fit offset = skew*ts + c, relative to the first sample for precision
+	var sumX, sumY, sumXX, sumXY float64
+	for _, s := range e.samples {
+		x := float64(s.ts - e.samples[0].ts)
+		y := float64(s.offset - e.samples[0].offset)
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	denom := float64(n)*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0, false
+	}
+	skew := (float64(n)*sumXY - sumX*sumY) / denom
+	if math.Abs(skew) > driftMaxPPM/1e6 {
+		return 0, false
+	}
+	return skew, true
+}
+
+// reset forgets all samples, e.g. after the timeline was spliced and
+// offsets from before no longer compare
+func (e *driftEstimator) reset() {
+	e.samples = e.samples[:0]
+	e.active = false
+}
@@ -0,0 +1,429 @@
+// Package failover combines an ordered list of video sources into one,
+// switching to the best healthy source automatically.
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Entry is one source in the chain
+type Entry struct {
+	Name   string
+	Source media.FrameSource
+}
+
+// Config configures a failover source
+type Config struct {
+	// Timeout is the frame gap after which a source counts as unhealthy,
+	// default 2s
+	Timeout time.Duration
+
+	// FailbackDelay is how long a higher-priority source must stay healthy
+	// before switching back to it, default 5s. This keeps a flapping primary
+	// from bouncing viewers between sources.
+	FailbackDelay time.Duration
+
+	VideoBufferSize int // Output channel buffer size, default 30
+}
+
+// SwitchEvent describes a change of active source
+type SwitchEvent struct {
+	From   string // Empty on the first selection
+	To     string
+	Reason string // "initial", "failover" or "failback"
+	At     time.Time
+}
+
+// SourceStatus is the health of one source in the chain
+type SourceStatus struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	Active    bool      `json:"active"`
+	LastFrame time.Time `json:"last_frame,omitempty"`
+}
+
+// taggedFrame is a frame labelled with the index of its source
+type taggedFrame struct {
+	index int
+	frame media.VideoFrame
+}
+
+// sourceState tracks one entry's health; owned by the run goroutine
+type sourceState struct {
+	lastFrame    time.Time
+	healthySince time.Time // Zero while unhealthy
+}
+
+// Source runs every source in the chain and forwards frames from the active
+// one. Lower indexes have higher priority. Switches take effect at the new
+// source's next keyframe, so viewers never see a broken picture.
+type Source struct {
+	cfg      Config
+	entries  []Entry
+	logger   zerolog.Logger
+	warnings *logging.Summarizer // Rate-limits per-frame warnings
+
+	videoFrames chan media.VideoFrame
+	tagged      chan taggedFrame
+
+	mu        sync.Mutex
+	running   bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+	startedAt time.Time
+	states    []sourceState
+	active    int // -1 before any source has delivered a keyframe
+	pending   int // Source being switched to, -1 if none
+	reason    string
+	onSwitch  func(SwitchEvent)
+
+	// Statistics
+	frameCount  atomic.Uint64
+	dropCount   atomic.Uint64
+	switchCount atomic.Uint64
+}
+
+// New creates a failover source over entries, highest priority first
+func New(cfg Config, entries []Entry, logger zerolog.Logger) *Source {
+	// Apply defaults for zero values
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	if cfg.FailbackDelay <= 0 {
+		cfg.FailbackDelay = 5 * time.Second
+	}
+	if cfg.VideoBufferSize <= 0 {
+		cfg.VideoBufferSize = 30
+	}
+
+	logger = logger.With().Str("component", "failover").Logger()
+	return &Source{
+		cfg:         cfg,
+		entries:     entries,
+		logger:      logger,
+		warnings:    logging.NewSummarizer(logger),
+		videoFrames: make(chan media.VideoFrame, cfg.VideoBufferSize),
+		tagged:      make(chan taggedFrame, cfg.VideoBufferSize),
+		states:      make([]sourceState, len(entries)),
+		active:      -1,
+		pending:     -1,
+	}
+}
+
+// SetOnSwitch sets a callback invoked whenever the active source changes.
+// It runs on the failover goroutine and must not block.
+func (s *Source) SetOnSwitch(fn func(SwitchEvent)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onSwitch = fn
+}
+
+// Start starts every source in the chain; returns immediately
+func (s *Source) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return errors.New("failover source already started")
+	}
+	if len(s.entries) == 0 {
+		return errors.New("failover chain is empty")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+
+	for i, e := range s.entries {
+		if err := e.Source.Start(runCtx); err != nil {
+			cancel()
+			for _, started := range s.entries[:i] {
+				started.Source.Stop()
+			}
+			return fmt.Errorf("failed to start source %q: %w", e.Name, err)
+		}
+	}
+
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.running = true
+	s.startedAt = time.Now()
+
+	var wg sync.WaitGroup
+	for i, e := range s.entries {
+		wg.Add(1)
+		go func(index int, ch <-chan media.VideoFrame) {
+			defer wg.Done()
+			s.drain(runCtx, index, ch)
+		}(i, e.Source.VideoFrameChannel())
+	}
+
+	go func() {
+		s.run(runCtx)
+		wg.Wait()
+		close(s.done)
+	}()
+
+	names := make([]string, len(s.entries))
+	for i, e := range s.entries {
+		names[i] = e.Name
+	}
+	s.logger.Info().
+		Strs("chain", names).
+		Dur("timeout", s.cfg.Timeout).
+		Dur("failback_delay", s.cfg.FailbackDelay).
+		Msg("Failover source started")
+
+	return nil
+}
+
+// Stop stops every source in the chain
+func (s *Source) Stop() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	s.running = false
+	s.cancel()
+	done := s.done
+	s.mu.Unlock()
+
+	<-done
+
+	var errs []error
+	for _, e := range s.entries {
+		if err := e.Source.Stop(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", e.Name, err))
+		}
+	}
+
+	s.logger.Info().
+		Uint64("frames", s.frameCount.Load()).
+		Uint64("switches", s.switchCount.Load()).
+		Msg("Failover source stopped")
+
+	return errors.Join(errs...)
+}
+
+// VideoFrameChannel returns the channel for receiving frames from the active source
+func (s *Source) VideoFrameChannel() <-chan media.VideoFrame {
+	return s.videoFrames
+}
+
+// ForceKeyframe asks the active source for a keyframe, if it supports it
+func (s *Source) ForceKeyframe() {
+	s.mu.Lock()
+	active := s.active
+	s.mu.Unlock()
+
+	if active >= 0 {
+		s.requestKeyframe(active)
+	}
+}
+
+// Active returns the name of the active source, or "" before the first switch
+func (s *Source) Active() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active < 0 {
+		return ""
+	}
+	return s.entries[s.active].Name
+}
+
+// Status returns the health of every source in the chain
+func (s *Source) Status() []SourceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := make([]SourceStatus, len(s.entries))
+	for i, e := range s.entries {
+		status[i] = SourceStatus{
+			Name:      e.Name,
+			Healthy:   !s.states[i].healthySince.IsZero(),
+			Active:    i == s.active,
+			LastFrame: s.states[i].lastFrame,
+		}
+	}
+	return status
+}
+
+// drain forwards one source's frames to the run goroutine. Every source is
+// drained, active or not, so standbys stay healthy and never back up.
+func (s *Source) drain(ctx context.Context, index int, ch <-chan media.VideoFrame) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case frame, ok := <-ch:
+			if !ok {
+				return
+			}
+			select {
+			case s.tagged <- taggedFrame{index: index, frame: frame}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// run tracks health, picks the active source and forwards its frames
+func (s *Source) run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.Timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.evaluate(time.Now())
+		case tf := <-s.tagged:
+			s.handleFrame(tf)
+		}
+	}
+}
+
+// handleFrame records health and forwards frames from the active source
+func (s *Source) handleFrame(tf taggedFrame) {
+	now := time.Now()
+
+	s.mu.Lock()
+	st := &s.states[tf.index]
+	st.lastFrame = now
+	if st.healthySince.IsZero() {
+		st.healthySince = now
+	}
+
+	// A pending switch completes on the new source's first keyframe; until
+	// then the old source keeps playing if it still can
+	var event *SwitchEvent
+	if tf.index == s.pending && tf.frame.IsKeyframe {
+		event = s.completeSwitch(now)
+	}
+
+	forward := tf.index == s.active
+	s.mu.Unlock()
+
+	if event != nil {
+		s.emit(*event)
+	}
+	if forward {
+		s.forward(tf.frame)
+	}
+}
+
+// evaluate updates health and starts a switch if a better source is available
+func (s *Source) evaluate(now time.Time) {
+	s.mu.Lock()
+	for i := range s.states {
+		st := &s.states[i]
+		if !st.healthySince.IsZero() && now.Sub(st.lastFrame) >= s.cfg.Timeout {
+			st.healthySince = time.Time{}
+			s.logger.Warn().Str("source", s.entries[i].Name).Msg("Source unhealthy")
+		}
+	}
+
+	target, reason := s.choose(now)
+	start := target >= 0 && target != s.active && target != s.pending
+	if start {
+		s.pending = target
+		s.reason = reason
+	} else if target == s.active && s.pending >= 0 {
+		// The active source recovered before the switch completed
+		s.pending = -1
+	}
+	s.mu.Unlock()
+
+	if start {
+		s.logger.Info().
+			Str("to", s.entries[target].Name).
+			Str("reason", reason).
+			Msg("Switching source at next keyframe")
+		s.requestKeyframe(target)
+	}
+}
+
+// choose returns the source that should be active, or -1 to stay put.
+// Caller holds mu.
+func (s *Source) choose(now time.Time) (int, string) {
+	activeHealthy := s.active >= 0 && !s.states[s.active].healthySince.IsZero()
+
+	for i, st := range s.states {
+		if st.healthySince.IsZero() {
+			continue
+		}
+		switch {
+		case s.active < 0:
+			// Give higher-priority sources one timeout to come up so that
+			// startup does not go through a backup first
+			if i > 0 && now.Sub(s.startedAt) < s.cfg.Timeout {
+				return -1, ""
+			}
+			return i, "initial"
+		case i == s.active:
+			return i, ""
+		case !activeHealthy:
+			return i, "failover"
+		case i < s.active && now.Sub(st.healthySince) >= s.cfg.FailbackDelay:
+			return i, "failback"
+		}
+	}
+	return -1, ""
+}
+
+// completeSwitch makes the pending source active. Caller holds mu.
+func (s *Source) completeSwitch(now time.Time) *SwitchEvent {
+	event := SwitchEvent{To: s.entries[s.pending].Name, Reason: s.reason, At: now}
+	if s.active >= 0 {
+		event.From = s.entries[s.active].Name
+	}
+	s.active = s.pending
+	s.pending = -1
+	s.switchCount.Add(1)
+	return &event
+}
+
+// emit logs a switch and notifies the callback
+func (s *Source) emit(event SwitchEvent) {
+	s.logger.Info().
+		Str("from", event.From).
+		Str("to", event.To).
+		Str("reason", event.Reason).
+		Msg("Active source switched")
+
+	s.mu.Lock()
+	fn := s.onSwitch
+	s.mu.Unlock()
+	if fn != nil {
+		fn(event)
+	}
+}
+
+// forward sends a frame downstream
+func (s *Source) forward(frame media.VideoFrame) {
+	select {
+	case s.videoFrames <- frame:
+		s.frameCount.Add(1)
+	default:
+		s.dropCount.Add(1)
+		s.warnings.Warn("Video frame channel full, dropping frame", nil)
+	}
+}
+
+// requestKeyframe asks a source for a keyframe if it supports it
+func (s *Source) requestKeyframe(index int) {
+	if kr, ok := s.entries[index].Source.(media.KeyframeRequester); ok {
+		kr.ForceKeyframe()
+	}
+}
@@ -0,0 +1,274 @@
+package media
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/rs/zerolog"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/pacer"
+)
+
+// PeerQueueStats are one peer's fan-out counters
+type PeerQueueStats struct {
+	PeerID  string `json:"peer_id"`
+	Queued  int    `json:"queued"`  // Samples waiting to be written
+	Written uint64 `json:"written"` // Samples written
+	Dropped uint64 `json:"dropped"` // Samples dropped because the queue was full
+	Skipped uint64 `json:"skipped"` // Delta frames skipped while waiting for a keyframe
+	Errors  uint64 `json:"errors"`  // Failed writes
+}
+
+// fanoutSample is a queued sample
+type fanoutSample struct {
+	sample   media.Sample
+	keyframe bool
+}
+
+// peerQueue is one peer's bounded queue and writer goroutine
+type peerQueue struct {
+	id string
+	ch chan fanoutSample
+
+	// Sender-side state, owned by the distribution goroutine
+	awaitKeyframe bool          // A drop broke the reference chain
+	debt          time.Duration // Duration of dropped samples not yet stamped
+
+	// congested is set by the writer when the peer's send path refused a
+	// frame; the sender then waits for a keyframe
+	congested atomic.Bool
+
+	// Guarded by fanout.mu
+	detached bool // Live video is withheld, e.g. during timeshift
+	attached bool // Detached until now; the sender must wait for a keyframe
+
+	// Statistics
+	written atomic.Uint64
+	dropped atomic.Uint64
+	skipped atomic.Uint64
+	errors  atomic.Uint64
+}
+
+// fanout gives every peer its own queue and writer goroutine, so a peer whose
+// writes block only falls behind itself. A peer whose queue overflows drops
+// samples until the next keyframe, since later frames would reference the
+// dropped ones. So does a peer whose link is congested downstream, reported
+// by the pacer refusing a frame, rather than letting its send buffer grow.
+//
+// Send and sync are called from the distribution goroutine only.
+type fanout struct {
+	writer    PeerSampleWriter
+	queueSize int
+	logger    zerolog.Logger
+
+	// requestKeyframe recovers an overflowed peer sooner than the next
+	// scheduled keyframe; rate-limited since it costs every peer bitrate
+	requestKeyframe func()
+	lastRequest     time.Time
+
+	mu    sync.Mutex
+	peers map[string]*peerQueue
+	wg    sync.WaitGroup
+
+	// Statistics
+	dropped atomic.Uint64
+}
+
+// keyframeRequestInterval limits keyframe requests caused by slow peers
+const keyframeRequestInterval = time.Second
+
+func newFanout(writer PeerSampleWriter, queueSize int, requestKeyframe func(), logger zerolog.Logger) *fanout {
+	return &fanout{
+		writer:          writer,
+		queueSize:       queueSize,
+		logger:          logger,
+		requestKeyframe: requestKeyframe,
+		peers:           make(map[string]*peerQueue),
+	}
+}
+
+// sync starts queues for new peers and stops those of departed peers
+func (f *fanout) sync(ids []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		current[id] = true
+		if _, ok := f.peers[id]; ok {
+			continue
+		}
+		// A joining peer cannot decode anything before a keyframe
+		q := &peerQueue{
+			id:            id,
+			ch:            make(chan fanoutSample, f.queueSize),
+			awaitKeyframe: true,
+		}
+		f.peers[id] = q
+		f.wg.Add(1)
+		go f.writeLoop(q)
+		f.maybeRequestKeyframe()
+	}
+
+	for id, q := range f.peers {
+		if !current[id] {
+			close(q.ch)
+			delete(f.peers, id)
+		}
+	}
+}
+
+// send queues a sample for one peer without blocking
+func (f *fanout) send(id string, sample media.Sample, keyframe bool) {
+	f.mu.Lock()
+	q, ok := f.peers[id]
+	f.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	detached, attached := q.detached, q.attached
+	q.attached = false
+	f.mu.Unlock()
+	if detached {
+		return
+	}
+	if attached {
+		q.awaitKeyframe = true
+		q.debt = 0
+		f.maybeRequestKeyframe()
+	}
+	if q.congested.Swap(false) && !q.awaitKeyframe {
+		q.awaitKeyframe = true
+		f.maybeRequestKeyframe()
+	}
+
+	if q.awaitKeyframe && !keyframe {
+		q.debt += sample.Duration
+		q.skipped.Add(1)
+		return
+	}
+
+	// Stamp the time of dropped samples onto this one so the peer's RTP
+	// clock keeps pace
+	stamped := sample
+	stamped.Duration += q.debt
+
+	select {
+	case q.ch <- fanoutSample{sample: stamped, keyframe: keyframe}:
+		q.awaitKeyframe = false
+		q.debt = 0
+	default:
+		q.awaitKeyframe = true
+		q.debt += sample.Duration
+		q.dropped.Add(1)
+		f.dropped.Add(1)
+		f.logger.Debug().Str("peer_id", id).Msg("Peer queue full, dropping until next keyframe")
+		f.maybeRequestKeyframe()
+	}
+}
+
+// detach withholds live video from a peer until attach; the peer's queue
+// keeps running so whoever detached it can write to the peer directly
+func (f *fanout) detach(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q, ok := f.peers[id]
+	if ok {
+		q.detached = true
+	}
+	return ok
+}
+
+// attach resumes live video for a detached peer from the next keyframe
+func (f *fanout) attach(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if q, ok := f.peers[id]; ok && q.detached {
+		q.detached = false
+		q.attached = true
+	}
+}
+
+// maybeRequestKeyframe asks for a keyframe at most once per interval
+func (f *fanout) maybeRequestKeyframe() {
+	if f.requestKeyframe == nil || time.Since(f.lastRequest) < keyframeRequestInterval {
+		return
+	}
+	f.lastRequest = time.Now()
+	f.requestKeyframe()
+}
+
+// writeLoop writes one peer's samples until its queue is closed. After a
+// congested write it skips the delta frames already queued, stamping their
+// time onto the next keyframe like send does.
+func (f *fanout) writeLoop(q *peerQueue) {
+	defer f.wg.Done()
+
+	var (
+		skipping bool
+		debt     time.Duration
+	)
+	for s := range q.ch {
+		if skipping && !s.keyframe {
+			debt += s.sample.Duration
+			q.skipped.Add(1)
+			continue
+		}
+		sample := s.sample
+		sample.Duration += debt
+		skipping, debt = false, 0
+
+		err := f.writer.WritePeerVideoSample(q.id, sample)
+		switch {
+		case errors.Is(err, pacer.ErrCongested):
+			// The track's RTP clock advanced past the refused sample
+			// already; only samples skipped from now on are owed
+			skipping = true
+			q.skipped.Add(1)
+			q.congested.Store(true)
+			f.logger.Debug().Str("peer_id", q.id).Msg("Peer link congested, skipping until next keyframe")
+		case err != nil:
+			q.errors.Add(1)
+			f.logger.Debug().Err(err).Str("peer_id", q.id).Msg("Error writing peer video sample")
+		default:
+			q.written.Add(1)
+		}
+	}
+}
+
+// close stops every queue and waits for queued samples to be written
+func (f *fanout) close() {
+	f.mu.Lock()
+	for id, q := range f.peers {
+		close(q.ch)
+		delete(f.peers, id)
+	}
+	f.mu.Unlock()
+
+	f.wg.Wait()
+}
+
+// stats returns per-peer counters, ordered by peer ID
+func (f *fanout) stats() []PeerQueueStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := make([]PeerQueueStats, 0, len(f.peers))
+	for _, q := range f.peers {
+		out = append(out, PeerQueueStats{
+			PeerID:  q.id,
+			Queued:  len(q.ch),
+			Written: q.written.Load(),
+			Dropped: q.dropped.Load(),
+			Skipped: q.skipped.Load(),
+			Errors:  q.errors.Load(),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].PeerID < out[j].PeerID })
+	return out
+}
@@ -0,0 +1,189 @@
+package media
+
+import (
+	"context"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// BufferPressure is a sustained backlog in a stage's queue: it stayed
+// nearly full, or kept dropping frames, for longer than a passing burst
+type BufferPressure struct {
+	Since   time.Time `json:"since"`
+	Dropped uint64    `json:"dropped"` // Frames dropped since it began
+}
+
+// Buffer sizing and pressure detection
+const (
+	// pressureLevel is the occupancy, in percent, counted as pressure
+	pressureLevel = 80
+
+	// pressureSustain is how long pressure, or its absence, must last
+	// before the condition is raised or cleared
+	pressureSustain = 3 * time.Second
+)
+
+// frameQueueConfig configures a frameQueue
+type frameQueueConfig struct {
+	name     string        // Stage name for logs
+	initial  int           // Capacity until the stream has been measured
+	duration time.Duration // Stream time the queue holds
+	minCap   int
+	maxCap   int
+	maxBytes int64 // Caps capacity at this many bytes of average frames; 0 is unlimited
+}
+
+// frameQueue is a bounded FIFO between the IPC read loop and a consumer
+// channel. A fixed channel size suits one frame rate only: too short for
+// 120fps, or holding seconds of 30fps video. The queue instead holds a
+// fixed duration of the stream at the measured frame rate, within a byte
+// budget for large frames, and is re-sized by tune. Frames that do not fit
+// are dropped; a backlog that persists is raised as a pressure condition
+// rather than logged per frame.
+type frameQueue[T any] struct {
+	cfg    frameQueueConfig
+	logger zerolog.Logger
+
+	mu       sync.Mutex
+	items    []T
+	capacity int
+	notify   chan struct{}
+
+	// Pressure tracking, guarded by mu
+	pressuredSince time.Time // Start of the current streak of pressure
+	calmSince      time.Time // Start of the current streak without it
+	pressure       *BufferPressure
+	droppedAtStart uint64
+	lastDropped    uint64
+
+	// Statistics
+	dropped atomic.Uint64
+}
+
+func newFrameQueue[T any](cfg frameQueueConfig, logger zerolog.Logger) *frameQueue[T] {
+	return &frameQueue[T]{
+		cfg:      cfg,
+		logger:   logger,
+		capacity: cfg.initial,
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// push queues an item, or drops it and returns false when the queue is full
+func (q *frameQueue[T]) push(item T) bool {
+	q.mu.Lock()
+	if len(q.items) >= q.capacity {
+		q.mu.Unlock()
+		q.dropped.Add(1)
+		return false
+	}
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// run moves queued items to out until ctx is done
+func (q *frameQueue[T]) run(ctx context.Context, out chan<- T) {
+	for {
+		q.mu.Lock()
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return
+			case <-q.notify:
+			}
+			continue
+		}
+		item := q.items[0]
+		var zero T
+		q.items[0] = zero
+		q.items = q.items[1:]
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case out <- item:
+		}
+	}
+}
+
+// tune sizes the queue for the measured frame rate and bitrate, and
+// updates the pressure condition. Call it about once a second.
+func (q *frameQueue[T]) tune(now time.Time, fps, bitrateKbps float64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if fps > 0 {
+		capacity := int(math.Ceil(fps * q.cfg.duration.Seconds()))
+		if q.cfg.maxBytes > 0 && bitrateKbps > 0 {
+			frameBytes := bitrateKbps * 1000 / 8 / fps
+			capacity = min(capacity, int(float64(q.cfg.maxBytes)/frameBytes))
+		}
+		capacity = max(q.cfg.minCap, min(capacity, q.cfg.maxCap))
+		if capacity != q.capacity {
+			q.logger.Debug().Str("queue", q.cfg.name).Int("from", q.capacity).Int("to", capacity).
+				Float64("fps", fps).Msg("Resized frame queue")
+			q.capacity = capacity
+		}
+	}
+
+	// Nearly full, or dropping, counts as pressure
+	dropped := q.dropped.Load()
+	pressured := len(q.items)*100 >= q.capacity*pressureLevel || dropped > q.lastDropped
+	q.lastDropped = dropped
+
+	if pressured {
+		q.calmSince = time.Time{}
+		if q.pressuredSince.IsZero() {
+			q.pressuredSince = now
+			if q.pressure == nil {
+				q.droppedAtStart = dropped
+			}
+		}
+		if q.pressure == nil && now.Sub(q.pressuredSince) >= pressureSustain {
+			q.pressure = &BufferPressure{Since: q.pressuredSince}
+			q.logger.Warn().Str("queue", q.cfg.name).Int("capacity", q.capacity).
+				Uint64("dropped", dropped-q.droppedAtStart).
+				Msg("Frame queue under sustained pressure; the consumer is not keeping up")
+		}
+	} else {
+		q.pressuredSince = time.Time{}
+		if q.calmSince.IsZero() {
+			q.calmSince = now
+		}
+		if q.pressure != nil && now.Sub(q.calmSince) >= pressureSustain {
+			q.logger.Info().Str("queue", q.cfg.name).
+				Dur("lasted", q.calmSince.Sub(q.pressure.Since)).
+				Uint64("dropped", dropped-q.droppedAtStart).
+				Msg("Frame queue pressure relieved")
+			q.pressure = nil
+		}
+	}
+	if q.pressure != nil {
+		q.pressure.Dropped = dropped - q.droppedAtStart
+	}
+}
+
+// fill sets the queue counters of s
+func (q *frameQueue[T]) fill(s *StageStats) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s.Dropped = q.dropped.Load()
+	s.QueueDepth = len(q.items)
+	s.QueueCapacity = q.capacity
+	if q.pressure != nil {
+		p := *q.pressure
+		s.Pressure = &p
+	}
+}
@@ -0,0 +1,196 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeatMessage is the JSON of MessageTypePing and MessageTypePong. A
+// pong echoes the sequence number of the ping it answers.
+type heartbeatMessage struct {
+	Seq uint64 `json:"seq"`
+}
+
+// Producer states reported by HeartbeatStats
+const (
+	ProducerDisconnected = "disconnected"
+	ProducerStreaming    = "streaming"    // Media is arriving
+	ProducerIdle         = "idle"         // Connected and answering, but sending no media
+	ProducerUnresponsive = "unresponsive" // Heartbeats are going unanswered
+)
+
+// HeartbeatStats describe the liveness of the producer connection
+type HeartbeatStats struct {
+	State string `json:"state"`
+
+	// Supported is set once the producer has answered a ping on this
+	// connection; only then do missed heartbeats disconnect it
+	Supported bool `json:"supported"`
+
+	Missed        int        `json:"missed"` // Pings sent since anything was heard
+	RTTMs         float64    `json:"rtt_ms,omitempty"`
+	LastMessageAt *time.Time `json:"last_message_at,omitempty"`
+	LastMediaAt   *time.Time `json:"last_media_at,omitempty"`
+	Disconnects   uint64     `json:"disconnects"` // Connections dropped for missed heartbeats
+}
+
+// heartbeatState tracks the liveness of the current connection
+type heartbeatState struct {
+	supported   atomic.Bool
+	missed      atomic.Int32
+	seq         atomic.Uint64
+	lastMessage atomic.Int64 // Unix nanoseconds
+	lastMedia   atomic.Int64
+	disconnects atomic.Uint64
+
+	mu     sync.Mutex
+	sentAt map[uint64]time.Time // Outstanding pings
+	rtt    time.Duration
+}
+
+// reset forgets the previous connection
+func (h *heartbeatState) reset() {
+	h.supported.Store(false)
+	h.missed.Store(0)
+	h.lastMessage.Store(time.Now().UnixNano())
+	h.lastMedia.Store(0)
+	h.mu.Lock()
+	h.sentAt = nil
+	h.rtt = 0
+	h.mu.Unlock()
+}
+
+// heard records a message from the producer; anything it sends shows it is
+// alive
+func (h *heartbeatState) heard(now time.Time, media bool) {
+	h.missed.Store(0)
+	h.lastMessage.Store(now.UnixNano())
+	if media {
+		h.lastMedia.Store(now.UnixNano())
+	}
+}
+
+// heartbeat pings the producer on conn every interval until ctx is done,
+// and closes conn once a producer that answers pings misses maxMissed in a
+// row. Producers that never answer are left connected, as older capture
+// services ignore pings.
+func (c *IPCConsumer) heartbeat(ctx context.Context, conn net.Conn) {
+	ticker := time.NewTicker(c.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if n := c.negotiated(); n != nil && !n.Has(FeatureHeartbeat) {
+			return // The producer said it does not answer pings
+		}
+
+		h := &c.hb
+		if missed := int(h.missed.Load()); h.supported.Load() && missed >= c.maxMissedHeartbeats {
+			c.logger.Warn().
+				Int("missed", missed).
+				Dur("interval", c.heartbeatInterval).
+				Msg("Capture service stopped answering heartbeats, disconnecting")
+			h.disconnects.Add(1)
+			conn.Close()
+			return
+		}
+
+		seq := h.seq.Add(1)
+		h.mu.Lock()
+		if h.sentAt == nil {
+			h.sentAt = make(map[uint64]time.Time)
+		}
+		h.sentAt[seq] = time.Now()
+		// Only the latest few pings can still be answered in time
+		delete(h.sentAt, seq-uint64(c.maxMissedHeartbeats)-1)
+		h.mu.Unlock()
+
+		if err := c.writeMessage(conn, MessageTypePing, heartbeatMessage{Seq: seq}); err != nil {
+			if errors.Is(err, ErrControlTransport) {
+				return // Nothing more can be written on this connection
+			}
+			c.logger.Debug().Err(err).Msg("Failed to send heartbeat")
+		}
+		h.missed.Add(1)
+	}
+}
+
+// handlePing answers a producer's ping. The write happens off the read
+// loop, which must not block on it.
+func (c *IPCConsumer) handlePing(conn net.Conn, jsonData []byte) {
+	var m heartbeatMessage
+	if err := json.Unmarshal(jsonData, &m); err != nil {
+		c.warnings.Warn("Failed to parse ping", nil)
+		return
+	}
+	c.hb.supported.Store(true)
+	go func() {
+		if err := c.writeMessage(conn, MessageTypePong, m); err != nil {
+			c.logger.Debug().Err(err).Msg("Failed to answer ping")
+		}
+	}()
+}
+
+// handlePong records the round trip of an answered ping
+func (c *IPCConsumer) handlePong(jsonData []byte) {
+	var m heartbeatMessage
+	if err := json.Unmarshal(jsonData, &m); err != nil {
+		c.warnings.Warn("Failed to parse pong", nil)
+		return
+	}
+	h := &c.hb
+	if !h.supported.Swap(true) {
+		c.logger.Info().Msg("Capture service answers heartbeats")
+	}
+	h.mu.Lock()
+	if sent, ok := h.sentAt[m.Seq]; ok {
+		h.rtt = time.Since(sent)
+		delete(h.sentAt, m.Seq)
+	}
+	h.mu.Unlock()
+}
+
+// HeartbeatStats reports whether the producer is streaming, idle or hung
+func (c *IPCConsumer) HeartbeatStats() HeartbeatStats {
+	h := &c.hb
+	st := HeartbeatStats{
+		State:       ProducerDisconnected,
+		Supported:   h.supported.Load(),
+		Missed:      int(h.missed.Load()),
+		Disconnects: h.disconnects.Load(),
+	}
+	h.mu.Lock()
+	st.RTTMs = float64(h.rtt.Microseconds()) / 1000
+	h.mu.Unlock()
+	if ns := h.lastMessage.Load(); ns != 0 {
+		at := time.Unix(0, ns).UTC()
+		st.LastMessageAt = &at
+	}
+	if ns := h.lastMedia.Load(); ns != 0 {
+		at := time.Unix(0, ns).UTC()
+		st.LastMediaAt = &at
+	}
+
+	if !c.IsConnected() {
+		return st
+	}
+	switch {
+	case st.Supported && st.Missed >= 2: // One ping is normally in flight
+		st.State = ProducerUnresponsive
+	case st.LastMediaAt != nil && time.Since(*st.LastMediaAt) < c.readTimeout:
+		st.State = ProducerStreaming
+	default:
+		st.State = ProducerIdle
+	}
+	return st
+}
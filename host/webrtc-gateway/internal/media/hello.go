@@ -0,0 +1,221 @@
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"slices"
+)
+
+// IPC protocol versions the gateway speaks. A producer that sends no hello
+// speaks version 0, the original unversioned protocol, which is always
+// accepted; hello and everything it negotiates start at version 1.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// Features a producer and the gateway may share, negotiated in the hello
+// exchange
+const (
+	FeatureControl      = "control"   // Encoder commands from the gateway
+	FeatureHeartbeat    = "heartbeat" // Ping and pong
+	FeatureText         = "text"      // Timed text messages
+	FeatureGameInfo     = "game_info" // Game info messages
+	FeatureSharedMemory = "shm"       // Frame payloads in shared memory; not yet supported by the gateway
+)
+
+// gatewayFeatures are the features this gateway offers
+var gatewayFeatures = []string{FeatureControl, FeatureHeartbeat, FeatureText, FeatureGameInfo}
+
+// helloMessage is the JSON of MessageTypeHello. The producer sends one as
+// its first message, listing what it can do; the gateway answers with what
+// the two have in common, or with Error and a closed connection when no
+// protocol version is shared.
+type helloMessage struct {
+	Version    int      `json:"version"`
+	MinVersion int      `json:"min_version"`
+	Software   string   `json:"software,omitempty"`
+	Codecs     []string `json:"codecs,omitempty"` // Most preferred first
+	Features   []string `json:"features,omitempty"`
+	Error      string   `json:"error,omitempty"`
+
+	// Capture names the producer's capture API, e.g. "screencapturekit"
+	Capture string `json:"capture,omitempty"`
+
+	// PixelFormats are the formats the producer can encode from; the
+	// gateway answers with the one to use in PixelFormat
+	PixelFormats []string `json:"pixel_formats,omitempty"`
+	PixelFormat  string   `json:"pixel_format,omitempty"`
+}
+
+// Negotiation is what the gateway and the connected producer agreed on
+type Negotiation struct {
+	// Version is the protocol version in use; 0 is a producer that sent no
+	// hello, whose features are discovered as it uses them
+	Version  int      `json:"version"`
+	Software string   `json:"software,omitempty"`
+	Codecs   []string `json:"codecs,omitempty"` // In the gateway's order of preference
+	Features []string `json:"features,omitempty"`
+
+	Capture     string `json:"capture,omitempty"`
+	PixelFormat string `json:"pixel_format,omitempty"` // Empty when the producer offered none
+	BitDepth    int    `json:"bit_depth,omitempty"`    // Of PixelFormat
+}
+
+// Has reports whether a feature was negotiated
+func (n *Negotiation) Has(feature string) bool {
+	return n != nil && slices.Contains(n.Features, feature)
+}
+
+// negotiate finds what the gateway shares with a producer's hello, given
+// the codecs and pixel formats the gateway accepts
+func negotiate(p helloMessage, codecs, formats []string) (Negotiation, error) {
+	version := min(p.Version, ProtocolVersion)
+	if version < max(p.MinVersion, MinProtocolVersion) {
+		return Negotiation{}, fmt.Errorf("no common protocol version: producer speaks %d to %d, gateway %d to %d",
+			p.MinVersion, p.Version, MinProtocolVersion, ProtocolVersion)
+	}
+	n := Negotiation{Version: version, Software: p.Software, Capture: p.Capture}
+	for _, codec := range codecs {
+		if slices.Contains(p.Codecs, codec) {
+			n.Codecs = append(n.Codecs, codec)
+		}
+	}
+	if len(p.Codecs) > 0 && len(n.Codecs) == 0 {
+		if slices.Contains(p.Codecs, CodecHEVCAlpha) {
+			return Negotiation{}, fmt.Errorf("no common codec: %w", errHEVCAlpha)
+		}
+		return Negotiation{}, fmt.Errorf("no common codec: producer offers %v, gateway accepts %v", p.Codecs, codecs)
+	}
+	for _, format := range formats {
+		if !slices.Contains(p.PixelFormats, format) {
+			continue
+		}
+		n.PixelFormat, n.BitDepth = format, 8
+		if format == PixelFormatP010 {
+			// 10-bit output narrows the codecs to those with a 10-bit
+			// profile viewers decode
+			deep := deepCodecs(n.Codecs)
+			if len(p.Codecs) == 0 {
+				deep = deepCodecs(codecs)
+			}
+			if len(deep) == 0 {
+				n.PixelFormat = ""
+				continue
+			}
+			n.Codecs, n.BitDepth = deep, 10
+		}
+		break
+	}
+	if len(p.PixelFormats) > 0 && n.PixelFormat == "" {
+		if slices.Contains(formats, PixelFormatP010) && slices.Contains(p.PixelFormats, PixelFormatP010) {
+			return Negotiation{}, fmt.Errorf("no common pixel format: p010 needs one of %v, producer offers %v", highBitDepthCodecs, p.Codecs)
+		}
+		return Negotiation{}, fmt.Errorf("no common pixel format: producer offers %v, gateway accepts %v", p.PixelFormats, formats)
+	}
+	for _, feature := range gatewayFeatures {
+		if slices.Contains(p.Features, feature) {
+			n.Features = append(n.Features, feature)
+		}
+	}
+	return n, nil
+}
+
+// deepCodecs returns the codecs with a 10-bit profile viewers decode
+func deepCodecs(codecs []string) []string {
+	var out []string
+	for _, codec := range codecs {
+		if slices.Contains(highBitDepthCodecs, codec) {
+			out = append(out, codec)
+		}
+	}
+	return out
+}
+
+// handleHello negotiates with the producer on conn and answers it. It
+// returns an error, ending the connection, when nothing can be agreed.
+func (c *IPCConsumer) handleHello(conn net.Conn, jsonData []byte) error {
+	var p helloMessage
+	if err := json.Unmarshal(jsonData, &p); err != nil {
+		return fmt.Errorf("invalid hello: %w", err)
+	}
+
+	n, err := negotiate(p, c.codecs, c.pixelFormats)
+	if err != nil {
+		c.logger.Warn().
+			Err(err).
+			Str("software", p.Software).
+			Msg("Rejecting capture service")
+		// Best effort: the producer learns why before the connection closes
+		c.writeMessage(conn, MessageTypeHello, helloMessage{
+			Version:      ProtocolVersion,
+			MinVersion:   MinProtocolVersion,
+			Codecs:       c.codecs,
+			Features:     gatewayFeatures,
+			PixelFormats: c.pixelFormats,
+			Error:        err.Error(),
+		})
+		return err
+	}
+
+	c.helloMu.Lock()
+	c.negotiation = &n
+	c.helloMu.Unlock()
+
+	// Negotiated features need no discovery
+	if n.Has(FeatureControl) {
+		c.controlSupported.Store(true)
+	}
+	if n.Has(FeatureHeartbeat) {
+		c.hb.supported.Store(true)
+	}
+
+	c.logger.Info().
+		Int("version", n.Version).
+		Str("software", n.Software).
+		Str("capture", n.Capture).
+		Strs("codecs", n.Codecs).
+		Strs("features", n.Features).
+		Str("pixel_format", n.PixelFormat).
+		Int("bit_depth", n.BitDepth).
+		Msg("Negotiated with capture service")
+
+	if err := c.writeMessage(conn, MessageTypeHello, helloMessage{
+		Version:     n.Version,
+		MinVersion:  MinProtocolVersion,
+		Codecs:      n.Codecs,
+		Features:    n.Features,
+		PixelFormat: n.PixelFormat,
+	}); err != nil {
+		c.logger.Debug().Err(err).Msg("Failed to answer hello")
+	}
+	return nil
+}
+
+// resetNegotiation forgets the previous producer's hello
+func (c *IPCConsumer) resetNegotiation() {
+	c.helloMu.Lock()
+	c.negotiation = nil
+	c.helloMu.Unlock()
+}
+
+// negotiated returns the current producer's negotiation, or nil for a
+// producer that sent no hello
+func (c *IPCConsumer) negotiated() *Negotiation {
+	c.helloMu.Lock()
+	defer c.helloMu.Unlock()
+	return c.negotiation
+}
+
+// Negotiation reports what the connected producer agreed on; Version is 0
+// for a producer that sent no hello. ok is false with no producer.
+func (c *IPCConsumer) Negotiation() (n Negotiation, ok bool) {
+	if !c.IsConnected() {
+		return Negotiation{}, false
+	}
+	if p := c.negotiated(); p != nil {
+		return *p, true
+	}
+	return Negotiation{}, true
+}
@@ -2,6 +2,7 @@
 package media
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
 	"encoding/json"
@@ -9,14 +10,27 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"os"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/rs/zerolog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/mpegts"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/svc"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/tracing"
 )
 
+// ipcTracer traces frame receipt from the capture service
+var ipcTracer = tracing.Tracer("ipc")
+
 // MessageType represents the type of IPC message
 type MessageType byte
 
@@ -24,6 +38,32 @@ const (
 	MessageTypeVideo    MessageType = 0x01
 	MessageTypeAudio    MessageType = 0x02
 	MessageTypeMetadata MessageType = 0x03
+
+	// MessageTypeReturnAudio flows the other way, from the gateway to the
+	// host over the return channel socket
+	MessageTypeReturnAudio MessageType = 0x04
+
+	// MessageTypeText carries timed text such as speech-to-text captions
+	MessageTypeText MessageType = 0x05
+
+	// MessageTypeGameInfo carries the running game and performance counters
+	MessageTypeGameInfo MessageType = 0x06
+
+	// MessageTypeControl flows from the gateway to the capture service on
+	// the capture socket, commanding its encoder; MessageTypeControlReply
+	// is the answer
+	MessageTypeControl      MessageType = 0x07
+	MessageTypeControlReply MessageType = 0x08
+
+	// MessageTypePing may be sent either way on the capture socket; the
+	// other side answers with a MessageTypePong echoing its sequence number
+	MessageTypePing MessageType = 0x09
+	MessageTypePong MessageType = 0x0A
+
+	// MessageTypeHello opens a connection: the producer advertises its
+	// protocol versions, codecs and features, and the gateway answers with
+	// what they share
+	MessageTypeHello MessageType = 0x0B
 )
 
 // String returns a human-readable name for the message type
@@ -35,6 +75,22 @@ func (m MessageType) String() string {
 		return "audio"
 	case MessageTypeMetadata:
 		return "metadata"
+	case MessageTypeReturnAudio:
+		return "return_audio"
+	case MessageTypeText:
+		return "text"
+	case MessageTypeGameInfo:
+		return "game_info"
+	case MessageTypeControl:
+		return "control"
+	case MessageTypeControlReply:
+		return "control_reply"
+	case MessageTypePing:
+		return "ping"
+	case MessageTypePong:
+		return "pong"
+	case MessageTypeHello:
+		return "hello"
 	default:
 		return fmt.Sprintf("unknown(0x%02x)", byte(m))
 	}
@@ -47,19 +103,70 @@ type VideoFrame struct {
 	IsKeyframe bool   // True if this is a keyframe
 	Width      int    // Frame width
 	Height     int    // Frame height
-	Codec      string // "h264" or "hevc"
-	Data       []byte // Encoded frame data (NAL units)
+	Codec      string // "h264", "hevc" or "vp9"
+	Data       []byte // Encoded frame data (Annex-B NAL units, or a VP9 frame)
 	ReceivedAt time.Time
+
+	// Discontinuity marks the first frame after a jump in the producer's
+	// timestamps was spliced out; recorders should not join it to what
+	// came before
+	Discontinuity bool
+
+	// Trace links per-frame spans across stages; invalid when not sampled
+	Trace trace.SpanContext
+
+	// SVC carries producer-signalled layer metadata for scalable VP9; nil
+	// otherwise. AV1 layer IDs are read from the bitstream.
+	SVC *svc.FrameInfo
+
+	// Color is the producer's declared color space; nil when unknown
+	Color *ColorSpace
+
+	// HDR is the stream's HDR10 mastering and light level metadata; nil
+	// for SDR or when the producer does not say
+	HDR *HDRMetadata
+
+	// Rotation is how far the picture is turned clockwise for display: 0,
+	// 90, 180 or 270 degrees, e.g. 90 for a handheld held upright
+	Rotation int
 }
 
 // AudioFrame represents PCM audio samples
 type AudioFrame struct {
 	PTS         int64  // Presentation timestamp in nanoseconds
 	SampleRate  int    // e.g., 48000
-	Channels    int    // e.g., 2 for stereo
+	Channels    int    // 1-8, WAVE order: L R C LFE Ls Rs Lb Rb
 	SampleCount int    // Number of samples
 	Data        []byte // Raw PCM samples (16-bit signed, interleaved)
+	Source      string // Producer's name for the input, e.g. "game" or "mic"; empty for the main mix
 	ReceivedAt  time.Time
+
+	// Discontinuity marks the first frame after a jump in the producer's
+	// timestamps was spliced out
+	Discontinuity bool
+}
+
+// TextFrame is a timed caption
+type TextFrame struct {
+	PTS        int64         // Presentation timestamp in nanoseconds, on the video clock
+	Duration   time.Duration // How long the text is shown
+	Text       string
+	Speaker    string // Optional speaker label
+	Language   string // Optional BCP 47 tag
+	ReceivedAt time.Time
+}
+
+// GameInfo describes what the host is playing. Producers send it when the
+// game or scene changes and periodically with fresh counters.
+type GameInfo struct {
+	Game        string             `json:"game,omitempty"`          // Display name of the running game
+	Scene       string             `json:"scene,omitempty"`         // Level, map or menu, as the producer names it
+	FPS         float64            `json:"fps,omitempty"`           // Game render rate
+	FrameTimeMs float64            `json:"frame_time_ms,omitempty"` // Average frame time
+	CPUPercent  float64            `json:"cpu_percent,omitempty"`
+	GPUPercent  float64            `json:"gpu_percent,omitempty"`
+	Counters    map[string]float64 `json:"counters,omitempty"` // Any other named counters
+	ReceivedAt  time.Time          `json:"-"`
 }
 
 // StreamMetadata contains stream configuration from capture service
@@ -70,6 +177,28 @@ type StreamMetadata struct {
 	VideoFPS      int    `json:"video_fps"`
 	AudioRate     int    `json:"audio_sample_rate"`
 	AudioChannels int    `json:"audio_channels"`
+
+	// VideoFormat is the NAL framing of H.264/H.265 frames: "annexb",
+	// "avcc" (length-prefixed, also for HEVC) or empty to detect per frame
+	VideoFormat string `json:"video_format,omitempty"`
+
+	// VideoCodecConfig is the avcC/hvcC decoder configuration record for
+	// length-prefixed streams, base64 in JSON. It supplies the NAL length
+	// size and the parameter sets inserted ahead of keyframes.
+	VideoCodecConfig []byte `json:"video_codec_config,omitempty"`
+
+	// Color is the video's color space, passed through to frames; nil
+	// when the producer does not say
+	Color *ColorSpace `json:"color,omitempty"`
+
+	// HDR is the HDR10 static metadata of a PQ or HLG stream, passed
+	// through to frames and recordings
+	HDR *HDRMetadata `json:"hdr,omitempty"`
+
+	// Rotation is the clockwise display rotation of the video in degrees,
+	// a multiple of 90, for portrait and handheld captures whose encoded
+	// picture is sideways
+	Rotation int `json:"rotation,omitempty"`
 }
 
 // videoFrameMetadata is the JSON structure for video frame metadata
@@ -80,31 +209,110 @@ type videoFrameMetadata struct {
 	Width    int    `json:"width"`
 	Height   int    `json:"height"`
 	Codec    string `json:"codec"`
+
+	// Optional integrity fields, see seqTracker
+	Seq   uint64  `json:"seq,omitempty"`
+	CRC32 *uint32 `json:"crc32,omitempty"` // IEEE CRC-32 of the payload
 }
 
 // audioFrameMetadata is the JSON structure for audio frame metadata
 type audioFrameMetadata struct {
-	PTS         int64 `json:"pts"`
-	SampleRate  int   `json:"sample_rate"`
-	Channels    int   `json:"channels"`
-	SampleCount int   `json:"sample_count"`
+	PTS         int64  `json:"pts"`
+	SampleRate  int    `json:"sample_rate"`
+	Channels    int    `json:"channels"`
+	SampleCount int    `json:"sample_count"`
+	Source      string `json:"source"`
+
+	// Optional integrity fields, see seqTracker
+	Seq   uint64  `json:"seq,omitempty"`
+	CRC32 *uint32 `json:"crc32,omitempty"` // IEEE CRC-32 of the payload
+}
+
+// textFrameMetadata is the JSON structure for a text message. The text
+// may also be sent as the UTF-8 payload.
+type textFrameMetadata struct {
+	PTS        int64  `json:"pts"`
+	DurationMs int64  `json:"duration_ms"`
+	Text       string `json:"text"`
+	Speaker    string `json:"speaker"`
+	Language   string `json:"language"`
 }
 
 // IPCConsumerConfig configures the IPC consumer
 type IPCConsumerConfig struct {
-	SocketPath      string
-	VideoBufferSize int           // Channel buffer size, default 30
-	AudioBufferSize int           // Channel buffer size, default 60
-	ReconnectDelay  time.Duration // Delay between reconnect attempts
+	SocketPath     string
+	ReconnectDelay time.Duration // Delay between reconnect attempts
+
+	// Frames wait in queues sized to hold a duration of the stream at its
+	// measured frame rate. The buffer sizes are the capacities until the
+	// rate is known, default 30 video and 60 audio frames; the durations
+	// default to 500ms of video and 1s of audio. MaxVideoBufferBytes caps
+	// the video queue for large frames, default 64 MiB.
+	VideoBufferSize     int
+	AudioBufferSize     int
+	VideoBufferDuration time.Duration
+	AudioBufferDuration time.Duration
+	MaxVideoBufferBytes int64
+
+	// VideoFormat forces the NAL framing of H.264/H.265 input, overriding
+	// stream metadata; bitstream.FormatUnknown leaves it to the producer or
+	// to detection. Frames are always passed on in Annex-B form.
+	VideoFormat bitstream.Format
+
+	// Listener is an already-open socket, e.g. from systemd socket
+	// activation, used instead of creating SocketPath. The socket file is
+	// then left in place on Stop, and the consumer cannot be restarted.
+	Listener net.Listener
+
+	// MaxTimestampGap is the longest forward step in producer timestamps
+	// taken as continuous, default 5s. Longer ones, and every step back,
+	// are spliced out of the timeline.
+	MaxTimestampGap time.Duration
+
+	// ReadTimeout is how long the consumer waits for the next message
+	// before checking for shutdown, default 5s; a quiet producer stays
+	// connected. Once a message has begun, the rest of it must arrive
+	// within ReadTimeout or the producer is taken to be hung.
+	ReadTimeout time.Duration
+
+	// HeartbeatInterval is how often the producer is pinged, default 2s;
+	// negative disables heartbeats. A producer that has answered a ping
+	// and then sends nothing for MaxMissedHeartbeats pings in a row,
+	// default 3, is disconnected.
+	HeartbeatInterval   time.Duration
+	MaxMissedHeartbeats int
+
+	// Codecs are the video codecs accepted from producers that negotiate,
+	// most preferred first, default h264, hevc, av1 and vp9
+	Codecs []string
+
+	// HighBitDepth accepts 10-bit (p010) capture from producers that
+	// negotiate it, for HEVC Main 10, AV1 or VP9 profile 2 output. Viewers
+	// that decode only 8-bit need the producer to fall back on command.
+	HighBitDepth bool
+
+	// TapPath, if set, is a file every producer connection's byte stream
+	// is appended to, with arrival times, for replay through a
+	// ReplayListener. Recording stops once the file passes TapMaxBytes,
+	// default 1 GiB.
+	TapPath     string
+	TapMaxBytes int64
 }
 
 // DefaultIPCConsumerConfig returns sensible defaults for IPC consumer config
 func DefaultIPCConsumerConfig() IPCConsumerConfig {
 	return IPCConsumerConfig{
-		SocketPath:      "/tmp/gaming-capture.sock",
-		VideoBufferSize: 30,
-		AudioBufferSize: 60,
-		ReconnectDelay:  time.Second,
+		SocketPath:          "/tmp/gaming-capture.sock",
+		VideoBufferSize:     30,
+		AudioBufferSize:     60,
+		VideoBufferDuration: 500 * time.Millisecond,
+		AudioBufferDuration: time.Second,
+		MaxVideoBufferBytes: 64 << 20,
+		ReconnectDelay:      time.Second,
+		ReadTimeout:         5 * time.Second,
+		HeartbeatInterval:   2 * time.Second,
+		MaxMissedHeartbeats: 3,
+		Codecs:              []string{"h264", "hevc", "av1", "vp9"},
 	}
 }
 
@@ -112,23 +320,78 @@ func DefaultIPCConsumerConfig() IPCConsumerConfig {
 type IPCConsumer struct {
 	socketPath string
 	listener   net.Listener
+	activated  net.Listener // Inherited listener from config, if any
 	conn       net.Conn
 	logger     zerolog.Logger
+	warnings   *logging.Summarizer // Rate-limits per-frame warnings
+
+	// Liveness of the producer connection
+	readTimeout         time.Duration
+	heartbeatInterval   time.Duration // Negative disables heartbeats
+	maxMissedHeartbeats int
+	hb                  heartbeatState
+	resyncs             resyncState // Recoveries from stream corruption
+	videoSeq            seqTracker  // Producer-side video drops
+	audioSeq            seqTracker  // Producer-side audio drops
+
+	// Protocol negotiated with the current producer; nil without a hello
+	codecs       []string
+	pixelFormats []string
+	helloMu      sync.Mutex
+	negotiation  *Negotiation
+
+	// Recording of the producer byte stream, if configured
+	tapPath     string
+	tapMaxBytes int64
+	tap         *ipcTap
 
 	videoFrames chan VideoFrame
 	audioFrames chan AudioFrame
+	videoQueue  *frameQueue[VideoFrame] // Feeds videoFrames
+	audioQueue  *frameQueue[AudioFrame] // Feeds audioFrames
+	textFrames  chan TextFrame
+	gameInfo    chan GameInfo
 	metadata    chan StreamMetadata
 	errors      chan error
 
-	mu        sync.RWMutex
-	connected bool
-	listening bool
+	mu           sync.RWMutex
+	connected    bool
+	listening    bool
+	onConnection func(connected bool)
+
+	// Framing normalization; only touched by the read loop
+	videoFormat bitstream.Format
+	streamMeta  StreamMetadata
+	normalizer  *bitstream.Normalizer
+	normCodec   string
+
+	// timeline keeps frame timestamps continuous across producer restarts
+	// and clock jumps, running at the gateway's clock rate
+	timeline *Timeline
 
 	ctx    context.Context
 	cancel context.CancelFunc
 
+	// Control channel back to the producer on the same connection
+	ctlMu            sync.Mutex
+	ctlWriteMu       sync.Mutex // Serializes command writes
+	controlPending   map[uint64]chan ControlReply
+	controlState     *ControlReply
+	controlBroken    net.Conn // Connection a write failed on
+	controlTS        bool     // The producer pushes plain MPEG-TS
+	controlID        atomic.Uint64
+	controlSupported atomic.Bool
+	keyframeQueued   atomic.Bool
+
 	// Statistics
 	videoFrameCount atomic.Uint64
+	videoMeter      rateMeter
+	videoTiming     frameTiming
+	declaredFPS     atomic.Int32 // Frame rate in the latest stream metadata
+	audioMeter      rateMeter
+	controlSent     atomic.Uint64
+	controlFailed   atomic.Uint64
+	controlTimedOut atomic.Uint64
 	audioFrameCount atomic.Uint64
 	bytesReceived   atomic.Uint64
 	lastStatsTime   time.Time
@@ -149,12 +412,65 @@ func NewIPCConsumer(cfg IPCConsumerConfig, logger zerolog.Logger) *IPCConsumer {
 	if cfg.AudioBufferSize <= 0 {
 		cfg.AudioBufferSize = 60
 	}
+	if cfg.VideoBufferDuration <= 0 {
+		cfg.VideoBufferDuration = 500 * time.Millisecond
+	}
+	if cfg.AudioBufferDuration <= 0 {
+		cfg.AudioBufferDuration = time.Second
+	}
+	if cfg.MaxVideoBufferBytes <= 0 {
+		cfg.MaxVideoBufferBytes = 64 << 20
+	}
+	if cfg.ReadTimeout <= 0 {
+		cfg.ReadTimeout = 5 * time.Second
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = 2 * time.Second
+	}
+	if cfg.MaxMissedHeartbeats <= 0 {
+		cfg.MaxMissedHeartbeats = 3
+	}
+	if len(cfg.Codecs) == 0 {
+		cfg.Codecs = []string{"h264", "hevc", "av1", "vp9"}
+	}
+	if cfg.TapMaxBytes <= 0 {
+		cfg.TapMaxBytes = 1 << 30
+	}
+	logger = logger.With().Str("component", "ipc_consumer").Logger()
 
 	return &IPCConsumer{
-		socketPath:    cfg.SocketPath,
-		logger:        logger.With().Str("component", "ipc_consumer").Logger(),
-		videoFrames:   make(chan VideoFrame, cfg.VideoBufferSize),
-		audioFrames:   make(chan AudioFrame, cfg.AudioBufferSize),
+		socketPath:          cfg.SocketPath,
+		videoFormat:         cfg.VideoFormat,
+		activated:           cfg.Listener,
+		tapPath:             cfg.TapPath,
+		readTimeout:         cfg.ReadTimeout,
+		heartbeatInterval:   cfg.HeartbeatInterval,
+		maxMissedHeartbeats: cfg.MaxMissedHeartbeats,
+		codecs:              cfg.Codecs,
+		pixelFormats:        pixelFormats(cfg.HighBitDepth),
+		tapMaxBytes:         cfg.TapMaxBytes,
+		logger:              logger,
+		warnings:            logging.NewSummarizer(logger),
+		timeline:            NewTimeline(cfg.MaxTimestampGap, logger.With().Str("component", "timeline").Logger()),
+		videoFrames:         make(chan VideoFrame),
+		audioFrames:         make(chan AudioFrame),
+		videoQueue: newFrameQueue[VideoFrame](frameQueueConfig{
+			name:     "video",
+			initial:  cfg.VideoBufferSize,
+			duration: cfg.VideoBufferDuration,
+			minCap:   8,
+			maxCap:   600,
+			maxBytes: cfg.MaxVideoBufferBytes,
+		}, logger),
+		audioQueue: newFrameQueue[AudioFrame](frameQueueConfig{
+			name:     "audio",
+			initial:  cfg.AudioBufferSize,
+			duration: cfg.AudioBufferDuration,
+			minCap:   16,
+			maxCap:   1000,
+		}, logger),
+		textFrames:    make(chan TextFrame, 32),
+		gameInfo:      make(chan GameInfo, 8),
 		metadata:      make(chan StreamMetadata, 4),
 		errors:        make(chan error, 16),
 		statsInterval: 5 * time.Second,
@@ -172,15 +488,22 @@ func (c *IPCConsumer) Start(ctx context.Context) error {
 	c.ctx, c.cancel = context.WithCancel(ctx)
 	c.mu.Unlock()
 
-	// Remove stale socket file if it exists
-	if err := os.Remove(c.socketPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove stale socket: %w", err)
+	if c.tapPath != "" {
+		tap, err := openIPCTap(c.tapPath, c.tapMaxBytes, c.logger)
+		if err != nil {
+			return fmt.Errorf("failed to open IPC tap: %w", err)
+		}
+		c.tap = tap
+		c.logger.Info().Str("path", c.tapPath).Msg("Recording producer streams")
 	}
 
-	// Start listening on Unix socket
-	listener, err := net.Listen("unix", c.socketPath)
+	listener, err := c.listen()
 	if err != nil {
-		return fmt.Errorf("failed to listen on socket: %w", err)
+		if c.tap != nil {
+			c.tap.Close()
+			c.tap = nil
+		}
+		return err
 	}
 
 	c.mu.Lock()
@@ -192,6 +515,9 @@ func (c *IPCConsumer) Start(ctx context.Context) error {
 
 	// Start the accept loop in a goroutine
 	go c.acceptLoop()
+	go c.videoQueue.run(c.ctx, c.videoFrames)
+	go c.audioQueue.run(c.ctx, c.audioFrames)
+	go c.tuneQueues(c.ctx)
 
 	c.logger.Info().
 		Str("socket_path", c.socketPath).
@@ -200,6 +526,14 @@ func (c *IPCConsumer) Start(ctx context.Context) error {
 	return nil
 }
 
+// listen returns the inherited listener, or creates the socket or pipe
+func (c *IPCConsumer) listen() (net.Listener, error) {
+	if c.activated != nil {
+		return c.activated, nil
+	}
+	return listenIPC(c.socketPath)
+}
+
 // Stop stops listening and disconnects any active connection
 func (c *IPCConsumer) Stop() error {
 	c.mu.Lock()
@@ -229,8 +563,17 @@ func (c *IPCConsumer) Stop() error {
 	}
 	c.listening = false
 
-	// Clean up socket file
-	os.Remove(c.socketPath)
+	if c.tap != nil {
+		if err := c.tap.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		c.tap = nil
+	}
+
+	// Clean up socket file; an inherited socket belongs to its creator
+	if c.activated == nil {
+		removeIPC(c.socketPath)
+	}
 
 	c.logger.Info().Msg("IPC consumer stopped")
 
@@ -245,11 +588,27 @@ func (c *IPCConsumer) VideoFrames() <-chan VideoFrame {
 	return c.videoFrames
 }
 
+// VideoFrameChannel implements FrameSource, so a consumer can feed the
+// distributor directly
+func (c *IPCConsumer) VideoFrameChannel() <-chan VideoFrame {
+	return c.videoFrames
+}
+
 // AudioFrames returns the channel for receiving audio frames
 func (c *IPCConsumer) AudioFrames() <-chan AudioFrame {
 	return c.audioFrames
 }
 
+// TextFrames returns the channel for receiving timed text
+func (c *IPCConsumer) TextFrames() <-chan TextFrame {
+	return c.textFrames
+}
+
+// GameInfo returns the channel for receiving game info
+func (c *IPCConsumer) GameInfo() <-chan GameInfo {
+	return c.gameInfo
+}
+
 // Metadata returns the channel for receiving stream metadata
 func (c *IPCConsumer) Metadata() <-chan StreamMetadata {
 	return c.metadata
@@ -260,6 +619,15 @@ func (c *IPCConsumer) Errors() <-chan error {
 	return c.errors
 }
 
+// SetOnConnectionChange sets a callback run when the capture service
+// connects or disconnects. It runs on the accept goroutine and must not
+// block.
+func (c *IPCConsumer) SetOnConnectionChange(fn func(connected bool)) {
+	c.mu.Lock()
+	c.onConnection = fn
+	c.mu.Unlock()
+}
+
 // IsConnected returns true if connected to the socket
 func (c *IPCConsumer) IsConnected() bool {
 	c.mu.RLock()
@@ -272,6 +640,49 @@ func (c *IPCConsumer) Stats() (videoFrames, audioFrames, bytesReceived uint64) {
 	return c.videoFrameCount.Load(), c.audioFrameCount.Load(), c.bytesReceived.Load()
 }
 
+// IngestStats returns the video and audio stages: frames received from the
+// capture service and waiting to be consumed. Dropped counts the consumer's
+// own queue drops; ProducerDropped the frames the producer numbered but never
+// sent. NominalFPS is the frame rate the producer declared.
+func (c *IPCConsumer) IngestStats() (video, audio StageStats) {
+	now := time.Now()
+	video = StageStats{Frames: c.videoFrameCount.Load()}
+	c.videoQueue.fill(&video)
+	c.videoMeter.fill(&video, now)
+	c.videoSeq.fill(&video)
+	c.videoTiming.fill(&video)
+	video.NominalFPS = float64(c.declaredFPS.Load())
+	audio = StageStats{Frames: c.audioFrameCount.Load()}
+	c.audioQueue.fill(&audio)
+	c.audioMeter.fill(&audio, now)
+	c.audioSeq.fill(&audio)
+	return video, audio
+}
+
+// tuneQueues re-sizes the frame queues to the measured stream every second
+// until ctx is done
+func (c *IPCConsumer) tuneQueues(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			var video, audio StageStats
+			c.videoMeter.fill(&video, now)
+			c.audioMeter.fill(&audio, now)
+			c.videoQueue.tune(now, video.FPS, video.BitrateKbps)
+			c.audioQueue.tune(now, audio.FPS, audio.BitrateKbps)
+		}
+	}
+}
+
+// TimelineStats returns the timestamp sanitizer's counters
+func (c *IPCConsumer) TimelineStats() TimelineStats {
+	return c.timeline.Stats()
+}
+
 // acceptLoop waits for capture service connections and handles them
 func (c *IPCConsumer) acceptLoop() {
 	for {
@@ -318,7 +729,11 @@ func (c *IPCConsumer) acceptLoop() {
 		}
 		c.conn = conn
 		c.connected = true
+		onConnection := c.onConnection
 		c.mu.Unlock()
+		if onConnection != nil {
+			onConnection(true)
+		}
 
 		// Read frames until disconnected
 		if err := c.readLoop(); err != nil {
@@ -341,7 +756,11 @@ func (c *IPCConsumer) acceptLoop() {
 			c.conn = nil
 		}
 		c.connected = false
+		onConnection = c.onConnection
 		c.mu.Unlock()
+		if onConnection != nil {
+			onConnection(false)
+		}
 
 		c.logger.Info().Msg("Capture service disconnected, waiting for reconnection")
 	}
@@ -349,6 +768,39 @@ func (c *IPCConsumer) acceptLoop() {
 
 // readLoop continuously reads frames from socket
 func (c *IPCConsumer) readLoop() error {
+	c.mu.RLock()
+	conn := c.conn
+	tap := c.tap
+	c.mu.RUnlock()
+	if conn == nil {
+		return errors.New("connection closed")
+	}
+	r := bufio.NewReaderSize(conn, ipcReadBuffer)
+	if tap != nil {
+		tap.connected()
+		defer tap.flush()
+		r = bufio.NewReaderSize(&tapReader{r: conn, tap: tap}, ipcReadBuffer)
+	}
+
+	// Producers may push a plain MPEG-TS stream instead of IPC messages
+	isTS, err := c.detectTS(conn, r)
+	if err != nil {
+		return err
+	}
+	c.resetControl(isTS)
+	c.hb.reset()
+	c.resetNegotiation()
+	c.videoSeq.reset()
+	c.audioSeq.reset()
+	if isTS {
+		return c.readTSLoop(conn, r)
+	}
+	if c.heartbeatInterval > 0 {
+		ctx, stop := context.WithCancel(c.ctx)
+		defer stop()
+		go c.heartbeat(ctx, conn)
+	}
+
 	for {
 		select {
 		case <-c.ctx.Done():
@@ -365,59 +817,147 @@ func (c *IPCConsumer) readLoop() error {
 			return errors.New("connection closed")
 		}
 
-		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		// Wait for the next message; a quiet producer is not an error
+		if err := conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
 			return err
 		}
-
-		// Parse a single message
-		msgType, jsonData, payload, err := c.parseMessage(conn)
-		if err != nil {
+		if _, err := r.Peek(1); err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				// Timeout is OK, just continue to check context
 				c.logStats()
 				continue
 			}
 			return err
 		}
 
+		// A message cut off part way is a stalled producer; one that does
+		// not parse is skipped to the next
+		if err := conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return err
+		}
+		var (
+			msgType           MessageType
+			jsonData, payload []byte
+		)
+		valid, err := c.checkHeader(r)
+		if err == nil {
+			if valid {
+				msgType, jsonData, payload, err = c.parseMessage(r)
+			} else {
+				err = errCorruptMessage
+			}
+		}
+		if errors.Is(err, errCorruptMessage) {
+			err = c.resync(conn, r, err)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return fmt.Errorf("producer stalled mid-message: %w", err)
+			}
+			return err
+		}
+		c.hb.heard(time.Now(), msgType == MessageTypeVideo || msgType == MessageTypeAudio)
+
 		// Track bytes received
 		c.bytesReceived.Add(uint64(1 + 4 + len(jsonData) + len(payload)))
 
 		// Process based on message type
 		switch msgType {
 		case MessageTypeVideo:
+			_, span := ipcTracer.Start(c.ctx, "ipc.receive_video")
 			frame, err := c.parseVideoFrame(jsonData, payload)
 			if err != nil {
-				c.logger.Warn().Err(err).Msg("Failed to parse video frame")
+				c.warnings.Warn("Failed to parse video frame", func(e *zerolog.Event) { e.Err(err) })
+				span.SetStatus(codes.Error, err.Error())
+				span.End()
 				continue
 			}
+			span.SetAttributes(
+				attribute.Int("frame.size", len(frame.Data)),
+				attribute.Bool("frame.keyframe", frame.IsKeyframe),
+				attribute.Int64("frame.pts", frame.PTS),
+			)
+
+			if n := c.negotiated(); n != nil && len(n.Codecs) > 0 && !slices.Contains(n.Codecs, frame.Codec) {
+				c.warnings.Warn("Capture service sent a codec it did not negotiate", func(e *zerolog.Event) {
+					e.Str("codec", frame.Codec).Strs("negotiated", n.Codecs)
+				})
+			}
 
-			// Send to channel (non-blocking to avoid backpressure issues)
-			select {
-			case c.videoFrames <- frame:
+			// Downstream spans for this frame join the receive trace
+			frame.Trace = span.SpanContext()
+			frame = c.timeline.Video(frame)
+			c.videoTiming.add(frame)
+
+			// Queue without blocking; sustained drops are reported by tuneQueues
+			if c.videoQueue.push(frame) {
 				c.videoFrameCount.Add(1)
-			default:
-				c.logger.Warn().Msg("Video frame channel full, dropping frame")
+				c.videoMeter.add(time.Now(), len(frame.Data))
+			} else {
+				span.AddEvent("dropped: queue full")
 			}
+			span.End()
 
 		case MessageTypeAudio:
 			frame, err := c.parseAudioFrame(jsonData, payload)
 			if err != nil {
-				c.logger.Warn().Err(err).Msg("Failed to parse audio frame")
+				c.warnings.Warn("Failed to parse audio frame", func(e *zerolog.Event) { e.Err(err) })
 				continue
 			}
+			frame = c.timeline.Audio(frame)
 
-			select {
-			case c.audioFrames <- frame:
+			if c.audioQueue.push(frame) {
 				c.audioFrameCount.Add(1)
+				c.audioMeter.add(time.Now(), len(frame.Data))
+			}
+
+		case MessageTypeText:
+			frame, err := c.parseTextFrame(jsonData, payload)
+			if err != nil {
+				c.warnings.Warn("Failed to parse text frame", func(e *zerolog.Event) { e.Err(err) })
+				continue
+			}
+			frame = c.timeline.Text(frame)
+
+			select {
+			case c.textFrames <- frame:
 			default:
-				c.logger.Warn().Msg("Audio frame channel full, dropping frame")
+				c.warnings.Warn("Text frame channel full, dropping frame", nil)
 			}
 
+		case MessageTypeGameInfo:
+			info, err := c.parseGameInfo(jsonData)
+			if err != nil {
+				c.warnings.Warn("Failed to parse game info", func(e *zerolog.Event) { e.Err(err) })
+				continue
+			}
+
+			select {
+			case c.gameInfo <- info:
+			default:
+				c.warnings.Warn("Game info channel full, dropping update", nil)
+			}
+
+		case MessageTypeControlReply:
+			c.handleControlReply(jsonData)
+
+		case MessageTypeHello:
+			if err := c.handleHello(conn, jsonData); err != nil {
+				return err
+			}
+
+		case MessageTypePing:
+			c.handlePing(conn, jsonData)
+
+		case MessageTypePong:
+			c.handlePong(jsonData)
+
 		case MessageTypeMetadata:
 			meta, err := c.parseStreamMetadata(jsonData)
 			if err != nil {
-				c.logger.Warn().Err(err).Msg("Failed to parse stream metadata")
+				c.warnings.Warn("Failed to parse stream metadata", func(e *zerolog.Event) { e.Err(err) })
 				continue
 			}
 
@@ -428,24 +968,122 @@ func (c *IPCConsumer) readLoop() error {
 				Int("video_fps", meta.VideoFPS).
 				Int("audio_rate", meta.AudioRate).
 				Int("audio_channels", meta.AudioChannels).
+				Str("video_format", meta.VideoFormat).
+				Interface("color", meta.Color).
+				Interface("hdr", meta.HDR).
+				Int("rotation", meta.Rotation).
 				Msg("Received stream metadata")
 
+			// Rebuild the normalizer with the new framing on the next frame
+			c.streamMeta = meta
+			c.normalizer = nil
+			c.declaredFPS.Store(int32(meta.VideoFPS))
+
 			select {
 			case c.metadata <- meta:
 			default:
-				c.logger.Warn().Msg("Metadata channel full, dropping metadata")
+				c.warnings.Warn("Metadata channel full, dropping metadata", nil)
 			}
 
 		default:
-			c.logger.Warn().
-				Stringer("type", msgType).
-				Msg("Unknown message type")
+			c.warnings.Warn("Unknown message type", func(e *zerolog.Event) { e.Stringer("type", msgType) })
 		}
 
 		c.logStats()
 	}
 }
 
+// detectTS waits for the first byte of a connection and reports whether it
+// is an MPEG-TS sync byte; IPC message types never collide with it
+func (c *IPCConsumer) detectTS(conn net.Conn, r *bufio.Reader) (bool, error) {
+	for {
+		if err := c.ctx.Err(); err != nil {
+			return false, err
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return false, err
+		}
+		b, err := r.Peek(1)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return false, err
+		}
+		return b[0] == 0x47, nil
+	}
+}
+
+// readTSLoop demultiplexes video from an MPEG-TS stream until it ends. Audio
+// in the stream is ignored; the gateway's audio path takes PCM.
+func (c *IPCConsumer) readTSLoop(conn net.Conn, r io.Reader) error {
+	// Stop closes the connection, so reads can block without a deadline
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	c.logger.Info().Msg("Receiving MPEG-TS stream")
+	demuxer := mpegts.NewDemuxer(&countingReader{r: r, n: &c.bytesReceived})
+	defer func() {
+		st := demuxer.Stats()
+		c.logger.Info().
+			Uint64("packets", st.Packets).
+			Uint64("frames", st.Frames).
+			Uint64("resyncs", st.Resyncs).
+			Uint64("cc_errors", st.CCErrors).
+			Uint64("discarded", st.Discarded).
+			Msg("MPEG-TS stream ended")
+	}()
+
+	for {
+		tsFrame, err := demuxer.ReadFrame()
+		if err != nil {
+			return err
+		}
+
+		_, span := ipcTracer.Start(c.ctx, "ipc.receive_video")
+		frame := VideoFrame{
+			PTS:        tsFrame.PTS,
+			DTS:        tsFrame.DTS,
+			IsKeyframe: tsFrame.Keyframe,
+			Codec:      tsFrame.Codec,
+			Data:       tsFrame.Data,
+			ReceivedAt: time.Now(),
+		}
+		span.SetAttributes(
+			attribute.Int("frame.size", len(frame.Data)),
+			attribute.Bool("frame.keyframe", frame.IsKeyframe),
+			attribute.Int64("frame.pts", frame.PTS),
+		)
+		frame.Trace = span.SpanContext()
+		frame = c.timeline.Video(frame)
+		c.videoTiming.add(frame)
+		c.hb.heard(frame.ReceivedAt, true)
+
+		if c.videoQueue.push(frame) {
+			c.videoFrameCount.Add(1)
+			c.videoMeter.add(time.Now(), len(frame.Data))
+		} else {
+			span.AddEvent("dropped: queue full")
+		}
+		span.End()
+
+		c.logStats()
+	}
+}
+
+// countingReader adds the bytes read to a counter
+type countingReader struct {
+	r io.Reader
+	n *atomic.Uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n.Add(uint64(n))
+	return n, err
+}
+
 // parseMessage parses a single message from the stream
 // Protocol: [1 byte: type] [4 bytes: length (big-endian)] [JSON metadata] [binary payload]
 func (c *IPCConsumer) parseMessage(r io.Reader) (MessageType, []byte, []byte, error) {
@@ -464,8 +1102,8 @@ func (c *IPCConsumer) parseMessage(r io.Reader) (MessageType, []byte, []byte, er
 	totalLen := binary.BigEndian.Uint32(lenBuf)
 
 	// Sanity check length (max 100MB)
-	if totalLen > 100*1024*1024 {
-		return 0, nil, nil, fmt.Errorf("message too large: %d bytes", totalLen)
+	if totalLen > maxMessageSize {
+		return 0, nil, nil, fmt.Errorf("%w: message too large: %d bytes", errCorruptMessage, totalLen)
 	}
 
 	// Read the combined JSON + payload data
@@ -478,7 +1116,7 @@ func (c *IPCConsumer) parseMessage(r io.Reader) (MessageType, []byte, []byte, er
 	// JSON is null-terminated or we find the closing brace
 	jsonEnd := c.findJSONEnd(data)
 	if jsonEnd < 0 {
-		return 0, nil, nil, errors.New("could not find JSON boundary in message")
+		return 0, nil, nil, fmt.Errorf("%w: could not find JSON boundary in message", errCorruptMessage)
 	}
 
 	jsonData := data[:jsonEnd]
@@ -550,6 +1188,25 @@ func (c *IPCConsumer) parseVideoFrame(jsonData, payload []byte) (VideoFrame, err
 	if err := json.Unmarshal(jsonData, &meta); err != nil {
 		return VideoFrame{}, fmt.Errorf("failed to parse video metadata: %w", err)
 	}
+	if err := c.checkFrame(&c.videoSeq, "video", meta.Seq, meta.CRC32, payload); err != nil {
+		return VideoFrame{}, err
+	}
+
+	// Frames may leave the codec to the stream metadata
+	if meta.Codec == "" {
+		meta.Codec = c.streamMeta.VideoCodec
+	}
+	if meta.Codec == CodecHEVCAlpha {
+		return VideoFrame{}, errHEVCAlpha
+	}
+
+	data, err := c.normalizeVideo(meta.Codec, payload, meta.Keyframe)
+	if err != nil {
+		return VideoFrame{}, err
+	}
+	if meta.Codec == "hevc" && hasHEVCLayers(data) {
+		return VideoFrame{}, errHEVCAlpha
+	}
 
 	return VideoFrame{
 		PTS:        meta.PTS,
@@ -558,17 +1215,68 @@ func (c *IPCConsumer) parseVideoFrame(jsonData, payload []byte) (VideoFrame, err
 		Width:      meta.Width,
 		Height:     meta.Height,
 		Codec:      meta.Codec,
-		Data:       payload,
+		Data:       data,
 		ReceivedAt: time.Now(),
+		Color:      c.streamMeta.Color,
+		HDR:        c.streamMeta.HDR,
+		Rotation:   c.streamMeta.Rotation,
 	}, nil
 }
 
+// normalizeVideo converts H.264/H.265 frames to Annex-B; other codecs are
+// returned unchanged
+func (c *IPCConsumer) normalizeVideo(codec string, payload []byte, keyframe bool) ([]byte, error) {
+	if codec != "h264" && codec != "hevc" {
+		return payload, nil
+	}
+
+	if c.normalizer == nil || c.normCodec != codec {
+		format := c.videoFormat
+		if format == bitstream.FormatUnknown {
+			f, err := bitstream.ParseFormat(c.streamMeta.VideoFormat)
+			if err != nil {
+				c.logger.Warn().Err(err).Msg("Ignoring declared video format")
+			}
+			format = f
+		}
+
+		// The codec config only applies to the codec the metadata declared
+		var record []byte
+		if c.streamMeta.VideoCodec == codec {
+			record = c.streamMeta.VideoCodecConfig
+		}
+
+		n, err := bitstream.NewNormalizer(codec, format, record)
+		if err != nil {
+			c.logger.Warn().Err(err).Msg("Invalid video codec config, ignoring")
+			n, _ = bitstream.NewNormalizer(codec, format, nil)
+		}
+		c.normalizer = n
+		c.normCodec = codec
+	}
+
+	data, _, err := c.normalizer.Normalize(payload, keyframe)
+	if err != nil {
+		return nil, fmt.Errorf("failed to normalize video frame: %w", err)
+	}
+	return data, nil
+}
+
 // parseAudioFrame parses JSON metadata for audio frame
 func (c *IPCConsumer) parseAudioFrame(jsonData, payload []byte) (AudioFrame, error) {
 	var meta audioFrameMetadata
 	if err := json.Unmarshal(jsonData, &meta); err != nil {
 		return AudioFrame{}, fmt.Errorf("failed to parse audio metadata: %w", err)
 	}
+	if err := c.checkFrame(&c.audioSeq, "audio", meta.Seq, meta.CRC32, payload); err != nil {
+		return AudioFrame{}, err
+	}
+	if meta.Channels < 1 || meta.Channels > 8 {
+		return AudioFrame{}, fmt.Errorf("unsupported audio channel count %d", meta.Channels)
+	}
+	if meta.SampleCount > 0 && len(payload) != meta.SampleCount*meta.Channels*2 {
+		return AudioFrame{}, fmt.Errorf("audio payload is %d bytes, want %d samples of %d channels", len(payload), meta.SampleCount, meta.Channels)
+	}
 
 	return AudioFrame{
 		PTS:         meta.PTS,
@@ -576,16 +1284,61 @@ func (c *IPCConsumer) parseAudioFrame(jsonData, payload []byte) (AudioFrame, err
 		Channels:    meta.Channels,
 		SampleCount: meta.SampleCount,
 		Data:        payload,
+		Source:      meta.Source,
 		ReceivedAt:  time.Now(),
 	}, nil
 }
 
+// parseTextFrame parses a text message
+func (c *IPCConsumer) parseTextFrame(jsonData, payload []byte) (TextFrame, error) {
+	var meta textFrameMetadata
+	if err := json.Unmarshal(jsonData, &meta); err != nil {
+		return TextFrame{}, fmt.Errorf("failed to parse text metadata: %w", err)
+	}
+	if meta.Text == "" {
+		meta.Text = string(payload)
+	}
+	if !utf8.ValidString(meta.Text) {
+		return TextFrame{}, errors.New("text is not valid UTF-8")
+	}
+	if meta.DurationMs < 0 {
+		return TextFrame{}, fmt.Errorf("negative text duration %dms", meta.DurationMs)
+	}
+
+	return TextFrame{
+		PTS:        meta.PTS,
+		Duration:   time.Duration(meta.DurationMs) * time.Millisecond,
+		Text:       meta.Text,
+		Speaker:    meta.Speaker,
+		Language:   meta.Language,
+		ReceivedAt: time.Now(),
+	}, nil
+}
+
+// parseGameInfo parses a game info message
+func (c *IPCConsumer) parseGameInfo(jsonData []byte) (GameInfo, error) {
+	var info GameInfo
+	if err := json.Unmarshal(jsonData, &info); err != nil {
+		return GameInfo{}, fmt.Errorf("failed to parse game info: %w", err)
+	}
+	if info.FPS < 0 || info.FrameTimeMs < 0 || info.CPUPercent < 0 || info.GPUPercent < 0 {
+		return GameInfo{}, errors.New("negative game info counter")
+	}
+	info.ReceivedAt = time.Now()
+	return info, nil
+}
+
 // parseStreamMetadata parses stream configuration metadata
 func (c *IPCConsumer) parseStreamMetadata(jsonData []byte) (StreamMetadata, error) {
 	var meta StreamMetadata
 	if err := json.Unmarshal(jsonData, &meta); err != nil {
 		return StreamMetadata{}, fmt.Errorf("failed to parse stream metadata: %w", err)
 	}
+	rotation, err := normalizeRotation(meta.Rotation)
+	if err != nil {
+		return StreamMetadata{}, fmt.Errorf("invalid stream metadata: %w", err)
+	}
+	meta.Rotation = rotation
 	return meta, nil
 }
 
@@ -612,6 +1365,11 @@ func (c *IPCConsumer) logStats() {
 		Float64("bytes_per_sec", float64(bytesDelta)/elapsed).
 		Uint64("total_video_frames", videoFrames).
 		Uint64("total_audio_frames", audioFrames).
+		Uint64("dropped_video_frames", c.videoQueue.dropped.Load()).
+		Uint64("dropped_audio_frames", c.audioQueue.dropped.Load()).
+		Uint64("producer_dropped_video_frames", c.videoSeq.lost.Load()).
+		Uint64("producer_dropped_audio_frames", c.audioSeq.lost.Load()).
+		Uint64("corrupted_frames", c.videoSeq.corrupted.Load()+c.audioSeq.corrupted.Load()).
 		Uint64("total_bytes", bytes).
 		Msg("IPC consumer statistics")
 
@@ -636,7 +1394,7 @@ type Frame struct {
 	// IsKeyframe indicates if this is an I-frame
 	IsKeyframe bool
 
-	// Codec indicates the video codec ("h264" or "hevc")
+	// Codec indicates the video codec ("h264", "hevc" or "vp9")
 	Codec string
 }
 
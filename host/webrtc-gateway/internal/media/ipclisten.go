@@ -0,0 +1,48 @@
+package media
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// pipePrefix starts the path of a local Windows named pipe
+const pipePrefix = `\\.\pipe\`
+
+// IsPipePath reports whether path names a Windows named pipe rather than a
+// Unix socket
+func IsPipePath(path string) bool {
+	return len(path) > len(pipePrefix) && strings.EqualFold(path[:len(pipePrefix)], pipePrefix)
+}
+
+// listenIPC listens for producers on path: a named pipe for \\.\pipe\
+// paths, which only Windows has, or else a Unix socket, replacing a stale
+// socket file
+func listenIPC(path string) (net.Listener, error) {
+	if IsPipePath(path) {
+		listener, err := listenPipe(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on pipe: %w", err)
+		}
+		return listener, nil
+	}
+
+	// Remove stale socket file if it exists
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on socket: %w", err)
+	}
+	return listener, nil
+}
+
+// removeIPC removes the socket file at path; pipes vanish with their
+// listener
+func removeIPC(path string) {
+	if !IsPipePath(path) {
+		os.Remove(path)
+	}
+}
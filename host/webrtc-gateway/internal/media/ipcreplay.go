@@ -0,0 +1,209 @@
+package media
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// replayMaxIdle caps the wait between recorded connections, so a tap
+// spanning a long producer outage replays without the dead time
+const replayMaxIdle = 2 * time.Second
+
+// ReplayListener replays an IPC tap file as producer connections. Set as
+// IPCConsumerConfig.Listener, it hands the consumer one in-memory
+// connection per recorded connection, carrying the recorded bytes at the
+// pace they arrived, so a captured session can be fed back through the
+// gateway.
+type ReplayListener struct {
+	path   string
+	loop   bool
+	logger zerolog.Logger
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewReplayListener opens a tap file for replay. With loop set the
+// recording starts over when it ends; otherwise Accept blocks after the
+// last connection until Close.
+func NewReplayListener(path string, loop bool, logger zerolog.Logger) (*ReplayListener, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = newTapFileReader(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &ReplayListener{
+		path:   path,
+		loop:   loop,
+		logger: logger.With().Str("component", "ipc_replay").Str("path", path).Logger(),
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+// Accept returns the next recorded connection
+func (l *ReplayListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the replay
+func (l *ReplayListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns the tap file as the listener's address
+func (l *ReplayListener) Addr() net.Addr {
+	return replayAddr(l.path)
+}
+
+type replayAddr string
+
+func (a replayAddr) Network() string { return "replay" }
+func (a replayAddr) String() string  { return string(a) }
+
+// run replays the file, once or in a loop, until closed
+func (l *ReplayListener) run() {
+	for pass := 1; ; pass++ {
+		err := l.replay()
+		if l.closed() {
+			return
+		}
+		if err != nil {
+			l.logger.Error().Err(err).Msg("IPC replay failed")
+			return
+		}
+		if !l.loop {
+			l.logger.Info().Msg("IPC replay finished")
+			return
+		}
+		l.logger.Info().Int("pass", pass).Msg("IPC replay finished, starting over")
+		if !l.sleep(replayMaxIdle) {
+			return
+		}
+	}
+}
+
+// replay plays the file through once
+func (l *ReplayListener) replay() error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tap, err := newTapFileReader(f)
+	if err != nil {
+		return err
+	}
+
+	var (
+		conn     net.Conn  // Our end of the current connection
+		broken   bool      // The consumer closed conn; skip to the next one
+		start    time.Time // When the current connection began
+		recStart int64     // Its recorded start
+		lastAt   int64     // Recorded time of the last record
+	)
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		rec, err := tap.next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Data ahead of any connection record starts one
+		if rec.kind == tapRecordConnect || conn == nil {
+			if conn != nil {
+				conn.Close()
+				idle := time.Duration(rec.at - lastAt)
+				if !l.sleep(min(max(idle, 0), replayMaxIdle)) {
+					return nil
+				}
+			}
+			if conn, err = l.connect(); err != nil {
+				return nil // Closed
+			}
+			broken = false
+			start, recStart = time.Now(), rec.at
+		}
+		lastAt = rec.at
+		if rec.kind != tapRecordData || broken {
+			continue
+		}
+
+		if !l.sleep(time.Until(start.Add(time.Duration(rec.at - recStart)))) {
+			return nil
+		}
+		if _, err := conn.Write(rec.data); err != nil {
+			l.logger.Debug().Err(err).Msg("Consumer closed replayed connection")
+			broken = true
+		}
+	}
+}
+
+// connect hands the consumer a new connection and returns our end of it
+func (l *ReplayListener) connect() (net.Conn, error) {
+	ours, theirs := net.Pipe()
+	select {
+	case l.conns <- theirs:
+	case <-l.done:
+		ours.Close()
+		theirs.Close()
+		return nil, net.ErrClosed
+	}
+
+	// Pipes are synchronous: discard the consumer's control commands so its
+	// writes do not block
+	go io.Copy(io.Discard, ours)
+	return ours, nil
+}
+
+// sleep waits for d, returning false if the listener closed meanwhile
+func (l *ReplayListener) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return !l.closed()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+func (l *ReplayListener) closed() bool {
+	select {
+	case <-l.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,210 @@
+package media
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// An IPC tap file records the byte stream producers send, so a session can
+// be replayed into a gateway later. It starts with tapMagic and holds
+// records of
+//
+//	[1 byte kind] [8 bytes time, Unix nanoseconds, big-endian]
+//
+// followed, for tapRecordData, by [4 bytes length, big-endian] [bytes].
+// tapRecordConnect marks a producer connecting; the data records after it
+// are what was read from that connection, as it arrived. Taps append, so a
+// file can span several gateway runs.
+const tapMagic = "GCIPCTAP"
+
+// Tap record kinds
+const (
+	tapRecordConnect byte = 'C'
+	tapRecordData    byte = 'D'
+)
+
+// tapFlushInterval bounds how much of the recording a crash may lose
+const tapFlushInterval = time.Second
+
+// ipcTap records producer connections to a tap file
+type ipcTap struct {
+	logger zerolog.Logger
+
+	mu        sync.Mutex
+	file      *os.File
+	w         *bufio.Writer
+	written   int64
+	maxBytes  int64 // 0 is unlimited
+	full      bool
+	closed    bool
+	lastFlush time.Time
+}
+
+// openIPCTap opens path for appending, writing the header to a new file
+func openIPCTap(path string, maxBytes int64, logger zerolog.Logger) (*ipcTap, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	t := &ipcTap{
+		logger:    logger,
+		file:      file,
+		w:         bufio.NewWriterSize(file, 1<<20),
+		written:   info.Size(),
+		maxBytes:  maxBytes,
+		lastFlush: time.Now(),
+	}
+	if info.Size() == 0 {
+		t.w.WriteString(tapMagic)
+	}
+	return t, nil
+}
+
+// connected records a producer connecting
+func (t *ipcTap) connected() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writeHeader(tapRecordConnect, time.Now())
+}
+
+// record records bytes read from the producer
+func (t *ipcTap) record(p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if !t.writeHeader(tapRecordData, now) {
+		return
+	}
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(p)))
+	t.w.Write(n[:])
+	t.w.Write(p)
+	t.written += int64(len(p)) + 4
+
+	if now.Sub(t.lastFlush) >= tapFlushInterval {
+		t.flushLocked()
+	}
+}
+
+// writeHeader starts a record, or returns false once the size limit is
+// reached. Caller holds mu.
+func (t *ipcTap) writeHeader(kind byte, at time.Time) bool {
+	if t.full || t.closed {
+		return false
+	}
+	if t.maxBytes > 0 && t.written >= t.maxBytes {
+		t.full = true
+		t.flushLocked()
+		t.logger.Warn().Int64("max_bytes", t.maxBytes).Msg("IPC tap reached its size limit; recording stopped")
+		return false
+	}
+	var h [9]byte
+	h[0] = kind
+	binary.BigEndian.PutUint64(h[1:], uint64(at.UnixNano()))
+	t.w.Write(h[:])
+	t.written += int64(len(h))
+	return true
+}
+
+// flush writes buffered records to the file
+func (t *ipcTap) flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.flushLocked()
+}
+
+func (t *ipcTap) flushLocked() {
+	if t.closed {
+		return
+	}
+	if err := t.w.Flush(); err != nil {
+		t.logger.Warn().Err(err).Msg("Failed to write IPC tap")
+	}
+	t.lastFlush = time.Now()
+}
+
+// Close flushes and closes the tap file
+func (t *ipcTap) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	return errors.Join(t.w.Flush(), t.file.Close())
+}
+
+// tapReader records everything read through it
+type tapReader struct {
+	r   io.Reader
+	tap *ipcTap
+}
+
+func (r *tapReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.tap.record(p[:n])
+	}
+	return n, err
+}
+
+// tapRecord is one record read back from a tap file
+type tapRecord struct {
+	kind byte
+	at   int64 // Unix nanoseconds
+	data []byte
+}
+
+// tapFileReader reads a tap file's records
+type tapFileReader struct {
+	r *bufio.Reader
+}
+
+// newTapFileReader checks the header of a tap file
+func newTapFileReader(r io.Reader) (*tapFileReader, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	magic := make([]byte, len(tapMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != tapMagic {
+		return nil, errors.New("not an IPC tap file")
+	}
+	return &tapFileReader{r: br}, nil
+}
+
+// next returns the next record, or io.EOF at the end of the file. A
+// record cut short, as by a crash while recording, also ends the file.
+func (f *tapFileReader) next() (tapRecord, error) {
+	var h [9]byte
+	if _, err := io.ReadFull(f.r, h[:]); err != nil {
+		return tapRecord{}, io.EOF
+	}
+	rec := tapRecord{kind: h[0], at: int64(binary.BigEndian.Uint64(h[1:]))}
+	switch rec.kind {
+	case tapRecordConnect:
+		return rec, nil
+	case tapRecordData:
+		var n [4]byte
+		if _, err := io.ReadFull(f.r, n[:]); err != nil {
+			return tapRecord{}, io.EOF
+		}
+		rec.data = make([]byte, binary.BigEndian.Uint32(n[:]))
+		if _, err := io.ReadFull(f.r, rec.data); err != nil {
+			return tapRecord{}, io.EOF
+		}
+		return rec, nil
+	default:
+		return tapRecord{}, fmt.Errorf("corrupt IPC tap: unknown record kind 0x%02x", rec.kind)
+	}
+}
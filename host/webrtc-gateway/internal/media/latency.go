@@ -0,0 +1,241 @@
+package media
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// LatencyTracker correlates each frame's timestamps across the pipeline:
+// capture (PTS), receipt from the source, sample write to peers, and render
+// on the client as reported over the data channel. It keeps a sliding window
+// of each interval and reports percentiles.
+//
+// Capture PTS is on the producer's clock, not the gateway's. The tracker maps
+// it onto wall-clock time using the smallest receive-minus-PTS offset seen, so
+// capture-relative figures measure latency above the fastest observed frame
+// and slightly under-report the true value.
+type LatencyTracker struct {
+	mu sync.Mutex
+
+	// frames maps recent PTS values to their gateway timestamps so render
+	// reports can be matched; pending holds the PTS order for eviction
+	frames  map[int64]frameTimes
+	pending []int64
+	maxKeep int
+
+	// captureOffset converts PTS to Unix nanoseconds; valid once anchored
+	captureOffset int64
+	anchored      bool
+	lastPTS       int64
+
+	ingest   latencyWindow // Capture to receipt
+	queue    latencyWindow // Receipt to sample write
+	delivery latencyWindow // Sample write to client render
+	glass    latencyWindow // Capture to client render
+}
+
+// frameTimes are the gateway-side timestamps of one frame
+type frameTimes struct {
+	receivedAt time.Time
+	writtenAt  time.Time
+}
+
+// LatencyPercentiles summarises one interval, in milliseconds
+type LatencyPercentiles struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50_ms"`
+	P95     float64 `json:"p95_ms"`
+	P99     float64 `json:"p99_ms"`
+}
+
+// LatencyStats is a snapshot of all tracked intervals
+type LatencyStats struct {
+	Ingest       LatencyPercentiles `json:"ingest"`         // Capture to receipt
+	Queue        LatencyPercentiles `json:"queue"`          // Receipt to sample write
+	Delivery     LatencyPercentiles `json:"delivery"`       // Sample write to render
+	GlassToGlass LatencyPercentiles `json:"glass_to_glass"` // Capture to render
+}
+
+// NewLatencyTracker creates a tracker keeping the last window samples of each
+// interval (default 1024)
+func NewLatencyTracker(window int) *LatencyTracker {
+	// Apply defaults for zero values
+	if window <= 0 {
+		window = 1024
+	}
+
+	return &LatencyTracker{
+		frames:   make(map[int64]frameTimes),
+		maxKeep:  600, // ~10s at 60fps; older render reports are ignored
+		ingest:   newLatencyWindow(window),
+		queue:    newLatencyWindow(window),
+		delivery: newLatencyWindow(window),
+		glass:    newLatencyWindow(window),
+	}
+}
+
+// Discontinuity re-anchors capture time after the producer's timeline was
+// spliced, since offsets seen before the splice no longer apply
+func (t *LatencyTracker) Discontinuity() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.anchored = false
+}
+
+// ObserveWrite records a frame written to peers. pts is in nanoseconds on the
+// producer's clock.
+func (t *LatencyTracker) ObserveWrite(pts int64, receivedAt, writtenAt time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !receivedAt.IsZero() {
+		// A PTS jump backwards means the producer restarted its clock
+		if t.anchored && pts < t.lastPTS {
+			t.anchored = false
+		}
+		t.lastPTS = pts
+
+		offset := receivedAt.UnixNano() - pts
+		if !t.anchored || offset < t.captureOffset {
+			t.captureOffset = offset
+			t.anchored = true
+		}
+		t.ingest.add(time.Duration(offset - t.captureOffset))
+		t.queue.add(writtenAt.Sub(receivedAt))
+	}
+
+	if _, ok := t.frames[pts]; !ok {
+		t.pending = append(t.pending, pts)
+	}
+	t.frames[pts] = frameTimes{receivedAt: receivedAt, writtenAt: writtenAt}
+	for len(t.pending) > t.maxKeep {
+		delete(t.frames, t.pending[0])
+		t.pending = t.pending[1:]
+	}
+}
+
+// ObserveRender records a client render report. renderedAt must already be
+// on the gateway's clock. Reports for unknown frames are ignored.
+func (t *LatencyTracker) ObserveRender(pts int64, renderedAt time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ft, ok := t.frames[pts]
+	if !ok {
+		return
+	}
+
+	t.delivery.add(renderedAt.Sub(ft.writtenAt))
+	if t.anchored && !ft.receivedAt.IsZero() {
+		captured := time.Unix(0, pts+t.captureOffset)
+		t.glass.add(renderedAt.Sub(captured))
+	}
+}
+
+// Stats returns percentiles over the current windows
+func (t *LatencyTracker) Stats() LatencyStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return LatencyStats{
+		Ingest:       t.ingest.percentiles(),
+		Queue:        t.queue.percentiles(),
+		Delivery:     t.delivery.percentiles(),
+		GlassToGlass: t.glass.percentiles(),
+	}
+}
+
+// Latency data channel messages. The client first synchronises clocks with
+// "clock_sync" (NTP-style: the gateway echoes the client time with its own),
+// then sends "render" reports with the rendered frame's PTS and the render
+// time converted to the gateway's clock using the measured offset.
+const (
+	latencyMessageClockSync = "clock_sync"
+	latencyMessageRender    = "render"
+)
+
+// latencyMessage is a latency data channel message
+type latencyMessage struct {
+	Type string `json:"type"`
+
+	// clock_sync
+	ClientTimeMs  float64 `json:"client_time_ms,omitempty"`
+	GatewayTimeMs float64 `json:"gateway_time_ms,omitempty"`
+
+	// render
+	PTS          int64   `json:"pts,omitempty"`            // Frame PTS in nanoseconds, as signalled to the client
+	RenderedAtMs float64 `json:"rendered_at_ms,omitempty"` // Unix milliseconds, gateway clock
+}
+
+// HandleMessage processes a latency data channel message and returns the
+// reply to send back, if any
+func (t *LatencyTracker) HandleMessage(data []byte) ([]byte, error) {
+	var msg latencyMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("invalid latency message: %w", err)
+	}
+
+	switch msg.Type {
+	case latencyMessageClockSync:
+		reply := latencyMessage{
+			Type:          latencyMessageClockSync,
+			ClientTimeMs:  msg.ClientTimeMs,
+			GatewayTimeMs: float64(time.Now().UnixNano()) / 1e6,
+		}
+		return json.Marshal(reply)
+	case latencyMessageRender:
+		if msg.RenderedAtMs <= 0 {
+			return nil, errors.New("render report missing rendered_at_ms")
+		}
+		t.ObserveRender(msg.PTS, time.Unix(0, int64(msg.RenderedAtMs*1e6)))
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown latency message type %q", msg.Type)
+	}
+}
+
+// latencyWindow is a ring buffer of recent durations
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyWindow(size int) latencyWindow {
+	return latencyWindow{samples: make([]time.Duration, size)}
+}
+
+// add records a sample; negative values from clock error are clamped to zero
+func (w *latencyWindow) add(d time.Duration) {
+	w.samples[w.next] = max(d, 0)
+	w.next++
+	if w.next == len(w.samples) {
+		w.next = 0
+		w.full = true
+	}
+}
+
+// percentiles returns nearest-rank percentiles over the window
+func (w *latencyWindow) percentiles() LatencyPercentiles {
+	n := w.next
+	if w.full {
+		n = len(w.samples)
+	}
+	if n == 0 {
+		return LatencyPercentiles{}
+	}
+
+	sorted := slices.Clone(w.samples[:n])
+	slices.Sort(sorted)
+
+	at := func(p float64) float64 {
+		i := min(max(int(math.Ceil(p*float64(n)))-1, 0), n-1)
+		return float64(sorted[i]) / float64(time.Millisecond)
+	}
+	return LatencyPercentiles{Samples: n, P50: at(0.50), P95: at(0.95), P99: at(0.99)}
+}
@@ -0,0 +1,123 @@
+package media
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/svc"
+)
+
+// PeerSampleWriter is implemented by writers that can address peers
+// individually. The distributor uses it to send each peer its own selection
+// of layers from scalable video.
+type PeerSampleWriter interface {
+	PeerIDs() []string
+	WritePeerVideoSample(peerID string, sample media.Sample) error
+}
+
+// LayerLimitFunc returns the layers a peer should receive
+type LayerLimitFunc func(peerID string) svc.Limits
+
+// layeredPeer is one peer's layer selection state, owned by the distribution
+// goroutine
+type layeredPeer struct {
+	sel svc.Selector
+
+	// RTP timestamps advance by each sample's duration, so a sample must
+	// cover the frames skipped after it. That is not known when it is sent;
+	// the previous gap is used as the estimate and any accumulated error is
+	// corrected in the next sample.
+	elapsed   time.Duration // Frame time since the peer's first sample
+	stamped   time.Duration // Sum of durations written
+	sinceSent time.Duration // Frame time since the last sample written
+	lastGap   time.Duration // Gap between the last two samples written
+}
+
+// advance accounts for one frame interval
+func (p *layeredPeer) advance(frame time.Duration) {
+	if p.lastGap > 0 {
+		p.elapsed += frame
+		p.sinceSent += frame
+	}
+}
+
+// duration returns the duration for a sample being written now
+func (p *layeredPeer) duration(frame time.Duration) time.Duration {
+	if p.lastGap == 0 {
+		p.lastGap = frame
+	} else {
+		p.lastGap = p.sinceSent
+	}
+	p.sinceSent = 0
+
+	// elapsed-stamped is how far this sample's timestamp is behind
+	d := max(p.lastGap+p.elapsed-p.stamped, frame/2)
+	p.stamped += d
+	return d
+}
+
+// layered reports whether frame should be layer-filtered per peer
+func (d *Distributor) layered(frame VideoFrame) bool {
+	return d.cfg.LayerLimits != nil && d.fanout != nil && svc.Layered(frame.Codec, frame.SVC)
+}
+
+// writeLayered queues for each peer the layers its limits allow; interval is
+// the frame's duration
+func (d *Distributor) writeLayered(frame VideoFrame, interval time.Duration) error {
+	if d.layers == nil {
+		d.layers = make(map[string]*layeredPeer)
+	}
+
+	peers := d.videoPeers()
+	d.fanout.sync(peers)
+	seen := make(map[string]bool, len(peers))
+	needKeyframe := false
+	var errs []error
+
+	for _, id := range peers {
+		seen[id] = true
+		p, ok := d.layers[id]
+		if !ok {
+			p = &layeredPeer{}
+			d.layers[id] = p
+		}
+		p.advance(interval)
+
+		data, wantKeyframe, err := p.sel.Select(svc.Frame{
+			Codec:      frame.Codec,
+			Data:       frame.Data,
+			IsKeyframe: frame.IsKeyframe,
+			Info:       frame.SVC,
+			PTS:        frame.PTS,
+		}, d.cfg.LayerLimits(id))
+		needKeyframe = needKeyframe || wantKeyframe
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if data == nil {
+			continue
+		}
+
+		sample := media.Sample{Data: data, Duration: p.duration(interval)}
+		d.fanout.send(id, sample, frame.IsKeyframe)
+	}
+
+	for id := range d.layers {
+		if !seen[id] {
+			delete(d.layers, id)
+		}
+	}
+
+	if needKeyframe {
+		d.requestKeyframe()
+	}
+
+	err := errors.Join(errs...)
+	if err != nil {
+		d.logger.Debug().Err(err).Msg("Error selecting video layers")
+	}
+	return err
+}
@@ -0,0 +1,138 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"time"
+)
+
+// Chapter is a named point of the file. Chapters are written as a Nero
+// chpl box, which ffmpeg, mpv and VLC list for navigation.
+type Chapter struct {
+	Start time.Duration // From the first sample's presentation time
+	Title string
+}
+
+// maxChapters is what the chpl box's 8-bit count holds
+const maxChapters = 255
+
+// chpl builds a Nero chapter list. Chapters are sorted, and one is added at
+// the start when the first begins later, so players can jump back to it.
+func chpl(chapters []Chapter) []byte {
+	chapters = append([]Chapter(nil), chapters...)
+	sort.SliceStable(chapters, func(i, j int) bool { return chapters[i].Start < chapters[j].Start })
+	if chapters[0].Start > 0 {
+		chapters = append([]Chapter{{Title: "Start"}}, chapters...)
+	}
+	chapters = chapters[:min(len(chapters), maxChapters)]
+
+	payload := append(u32(0), byte(len(chapters)))
+	for _, c := range chapters {
+		title := c.Title
+		if len(title) > 255 {
+			title = title[:255]
+		}
+		payload = binary.BigEndian.AppendUint64(payload, uint64(max(c.Start, 0)/100)) // 100 ns units
+		payload = append(payload, byte(len(title)))
+		payload = append(payload, title...)
+	}
+	return fullBox("chpl", 1, 0, payload)
+}
+
+// maxMoovSize bounds the movie box ReadChapters reads into memory
+const maxMoovSize = 64 << 20
+
+// ReadChapters reads the chapters of an MP4 file written by Write. Only the
+// boxes up to the movie box are read, which Write puts first.
+func ReadChapters(r io.Reader) ([]Chapter, error) {
+	for {
+		typ, payload, err := readBox(r, maxMoovSize)
+		if err != nil {
+			return nil, err
+		}
+		if typ != "moov" {
+			continue
+		}
+		udta, ok := child(payload, "udta")
+		if !ok {
+			return nil, nil
+		}
+		list, ok := child(udta, "chpl")
+		if !ok {
+			return nil, nil
+		}
+		return parseChpl(list)
+	}
+}
+
+// readBox reads the next top-level box, skipping the payload of any but
+// the movie box
+func readBox(r io.Reader, limit int64) (string, []byte, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", nil, errors.New("mp4: no movie box")
+		}
+		return "", nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[:4]))
+	typ := string(header[4:])
+	headerSize := int64(8)
+	if size == 1 {
+		var large [8]byte
+		if _, err := io.ReadFull(r, large[:]); err != nil {
+			return "", nil, err
+		}
+		size, headerSize = int64(binary.BigEndian.Uint64(large[:])), 16
+	}
+	if size < headerSize {
+		return "", nil, errors.New("mp4: invalid box size")
+	}
+	if typ != "moov" {
+		_, err := io.CopyN(io.Discard, r, size-headerSize)
+		return typ, nil, err
+	}
+	if size-headerSize > limit {
+		return "", nil, errors.New("mp4: movie box too large")
+	}
+	payload := make([]byte, size-headerSize)
+	_, err := io.ReadFull(r, payload)
+	return typ, payload, err
+}
+
+// child finds a box of type typ among the boxes in payload
+func child(payload []byte, typ string) ([]byte, bool) {
+	for len(payload) >= 8 {
+		size := int(binary.BigEndian.Uint32(payload))
+		if size < 8 || size > len(payload) {
+			return nil, false
+		}
+		if string(payload[4:8]) == typ {
+			return payload[8:size], true
+		}
+		payload = payload[size:]
+	}
+	return nil, false
+}
+
+// parseChpl reads a version 1 chpl payload, as chpl writes it
+func parseChpl(b []byte) ([]Chapter, error) {
+	if len(b) < 9 || b[0] != 1 {
+		return nil, errors.New("mp4: unsupported chapter list")
+	}
+	n := int(b[8])
+	b = b[9:]
+	chapters := make([]Chapter, 0, n)
+	for i := 0; i < n; i++ {
+		if len(b) < 9 || len(b) < 9+int(b[8]) {
+			return nil, errors.New("mp4: truncated chapter list")
+		}
+		start := time.Duration(binary.BigEndian.Uint64(b)) * 100
+		title := string(b[9 : 9+int(b[8])])
+		chapters = append(chapters, Chapter{Start: start, Title: title})
+		b = b[9+int(b[8]):]
+	}
+	return chapters, nil
+}
@@ -0,0 +1,420 @@
+// Package mp4 writes H.264 and HEVC video to progressive MP4 files. The
+// whole file is laid out in memory with the moov box first, so clips play
+// while downloading and need no seeking to write.
+package mp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+)
+
+// timescale is the media timescale, the usual 90 kHz of video
+const timescale = 90000
+
+// Sample is one Annex-B access unit
+type Sample struct {
+	PTS      int64 // Presentation timestamp in nanoseconds
+	DTS      int64 // Decode timestamp in nanoseconds; zero uses PTS
+	Keyframe bool
+	Data     []byte
+}
+
+// Track is a video track to write
+type Track struct {
+	Codec   string // "h264" or "hevc"
+	Samples []Sample
+
+	// Width and Height are read from the SPS when zero
+	Width  int
+	Height int
+
+	// Rotation is how far players turn the picture clockwise for display:
+	// 0, 90, 180 or 270 degrees. It is written as the track matrix.
+	Rotation int
+
+	// Color, Mastering and ContentLight are written as colr, mdcv and clli
+	// boxes when set, so players tone-map HDR instead of showing it
+	// washed out
+	Color        *Color
+	Mastering    *MasteringDisplay
+	ContentLight *ContentLight
+
+	// Chapters are written as a Nero chpl box in the movie's user data
+	Chapters []Chapter
+}
+
+// Color is an nclx color description in ISO/IEC 23091-2 code points
+type Color struct {
+	Primaries uint8
+	Transfer  uint8
+	Matrix    uint8
+	FullRange bool
+}
+
+// MasteringDisplay is SMPTE ST 2086 mastering display metadata in the
+// units of the mdcv box: chromaticities in 0.00002 steps and luminance in
+// 0.0001 cd/m²
+type MasteringDisplay struct {
+	Primaries    [3][2]uint16 // Green, blue, red, as in the HEVC SEI
+	WhitePoint   [2]uint16
+	MaxLuminance uint32
+	MinLuminance uint32
+}
+
+// ContentLight is CTA-861.3 content light level information in cd/m²
+type ContentLight struct {
+	MaxCLL  uint16
+	MaxFALL uint16
+}
+
+// Write writes t as an MP4 file. The first sample must be a keyframe
+// carrying parameter sets.
+func Write(w io.Writer, t Track) error {
+	if len(t.Samples) == 0 {
+		return errors.New("mp4: no samples")
+	}
+	if !t.Samples[0].Keyframe {
+		return errors.New("mp4: first sample is not a keyframe")
+	}
+
+	// Parameter sets move to the sample entry; later ones that differ stay
+	// in band so decoders still see the change
+	var paramSets [][]byte
+	for _, nal := range bitstream.SplitAnnexB(t.Samples[0].Data) {
+		if isParamSet(t.Codec, nal) {
+			paramSets = append(paramSets, nal)
+		}
+	}
+	record, err := bitstream.BuildDecoderConfig(t.Codec, paramSets)
+	if err != nil {
+		return fmt.Errorf("mp4: %w", err)
+	}
+	if t.Width == 0 || t.Height == 0 {
+		p, ok, err := bitstream.FindParams(t.Codec, t.Samples[0].Data)
+		if err != nil || !ok {
+			return errors.New("mp4: cannot read picture size from the SPS")
+		}
+		t.Width, t.Height = p.Width, p.Height
+	}
+
+	var mdat bytes.Buffer
+	sizes := make([]uint32, len(t.Samples))
+	for i, s := range t.Samples {
+		var nals [][]byte
+		for _, nal := range bitstream.SplitAnnexB(s.Data) {
+			if isAUD(t.Codec, nal) || (isParamSet(t.Codec, nal) && contains(paramSets, nal)) {
+				continue
+			}
+			nals = append(nals, nal)
+		}
+		avcc, err := bitstream.JoinAVCC(nals, 4)
+		if err != nil {
+			return fmt.Errorf("mp4: %w", err)
+		}
+		sizes[i] = uint32(len(avcc))
+		mdat.Write(avcc)
+	}
+
+	tm := timing(t.Samples)
+	ftyp := box("ftyp", []byte("isom"), u32(0x200), []byte("isomiso2mp41"), []byte(sampleEntryType(t.Codec)))
+
+	// The chunk offset does not change the moov size, so lay out once to
+	// find where sample data starts
+	moov := t.moov(record, tm, sizes, 0)
+	mdatHeader := u32(uint32(8 + mdat.Len()))
+	mdatHeader = append(mdatHeader, "mdat"...)
+	if 8+uint64(mdat.Len()) > 0xFFFFFFFF {
+		mdatHeader = append(u32(1), "mdat"...)
+		mdatHeader = binary.BigEndian.AppendUint64(mdatHeader, 16+uint64(mdat.Len()))
+	}
+	moov = t.moov(record, tm, sizes, uint64(len(ftyp)+len(moov)+len(mdatHeader)))
+
+	for _, b := range [][]byte{ftyp, moov, mdatHeader, mdat.Bytes()} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sampleTiming holds per-sample decode durations and composition offsets
+// in timescale units
+type sampleTiming struct {
+	durations []uint32
+	offsets   []int32
+	total     uint64
+}
+
+// timing converts nanosecond timestamps to durations and composition
+// offsets, forcing decode order to be strictly increasing
+func timing(samples []Sample) sampleTiming {
+	toTicks := func(ns int64) int64 { return ns * timescale / 1e9 }
+	dts := make([]int64, len(samples))
+	for i, s := range samples {
+		d := s.DTS
+		if d == 0 {
+			d = s.PTS
+		}
+		dts[i] = toTicks(d - firstDTS(samples))
+		if i > 0 && dts[i] <= dts[i-1] {
+			dts[i] = dts[i-1] + 1
+		}
+	}
+
+	tm := sampleTiming{durations: make([]uint32, len(samples)), offsets: make([]int32, len(samples))}
+	for i := range samples {
+		switch {
+		case i+1 < len(samples):
+			tm.durations[i] = uint32(dts[i+1] - dts[i])
+		case i > 0:
+			tm.durations[i] = tm.durations[i-1]
+		default:
+			tm.durations[i] = timescale / 30
+		}
+		tm.total += uint64(tm.durations[i])
+		if samples[i].DTS != 0 {
+			tm.offsets[i] = int32(toTicks(samples[i].PTS-firstDTS(samples)) - dts[i])
+		}
+	}
+	return tm
+}
+
+func firstDTS(samples []Sample) int64 {
+	if samples[0].DTS != 0 {
+		return samples[0].DTS
+	}
+	return samples[0].PTS
+}
+
+// moov builds the movie box for a single video track whose samples are one
+// chunk at offset
+func (t Track) moov(record []byte, tm sampleTiming, sizes []uint32, offset uint64) []byte {
+	movieDuration := uint32(tm.total * 1000 / timescale)
+	matrix := []byte{
+		0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0x40, 0, 0, 0,
+	}
+
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(movieDuration),
+		u32(0x00010000), u16(0x0100), make([]byte, 10),
+		matrix, make([]byte, 24), u32(2))
+	tkhd := fullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(1), u32(0), u32(movieDuration), make([]byte, 8),
+		u16(0), u16(0), u16(0), u16(0), t.displayMatrix(),
+		u32(uint32(t.Width)<<16), u32(uint32(t.Height)<<16))
+
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(timescale), u32(uint32(tm.total)), u16(0x55C4), u16(0)) // "und"
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte("vide"), make([]byte, 12), []byte("VideoHandler\x00"))
+	vmhd := fullBox("vmhd", 0, 1, make([]byte, 8))
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+
+	trak := box("trak", tkhd,
+		box("mdia", mdhd, hdlr,
+			box("minf", vmhd, dinf, t.stbl(record, tm, sizes, offset))))
+	if len(t.Chapters) == 0 {
+		return box("moov", mvhd, trak)
+	}
+	return box("moov", mvhd, trak, box("udta", chpl(t.Chapters)))
+}
+
+// displayMatrix builds the track matrix turning the picture by Rotation,
+// translated back into view as other muxers write it
+func (t Track) displayMatrix() []byte {
+	const one = 0x00010000 // 16.16 fixed point
+	w, h := int32(t.Width)<<16, int32(t.Height)<<16
+	var a, b, c, d, tx, ty int32
+	switch t.Rotation {
+	case 90:
+		b, c, tx = one, -one, h
+	case 180:
+		a, d, tx, ty = -one, -one, w, h
+	case 270:
+		b, c, ty = -one, one, w
+	default:
+		a, d = one, one
+	}
+	var m []byte
+	for _, v := range []int32{a, b, 0, c, d, 0, tx, ty, 0x40000000} {
+		m = append(m, u32(uint32(v))...)
+	}
+	return m
+}
+
+func (t Track) stbl(record []byte, tm sampleTiming, sizes []uint32, offset uint64) []byte {
+	configType := "avcC"
+	if t.Codec == "hevc" {
+		configType = "hvcC"
+	}
+	compressor := make([]byte, 32)
+	entry := box(sampleEntryType(t.Codec),
+		make([]byte, 6), u16(1), // data_reference_index
+		make([]byte, 16), u16(uint16(t.Width)), u16(uint16(t.Height)),
+		u32(0x00480000), u32(0x00480000), u32(0), u16(1), // 72 dpi, one frame per sample
+		compressor, u16(0x0018), u16(0xFFFF),
+		box(configType, record), t.colorBoxes())
+	stsd := fullBox("stsd", 0, 0, u32(1), entry)
+
+	// Run-length encoded durations
+	var stts []byte
+	runs := 0
+	for i := 0; i < len(tm.durations); {
+		j := i
+		for j < len(tm.durations) && tm.durations[j] == tm.durations[i] {
+			j++
+		}
+		stts = append(stts, u32(uint32(j-i))...)
+		stts = append(stts, u32(tm.durations[i])...)
+		runs++
+		i = j
+	}
+
+	var stss []byte
+	keyframes := 0
+	for i, s := range t.Samples {
+		if s.Keyframe {
+			stss = append(stss, u32(uint32(i+1))...)
+			keyframes++
+		}
+	}
+
+	var stsz []byte
+	for _, size := range sizes {
+		stsz = append(stsz, u32(size)...)
+	}
+
+	boxes := [][]byte{
+		stsd,
+		fullBox("stts", 0, 0, u32(uint32(runs)), stts),
+		fullBox("stss", 0, 0, u32(uint32(keyframes)), stss),
+	}
+	if ctts := compositionOffsets(tm.offsets); ctts != nil {
+		boxes = append(boxes, ctts)
+	}
+	boxes = append(boxes,
+		fullBox("stsc", 0, 0, u32(1), u32(1), u32(uint32(len(sizes))), u32(1)),
+		fullBox("stsz", 0, 0, u32(0), u32(uint32(len(sizes))), stsz),
+		fullBox("co64", 0, 0, u32(1), binary.BigEndian.AppendUint64(nil, offset)),
+	)
+	return box("stbl", boxes...)
+}
+
+// colorBoxes builds the sample entry's colr, mdcv and clli boxes
+func (t Track) colorBoxes() []byte {
+	var b []byte
+	if c := t.Color; c != nil {
+		rng := uint8(0)
+		if c.FullRange {
+			rng = 0x80
+		}
+		b = append(b, box("colr", []byte("nclx"), u16(uint16(c.Primaries)), u16(uint16(c.Transfer)), u16(uint16(c.Matrix)), []byte{rng})...)
+	}
+	if m := t.Mastering; m != nil {
+		var p []byte
+		for _, xy := range append(m.Primaries[:], m.WhitePoint) {
+			p = append(p, u16(xy[0])...)
+			p = append(p, u16(xy[1])...)
+		}
+		b = append(b, box("mdcv", p, u32(m.MaxLuminance), u32(m.MinLuminance))...)
+	}
+	if l := t.ContentLight; l != nil {
+		b = append(b, box("clli", u16(l.MaxCLL), u16(l.MaxFALL))...)
+	}
+	return b
+}
+
+// compositionOffsets builds a ctts box, or nil when presentation order is
+// decode order
+func compositionOffsets(offsets []int32) []byte {
+	var entries []byte
+	runs := 0
+	reordered := false
+	version := uint8(0)
+	for i := 0; i < len(offsets); {
+		j := i
+		for j < len(offsets) && offsets[j] == offsets[i] {
+			j++
+		}
+		if offsets[i] != 0 {
+			reordered = true
+		}
+		if offsets[i] < 0 {
+			version = 1
+		}
+		entries = append(entries, u32(uint32(j-i))...)
+		entries = append(entries, u32(uint32(offsets[i]))...)
+		runs++
+		i = j
+	}
+	if !reordered {
+		return nil
+	}
+	return fullBox("ctts", version, 0, u32(uint32(runs)), entries)
+}
+
+func sampleEntryType(codec string) string {
+	if codec == "hevc" {
+		return "hvc1"
+	}
+	return "avc1"
+}
+
+func isParamSet(codec string, nal []byte) bool {
+	if len(nal) == 0 {
+		return false
+	}
+	if codec == "hevc" {
+		t := bitstream.H265NALType(nal)
+		return t == bitstream.H265NALVPS || t == bitstream.H265NALSPS || t == bitstream.H265NALPPS
+	}
+	t := nal[0] & 0x1F
+	return t == bitstream.H264NALSPS || t == bitstream.H264NALPPS
+}
+
+// isAUD reports access unit delimiters, which MP4 samples omit
+func isAUD(codec string, nal []byte) bool {
+	if len(nal) == 0 {
+		return false
+	}
+	if codec == "hevc" {
+		return bitstream.H265NALType(nal) == 35
+	}
+	return nal[0]&0x1F == 9
+}
+
+func contains(nals [][]byte, nal []byte) bool {
+	for _, n := range nals {
+		if bytes.Equal(n, nal) {
+			return true
+		}
+	}
+	return false
+}
+
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func fullBox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	header := u32(uint32(version)<<24 | flags&0xFFFFFF)
+	return box(typ, append([][]byte{header}, payload...)...)
+}
+
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
@@ -0,0 +1,429 @@
+// Package mpegts demultiplexes H.264 and H.265 video from an MPEG transport
+// stream, so producers such as ffmpeg can push a plain TS stream instead of
+// implementing the gateway's IPC protocol, and multiplexes the gateway's
+// stream back into one for receivers on the LAN.
+package mpegts
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	packetSize = 188
+	syncByte   = 0x47
+
+	pidPAT = 0x0000
+
+	tableIDPAT = 0x00
+	tableIDPMT = 0x02
+
+	streamTypeH264 = 0x1B
+	streamTypeH265 = 0x24
+
+	// maxPESSize bounds a buffered PES packet; larger ones are discarded
+	maxPESSize = 16 << 20
+)
+
+// Frame is one demultiplexed video access unit in Annex-B form
+type Frame struct {
+	Codec    string // "h264" or "hevc"
+	PTS      int64  // Nanoseconds
+	DTS      int64  // Nanoseconds; equal to PTS when the stream omits it
+	Keyframe bool
+	Data     []byte
+}
+
+// Stats are demuxer counters
+type Stats struct {
+	Packets   uint64 // Transport packets read
+	Resyncs   uint64 // Times the reader lost sync and searched for 0x47
+	CCErrors  uint64 // Continuity counter gaps on the video PID
+	Discarded uint64 // PES packets dropped because they were incomplete
+	Frames    uint64 // Frames returned
+}
+
+// Demuxer reads transport packets and returns video frames from the first
+// program's first H.264 or H.265 stream. Other streams, including audio, are
+// ignored.
+//
+// Video PES packets from muxers like ffmpeg have no length, so a frame is
+// returned when the next one starts; this adds one frame interval of delay.
+// PSI sections are assumed to fit in one packet, as they do in practice.
+//
+// A Demuxer is not safe for concurrent use.
+type Demuxer struct {
+	r *bufio.Reader
+
+	pmtPID   int // -1 until the PAT is seen
+	videoPID int // -1 until the PMT is seen
+	codec    string
+
+	pes          []byte
+	pesValid     bool // pes holds a PES packet that started cleanly
+	lastCC       int  // -1 before the first video packet
+	randomAccess bool
+
+	// 33-bit timestamp unwrapping
+	ptsBase int64
+	lastRaw int64
+	started bool
+
+	stats Stats
+	buf   [packetSize]byte
+}
+
+// NewDemuxer creates a demuxer reading from r
+func NewDemuxer(r io.Reader) *Demuxer {
+	return &Demuxer{
+		r:        bufio.NewReaderSize(r, 64*packetSize),
+		pmtPID:   -1,
+		videoPID: -1,
+		lastCC:   -1,
+	}
+}
+
+// Stats returns the demuxer counters
+func (d *Demuxer) Stats() Stats {
+	return d.stats
+}
+
+// Codec returns the video codec, or "" before the PMT has been read
+func (d *Demuxer) Codec() string {
+	return d.codec
+}
+
+// ReadFrame returns the next video frame. At the end of the stream the last
+// buffered frame is returned before io.EOF.
+func (d *Demuxer) ReadFrame() (Frame, error) {
+	for {
+		pkt, err := d.readPacket()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				if frame, ok := d.flush(); ok {
+					return frame, nil
+				}
+				return Frame{}, io.EOF
+			}
+			return Frame{}, err
+		}
+		if frame, ok := d.handlePacket(pkt); ok {
+			return frame, nil
+		}
+	}
+}
+
+// readPacket reads one transport packet, resynchronising on a lost sync byte
+func (d *Demuxer) readPacket() ([]byte, error) {
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != syncByte {
+			d.stats.Resyncs++
+			if err := d.skipToSync(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		d.buf[0] = b
+		if _, err := io.ReadFull(d.r, d.buf[1:]); err != nil {
+			return nil, err
+		}
+		d.stats.Packets++
+		return d.buf[:], nil
+	}
+}
+
+// skipToSync discards bytes up to the next sync byte
+func (d *Demuxer) skipToSync() error {
+	for {
+		b, err := d.r.Peek(1)
+		if err != nil {
+			return err
+		}
+		if b[0] == syncByte {
+			return nil
+		}
+		if _, err := d.r.Discard(1); err != nil {
+			return err
+		}
+	}
+}
+
+// handlePacket processes one packet and returns a frame when one completes
+func (d *Demuxer) handlePacket(pkt []byte) (Frame, bool) {
+	if pkt[1]&0x80 != 0 {
+		return Frame{}, false // transport_error_indicator
+	}
+	pusi := pkt[1]&0x40 != 0
+	pid := int(pkt[1]&0x1F)<<8 | int(pkt[2])
+	afc := (pkt[3] >> 4) & 0x03
+	cc := int(pkt[3] & 0x0F)
+
+	payload := pkt[4:]
+	randomAccess := false
+	if afc&0x02 != 0 {
+		afLen := int(payload[0])
+		if afLen > len(payload)-1 {
+			return Frame{}, false
+		}
+		if afLen > 0 {
+			randomAccess = payload[1]&0x40 != 0
+		}
+		payload = payload[1+afLen:]
+	}
+	if afc&0x01 == 0 {
+		payload = nil
+	}
+
+	switch {
+	case pid == pidPAT:
+		if pusi {
+			d.parsePAT(payload)
+		}
+	case pid == d.pmtPID:
+		if pusi {
+			d.parsePMT(payload)
+		}
+	case pid == d.videoPID:
+		return d.handleVideo(payload, pusi, cc, afc, randomAccess)
+	}
+	return Frame{}, false
+}
+
+// handleVideo accumulates PES data for the video PID
+func (d *Demuxer) handleVideo(payload []byte, pusi bool, cc int, afc byte, randomAccess bool) (Frame, bool) {
+	// The counter only advances on packets with payload
+	if afc&0x01 != 0 {
+		if cc == d.lastCC {
+			return Frame{}, false // Duplicate packet
+		}
+		if d.lastCC >= 0 && cc != (d.lastCC+1)&0x0F {
+			d.stats.CCErrors++
+			if len(d.pes) > 0 && !pusi {
+				d.pesValid = false
+			}
+		}
+		d.lastCC = cc
+	}
+
+	var (
+		frame Frame
+		ready bool
+	)
+	if pusi {
+		frame, ready = d.flush()
+		d.pes = append(d.pes[:0], payload...)
+		d.pesValid = true
+		d.randomAccess = randomAccess
+	} else if d.pesValid {
+		if len(d.pes)+len(payload) > maxPESSize {
+			d.pesValid = false
+			d.stats.Discarded++
+		} else {
+			d.pes = append(d.pes, payload...)
+		}
+	}
+
+	// A bounded PES packet can be returned as soon as it is complete
+	if !ready && d.pesValid && len(d.pes) >= 6 {
+		if n := int(d.pes[4])<<8 | int(d.pes[5]); n > 0 && len(d.pes) >= 6+n {
+			d.pes = d.pes[:6+n]
+			frame, ready = d.flush()
+		}
+	}
+	return frame, ready
+}
+
+// flush turns the buffered PES packet into a frame
+func (d *Demuxer) flush() (Frame, bool) {
+	defer func() {
+		d.pes = d.pes[:0]
+		d.pesValid = false
+	}()
+
+	if len(d.pes) == 0 {
+		return Frame{}, false
+	}
+	if !d.pesValid {
+		d.stats.Discarded++
+		return Frame{}, false
+	}
+
+	pts, dts, data, err := parsePES(d.pes)
+	if err != nil || len(data) == 0 {
+		d.stats.Discarded++
+		return Frame{}, false
+	}
+
+	frame := Frame{
+		Codec:    d.codec,
+		PTS:      d.timestamp(pts),
+		Keyframe: d.randomAccess || isKeyframe(d.codec, data),
+		Data:     bytes.Clone(data),
+	}
+	frame.DTS = frame.PTS
+	if dts >= 0 {
+		frame.DTS = frame.PTS - ticksToDuration(pts-dts)
+	}
+	d.stats.Frames++
+	return frame, true
+}
+
+// timestamp converts a 90 kHz PTS to nanoseconds, unwrapping 33-bit rollover
+func (d *Demuxer) timestamp(raw int64) int64 {
+	if raw < 0 {
+		raw = d.lastRaw
+	}
+	if d.started && raw < d.lastRaw && d.lastRaw-raw > 1<<32 {
+		d.ptsBase += 1 << 33
+	}
+	d.lastRaw = raw
+	d.started = true
+	return ticksToDuration(d.ptsBase + raw)
+}
+
+// parsePAT picks the first program's PMT PID
+func (d *Demuxer) parsePAT(payload []byte) {
+	section, ok := psiSection(payload, tableIDPAT)
+	if !ok {
+		return
+	}
+	// Skip transport_stream_id, version and section numbers
+	for entries := section[5:]; len(entries) >= 4; entries = entries[4:] {
+		program := int(entries[0])<<8 | int(entries[1])
+		if program == 0 {
+			continue // Network PID
+		}
+		d.pmtPID = int(entries[2]&0x1F)<<8 | int(entries[3])
+		return
+	}
+}
+
+// parsePMT picks the first supported video stream
+func (d *Demuxer) parsePMT(payload []byte) {
+	section, ok := psiSection(payload, tableIDPMT)
+	if !ok || len(section) < 9 {
+		return
+	}
+	infoLen := int(section[7]&0x0F)<<8 | int(section[8])
+	if 9+infoLen > len(section) {
+		return
+	}
+
+	for es := section[9+infoLen:]; len(es) >= 5; {
+		streamType := es[0]
+		pid := int(es[1]&0x1F)<<8 | int(es[2])
+		esInfoLen := int(es[3]&0x0F)<<8 | int(es[4])
+		if 5+esInfoLen > len(es) {
+			return
+		}
+		es = es[5+esInfoLen:]
+
+		var codec string
+		switch streamType {
+		case streamTypeH264:
+			codec = "h264"
+		case streamTypeH265:
+			codec = "hevc"
+		default:
+			continue
+		}
+
+		if pid != d.videoPID {
+			d.videoPID = pid
+			d.codec = codec
+			d.lastCC = -1
+			d.pes = d.pes[:0]
+			d.pesValid = false
+		}
+		return
+	}
+}
+
+// psiSection returns a PSI section's body after section_length, without
+// the CRC, when it has the expected table ID and fits in the payload
+func psiSection(payload []byte, tableID byte) ([]byte, bool) {
+	if len(payload) < 1 {
+		return nil, false
+	}
+	pointer := int(payload[0])
+	if 1+pointer+3 > len(payload) {
+		return nil, false
+	}
+	s := payload[1+pointer:]
+	if s[0] != tableID {
+		return nil, false
+	}
+	length := int(s[1]&0x0F)<<8 | int(s[2])
+	if length < 9 || 3+length > len(s) {
+		return nil, false
+	}
+	return s[3 : 3+length-4], true
+}
+
+// parsePES returns the PTS, DTS (-1 when absent) and payload of a PES packet
+func parsePES(pes []byte) (pts, dts int64, data []byte, err error) {
+	if len(pes) < 9 || pes[0] != 0 || pes[1] != 0 || pes[2] != 1 {
+		return 0, 0, nil, errors.New("mpegts: invalid PES start code")
+	}
+	flags := pes[7] >> 6
+	headerLen := int(pes[8])
+	if 9+headerLen > len(pes) {
+		return 0, 0, nil, fmt.Errorf("mpegts: PES header length %d exceeds packet", headerLen)
+	}
+
+	pts, dts = -1, -1
+	opt := pes[9 : 9+headerLen]
+	if flags&0x02 != 0 && len(opt) >= 5 {
+		pts = readTimestamp(opt)
+	}
+	if flags == 0x03 && len(opt) >= 10 {
+		dts = readTimestamp(opt[5:])
+	}
+	return pts, dts, pes[9+headerLen:], nil
+}
+
+// readTimestamp decodes a 33-bit PES timestamp
+func readTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&0x07)<<30 |
+		int64(b[1])<<22 |
+		int64(b[2]>>1)<<15 |
+		int64(b[3])<<7 |
+		int64(b[4]>>1)
+}
+
+// ticksToDuration converts 90 kHz ticks to nanoseconds
+func ticksToDuration(ticks int64) int64 {
+	return ticks * int64(time.Second) / 90000
+}
+
+// isKeyframe reports whether an Annex-B access unit contains an IDR (H.264)
+// or IRAP (H.265) picture
+func isKeyframe(codec string, au []byte) bool {
+	for i := 0; i+3 < len(au); i++ {
+		if au[i] != 0 || au[i+1] != 0 || au[i+2] != 1 {
+			continue
+		}
+		header := au[i+3]
+		switch codec {
+		case "h264":
+			if header&0x1F == 5 {
+				return true
+			}
+		case "hevc":
+			if t := header >> 1 & 0x3F; t >= 16 && t <= 21 {
+				return true
+			}
+		}
+		i += 2
+	}
+	return false
+}
@@ -0,0 +1,328 @@
+package mpegts
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Muxer layout: one program with video and, optionally, Opus audio
+const (
+	pidPMT   = 0x1000
+	pidVideo = 0x0100
+	pidAudio = 0x0101
+
+	programNumber = 1
+
+	streamTypePrivate = 0x06 // Opus, identified by its registration descriptor
+
+	streamIDVideo   = 0xE0
+	streamIDPrivate = 0xBD
+
+	// psiInterval is how often the PAT and PMT are repeated between
+	// keyframes, so receivers tuning in find the program quickly
+	psiInterval = 100 * time.Millisecond
+
+	// pcrDelay is how far the clock runs behind presentation times, giving
+	// receivers time to buffer a frame before showing it
+	pcrDelay = 100 * time.Millisecond
+)
+
+// Muxer multiplexes H.264 or H.265 video and optional Opus audio into an
+// MPEG transport stream, for receivers such as set-top boxes and VLC.
+// Timestamps are nanoseconds on a clock shared by both streams.
+//
+// The PAT and PMT are repeated on every keyframe and at least every 100ms,
+// and the video carries the PCR. Video access units must be Annex-B; an
+// access unit delimiter is added when missing, as some decoders require it.
+//
+// A Muxer is not safe for concurrent use.
+type Muxer struct {
+	w     io.Writer
+	audio bool
+	chans int
+
+	codec   string
+	version byte  // PMT version, bumped when the codec changes
+	lastPSI int64 // -1 before the first PAT
+	cc      map[int]byte
+
+	pes []byte
+	buf [packetSize]byte
+}
+
+// NewMuxer creates a muxer writing whole transport packets to w. With
+// audioChannels above zero the program also has an Opus stream with that
+// many channels (1 or 2).
+func NewMuxer(w io.Writer, audioChannels int) *Muxer {
+	return &Muxer{
+		w:       w,
+		audio:   audioChannels > 0,
+		chans:   min(audioChannels, 2),
+		lastPSI: -1,
+		cc:      make(map[int]byte),
+	}
+}
+
+// Codec returns the video codec of the current program, or "" before the
+// first frame
+func (m *Muxer) Codec() string {
+	return m.codec
+}
+
+// WriteVideo writes a video access unit presented at pts
+func (m *Muxer) WriteVideo(codec string, pts int64, keyframe bool, au []byte) error {
+	if codec != "h264" && codec != "hevc" {
+		return fmt.Errorf("mpegts: unsupported video codec %q", codec)
+	}
+	if len(au) == 0 {
+		return errors.New("mpegts: empty access unit")
+	}
+	if codec != m.codec {
+		if m.codec != "" {
+			m.version = (m.version + 1) & 0x1F
+		}
+		m.codec = codec
+		m.lastPSI = -1
+	}
+	if keyframe || m.lastPSI < 0 || pts-m.lastPSI >= int64(psiInterval) || pts < m.lastPSI {
+		if err := m.writePSI(); err != nil {
+			return err
+		}
+		m.lastPSI = pts
+	}
+
+	m.pes = append(m.pes[:0], 0, 0, 1, streamIDVideo, 0, 0, 0x84, 0x80, 5)
+	m.pes = appendTimestamp(m.pes, 0x2, durationToTicks(pts))
+	if !hasAUD(codec, au) {
+		m.pes = append(m.pes, audFor(codec)...)
+	}
+	m.pes = append(m.pes, au...)
+	// Video PES packets may be unbounded when they do not fit the length
+	if n := len(m.pes) - 6; n <= 0xFFFF {
+		m.pes[4], m.pes[5] = byte(n>>8), byte(n)
+	}
+	return m.writePES(pidVideo, m.pes, durationToTicks(pts-int64(pcrDelay)), keyframe)
+}
+
+// WriteAudio writes one Opus packet presented at pts. It is ignored when the
+// muxer has no audio stream or before the first video frame, as receivers
+// cannot find the program until then.
+func (m *Muxer) WriteAudio(pts int64, opus []byte) error {
+	if !m.audio || m.lastPSI < 0 || len(opus) == 0 {
+		return nil
+	}
+
+	m.pes = append(m.pes[:0], 0, 0, 1, streamIDPrivate, 0, 0, 0x84, 0x80, 5)
+	m.pes = appendTimestamp(m.pes, 0x2, durationToTicks(pts))
+	// Opus control header (ETSI TS 102 366 style, as in the Opus TS mapping)
+	m.pes = append(m.pes, 0x7F, 0xE0)
+	n := len(opus)
+	for ; n >= 0xFF; n -= 0xFF {
+		m.pes = append(m.pes, 0xFF)
+	}
+	m.pes = append(m.pes, byte(n))
+	m.pes = append(m.pes, opus...)
+	if n := len(m.pes) - 6; n <= 0xFFFF {
+		m.pes[4], m.pes[5] = byte(n>>8), byte(n)
+	} else {
+		return errors.New("mpegts: audio packet too large")
+	}
+	return m.writePES(pidAudio, m.pes, -1, false)
+}
+
+// writePSI writes the PAT and PMT
+func (m *Muxer) writePSI() error {
+	pat := []byte{
+		tableIDPAT, 0, 0,
+		0x00, 0x01, // transport_stream_id
+		0xC1 | m.version<<1, 0, 0,
+		byte(programNumber >> 8), byte(programNumber), 0xE0 | pidPMT>>8, pidPMT & 0xFF,
+	}
+	if err := m.writeSection(pidPAT, pat); err != nil {
+		return err
+	}
+
+	streamType := byte(streamTypeH264)
+	if m.codec == "hevc" {
+		streamType = streamTypeH265
+	}
+	pmt := []byte{
+		tableIDPMT, 0, 0,
+		byte(programNumber >> 8), byte(programNumber),
+		0xC1 | m.version<<1, 0, 0,
+		0xE0 | pidVideo>>8, pidVideo & 0xFF, // PCR PID
+		0xF0, 0, // No program descriptors
+		streamType, 0xE0 | pidVideo>>8, pidVideo & 0xFF, 0xF0, 0,
+	}
+	if m.audio {
+		pmt = append(pmt,
+			streamTypePrivate, 0xE0|pidAudio>>8, pidAudio&0xFF, 0xF0, 10,
+			0x05, 4, 'O', 'p', 'u', 's', // Registration descriptor
+			0x7F, 2, 0x80, byte(m.chans), // Extension descriptor: Opus channel configuration
+		)
+	}
+	return m.writeSection(pidPMT, pmt)
+}
+
+// writeSection fills in a PSI section's length and CRC and writes it in one
+// packet
+func (m *Muxer) writeSection(pid int, section []byte) error {
+	length := len(section) - 3 + 4
+	section[1] = 0xB0 | byte(length>>8)
+	section[2] = byte(length)
+	crc := crc32MPEG(section)
+	section = append(section, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	pkt := m.buf[:]
+	m.header(pkt, pid, true, false)
+	pkt[4] = 0 // Pointer field
+	n := copy(pkt[5:], section)
+	for i := 5 + n; i < packetSize; i++ {
+		pkt[i] = 0xFF
+	}
+	_, err := m.w.Write(pkt)
+	return err
+}
+
+// writePES splits a PES packet into transport packets. pcr, in 90 kHz
+// ticks, is carried in the first packet unless negative.
+func (m *Muxer) writePES(pid int, pes []byte, pcr int64, randomAccess bool) error {
+	first := true
+	for len(pes) > 0 {
+		pkt := m.buf[:]
+		var af [184]byte
+		afSize := 0 // Adaptation field bytes, including its length byte
+		if first && (pcr >= 0 || randomAccess) {
+			afSize = 2
+			if randomAccess {
+				af[1] |= 0x40
+			}
+			if pcr >= 0 {
+				af[1] |= 0x10
+				base := pcr & (1<<33 - 1)
+				af[2] = byte(base >> 25)
+				af[3] = byte(base >> 17)
+				af[4] = byte(base >> 9)
+				af[5] = byte(base >> 1)
+				af[6] = byte(base<<7) | 0x7E
+				af[7] = 0
+				afSize = 8
+			}
+		}
+
+		n := min(len(pes), 184-afSize)
+		if stuff := 184 - afSize - n; stuff > 0 {
+			// Pad the last packet with adaptation field stuffing
+			if afSize == 0 {
+				afSize = 1
+				stuff--
+				if stuff > 0 {
+					af[1] = 0
+					afSize = 2
+					stuff--
+				}
+			}
+			for i := 0; i < stuff; i++ {
+				af[afSize+i] = 0xFF
+			}
+			afSize += stuff
+		}
+
+		m.header(pkt, pid, first, afSize > 0)
+		if afSize > 0 {
+			af[0] = byte(afSize - 1)
+			copy(pkt[4:], af[:afSize])
+		}
+		copy(pkt[4+afSize:], pes[:n])
+		if _, err := m.w.Write(pkt); err != nil {
+			return err
+		}
+		pes = pes[n:]
+		first = false
+	}
+	return nil
+}
+
+// header writes a transport packet header carrying a payload
+func (m *Muxer) header(pkt []byte, pid int, start, adaptation bool) {
+	pkt[0] = syncByte
+	pkt[1] = byte(pid>>8) & 0x1F
+	if start {
+		pkt[1] |= 0x40
+	}
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 | m.cc[pid]
+	if adaptation {
+		pkt[3] |= 0x20
+	}
+	m.cc[pid] = (m.cc[pid] + 1) & 0x0F
+}
+
+// appendTimestamp encodes a 33-bit PES timestamp with the given prefix
+func appendTimestamp(b []byte, prefix byte, ticks int64) []byte {
+	ticks &= 1<<33 - 1
+	return append(b,
+		prefix<<4|byte(ticks>>29)&0x0E|1,
+		byte(ticks>>22),
+		byte(ticks>>14)|1,
+		byte(ticks>>7),
+		byte(ticks<<1)|1,
+	)
+}
+
+// durationToTicks converts nanoseconds to 90 kHz ticks without overflowing
+// on wall-clock timestamps
+func durationToTicks(ns int64) int64 {
+	sec, frac := ns/int64(time.Second), ns%int64(time.Second)
+	return sec*90000 + frac*90000/int64(time.Second)
+}
+
+// hasAUD reports whether an access unit starts with an access unit
+// delimiter
+func hasAUD(codec string, au []byte) bool {
+	i := 0
+	for i < len(au) && au[i] == 0 {
+		i++
+	}
+	if i < 2 || i+1 >= len(au) || au[i] != 1 {
+		return false
+	}
+	if codec == "hevc" {
+		return au[i+1]>>1&0x3F == 35
+	}
+	return au[i+1]&0x1F == 9
+}
+
+// audFor returns an access unit delimiter allowing any picture type
+func audFor(codec string) []byte {
+	if codec == "hevc" {
+		return []byte{0, 0, 0, 1, 0x46, 0x01, 0x50}
+	}
+	return []byte{0, 0, 0, 1, 0x09, 0xF0}
+}
+
+var crcTable = func() (t [256]uint32) {
+	for i := range t {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04C11DB7
+			} else {
+				c <<= 1
+			}
+		}
+		t[i] = c
+	}
+	return t
+}()
+
+// crc32MPEG is the CRC used by PSI sections (CRC-32/MPEG-2)
+func crc32MPEG(b []byte) uint32 {
+	crc := uint32(0xFFFFFFFF)
+	for _, v := range b {
+		crc = crc<<8 ^ crcTable[byte(crc>>24)^v]
+	}
+	return crc
+}
@@ -0,0 +1,23 @@
+package media
+
+import "fmt"
+
+// VideoOrientationExtensionURI is the coordination of video orientation
+// (CVO) RTP header extension of 3GPP TS 26.114, which browsers apply when
+// rendering; it is negotiated with an SDP extmap
+const VideoOrientationExtensionURI = "urn:3gpp:video-orientation"
+
+// normalizeRotation turns a rotation in degrees into 0, 90, 180 or 270.
+// Rotations that are not a multiple of 90 are an error.
+func normalizeRotation(degrees int) (int, error) {
+	if degrees%90 != 0 {
+		return 0, fmt.Errorf("rotation %d is not a multiple of 90 degrees", degrees)
+	}
+	return (degrees%360 + 360) % 360, nil
+}
+
+// VideoOrientationExtension builds the one-byte payload of the CVO header
+// extension for a clockwise display rotation of 0, 90, 180 or 270 degrees
+func VideoOrientationExtension(rotation int) []byte {
+	return []byte{byte(rotation/90) & 0x03}
+}
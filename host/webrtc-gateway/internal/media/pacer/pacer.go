@@ -0,0 +1,352 @@
+// Package pacer spreads the RTP packets of large video frames over time.
+//
+// A track packetizes each frame and writes all its packets at once, so a
+// keyframe several times the size of a delta frame leaves as one burst that
+// overflows router queues and Wi-Fi aggregation, and loses packets exactly
+// when they matter most. The pacer is an interceptor: every outgoing video
+// stream of every peer passes a token bucket refilled at the pacing rate.
+// Small frames fit the bucket's burst and leave untouched; the rest of a
+// big frame queues and is sent as tokens accrue.
+//
+// A viewer whose link cannot keep up would make its queue grow without
+// bound. Once a stream's backlog exceeds the delay bound, the pacer refuses
+// whole new frames with ErrCongested until it drains; the sender then skips
+// that viewer's delta frames until the next keyframe.
+package pacer
+
+import (
+	"errors"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/rs/zerolog"
+)
+
+// ErrCongested is returned for the packets of a frame refused because the
+// stream's backlog exceeds MaxDelay. Frames referencing it cannot be
+// decoded, so the sender should skip to the next keyframe.
+var ErrCongested = errors.New("pacer: stream congested, frame dropped")
+
+// Config configures the pacer
+type Config struct {
+	// RateKbps is the pacing rate of each stream. Set it well above the
+	// video bitrate, e.g. 2.5x, so queues drain between keyframes.
+	RateKbps int
+
+	// BurstBytes are sent without pacing, default 16 full packets
+	BurstBytes int
+
+	// MaxDelay bounds the delay pacing adds; a stream whose queue would
+	// take longer to drain refuses new frames until it catches up. A frame
+	// already being queued is never cut short. Default 100ms.
+	MaxDelay time.Duration
+}
+
+// Stats are pacer counters, summed over all streams
+type Stats struct {
+	RateKbps   int     `json:"rate_kbps"`
+	Streams    int     `json:"streams"`
+	Immediate  uint64  `json:"immediate"` // Packets sent within the burst
+	Paced      uint64  `json:"paced"`     // Packets queued for pacing
+	Skipped    uint64  `json:"skipped"`   // Frames refused for exceeding MaxDelay
+	Errors     uint64  `json:"errors"`    // Failed writes of queued packets
+	MaxDelayMs float64 `json:"max_delay_ms"`
+}
+
+// Pacer creates the pacing interceptor of each peer connection. Register
+// it with the interceptor registry of the WebRTC API.
+type Pacer struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	streams atomic.Int64
+
+	// Statistics
+	immediate atomic.Uint64
+	paced     atomic.Uint64
+	skipped   atomic.Uint64
+	errors    atomic.Uint64
+	maxDelay  atomic.Int64 // Nanoseconds
+}
+
+// New creates a pacer
+func New(cfg Config, logger zerolog.Logger) *Pacer {
+	// Apply defaults for zero values
+	if cfg.BurstBytes <= 0 {
+		cfg.BurstBytes = 16 * 1200
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = 100 * time.Millisecond
+	}
+	return &Pacer{
+		cfg:    cfg,
+		logger: logger.With().Str("component", "pacer").Logger(),
+	}
+}
+
+// NewInterceptor implements interceptor.Factory
+func (p *Pacer) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &pacingInterceptor{
+		pacer:   p,
+		streams: make(map[uint32]*stream),
+	}, nil
+}
+
+// Stats returns pacing counters
+func (p *Pacer) Stats() Stats {
+	return Stats{
+		RateKbps:   p.cfg.RateKbps,
+		Streams:    int(p.streams.Load()),
+		Immediate:  p.immediate.Load(),
+		Paced:      p.paced.Load(),
+		Skipped:    p.skipped.Load(),
+		Errors:     p.errors.Load(),
+		MaxDelayMs: float64(p.maxDelay.Load()) / float64(time.Millisecond),
+	}
+}
+
+// observeDelay records the queueing delay of a sent packet
+func (p *Pacer) observeDelay(d time.Duration) {
+	for {
+		current := p.maxDelay.Load()
+		if int64(d) <= current || p.maxDelay.CompareAndSwap(current, int64(d)) {
+			return
+		}
+	}
+}
+
+// pacingInterceptor paces the video streams of one peer connection
+type pacingInterceptor struct {
+	interceptor.NoOp
+	pacer *Pacer
+
+	mu      sync.Mutex
+	streams map[uint32]*stream // By SSRC
+}
+
+// BindLocalStream paces outgoing video; audio is small and passes through
+func (i *pacingInterceptor) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	if i.pacer.cfg.RateKbps <= 0 || !strings.HasPrefix(strings.ToLower(info.MimeType), "video/") {
+		return writer
+	}
+	s := newStream(i.pacer, writer)
+
+	i.mu.Lock()
+	if old, ok := i.streams[info.SSRC]; ok {
+		old.close()
+	}
+	i.streams[info.SSRC] = s
+	i.mu.Unlock()
+
+	go s.run()
+	return s
+}
+
+// UnbindLocalStream stops pacing a stream; queued packets are dropped
+func (i *pacingInterceptor) UnbindLocalStream(info *interceptor.StreamInfo) {
+	i.mu.Lock()
+	s, ok := i.streams[info.SSRC]
+	delete(i.streams, info.SSRC)
+	i.mu.Unlock()
+	if ok {
+		s.close()
+	}
+}
+
+// Close stops every stream of the connection
+func (i *pacingInterceptor) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for ssrc, s := range i.streams {
+		s.close()
+		delete(i.streams, ssrc)
+	}
+	return nil
+}
+
+// queuedPacket is a packet waiting for tokens
+type queuedPacket struct {
+	header     rtp.Header
+	payload    []byte
+	attributes interceptor.Attributes
+	size       float64
+	at         time.Time
+}
+
+// stream is one outgoing video stream's token bucket and queue
+type stream struct {
+	pacer *Pacer
+	next  interceptor.RTPWriter
+	rate  float64 // Bytes per second
+	burst float64
+
+	mu      sync.Mutex
+	queue   []queuedPacket
+	queued  float64 // Bytes
+	tokens  float64
+	refill  time.Time
+	sending bool // The run loop holds a dequeued packet
+	closed  bool
+
+	// The RTP timestamp of the last frame written, and whether it was
+	// refused; packets of one frame share a timestamp
+	frame    uint32
+	started  bool
+	refusing bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+func newStream(p *Pacer, next interceptor.RTPWriter) *stream {
+	p.streams.Add(1)
+	return &stream{
+		pacer:  p,
+		next:   next,
+		rate:   float64(p.cfg.RateKbps) * 1000 / 8,
+		burst:  float64(p.cfg.BurstBytes),
+		tokens: float64(p.cfg.BurstBytes),
+		refill: time.Now(),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// Write sends a packet at once when the bucket holds enough tokens and
+// nothing is queued ahead of it, and queues it otherwise
+func (s *stream) Write(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+	size := float64(header.MarshalSize() + len(payload))
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return s.next.Write(header, payload, attributes)
+	}
+	if !s.admit(header.Timestamp) {
+		s.mu.Unlock()
+		return 0, ErrCongested
+	}
+	s.refillTokens(time.Now())
+	if len(s.queue) == 0 && !s.sending && s.tokens >= size {
+		s.tokens -= size
+		s.mu.Unlock()
+		s.pacer.immediate.Add(1)
+		return s.next.Write(header, payload, attributes)
+	}
+
+	// Copy the packet; the caller may reuse its buffers once Write returns
+	s.queue = append(s.queue, queuedPacket{
+		header:     header.Clone(),
+		payload:    append([]byte(nil), payload...),
+		attributes: attributes,
+		size:       size,
+		at:         time.Now(),
+	})
+	s.queued += size
+	s.mu.Unlock()
+	s.pacer.paced.Add(1)
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return int(size), nil
+}
+
+// run sends queued packets as tokens accrue until the stream is closed
+func (s *stream) run() {
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.wake:
+		}
+
+		for {
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				return
+			}
+			if len(s.queue) == 0 {
+				s.sending = false
+				s.mu.Unlock()
+				break
+			}
+			now := time.Now()
+			s.refillTokens(now)
+			p := s.queue[0]
+			if s.tokens < p.size {
+				wait := time.Duration((p.size - s.tokens) / s.rate * float64(time.Second))
+				s.mu.Unlock()
+				timer.Reset(wait)
+				select {
+				case <-s.done:
+					return
+				case <-timer.C:
+				}
+				continue
+			}
+			s.tokens = math.Max(s.tokens-p.size, 0)
+			s.queue[0] = queuedPacket{}
+			s.queue = s.queue[1:]
+			s.queued -= p.size
+			s.sending = true
+			s.mu.Unlock()
+
+			s.pacer.observeDelay(now.Sub(p.at))
+			if _, err := s.next.Write(&p.header, p.payload, p.attributes); err != nil {
+				s.pacer.errors.Add(1)
+				s.pacer.logger.Debug().Err(err).Uint32("ssrc", p.header.SSRC).Msg("Error writing paced packet")
+			}
+		}
+	}
+}
+
+// admit decides whether a packet of the frame with the given timestamp may
+// be queued. The decision is made on a frame's first packet and holds for
+// the rest, so frames are refused whole. Caller holds mu.
+func (s *stream) admit(timestamp uint32) bool {
+	if s.started && timestamp == s.frame {
+		return !s.refusing
+	}
+	s.frame = timestamp
+	s.started = true
+	s.refusing = s.queued/s.rate > s.pacer.cfg.MaxDelay.Seconds()
+	if s.refusing {
+		s.pacer.skipped.Add(1)
+	}
+	return !s.refusing
+}
+
+// refillTokens adds the tokens accrued since the last refill. Caller
+// holds mu.
+func (s *stream) refillTokens(now time.Time) {
+	s.tokens = math.Min(s.burst, s.tokens+now.Sub(s.refill).Seconds()*s.rate)
+	s.refill = now
+}
+
+// close stops the stream, dropping queued packets
+func (s *stream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.queue = nil
+	s.queued = 0
+	close(s.done)
+	s.pacer.streams.Add(-1)
+}
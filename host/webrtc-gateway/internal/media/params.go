@@ -0,0 +1,210 @@
+package media
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+)
+
+// StreamInspector reads the parameter sets carried on keyframes, so the
+// stream's real resolution, profile, level and frame rate are known, and
+// reports when they disagree with what the producer or configuration
+// declared
+type StreamInspector struct {
+	logger zerolog.Logger
+
+	mu       sync.Mutex
+	params   bitstream.Params
+	known    bool
+	color    *ColorSpace // Declared by the producer, from the latest keyframe
+	hdr      *HDRMetadata
+	expected StreamMetadata
+	onChange func(bitstream.Params)
+	onColor  func(*ColorSpace, *HDRMetadata)
+	rotation atomic.Int32 // Clockwise display rotation of the latest frame
+	onRotate func(int)
+
+	// Statistics
+	mismatches atomic.Uint64
+	errors     atomic.Uint64
+}
+
+// NewStreamInspector creates a stream inspector
+func NewStreamInspector(logger zerolog.Logger) *StreamInspector {
+	return &StreamInspector{
+		logger: logger.With().Str("component", "stream_inspector").Logger(),
+	}
+}
+
+// SetExpected sets the declared stream properties to validate against; zero
+// fields are not checked
+func (i *StreamInspector) SetExpected(meta StreamMetadata) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.expected = meta
+}
+
+// SetOnChange sets a callback for when the stream's parameters change. It
+// runs on the caller of Observe and must not block.
+func (i *StreamInspector) SetOnChange(fn func(bitstream.Params)) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.onChange = fn
+}
+
+// SetOnColorChange sets a callback for when the declared color space or
+// HDR metadata changes. It runs on the caller of Observe and must not
+// block.
+func (i *StreamInspector) SetOnColorChange(fn func(*ColorSpace, *HDRMetadata)) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.onColor = fn
+}
+
+// SetOnRotationChange sets a callback for when the display rotation
+// changes. It runs on the caller of Observe and must not block.
+func (i *StreamInspector) SetOnRotationChange(fn func(rotation int)) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.onRotate = fn
+}
+
+// Params returns the most recent parameters, if any have been seen
+func (i *StreamInspector) Params() (bitstream.Params, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.params, i.known
+}
+
+// Color returns the color space the producer declared, or nil
+func (i *StreamInspector) Color() *ColorSpace {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.color
+}
+
+// Rotation returns the clockwise display rotation in degrees
+func (i *StreamInspector) Rotation() int {
+	return int(i.rotation.Load())
+}
+
+// HDR returns the HDR metadata the producer declared, or nil
+func (i *StreamInspector) HDR() *HDRMetadata {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.hdr
+}
+
+// Mismatches returns how many parameter changes disagreed with the declared
+// properties
+func (i *StreamInspector) Mismatches() uint64 {
+	return i.mismatches.Load()
+}
+
+// Observe inspects a frame. Only H.264, HEVC, VP9 and AV1 keyframes are
+// parsed.
+func (i *StreamInspector) Observe(frame VideoFrame) {
+	// The display rotation may change on any frame
+	if old := i.rotation.Swap(int32(frame.Rotation)); old != int32(frame.Rotation) {
+		i.rotated(frame.Rotation)
+	}
+	if !frame.IsKeyframe {
+		return
+	}
+	i.observeColor(frame)
+	if frame.Codec != "h264" && frame.Codec != "hevc" && frame.Codec != "vp9" && frame.Codec != "av1" {
+		return
+	}
+
+	params, ok, err := bitstream.FindParams(frame.Codec, frame.Data)
+	if err != nil {
+		// Only log the first failure; a bad SPS repeats on every keyframe
+		if i.errors.Add(1) == 1 {
+			i.logger.Warn().Err(err).Str("codec", frame.Codec).Msg("Failed to parse stream parameters")
+		}
+		return
+	}
+	if !ok {
+		return
+	}
+
+	i.mu.Lock()
+	if i.known && params == i.params {
+		i.mu.Unlock()
+		return
+	}
+	i.params = params
+	i.known = true
+	expected := i.expected
+	fn := i.onChange
+	i.mu.Unlock()
+
+	i.logger.Info().
+		Str("codec", params.Codec).
+		Int("width", params.Width).
+		Int("height", params.Height).
+		Float64("fps", params.FPS).
+		Int("profile", params.Profile).
+		Int("level", params.Level).
+		Int("bit_depth", params.BitDepth).
+		Str("fmtp", params.Fmtp).
+		Msg("Stream parameters")
+
+	mismatches := params.Mismatches(expected.VideoWidth, expected.VideoHeight, float64(expected.VideoFPS))
+	if expected.VideoCodec != "" && expected.VideoCodec != params.Codec {
+		mismatches = append(mismatches, "codec "+params.Codec+", declared "+expected.VideoCodec)
+	}
+	if params.Codec == "h264" && params.BitDepth > 8 {
+		mismatches = append(mismatches, fmt.Sprintf("%d-bit H.264, which browsers cannot decode", params.BitDepth))
+	}
+	if len(mismatches) > 0 {
+		i.mismatches.Add(1)
+		i.logger.Warn().Strs("mismatches", mismatches).Msg("Stream does not match declared parameters")
+	}
+
+	if fn != nil {
+		fn(params)
+	}
+}
+
+// observeColor records the keyframe's color space and HDR metadata,
+// calling back when either changed
+func (i *StreamInspector) observeColor(frame VideoFrame) {
+	i.mu.Lock()
+	changed := !equalPtr(i.color, frame.Color) || !equalPtr(i.hdr, frame.HDR)
+	i.color, i.hdr = frame.Color, frame.HDR
+	fn := i.onColor
+	i.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	i.logger.Info().Interface("color", frame.Color).Interface("hdr", frame.HDR).Msg("Stream color space")
+	if fn != nil {
+		fn(frame.Color, frame.HDR)
+	}
+}
+
+// equalPtr compares what two pointers point to; nil equals only nil
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// rotated reports a change of display rotation
+func (i *StreamInspector) rotated(rotation int) {
+	i.mu.Lock()
+	fn := i.onRotate
+	i.mu.Unlock()
+
+	i.logger.Info().Int("rotation", rotation).Msg("Stream display rotation")
+	if fn != nil {
+		fn(rotation)
+	}
+}
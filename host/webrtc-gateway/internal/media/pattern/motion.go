@@ -0,0 +1,125 @@
+package pattern
+
+import (
+	"image"
+	"time"
+)
+
+// Motion patterns exercise encoders and rate control with content that
+// changes every frame, unlike the static color bars.
+
+type bouncePattern struct{}
+
+// NewBounce returns a ball bouncing around the frame over a colored backdrop
+func NewBounce() Pattern {
+	return bouncePattern{}
+}
+
+func (bouncePattern) Name() string {
+	return "bounce"
+}
+
+func (bouncePattern) Render(img *image.YCbCr, n uint64, now time.Time) {
+	Fill(img, RGB(20, 40, 90))
+
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	radius := max(4, h/12)
+	speed := max(2, h/90)
+
+	// Position follows a triangle wave on each axis, so it is a pure
+	// function of the frame number
+	x := img.Rect.Min.X + radius + triangle(int(n)*speed, w-2*radius)
+	y := img.Rect.Min.Y + radius + triangle(int(n)*speed*3/4, h-2*radius)
+
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			if dx*dx+dy*dy > radius*radius {
+				continue
+			}
+			FillRect(img, image.Rect(x+dx, y+dy, x+dx+1, y+dy+1), RGB(250, 200, 30))
+		}
+	}
+}
+
+// triangle maps t onto 0..span..0 repeatedly
+func triangle(t, span int) int {
+	if span <= 0 {
+		return 0
+	}
+	t %= 2 * span
+	if t > span {
+		return 2*span - t
+	}
+	return t
+}
+
+type checkerboardPattern struct{}
+
+// NewCheckerboard returns a checkerboard scrolling diagonally
+func NewCheckerboard() Pattern {
+	return checkerboardPattern{}
+}
+
+func (checkerboardPattern) Name() string {
+	return "checkerboard"
+}
+
+func (checkerboardPattern) Render(img *image.YCbCr, n uint64, now time.Time) {
+	size := max(2, img.Rect.Dy()/9)
+	light, dark := RGB(230, 230, 230), RGB(30, 30, 30)
+
+	// The board repeats every two squares, so shifting modulo 2*size keeps
+	// square colors stable while scrolling
+	shift := int(n) * max(1, size/16) % (2 * size)
+
+	for row := 0; ; row++ {
+		y := img.Rect.Min.Y - 2*size + shift + row*size
+		if y >= img.Rect.Max.Y {
+			break
+		}
+		for col := 0; ; col++ {
+			x := img.Rect.Min.X - 2*size + shift + col*size
+			if x >= img.Rect.Max.X {
+				break
+			}
+			c := dark
+			if (row+col)%2 == 0 {
+				c = light
+			}
+			FillRect(img, image.Rect(x, y, x+size, y+size), c)
+		}
+	}
+}
+
+type noisePattern struct {
+	state uint64
+}
+
+// NewNoise returns full-frame random noise, the worst case for any encoder
+func NewNoise() Pattern {
+	return &noisePattern{state: 0x9E3779B97F4A7C15}
+}
+
+func (*noisePattern) Name() string {
+	return "noise"
+}
+
+func (p *noisePattern) Render(img *image.YCbCr, n uint64, now time.Time) {
+	for _, plane := range [][]byte{img.Y, img.Cb, img.Cr} {
+		for i := 0; i < len(plane); i += 8 {
+			v := p.next()
+			for j := 0; j < 8 && i+j < len(plane); j++ {
+				// Keep samples within limited range
+				plane[i+j] = 16 + uint8(v>>(j*8))%220
+			}
+		}
+	}
+}
+
+// next advances a xorshift64 generator
+func (p *noisePattern) next() uint64 {
+	p.state ^= p.state << 13
+	p.state ^= p.state >> 7
+	p.state ^= p.state << 17
+	return p.state
+}
@@ -0,0 +1,67 @@
+// Package pattern renders raw synthetic test patterns and encodes them into a
+// video source, for testing the gateway and clients without capture hardware.
+package pattern
+
+import (
+	"image"
+	"time"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/encoder"
+)
+
+// Pattern renders one frame of a test pattern into a 4:2:0 picture
+type Pattern interface {
+	// Name returns the pattern's registered name
+	Name() string
+
+	// Render draws frame number n, rendered at wall-clock time now
+	Render(img *image.YCbCr, n uint64, now time.Time)
+}
+
+// Color is a limited-range BT.601 YCbCr color
+type Color struct {
+	Y, Cb, Cr uint8
+}
+
+// RGB returns the YCbCr color for an 8-bit RGB triple
+func RGB(r, g, b uint8) Color {
+	y, cb, cr := encoder.RGBToYCbCr(r, g, b)
+	return Color{Y: y, Cb: cb, Cr: cr}
+}
+
+// Common colors
+var (
+	Black = RGB(0, 0, 0)
+	White = RGB(255, 255, 255)
+	Gray  = RGB(64, 64, 64)
+	Red   = RGB(220, 30, 30)
+)
+
+// Fill paints the whole picture with a color
+func Fill(img *image.YCbCr, c Color) {
+	FillRect(img, img.Rect, c)
+}
+
+// FillRect paints a rectangle, clipped to the picture
+func FillRect(img *image.YCbCr, r image.Rectangle, c Color) {
+	r = r.Intersect(img.Rect)
+	if r.Empty() {
+		return
+	}
+
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := img.Y[img.YOffset(r.Min.X, y) : img.YOffset(r.Max.X-1, y)+1]
+		for i := range row {
+			row[i] = c.Y
+		}
+	}
+
+	// Chroma covers 2x2 luma blocks; paint every block the rectangle touches
+	for y := r.Min.Y &^ 1; y < r.Max.Y; y += 2 {
+		for x := r.Min.X &^ 1; x < r.Max.X; x += 2 {
+			o := img.COffset(max(x, img.Rect.Min.X), max(y, img.Rect.Min.Y))
+			img.Cb[o] = c.Cb
+			img.Cr[o] = c.Cr
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package pattern
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Factory creates a new instance of a pattern
+type Factory func() Pattern
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+func init() {
+	Register("timestamp", NewTimestamp)
+	Register("bounce", NewBounce)
+	Register("checkerboard", NewCheckerboard)
+	Register("noise", NewNoise)
+}
+
+// Register makes a pattern available by name, replacing any existing pattern
+// with the same name. Custom patterns can be registered from init functions.
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[name] = factory
+}
+
+// New creates a registered pattern by name
+func New(name string) (Pattern, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown pattern %q (have %v)", name, Names())
+	}
+	return factory(), nil
+}
+
+// Names returns all registered pattern names
+func Names() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,83 @@
+package pattern
+
+import (
+	"fmt"
+	"image"
+	"time"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/encoder"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+type slatePattern struct {
+	text string
+}
+
+// NewSlate returns a static card with centered text, shown to viewers in
+// place of live video (e.g. "PAUSED")
+func NewSlate(text string) Pattern {
+	return slatePattern{text: text}
+}
+
+func (slatePattern) Name() string {
+	return "slate"
+}
+
+func (p slatePattern) Render(img *image.YCbCr, n uint64, now time.Time) {
+	Fill(img, RGB(16, 16, 24))
+
+	// Text spans roughly half the picture width
+	scale := max(1, img.Rect.Dx()/2/max(1, TextSize(p.text, 1).X))
+	center := image.Pt(img.Rect.Min.X+img.Rect.Dx()/2, img.Rect.Min.Y+img.Rect.Dy()/2)
+	DrawTextCentered(img, center, scale, p.text, White)
+
+	// Thin accent bar under the text
+	barY := center.Y + TextSize(p.text, scale).Y
+	FillRect(img, image.Rect(img.Rect.Min.X+img.Rect.Dx()/4, barY, img.Rect.Max.X-img.Rect.Dx()/4, barY+max(2, scale/2)), Red)
+}
+
+// EncodeStill renders a pattern and encodes it into count consecutive
+// keyframes. Repeating a single IDR is not valid H.264 (consecutive IDRs must
+// differ in idr_pic_id), so callers that loop a still cycle through the
+// returned frames instead.
+func EncodeStill(p Pattern, cfg encoder.Config, count int) ([]media.VideoFrame, error) {
+	if cfg.FrameRate <= 0 {
+		cfg.FrameRate = 1
+	}
+
+	enc, err := encoder.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encoder: %w", err)
+	}
+	defer enc.Close()
+
+	img := image.NewYCbCr(image.Rect(0, 0, cfg.Width, cfg.Height), image.YCbCrSubsampleRatio420)
+	now := time.Now()
+	p.Render(img, 0, now)
+
+	frameDuration := time.Second / time.Duration(cfg.FrameRate)
+	frames := make([]media.VideoFrame, 0, count)
+	for i := 0; i < count; i++ {
+		enc.ForceKeyframe()
+		encoded, err := enc.Encode(img, int64(i)*frameDuration.Nanoseconds())
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode still: %w", err)
+		}
+		if len(encoded.Data) == 0 {
+			return nil, fmt.Errorf("encoder %s produced no output", enc.Name())
+		}
+
+		frames = append(frames, media.VideoFrame{
+			PTS:        encoded.PTS,
+			DTS:        encoded.PTS,
+			IsKeyframe: true,
+			Width:      cfg.Width,
+			Height:     cfg.Height,
+			Codec:      "h264",
+			Data:       encoded.Data,
+			ReceivedAt: now,
+		})
+	}
+
+	return frames, nil
+}
@@ -0,0 +1,214 @@
+package pattern
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/encoder"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// SourceConfig configures a pattern source
+type SourceConfig struct {
+	Width           int
+	Height          int
+	FrameRate       int
+	VideoBufferSize int            // Output channel buffer size, default 30
+	Encoder         encoder.Config // Size and frame rate are filled in from above
+
+	// Budget, when set, times rendering and encoding as the
+	// "pattern.render" and "pattern.encode" stages
+	Budget *media.FrameBudget
+}
+
+// Source renders a pattern at a fixed frame rate, encodes it, and delivers
+// the result as a media.FrameSource
+type Source struct {
+	cfg      SourceConfig
+	pattern  Pattern
+	logger   zerolog.Logger
+	warnings *logging.Summarizer // Rate-limits per-frame warnings
+
+	videoFrames chan media.VideoFrame
+
+	mu      sync.Mutex
+	enc     encoder.Encoder
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	// Frame budget stages; nil without a budget
+	renderStage *media.BudgetStage
+	encodeStage *media.BudgetStage
+
+	// Statistics
+	frameCount atomic.Uint64
+	dropCount  atomic.Uint64
+}
+
+// NewSource creates a pattern source; the encoder is created on Start
+func NewSource(cfg SourceConfig, p Pattern, logger zerolog.Logger) *Source {
+	// Apply defaults for zero values
+	if cfg.FrameRate <= 0 {
+		cfg.FrameRate = 30
+	}
+	if cfg.VideoBufferSize <= 0 {
+		cfg.VideoBufferSize = 30
+	}
+
+	logger = logger.With().Str("component", "pattern_source").Str("pattern", p.Name()).Logger()
+	return &Source{
+		cfg:         cfg,
+		pattern:     p,
+		logger:      logger,
+		warnings:    logging.NewSummarizer(logger),
+		videoFrames: make(chan media.VideoFrame, cfg.VideoBufferSize),
+		renderStage: cfg.Budget.Stage("pattern.render"),
+		encodeStage: cfg.Budget.Stage("pattern.encode"),
+	}
+}
+
+// Start creates the encoder and begins rendering
+func (s *Source) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return errors.New("pattern source already started")
+	}
+
+	encCfg := s.cfg.Encoder
+	encCfg.Width = s.cfg.Width
+	encCfg.Height = s.cfg.Height
+	encCfg.FrameRate = s.cfg.FrameRate
+	enc, err := encoder.New(encCfg)
+	if err != nil {
+		return fmt.Errorf("failed to create encoder: %w", err)
+	}
+	s.enc = enc
+
+	runCtx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.running = true
+
+	go s.renderLoop(runCtx)
+
+	s.logger.Info().
+		Int("width", s.cfg.Width).
+		Int("height", s.cfg.Height).
+		Int("fps", s.cfg.FrameRate).
+		Str("encoder", enc.Name()).
+		Msg("Pattern source started")
+
+	return nil
+}
+
+// Stop stops rendering and closes the encoder
+func (s *Source) Stop() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	s.running = false
+	s.cancel()
+	done := s.done
+	s.mu.Unlock()
+
+	<-done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.enc.Close()
+	s.enc = nil
+
+	s.logger.Info().
+		Uint64("frames", s.frameCount.Load()).
+		Uint64("dropped", s.dropCount.Load()).
+		Msg("Pattern source stopped")
+
+	return err
+}
+
+// VideoFrameChannel returns the channel for receiving encoded frames
+func (s *Source) VideoFrameChannel() <-chan media.VideoFrame {
+	return s.videoFrames
+}
+
+// ForceKeyframe makes the next encoded frame an IDR
+func (s *Source) ForceKeyframe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.enc != nil {
+		s.enc.ForceKeyframe()
+	}
+}
+
+// Stats returns rendered and dropped frame counts
+func (s *Source) Stats() (frames, dropped uint64) {
+	return s.frameCount.Load(), s.dropCount.Load()
+}
+
+// renderLoop renders, encodes and forwards one frame per tick
+func (s *Source) renderLoop(ctx context.Context) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(time.Second / time.Duration(s.cfg.FrameRate))
+	defer ticker.Stop()
+
+	img := image.NewYCbCr(image.Rect(0, 0, s.cfg.Width, s.cfg.Height), image.YCbCrSubsampleRatio420)
+	start := time.Now()
+
+	for n := uint64(0); ; n++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		began := s.renderStage.Begin()
+		s.pattern.Render(img, n, now)
+		s.renderStage.End(began)
+
+		began = s.encodeStage.Begin()
+		encoded, err := s.enc.Encode(img, now.Sub(start).Nanoseconds())
+		s.encodeStage.End(began)
+		if err != nil {
+			s.warnings.Warn("Failed to encode pattern frame", func(e *zerolog.Event) { e.Err(err) })
+			continue
+		}
+		if len(encoded.Data) == 0 {
+			continue
+		}
+
+		frame := media.VideoFrame{
+			PTS:        encoded.PTS,
+			DTS:        encoded.PTS,
+			IsKeyframe: encoded.IsKeyframe,
+			Width:      s.cfg.Width,
+			Height:     s.cfg.Height,
+			Codec:      "h264",
+			Data:       encoded.Data,
+			ReceivedAt: now,
+		}
+
+		select {
+		case s.videoFrames <- frame:
+			s.frameCount.Add(1)
+		default:
+			s.dropCount.Add(1)
+			s.warnings.Warn("Video frame channel full, dropping frame", nil)
+		}
+	}
+}
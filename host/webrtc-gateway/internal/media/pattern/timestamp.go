@@ -0,0 +1,168 @@
+package pattern
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"time"
+)
+
+// The timestamp pattern burns a machine-readable code block into the top-left
+// corner: 16x7 black/white cells carrying the frame counter, the render time
+// in Unix microseconds, and a CRC-16. Cell geometry is proportional to picture
+// height, so the code survives client-side scaling.
+const (
+	stampColumns = 16
+	stampRows    = 7
+	stampBytes   = stampColumns * stampRows / 8 // 4 frame + 8 time + 2 CRC
+)
+
+// ErrNoStamp is returned when a picture carries no valid timestamp code
+var ErrNoStamp = errors.New("no valid timestamp code found")
+
+// Stamp is the data carried by each timestamp-pattern frame
+type Stamp struct {
+	Frame uint32    // Frame counter, wraps at 2^32
+	Time  time.Time // Wall-clock render time, microsecond precision
+}
+
+// Latency returns the glass-to-glass latency if now is the display time.
+// Producer and client clocks must be synchronized (same host or NTP).
+func (s Stamp) Latency(now time.Time) time.Duration {
+	return now.Sub(s.Time)
+}
+
+type timestampPattern struct{}
+
+// NewTimestamp returns the timestamp/latency test pattern
+func NewTimestamp() Pattern {
+	return timestampPattern{}
+}
+
+func (timestampPattern) Name() string {
+	return "timestamp"
+}
+
+func (timestampPattern) Render(img *image.YCbCr, n uint64, now time.Time) {
+	Fill(img, Gray)
+
+	x0, y0, cell := stampGeometry(img.Rect)
+	payload := encodeStamp(Stamp{Frame: uint32(n), Time: now})
+
+	// White border so the code block stands out from the background
+	border := cell / 2
+	FillRect(img, image.Rect(
+		int(math.Round(x0-border)), int(math.Round(y0-border)),
+		int(math.Round(x0+stampColumns*cell+border)), int(math.Round(y0+stampRows*cell+border)),
+	), White)
+
+	for bit := 0; bit < stampBytes*8; bit++ {
+		c := Black
+		if payload[bit/8]&(0x80>>(bit%8)) != 0 {
+			c = White
+		}
+		FillRect(img, cellRect(x0, y0, cell, bit%stampColumns, bit/stampColumns), c)
+	}
+
+	// Human-readable copy of the stamp below the code block
+	scale := max(1, int(cell/4))
+	textY := int(y0 + (stampRows+1)*cell)
+	DrawText(img, image.Pt(int(x0), textY), scale, fmt.Sprintf("FRAME %010d", uint32(n)), White)
+	DrawText(img, image.Pt(int(x0), textY+(glyphHeight+3)*scale), scale, now.Format("15:04:05.000000"), White)
+
+	// Frame-drop indicator: one of ten boxes lit per frame
+	boxY := textY + 2*(glyphHeight+3)*scale
+	boxSize := max(2, int(cell))
+	for i := 0; i < 10; i++ {
+		c := Black
+		if uint64(i) == n%10 {
+			c = Red
+		}
+		x := int(x0) + i*(boxSize+boxSize/2)
+		FillRect(img, image.Rect(x, boxY, x+boxSize, boxY+boxSize), c)
+	}
+
+	// Moving bar so motion and dropped frames are visible to the eye
+	barWidth := max(2, int(cell))
+	barX := img.Rect.Min.X + int(n*uint64(barWidth/2+1))%max(1, img.Rect.Dx()-barWidth)
+	FillRect(img, image.Rect(barX, boxY+int(2*cell), barX+barWidth, img.Rect.Max.Y), White)
+}
+
+// DecodeStamp reads the timestamp code back from a decoded picture
+func DecodeStamp(img *image.YCbCr) (Stamp, error) {
+	x0, y0, cell := stampGeometry(img.Rect)
+	if cell < 2 {
+		return Stamp{}, ErrNoStamp
+	}
+
+	var payload [stampBytes]byte
+	for bit := 0; bit < stampBytes*8; bit++ {
+		r := cellRect(x0, y0, cell, bit%stampColumns, bit/stampColumns)
+
+		// Sample the center half of the cell to avoid edge ringing
+		inset := r.Inset(max(1, r.Dx()/4))
+		if inset.Empty() {
+			inset = r
+		}
+		var sum, count int
+		for y := inset.Min.Y; y < inset.Max.Y; y++ {
+			for x := inset.Min.X; x < inset.Max.X; x++ {
+				sum += int(img.Y[img.YOffset(x, y)])
+				count++
+			}
+		}
+		if count > 0 && sum/count > int(Black.Y+White.Y)/2 {
+			payload[bit/8] |= 0x80 >> (bit % 8)
+		}
+	}
+
+	if binary.BigEndian.Uint16(payload[12:14]) != crc16(payload[:12]) {
+		return Stamp{}, ErrNoStamp
+	}
+
+	return Stamp{
+		Frame: binary.BigEndian.Uint32(payload[0:4]),
+		Time:  time.UnixMicro(int64(binary.BigEndian.Uint64(payload[4:12]))),
+	}, nil
+}
+
+// stampGeometry returns the code block origin and cell size for a picture
+func stampGeometry(bounds image.Rectangle) (x0, y0, cell float64) {
+	cell = float64(bounds.Dy()) / 40
+	return float64(bounds.Min.X) + 2*cell, float64(bounds.Min.Y) + 2*cell, cell
+}
+
+// cellRect returns the pixel rectangle of the cell at (col, row)
+func cellRect(x0, y0, cell float64, col, row int) image.Rectangle {
+	return image.Rect(
+		int(math.Round(x0+float64(col)*cell)), int(math.Round(y0+float64(row)*cell)),
+		int(math.Round(x0+float64(col+1)*cell)), int(math.Round(y0+float64(row+1)*cell)),
+	)
+}
+
+// encodeStamp serializes a stamp with its CRC
+func encodeStamp(s Stamp) [stampBytes]byte {
+	var b [stampBytes]byte
+	binary.BigEndian.PutUint32(b[0:4], s.Frame)
+	binary.BigEndian.PutUint64(b[4:12], uint64(s.Time.UnixMicro()))
+	binary.BigEndian.PutUint16(b[12:14], crc16(b[:12]))
+	return b
+}
+
+// crc16 computes CRC-16/CCITT-FALSE
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package media
+
+import (
+	"errors"
+	"net"
+)
+
+// listenPipe fails; named pipes are a Windows feature
+func listenPipe(path string) (net.Listener, error) {
+	return nil, errors.New("named pipes are only supported on Windows")
+}
@@ -0,0 +1,333 @@
+//go:build windows
+
+package media
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// pipeSDDL limits the pipe to the gateway's user, SYSTEM and
+// administrators, as a Unix socket is limited to its owner
+const pipeSDDL = "D:P(A;;GA;;;OW)(A;;GA;;;SY)(A;;GA;;;BA)"
+
+// pipeBufferSize is the kernel buffer of each pipe direction
+const pipeBufferSize = 64 << 10
+
+// pipeAddr is the address of a named pipe
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// createPipe creates an instance of the pipe at path for one client. The
+// first instance claims the name, so a second gateway fails to listen
+// instead of sharing it.
+func createPipe(path string, first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	sd, err := windows.SecurityDescriptorFromString(pipeSDDL)
+	if err != nil {
+		return 0, err
+	}
+	sa := &windows.SecurityAttributes{
+		Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+		SecurityDescriptor: sd,
+	}
+
+	mode := uint32(windows.PIPE_ACCESS_DUPLEX | windows.FILE_FLAG_OVERLAPPED)
+	if first {
+		mode |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	return windows.CreateNamedPipe(name, mode,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES, pipeBufferSize, pipeBufferSize, 0, sa)
+}
+
+// pipeListener accepts producers on a named pipe. Each client connects to
+// its own pipe instance; the next is created as soon as one is taken.
+type pipeListener struct {
+	path     string
+	acceptMu sync.Mutex // Serializes Accept
+
+	mu     sync.Mutex
+	h      windows.Handle // Instance waiting for the next client; 0 if none
+	ev     windows.Handle // Signals the pending connect
+	o      windows.Overlapped
+	closed bool
+}
+
+// listenPipe creates the pipe at path
+func listenPipe(path string) (net.Listener, error) {
+	h, err := createPipe(path, true)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	return &pipeListener{path: path, h: h, ev: ev}, nil
+}
+
+// Accept waits for a client to open the pipe
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.acceptMu.Lock()
+	defer l.acceptMu.Unlock()
+
+	for {
+		// The connect is issued under mu, so Close either sees it pending
+		// and cancels it, or comes first
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		if l.h == 0 {
+			h, err := createPipe(l.path, false)
+			if err != nil {
+				l.mu.Unlock()
+				return nil, err
+			}
+			l.h = h
+		}
+		h := l.h
+		l.o = windows.Overlapped{HEvent: l.ev}
+		err := windows.ConnectNamedPipe(h, &l.o)
+		l.mu.Unlock()
+
+		if err == windows.ERROR_IO_PENDING {
+			var n uint32
+			err = windows.GetOverlappedResult(h, &l.o, &n, true)
+		}
+		switch err {
+		case nil, windows.ERROR_PIPE_CONNECTED:
+		case windows.ERROR_NO_DATA:
+			// The client left before it was accepted; reuse the instance
+			windows.DisconnectNamedPipe(h)
+			continue
+		default:
+			if l.isClosed() {
+				return nil, net.ErrClosed
+			}
+			return nil, &net.OpError{Op: "accept", Net: "pipe", Addr: l.Addr(), Err: os.NewSyscallError("ConnectNamedPipe", err)}
+		}
+
+		// Have the next instance ready; on failure the next Accept retries
+		next, err := createPipe(l.path, false)
+		if err != nil {
+			next = 0
+		}
+		l.mu.Lock()
+		closed := l.closed
+		l.h = next
+		l.mu.Unlock()
+		if closed {
+			windows.CloseHandle(h)
+			return nil, net.ErrClosed
+		}
+
+		conn, err := newPipeConn(h, l.path)
+		if err != nil {
+			windows.CloseHandle(h)
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// isClosed reports whether Close was called
+func (l *pipeListener) isClosed() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.closed
+}
+
+// Close stops accepting; connected clients are unaffected
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return net.ErrClosed
+	}
+	l.closed = true
+	if l.h != 0 {
+		windows.CancelIoEx(l.h, &l.o)
+	}
+	l.mu.Unlock()
+
+	// Wait for a cancelled Accept before freeing its handles
+	l.acceptMu.Lock()
+	defer l.acceptMu.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.h != 0 {
+		windows.CloseHandle(l.h)
+		l.h = 0
+	}
+	return windows.CloseHandle(l.ev)
+}
+
+// Addr returns the pipe path
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr(l.path)
+}
+
+// pipeIO is one direction of a pipeConn
+type pipeIO struct {
+	mu       sync.Mutex // One operation at a time
+	o        windows.Overlapped
+	ev       windows.Handle
+	deadline atomic.Int64 // Unix nanoseconds; 0 for none
+}
+
+// pipeConn is a connected named pipe. Reads and writes are overlapped, so
+// they run concurrently, and each waits at most until the deadline set
+// when it starts.
+type pipeConn struct {
+	h      windows.Handle
+	addr   pipeAddr
+	rd     pipeIO
+	wr     pipeIO
+	closed atomic.Bool
+}
+
+// newPipeConn wraps a connected pipe handle
+func newPipeConn(h windows.Handle, path string) (*pipeConn, error) {
+	c := &pipeConn{h: h, addr: pipeAddr(path)}
+	var err error
+	if c.rd.ev, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+		return nil, err
+	}
+	if c.wr.ev, err = windows.CreateEvent(nil, 1, 0, nil); err != nil {
+		windows.CloseHandle(c.rd.ev)
+		return nil, err
+	}
+	return c, nil
+}
+
+// do runs one overlapped read or write
+func (c *pipeConn) do(op *pipeIO, b []byte, f func(windows.Handle, []byte, *uint32, *windows.Overlapped) error) (int, error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if c.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	wait := uint32(windows.INFINITE)
+	if d := op.deadline.Load(); d != 0 {
+		left := time.Until(time.Unix(0, d))
+		if left <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		wait = uint32(min(left.Milliseconds()+1, windows.INFINITE-1))
+	}
+
+	op.o = windows.Overlapped{HEvent: op.ev}
+	var n uint32
+	err := f(c.h, b, &n, &op.o)
+	timedOut := false
+	if err == windows.ERROR_IO_PENDING {
+		// Close may have missed this operation when it cancelled
+		if c.closed.Load() {
+			windows.CancelIoEx(c.h, &op.o)
+		}
+		if ev, _ := windows.WaitForSingleObject(op.ev, wait); ev == uint32(windows.WAIT_TIMEOUT) {
+			windows.CancelIoEx(c.h, &op.o)
+			timedOut = true
+		}
+		err = windows.GetOverlappedResult(c.h, &op.o, &n, true)
+	}
+	switch {
+	case err == nil:
+		return int(n), nil
+	case err == windows.ERROR_OPERATION_ABORTED && c.closed.Load():
+		return int(n), net.ErrClosed
+	case err == windows.ERROR_OPERATION_ABORTED && timedOut:
+		return int(n), os.ErrDeadlineExceeded
+	default:
+		return int(n), err
+	}
+}
+
+// Read reads from the pipe; a closed client end reads as io.EOF
+func (c *pipeConn) Read(b []byte) (int, error) {
+	n, err := c.do(&c.rd, b, windows.ReadFile)
+	switch {
+	case err == windows.ERROR_BROKEN_PIPE || err == windows.ERROR_PIPE_NOT_CONNECTED:
+		return n, io.EOF
+	case err == nil && n == 0 && len(b) > 0:
+		return 0, io.EOF
+	case err != nil && err != net.ErrClosed && err != os.ErrDeadlineExceeded:
+		return n, os.NewSyscallError("ReadFile", err)
+	}
+	return n, err
+}
+
+// Write writes all of b to the pipe
+func (c *pipeConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := c.do(&c.wr, b[written:], windows.WriteFile)
+		written += n
+		if err != nil {
+			if err != net.ErrClosed && err != os.ErrDeadlineExceeded {
+				err = os.NewSyscallError("WriteFile", err)
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close closes the pipe, cancelling pending reads and writes
+func (c *pipeConn) Close() error {
+	if !c.closed.CompareAndSwap(false, true) {
+		return net.ErrClosed
+	}
+	windows.CancelIoEx(c.h, nil)
+
+	// Wait for cancelled operations before freeing their handles
+	c.rd.mu.Lock()
+	defer c.rd.mu.Unlock()
+	c.wr.mu.Lock()
+	defer c.wr.mu.Unlock()
+	windows.CloseHandle(c.rd.ev)
+	windows.CloseHandle(c.wr.ev)
+	return windows.CloseHandle(c.h)
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.addr }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.rd.deadline.Store(deadlineNanos(t))
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.wr.deadline.Store(deadlineNanos(t))
+	return nil
+}
+
+// deadlineNanos converts a deadline for pipeIO; the zero time is none
+func deadlineNanos(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
@@ -0,0 +1,145 @@
+package media
+
+import (
+	"sync"
+	"time"
+)
+
+// StageStats are the counters of one pipeline stage
+type StageStats struct {
+	Frames         uint64  `json:"frames"`
+	Dropped        uint64  `json:"dropped"`
+	QueueDepth     int     `json:"queue_depth"`
+	QueueCapacity  int     `json:"queue_capacity,omitempty"`
+	LastFrameAgeMs int64   `json:"last_frame_age_ms"` // -1 before the first frame
+	FPS            float64 `json:"fps"`               // Frames actually received per second
+	BitrateKbps    float64 `json:"bitrate_kbps"`
+
+	// NominalFPS is the frame rate the producer declared or the parameter
+	// sets signal; 0 when unknown. VariableFrameRate is set when frame
+	// timestamps are irregular beyond capture jitter, as when a game only
+	// presents frames that changed, so FPS falls below NominalFPS by design.
+	NominalFPS        float64 `json:"nominal_fps,omitempty"`
+	VariableFrameRate bool    `json:"variable_frame_rate,omitempty"`
+
+	// Duplicated counts repeated pictures inserted to keep the frame rate
+	// up to a configured minimum
+	Duplicated uint64 `json:"duplicated,omitempty"`
+
+	// Frames the producer numbered but never delivered, and frames that
+	// failed their checksum; only for producers that send them
+	ProducerDropped uint64 `json:"producer_dropped,omitempty"`
+	Corrupted       uint64 `json:"corrupted,omitempty"`
+
+	// Pressure is set while the stage's queue is under sustained pressure
+	Pressure *BufferPressure `json:"pressure,omitempty"`
+}
+
+// PipelineStats are per-stage counters from the producer to peers, for the
+// health status, metrics and the admin dashboard
+type PipelineStats struct {
+	Video        StageStats  `json:"video"`           // Video received from the source
+	Audio        *StageStats `json:"audio,omitempty"` // Audio received, for sources that carry it
+	Distribution StageStats  `json:"distribution"`    // Live video written to peers
+}
+
+// rateWindow is the number of whole seconds rates are averaged over
+const rateWindow = 5
+
+// rateBucket counts the frames of one second
+type rateBucket struct {
+	second int64
+	frames uint64
+	bytes  uint64
+}
+
+// rateMeter measures frame rate and bitrate over the last few seconds
+type rateMeter struct {
+	mu      sync.Mutex
+	buckets [rateWindow + 1]rateBucket // The current second and the window
+	last    time.Time
+}
+
+// add counts a frame of size bytes
+func (m *rateMeter) add(now time.Time, bytes int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sec := now.Unix()
+	b := &m.buckets[sec%int64(len(m.buckets))]
+	if b.second != sec {
+		*b = rateBucket{second: sec}
+	}
+	b.frames++
+	b.bytes += uint64(bytes)
+	m.last = now
+}
+
+// fill sets the rates and last frame age of s
+func (m *rateMeter) fill(s *StageStats, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sec := now.Unix()
+	var frames, bytes uint64
+	for _, b := range m.buckets {
+		if b.second < sec && b.second >= sec-rateWindow {
+			frames += b.frames
+			bytes += b.bytes
+		}
+	}
+	s.FPS = float64(frames) / rateWindow
+	s.BitrateKbps = float64(bytes) * 8 / 1000 / rateWindow
+	s.LastFrameAgeMs = -1
+	if !m.last.IsZero() {
+		s.LastFrameAgeMs = now.Sub(m.last).Milliseconds()
+	}
+}
+
+// Frame timing tracking: gaps are averaged over about timingWindow frames,
+// and the rate counts as variable once the gaps' mean deviation exceeds
+// variableDeviation of their mean. Gaps over timingMaxGap are outages.
+const (
+	timingWindow      = 32
+	variableDeviation = 0.25
+	timingMaxGap      = 5 * time.Second
+)
+
+// frameTiming tells a variable frame rate from a constant one with capture
+// jitter, from the PTS gaps between frames
+type frameTiming struct {
+	mu      sync.Mutex
+	lastPTS int64
+	frames  int     // Gaps averaged, up to timingWindow
+	mean    float64 // Moving average of the gap, in nanoseconds
+	dev     float64 // Moving average of the gap's absolute deviation
+}
+
+// add records a frame. Discontinuities and outages are not frame timing,
+// and are skipped.
+func (t *frameTiming) add(frame VideoFrame) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	gap := frame.PTS - t.lastPTS
+	valid := t.lastPTS != 0 && !frame.Discontinuity && gap > 0 && gap <= int64(timingMaxGap)
+	t.lastPTS = frame.PTS
+	if !valid {
+		return
+	}
+
+	if t.frames < timingWindow {
+		t.frames++
+	}
+	weight := 1 / float64(t.frames)
+	t.mean += (float64(gap) - t.mean) * weight
+	deviation := float64(gap) - t.mean
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	t.dev += (deviation - t.dev) * weight
+}
+
+// fill sets VariableFrameRate of s once enough gaps have been seen
+func (t *frameTiming) fill(s *StageStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s.VariableFrameRate = t.frames >= timingWindow && t.dev > t.mean*variableDeviation
+}
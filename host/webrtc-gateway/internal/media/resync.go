@@ -0,0 +1,118 @@
+package media
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxMessageSize is the largest IPC message accepted
+const maxMessageSize = 100 * 1024 * 1024
+
+// ipcReadBuffer is the read buffer of a producer connection. A message's
+// JSON header must fit in it to be checked during a resync.
+const ipcReadBuffer = 64 << 10
+
+// maxResyncBytes is how far the consumer scans for the next message after
+// corruption before giving up on the producer
+const maxResyncBytes = 16 << 20
+
+// errCorruptMessage marks bytes that cannot be the start of a message
+var errCorruptMessage = errors.New("corrupt IPC message")
+
+// ResyncStats count recoveries from a corrupted producer stream
+type ResyncStats struct {
+	Resyncs      uint64     `json:"resyncs"`
+	SkippedBytes uint64     `json:"skipped_bytes"`
+	LastAt       *time.Time `json:"last_at,omitempty"`
+	LastSkipped  int        `json:"last_skipped,omitempty"`
+}
+
+// resyncState accumulates ResyncStats
+type resyncState struct {
+	mu    sync.Mutex
+	stats ResyncStats
+}
+
+// checkHeader reports whether the message at the head of r looks valid: a
+// type in the message range, a plausible length, and a JSON object header
+// that parses. Where the header is not yet buffered, it waits for it.
+func (c *IPCConsumer) checkHeader(r *bufio.Reader) (bool, error) {
+	b, err := r.Peek(6)
+	if err != nil {
+		return false, err
+	}
+	t, n := b[0], binary.BigEndian.Uint32(b[1:5])
+	if t == 0 || t >= 0x40 || n < 2 || n > maxMessageSize || b[5] != '{' {
+		return false, nil
+	}
+
+	b, err = r.Peek(min(5+int(n), r.Size()))
+	if err != nil {
+		return false, err
+	}
+	end := c.findJSONEnd(b[5:])
+	return end > 0 && json.Valid(b[5:5+end]), nil
+}
+
+// resync skips bytes until a valid message starts, and reports the
+// corruption. It gives up, ending the connection, after maxResyncBytes.
+func (c *IPCConsumer) resync(conn net.Conn, r *bufio.Reader, cause error) error {
+	skipped := 0
+	for skipped < maxResyncBytes {
+		// Garbage may keep arriving; only a stalled producer times out
+		if r.Buffered() == 0 {
+			if err := conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+				return err
+			}
+		}
+		if _, err := r.Discard(1); err != nil {
+			return err
+		}
+		skipped++
+
+		ok, err := c.checkHeader(r)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+
+		now := time.Now()
+		c.resyncs.mu.Lock()
+		c.resyncs.stats.Resyncs++
+		c.resyncs.stats.SkippedBytes += uint64(skipped)
+		c.resyncs.stats.LastAt = &now
+		c.resyncs.stats.LastSkipped = skipped
+		c.resyncs.mu.Unlock()
+
+		c.logger.Warn().
+			Err(cause).
+			Int("skipped_bytes", skipped).
+			Msg("IPC stream corrupted, resynchronized at the next message")
+		select {
+		case c.errors <- fmt.Errorf("stream corrupted, skipped %d bytes: %w", skipped, cause):
+		default:
+		}
+		return nil
+	}
+	return fmt.Errorf("no valid message within %d bytes: %w", maxResyncBytes, cause)
+}
+
+// ResyncStats returns counters of recoveries from stream corruption
+func (c *IPCConsumer) ResyncStats() ResyncStats {
+	c.resyncs.mu.Lock()
+	defer c.resyncs.mu.Unlock()
+	st := c.resyncs.stats
+	if st.LastAt != nil {
+		at := st.LastAt.UTC()
+		st.LastAt = &at
+	}
+	return st
+}
@@ -0,0 +1,261 @@
+package media
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ReturnAudio is one packet of audio sent by a viewer, e.g. a co-op
+// partner's microphone. Data is the packet as received (Opus for WebRTC
+// peers); the host decodes and mixes it.
+type ReturnAudio struct {
+	PeerID     string
+	PTS        int64 // Nanoseconds since the peer's track started
+	Codec      string
+	SampleRate int
+	Channels   int
+	Data       []byte
+}
+
+// ReturnAudioSource is implemented by peer managers that accept an audio
+// track from viewers (recvonly on the gateway side)
+type ReturnAudioSource interface {
+	SetOnReturnAudio(fn func(ReturnAudio))
+}
+
+// returnAudioHeader is the JSON header of a MessageTypeReturnAudio message
+type returnAudioHeader struct {
+	PeerID     string `json:"peer_id"`
+	PTS        int64  `json:"pts"`
+	Codec      string `json:"codec"`
+	SampleRate int    `json:"sample_rate"`
+	Channels   int    `json:"channels"`
+}
+
+// ReturnChannelConfig configures the return channel
+type ReturnChannelConfig struct {
+	SocketPath   string        // Unix socket or named pipe the host connects to
+	QueueSize    int           // Packets buffered for the host, default 64
+	WriteTimeout time.Duration // Per-message write deadline, default 1s
+}
+
+// ReturnChannel carries viewer audio back to the host. It listens on its own
+// Unix socket, the reverse of the capture socket: the host connects and reads
+// messages in the same framing the capture service writes, with type
+// MessageTypeReturnAudio. One host is served at a time; a new connection
+// replaces the old. Packets are dropped while no host is connected or when
+// the host falls behind, since late voice is worse than none.
+type ReturnChannel struct {
+	cfg    ReturnChannelConfig
+	logger zerolog.Logger
+
+	queue chan ReturnAudio
+	conns chan net.Conn
+
+	mu       sync.Mutex
+	running  bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+	listener net.Listener
+
+	connected atomic.Bool
+
+	// Statistics
+	sentCount    atomic.Uint64
+	droppedCount atomic.Uint64
+}
+
+// ReturnChannelStats are return channel counters
+type ReturnChannelStats struct {
+	Connected bool   `json:"connected"`
+	Sent      uint64 `json:"sent"`
+	Dropped   uint64 `json:"dropped"`
+}
+
+// NewReturnChannel creates a return channel; the socket is created on Start
+func NewReturnChannel(cfg ReturnChannelConfig, logger zerolog.Logger) *ReturnChannel {
+	// Apply defaults for zero values
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 64
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = time.Second
+	}
+
+	return &ReturnChannel{
+		cfg:    cfg,
+		logger: logger.With().Str("component", "return_channel").Logger(),
+		queue:  make(chan ReturnAudio, cfg.QueueSize),
+		conns:  make(chan net.Conn),
+	}
+}
+
+// Start listens for the host; returns immediately
+func (r *ReturnChannel) Start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running {
+		return errors.New("return channel already started")
+	}
+
+	listener, err := listenIPC(r.cfg.SocketPath)
+	if err != nil {
+		return err
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.listener = listener
+	r.running = true
+
+	go r.acceptLoop(runCtx, listener)
+	go r.writeLoop(runCtx)
+
+	r.logger.Info().Str("socket_path", r.cfg.SocketPath).Msg("Return channel listening")
+
+	return nil
+}
+
+// Stop closes the socket and any host connection
+func (r *ReturnChannel) Stop() error {
+	r.mu.Lock()
+	if !r.running {
+		r.mu.Unlock()
+		return nil
+	}
+	r.running = false
+	r.cancel()
+	err := r.listener.Close()
+	done := r.done
+	r.mu.Unlock()
+
+	<-done
+	removeIPC(r.cfg.SocketPath)
+
+	r.logger.Info().
+		Uint64("sent", r.sentCount.Load()).
+		Uint64("dropped", r.droppedCount.Load()).
+		Msg("Return channel stopped")
+
+	return err
+}
+
+// WriteAudio queues a viewer's audio packet for the host without blocking
+func (r *ReturnChannel) WriteAudio(pkt ReturnAudio) {
+	if !r.connected.Load() {
+		r.droppedCount.Add(1)
+		return
+	}
+	select {
+	case r.queue <- pkt:
+	default:
+		r.droppedCount.Add(1)
+	}
+}
+
+// Stats returns return channel counters
+func (r *ReturnChannel) Stats() ReturnChannelStats {
+	return ReturnChannelStats{
+		Connected: r.connected.Load(),
+		Sent:      r.sentCount.Load(),
+		Dropped:   r.droppedCount.Load(),
+	}
+}
+
+// acceptLoop hands each host connection to the writer
+func (r *ReturnChannel) acceptLoop(ctx context.Context, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			r.logger.Warn().Err(err).Msg("Accept error")
+			continue
+		}
+
+		select {
+		case r.conns <- conn:
+		case <-ctx.Done():
+			conn.Close()
+			return
+		}
+	}
+}
+
+// writeLoop owns the host connection and writes queued packets to it
+func (r *ReturnChannel) writeLoop(ctx context.Context) {
+	defer close(r.done)
+
+	var conn net.Conn
+	disconnect := func() {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+		r.connected.Store(false)
+	}
+	defer disconnect()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case c := <-r.conns:
+			disconnect()
+			conn = c
+			r.connected.Store(true)
+			r.logger.Info().Msg("Host connected to return channel")
+		case pkt := <-r.queue:
+			if conn == nil {
+				r.droppedCount.Add(1)
+				continue
+			}
+			if err := r.write(conn, pkt); err != nil {
+				r.droppedCount.Add(1)
+				r.logger.Warn().Err(err).Msg("Host disconnected from return channel")
+				disconnect()
+				continue
+			}
+			r.sentCount.Add(1)
+		}
+	}
+}
+
+// write sends one packet as a MessageTypeReturnAudio message:
+// [1 byte type] [4 bytes length, big-endian] [JSON] [0x00] [payload]
+func (r *ReturnChannel) write(conn net.Conn, pkt ReturnAudio) error {
+	js, err := json.Marshal(returnAudioHeader{
+		PeerID:     pkt.PeerID,
+		PTS:        pkt.PTS,
+		Codec:      pkt.Codec,
+		SampleRate: pkt.SampleRate,
+		Channels:   pkt.Channels,
+	})
+	if err != nil {
+		return err
+	}
+
+	msg := make([]byte, 0, 5+len(js)+1+len(pkt.Data))
+	msg = append(msg, byte(MessageTypeReturnAudio))
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(js)+1+len(pkt.Data)))
+	msg = append(msg, js...)
+	msg = append(msg, 0)
+	msg = append(msg, pkt.Data...)
+
+	if err := conn.SetWriteDeadline(time.Now().Add(r.cfg.WriteTimeout)); err != nil {
+		return err
+	}
+	_, err = conn.Write(msg)
+	return err
+}
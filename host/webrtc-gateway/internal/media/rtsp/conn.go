@@ -0,0 +1,287 @@
+package rtsp
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userAgent is sent with every request
+const userAgent = "gaming-capture-gateway"
+
+// response is a parsed RTSP response
+type response struct {
+	StatusCode int
+	Status     string
+	Header     textproto.MIMEHeader
+	Body       []byte
+}
+
+// conn is an RTSP control connection carrying RTP interleaved over TCP
+type conn struct {
+	nc      net.Conn
+	br      *bufio.Reader
+	timeout time.Duration
+
+	// Request URL without credentials, and the credentials themselves
+	url  *url.URL
+	user *url.Userinfo
+
+	// wmu serializes writes: keepalives are sent while the reader is busy
+	wmu     sync.Mutex
+	cseq    int
+	session string
+	auth    *authChallenge
+}
+
+// dial connects to the server named in rawURL
+func dial(ctx context.Context, rawURL string, timeout time.Duration) (*conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RTSP URL: %w", err)
+	}
+	if u.Scheme != "rtsp" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "554")
+	}
+
+	dialer := net.Dialer{Timeout: timeout}
+	nc, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	user := u.User
+	u.User = nil
+
+	return &conn{
+		nc:      nc,
+		br:      bufio.NewReaderSize(nc, 64*1024),
+		timeout: timeout,
+		url:     u,
+		user:    user,
+	}, nil
+}
+
+// Close closes the connection
+func (c *conn) Close() error {
+	return c.nc.Close()
+}
+
+// do sends a request and waits for its response, authenticating once if the
+// server asks for credentials
+func (c *conn) do(method, uri string, header map[string]string) (*response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := c.send(method, uri, header); err != nil {
+			return nil, err
+		}
+
+		c.nc.SetReadDeadline(time.Now().Add(c.timeout))
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == 401 && attempt == 0 && c.user != nil {
+			challenge, err := parseChallenge(resp.Header.Values("Www-Authenticate"))
+			if err != nil {
+				return nil, err
+			}
+			c.auth = challenge
+			continue
+		}
+
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("%s failed: %d %s", method, resp.StatusCode, resp.Status)
+		}
+		return resp, nil
+	}
+}
+
+// send writes a request without waiting for the response
+func (c *conn) send(method, uri string, header map[string]string) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.cseq++
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\n", method, uri)
+	fmt.Fprintf(&b, "CSeq: %d\r\n", c.cseq)
+	fmt.Fprintf(&b, "User-Agent: %s\r\n", userAgent)
+	if c.session != "" {
+		fmt.Fprintf(&b, "Session: %s\r\n", c.session)
+	}
+	if c.auth != nil && c.user != nil {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", c.auth.authorization(c.user, method, uri))
+	}
+	for k, v := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", k, v)
+	}
+	b.WriteString("\r\n")
+
+	c.nc.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := io.WriteString(c.nc, b.String())
+	return err
+}
+
+// readResponse reads the next RTSP response, discarding any interleaved
+// packets that arrive first
+func (c *conn) readResponse() (*response, error) {
+	for {
+		b, err := c.br.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != '$' {
+			return c.readMessage()
+		}
+		if _, _, err := c.readPacket(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readInterleaved reads the next interleaved packet, discarding any RTSP
+// responses in between (e.g. replies to keepalives)
+func (c *conn) readInterleaved() (channel byte, payload []byte, err error) {
+	for {
+		c.nc.SetReadDeadline(time.Now().Add(c.timeout))
+
+		b, err := c.br.Peek(1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if b[0] == '$' {
+			return c.readPacket()
+		}
+
+		resp, err := c.readMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		if resp.StatusCode != 200 {
+			return 0, nil, fmt.Errorf("server error: %d %s", resp.StatusCode, resp.Status)
+		}
+	}
+}
+
+// readPacket reads one '$'-framed interleaved packet
+func (c *conn) readPacket() (byte, []byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[2:4]))
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[1], payload, nil
+}
+
+// readMessage reads a status line, headers and body
+func (c *conn) readMessage() (*response, error) {
+	tp := textproto.NewReader(c.br)
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, ok := strings.Cut(line, " ")
+	if !ok || !strings.HasPrefix(proto, "RTSP/") {
+		return nil, fmt.Errorf("malformed status line %q", line)
+	}
+	codeStr, status, _ := strings.Cut(rest, " ")
+	code, err := strconv.Atoi(codeStr)
+	if err != nil {
+		return nil, fmt.Errorf("malformed status line %q", line)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	resp := &response{StatusCode: code, Status: status, Header: header}
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		resp.Body = make([]byte, n)
+		if _, err := io.ReadFull(c.br, resp.Body); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// authChallenge is a parsed WWW-Authenticate challenge
+type authChallenge struct {
+	digest bool
+	realm  string
+	nonce  string
+}
+
+// parseChallenge picks Digest over Basic when the server offers both
+func parseChallenge(values []string) (*authChallenge, error) {
+	var basic *authChallenge
+	for _, v := range values {
+		scheme, params, _ := strings.Cut(v, " ")
+		switch strings.ToLower(scheme) {
+		case "digest":
+			p := parseAuthParams(params)
+			return &authChallenge{digest: true, realm: p["realm"], nonce: p["nonce"]}, nil
+		case "basic":
+			basic = &authChallenge{realm: parseAuthParams(params)["realm"]}
+		}
+	}
+	if basic == nil {
+		return nil, errors.New("server requires unsupported authentication")
+	}
+	return basic, nil
+}
+
+// parseAuthParams parses comma-separated key="value" pairs
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if ok {
+			params[strings.ToLower(k)] = strings.Trim(v, `"`)
+		}
+	}
+	return params
+}
+
+// authorization returns the Authorization header value for a request
+func (a *authChallenge) authorization(user *url.Userinfo, method, uri string) string {
+	password, _ := user.Password()
+	if !a.digest {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password))
+	}
+
+	ha1 := md5Hex(user.Username() + ":" + a.realm + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		user.Username(), a.realm, a.nonce, uri, md5Hex(ha1+":"+a.nonce+":"+ha2))
+}
+
+// md5Hex returns the lowercase hex MD5 of s
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
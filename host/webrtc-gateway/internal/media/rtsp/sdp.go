@@ -0,0 +1,96 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// videoTrack describes the H.264 track found in a DESCRIBE response
+type videoTrack struct {
+	control     string // Absolute control URL for SETUP
+	payloadType uint8
+	params      [][]byte // SPS/PPS from sprop-parameter-sets, without start codes
+}
+
+// parseVideoTrack finds the first H.264 video track in an SDP
+func parseVideoTrack(body []byte, base *url.URL) (videoTrack, error) {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal(body); err != nil {
+		return videoTrack{}, err
+	}
+
+	for _, md := range desc.MediaDescriptions {
+		if md.MediaName.Media != "video" {
+			continue
+		}
+
+		for _, attr := range md.Attributes {
+			if attr.Key != "rtpmap" {
+				continue
+			}
+			ptStr, encoding, _ := strings.Cut(attr.Value, " ")
+			if !strings.HasPrefix(strings.ToUpper(encoding), "H264/") {
+				continue
+			}
+			pt, err := strconv.ParseUint(ptStr, 10, 8)
+			if err != nil {
+				continue
+			}
+
+			control, _ := md.Attribute("control")
+			track := videoTrack{
+				control:     resolveControl(base, control),
+				payloadType: uint8(pt),
+				params:      spropParams(md, ptStr),
+			}
+			return track, nil
+		}
+	}
+
+	return videoTrack{}, errors.New("no H.264 video track in session description")
+}
+
+// resolveControl makes a track control attribute absolute
+func resolveControl(base *url.URL, control string) string {
+	if control == "" || control == "*" {
+		return base.String()
+	}
+	if strings.HasPrefix(control, "rtsp://") {
+		return control
+	}
+
+	u := *base
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.Path += control
+	return u.String()
+}
+
+// spropParams decodes sprop-parameter-sets from the fmtp line for pt
+func spropParams(md *sdp.MediaDescription, pt string) [][]byte {
+	for _, attr := range md.Attributes {
+		if attr.Key != "fmtp" || !strings.HasPrefix(attr.Value, pt+" ") {
+			continue
+		}
+		for _, param := range strings.Split(strings.TrimPrefix(attr.Value, pt+" "), ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if k != "sprop-parameter-sets" {
+				continue
+			}
+			var params [][]byte
+			for _, set := range strings.Split(v, ",") {
+				if nal, err := base64.StdEncoding.DecodeString(set); err == nil && len(nal) > 0 {
+					params = append(params, nal)
+				}
+			}
+			return params
+		}
+	}
+	return nil
+}
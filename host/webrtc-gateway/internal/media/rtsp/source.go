@@ -0,0 +1,442 @@
+// Package rtsp provides a minimal RTSP client video source, used to pull H.264
+// from IP cameras or another gateway as a backup input.
+package rtsp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// annexBStartCode prefixes every NAL unit we emit
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// Config configures an RTSP source
+type Config struct {
+	URL             string        // rtsp://[user:pass@]host[:port]/path
+	Timeout         time.Duration // Network timeout, default 10s
+	ReconnectDelay  time.Duration // Delay between reconnect attempts, default 2s
+	VideoBufferSize int           // Output channel buffer size, default 30
+}
+
+// Source pulls H.264 video from an RTSP server over TCP-interleaved RTP,
+// reconnecting automatically
+type Source struct {
+	cfg      Config
+	logger   zerolog.Logger
+	warnings *logging.Summarizer // Rate-limits per-frame warnings
+
+	videoFrames chan media.VideoFrame
+
+	mu      sync.Mutex
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	connected atomic.Bool
+
+	// Statistics
+	frameCount atomic.Uint64
+	dropCount  atomic.Uint64
+}
+
+// NewSource creates an RTSP source; the connection is made on Start
+func NewSource(cfg Config, logger zerolog.Logger) *Source {
+	// Apply defaults for zero values
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.ReconnectDelay <= 0 {
+		cfg.ReconnectDelay = 2 * time.Second
+	}
+	if cfg.VideoBufferSize <= 0 {
+		cfg.VideoBufferSize = 30
+	}
+
+	logger = logger.With().Str("component", "rtsp_source").Str("url", redactURL(cfg.URL)).Logger()
+	return &Source{
+		cfg:         cfg,
+		logger:      logger,
+		warnings:    logging.NewSummarizer(logger),
+		videoFrames: make(chan media.VideoFrame, cfg.VideoBufferSize),
+	}
+}
+
+// Start begins connecting in the background; returns immediately
+func (s *Source) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return errors.New("rtsp source already started")
+	}
+	if _, err := url.Parse(s.cfg.URL); err != nil {
+		return fmt.Errorf("invalid RTSP URL: %w", err)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.running = true
+
+	go s.connectLoop(runCtx)
+
+	s.logger.Info().Msg("RTSP source started")
+
+	return nil
+}
+
+// Stop disconnects and waits for the session to end
+func (s *Source) Stop() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	s.running = false
+	s.cancel()
+	done := s.done
+	s.mu.Unlock()
+
+	<-done
+
+	s.logger.Info().
+		Uint64("frames", s.frameCount.Load()).
+		Uint64("dropped", s.dropCount.Load()).
+		Msg("RTSP source stopped")
+
+	return nil
+}
+
+// VideoFrameChannel returns the channel for receiving encoded frames
+func (s *Source) VideoFrameChannel() <-chan media.VideoFrame {
+	return s.videoFrames
+}
+
+// IsConnected returns true while a session is playing
+func (s *Source) IsConnected() bool {
+	return s.connected.Load()
+}
+
+// Stats returns received and dropped frame counts
+func (s *Source) Stats() (frames, dropped uint64) {
+	return s.frameCount.Load(), s.dropCount.Load()
+}
+
+// connectLoop runs sessions until the context is cancelled
+func (s *Source) connectLoop(ctx context.Context) {
+	defer close(s.done)
+
+	for {
+		err := s.session(ctx)
+		s.connected.Store(false)
+
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warn().Err(err).Dur("retry_in", s.cfg.ReconnectDelay).Msg("RTSP session ended")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.cfg.ReconnectDelay):
+		}
+	}
+}
+
+// session connects, starts playback and reads until an error occurs
+func (s *Source) session(ctx context.Context) error {
+	c, err := dial(ctx, s.cfg.URL, s.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	// Unblock reads when stopping
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+
+	resp, err := c.do("DESCRIBE", c.url.String(), map[string]string{"Accept": "application/sdp"})
+	if err != nil {
+		return err
+	}
+
+	base := c.url
+	if cb := resp.Header.Get("Content-Base"); cb != "" {
+		if u, err := url.Parse(cb); err == nil {
+			base = u
+		}
+	}
+	track, err := parseVideoTrack(resp.Body, base)
+	if err != nil {
+		return err
+	}
+
+	resp, err = c.do("SETUP", track.control, map[string]string{"Transport": "RTP/AVP/TCP;unicast;interleaved=0-1"})
+	if err != nil {
+		return err
+	}
+	session, sessionTimeout := parseSession(resp.Header.Get("Session"))
+	if session == "" {
+		return errors.New("SETUP response has no session")
+	}
+	c.session = session
+
+	if _, err := c.do("PLAY", base.String(), map[string]string{"Range": "npt=0.000-"}); err != nil {
+		return err
+	}
+
+	s.connected.Store(true)
+	s.logger.Info().Int("payload_type", int(track.payloadType)).Msg("RTSP session playing")
+
+	// Servers drop sessions that go quiet; refresh well within the timeout
+	keepaliveCtx, cancelKeepalive := context.WithCancel(ctx)
+	defer cancelKeepalive()
+	go s.keepalive(keepaliveCtx, c, base.String(), sessionTimeout/2)
+
+	return s.readLoop(c, track)
+}
+
+// keepalive sends OPTIONS periodically; replies are consumed by the reader
+func (s *Source) keepalive(ctx context.Context, c *conn, uri string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.send("OPTIONS", uri, nil); err != nil {
+				s.logger.Debug().Err(err).Msg("RTSP keepalive failed")
+				return
+			}
+		}
+	}
+}
+
+// readLoop depacketizes RTP into access units
+func (s *Source) readLoop(c *conn, track videoTrack) error {
+	asm := newAssembler(track.params)
+
+	for {
+		channel, payload, err := c.readInterleaved()
+		if err != nil {
+			return err
+		}
+		if channel != 0 {
+			continue // RTCP
+		}
+
+		var pkt rtp.Packet
+		if err := pkt.Unmarshal(payload); err != nil {
+			s.logger.Debug().Err(err).Msg("Invalid RTP packet")
+			continue
+		}
+		if pkt.PayloadType != track.payloadType {
+			continue
+		}
+
+		frame, ok := asm.push(&pkt)
+		if !ok {
+			continue
+		}
+
+		select {
+		case s.videoFrames <- frame:
+			s.frameCount.Add(1)
+		default:
+			s.dropCount.Add(1)
+			s.warnings.Warn("Video frame channel full, dropping frame", nil)
+		}
+	}
+}
+
+// assembler turns RTP packets into Annex-B access units
+type assembler struct {
+	depacketizer codecs.H264Packet
+	params       [][]byte // Latest SPS/PPS, re-sent ahead of keyframes
+
+	au        []byte
+	auTS      uint32
+	auKey     bool
+	auParams  bool
+	lastSeq   uint16
+	started   bool
+	broken    bool // Packet loss; drop until the next keyframe
+	firstTS   uint32
+	tsCycles  int64
+	lastRawTS uint32
+}
+
+func newAssembler(params [][]byte) *assembler {
+	return &assembler{params: params, broken: true}
+}
+
+// push adds a packet and returns a frame when an access unit completes
+func (a *assembler) push(pkt *rtp.Packet) (media.VideoFrame, bool) {
+	var (
+		frame media.VideoFrame
+		ready bool
+	)
+
+	if a.started && pkt.SequenceNumber != a.lastSeq+1 {
+		// Lost packets corrupt the current picture and everything that
+		// references it
+		a.depacketizer = codecs.H264Packet{}
+		a.au = a.au[:0]
+		a.broken = true
+	}
+	if !a.started {
+		a.firstTS = pkt.Timestamp
+		a.lastRawTS = pkt.Timestamp
+	}
+	a.started = true
+	a.lastSeq = pkt.SequenceNumber
+
+	// A timestamp change without a marker means the marker packet was lost
+	if len(a.au) > 0 && pkt.Timestamp != a.auTS {
+		frame, ready = a.flush()
+	}
+	a.auTS = pkt.Timestamp
+
+	nals, err := a.depacketizer.Unmarshal(pkt.Payload)
+	if err != nil {
+		a.broken = true
+		return frame, ready
+	}
+	forEachNAL(nals, func(nal []byte) {
+		switch nal[0] & 0x1F {
+		case 5:
+			a.auKey = true
+		case 7:
+			a.params = [][]byte{append([]byte(nil), nal...)}
+			a.auParams = true
+		case 8:
+			if len(a.params) > 0 {
+				a.params = append(a.params[:1], append([]byte(nil), nal...))
+			}
+			a.auParams = true
+		}
+		a.au = append(a.au, annexBStartCode...)
+		a.au = append(a.au, nal...)
+	})
+
+	if pkt.Marker && !ready {
+		frame, ready = a.flush()
+	}
+	return frame, ready
+}
+
+// flush completes the current access unit
+func (a *assembler) flush() (media.VideoFrame, bool) {
+	defer func() {
+		a.au = a.au[:0]
+		a.auKey = false
+		a.auParams = false
+	}()
+
+	if len(a.au) == 0 {
+		return media.VideoFrame{}, false
+	}
+	if a.broken && !a.auKey {
+		return media.VideoFrame{}, false
+	}
+	a.broken = false
+
+	var data []byte
+	if a.auKey && !a.auParams {
+		// Many cameras only signal SPS/PPS in the SDP
+		for _, p := range a.params {
+			data = append(data, annexBStartCode...)
+			data = append(data, p...)
+		}
+	}
+	data = append(data, a.au...)
+
+	pts := a.pts(a.auTS)
+	return media.VideoFrame{
+		PTS:        pts,
+		DTS:        pts,
+		IsKeyframe: a.auKey,
+		Codec:      "h264",
+		Data:       data,
+		ReceivedAt: time.Now(),
+	}, true
+}
+
+// pts converts a 90 kHz RTP timestamp to nanoseconds since the first packet,
+// unwrapping 32-bit rollover
+func (a *assembler) pts(ts uint32) int64 {
+	if ts < a.lastRawTS && a.lastRawTS-ts > 1<<31 {
+		a.tsCycles++
+	}
+	a.lastRawTS = ts
+	ticks := a.tsCycles<<32 + int64(ts) - int64(a.firstTS)
+	return ticks * int64(time.Second) / 90000
+}
+
+// forEachNAL calls fn for each NAL unit in an Annex-B byte stream
+func forEachNAL(data []byte, fn func(nal []byte)) {
+	for len(data) > 0 {
+		start := bytes.Index(data, []byte{0, 0, 1})
+		if start < 0 {
+			return
+		}
+		data = data[start+3:]
+
+		end := bytes.Index(data, []byte{0, 0, 1})
+		nal := data
+		if end >= 0 {
+			nal = data[:end]
+			// A 4-byte start code leaves a trailing zero behind
+			if len(nal) > 0 && nal[len(nal)-1] == 0 {
+				nal = nal[:len(nal)-1]
+			}
+			data = data[end:]
+		} else {
+			data = nil
+		}
+		if len(nal) > 0 {
+			fn(nal)
+		}
+	}
+}
+
+// parseSession splits a Session header into its ID and timeout
+func parseSession(header string) (string, time.Duration) {
+	timeout := 60 * time.Second
+	id, params, _ := strings.Cut(header, ";")
+	for _, p := range strings.Split(params, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.EqualFold(k, "timeout") {
+			if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+				timeout = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return strings.TrimSpace(id), timeout
+}
+
+// redactURL hides credentials for logging
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,84 @@
+package media
+
+import (
+	"errors"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog"
+)
+
+// errChecksumMismatch marks a frame whose payload does not match the
+// checksum in its header
+var errChecksumMismatch = errors.New("payload checksum mismatch")
+
+// seqTracker follows one stream's sequence numbers. Producers may number
+// their video and audio messages, one sequence per message type starting at
+// 1 and counting every frame offered, so frames the producer drops show up
+// as gaps. The count restarts with each connection: frames lost while the
+// producer reconnects are not seen.
+type seqTracker struct {
+	mu   sync.Mutex
+	last uint64 // 0 before the first numbered frame of a connection
+
+	// Statistics
+	gaps      atomic.Uint64
+	lost      atomic.Uint64
+	reordered atomic.Uint64
+	corrupted atomic.Uint64
+}
+
+// observe records seq and returns how many frames are missing before it.
+// Unnumbered frames, seq 0, are ignored.
+func (t *seqTracker) observe(seq uint64) uint64 {
+	if seq == 0 {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case t.last == 0 || seq == t.last+1:
+		t.last = seq
+		return 0
+	case seq <= t.last:
+		// Repeated or out of order; keep the highest seen
+		t.reordered.Add(1)
+		return 0
+	default:
+		missing := seq - t.last - 1
+		t.last = seq
+		t.gaps.Add(1)
+		t.lost.Add(missing)
+		return missing
+	}
+}
+
+// reset forgets the previous connection's sequence
+func (t *seqTracker) reset() {
+	t.mu.Lock()
+	t.last = 0
+	t.mu.Unlock()
+}
+
+// fill sets the producer counters of s
+func (t *seqTracker) fill(s *StageStats) {
+	s.ProducerDropped = t.lost.Load()
+	s.Corrupted = t.corrupted.Load()
+}
+
+// checkFrame records a frame's sequence number and verifies its checksum,
+// when the producer sent them. Gaps are reported as producer drops; a
+// checksum mismatch returns errChecksumMismatch.
+func (c *IPCConsumer) checkFrame(t *seqTracker, stream string, seq uint64, sum *uint32, payload []byte) error {
+	if missing := t.observe(seq); missing > 0 {
+		c.warnings.Warn("Capture service dropped frames", func(e *zerolog.Event) {
+			e.Str("stream", stream).Uint64("missing", missing).Uint64("seq", seq)
+		})
+	}
+	if sum != nil && crc32.ChecksumIEEE(payload) != *sum {
+		t.corrupted.Add(1)
+		return errChecksumMismatch
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package media
+
+import "context"
+
+// FrameSource is anything that produces encoded video frames for distribution.
+// Pipeline satisfies it, as do the built-in capture sources (e.g. V4L2).
+type FrameSource interface {
+	// Start begins producing frames; returns immediately
+	Start(ctx context.Context) error
+
+	// Stop stops producing frames and releases the underlying device or socket
+	Stop() error
+
+	// VideoFrameChannel returns the channel frames are delivered on
+	VideoFrameChannel() <-chan VideoFrame
+}
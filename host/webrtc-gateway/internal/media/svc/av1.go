@@ -0,0 +1,112 @@
+package svc
+
+import "errors"
+
+// AV1 OBU types that matter for layer selection
+const (
+	av1OBUSequenceHeader    = 1
+	av1OBUTemporalDelimiter = 2
+)
+
+// av1OBU is one OBU in a temporal unit
+type av1OBU struct {
+	data     []byte // Whole OBU including header
+	typ      byte
+	hasLayer bool // Has an extension header with layer IDs
+	temporal int
+	spatial  int
+}
+
+// parseAV1 splits a low-overhead bitstream temporal unit into OBUs
+func parseAV1(data []byte) ([]av1OBU, error) {
+	var obus []av1OBU
+	for len(data) > 0 {
+		header := data[0]
+		if header&0x80 != 0 {
+			return nil, errors.New("av1: forbidden bit set")
+		}
+		obu := av1OBU{typ: (header >> 3) & 0x0F}
+		hasExtension := header&0x04 != 0
+		hasSize := header&0x02 != 0
+
+		n := 1
+		if hasExtension {
+			if len(data) < 2 {
+				return nil, errors.New("av1: truncated extension header")
+			}
+			obu.hasLayer = true
+			obu.temporal = int(data[1] >> 5)
+			obu.spatial = int(data[1]>>3) & 0x03
+			n = 2
+		}
+
+		end := len(data)
+		if hasSize {
+			size, sizeLen, err := readLEB128(data[n:])
+			if err != nil {
+				return nil, err
+			}
+			n += sizeLen
+			if size > uint64(len(data)-n) {
+				return nil, errors.New("av1: OBU size exceeds data")
+			}
+			end = n + int(size)
+		}
+
+		obu.data = data[:end]
+		obus = append(obus, obu)
+		data = data[end:]
+	}
+	return obus, nil
+}
+
+// readLEB128 decodes an unsigned LEB128 value
+func readLEB128(data []byte) (uint64, int, error) {
+	var value uint64
+	for i := 0; i < 8 && i < len(data); i++ {
+		value |= uint64(data[i]&0x7F) << (7 * i)
+		if data[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("av1: invalid leb128")
+}
+
+// av1TemporalID returns the temporal layer of a temporal unit; all layered
+// OBUs in one unit share it
+func av1TemporalID(obus []av1OBU) int {
+	for _, obu := range obus {
+		if obu.hasLayer {
+			return obu.temporal
+		}
+	}
+	return 0
+}
+
+// filterAV1 drops OBUs above maxSpatial. OBUs without layer IDs (sequence
+// headers, temporal delimiters, metadata) are always kept.
+func filterAV1(data []byte, obus []av1OBU, maxSpatial int) []byte {
+	if maxSpatial == NoLimit {
+		return data
+	}
+
+	dropped := false
+	for _, obu := range obus {
+		if obu.hasLayer && obu.spatial > maxSpatial {
+			dropped = true
+			break
+		}
+	}
+	if !dropped {
+		return data
+	}
+
+	out := make([]byte, 0, len(data))
+	for _, obu := range obus {
+		if obu.hasLayer && obu.spatial > maxSpatial {
+			continue
+		}
+		out = append(out, obu.data...)
+	}
+	return out
+}
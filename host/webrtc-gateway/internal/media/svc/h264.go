@@ -0,0 +1,41 @@
+package svc
+
+import "bytes"
+
+// H.264 NAL unit types that carry picture data
+const (
+	h264NALSlice    = 1
+	h264NALSliceIDR = 5
+)
+
+// h264TemporalID classifies an Annex-B access unit into two temporal levels:
+// 0 for frames other pictures may reference, 1 for disposable frames whose
+// slices all have nal_ref_idc 0. Dropping level 1 never breaks decode; with
+// the common one-in-two non-reference structure it halves the frame rate and
+// roughly halves the bitrate.
+func h264TemporalID(data []byte) int {
+	slices := 0
+	for len(data) > 0 {
+		start := bytes.Index(data, []byte{0, 0, 1})
+		if start < 0 || start+3 >= len(data) {
+			break
+		}
+		data = data[start+3:]
+
+		header := data[0]
+		switch header & 0x1F {
+		case h264NALSliceIDR:
+			return 0
+		case h264NALSlice:
+			if header&0x60 != 0 {
+				return 0
+			}
+			slices++
+		}
+	}
+	if slices == 0 {
+		// Parameter sets or SEI only; keep
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,113 @@
+package svc
+
+// Rate limiting: layer shares and the frame rate are averaged over about
+// rateWindow frames, and nothing is left out before rateWarmup frames
+const (
+	rateWindow = 32
+	rateWarmup = 16
+
+	// maxTemporalLayers covers the 3-bit temporal IDs of AV1 and VP9
+	maxTemporalLayers = 8
+
+	// rateTolerance lets layers through that exceed the cap by no more
+	// than measurement jitter
+	rateTolerance = 1.02
+)
+
+// rateLimiter decimates a stream to a frame rate cap by leaving out
+// temporal layers, so every frame sent can still be decoded. The rate of
+// each layer is measured from the stream, and the highest layers are left
+// out until the rest fit under the cap. Nothing references frames of the
+// stream's top layer (for plain H.264, its non-reference frames), so when
+// leaving that whole layer out would undershoot the cap, its frames are
+// let through one at a time as the rate allows. Keyframes are in the base
+// layer and always kept.
+type rateLimiter struct {
+	frames  int
+	share   [maxTemporalLayers]float64 // Moving share of frames in each layer
+	gap     float64                    // Moving gap between frames, in seconds
+	lastPTS int64
+	top     int     // Highest temporal layer seen
+	credit  float64 // Frames the cap allows beyond those already sent
+}
+
+// observe records a frame of layer temporal at pts, in nanoseconds, and
+// accrues credit at maxFPS for the time since the last one
+func (r *rateLimiter) observe(pts int64, temporal int, maxFPS float64) {
+	temporal = min(max(temporal, 0), maxTemporalLayers-1)
+	r.top = max(r.top, temporal)
+
+	gap := float64(pts-r.lastPTS) / 1e9
+	first := r.frames == 0
+	r.lastPTS = pts
+	if first {
+		r.frames = 1
+		r.share[temporal] = 1
+		return
+	}
+	if gap <= 0 || gap > 1 {
+		// Outages and timestamp jumps are not frame timing
+		return
+	}
+
+	if r.frames < rateWindow {
+		r.frames++
+	}
+	weight := 1 / float64(r.frames)
+	r.gap += (gap - r.gap) * weight
+	for i := range r.share {
+		in := 0.0
+		if i == temporal {
+			in = 1
+		}
+		r.share[i] += (in - r.share[i]) * weight
+	}
+	// Credit is capped, so time under the cap cannot become a burst
+	r.credit = min(r.credit+gap*maxFPS, 2)
+}
+
+// limit returns the highest temporal layer whose frames, with those of the
+// layers below, fit under maxFPS; NoLimit when the whole stream fits or
+// the rates are not yet known
+func (r *rateLimiter) limit(maxFPS float64) int {
+	if maxFPS <= 0 || r.frames < rateWarmup || r.gap <= 0 {
+		return NoLimit
+	}
+	fps := 1 / r.gap
+	if fps <= maxFPS*rateTolerance {
+		return NoLimit
+	}
+
+	rate := 0.0
+	for layer := 0; layer < r.top; layer++ {
+		rate += r.share[layer] * fps
+		if next := rate + r.share[layer+1]*fps; next > maxFPS*rateTolerance {
+			return layer
+		}
+	}
+	return NoLimit
+}
+
+// fill reports whether a frame of layer temporal, just above the layer
+// limit, may be sent anyway to bring the rate up to the cap: only frames of
+// the top layer, which nothing references, while credit remains
+func (r *rateLimiter) fill(temporal, limit int) bool {
+	return temporal > 0 && temporal == r.top && temporal == limit+1 && r.credit >= 1
+}
+
+// sent spends the credit of a frame sent; frames that cannot be left out
+// may run the credit into a bounded debt
+func (r *rateLimiter) sent() {
+	r.credit = max(r.credit-1, -1)
+}
+
+// lower returns the stricter of two layer limits
+func lower(a, b int) int {
+	switch {
+	case a == NoLimit:
+		return b
+	case b == NoLimit:
+		return a
+	}
+	return min(a, b)
+}
@@ -0,0 +1,101 @@
+package svc
+
+import "fmt"
+
+// Frame is the input to a Selector
+type Frame struct {
+	Codec      string // "av1", "vp9" or "h264"
+	Data       []byte
+	IsKeyframe bool
+	Info       *FrameInfo // Required for VP9, ignored for AV1
+	PTS        int64      // Presentation time in nanoseconds, for Limits.MaxFPS
+}
+
+// Layered reports whether a frame can be layer-filtered
+func Layered(codec string, info *FrameInfo) bool {
+	switch codec {
+	case "av1", "h264":
+		return true
+	case "vp9":
+		return info != nil && (info.SpatialLayers > 1 || info.TemporalID > 0)
+	}
+	return false
+}
+
+// Selector tracks the layers one peer is receiving. Layers are removed
+// immediately, but added only where the peer can decode them: temporal
+// layers at the next base-layer frame, spatial layers at the next keyframe.
+type Selector struct {
+	current   Limits
+	started   bool
+	requested bool // A keyframe has been requested for a spatial upswitch
+	rate      rateLimiter
+}
+
+// Select returns the data to send for frame under target, or nil to skip the
+// frame. needKeyframe is set once when a spatial upswitch is waiting for a
+// keyframe.
+func (s *Selector) Select(frame Frame, target Limits) (data []byte, needKeyframe bool, err error) {
+	var (
+		temporal int
+		obus     []av1OBU
+	)
+	switch frame.Codec {
+	case "av1":
+		obus, err = parseAV1(frame.Data)
+		if err != nil {
+			return nil, false, err
+		}
+		temporal = av1TemporalID(obus)
+	case "vp9":
+		if frame.Info != nil {
+			temporal = frame.Info.TemporalID
+		}
+	case "h264":
+		temporal = h264TemporalID(frame.Data)
+	default:
+		return nil, false, fmt.Errorf("svc: unsupported codec %q", frame.Codec)
+	}
+
+	// A frame rate cap is met by leaving out temporal layers
+	s.rate.observe(frame.PTS, temporal, target.MaxFPS)
+	target.MaxTemporal = lower(target.MaxTemporal, s.rate.limit(target.MaxFPS))
+	if !s.started {
+		s.current = target
+		s.started = true
+	}
+	s.current.MaxFPS = target.MaxFPS
+
+	// Removing layers never breaks decode; adding them needs a switch point
+	if !raises(s.current.MaxTemporal, target.MaxTemporal) || temporal == 0 || frame.IsKeyframe {
+		s.current.MaxTemporal = target.MaxTemporal
+	}
+	if !raises(s.current.MaxSpatial, target.MaxSpatial) || frame.IsKeyframe {
+		s.current.MaxSpatial = target.MaxSpatial
+		s.requested = false
+	} else if !s.requested {
+		s.requested = true
+		needKeyframe = true
+	}
+
+	if !allows(s.current.MaxTemporal, temporal) && !s.rate.fill(temporal, s.current.MaxTemporal) {
+		return nil, needKeyframe, nil
+	}
+	s.rate.sent()
+
+	switch frame.Codec {
+	case "av1":
+		data = filterAV1(frame.Data, obus, s.current.MaxSpatial)
+	case "vp9":
+		data, err = filterVP9(frame.Data, s.current.MaxSpatial)
+	default:
+		// H.264 has no spatial layers
+		data = frame.Data
+	}
+	return data, needKeyframe, err
+}
+
+// Current returns the layers the peer is receiving
+func (s *Selector) Current() Limits {
+	return s.current
+}
@@ -0,0 +1,41 @@
+// Package svc selects spatial and temporal layers from scalable (SVC) video,
+// so each peer can be sent only the layers its connection can carry without
+// encoding the stream more than once. Plain H.264 is treated as two temporal
+// layers: reference frames and disposable non-reference frames. The same
+// layers decimate a stream to a frame rate cap, e.g. 120fps capture to 60fps
+// for peers that cannot use the full rate.
+package svc
+
+// NoLimit as a layer limit forwards every layer
+const NoLimit = -1
+
+// Limits caps the layers forwarded to a peer; NoLimit means all. MaxFPS,
+// when positive, caps the frame rate by leaving out temporal layers.
+type Limits struct {
+	MaxSpatial  int     `json:"max_spatial"`
+	MaxTemporal int     `json:"max_temporal"`
+	MaxFPS      float64 `json:"max_fps,omitempty"`
+}
+
+// Unlimited forwards every layer
+var Unlimited = Limits{MaxSpatial: NoLimit, MaxTemporal: NoLimit}
+
+// FrameInfo is producer-signalled layer metadata, for codecs whose bitstream
+// does not carry layer IDs (VP9)
+type FrameInfo struct {
+	SpatialLayers int // Frames in the VP9 superframe, lowest layer first
+	TemporalID    int
+}
+
+// allows reports whether layer id is within limit
+func allows(limit, id int) bool {
+	return limit == NoLimit || id <= limit
+}
+
+// raises reports whether moving from one limit to another adds layers
+func raises(from, to int) bool {
+	if from == NoLimit {
+		return false
+	}
+	return to == NoLimit || to > from
+}
@@ -0,0 +1,50 @@
+package svc
+
+import "github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+
+// joinVP9 builds a superframe from frames, omitting the index for one frame
+func joinVP9(frames [][]byte) []byte {
+	if len(frames) == 1 {
+		return frames[0]
+	}
+
+	largest := 0
+	total := 0
+	for _, f := range frames {
+		largest = max(largest, len(f))
+		total += len(f)
+	}
+	sizeBytes := 1
+	for largest >= 1<<(8*sizeBytes) {
+		sizeBytes++
+	}
+
+	marker := byte(0xC0) | byte(sizeBytes-1)<<3 | byte(len(frames)-1)
+	out := make([]byte, 0, total+2+sizeBytes*len(frames))
+	for _, f := range frames {
+		out = append(out, f...)
+	}
+	out = append(out, marker)
+	for _, f := range frames {
+		for b := 0; b < sizeBytes; b++ {
+			out = append(out, byte(len(f)>>(8*b)))
+		}
+	}
+	return append(out, marker)
+}
+
+// filterVP9 keeps the spatial layers up to maxSpatial. Each frame in an SVC
+// superframe is one spatial layer, lowest first.
+func filterVP9(data []byte, maxSpatial int) ([]byte, error) {
+	if maxSpatial == NoLimit {
+		return data, nil
+	}
+	frames, err := bitstream.SplitVP9Superframe(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) <= maxSpatial+1 {
+		return data, nil
+	}
+	return joinVP9(frames[:maxSpatial+1]), nil
+}
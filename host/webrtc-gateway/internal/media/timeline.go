@@ -0,0 +1,267 @@
+package media
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// TimelineStats are timestamp sanitizer counters
+type TimelineStats struct {
+	Discontinuities uint64  `json:"discontinuities"`
+	OffsetMs        float64 `json:"offset_ms"`     // Current shift of video timestamps from the producer's
+	LastJumpMs      float64 `json:"last_jump_ms"`  // Size of the last jump spliced out
+	SkewPPM         float64 `json:"skew_ppm"`      // Producer clock skew against the gateway's, positive when slow
+	CorrectionMs    float64 `json:"correction_ms"` // Drift correction currently applied
+}
+
+// timelineKind indexes the tracks of a Timeline
+type timelineKind int
+
+const (
+	timelineVideo timelineKind = iota
+	timelineAudio
+)
+
+func (k timelineKind) String() string {
+	if k == timelineAudio {
+		return "audio"
+	}
+	return "video"
+}
+
+// spliceWindow is how long a splice found on one kind waits for the other
+// kind's matching jump
+const spliceWindow = 5 * time.Second
+
+// timelineTrack is one kind's position on both timelines
+type timelineTrack struct {
+	seen     bool
+	lastRaw  int64 // Producer timestamp of the last frame
+	lastOut  int64 // Its rewritten timestamp
+	interval int64 // Expected gap to the next frame
+	offset   int64 // Added to producer timestamps
+}
+
+// Timeline rewrites the capture service's timestamps into one continuous,
+// monotonic timeline. Producers restart their clocks, wrap their counters,
+// or jump ahead by however long the console slept, and RTP timestamps, the
+// replay buffer and timeshift playback would all follow. A jump is spliced
+// out by shifting later frames to continue one frame interval after the
+// last, and the first frame after a splice is marked Discontinuity.
+//
+// Audio and video share the producer's clock, so a splice found on one is
+// reused for the other's matching jump and they stay in sync. A forward gap
+// on one kind while the other kept flowing is real, e.g. a static screen
+// with a variable frame rate, and is kept.
+//
+// The producer's clock also drifts against the gateway's by up to a few
+// hundred parts per million, which over a long session would add up to
+// growing latency or starved buffers downstream. Timestamps are scaled by
+// the skew estimated from video receive times, so the timeline runs at the
+// gateway's rate.
+type Timeline struct {
+	maxGap int64
+	logger zerolog.Logger
+
+	mu     sync.Mutex
+	tracks [2]timelineTrack
+
+	// A splice found on one kind, for the other to adopt
+	pending       bool
+	pendingKind   timelineKind
+	pendingOffset int64
+	pendingAt     time.Time
+	lastJump      int64
+
+	// Drift correction is skew*(x-corrAt)+corrBase at spliced time x
+	drift    driftEstimator
+	skew     float64
+	corrAt   int64
+	corrBase int64
+	lastX    int64
+
+	// Statistics
+	discontinuities atomic.Uint64
+}
+
+// NewTimeline creates a sanitizer that splices out forward gaps longer than
+// maxGap, default 5s, and every step back
+func NewTimeline(maxGap time.Duration, logger zerolog.Logger) *Timeline {
+	if maxGap <= 0 {
+		maxGap = 5 * time.Second
+	}
+	return &Timeline{
+		maxGap: int64(maxGap),
+		logger: logger,
+	}
+}
+
+// Video rewrites a video frame's timestamps. Jumps are found on the decode
+// timestamp, since presentation order may go back with B-frames.
+func (t *Timeline) Video(f VideoFrame) VideoFrame {
+	ts := f.DTS
+	if ts == 0 {
+		ts = f.PTS
+	}
+	if ts == 0 {
+		return f // No timestamps to rewrite
+	}
+	offset, spliced := t.rewrite(timelineVideo, ts, int64(time.Second/30), f.ReceivedAt)
+	f.PTS += offset
+	if f.DTS != 0 {
+		f.DTS += offset
+	}
+	f.Discontinuity = spliced
+	return f
+}
+
+// Audio rewrites an audio frame's timestamp
+func (t *Timeline) Audio(f AudioFrame) AudioFrame {
+	if f.PTS == 0 {
+		return f
+	}
+	interval := int64(time.Second / 100)
+	if f.SampleRate > 0 && f.SampleCount > 0 {
+		interval = int64(f.SampleCount) * int64(time.Second) / int64(f.SampleRate)
+	}
+	offset, spliced := t.rewrite(timelineAudio, f.PTS, interval, time.Time{})
+	f.PTS += offset
+	f.Discontinuity = spliced
+	return f
+}
+
+// Text moves a text frame, timed on the video clock, onto the rewritten
+// timeline
+func (t *Timeline) Text(f TextFrame) TextFrame {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if f.PTS != 0 {
+		x := f.PTS + t.tracks[timelineVideo].offset
+		f.PTS = x + t.correction(x)
+	}
+	return f
+}
+
+// Stats returns sanitizer counters
+func (t *Timeline) Stats() TimelineStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return TimelineStats{
+		Discontinuities: t.discontinuities.Load(),
+		OffsetMs:        float64(t.tracks[timelineVideo].offset) / float64(time.Millisecond),
+		LastJumpMs:      float64(t.lastJump) / float64(time.Millisecond),
+		SkewPPM:         t.skew * 1e6,
+		CorrectionMs:    float64(t.correction(t.lastX)) / float64(time.Millisecond),
+	}
+}
+
+// rewrite returns the shift for a frame of kind at producer timestamp raw,
+// and whether a jump was spliced out before it. interval is the expected
+// gap to the next frame, when the kind cannot measure it; receivedAt feeds
+// the drift estimate when set.
+func (t *Timeline) rewrite(kind timelineKind, raw, interval int64, receivedAt time.Time) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tr := &t.tracks[kind]
+	other := &t.tracks[1-kind]
+	if !tr.seen {
+		// Start on the timeline the other kind is already on
+		tr.seen = true
+		tr.offset = other.offset
+		tr.interval = interval
+		tr.lastRaw, tr.lastOut = raw, raw+tr.offset
+		return tr.offset + t.correction(tr.lastOut), false
+	}
+
+	spliced := false
+	delta := raw - tr.lastRaw
+	switch {
+	case delta >= 0 && delta <= t.maxGap:
+		if kind == timelineAudio {
+			tr.interval = interval
+		} else if delta > 0 {
+			tr.interval = delta
+		}
+	case delta > 0 && other.seen && other.lastOut > tr.lastOut+t.maxGap/2:
+		// The other kind kept flowing through the gap without a splice of
+		// its own; it is real
+	default:
+		t.splice(kind, raw)
+		spliced = true
+	}
+
+	tr.lastRaw = raw
+	tr.lastOut = raw + tr.offset
+	if kind == timelineVideo {
+		t.lastX = tr.lastOut
+		if spliced {
+			t.drift.reset()
+		}
+		if t.drift.observe(tr.lastOut, receivedAt) {
+			t.updateSkew(tr.lastOut)
+		}
+	}
+	return tr.offset + t.correction(tr.lastOut), spliced
+}
+
+// correction returns the drift correction at spliced time x. Caller holds
+// mu.
+func (t *Timeline) correction(x int64) int64 {
+	return t.corrBase + int64(float64(x-t.corrAt)*t.skew)
+}
+
+// updateSkew applies a new skew estimate from spliced time x on, keeping
+// the correction continuous. Caller holds mu.
+func (t *Timeline) updateSkew(x int64) {
+	skew, ok := t.drift.skew()
+	if !ok {
+		return
+	}
+	t.corrBase = t.correction(x)
+	t.corrAt = x
+	t.skew = skew
+	t.logger.Debug().
+		Float64("skew_ppm", skew*1e6).
+		Dur("correction", time.Duration(t.corrBase)).
+		Msg("Updated producer clock drift")
+}
+
+// splice moves kind onto a timeline continuing one interval after its last
+// frame, or onto the other kind's new timeline when that also continues it.
+// Caller holds mu.
+func (t *Timeline) splice(kind timelineKind, raw int64) {
+	tr := &t.tracks[kind]
+	own := tr.lastOut + tr.interval - raw
+	jump := raw - tr.lastRaw
+
+	if t.pending && t.pendingKind != kind && time.Since(t.pendingAt) < spliceWindow &&
+		raw+t.pendingOffset > tr.lastOut && abs64(t.pendingOffset-own) <= t.maxGap {
+		tr.offset = t.pendingOffset
+		t.pending = false
+	} else {
+		tr.offset = own
+		t.pending = true
+		t.pendingKind = kind
+		t.pendingOffset = own
+		t.pendingAt = time.Now()
+	}
+	t.lastJump = jump
+	t.discontinuities.Add(1)
+
+	t.logger.Warn().
+		Str("kind", kind.String()).
+		Dur("jump", time.Duration(jump)).
+		Dur("offset", time.Duration(tr.offset)).
+		Msg("Producer timestamps jumped, splicing timeline")
+}
+
+func abs64(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,116 @@
+package media
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Tracks is the set of media tracks a peer subscribes to
+type Tracks uint8
+
+// Track kinds
+const (
+	TrackVideo Tracks = 1 << iota
+	TrackAudio
+
+	TracksAll = TrackVideo | TrackAudio
+)
+
+// Video reports whether the set includes video
+func (t Tracks) Video() bool {
+	return t&TrackVideo != 0
+}
+
+// Audio reports whether the set includes audio
+func (t Tracks) Audio() bool {
+	return t&TrackAudio != 0
+}
+
+// Names returns the track kinds in the set, video first
+func (t Tracks) Names() []string {
+	var names []string
+	if t.Video() {
+		names = append(names, "video")
+	}
+	if t.Audio() {
+		names = append(names, "audio")
+	}
+	return names
+}
+
+func (t Tracks) String() string {
+	if t == 0 {
+		return "none"
+	}
+	return strings.Join(t.Names(), ",")
+}
+
+// ParseTracks parses the track kinds a client asks for during signaling,
+// e.g. ["audio"] for a second device that only plays sound. An empty list
+// subscribes to everything, as clients that predate subscriptions expect.
+func ParseTracks(names []string) (Tracks, error) {
+	if len(names) == 0 {
+		return TracksAll, nil
+	}
+
+	var t Tracks
+	for _, name := range names {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "video":
+			t |= TrackVideo
+		case "audio":
+			t |= TrackAudio
+		default:
+			return 0, fmt.Errorf("unknown track kind %q", name)
+		}
+	}
+	return t, nil
+}
+
+// Subscriptions records which tracks each peer asked for. Signaling sets a
+// peer's subscription when it negotiates; peers without one get every track.
+type Subscriptions struct {
+	mu    sync.RWMutex
+	peers map[string]Tracks
+}
+
+// NewSubscriptions creates an empty subscription registry
+func NewSubscriptions() *Subscriptions {
+	return &Subscriptions{peers: make(map[string]Tracks)}
+}
+
+// Set records the tracks peerID subscribes to
+func (s *Subscriptions) Set(peerID string, tracks Tracks) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[peerID] = tracks
+}
+
+// Remove forgets peerID's subscription
+func (s *Subscriptions) Remove(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, peerID)
+}
+
+// Tracks returns the tracks peerID subscribes to
+func (s *Subscriptions) Tracks(peerID string) Tracks {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if t, ok := s.peers[peerID]; ok {
+		return t
+	}
+	return TracksAll
+}
+
+// Snapshot returns every explicit subscription, keyed by peer ID
+func (s *Subscriptions) Snapshot() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]string, len(s.peers))
+	for id, t := range s.peers {
+		out[id] = t.String()
+	}
+	return out
+}
@@ -0,0 +1,97 @@
+package v4l2
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"sync"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/encoder"
+)
+
+// yuyvToI420 converts packed YUYV 4:2:2 into a 4:2:0 picture
+func yuyvToI420(data []byte, width, height, stride int) (*image.YCbCr, error) {
+	if stride < width*2 || len(data) < stride*(height-1)+width*2 {
+		return nil, errors.New("short YUYV buffer")
+	}
+
+	img := image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio420)
+	for y := 0; y < height; y++ {
+		row := data[y*stride:]
+		yRow := img.Y[y*img.YStride:]
+		for x := 0; x < width; x++ {
+			yRow[x] = row[x*2]
+		}
+
+		// Take chroma from even rows only
+		if y%2 != 0 {
+			continue
+		}
+		cRow := (y / 2) * img.CStride
+		for x := 0; x+1 < width; x += 2 {
+			img.Cb[cRow+x/2] = row[x*2+1]
+			img.Cr[cRow+x/2] = row[x*2+3]
+		}
+	}
+	return img, nil
+}
+
+var (
+	defaultDHTOnce sync.Once
+	defaultDHT     []byte
+)
+
+// standardHuffmanTables returns a DHT segment with the JPEG Annex K tables.
+// The standard library encoder always emits them, so borrow its output.
+func standardHuffmanTables() []byte {
+	defaultDHTOnce.Do(func() {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, image.NewYCbCr(image.Rect(0, 0, 8, 8), image.YCbCrSubsampleRatio420), nil); err != nil {
+			return
+		}
+		encoded := buf.Bytes()
+		if start := findMarker(encoded, 0xC4); start >= 0 && start+4 <= len(encoded) {
+			length := int(encoded[start+2])<<8 | int(encoded[start+3])
+			defaultDHT = append([]byte(nil), encoded[start:start+2+length]...)
+		}
+	})
+	return defaultDHT
+}
+
+// findMarker returns the offset of the first 0xFF<marker> before the scan data
+func findMarker(data []byte, marker byte) int {
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] != 0xFF {
+			continue
+		}
+		if data[i+1] == marker {
+			return i
+		}
+		if data[i+1] == 0xDA { // start of scan
+			return -1
+		}
+	}
+	return -1
+}
+
+// decodeMJPEG decodes a UVC MJPEG frame into a 4:2:0 picture. Many UVC devices
+// omit the Huffman tables and rely on the standard ones, so insert them.
+func decodeMJPEG(data []byte) (*image.YCbCr, error) {
+	if findMarker(data, 0xC4) < 0 {
+		sos := findMarker(data, 0xDA)
+		if dht := standardHuffmanTables(); sos > 0 && dht != nil {
+			patched := make([]byte, 0, len(data)+len(dht))
+			patched = append(patched, data[:sos]...)
+			patched = append(patched, dht...)
+			patched = append(patched, data[sos:]...)
+			data = patched
+		}
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return encoder.ToI420(img), nil
+}
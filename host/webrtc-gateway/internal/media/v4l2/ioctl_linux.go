@@ -0,0 +1,146 @@
+//go:build linux && (amd64 || arm64)
+
+package v4l2
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Struct layouts below mirror <linux/videodev2.h> on 64-bit platforms.
+
+const (
+	capVideoCapture = 0x00000001
+	capStreaming    = 0x04000000
+	capDeviceCaps   = 0x80000000
+
+	bufTypeVideoCapture = 1
+	memoryMMAP          = 1
+	fieldNone           = 1
+)
+
+type v4l2Capability struct {
+	Driver       [16]uint8
+	Card         [32]uint8
+	BusInfo      [32]uint8
+	Version      uint32
+	Capabilities uint32
+	DeviceCaps   uint32
+	Reserved     [3]uint32
+}
+
+type v4l2PixFormat struct {
+	Width        uint32
+	Height       uint32
+	PixelFormat  uint32
+	Field        uint32
+	BytesPerLine uint32
+	SizeImage    uint32
+	Colorspace   uint32
+	Priv         uint32
+	Flags        uint32
+	YCbCrEnc     uint32
+	Quantization uint32
+	XferFunc     uint32
+}
+
+type v4l2Format struct {
+	Type uint32
+	_    uint32 // union is 8-byte aligned
+	Pix  v4l2PixFormat
+	_    [200 - unsafe.Sizeof(v4l2PixFormat{})]uint8
+}
+
+type v4l2Fract struct {
+	Numerator   uint32
+	Denominator uint32
+}
+
+type v4l2CaptureParm struct {
+	Capability   uint32
+	CaptureMode  uint32
+	TimePerFrame v4l2Fract
+	ExtendedMode uint32
+	ReadBuffers  uint32
+	Reserved     [4]uint32
+}
+
+type v4l2StreamParm struct {
+	Type    uint32
+	Capture v4l2CaptureParm
+	_       [200 - unsafe.Sizeof(v4l2CaptureParm{})]uint8
+}
+
+type v4l2RequestBuffers struct {
+	Count        uint32
+	Type         uint32
+	Memory       uint32
+	Capabilities uint32
+	Flags        uint8
+	Reserved     [3]uint8
+}
+
+type v4l2Timecode struct {
+	Type     uint32
+	Flags    uint32
+	Frames   uint8
+	Seconds  uint8
+	Minutes  uint8
+	Hours    uint8
+	UserBits [4]uint8
+}
+
+type v4l2Buffer struct {
+	Index     uint32
+	Type      uint32
+	BytesUsed uint32
+	Flags     uint32
+	Field     uint32
+	_         uint32 // timeval is 8-byte aligned
+	Timestamp unix.Timeval
+	Timecode  v4l2Timecode
+	Sequence  uint32
+	Memory    uint32
+	Offset    uint32 // m.offset (union with 8-byte userptr)
+	_         uint32
+	Length    uint32
+	Reserved2 uint32
+	RequestFD int32
+	_         uint32
+}
+
+const (
+	iocWrite = 1
+	iocRead  = 2
+)
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | uintptr('V')<<8 | nr
+}
+
+var (
+	vidiocQueryCap  = ioc(iocRead, 0, unsafe.Sizeof(v4l2Capability{}))
+	vidiocSFmt      = ioc(iocRead|iocWrite, 5, unsafe.Sizeof(v4l2Format{}))
+	vidiocReqBufs   = ioc(iocRead|iocWrite, 8, unsafe.Sizeof(v4l2RequestBuffers{}))
+	vidiocQueryBuf  = ioc(iocRead|iocWrite, 9, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocQBuf      = ioc(iocRead|iocWrite, 15, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocDQBuf     = ioc(iocRead|iocWrite, 17, unsafe.Sizeof(v4l2Buffer{}))
+	vidiocStreamOn  = ioc(iocWrite, 18, unsafe.Sizeof(int32(0)))
+	vidiocStreamOff = ioc(iocWrite, 19, unsafe.Sizeof(int32(0)))
+	vidiocSParm     = ioc(iocRead|iocWrite, 22, unsafe.Sizeof(v4l2StreamParm{}))
+)
+
+// ioctl issues a V4L2 ioctl, retrying on EINTR
+func ioctl(fd int, req uintptr, arg unsafe.Pointer) error {
+	for {
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
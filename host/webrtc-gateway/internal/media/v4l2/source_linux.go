@@ -0,0 +1,499 @@
+//go:build linux && (amd64 || arm64)
+
+package v4l2
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/sys/unix"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/encoder"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Source captures frames from a V4L2 device using mmap streaming I/O
+type Source struct {
+	cfg      Config
+	logger   zerolog.Logger
+	warnings *logging.Summarizer // Rate-limits per-frame warnings
+
+	fd      int
+	buffers [][]byte
+
+	videoFrames chan media.VideoFrame
+
+	mu      sync.Mutex
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	// Negotiated format (may differ from the request)
+	width  int
+	height int
+	stride int
+
+	// Software encoder for raw formats, nil for H.264 passthrough
+	enc encoder.Encoder
+
+	// The last raw picture, kept for MinFrameRate, with the timestamp and
+	// time of the last frame sent; owned by the capture goroutine
+	lastPicture *image.YCbCr
+	lastPTS     int64
+	lastAt      time.Time
+
+	// Frame budget stages; nil without a budget
+	convertStage *media.BudgetStage
+	encodeStage  *media.BudgetStage
+
+	// Statistics
+	frameCount atomic.Uint64
+	dropCount  atomic.Uint64
+	dupCount   atomic.Uint64
+}
+
+// NewSource creates a new V4L2 capture source. The device is opened on Start.
+func NewSource(cfg Config, logger zerolog.Logger) *Source {
+	// Apply defaults for zero values
+	if cfg.BufferCount <= 0 {
+		cfg.BufferCount = 4
+	}
+	if cfg.VideoBufferSize <= 0 {
+		cfg.VideoBufferSize = 30
+	}
+
+	logger = logger.With().Str("component", "v4l2_source").Str("device", cfg.Device).Logger()
+	return &Source{
+		cfg:          cfg,
+		logger:       logger,
+		warnings:     logging.NewSummarizer(logger),
+		fd:           -1,
+		videoFrames:  make(chan media.VideoFrame, cfg.VideoBufferSize),
+		convertStage: cfg.Budget.Stage("v4l2.convert"),
+		encodeStage:  cfg.Budget.Stage("v4l2.encode"),
+	}
+}
+
+// Start opens the device, negotiates the format and begins streaming
+func (s *Source) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return errors.New("v4l2 source already started")
+	}
+
+	if !s.cfg.PixelFormat.IsEncoded() && s.cfg.Encoder == nil {
+		return fmt.Errorf("pixel format %q requires a software encoder", s.cfg.PixelFormat)
+	}
+
+	fd, err := unix.Open(s.cfg.Device, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", s.cfg.Device, err)
+	}
+	s.fd = fd
+
+	if err := s.configure(); err != nil {
+		s.release()
+		return err
+	}
+
+	if !s.cfg.PixelFormat.IsEncoded() {
+		encCfg := *s.cfg.Encoder
+		encCfg.Width = s.width
+		encCfg.Height = s.height
+		encCfg.FrameRate = s.cfg.FrameRate
+		enc, err := encoder.New(encCfg)
+		if err != nil {
+			s.release()
+			return fmt.Errorf("failed to create encoder: %w", err)
+		}
+		s.enc = enc
+	}
+
+	if err := s.mapBuffers(); err != nil {
+		s.release()
+		return err
+	}
+
+	bufType := int32(bufTypeVideoCapture)
+	if err := ioctl(s.fd, vidiocStreamOn, unsafe.Pointer(&bufType)); err != nil {
+		s.release()
+		return fmt.Errorf("VIDIOC_STREAMON failed: %w", err)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.running = true
+	s.lastPicture = nil
+
+	go s.captureLoop(runCtx)
+
+	s.logger.Info().
+		Int("width", s.width).
+		Int("height", s.height).
+		Int("fps", s.cfg.FrameRate).
+		Str("pixel_format", string(s.cfg.PixelFormat)).
+		Int("buffers", len(s.buffers)).
+		Bool("encoding", s.enc != nil).
+		Int("min_fps", s.cfg.MinFrameRate).
+		Msg("V4L2 capture started")
+
+	return nil
+}
+
+// Stop stops streaming and closes the device
+func (s *Source) Stop() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	s.running = false
+	s.cancel()
+	done := s.done
+	s.mu.Unlock()
+
+	<-done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stopErr error
+	bufType := int32(bufTypeVideoCapture)
+	if err := ioctl(s.fd, vidiocStreamOff, unsafe.Pointer(&bufType)); err != nil {
+		stopErr = fmt.Errorf("VIDIOC_STREAMOFF failed: %w", err)
+	}
+	s.release()
+
+	s.logger.Info().
+		Uint64("frames", s.frameCount.Load()).
+		Uint64("dropped", s.dropCount.Load()).
+		Msg("V4L2 capture stopped")
+
+	return stopErr
+}
+
+// VideoFrameChannel returns the channel for receiving captured frames
+func (s *Source) VideoFrameChannel() <-chan media.VideoFrame {
+	return s.videoFrames
+}
+
+// Stats returns captured and dropped frame counts
+func (s *Source) Stats() (frames, dropped uint64) {
+	return s.frameCount.Load(), s.dropCount.Load()
+}
+
+// Duplicated returns how many repeated pictures were sent to keep
+// MinFrameRate
+func (s *Source) Duplicated() uint64 {
+	return s.dupCount.Load()
+}
+
+// NominalFPS returns the requested capture frame rate
+func (s *Source) NominalFPS() float64 {
+	return float64(s.cfg.FrameRate)
+}
+
+// configure checks device capabilities and negotiates format and frame rate
+func (s *Source) configure() error {
+	var caps v4l2Capability
+	if err := ioctl(s.fd, vidiocQueryCap, unsafe.Pointer(&caps)); err != nil {
+		return fmt.Errorf("VIDIOC_QUERYCAP failed: %w", err)
+	}
+
+	deviceCaps := caps.Capabilities
+	if deviceCaps&capDeviceCaps != 0 {
+		deviceCaps = caps.DeviceCaps
+	}
+	if deviceCaps&capVideoCapture == 0 {
+		return fmt.Errorf("%s is not a video capture device", s.cfg.Device)
+	}
+	if deviceCaps&capStreaming == 0 {
+		return fmt.Errorf("%s does not support streaming I/O", s.cfg.Device)
+	}
+
+	format := v4l2Format{Type: bufTypeVideoCapture}
+	format.Pix.Width = uint32(s.cfg.Width)
+	format.Pix.Height = uint32(s.cfg.Height)
+	format.Pix.PixelFormat = s.cfg.PixelFormat.fourcc()
+	format.Pix.Field = fieldNone
+	if err := ioctl(s.fd, vidiocSFmt, unsafe.Pointer(&format)); err != nil {
+		return fmt.Errorf("VIDIOC_S_FMT failed: %w", err)
+	}
+	if format.Pix.PixelFormat != s.cfg.PixelFormat.fourcc() {
+		return fmt.Errorf("%s does not support pixel format %q", s.cfg.Device, s.cfg.PixelFormat)
+	}
+	s.width = int(format.Pix.Width)
+	s.height = int(format.Pix.Height)
+	s.stride = int(format.Pix.BytesPerLine)
+
+	if s.width != s.cfg.Width || s.height != s.cfg.Height {
+		s.logger.Warn().
+			Int("requested_width", s.cfg.Width).
+			Int("requested_height", s.cfg.Height).
+			Int("width", s.width).
+			Int("height", s.height).
+			Msg("Driver adjusted capture resolution")
+	}
+
+	// Frame rate is best-effort; not every driver supports S_PARM
+	parm := v4l2StreamParm{Type: bufTypeVideoCapture}
+	parm.Capture.TimePerFrame = v4l2Fract{Numerator: 1, Denominator: uint32(s.cfg.FrameRate)}
+	if err := ioctl(s.fd, vidiocSParm, unsafe.Pointer(&parm)); err != nil {
+		s.logger.Warn().Err(err).Msg("VIDIOC_S_PARM failed, using driver default frame rate")
+	}
+
+	return nil
+}
+
+// mapBuffers requests and memory-maps capture buffers, then queues them
+func (s *Source) mapBuffers() error {
+	req := v4l2RequestBuffers{
+		Count:  uint32(s.cfg.BufferCount),
+		Type:   bufTypeVideoCapture,
+		Memory: memoryMMAP,
+	}
+	if err := ioctl(s.fd, vidiocReqBufs, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("VIDIOC_REQBUFS failed: %w", err)
+	}
+	if req.Count < 2 {
+		return fmt.Errorf("insufficient buffer memory on %s", s.cfg.Device)
+	}
+
+	s.buffers = make([][]byte, 0, req.Count)
+	for i := uint32(0); i < req.Count; i++ {
+		buf := v4l2Buffer{Index: i, Type: bufTypeVideoCapture, Memory: memoryMMAP}
+		if err := ioctl(s.fd, vidiocQueryBuf, unsafe.Pointer(&buf)); err != nil {
+			return fmt.Errorf("VIDIOC_QUERYBUF failed: %w", err)
+		}
+
+		data, err := unix.Mmap(s.fd, int64(buf.Offset), int(buf.Length), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			return fmt.Errorf("mmap buffer %d failed: %w", i, err)
+		}
+		s.buffers = append(s.buffers, data)
+
+		if err := ioctl(s.fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+			return fmt.Errorf("VIDIOC_QBUF failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// release unmaps buffers, closes the encoder and closes the device
+func (s *Source) release() {
+	if s.enc != nil {
+		s.enc.Close()
+		s.enc = nil
+	}
+
+	for _, b := range s.buffers {
+		unix.Munmap(b)
+	}
+	s.buffers = nil
+
+	if s.fd >= 0 {
+		unix.Close(s.fd)
+		s.fd = -1
+	}
+}
+
+// captureLoop dequeues filled buffers and forwards them as frames
+func (s *Source) captureLoop(ctx context.Context) {
+	defer close(s.done)
+
+	pollFds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLIN}}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		// Poll with a timeout so cancellation is noticed promptly, and the
+		// last picture is repeated on time
+		n, err := unix.Poll(pollFds, s.pollTimeout())
+		if err != nil {
+			if errors.Is(err, unix.EINTR) {
+				continue
+			}
+			s.logger.Error().Err(err).Msg("Poll failed, stopping capture")
+			return
+		}
+		if n == 0 {
+			s.duplicate(time.Now())
+			continue
+		}
+
+		buf := v4l2Buffer{Type: bufTypeVideoCapture, Memory: memoryMMAP}
+		if err := ioctl(s.fd, vidiocDQBuf, unsafe.Pointer(&buf)); err != nil {
+			if errors.Is(err, unix.EAGAIN) {
+				continue
+			}
+			s.logger.Error().Err(err).Msg("VIDIOC_DQBUF failed, stopping capture")
+			return
+		}
+
+		// Copy out of the mmap buffer before handing it back to the driver
+		data := make([]byte, buf.BytesUsed)
+		copy(data, s.buffers[buf.Index][:buf.BytesUsed])
+
+		if err := ioctl(s.fd, vidiocQBuf, unsafe.Pointer(&buf)); err != nil {
+			s.logger.Error().Err(err).Msg("VIDIOC_QBUF failed, stopping capture")
+			return
+		}
+
+		pts := buf.Timestamp.Sec*int64(time.Second) + buf.Timestamp.Usec*int64(time.Microsecond)
+		if s.lastPicture != nil && pts <= s.lastPTS {
+			// Captured before a repeat went out; keep timestamps rising
+			pts = s.lastPTS + int64(time.Millisecond)
+		}
+		frame, err := s.buildFrame(data, pts)
+		if err != nil {
+			s.dropCount.Add(1)
+			s.warnings.Warn("Failed to process captured frame", func(e *zerolog.Event) { e.Err(err) })
+			continue
+		}
+		s.lastPTS, s.lastAt = pts, time.Now()
+		if s.send(frame) {
+			s.frameCount.Add(1)
+		}
+	}
+}
+
+// send queues a frame without blocking, and reports whether it was queued
+func (s *Source) send(frame media.VideoFrame) bool {
+	select {
+	case s.videoFrames <- frame:
+		return true
+	default:
+		s.dropCount.Add(1)
+		s.warnings.Warn("Video frame channel full, dropping frame", nil)
+		return false
+	}
+}
+
+// pollTimeout returns how long to wait for the device, in milliseconds:
+// until the last picture is due to be repeated, at most 200ms
+func (s *Source) pollTimeout() int {
+	const maxWait = 200 * time.Millisecond
+	if s.cfg.MinFrameRate <= 0 || s.lastPicture == nil {
+		return int(maxWait / time.Millisecond)
+	}
+	wait := min(max(time.Until(s.lastAt.Add(s.minInterval())), 0), maxWait)
+	// Round up so the repeat is due when poll returns
+	return int((wait + time.Millisecond - 1) / time.Millisecond)
+}
+
+// minInterval is the longest gap between frames MinFrameRate allows
+func (s *Source) minInterval() time.Duration {
+	return time.Second / time.Duration(s.cfg.MinFrameRate)
+}
+
+// duplicate encodes the last picture again when the device has sent
+// nothing for the MinFrameRate interval, so the encoder, peers and
+// recorders downstream keep that rate while the device slows down. The
+// repeat is stamped one interval after the last frame.
+func (s *Source) duplicate(now time.Time) {
+	if s.cfg.MinFrameRate <= 0 || s.lastPicture == nil || now.Sub(s.lastAt) < s.minInterval() {
+		return
+	}
+
+	pts := s.lastPTS + int64(s.minInterval())
+	s.lastPTS, s.lastAt = pts, now
+	// The encoder's overlay draws on its input; keep the original clean
+	frame, err := s.encodeFrame(clonePicture(s.lastPicture), pts)
+	if err != nil {
+		s.warnings.Warn("Failed to repeat the last picture", func(e *zerolog.Event) { e.Err(err) })
+		return
+	}
+	if s.send(frame) {
+		s.dupCount.Add(1)
+	}
+}
+
+// buildFrame turns a captured buffer into an encoded frame, decoding and
+// encoding raw formats as needed
+func (s *Source) buildFrame(data []byte, pts int64) (media.VideoFrame, error) {
+	frame := s.newFrame(pts)
+	if s.enc == nil {
+		frame.Data = data
+		frame.IsKeyframe = isH264Keyframe(data)
+		return frame, nil
+	}
+
+	var (
+		img *image.YCbCr
+		err error
+	)
+	start := s.convertStage.Begin()
+	switch s.cfg.PixelFormat {
+	case PixelFormatYUYV:
+		img, err = yuyvToI420(data, s.width, s.height, s.stride)
+	case PixelFormatMJPEG:
+		img, err = decodeMJPEG(data)
+	default:
+		err = fmt.Errorf("unsupported raw pixel format %q", s.cfg.PixelFormat)
+	}
+	s.convertStage.End(start)
+	if err != nil {
+		return frame, err
+	}
+
+	if s.cfg.MinFrameRate > 0 {
+		s.lastPicture = clonePicture(img)
+	}
+	return s.encodeFrame(img, pts)
+}
+
+// encodeFrame encodes a raw picture
+func (s *Source) encodeFrame(img *image.YCbCr, pts int64) (media.VideoFrame, error) {
+	frame := s.newFrame(pts)
+	start := s.encodeStage.Begin()
+	encoded, err := s.enc.Encode(img, pts)
+	s.encodeStage.End(start)
+	if err != nil {
+		return frame, err
+	}
+	if len(encoded.Data) == 0 {
+		return frame, errors.New("encoder produced no output")
+	}
+
+	frame.Data = encoded.Data
+	frame.IsKeyframe = encoded.IsKeyframe
+	return frame, nil
+}
+
+// newFrame returns a frame of the negotiated size, without data
+func (s *Source) newFrame(pts int64) media.VideoFrame {
+	return media.VideoFrame{
+		PTS:        pts,
+		DTS:        pts,
+		Width:      s.width,
+		Height:     s.height,
+		Codec:      "h264",
+		ReceivedAt: time.Now(),
+	}
+}
+
+// clonePicture returns a copy of img
+func clonePicture(img *image.YCbCr) *image.YCbCr {
+	c := *img
+	c.Y = slices.Clone(img.Y)
+	c.Cb = slices.Clone(img.Cb)
+	c.Cr = slices.Clone(img.Cr)
+	return &c
+}
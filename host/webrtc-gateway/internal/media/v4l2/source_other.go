@@ -0,0 +1,51 @@
+//go:build !linux || !(amd64 || arm64)
+
+package v4l2
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Source is unavailable on this platform; Start always fails
+type Source struct {
+	videoFrames chan media.VideoFrame
+}
+
+// NewSource creates a V4L2 source that reports ErrUnsupported on Start
+func NewSource(cfg Config, logger zerolog.Logger) *Source {
+	return &Source{videoFrames: make(chan media.VideoFrame)}
+}
+
+// Start always returns ErrUnsupported
+func (s *Source) Start(ctx context.Context) error {
+	return ErrUnsupported
+}
+
+// Stop is a no-op
+func (s *Source) Stop() error {
+	return nil
+}
+
+// VideoFrameChannel returns a channel that never delivers frames
+func (s *Source) VideoFrameChannel() <-chan media.VideoFrame {
+	return s.videoFrames
+}
+
+// Stats always reports zero
+func (s *Source) Stats() (frames, dropped uint64) {
+	return 0, 0
+}
+
+// Duplicated always reports zero
+func (s *Source) Duplicated() uint64 {
+	return 0
+}
+
+// NominalFPS always reports zero
+func (s *Source) NominalFPS() float64 {
+	return 0
+}
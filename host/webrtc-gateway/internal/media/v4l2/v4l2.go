@@ -0,0 +1,113 @@
+// Package v4l2 provides a direct Video4Linux2 capture source for Linux hosts.
+// It lets UVC capture cards (Elgato, Cam Link, ...) feed the gateway without a
+// separate capture service.
+package v4l2
+
+import (
+	"errors"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/encoder"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// PixelFormat identifies the format requested from the capture device
+type PixelFormat string
+
+const (
+	// PixelFormatH264 is passed through to peers untouched
+	PixelFormatH264 PixelFormat = "h264"
+	// PixelFormatMJPEG must be decoded and re-encoded before distribution
+	PixelFormatMJPEG PixelFormat = "mjpeg"
+	// PixelFormatYUYV (packed 4:2:2) must be encoded before distribution
+	PixelFormatYUYV PixelFormat = "yuyv"
+)
+
+// fourcc returns the V4L2 fourcc code for the pixel format
+func (p PixelFormat) fourcc() uint32 {
+	switch p {
+	case PixelFormatH264:
+		return fourcc('H', '2', '6', '4')
+	case PixelFormatMJPEG:
+		return fourcc('M', 'J', 'P', 'G')
+	case PixelFormatYUYV:
+		return fourcc('Y', 'U', 'Y', 'V')
+	default:
+		return 0
+	}
+}
+
+// IsEncoded returns true if the device delivers H.264 that can be forwarded as-is
+func (p PixelFormat) IsEncoded() bool {
+	return p == PixelFormatH264
+}
+
+func fourcc(a, b, c, d byte) uint32 {
+	return uint32(a) | uint32(b)<<8 | uint32(c)<<16 | uint32(d)<<24
+}
+
+// ErrUnsupported is returned when V4L2 capture is not available on this platform
+var ErrUnsupported = errors.New("v4l2 capture is only supported on 64-bit Linux")
+
+// Config configures the V4L2 capture source
+type Config struct {
+	Device          string      // Device node, e.g. /dev/video0
+	Width           int         // Requested width (driver may adjust)
+	Height          int         // Requested height (driver may adjust)
+	FrameRate       int         // Requested frame rate
+	PixelFormat     PixelFormat // Requested capture format
+	BufferCount     int         // Number of mmap buffers, default 4
+	VideoBufferSize int         // Output channel buffer size, default 30
+
+	// Encoder configures the software encoder used for raw formats (MJPEG,
+	// YUYV). Size and frame rate are filled in from the negotiated format.
+	// Required unless PixelFormat is H.264.
+	Encoder *encoder.Config
+
+	// MinFrameRate is the lowest rate frames are delivered at from raw
+	// formats: when the device sends nothing for 1/MinFrameRate, the last
+	// picture is encoded again. 0 disables; H.264 is never repeated.
+	MinFrameRate int
+
+	// Budget, when set, times converting and encoding raw frames as the
+	// "v4l2.convert" and "v4l2.encode" stages
+	Budget *media.FrameBudget
+}
+
+// DefaultConfig returns sensible defaults for a 1080p60 H.264 UVC device
+func DefaultConfig() Config {
+	return Config{
+		Device:          "/dev/video0",
+		Width:           1920,
+		Height:          1080,
+		FrameRate:       60,
+		PixelFormat:     PixelFormatH264,
+		BufferCount:     4,
+		VideoBufferSize: 30,
+	}
+}
+
+// isH264Keyframe scans Annex B data for an IDR slice or SPS NAL unit
+func isH264Keyframe(data []byte) bool {
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 {
+			continue
+		}
+		var nalStart int
+		if data[i+2] == 1 {
+			nalStart = i + 3
+		} else if data[i+2] == 0 && i+4 < len(data) && data[i+3] == 1 {
+			nalStart = i + 4
+		} else {
+			continue
+		}
+		if nalStart >= len(data) {
+			return false
+		}
+		switch data[nalStart] & 0x1F {
+		case 5, 7: // IDR slice, SPS
+			return true
+		}
+		i = nalStart
+	}
+	return false
+}
@@ -0,0 +1,277 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// WatchdogConfig configures a Watchdog
+type WatchdogConfig struct {
+	// StallTimeout is the frame gap after which the source counts as
+	// stalled, default 3s
+	StallTimeout time.Duration
+
+	// RestartAfter restarts the source once it has been stalled this long,
+	// and again after each further RestartAfter. Zero disables restarts.
+	RestartAfter time.Duration
+
+	CheckInterval time.Duration // How often to check, default StallTimeout/4
+}
+
+// WatchdogEventType identifies a watchdog event
+type WatchdogEventType string
+
+const (
+	WatchdogStalled       WatchdogEventType = "stalled"        // The source stopped delivering frames
+	WatchdogRecovered     WatchdogEventType = "recovered"      // Frames resumed after a stall
+	WatchdogRestarted     WatchdogEventType = "restarted"      // The source was restarted
+	WatchdogRestartFailed WatchdogEventType = "restart_failed" // Restarting the source failed
+)
+
+// WatchdogEvent describes a stall or recovery action
+type WatchdogEvent struct {
+	Type       WatchdogEventType
+	StalledFor time.Duration
+	Restarts   int   // Restarts during this stall
+	Err        error // Set for WatchdogRestartFailed
+}
+
+// WatchdogStats is a snapshot of watchdog counters
+type WatchdogStats struct {
+	Stalled  bool   `json:"stalled"`
+	Stalls   uint64 `json:"stalls"`
+	Restarts uint64 `json:"restarts"`
+}
+
+// Watchdog detects a source that has stopped delivering frames. On a stall
+// it logs diagnostics, requests a keyframe, and optionally restarts the
+// source. Restarting relies on the source keeping its frame channel across
+// Stop and Start, as the built-in sources do, so downstream consumers are
+// unaffected.
+type Watchdog struct {
+	cfg       WatchdogConfig
+	source    FrameSource
+	lastFrame func() time.Time
+	logger    zerolog.Logger
+
+	mu      sync.Mutex
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+	onEvent func(WatchdogEvent)
+
+	// Stall state, owned by the watchdog goroutine
+	stalled     bool
+	stallStart  time.Time
+	lastRestart time.Time
+	restarts    int
+
+	stalledFlag atomic.Bool
+
+	// Statistics
+	stallCount   atomic.Uint64
+	restartCount atomic.Uint64
+}
+
+// NewWatchdog creates a watchdog for source. lastFrame reports when the
+// source last delivered a frame; Distributor.LastFrameAt fits.
+func NewWatchdog(cfg WatchdogConfig, source FrameSource, lastFrame func() time.Time, logger zerolog.Logger) *Watchdog {
+	// Apply defaults for zero values
+	if cfg.StallTimeout <= 0 {
+		cfg.StallTimeout = 3 * time.Second
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = cfg.StallTimeout / 4
+	}
+
+	return &Watchdog{
+		cfg:       cfg,
+		source:    source,
+		lastFrame: lastFrame,
+		logger:    logger.With().Str("component", "watchdog").Logger(),
+	}
+}
+
+// SetOnEvent sets a callback for stalls and recovery actions. It runs on the
+// watchdog goroutine and must not block.
+func (w *Watchdog) SetOnEvent(fn func(WatchdogEvent)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.onEvent = fn
+}
+
+// Start begins watching; returns immediately. ctx is also the context the
+// source is restarted with, so it should be the one the source was started
+// with.
+func (w *Watchdog) Start(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.running {
+		return errors.New("watchdog already started")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	w.cancel = cancel
+	w.done = make(chan struct{})
+	w.running = true
+
+	go w.run(ctx, runCtx)
+
+	w.logger.Info().
+		Dur("stall_timeout", w.cfg.StallTimeout).
+		Dur("restart_after", w.cfg.RestartAfter).
+		Msg("Watchdog started")
+
+	return nil
+}
+
+// Stop stops watching and waits for any restart in progress to finish
+func (w *Watchdog) Stop() {
+	w.mu.Lock()
+	if !w.running {
+		w.mu.Unlock()
+		return
+	}
+	w.running = false
+	w.cancel()
+	done := w.done
+	w.mu.Unlock()
+
+	<-done
+}
+
+// Stats returns a snapshot of watchdog counters
+func (w *Watchdog) Stats() WatchdogStats {
+	return WatchdogStats{
+		Stalled:  w.stalledFlag.Load(),
+		Stalls:   w.stallCount.Load(),
+		Restarts: w.restartCount.Load(),
+	}
+}
+
+// run checks the source periodically
+func (w *Watchdog) run(sourceCtx, ctx context.Context) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.cfg.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			w.check(sourceCtx, now)
+		}
+	}
+}
+
+// check detects stalls and recoveries and restarts the source when due
+func (w *Watchdog) check(sourceCtx context.Context, now time.Time) {
+	last := w.lastFrame()
+	gap := now.Sub(last)
+
+	if gap < w.cfg.StallTimeout {
+		if w.stalled {
+			stalledFor := now.Sub(w.stallStart)
+			w.logger.Info().
+				Dur("stalled_for", stalledFor).
+				Int("restarts", w.restarts).
+				Msg("Video source recovered")
+			w.emit(WatchdogEvent{Type: WatchdogRecovered, StalledFor: stalledFor, Restarts: w.restarts})
+			w.stalled = false
+			w.stalledFlag.Store(false)
+		}
+		return
+	}
+
+	if !w.stalled {
+		w.stalled = true
+		w.stallStart = last
+		w.lastRestart = time.Time{}
+		w.restarts = 0
+		w.stalledFlag.Store(true)
+		w.stallCount.Add(1)
+
+		w.diagnostics(gap, last).Msg("Video source stalled")
+		w.emit(WatchdogEvent{Type: WatchdogStalled, StalledFor: gap})
+
+		// A source that is merely waiting for its next IDR recovers here
+		if kr, ok := w.source.(KeyframeRequester); ok {
+			kr.ForceKeyframe()
+		}
+		return
+	}
+
+	if w.cfg.RestartAfter <= 0 {
+		return
+	}
+	since := w.stallStart
+	if !w.lastRestart.IsZero() {
+		since = w.lastRestart
+	}
+	if now.Sub(since) < w.cfg.RestartAfter {
+		return
+	}
+
+	w.restart(sourceCtx, now)
+}
+
+// restart stops and starts the source
+func (w *Watchdog) restart(ctx context.Context, now time.Time) {
+	w.lastRestart = now
+	w.restarts++
+	stalledFor := now.Sub(w.stallStart)
+
+	w.logger.Warn().
+		Dur("stalled_for", stalledFor).
+		Int("attempt", w.restarts).
+		Msg("Restarting stalled video source")
+
+	if err := w.source.Stop(); err != nil {
+		w.logger.Warn().Err(err).Msg("Error stopping stalled video source")
+	}
+	if err := w.source.Start(ctx); err != nil {
+		w.logger.Error().Err(err).Msg("Failed to restart video source")
+		w.emit(WatchdogEvent{Type: WatchdogRestartFailed, StalledFor: stalledFor, Restarts: w.restarts, Err: err})
+		return
+	}
+
+	w.restartCount.Add(1)
+	w.emit(WatchdogEvent{Type: WatchdogRestarted, StalledFor: stalledFor, Restarts: w.restarts})
+}
+
+// diagnostics returns a warning log event describing the source's state
+func (w *Watchdog) diagnostics(gap time.Duration, last time.Time) *zerolog.Event {
+	ev := w.logger.Warn().
+		Dur("gap", gap).
+		Time("last_frame", last).
+		Int("queued_frames", len(w.source.VideoFrameChannel())).
+		Int("goroutines", runtime.NumGoroutine())
+
+	if cr, ok := w.source.(ConnectionReporter); ok {
+		ev = ev.Bool("producer_connected", cr.IsConnected())
+	}
+	if st, ok := w.source.(interface{ Stats() (uint64, uint64) }); ok {
+		frames, dropped := st.Stats()
+		ev = ev.Uint64("source_frames", frames).Uint64("source_dropped", dropped)
+	}
+	return ev
+}
+
+// emit notifies the callback
+func (w *Watchdog) emit(event WatchdogEvent) {
+	w.mu.Lock()
+	fn := w.onEvent
+	w.mu.Unlock()
+	if fn != nil {
+		fn(event)
+	}
+}
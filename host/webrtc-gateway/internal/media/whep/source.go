@@ -0,0 +1,421 @@
+// Package whep provides a WHEP client video source. It pulls H.264 from
+// another gateway, or any WHEP server, so this gateway can relay the stream
+// to its own viewers and fan out beyond one host's uplink.
+package whep
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/samplebuilder"
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Config configures a WHEP source
+type Config struct {
+	URL             string             // WHEP endpoint, http:// or https://
+	Token           string             // Bearer token, if the endpoint requires one
+	Timeout         time.Duration      // Signaling and connect timeout, default 10s
+	ReconnectDelay  time.Duration      // Delay between reconnect attempts, default 2s
+	ICEServers      []webrtc.ICEServer // STUN/TURN servers for reaching the upstream
+	VideoBufferSize int                // Output channel buffer size, default 30
+}
+
+// maxLatePackets is how far the sample builder waits for reordered packets
+const maxLatePackets = 512
+
+// Source receives video from a WHEP endpoint over WebRTC and delivers it as
+// Annex-B access units, reconnecting automatically
+type Source struct {
+	cfg      Config
+	logger   zerolog.Logger
+	warnings *logging.Summarizer // Rate-limits per-frame warnings
+	client   *http.Client
+
+	videoFrames chan media.VideoFrame
+	keyframes   chan struct{}
+
+	mu      sync.Mutex
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	connected atomic.Bool
+
+	// Statistics
+	frameCount atomic.Uint64
+	dropCount  atomic.Uint64
+}
+
+// NewSource creates a WHEP source; the connection is made on Start
+func NewSource(cfg Config, logger zerolog.Logger) *Source {
+	// Apply defaults for zero values
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.ReconnectDelay <= 0 {
+		cfg.ReconnectDelay = 2 * time.Second
+	}
+	if cfg.VideoBufferSize <= 0 {
+		cfg.VideoBufferSize = 30
+	}
+
+	logger = logger.With().Str("component", "whep_source").Str("url", cfg.URL).Logger()
+	return &Source{
+		cfg:         cfg,
+		logger:      logger,
+		warnings:    logging.NewSummarizer(logger),
+		client:      &http.Client{Timeout: cfg.Timeout},
+		videoFrames: make(chan media.VideoFrame, cfg.VideoBufferSize),
+		keyframes:   make(chan struct{}, 1),
+	}
+}
+
+// Start begins connecting in the background; returns immediately
+func (s *Source) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return errors.New("whep source already started")
+	}
+	if u, err := url.Parse(s.cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid WHEP URL %q", s.cfg.URL)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.running = true
+
+	go s.connectLoop(runCtx)
+
+	s.logger.Info().Msg("WHEP source started")
+
+	return nil
+}
+
+// Stop disconnects and waits for the session to end
+func (s *Source) Stop() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	s.running = false
+	s.cancel()
+	done := s.done
+	s.mu.Unlock()
+
+	<-done
+
+	s.logger.Info().
+		Uint64("frames", s.frameCount.Load()).
+		Uint64("dropped", s.dropCount.Load()).
+		Msg("WHEP source stopped")
+
+	return nil
+}
+
+// VideoFrameChannel returns the channel for receiving encoded frames
+func (s *Source) VideoFrameChannel() <-chan media.VideoFrame {
+	return s.videoFrames
+}
+
+// IsConnected returns true while a session is receiving
+func (s *Source) IsConnected() bool {
+	return s.connected.Load()
+}
+
+// ForceKeyframe sends a PLI upstream
+func (s *Source) ForceKeyframe() {
+	select {
+	case s.keyframes <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns received and dropped frame counts
+func (s *Source) Stats() (frames, dropped uint64) {
+	return s.frameCount.Load(), s.dropCount.Load()
+}
+
+// connectLoop runs sessions until the context is cancelled
+func (s *Source) connectLoop(ctx context.Context) {
+	defer close(s.done)
+
+	for {
+		err := s.session(ctx)
+		s.connected.Store(false)
+
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warn().Err(err).Dur("retry_in", s.cfg.ReconnectDelay).Msg("WHEP session ended")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(s.cfg.ReconnectDelay):
+		}
+	}
+}
+
+// session negotiates with the endpoint and reads until the connection fails
+func (s *Source) session(ctx context.Context) error {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{ICEServers: s.cfg.ICEServers})
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	// Unblock reads when stopping or when the connection fails
+	stop := context.AfterFunc(ctx, func() { pc.Close() })
+	defer stop()
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateDisconnected {
+			pc.Close()
+		}
+	})
+
+	tracks := make(chan *webrtc.TrackRemote, 1)
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if track.Kind() != webrtc.RTPCodecTypeVideo {
+			return
+		}
+		select {
+		case tracks <- track:
+		default:
+		}
+	})
+
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		return err
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	// WHEP has no trickle requirement; send every candidate in the offer
+	select {
+	case <-gathered:
+	case <-time.After(s.cfg.Timeout):
+		return errors.New("ICE gathering timed out")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	answer, resource, err := s.post(ctx, pc.LocalDescription().SDP)
+	if err != nil {
+		return err
+	}
+	if resource != "" {
+		defer s.teardown(resource)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		return err
+	}
+
+	var track *webrtc.TrackRemote
+	select {
+	case track = <-tracks:
+	case <-time.After(s.cfg.Timeout):
+		return errors.New("no video track received")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if mime := track.Codec().MimeType; !strings.EqualFold(mime, webrtc.MimeTypeH264) {
+		return fmt.Errorf("unsupported upstream codec %s", mime)
+	}
+
+	s.connected.Store(true)
+	s.logger.Info().Uint32("ssrc", uint32(track.SSRC())).Msg("WHEP session receiving")
+
+	// Start from a fresh keyframe rather than the upstream's next scheduled one
+	s.ForceKeyframe()
+	pliCtx, cancelPLI := context.WithCancel(ctx)
+	defer cancelPLI()
+	go s.sendKeyframeRequests(pliCtx, pc, track.SSRC())
+
+	return s.readLoop(track)
+}
+
+// post sends the offer and returns the answer and the session resource URL
+func (s *Source) post(ctx context.Context, offer string) (answer, resource string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, strings.NewReader(offer))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("WHEP endpoint returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	if loc := resp.Header.Get("Location"); loc != "" {
+		if u, err := resp.Request.URL.Parse(loc); err == nil {
+			resource = u.String()
+		}
+	}
+	return string(body), resource, nil
+}
+
+// teardown deletes the session resource so the upstream frees it at once
+// instead of waiting for ICE to time out
+func (s *Source) teardown(resource string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, resource, nil)
+	if err != nil {
+		return
+	}
+	if s.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.logger.Debug().Err(err).Msg("WHEP session teardown failed")
+		return
+	}
+	resp.Body.Close()
+}
+
+// sendKeyframeRequests forwards ForceKeyframe calls upstream as PLIs
+func (s *Source) sendKeyframeRequests(ctx context.Context, pc *webrtc.PeerConnection, ssrc webrtc.SSRC) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.keyframes:
+			if err := pc.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: uint32(ssrc)}}); err != nil {
+				s.logger.Debug().Err(err).Msg("Error sending PLI")
+			}
+		}
+	}
+}
+
+// readLoop depacketizes RTP into access units
+func (s *Source) readLoop(track *webrtc.TrackRemote) error {
+	builder := samplebuilder.New(maxLatePackets, &codecs.H264Packet{}, track.Codec().ClockRate)
+	clock := newTimestampUnwrapper(track.Codec().ClockRate)
+	broken := true // Until the first keyframe, and after packet loss
+
+	for {
+		pkt, _, err := track.ReadRTP()
+		if err != nil {
+			return err
+		}
+		builder.Push(pkt)
+
+		for sample := builder.Pop(); sample != nil; sample = builder.Pop() {
+			keyframe := hasIDR(sample.Data)
+			if sample.PrevDroppedPackets > 0 {
+				broken = true
+			}
+			if broken && !keyframe {
+				s.ForceKeyframe()
+				continue
+			}
+			broken = false
+
+			pts := clock.pts(sample.PacketTimestamp)
+			frame := media.VideoFrame{
+				PTS:        pts,
+				DTS:        pts,
+				IsKeyframe: keyframe,
+				Codec:      "h264",
+				Data:       sample.Data,
+				ReceivedAt: time.Now(),
+			}
+
+			select {
+			case s.videoFrames <- frame:
+				s.frameCount.Add(1)
+			default:
+				s.dropCount.Add(1)
+				s.warnings.Warn("Video frame channel full, dropping frame", nil)
+			}
+		}
+	}
+}
+
+// timestampUnwrapper converts RTP timestamps to nanoseconds since the first
+// sample, unwrapping 32-bit rollover
+type timestampUnwrapper struct {
+	clockRate int64
+	started   bool
+	first     uint32
+	last      uint32
+	cycles    int64
+}
+
+func newTimestampUnwrapper(clockRate uint32) *timestampUnwrapper {
+	if clockRate == 0 {
+		clockRate = 90000
+	}
+	return &timestampUnwrapper{clockRate: int64(clockRate)}
+}
+
+func (u *timestampUnwrapper) pts(ts uint32) int64 {
+	if !u.started {
+		u.started = true
+		u.first, u.last = ts, ts
+	}
+	if ts < u.last && u.last-ts > 1<<31 {
+		u.cycles++
+	}
+	u.last = ts
+	ticks := u.cycles<<32 + int64(ts) - int64(u.first)
+	return ticks * int64(time.Second) / u.clockRate
+}
+
+// hasIDR reports whether an Annex-B access unit contains an IDR slice
+func hasIDR(data []byte) bool {
+	for {
+		i := bytes.Index(data, []byte{0, 0, 1})
+		if i < 0 || i+3 >= len(data) {
+			return false
+		}
+		data = data[i+3:]
+		if data[0]&0x1F == 5 {
+			return true
+		}
+	}
+}
@@ -0,0 +1,424 @@
+// Package multicast sends the gateway's stream as MPEG-TS to a multicast
+// group on the LAN, over RTP (RFC 2250) or as bare UDP, so set-top boxes,
+// VLC and IPTV players can tune in without any signaling, e.g. with
+// rtp://@239.255.0.1:5004.
+//
+// Only H.264 and H.265 fit in the transport stream; VP9 and AV1 frames are
+// dropped. Audio is Opus, which recent players decode from TS.
+package multicast
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/mpegts"
+)
+
+const (
+	// tsPerDatagram transport packets fill a datagram under a 1500-byte MTU
+	tsPerDatagram = 7
+
+	rtpHeaderSize  = 12
+	rtpPayloadMP2T = 33
+
+	// How far a stream's timestamps may stray from the wall clock before
+	// they are re-anchored
+	videoResync = time.Second
+	audioResync = 200 * time.Millisecond
+)
+
+// Config configures a multicast sender
+type Config struct {
+	Addr       string // Group and port, e.g. 239.255.0.1:5004
+	Interface  string // Interface to send from; default follows the routing table
+	TTL        int    // Hops the datagrams may cross, default 1 (the local subnet)
+	RawUDP     bool   // Send bare TS over UDP instead of RTP
+	Audio      bool   // Include an Opus stream fed by WriteAudio
+	BufferSize int    // Frames queued for sending, default 60
+}
+
+// Stats are sender counters
+type Stats struct {
+	URL       string `json:"url"`
+	Codec     string `json:"codec,omitempty"`
+	Frames    uint64 `json:"frames"`
+	Dropped   uint64 `json:"dropped"`
+	Audio     uint64 `json:"audio_packets"`
+	Datagrams uint64 `json:"datagrams"`
+	Errors    uint64 `json:"send_errors"`
+}
+
+type audioPacket struct {
+	data     []byte
+	duration time.Duration
+	at       time.Time
+}
+
+// Sender multiplexes the stream into MPEG-TS and sends it to a multicast
+// group. Frames are queued and sent from its own goroutine, so the
+// distributor never waits on the network.
+type Sender struct {
+	cfg       Config
+	dst       *net.UDPAddr
+	conn      net.PacketConn
+	requester media.KeyframeRequester
+	logger    zerolog.Logger
+	warnings  *logging.Summarizer // Rate-limits per-frame warnings
+
+	frames chan media.VideoFrame
+	audio  chan audioPacket
+	broken atomic.Bool // A frame was dropped; wait for a keyframe
+
+	mu      sync.Mutex
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+	codec   string
+
+	// Owned by the run goroutine
+	mux      *mpegts.Muxer
+	datagram []byte
+	rtpSeq   uint16
+	ssrc     uint32
+	epoch    time.Time
+
+	// Statistics
+	sent      atomic.Uint64
+	dropped   atomic.Uint64
+	audioSent atomic.Uint64
+	datagrams atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// New opens the socket for a sender. requester, which may be nil, is asked
+// for a keyframe when sending starts or resumes after a drop.
+func New(cfg Config, requester media.KeyframeRequester, logger zerolog.Logger) (*Sender, error) {
+	// Apply defaults for zero values
+	if cfg.TTL <= 0 {
+		cfg.TTL = 1
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 60
+	}
+
+	dst, err := net.ResolveUDPAddr("udp", cfg.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid multicast address %q: %w", cfg.Addr, err)
+	}
+	if dst.IP == nil || dst.Port == 0 {
+		return nil, fmt.Errorf("multicast address %q needs an IP and a port", cfg.Addr)
+	}
+	var ifi *net.Interface
+	if cfg.Interface != "" {
+		if ifi, err = net.InterfaceByName(cfg.Interface); err != nil {
+			return nil, fmt.Errorf("multicast interface: %w", err)
+		}
+	}
+	conn, err := openSocket(dst, ifi, cfg.TTL)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Sender{
+		cfg:       cfg,
+		dst:       dst,
+		conn:      conn,
+		requester: requester,
+		frames:    make(chan media.VideoFrame, cfg.BufferSize),
+		audio:     make(chan audioPacket, cfg.BufferSize),
+		datagram:  make([]byte, 0, rtpHeaderSize+tsPerDatagram*188),
+		ssrc:      rand.Uint32(),
+	}
+	s.logger = logger.With().Str("component", "multicast").Str("url", s.URL()).Logger()
+	s.warnings = logging.NewSummarizer(s.logger)
+	channels := 0
+	if cfg.Audio {
+		channels = 2 // WebRTC Opus is always signalled as stereo
+	}
+	s.mux = mpegts.NewMuxer(datagramWriter{s}, channels)
+	return s, nil
+}
+
+// openSocket opens a UDP socket for sending to dst, with the multicast
+// options set when dst is a group
+func openSocket(dst *net.UDPAddr, ifi *net.Interface, ttl int) (net.PacketConn, error) {
+	if dst.IP.To4() != nil {
+		conn, err := net.ListenPacket("udp4", ":0")
+		if err != nil {
+			return nil, err
+		}
+		p := ipv4.NewPacketConn(conn)
+		err = errors.Join(p.SetMulticastTTL(ttl), p.SetMulticastLoopback(true))
+		if ifi != nil {
+			err = errors.Join(err, p.SetMulticastInterface(ifi))
+		}
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("multicast socket options: %w", err)
+		}
+		return conn, nil
+	}
+
+	conn, err := net.ListenPacket("udp6", "[::]:0")
+	if err != nil {
+		return nil, err
+	}
+	p := ipv6.NewPacketConn(conn)
+	err = errors.Join(p.SetMulticastHopLimit(ttl), p.SetMulticastLoopback(true))
+	if ifi != nil {
+		err = errors.Join(err, p.SetMulticastInterface(ifi))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("multicast socket options: %w", err)
+	}
+	return conn, nil
+}
+
+// URL is the address players open, such as rtp://@239.255.0.1:5004
+func (s *Sender) URL() string {
+	scheme := "rtp"
+	if s.cfg.RawUDP {
+		scheme = "udp"
+	}
+	host := s.dst.String()
+	if s.dst.IP.IsMulticast() {
+		host = "@" + host
+	}
+	return scheme + "://" + host
+}
+
+// Start begins sending in the background; returns immediately
+func (s *Sender) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return errors.New("multicast sender already started")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.running = true
+
+	go s.run(runCtx)
+
+	s.logger.Info().Int("ttl", s.cfg.TTL).Bool("audio", s.cfg.Audio).Msg("Multicast output started")
+
+	return nil
+}
+
+// Stop stops sending and closes the socket
+func (s *Sender) Stop() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = false
+	s.cancel()
+	done := s.done
+	s.mu.Unlock()
+
+	<-done
+	s.conn.Close()
+
+	s.logger.Info().
+		Uint64("frames", s.sent.Load()).
+		Uint64("dropped", s.dropped.Load()).
+		Msg("Multicast output stopped")
+}
+
+// Observe queues a frame for sending. It is a media.Distributor tap.
+func (s *Sender) Observe(f media.VideoFrame) {
+	select {
+	case s.frames <- f:
+	default:
+		s.dropped.Add(1)
+		s.broken.Store(true)
+		s.warnings.Warn("Multicast queue full, dropping frame", nil)
+	}
+}
+
+// WriteAudio queues an Opus packet lasting duration. It is ignored unless
+// Config.Audio is set.
+func (s *Sender) WriteAudio(data []byte, duration time.Duration) {
+	if !s.cfg.Audio {
+		return
+	}
+	select {
+	case s.audio <- audioPacket{data: data, duration: duration, at: time.Now()}:
+	default:
+		s.warnings.Warn("Multicast audio queue full, dropping packet", nil)
+	}
+}
+
+// Stats returns sender counters
+func (s *Sender) Stats() Stats {
+	s.mu.Lock()
+	codec := s.codec
+	s.mu.Unlock()
+	return Stats{
+		URL:       s.URL(),
+		Codec:     codec,
+		Frames:    s.sent.Load(),
+		Dropped:   s.dropped.Load(),
+		Audio:     s.audioSent.Load(),
+		Datagrams: s.datagrams.Load(),
+		Errors:    s.failed.Load(),
+	}
+}
+
+// run multiplexes queued frames and audio. Both streams are stamped on the
+// wall clock since the sender started: video keeps its own spacing from an
+// anchor re-taken on discontinuities, and audio follows its packet
+// durations while they agree with arrival times.
+func (s *Sender) run(ctx context.Context) {
+	defer close(s.done)
+
+	s.epoch = time.Now()
+	s.requestKeyframe()
+
+	waiting := true // For a keyframe to start or resume from
+	var (
+		videoOffset  int64 // Added to frame timestamps
+		videoAnchor  bool
+		audioPTS     int64
+		audioStarted bool
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case f := <-s.frames:
+			if f.Codec != "h264" && f.Codec != "hevc" {
+				s.warnings.Warn("Multicast output carries H.264 and H.265 only, dropping frame", func(e *zerolog.Event) {
+					e.Str("codec", f.Codec)
+				})
+				waiting = true
+				continue
+			}
+			if s.broken.Swap(false) && !waiting {
+				waiting = true
+				s.requestKeyframe()
+			}
+			if waiting && !f.IsKeyframe {
+				continue
+			}
+			waiting = false
+
+			ts := f.PTS
+			if ts <= 0 {
+				ts = f.ReceivedAt.UnixNano()
+			}
+			now := int64(time.Since(s.epoch))
+			if pts := ts + videoOffset; !videoAnchor || f.Discontinuity || abs(pts-now) > int64(videoResync) {
+				videoOffset = now - ts
+				videoAnchor = true
+			}
+
+			if f.Codec != s.mux.Codec() {
+				s.mu.Lock()
+				s.codec = f.Codec
+				s.mu.Unlock()
+				s.logger.Info().Str("codec", f.Codec).Msg("Multicast video codec")
+			}
+			if err := s.mux.WriteVideo(f.Codec, ts+videoOffset, f.IsKeyframe, f.Data); err != nil {
+				s.warnings.Warn("Cannot multiplex frame for multicast", func(e *zerolog.Event) { e.Err(err) })
+				continue
+			}
+			s.flush()
+			s.sent.Add(1)
+
+		case p := <-s.audio:
+			at := int64(p.at.Sub(s.epoch))
+			if !audioStarted || abs(audioPTS-at) > int64(audioResync) {
+				audioPTS = at
+				audioStarted = true
+			}
+			if err := s.mux.WriteAudio(audioPTS, p.data); err != nil {
+				s.warnings.Warn("Cannot multiplex audio for multicast", func(e *zerolog.Event) { e.Err(err) })
+			}
+			s.flush()
+			audioPTS += int64(p.duration)
+			s.audioSent.Add(1)
+		}
+	}
+}
+
+// datagramWriter collects transport packets into datagrams
+type datagramWriter struct{ s *Sender }
+
+func (w datagramWriter) Write(pkt []byte) (int, error) {
+	s := w.s
+	if len(s.datagram) == 0 && !s.cfg.RawUDP {
+		s.datagram = s.datagram[:rtpHeaderSize]
+	}
+	s.datagram = append(s.datagram, pkt...)
+	if s.packets() == tsPerDatagram {
+		s.flush()
+	}
+	return len(pkt), nil
+}
+
+// packets returns how many transport packets the pending datagram holds
+func (s *Sender) packets() int {
+	n := len(s.datagram)
+	if !s.cfg.RawUDP && n > 0 {
+		n -= rtpHeaderSize
+	}
+	return n / 188
+}
+
+// flush sends the pending datagram. A short one ends each frame so
+// receivers are not kept waiting for the next.
+func (s *Sender) flush() {
+	if s.packets() == 0 {
+		return
+	}
+	if !s.cfg.RawUDP {
+		// The timestamp is the 90 kHz send time (RFC 2250 section 2)
+		ts := uint32(time.Since(s.epoch) * 90000 / time.Second)
+		h := s.datagram[:rtpHeaderSize]
+		h[0] = 0x80 // Version 2
+		h[1] = rtpPayloadMP2T
+		h[2], h[3] = byte(s.rtpSeq>>8), byte(s.rtpSeq)
+		h[4], h[5], h[6], h[7] = byte(ts>>24), byte(ts>>16), byte(ts>>8), byte(ts)
+		h[8], h[9], h[10], h[11] = byte(s.ssrc>>24), byte(s.ssrc>>16), byte(s.ssrc>>8), byte(s.ssrc)
+		s.rtpSeq++
+	}
+	if _, err := s.conn.WriteTo(s.datagram, s.dst); err != nil {
+		s.failed.Add(1)
+		s.warnings.Warn("Multicast send failed", func(e *zerolog.Event) { e.Err(err) })
+	} else {
+		s.datagrams.Add(1)
+	}
+	s.datagram = s.datagram[:0]
+}
+
+func (s *Sender) requestKeyframe() {
+	if s.requester != nil {
+		s.requester.ForceKeyframe()
+	}
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
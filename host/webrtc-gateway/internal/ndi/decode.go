@@ -0,0 +1,150 @@
+package ndi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// decoder is an ffmpeg process turning the encoded stream into raw UYVY
+// pictures. H.264 and HEVC go in as Annex-B; VP9 and AV1 frames have no
+// framing of their own, so they are wrapped in IVF.
+type decoder struct {
+	codec  string
+	width  int
+	height int
+	ivf    bool
+	frames uint32
+
+	cmd    *exec.Cmd
+	cancel context.CancelFunc
+	stdin  io.WriteCloser
+	stderr *bytes.Buffer
+	done   chan struct{}
+	once   sync.Once
+}
+
+// startDecoder runs ffmpeg for a stream of the given codec and size,
+// calling send for each picture from its own goroutine
+func startDecoder(ctx context.Context, ffmpeg, codec string, width, height int, send func(uyvy []byte, width, height int)) (*decoder, error) {
+	format := map[string]string{"h264": "h264", "hevc": "hevc", "vp9": "ivf", "av1": "ivf"}[codec]
+	if format == "" {
+		return nil, fmt.Errorf("unsupported codec %q", codec)
+	}
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid picture size %dx%d", width, height)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cmd := exec.CommandContext(ctx, ffmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-flags", "low_delay", "-probesize", "32", "-analyzeduration", "0",
+		"-f", format, "-i", "pipe:0",
+		"-vf", "scale="+strconv.Itoa(width)+":"+strconv.Itoa(height),
+		"-fps_mode", "passthrough", "-f", "rawvideo", "-pix_fmt", "uyvy422", "pipe:1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	d := &decoder{
+		codec:  codec,
+		width:  width,
+		height: height,
+		ivf:    format == "ivf",
+		cmd:    cmd,
+		cancel: cancel,
+		stdin:  stdin,
+		stderr: &bytes.Buffer{},
+		done:   make(chan struct{}),
+	}
+	cmd.Stderr = d.stderr
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go func() {
+		defer close(d.done)
+		picture := make([]byte, width*height*2)
+		for {
+			if _, err := io.ReadFull(stdout, picture); err != nil {
+				return
+			}
+			send(picture, width, height)
+		}
+	}()
+
+	if d.ivf {
+		if _, err := stdin.Write(ivfHeader(codec, width, height)); err != nil {
+			d.close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// write feeds a frame to ffmpeg. It blocks while ffmpeg is busy, and closes
+// the decoder when ffmpeg has gone.
+func (d *decoder) write(f media.VideoFrame) error {
+	data := f.Data
+	if d.ivf {
+		// Frame header: size and a timestamp in the header's time base
+		header := make([]byte, 12, 12+len(data))
+		binary.LittleEndian.PutUint32(header[0:], uint32(len(data)))
+		binary.LittleEndian.PutUint64(header[4:], uint64(d.frames))
+		data = append(header, data...)
+		d.frames++
+	}
+	if _, err := d.stdin.Write(data); err != nil {
+		// ffmpeg has exited; its complaint says why
+		d.close()
+		if msg := strings.TrimSpace(d.stderr.String()); msg != "" {
+			return errors.New(msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// close stops ffmpeg and waits for it to exit
+func (d *decoder) close() {
+	d.once.Do(func() {
+		d.stdin.Close()
+		d.cancel()
+		<-d.done
+		d.cmd.Wait()
+	})
+}
+
+// ivfHeader is the 32-byte IVF file header
+func ivfHeader(codec string, width, height int) []byte {
+	fourcc := "VP90"
+	if codec == "av1" {
+		fourcc = "AV01"
+	}
+	h := make([]byte, 32)
+	copy(h[0:], "DKIF")
+	binary.LittleEndian.PutUint16(h[4:], 0)  // Version
+	binary.LittleEndian.PutUint16(h[6:], 32) // Header size
+	copy(h[8:], fourcc)
+	binary.LittleEndian.PutUint16(h[12:], uint16(width))
+	binary.LittleEndian.PutUint16(h[14:], uint16(height))
+	binary.LittleEndian.PutUint32(h[16:], 60) // Time base denominator
+	binary.LittleEndian.PutUint32(h[20:], 1)  // Time base numerator
+	return h
+}
@@ -0,0 +1,153 @@
+//go:build ndi && cgo
+
+package ndi
+
+/*
+#cgo linux LDFLAGS: -lndi
+#cgo darwin LDFLAGS: -lndi
+#cgo windows LDFLAGS: -lProcessing.NDI.Lib.x64
+#include <stdbool.h>
+#include <stdint.h>
+#include <stdlib.h>
+#include <Processing.NDI.Lib.h>
+
+static NDIlib_send_instance_t gateway_ndi_create(const char *name, const char *groups) {
+	NDIlib_send_create_t create = {0};
+	create.p_ndi_name = name;
+	create.p_groups = groups;
+	create.clock_video = false; // Frames go out as the stream delivers them
+	create.clock_audio = false;
+	return NDIlib_send_create(&create);
+}
+
+// The stride shares an anonymous union in the frame, which cgo cannot name
+static void gateway_ndi_send_video(NDIlib_send_instance_t send, uint8_t *data, int width, int height, int rate_n, int rate_d) {
+	NDIlib_video_frame_v2_t frame = {0};
+	frame.xres = width;
+	frame.yres = height;
+	frame.FourCC = NDIlib_FourCC_video_type_UYVY;
+	frame.frame_rate_N = rate_n;
+	frame.frame_rate_D = rate_d;
+	frame.frame_format_type = NDIlib_frame_format_type_progressive;
+	frame.timecode = NDIlib_send_timecode_synthesize;
+	frame.p_data = data;
+	frame.line_stride_in_bytes = width * 2;
+	NDIlib_send_send_video_v2(send, &frame);
+}
+
+static void gateway_ndi_send_audio(NDIlib_send_instance_t send, int16_t *data, int rate, int channels, int samples) {
+	NDIlib_audio_frame_interleaved_16s_t frame = {0};
+	frame.sample_rate = rate;
+	frame.no_channels = channels;
+	frame.no_samples = samples;
+	frame.timecode = NDIlib_send_timecode_synthesize;
+	frame.p_data = data;
+	NDIlib_util_send_send_audio_interleaved_16s(send, &frame);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"sync"
+	"unsafe"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+func init() {
+	openOutput = openLibNDI
+}
+
+var (
+	initOnce sync.Once
+	initOK   bool
+)
+
+// libNDI wraps an NDI SDK sender. Video and audio may be sent from
+// different goroutines; Close waits for sends in progress.
+type libNDI struct {
+	mu     sync.RWMutex
+	send   C.NDIlib_send_instance_t
+	name   *C.char
+	groups *C.char // nil for the public group
+}
+
+func openLibNDI(name, groups string) (output, error) {
+	initOnce.Do(func() {
+		initOK = bool(C.NDIlib_initialize())
+	})
+	if !initOK {
+		return nil, errors.New("NDI: the runtime does not support this CPU")
+	}
+
+	o := &libNDI{name: C.CString(name)}
+	if groups != "" {
+		o.groups = C.CString(groups)
+	}
+	o.send = C.gateway_ndi_create(o.name, o.groups)
+	if o.send == nil {
+		o.free()
+		return nil, errors.New("NDI: failed to create sender")
+	}
+	return o, nil
+}
+
+// SendVideo sends a UYVY picture; NDI copies it before returning
+func (o *libNDI) SendVideo(uyvy []byte, width, height, rateN, rateD int) {
+	if len(uyvy) < width*height*2 {
+		return
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.send == nil {
+		return
+	}
+	C.gateway_ndi_send_video(o.send, (*C.uint8_t)(unsafe.Pointer(&uyvy[0])),
+		C.int(width), C.int(height), C.int(rateN), C.int(rateD))
+}
+
+// SendAudio sends 16-bit interleaved PCM, which the SDK converts to its
+// float format
+func (o *libNDI) SendAudio(f media.AudioFrame) {
+	if f.SampleCount <= 0 || f.Channels <= 0 || len(f.Data) < f.SampleCount*f.Channels*2 {
+		return
+	}
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.send == nil {
+		return
+	}
+	C.gateway_ndi_send_audio(o.send, (*C.int16_t)(unsafe.Pointer(&f.Data[0])),
+		C.int(f.SampleRate), C.int(f.Channels), C.int(f.SampleCount))
+}
+
+// Receivers returns how many receivers are connected, without waiting
+func (o *libNDI) Receivers() int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.send == nil {
+		return 0
+	}
+	return int(C.NDIlib_send_get_no_connections(o.send, 0))
+}
+
+// Close withdraws the source from the network
+func (o *libNDI) Close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.send != nil {
+		C.NDIlib_send_destroy(o.send)
+		o.send = nil
+	}
+	o.free()
+}
+
+func (o *libNDI) free() {
+	C.free(unsafe.Pointer(o.name))
+	o.name = nil
+	if o.groups != nil {
+		C.free(unsafe.Pointer(o.groups))
+		o.groups = nil
+	}
+}
@@ -0,0 +1,366 @@
+// Package ndi offers the gateway's stream as an NDI source on the LAN, so
+// production tools such as OBS and vMix can take it in without going
+// through a browser. NDI carries uncompressed video, so the stream is
+// decoded by an ffmpeg process while at least one receiver is connected.
+//
+// The NDI sender is compiled in with the ndi build tag and requires cgo
+// and the NDI SDK; without it New returns ErrUnavailable.
+package ndi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/bitstream"
+)
+
+// ErrUnavailable is returned by New when the gateway was built without NDI
+var ErrUnavailable = errors.New("NDI support not compiled in; build with -tags ndi and the NDI SDK")
+
+// receiverPoll is how often the receiver count is checked
+const receiverPoll = 500 * time.Millisecond
+
+// output is an NDI sender instance
+type output interface {
+	// SendVideo sends a UYVY picture; the data may be reused on return
+	SendVideo(uyvy []byte, width, height, rateN, rateD int)
+
+	// SendAudio sends 16-bit interleaved PCM
+	SendAudio(f media.AudioFrame)
+
+	// Receivers returns how many receivers are connected
+	Receivers() int
+
+	Close()
+}
+
+// openOutput creates an NDI sender; set by the cgo build
+var openOutput func(name, groups string) (output, error)
+
+// Available reports whether NDI output was compiled in
+func Available() bool {
+	return openOutput != nil
+}
+
+// Config configures an NDI sender
+type Config struct {
+	// Name is the source name receivers list, shown as "HOST (Name)".
+	// Default "Gaming Capture".
+	Name string
+
+	// Groups limits the source to these comma-separated NDI groups;
+	// empty is the public group
+	Groups string
+
+	// BufferSize is how many frames wait for the decoder, default 30
+	BufferSize int
+}
+
+// Stats are sender counters
+type Stats struct {
+	Name      string `json:"name"`
+	Receivers int    `json:"receivers"`
+	Decoding  bool   `json:"decoding"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	Pictures  uint64 `json:"pictures"`
+	Dropped   uint64 `json:"dropped"`
+	Audio     uint64 `json:"audio_frames"`
+	Restarts  uint64 `json:"decoder_restarts"`
+}
+
+// Sender publishes the stream as an NDI source
+type Sender struct {
+	cfg       Config
+	ffmpeg    string
+	out       output
+	requester media.KeyframeRequester
+	logger    zerolog.Logger
+	warnings  *logging.Summarizer // Rate-limits per-frame warnings
+
+	frames    chan media.VideoFrame
+	broken    atomic.Bool  // A frame was dropped; wait for a keyframe
+	receivers atomic.Int64 // Last receiver count
+	interval  atomic.Int64 // Average frame interval in nanoseconds
+
+	mu      sync.Mutex
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+	dec     *decoder
+
+	// Statistics
+	pictures atomic.Uint64
+	dropped  atomic.Uint64
+	audio    atomic.Uint64
+	restarts atomic.Uint64
+}
+
+// New creates an NDI source. requester, which may be nil, is asked for a
+// keyframe whenever decoding starts.
+func New(cfg Config, requester media.KeyframeRequester, logger zerolog.Logger) (*Sender, error) {
+	// Apply defaults for zero values
+	if cfg.Name == "" {
+		cfg.Name = "Gaming Capture"
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 30
+	}
+
+	if openOutput == nil {
+		return nil, ErrUnavailable
+	}
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errors.New("NDI output decodes the stream with ffmpeg, which is not on PATH")
+	}
+	out, err := openOutput(cfg.Name, cfg.Groups)
+	if err != nil {
+		return nil, err
+	}
+
+	logger = logger.With().Str("component", "ndi").Str("name", cfg.Name).Logger()
+	return &Sender{
+		cfg:       cfg,
+		ffmpeg:    path,
+		out:       out,
+		requester: requester,
+		logger:    logger,
+		warnings:  logging.NewSummarizer(logger),
+		frames:    make(chan media.VideoFrame, cfg.BufferSize),
+	}, nil
+}
+
+// Start begins sending in the background; returns immediately
+func (s *Sender) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return errors.New("ndi sender already started")
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.running = true
+
+	go s.run(runCtx)
+
+	s.logger.Info().Msg("NDI source started")
+
+	return nil
+}
+
+// Stop stops decoding and withdraws the source from the network
+func (s *Sender) Stop() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = false
+	s.cancel()
+	done := s.done
+	s.mu.Unlock()
+
+	<-done
+	s.out.Close()
+
+	s.logger.Info().
+		Uint64("pictures", s.pictures.Load()).
+		Uint64("dropped", s.dropped.Load()).
+		Msg("NDI source stopped")
+}
+
+// Observe queues a frame for decoding. It is a media.Distributor tap.
+func (s *Sender) Observe(f media.VideoFrame) {
+	if s.receivers.Load() == 0 {
+		return
+	}
+	select {
+	case s.frames <- f:
+	default:
+		s.dropped.Add(1)
+		s.broken.Store(true)
+		s.warnings.Warn("NDI decoder falling behind, dropping frame", nil)
+	}
+}
+
+// ObserveAudio sends audio to receivers. It is an audio.Sink.
+func (s *Sender) ObserveAudio(f media.AudioFrame) {
+	if s.receivers.Load() == 0 || f.Source != "" {
+		return
+	}
+	s.out.SendAudio(f)
+	s.audio.Add(1)
+}
+
+// Stats returns sender counters
+func (s *Sender) Stats() Stats {
+	st := Stats{
+		Name:      s.cfg.Name,
+		Receivers: int(s.receivers.Load()),
+		Pictures:  s.pictures.Load(),
+		Dropped:   s.dropped.Load(),
+		Audio:     s.audio.Load(),
+		Restarts:  s.restarts.Load(),
+	}
+	s.mu.Lock()
+	if s.dec != nil {
+		st.Decoding, st.Width, st.Height = true, s.dec.width, s.dec.height
+	}
+	s.mu.Unlock()
+	return st
+}
+
+// run feeds the decoder while receivers are connected
+func (s *Sender) run(ctx context.Context) {
+	defer close(s.done)
+	defer s.setDecoder(nil)
+
+	poll := time.NewTicker(receiverPoll)
+	defer poll.Stop()
+	s.pollReceivers()
+
+	waiting := true // For a keyframe to start or resume decoding from
+	var lastTS int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+			if s.pollReceivers() == 0 && s.decoding() {
+				// Nobody is watching; spare the CPU
+				s.logger.Info().Msg("No NDI receivers, pausing decoding")
+				s.setDecoder(nil)
+				waiting = true
+			}
+		case f := <-s.frames:
+			ts := f.PTS
+			if ts <= 0 {
+				ts = f.ReceivedAt.UnixNano()
+			}
+			if lastTS != 0 && ts > lastTS && ts-lastTS < int64(time.Second) {
+				avg := s.interval.Load()
+				if avg == 0 {
+					avg = ts - lastTS
+				}
+				s.interval.Store(avg + (ts-lastTS-avg)/16)
+			}
+			lastTS = ts
+
+			if s.broken.Swap(false) && !waiting {
+				waiting = true
+				s.requestKeyframe()
+			}
+			if waiting && !f.IsKeyframe {
+				continue
+			}
+			if f.IsKeyframe {
+				if err := s.prepare(ctx, f); err != nil {
+					s.warnings.Warn("Cannot decode stream for NDI", func(e *zerolog.Event) { e.Err(err) })
+					waiting = true
+					continue
+				}
+			}
+			waiting = false
+
+			s.mu.Lock()
+			dec := s.dec
+			s.mu.Unlock()
+			if err := dec.write(f); err != nil {
+				s.logger.Warn().Err(err).Msg("NDI decoder exited")
+				s.setDecoder(nil)
+				waiting = true
+				s.requestKeyframe()
+			}
+		}
+	}
+}
+
+// prepare starts a decoder for the keyframe's stream, or a new one when
+// its codec or size changed
+func (s *Sender) prepare(ctx context.Context, f media.VideoFrame) error {
+	p, ok, err := bitstream.FindParams(f.Codec, f.Data)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("no parameter sets in %s keyframe", f.Codec)
+	}
+
+	s.mu.Lock()
+	dec := s.dec
+	s.mu.Unlock()
+	if dec != nil && dec.codec == p.Codec && dec.width == p.Width && dec.height == p.Height {
+		return nil
+	}
+
+	next, err := startDecoder(ctx, s.ffmpeg, p.Codec, p.Width, p.Height, s.sendPicture)
+	if err != nil {
+		return err
+	}
+	if dec != nil {
+		s.restarts.Add(1)
+	}
+	s.setDecoder(next)
+	s.logger.Info().Str("codec", p.Codec).Int("width", p.Width).Int("height", p.Height).Msg("NDI decoding started")
+	return nil
+}
+
+// sendPicture hands a decoded picture to NDI. It runs on the decoder's
+// reader goroutine.
+func (s *Sender) sendPicture(uyvy []byte, width, height int) {
+	rateN, rateD := 60000, 1000
+	if avg := s.interval.Load(); avg > 0 {
+		rateN = int(int64(time.Second) * 1000 / avg)
+	}
+	s.out.SendVideo(uyvy, width, height, rateN, rateD)
+	s.pictures.Add(1)
+}
+
+// setDecoder replaces the decoder, closing the old one
+func (s *Sender) setDecoder(dec *decoder) {
+	s.mu.Lock()
+	old := s.dec
+	s.dec = dec
+	s.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+func (s *Sender) decoding() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dec != nil
+}
+
+// pollReceivers refreshes the receiver count, asking for a keyframe when
+// the first receiver connects
+func (s *Sender) pollReceivers() int64 {
+	n := int64(s.out.Receivers())
+	if prev := s.receivers.Swap(n); prev != n {
+		s.logger.Info().Int64("receivers", n).Msg("NDI receivers changed")
+		if prev == 0 {
+			s.requestKeyframe()
+		}
+	}
+	return n
+}
+
+func (s *Sender) requestKeyframe() {
+	if s.requester != nil {
+		s.requester.ForceKeyframe()
+	}
+}
@@ -0,0 +1,299 @@
+// Package negotiation renegotiates established viewer sessions, so tracks
+// can be added or removed (audio enabled later, a second video) without the
+// viewer reconnecting.
+//
+// It follows the W3C "perfect negotiation" pattern. Either side may offer
+// when its tracks change; descriptions and candidates travel on the viewer's
+// data channel, since the session is already up. When both sides offer at
+// once, the gateway is the impolite peer: it ignores the viewer's offer and
+// the viewer, the polite peer, rolls its own back and answers the gateway's.
+package negotiation
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog"
+)
+
+// MessageType is the data channel message type for renegotiation, in both
+// directions:
+//
+//	{"type":"negotiate","description":{"type":"offer","sdp":"..."}}
+//	{"type":"negotiate","candidate":{"candidate":"...","sdpMid":"0"}}
+const MessageType = "negotiate"
+
+// ErrUnknownPeer is returned for a peer that is not attached
+var ErrUnknownPeer = errors.New("peer has no session to renegotiate")
+
+// Peers is implemented by peer managers that expose each viewer's
+// connection and can message a single viewer on its data channel
+type Peers interface {
+	PeerConnection(peerID string) (*webrtc.PeerConnection, bool)
+	SendMessage(peerID string, data []byte) error
+}
+
+// Message is a description or candidate exchanged with a viewer
+type Message struct {
+	Type        string                     `json:"type"`
+	Description *webrtc.SessionDescription `json:"description,omitempty"`
+	Candidate   *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+}
+
+// Stats are renegotiation counters
+type Stats struct {
+	Sessions   int    `json:"sessions"`
+	Offers     uint64 `json:"offers"`     // Sent by the gateway
+	Answers    uint64 `json:"answers"`    // Sent by the gateway to viewer offers
+	Collisions uint64 `json:"collisions"` // Viewer offers ignored for the gateway's own
+	Errors     uint64 `json:"errors"`
+}
+
+// session is one viewer's negotiation state
+type session struct {
+	pc *webrtc.PeerConnection
+
+	// mu serializes descriptions, so the gateway is never midway through
+	// making an offer when a viewer's arrives
+	mu          sync.Mutex
+	ignoreOffer bool // The last viewer offer collided; its candidates fail harmlessly
+	pending     bool // Negotiation was needed while an offer was outstanding
+}
+
+// Negotiator renegotiates viewer sessions
+type Negotiator struct {
+	peers  Peers
+	logger zerolog.Logger
+
+	mu            sync.Mutex
+	sessions      map[string]*session
+	onDescription func(peerID string, desc webrtc.SessionDescription, local bool)
+
+	// Statistics
+	offers     atomic.Uint64
+	answers    atomic.Uint64
+	collisions atomic.Uint64
+	errors     atomic.Uint64
+}
+
+// New creates a negotiator for peers
+func New(peers Peers, logger zerolog.Logger) *Negotiator {
+	return &Negotiator{
+		peers:    peers,
+		logger:   logger.With().Str("component", "negotiation").Logger(),
+		sessions: make(map[string]*session),
+	}
+}
+
+// SetOnDescription sets a callback for each description set during
+// renegotiation, e.g. for the session log. It must not block.
+func (n *Negotiator) SetOnDescription(fn func(peerID string, desc webrtc.SessionDescription, local bool)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.onDescription = fn
+}
+
+// Attach takes over renegotiation of peerID's session once it is
+// connected. The initial offer and answer stay with signaling.
+func (n *Negotiator) Attach(peerID string) error {
+	pc, ok := n.peers.PeerConnection(peerID)
+	if !ok {
+		return ErrUnknownPeer
+	}
+	s := &session{pc: pc}
+
+	n.mu.Lock()
+	n.sessions[peerID] = s
+	n.mu.Unlock()
+
+	// pion fires this on its operations goroutine; offer off it
+	pc.OnNegotiationNeeded(func() {
+		go n.offer(peerID, s)
+	})
+	return nil
+}
+
+// RemovePeer forgets a viewer that left
+func (n *Negotiator) RemovePeer(peerID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.sessions, peerID)
+}
+
+// AddTrack adds track to peerID's session and renegotiates
+func (n *Negotiator) AddTrack(peerID string, track webrtc.TrackLocal) (*webrtc.RTPSender, error) {
+	s, ok := n.session(peerID)
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+	sender, err := s.pc.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+	n.logger.Info().Str("peer_id", peerID).Str("track", track.ID()).Str("kind", track.Kind().String()).Msg("Track added")
+	return sender, nil
+}
+
+// RemoveTrack removes sender's track from peerID's session and
+// renegotiates
+func (n *Negotiator) RemoveTrack(peerID string, sender *webrtc.RTPSender) error {
+	s, ok := n.session(peerID)
+	if !ok {
+		return ErrUnknownPeer
+	}
+	if err := s.pc.RemoveTrack(sender); err != nil {
+		return err
+	}
+	n.logger.Info().Str("peer_id", peerID).Msg("Track removed")
+	return nil
+}
+
+// HandleMessage handles a description or candidate from a viewer. It is a
+// commands.Handler; the answer to a viewer offer is the reply.
+func (n *Negotiator) HandleMessage(peerID string, msg []byte) (any, error) {
+	var m Message
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return nil, err
+	}
+	s, ok := n.session(peerID)
+	if !ok {
+		return nil, ErrUnknownPeer
+	}
+
+	switch {
+	case m.Description != nil:
+		return n.handleDescription(peerID, s, *m.Description)
+	case m.Candidate != nil:
+		if err := s.pc.AddICECandidate(*m.Candidate); err != nil {
+			s.mu.Lock()
+			ignored := s.ignoreOffer
+			s.mu.Unlock()
+			if !ignored {
+				n.errors.Add(1)
+				return nil, err
+			}
+		}
+		return nil, nil
+	default:
+		return nil, errors.New("negotiate message needs a description or candidate")
+	}
+}
+
+// handleDescription applies a viewer's offer or answer
+func (n *Negotiator) handleDescription(peerID string, s *session, desc webrtc.SessionDescription) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if desc.Type == webrtc.SDPTypeOffer {
+		collision := s.pc.SignalingState() != webrtc.SignalingStateStable
+		s.ignoreOffer = collision
+		if collision {
+			// Impolite: keep our offer; the viewer rolls back and answers it
+			n.collisions.Add(1)
+			n.logger.Debug().Str("peer_id", peerID).Msg("Ignoring colliding viewer offer")
+			return nil, nil
+		}
+	}
+
+	if err := s.pc.SetRemoteDescription(desc); err != nil {
+		n.errors.Add(1)
+		n.logger.Warn().Err(err).Str("peer_id", peerID).Str("sdp_type", desc.Type.String()).Msg("Failed to apply viewer description")
+		return nil, err
+	}
+	n.described(peerID, desc, false)
+
+	if desc.Type != webrtc.SDPTypeOffer {
+		// Our offer was answered; offer again if tracks changed meanwhile
+		if s.pending {
+			s.pending = false
+			go n.offer(peerID, s)
+		}
+		return nil, nil
+	}
+
+	answer, err := s.pc.CreateAnswer(nil)
+	if err == nil {
+		err = s.pc.SetLocalDescription(answer)
+	}
+	if err != nil {
+		n.errors.Add(1)
+		n.logger.Warn().Err(err).Str("peer_id", peerID).Msg("Failed to answer viewer offer")
+		return nil, err
+	}
+	local := s.pc.LocalDescription()
+	n.described(peerID, *local, true)
+	n.answers.Add(1)
+	n.logger.Info().Str("peer_id", peerID).Msg("Answered viewer renegotiation")
+	return Message{Type: MessageType, Description: local}, nil
+}
+
+// offer sends the viewer a new offer for the session's current tracks
+func (n *Negotiator) offer(peerID string, s *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pc.SignalingState() != webrtc.SignalingStateStable {
+		// The answer to the outstanding offer triggers another
+		s.pending = true
+		return
+	}
+
+	offer, err := s.pc.CreateOffer(nil)
+	if err == nil {
+		err = s.pc.SetLocalDescription(offer)
+	}
+	if err != nil {
+		n.errors.Add(1)
+		n.logger.Warn().Err(err).Str("peer_id", peerID).Msg("Failed to create renegotiation offer")
+		return
+	}
+	local := s.pc.LocalDescription()
+	n.described(peerID, *local, true)
+
+	data, err := json.Marshal(Message{Type: MessageType, Description: local})
+	if err == nil {
+		err = n.peers.SendMessage(peerID, data)
+	}
+	if err != nil {
+		n.errors.Add(1)
+		n.logger.Warn().Err(err).Str("peer_id", peerID).Msg("Failed to send renegotiation offer")
+		return
+	}
+	n.offers.Add(1)
+	n.logger.Info().Str("peer_id", peerID).Msg("Sent renegotiation offer")
+}
+
+// described reports a description to the callback
+func (n *Negotiator) described(peerID string, desc webrtc.SessionDescription, local bool) {
+	n.mu.Lock()
+	fn := n.onDescription
+	n.mu.Unlock()
+	if fn != nil {
+		fn(peerID, desc, local)
+	}
+}
+
+// session returns peerID's session
+func (n *Negotiator) session(peerID string) (*session, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s, ok := n.sessions[peerID]
+	return s, ok
+}
+
+// Stats returns renegotiation counters
+func (n *Negotiator) Stats() Stats {
+	n.mu.Lock()
+	sessions := len(n.sessions)
+	n.mu.Unlock()
+	return Stats{
+		Sessions:   sessions,
+		Offers:     n.offers.Load(),
+		Answers:    n.answers.Load(),
+		Collisions: n.collisions.Load(),
+		Errors:     n.errors.Load(),
+	}
+}
@@ -0,0 +1,219 @@
+// Package overlay burns a watermark, the viewer count and a LIVE badge into
+// pictures before they are encoded. It works on raw 4:2:0 pictures, so it
+// applies to sources the gateway encodes itself (synthetic patterns, raw
+// V4L2 capture); streams that arrive encoded pass through untouched.
+package overlay
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"os"
+	"strconv"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/encoder"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/pattern"
+)
+
+// Positions
+const (
+	TopLeft     = "top-left"
+	TopRight    = "top-right"
+	BottomLeft  = "bottom-left"
+	BottomRight = "bottom-right"
+)
+
+// Config selects what is drawn
+type Config struct {
+	Text     string // Watermark text; empty for none
+	Image    string // PNG watermark file, drawn with its alpha; empty for none
+	Live     bool   // Draw a LIVE badge
+	Viewers  bool   // Draw the viewer count
+	Position string // Corner, default top-right
+}
+
+// Enabled reports whether cfg draws anything
+func (cfg Config) Enabled() bool {
+	return cfg.Text != "" || cfg.Image != "" || cfg.Live || cfg.Viewers
+}
+
+// Overlay draws the configured elements
+type Overlay struct {
+	cfg     Config
+	viewers func() int
+	logo    *logo
+}
+
+// logo is a watermark image converted to YCbCr with straight alpha
+type logo struct {
+	w, h      int
+	y, cb, cr []uint8
+	a         []uint8
+}
+
+// New creates an overlay. viewers returns the current viewer count and may
+// be nil when Viewers is off.
+func New(cfg Config, viewers func() int) (*Overlay, error) {
+	// Apply defaults for zero values
+	if cfg.Position == "" {
+		cfg.Position = TopRight
+	}
+
+	switch cfg.Position {
+	case TopLeft, TopRight, BottomLeft, BottomRight:
+	default:
+		return nil, fmt.Errorf("unknown overlay position %q", cfg.Position)
+	}
+	if cfg.Viewers && viewers == nil {
+		return nil, errors.New("viewer count overlay needs a viewer counter")
+	}
+
+	o := &Overlay{cfg: cfg, viewers: viewers}
+	if cfg.Image != "" {
+		l, err := loadLogo(cfg.Image)
+		if err != nil {
+			return nil, err
+		}
+		o.logo = l
+	}
+	return o, nil
+}
+
+// Draw draws the overlay onto img. It has the signature of
+// encoder.Config.Overlay.
+func (o *Overlay) Draw(img *image.YCbCr, _ int64) {
+	bounds := img.Rect
+	scale := max(1, bounds.Dy()/270)
+	margin := 4 * scale
+	pad := 2 * scale
+	lineGap := 3 * scale
+
+	// Lay out from the corner inwards: logo, text, then the badge row
+	type item struct {
+		size image.Point
+		draw func(at image.Point)
+	}
+	var items []item
+
+	if o.logo != nil {
+		items = append(items, item{image.Pt(o.logo.w, o.logo.h), func(at image.Point) { o.logo.draw(img, at) }})
+	}
+	if o.cfg.Text != "" {
+		size := pattern.TextSize(o.cfg.Text, scale).Add(image.Pt(scale, scale))
+		items = append(items, item{size, func(at image.Point) { shadowText(img, at, scale, o.cfg.Text, pattern.White) }})
+	}
+
+	var badges []item
+	if o.cfg.Live {
+		size := pattern.TextSize("LIVE", scale).Add(image.Pt(2*pad, 2*pad))
+		badges = append(badges, item{size, func(at image.Point) {
+			pattern.FillRect(img, image.Rectangle{Min: at, Max: at.Add(size)}, pattern.Red)
+			pattern.DrawText(img, at.Add(image.Pt(pad, pad)), scale, "LIVE", pattern.White)
+		}})
+	}
+	if o.cfg.Viewers {
+		text := strconv.Itoa(o.viewers()) + " WATCHING"
+		size := pattern.TextSize(text, scale).Add(image.Pt(2*pad, 2*pad))
+		badges = append(badges, item{size, func(at image.Point) {
+			pattern.FillRect(img, image.Rectangle{Min: at, Max: at.Add(size)}, pattern.Black)
+			pattern.DrawText(img, at.Add(image.Pt(pad, pad)), scale, text, pattern.White)
+		}})
+	}
+	if len(badges) > 0 {
+		var size image.Point
+		for i, b := range badges {
+			if i > 0 {
+				size.X += pad
+			}
+			size.X += b.size.X
+			size.Y = max(size.Y, b.size.Y)
+		}
+		items = append(items, item{size, func(at image.Point) {
+			for _, b := range badges {
+				b.draw(at)
+				at.X += b.size.X + pad
+			}
+		}})
+	}
+
+	left := o.cfg.Position == TopLeft || o.cfg.Position == BottomLeft
+	top := o.cfg.Position == TopLeft || o.cfg.Position == TopRight
+	y := bounds.Min.Y + margin
+	if !top {
+		y = bounds.Max.Y - margin
+	}
+	for _, it := range items {
+		x := bounds.Min.X + margin
+		if !left {
+			x = bounds.Max.X - margin - it.size.X
+		}
+		if top {
+			it.draw(image.Pt(x, y))
+			y += it.size.Y + lineGap
+		} else {
+			y -= it.size.Y
+			it.draw(image.Pt(x, y))
+			y -= lineGap
+		}
+	}
+}
+
+// shadowText draws text with a dark drop shadow so it reads on any picture
+func shadowText(img *image.YCbCr, at image.Point, scale int, text string, c pattern.Color) {
+	pattern.DrawText(img, at.Add(image.Pt(scale, scale)), scale, text, pattern.Black)
+	pattern.DrawText(img, at, scale, text, c)
+}
+
+// loadLogo reads a PNG watermark
+func loadLogo(path string) (*logo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open overlay image: %w", err)
+	}
+	defer f.Close()
+	src, err := png.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode overlay image: %w", err)
+	}
+
+	b := src.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(nrgba, nrgba.Rect, src, b.Min, draw.Src)
+
+	n := b.Dx() * b.Dy()
+	l := &logo{w: b.Dx(), h: b.Dy(), y: make([]uint8, n), cb: make([]uint8, n), cr: make([]uint8, n), a: make([]uint8, n)}
+	for i := 0; i < n; i++ {
+		p := nrgba.Pix[i*4 : i*4+4]
+		l.y[i], l.cb[i], l.cr[i] = encoder.RGBToYCbCr(p[0], p[1], p[2])
+		l.a[i] = p[3]
+	}
+	return l, nil
+}
+
+// draw blends the logo onto img with its top-left corner at at. Chroma is
+// blended once per 2x2 block, from the block's top-left logo pixel.
+func (l *logo) draw(img *image.YCbCr, at image.Point) {
+	r := image.Rect(at.X, at.Y, at.X+l.w, at.Y+l.h).Intersect(img.Rect)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			i := (y-at.Y)*l.w + (x - at.X)
+			a := uint32(l.a[i])
+			if a == 0 {
+				continue
+			}
+			o := img.YOffset(x, y)
+			img.Y[o] = blend(img.Y[o], l.y[i], a)
+			if x&1 == 0 && y&1 == 0 {
+				c := img.COffset(x, y)
+				img.Cb[c] = blend(img.Cb[c], l.cb[i], a)
+				img.Cr[c] = blend(img.Cr[c], l.cr[i], a)
+			}
+		}
+	}
+}
+
+func blend(dst, src uint8, alpha uint32) uint8 {
+	return uint8((uint32(src)*alpha + uint32(dst)*(255-alpha) + 127) / 255)
+}
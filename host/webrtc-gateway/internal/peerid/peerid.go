@@ -0,0 +1,318 @@
+// Package peerid decides what happens when a viewer offers with a peer ID
+// that is already connected, typically a client reconnecting before the
+// gateway noticed its old session drop.
+//
+// Viewers that want their previous ID back send it in the X-Peer-ID header
+// of their offer. Only IDs the gateway issued to a session that connected
+// recently are given back; any other gets a fresh ID, so viewers cannot
+// pick guessable ones. Depending on the policy, the old session is closed
+// and the new one takes the ID, the new one is refused, or both are kept
+// with the new one renamed. Issued IDs are random and only told to their
+// viewer, so knowing one is proof enough of having held it.
+package peerid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog"
+)
+
+// Errors returned by Resolve
+var (
+	ErrInUse     = errors.New("peer ID is already connected")
+	ErrInvalidID = errors.New("peer ID must be 1-64 letters, digits, '.', '_' or '-'")
+)
+
+// Policy is how a duplicate peer ID is handled
+type Policy string
+
+const (
+	Replace Policy = "replace" // Close the old session; the new one takes the ID
+	Reject  Policy = "reject"  // Refuse the new session
+	Suffix  Policy = "suffix"  // Keep both; the new one becomes "id-2", "id-3", ...
+)
+
+// Peers looks up connected viewers.
+// The WebRTC peer manager satisfies it.
+type Peers interface {
+	PeerConnection(peerID string) (*webrtc.PeerConnection, bool)
+}
+
+// Timing of replacements and reservations
+const (
+	// releaseTimeout is how long a replaced session has to shut down
+	releaseTimeout = 5 * time.Second
+
+	// reserveTTL is how long a resolved ID is held for its offer, unless
+	// the peer connects first
+	reserveTTL = 30 * time.Second
+
+	// rememberTTL is how long after its session leaves an ID is given back
+	// to a reconnecting viewer
+	rememberTTL = 10 * time.Minute
+
+	maxSuffix = 100
+)
+
+// Stats are duplicate peer ID counters
+type Stats struct {
+	Policy   Policy `json:"policy"`
+	Replaced uint64 `json:"replaced"`
+	Rejected uint64 `json:"rejected"`
+	Suffixed uint64 `json:"suffixed"`
+}
+
+// Resolver applies the policy to requested peer IDs
+type Resolver struct {
+	policy Policy
+	peers  Peers
+	logger zerolog.Logger
+
+	// Resolved IDs whose offer is still being answered, so concurrent
+	// offers for one ID do not both get it
+	mu       sync.Mutex
+	reserved map[string]time.Time
+
+	// IDs of sessions that connected, with when they were last seen
+	issued map[string]time.Time
+
+	// Statistics
+	replaced atomic.Uint64
+	rejected atomic.Uint64
+	suffixed atomic.Uint64
+}
+
+// ParsePolicy validates a policy name; "" is Replace
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case "":
+		return Replace, nil
+	case Replace, Reject, Suffix:
+		return p, nil
+	default:
+		return "", fmt.Errorf("duplicate peer policy must be %q, %q or %q", Replace, Reject, Suffix)
+	}
+}
+
+// New creates a resolver
+func New(policy Policy, peers Peers, logger zerolog.Logger) *Resolver {
+	return &Resolver{
+		policy:   policy,
+		peers:    peers,
+		logger:   logger.With().Str("component", "peer_ids").Logger(),
+		reserved: make(map[string]time.Time),
+		issued:   make(map[string]time.Time),
+	}
+}
+
+// Resolve returns the ID a new session offering with requested gets, ""
+// meaning the signaling server assigns a fresh one, as it does for IDs the
+// gateway did not issue. Under Replace it closes the old session first and
+// waits until it is gone.
+func (r *Resolver) Resolve(ctx context.Context, requested string) (string, error) {
+	if requested == "" {
+		return "", nil
+	}
+	if !valid(requested) {
+		return "", ErrInvalidID
+	}
+
+	r.mu.Lock()
+	if !r.wasIssued(requested) {
+		r.mu.Unlock()
+		r.logger.Debug().Str("peer_id", requested).Msg("Ignored request for a peer ID the gateway did not issue")
+		return "", nil
+	}
+	if !r.taken(requested) {
+		r.reserve(requested)
+		r.mu.Unlock()
+		return requested, nil
+	}
+
+	switch r.policy {
+	case Reject:
+		r.mu.Unlock()
+		r.rejected.Add(1)
+		r.logger.Info().Str("peer_id", requested).Msg("Refused session with a connected peer ID")
+		return "", ErrInUse
+
+	case Suffix:
+		defer r.mu.Unlock()
+		for n := 2; n <= maxSuffix; n++ {
+			id := requested + "-" + strconv.Itoa(n)
+			if !r.taken(id) {
+				r.reserve(id)
+				r.suffixed.Add(1)
+				r.logger.Info().Str("peer_id", requested).Str("new_peer_id", id).Msg("Renamed session with a connected peer ID")
+				return id, nil
+			}
+		}
+		r.rejected.Add(1)
+		return "", ErrInUse
+
+	default:
+		// Another offer already holds the ID; replacing a session that is
+		// not up yet would hand the ID out twice
+		if r.pending(requested) {
+			r.mu.Unlock()
+			r.rejected.Add(1)
+			return "", ErrInUse
+		}
+		// Reserve first, so a concurrent offer is not handed the ID while
+		// the old session closes
+		r.reserve(requested)
+		r.mu.Unlock()
+		if err := r.replace(ctx, requested); err != nil {
+			r.Release(requested)
+			r.rejected.Add(1)
+			return "", err
+		}
+		r.replaced.Add(1)
+		return requested, nil
+	}
+}
+
+// Release drops the reservation of a resolved ID; call when its offer
+// fails
+func (r *Resolver) Release(peerID string) {
+	r.mu.Lock()
+	delete(r.reserved, peerID)
+	r.mu.Unlock()
+}
+
+// Connected records peerID as issued, so its viewer may ask for it back,
+// and drops its reservation
+func (r *Resolver) Connected(peerID string) {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.reserved, peerID)
+	for id, at := range r.issued {
+		if now.Sub(at) >= rememberTTL {
+			if _, ok := r.peers.PeerConnection(id); !ok {
+				delete(r.issued, id)
+			}
+		}
+	}
+	r.issued[peerID] = now
+}
+
+// Disconnected starts the time peerID is remembered for its viewer
+func (r *Resolver) Disconnected(peerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.issued[peerID]; ok {
+		r.issued[peerID] = time.Now()
+	}
+}
+
+// Stats returns the policy and counters
+func (r *Resolver) Stats() Stats {
+	return Stats{
+		Policy:   r.policy,
+		Replaced: r.replaced.Load(),
+		Rejected: r.rejected.Load(),
+		Suffixed: r.suffixed.Load(),
+	}
+}
+
+// HTTPStatus maps a Resolve error to a response status
+func HTTPStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrInvalidID):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrInUse):
+		return http.StatusConflict
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// replace closes the session holding peerID and waits for the peer
+// manager to let it go, so the old session's teardown cannot clean up
+// after the new one
+func (r *Resolver) replace(ctx context.Context, peerID string) error {
+	if pc, ok := r.peers.PeerConnection(peerID); ok {
+		r.logger.Info().Str("peer_id", peerID).Msg("Replacing session of a reconnecting peer")
+		if err := pc.Close(); err != nil {
+			r.logger.Warn().Err(err).Str("peer_id", peerID).Msg("Failed to close replaced session")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, releaseTimeout)
+	defer cancel()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if _, ok := r.peers.PeerConnection(peerID); !ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			r.logger.Warn().Str("peer_id", peerID).Msg("Replaced session did not shut down in time")
+			return ErrInUse
+		case <-ticker.C:
+		}
+	}
+}
+
+// taken reports whether id is connected or reserved. Caller holds mu.
+func (r *Resolver) taken(id string) bool {
+	if r.pending(id) {
+		return true
+	}
+	_, ok := r.peers.PeerConnection(id)
+	return ok
+}
+
+// wasIssued reports whether id belongs to a session that connected and
+// has not been gone for long. Caller holds mu.
+func (r *Resolver) wasIssued(id string) bool {
+	at, ok := r.issued[id]
+	if !ok {
+		return false
+	}
+	if time.Since(at) < rememberTTL {
+		return true
+	}
+	_, connected := r.peers.PeerConnection(id)
+	return connected
+}
+
+// pending reports whether id is reserved for an offer. Caller holds mu.
+func (r *Resolver) pending(id string) bool {
+	at, ok := r.reserved[id]
+	if ok && time.Since(at) >= reserveTTL {
+		delete(r.reserved, id)
+		return false
+	}
+	return ok
+}
+
+// reserve holds id for its offer. Caller holds mu.
+func (r *Resolver) reserve(id string) {
+	r.reserved[id] = time.Now()
+}
+
+// valid reports whether id is safe to use as a peer ID
+func valid(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
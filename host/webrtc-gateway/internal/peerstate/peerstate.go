@@ -0,0 +1,324 @@
+// Package peerstate tracks each viewer's connection through a lifecycle the
+// front end can show: gathering, connecting, connected, degraded,
+// reconnecting, failed and closed. It folds pion's separate ICE gathering,
+// ICE connection and peer connection states, plus connection quality, into
+// one state per peer, and streams every change with its reason.
+package peerstate
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog"
+)
+
+// State is a stage of a peer's connection
+type State string
+
+const (
+	Gathering    State = "gathering"    // Collecting ICE candidates
+	Connecting   State = "connecting"   // Checking candidate pairs and handshaking
+	Connected    State = "connected"    // Media is flowing
+	Degraded     State = "degraded"     // Connected, but the connection quality is poor
+	Reconnecting State = "reconnecting" // Connectivity was lost and ICE is trying to recover it
+	Failed       State = "failed"       // The connection could not be established or recovered
+	Closed       State = "closed"       // The session ended
+)
+
+// Reasons given with events
+const (
+	ReasonICEGathering    = "ice_gathering"
+	ReasonICEChecking     = "ice_checking"
+	ReasonICEConnected    = "ice_connected"
+	ReasonICEDisconnected = "ice_disconnected"
+	ReasonICEFailed       = "ice_failed"
+	ReasonDTLSConnecting  = "dtls_connecting"
+	ReasonConnected       = "connected"
+	ReasonFailed          = "connection_failed"
+	ReasonQualityPoor     = "quality_poor"
+	ReasonQualityRestored = "quality_restored"
+	ReasonClosed          = "closed"
+	ReasonPeerLeft        = "peer_left"
+)
+
+// Event is a change of a peer's state
+type Event struct {
+	PeerID   string    `json:"peer_id"`
+	State    State     `json:"state"`
+	Previous State     `json:"previous,omitempty"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+}
+
+// Reporter is implemented by peer managers that report every transition
+// of each peer's connection, not only connect and disconnect
+type Reporter interface {
+	SetOnICEGatheringStateChange(fn func(peerID string, state webrtc.ICEGatheringState))
+	SetOnICEConnectionStateChange(fn func(peerID string, state webrtc.ICEConnectionState))
+	SetOnConnectionStateChange(fn func(peerID string, state webrtc.PeerConnectionState))
+}
+
+// Stats are state machine counters
+type Stats struct {
+	States     map[State]int `json:"states"` // Peers in each state
+	Events     uint64        `json:"events"`
+	Dropped    uint64        `json:"dropped"` // Events a slow subscriber missed
+	Rejected   uint64        `json:"rejected"`
+	Reconnects uint64        `json:"reconnects"` // Recoveries from reconnecting
+}
+
+// peer is one peer's state
+type peer struct {
+	state     State
+	connected bool // Has been connected; losing connectivity is then reconnecting
+	degraded  bool
+}
+
+// subscriber is one subscription's queue
+type subscriber struct {
+	ch chan Event
+}
+
+// Machine holds each peer's state
+type Machine struct {
+	logger zerolog.Logger
+
+	mu    sync.Mutex
+	peers map[string]*peer
+	subs  map[*subscriber]struct{}
+
+	// Statistics
+	events     atomic.Uint64
+	dropped    atomic.Uint64
+	rejected   atomic.Uint64
+	reconnects atomic.Uint64
+}
+
+// New creates a state machine
+func New(logger zerolog.Logger) *Machine {
+	return &Machine{
+		logger: logger.With().Str("component", "peer_state").Logger(),
+		peers:  make(map[string]*peer),
+		subs:   make(map[*subscriber]struct{}),
+	}
+}
+
+// Attach feeds the machine from a peer manager's transitions
+func (m *Machine) Attach(r Reporter) {
+	r.SetOnICEGatheringStateChange(m.ICEGatheringStateChanged)
+	r.SetOnICEConnectionStateChange(m.ICEConnectionStateChanged)
+	r.SetOnConnectionStateChange(m.ConnectionStateChanged)
+}
+
+// Subscribe returns a channel receiving every state change and a function
+// that ends the subscription. A subscriber that falls behind loses events
+// rather than stalling the peer manager.
+func (m *Machine) Subscribe(bufferSize int) (<-chan Event, func()) {
+	if bufferSize <= 0 {
+		bufferSize = 64
+	}
+	sub := &subscriber{ch: make(chan Event, bufferSize)}
+
+	m.mu.Lock()
+	m.subs[sub] = struct{}{}
+	m.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			m.mu.Lock()
+			delete(m.subs, sub)
+			m.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// ICEGatheringStateChanged records a peer's ICE gathering state
+func (m *Machine) ICEGatheringStateChanged(peerID string, state webrtc.ICEGatheringState) {
+	if state == webrtc.ICEGatheringStateGathering {
+		m.transition(peerID, Gathering, ReasonICEGathering)
+	}
+}
+
+// ICEConnectionStateChanged records a peer's ICE connection state
+func (m *Machine) ICEConnectionStateChanged(peerID string, state webrtc.ICEConnectionState) {
+	switch state {
+	case webrtc.ICEConnectionStateChecking:
+		m.transition(peerID, Connecting, ReasonICEChecking)
+	case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+		// Only a recovery; the first connection waits for DTLS
+		m.mu.Lock()
+		p := m.peers[peerID]
+		recovering := p != nil && p.state == Reconnecting
+		m.mu.Unlock()
+		if recovering {
+			m.transition(peerID, Connected, ReasonICEConnected)
+		}
+	case webrtc.ICEConnectionStateDisconnected:
+		m.transition(peerID, Reconnecting, ReasonICEDisconnected)
+	case webrtc.ICEConnectionStateFailed:
+		m.transition(peerID, Failed, ReasonICEFailed)
+	}
+}
+
+// ConnectionStateChanged records a peer's connection state
+func (m *Machine) ConnectionStateChanged(peerID string, state webrtc.PeerConnectionState) {
+	switch state {
+	case webrtc.PeerConnectionStateConnecting:
+		m.transition(peerID, Connecting, ReasonDTLSConnecting)
+	case webrtc.PeerConnectionStateConnected:
+		m.transition(peerID, Connected, ReasonConnected)
+	case webrtc.PeerConnectionStateDisconnected:
+		m.transition(peerID, Reconnecting, ReasonICEDisconnected)
+	case webrtc.PeerConnectionStateFailed:
+		m.transition(peerID, Failed, ReasonFailed)
+	case webrtc.PeerConnectionStateClosed:
+		m.transition(peerID, Closed, ReasonClosed)
+	}
+}
+
+// PeerConnected records a connection reported without transitions, by a
+// peer manager that is not a Reporter
+func (m *Machine) PeerConnected(peerID string) {
+	m.transition(peerID, Connected, ReasonConnected)
+}
+
+// PeerDisconnected records the end of a session and forgets the peer
+func (m *Machine) PeerDisconnected(peerID string) {
+	m.transition(peerID, Closed, ReasonPeerLeft)
+
+	m.mu.Lock()
+	delete(m.peers, peerID)
+	m.mu.Unlock()
+}
+
+// SetDegraded marks a connected peer degraded or restores it, e.g. on
+// connection quality changes
+func (m *Machine) SetDegraded(peerID string, degraded bool) {
+	m.mu.Lock()
+	p := m.peers[peerID]
+	if p == nil || p.degraded == degraded {
+		m.mu.Unlock()
+		return
+	}
+	p.degraded = degraded
+	state := p.state
+	m.mu.Unlock()
+
+	// Degradation only shows while connected; it is kept for later
+	switch {
+	case degraded && state == Connected:
+		m.transition(peerID, Degraded, ReasonQualityPoor)
+	case !degraded && state == Degraded:
+		m.transition(peerID, Connected, ReasonQualityRestored)
+	}
+}
+
+// State returns peerID's state
+func (m *Machine) State(peerID string) (State, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.peers[peerID]
+	if !ok {
+		return "", false
+	}
+	return p.state, true
+}
+
+// States returns the state of every known peer
+func (m *Machine) States() map[string]State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]State, len(m.peers))
+	for id, p := range m.peers {
+		out[id] = p.state
+	}
+	return out
+}
+
+// Stats returns state machine counters
+func (m *Machine) Stats() Stats {
+	m.mu.Lock()
+	states := make(map[State]int)
+	for _, p := range m.peers {
+		states[p.state]++
+	}
+	m.mu.Unlock()
+	return Stats{
+		States:     states,
+		Events:     m.events.Load(),
+		Dropped:    m.dropped.Load(),
+		Rejected:   m.rejected.Load(),
+		Reconnects: m.reconnects.Load(),
+	}
+}
+
+// allowed reports whether a peer may move from one state to another.
+// Gathering and connecting only precede the first connection; failed and
+// closed are final, except that a failed peer is closed.
+func allowed(from, to State, connected bool) bool {
+	switch from {
+	case Closed:
+		return false
+	case Failed:
+		return to == Closed
+	}
+	switch to {
+	case Gathering, Connecting:
+		return !connected
+	case Reconnecting:
+		return connected
+	}
+	return true
+}
+
+// transition moves peerID to state and notifies subscribers
+func (m *Machine) transition(peerID string, state State, reason string) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := m.peers[peerID]
+	if p == nil {
+		if state == Closed {
+			return // Already forgotten
+		}
+		p = &peer{}
+		m.peers[peerID] = p
+	}
+	// A degraded peer that recovers connectivity is still degraded
+	if state == Connected && p.degraded {
+		state = Degraded
+	}
+	if p.state == state {
+		return
+	}
+	if !allowed(p.state, state, p.connected) {
+		m.rejected.Add(1)
+		m.logger.Debug().Str("peer_id", peerID).Str("from", string(p.state)).Str("to", string(state)).Str("reason", reason).Msg("Ignoring peer state transition")
+		return
+	}
+	if state == Connected || state == Degraded {
+		if p.state == Reconnecting {
+			m.reconnects.Add(1)
+		}
+		p.connected = true
+	}
+	event := Event{PeerID: peerID, State: state, Previous: p.state, Reason: reason, Time: now.UTC()}
+	p.state = state
+
+	m.events.Add(1)
+	m.logger.Debug().Str("peer_id", peerID).Str("from", string(event.Previous)).Str("state", string(state)).Str("reason", reason).Msg("Peer state changed")
+
+	// Sent under the lock, so a subscription is not closed mid-send
+	for sub := range m.subs {
+		select {
+		case sub.ch <- event:
+		default:
+			m.dropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Package presence tracks who is watching each stream: the connected
+// peers, when they joined and, optionally, roughly where from. Every join
+// and leave is streamed to subscribers such as live dashboards.
+package presence
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// EventType is what happened to a viewer
+type EventType string
+
+const (
+	Joined EventType = "joined"
+	Left   EventType = "left"
+)
+
+// Viewer is one connected peer
+type Viewer struct {
+	PeerID   string    `json:"peer_id"`
+	Stream   string    `json:"stream"`
+	JoinedAt time.Time `json:"joined_at"`
+	Address  string    `json:"address,omitempty"`  // Remote IP of the selected candidate pair
+	Location string    `json:"location,omitempty"` // Approximate, when a Locator is set
+}
+
+// Event is a viewer joining or leaving a stream
+type Event struct {
+	Type    EventType `json:"type"`
+	Viewer  Viewer    `json:"viewer"`
+	Viewers int       `json:"viewers"` // Viewers of the stream after the event
+	Time    time.Time `json:"time"`
+}
+
+// Locator names the approximate location of an address
+type Locator interface {
+	Locate(ip netip.Addr) string
+}
+
+// Stats are presence counters
+type Stats struct {
+	Streams map[string]int `json:"streams"` // Viewers of each stream
+	Joins   uint64         `json:"joins"`
+	Dropped uint64         `json:"dropped"` // Events a slow subscriber missed
+}
+
+// subscriber is one subscription's queue
+type subscriber struct {
+	ch chan Event
+}
+
+// Tracker holds the viewers of every stream
+type Tracker struct {
+	logger  zerolog.Logger
+	locator Locator
+
+	mu      sync.Mutex
+	viewers map[string]*Viewer // By peer ID
+	subs    map[*subscriber]struct{}
+
+	// Statistics
+	joins   atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// New creates a tracker; locator may be nil to leave locations out
+func New(locator Locator, logger zerolog.Logger) *Tracker {
+	return &Tracker{
+		logger:  logger.With().Str("component", "presence").Logger(),
+		locator: locator,
+		viewers: make(map[string]*Viewer),
+		subs:    make(map[*subscriber]struct{}),
+	}
+}
+
+// Join records peerID watching stream from addr, an IP address with or
+// without a port, or "" if unknown. Joining again moves the peer.
+func (t *Tracker) Join(peerID, stream, addr string) {
+	v := &Viewer{
+		PeerID:   peerID,
+		Stream:   stream,
+		JoinedAt: time.Now().UTC(),
+	}
+	if ip, ok := parseAddr(addr); ok {
+		v.Address = ip.String()
+		if t.locator != nil {
+			v.Location = t.locator.Locate(ip)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if old, ok := t.viewers[peerID]; ok {
+		delete(t.viewers, peerID)
+		t.notify(Left, *old)
+	}
+	t.viewers[peerID] = v
+	t.joins.Add(1)
+	t.notify(Joined, *v)
+}
+
+// Leave forgets a peer; call when it disconnects
+func (t *Tracker) Leave(peerID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.viewers[peerID]
+	if !ok {
+		return
+	}
+	delete(t.viewers, peerID)
+	t.notify(Left, *v)
+}
+
+// Viewers returns the viewers of stream, longest watching first
+func (t *Tracker) Viewers(stream string) []Viewer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.list(stream)
+}
+
+// Subscribe returns the current viewers of stream together with a channel
+// receiving every later join and leave of any stream, and a function that
+// ends the subscription. A subscriber that falls behind loses events
+// rather than stalling peer setup.
+func (t *Tracker) Subscribe(stream string, bufferSize int) ([]Viewer, <-chan Event, func()) {
+	if bufferSize <= 0 {
+		bufferSize = 64
+	}
+	sub := &subscriber{ch: make(chan Event, bufferSize)}
+
+	t.mu.Lock()
+	current := t.list(stream)
+	t.subs[sub] = struct{}{}
+	t.mu.Unlock()
+
+	var once sync.Once
+	return current, sub.ch, func() {
+		once.Do(func() {
+			t.mu.Lock()
+			delete(t.subs, sub)
+			t.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// Stats returns presence counters
+func (t *Tracker) Stats() Stats {
+	t.mu.Lock()
+	streams := make(map[string]int)
+	for _, v := range t.viewers {
+		streams[v.Stream]++
+	}
+	t.mu.Unlock()
+	return Stats{
+		Streams: streams,
+		Joins:   t.joins.Load(),
+		Dropped: t.dropped.Load(),
+	}
+}
+
+// list returns the viewers of stream. Caller holds mu.
+func (t *Tracker) list(stream string) []Viewer {
+	list := make([]Viewer, 0)
+	for _, v := range t.viewers {
+		if v.Stream == stream {
+			list = append(list, *v)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].JoinedAt.Before(list[j].JoinedAt) })
+	return list
+}
+
+// notify sends an event to subscribers. Caller holds mu, so a
+// subscription is not closed mid-send.
+func (t *Tracker) notify(typ EventType, v Viewer) {
+	count := 0
+	for _, other := range t.viewers {
+		if other.Stream == v.Stream {
+			count++
+		}
+	}
+	event := Event{Type: typ, Viewer: v, Viewers: count, Time: time.Now().UTC()}
+
+	t.logger.Debug().Str("peer_id", v.PeerID).Str("stream", v.Stream).Str("event", string(typ)).Int("viewers", count).Msg("Presence changed")
+	for sub := range t.subs {
+		select {
+		case sub.ch <- event:
+		default:
+			t.dropped.Add(1)
+		}
+	}
+}
+
+// Networks locates addresses by the named networks containing them.
+// Addresses outside every network are "local network" when private or
+// loopback, otherwise "internet".
+type Networks []Network
+
+// Network is a named address range
+type Network struct {
+	Prefix netip.Prefix
+	Name   string
+}
+
+// ParseNetworks parses "cidr=name" entries such as "10.8.0.0/24=VPN"
+func ParseNetworks(entries []string) (Networks, error) {
+	networks := make(Networks, 0, len(entries))
+	for _, entry := range entries {
+		cidr, name, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("location %q must be cidr=name", entry)
+		}
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("location %q: invalid network", entry)
+		}
+		networks = append(networks, Network{Prefix: prefix.Masked(), Name: strings.TrimSpace(name)})
+	}
+	// The most specific network wins
+	sort.SliceStable(networks, func(i, j int) bool { return networks[i].Prefix.Bits() > networks[j].Prefix.Bits() })
+	return networks, nil
+}
+
+// Locate names the network containing ip
+func (n Networks) Locate(ip netip.Addr) string {
+	for _, network := range n {
+		if network.Prefix.Contains(ip) {
+			return network.Name
+		}
+	}
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return "local network"
+	}
+	return "internet"
+}
+
+// parseAddr parses the IP of a "host:port" or bare address
+func parseAddr(addr string) (netip.Addr, bool) {
+	if addr == "" {
+		return netip.Addr{}, false
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap().WithZone(""), true
+}
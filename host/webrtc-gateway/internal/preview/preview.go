@@ -0,0 +1,343 @@
+// Package preview produces a small, low frame rate MJPEG rendition of the
+// stream for dashboards and stream pickers. Preview viewers are plain HTTP
+// clients, so they never take a WebRTC peer slot.
+//
+// With ffmpeg on PATH the whole stream is decoded and resampled to the
+// preview rate. Without it only keyframes are decoded, through the decoder
+// package, so the preview updates once per GOP at best. Either way nothing
+// is decoded while no one is watching.
+package preview
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/jpeg"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/decoder"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// ErrNoFrame is returned by Latest before the first preview frame
+var ErrNoFrame = errors.New("no preview frame yet")
+
+// pollDemand is how long a Latest call keeps the preview rendering
+const pollDemand = 10 * time.Second
+
+// Modes
+const (
+	ModeStream   = "stream"   // ffmpeg decodes every frame
+	ModeKeyframe = "keyframe" // Only keyframes are decoded
+)
+
+// Config configures the preview
+type Config struct {
+	// FPS is the preview frame rate, default 2
+	FPS int
+
+	// Width is the preview width in pixels, default 320; the height keeps
+	// the aspect ratio
+	Width int
+
+	// Quality is the JPEG quality, default 70
+	Quality int
+
+	// Decoder is the decoder backend used in keyframe mode
+	Decoder string
+}
+
+// Stats are preview counters
+type Stats struct {
+	Mode    string `json:"mode"`
+	Viewers int    `json:"viewers"`
+	Frames  uint64 `json:"frames"`
+	Dropped uint64 `json:"dropped"`
+	Errors  uint64 `json:"errors"`
+}
+
+// Service renders the preview for any number of viewers
+type Service struct {
+	cfg    Config
+	logger zerolog.Logger
+	ffmpeg string // Path of the ffmpeg binary; empty selects keyframe mode
+
+	mu      sync.Mutex
+	viewers map[chan []byte]struct{}
+	latest  []byte
+	polled  time.Time // Last Latest call
+	stream  *stream   // Running ffmpeg in stream mode
+	retryAt time.Time
+
+	// Keyframe mode state, guarded by mu
+	lastDecode time.Time
+	decoding   bool
+	dec        decoder.Decoder
+	decCodec   string
+
+	// Statistics
+	frames  atomic.Uint64
+	dropped atomic.Uint64
+	errors  atomic.Uint64
+}
+
+// New creates a preview service
+func New(cfg Config, logger zerolog.Logger) *Service {
+	// Apply defaults for zero values
+	if cfg.FPS <= 0 {
+		cfg.FPS = 2
+	}
+	if cfg.Width <= 0 {
+		cfg.Width = 320
+	}
+	if cfg.Quality <= 0 {
+		cfg.Quality = 70
+	}
+
+	s := &Service{
+		cfg:     cfg,
+		logger:  logger.With().Str("component", "preview").Logger(),
+		viewers: make(map[chan []byte]struct{}),
+	}
+	if path, err := exec.LookPath("ffmpeg"); err == nil {
+		s.ffmpeg = path
+	}
+	s.logger.Info().Str("mode", s.mode()).Int("fps", cfg.FPS).Int("width", cfg.Width).Msg("Preview ready")
+	return s
+}
+
+func (s *Service) mode() string {
+	if s.ffmpeg != "" {
+		return ModeStream
+	}
+	return ModeKeyframe
+}
+
+// Subscribe registers a viewer. JPEG frames arrive on the channel, starting
+// with the latest one; frames are skipped when the viewer falls behind.
+// cancel must be called when the viewer leaves.
+func (s *Service) Subscribe() (frames <-chan []byte, cancel func()) {
+	ch := make(chan []byte, 2)
+	s.mu.Lock()
+	s.viewers[ch] = struct{}{}
+	if s.latest != nil {
+		ch <- s.latest
+	}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.viewers, ch)
+			s.mu.Unlock()
+		})
+	}
+}
+
+// Latest returns the most recent preview frame. Calls keep the preview
+// rendering for a while without a subscription.
+func (s *Service) Latest() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.polled = time.Now()
+	if s.latest == nil {
+		return nil, ErrNoFrame
+	}
+	return s.latest, nil
+}
+
+// Observe feeds the preview. It is a media.Distributor tap and returns
+// immediately when no one is watching.
+func (s *Service) Observe(f media.VideoFrame) {
+	if f.Codec != "h264" && f.Codec != "hevc" {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.viewers) == 0 && time.Since(s.polled) > pollDemand {
+		s.stopLocked()
+		return
+	}
+
+	if s.ffmpeg == "" {
+		s.observeKeyframe(f)
+		return
+	}
+
+	if s.stream != nil && (s.stream.codec != f.Codec || s.stream.rotation != f.Rotation || s.stream.exited()) {
+		s.stopLocked()
+	}
+	if s.stream == nil {
+		if !f.IsKeyframe || time.Now().Before(s.retryAt) {
+			return
+		}
+		st, err := startStream(s.ffmpeg, f.Codec, f.Rotation, s.cfg, s.publish)
+		if err != nil {
+			s.errors.Add(1)
+			s.retryAt = time.Now().Add(5 * time.Second)
+			s.logger.Warn().Err(err).Msg("Failed to start preview decoder")
+			return
+		}
+		s.stream = st
+		s.logger.Debug().Str("codec", f.Codec).Msg("Preview decoder started")
+	}
+	if !s.stream.feed(f) {
+		s.dropped.Add(1)
+	}
+}
+
+// observeKeyframe decodes at most FPS keyframes per second off the tap's
+// goroutine. Caller holds mu.
+func (s *Service) observeKeyframe(f media.VideoFrame) {
+	interval := time.Second / time.Duration(s.cfg.FPS)
+	if !f.IsKeyframe || s.decoding || time.Since(s.lastDecode) < interval {
+		return
+	}
+	if s.dec == nil || s.decCodec != f.Codec {
+		if s.dec != nil {
+			s.dec.Close()
+		}
+		dec, err := decoder.New(decoder.Config{Backend: s.cfg.Decoder, Codec: f.Codec})
+		if err != nil {
+			s.dec = nil
+			s.errors.Add(1)
+			return
+		}
+		s.dec, s.decCodec = dec, f.Codec
+	}
+	s.decoding = true
+	s.lastDecode = time.Now()
+	dec := s.dec
+	go func() {
+		img, err := dec.Decode(f.Data)
+		s.mu.Lock()
+		s.decoding = false
+		s.mu.Unlock()
+		if err != nil {
+			s.errors.Add(1)
+			s.logger.Debug().Err(err).Msg("Failed to decode preview keyframe")
+			return
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, Scale(Rotate(img, f.Rotation), s.cfg.Width), &jpeg.Options{Quality: s.cfg.Quality}); err != nil {
+			s.errors.Add(1)
+			return
+		}
+		s.publish(buf.Bytes())
+	}()
+}
+
+// publish hands a JPEG to every viewer
+func (s *Service) publish(frame []byte) {
+	s.frames.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latest = frame
+	for ch := range s.viewers {
+		select {
+		case ch <- frame:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// stopLocked stops the stream decoder. Caller holds mu.
+func (s *Service) stopLocked() {
+	if s.stream != nil {
+		s.stream.stop()
+		s.stream = nil
+	}
+}
+
+// Close stops decoding
+func (s *Service) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stopLocked()
+	if s.dec != nil {
+		s.dec.Close()
+		s.dec = nil
+	}
+	return nil
+}
+
+// Stats returns preview counters
+func (s *Service) Stats() Stats {
+	s.mu.Lock()
+	viewers := len(s.viewers)
+	s.mu.Unlock()
+	return Stats{
+		Mode:    s.mode(),
+		Viewers: viewers,
+		Frames:  s.frames.Load(),
+		Dropped: s.dropped.Load(),
+		Errors:  s.errors.Load(),
+	}
+}
+
+// Rotate turns img clockwise by 90, 180 or 270 degrees, as a stream's
+// display rotation asks. Other rotations return img unchanged.
+func Rotate(img image.Image, degrees int) image.Image {
+	if degrees != 90 && degrees != 180 && degrees != 270 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := image.NewRGBA(image.Rect(0, 0, h, w))
+	if degrees == 180 {
+		out = image.NewRGBA(image.Rect(0, 0, w, h))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch degrees {
+			case 90:
+				dx, dy = h-1-y, x
+			case 180:
+				dx, dy = w-1-x, h-1-y
+			case 270:
+				dx, dy = y, w-1-x
+			}
+			out.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return out
+}
+
+// Scale shrinks img to width, keeping the aspect ratio, by averaging boxes
+// of source pixels. Images already that narrow are returned unchanged.
+func Scale(img image.Image, width int) image.Image {
+	b := img.Bounds()
+	if b.Dx() <= width {
+		return img
+	}
+	height := max(1, b.Dy()*width/b.Dx())
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := b.Min.Y+y*b.Dy()/height, b.Min.Y+(y+1)*b.Dy()/height
+		for x := 0; x < width; x++ {
+			x0, x1 := b.Min.X+x*b.Dx()/width, b.Min.X+(x+1)*b.Dx()/width
+			var r, g, bl, n uint32
+			// Sample a 2x2 grid of the box; enough for a thumbnail
+			for _, sy := range []int{y0, (y0 + y1) / 2} {
+				for _, sx := range []int{x0, (x0 + x1) / 2} {
+					pr, pg, pb, _ := img.At(sx, sy).RGBA()
+					r, g, bl, n = r+pr, g+pg, bl+pb, n+1
+				}
+			}
+			i := out.PixOffset(x, y)
+			out.Pix[i+0] = uint8(r / n >> 8)
+			out.Pix[i+1] = uint8(g / n >> 8)
+			out.Pix[i+2] = uint8(bl / n >> 8)
+			out.Pix[i+3] = 0xFF
+		}
+	}
+	return out
+}
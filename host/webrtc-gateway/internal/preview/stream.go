@@ -0,0 +1,221 @@
+package preview
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// stream is a running ffmpeg process turning the encoded stream into MJPEG
+type stream struct {
+	codec    string
+	rotation int // Display rotation applied to the pictures
+	cancel   context.CancelFunc
+	frames   chan []byte
+	done     atomic.Bool
+
+	// needKeyframe is set after a drop, since decoding cannot resume from
+	// the middle of a GOP. Only touched under Service.mu.
+	needKeyframe bool
+}
+
+// startStream launches ffmpeg; publish receives every JPEG it produces
+func startStream(path, codec string, rotation int, cfg Config, publish func([]byte)) (*stream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, path,
+		"-hide_banner", "-loglevel", "error",
+		"-fflags", "nobuffer", "-f", codec, "-i", "pipe:0",
+		"-vf", fmt.Sprintf("fps=%d,%sscale=%d:-2", cfg.FPS, rotateFilter(rotation), cfg.Width),
+		"-q:v", strconv.Itoa(jpegQScale(cfg.Quality)),
+		"-f", "image2pipe", "-c:v", "mjpeg", "pipe:1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	st := &stream{codec: codec, rotation: rotation, cancel: cancel, frames: make(chan []byte, 30)}
+
+	// Writer: frames are queued so a slow decoder never blocks the tap
+	go func() {
+		defer stdin.Close()
+		for {
+			select {
+			case data := <-st.frames:
+				if _, err := stdin.Write(data); err != nil {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Reader: split ffmpeg's output into JPEGs
+	go func() {
+		r := bufio.NewReaderSize(stdout, 64*1024)
+		for {
+			frame, err := readJPEG(r)
+			if err != nil {
+				break
+			}
+			publish(frame)
+		}
+		cmd.Wait()
+		st.done.Store(true)
+	}()
+
+	return st, nil
+}
+
+// feed queues a frame, reporting false when it was dropped. Caller holds
+// Service.mu.
+func (st *stream) feed(f media.VideoFrame) bool {
+	if st.needKeyframe && !f.IsKeyframe {
+		return false
+	}
+	select {
+	case st.frames <- f.Data:
+		st.needKeyframe = false
+		return true
+	default:
+		st.needKeyframe = true
+		return false
+	}
+}
+
+func (st *stream) exited() bool {
+	return st.done.Load()
+}
+
+func (st *stream) stop() {
+	st.cancel()
+}
+
+// rotateFilter returns the ffmpeg filters turning pictures clockwise by a
+// display rotation, ending in a comma, or "" for none
+func rotateFilter(rotation int) string {
+	switch rotation {
+	case 90:
+		return "transpose=clock,"
+	case 180:
+		return "hflip,vflip,"
+	case 270:
+		return "transpose=cclock,"
+	}
+	return ""
+}
+
+// jpegQScale maps a 1-100 JPEG quality to ffmpeg's 2-31 qscale, where lower
+// is better
+func jpegQScale(quality int) int {
+	return max(2, min(31, 31-quality*29/100))
+}
+
+// readJPEG reads one JPEG image: marker segments up to the scan, then
+// entropy-coded data up to the EOI marker
+func readJPEG(r *bufio.Reader) ([]byte, error) {
+	var buf []byte
+	readByte := func() (byte, error) {
+		b, err := r.ReadByte()
+		if err == nil {
+			buf = append(buf, b)
+		}
+		return b, err
+	}
+
+	// Skip to SOI
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0xFF {
+			continue
+		}
+		if b, err = r.ReadByte(); err != nil {
+			return nil, err
+		}
+		if b == 0xD8 {
+			buf = append(buf, 0xFF, 0xD8)
+			break
+		}
+	}
+
+	// Marker segments up to and including SOS
+	for {
+		b, err := readByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0xFF {
+			return nil, errors.New("preview: malformed JPEG")
+		}
+		marker, err := readByte()
+		if err != nil {
+			return nil, err
+		}
+		if marker == 0xFF {
+			buf = buf[:len(buf)-1] // Fill byte
+			continue
+		}
+		hi, err := readByte()
+		if err != nil {
+			return nil, err
+		}
+		lo, err := readByte()
+		if err != nil {
+			return nil, err
+		}
+		n := int(hi)<<8 | int(lo) - 2
+		if n < 0 {
+			return nil, errors.New("preview: malformed JPEG")
+		}
+		seg := make([]byte, n)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			return nil, err
+		}
+		buf = append(buf, seg...)
+		if marker == 0xDA {
+			break
+		}
+	}
+
+	// Entropy-coded data: 0xFF is stuffed as FF 00 and RSTn markers may
+	// appear, so the first other marker is EOI
+	for {
+		b, err := readByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != 0xFF {
+			continue
+		}
+		marker, err := readByte()
+		for err == nil && marker == 0xFF {
+			marker, err = readByte()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if marker == 0xD9 {
+			return buf, nil
+		}
+	}
+}
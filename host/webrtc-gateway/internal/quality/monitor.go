@@ -0,0 +1,253 @@
+package quality
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/svc"
+)
+
+// Level is a coarse quality rating
+type Level string
+
+const (
+	LevelGood Level = "good"
+	LevelFair Level = "fair"
+	LevelPoor Level = "poor"
+)
+
+// Config configures a Monitor
+type Config struct {
+	FairBelow  float64 // Score below which a peer is fair, default 3.6
+	PoorBelow  float64 // Score below which a peer is poor, default 3.0
+	Hysteresis float64 // Margin required to move back up a level, default 0.2
+	Smoothing  float64 // Weight of each new sample in the moving score, default 0.3
+
+	// MaxFPS caps the frame rate sent to every peer, e.g. 60 from a 120fps
+	// capture; DegradedMaxFPS caps it further for fair and poor peers. Zero
+	// leaves the rate alone.
+	MaxFPS         float64
+	DegradedMaxFPS float64
+}
+
+// PeerQuality is one peer's current rating
+type PeerQuality struct {
+	PeerID  string    `json:"peer_id"`
+	Score   float64   `json:"score"` // Smoothed MOS-like score, 1-4.5
+	Level   Level     `json:"level"`
+	Last    Sample    `json:"last"`
+	Updated time.Time `json:"updated"`
+
+	// MaxTemporalLayer and MaxSpatialLayer are the highest layers the peer
+	// should be sent; -1 means no limit
+	MaxTemporalLayer int `json:"max_temporal_layer"`
+	MaxSpatialLayer  int `json:"max_spatial_layer"`
+
+	// MaxFPS is the frame rate cap for the peer; 0 means none
+	MaxFPS float64 `json:"max_fps,omitempty"`
+}
+
+// Change describes a peer moving between levels
+type Change struct {
+	PeerQuality
+	From Level
+}
+
+// Monitor scores peers and reports level changes. Poor peers are given a
+// layer limit the distribution layer uses to shed temporal layers before
+// loss turns into freezes.
+type Monitor struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	mu       sync.Mutex
+	peers    map[string]*PeerQuality
+	onChange func(Change)
+}
+
+// NewMonitor creates a quality monitor
+func NewMonitor(cfg Config, logger zerolog.Logger) *Monitor {
+	// Apply defaults for zero values
+	if cfg.FairBelow <= 0 {
+		cfg.FairBelow = 3.6
+	}
+	if cfg.PoorBelow <= 0 {
+		cfg.PoorBelow = 3.0
+	}
+	if cfg.Hysteresis <= 0 {
+		cfg.Hysteresis = 0.2
+	}
+	if cfg.Smoothing <= 0 || cfg.Smoothing > 1 {
+		cfg.Smoothing = 0.3
+	}
+
+	return &Monitor{
+		cfg:    cfg,
+		logger: logger.With().Str("component", "quality_monitor").Logger(),
+		peers:  make(map[string]*PeerQuality),
+	}
+}
+
+// SetOnChange sets a callback for level changes. It runs on the caller of
+// Update and must not block.
+func (m *Monitor) SetOnChange(fn func(Change)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onChange = fn
+}
+
+// Update records a sample for a peer and returns its new rating
+func (m *Monitor) Update(peerID string, s Sample) PeerQuality {
+	score := Score(s)
+
+	m.mu.Lock()
+	pq, ok := m.peers[peerID]
+	if !ok {
+		pq = &PeerQuality{PeerID: peerID, Score: score, Level: LevelGood, MaxTemporalLayer: -1, MaxSpatialLayer: -1}
+		m.peers[peerID] = pq
+	} else {
+		pq.Score += m.cfg.Smoothing * (score - pq.Score)
+	}
+	pq.Last = s
+	pq.Updated = time.Now()
+
+	from := pq.Level
+	pq.Level = m.level(pq.Level, pq.Score)
+	pq.MaxTemporalLayer, pq.MaxSpatialLayer = maxLayers(pq.Level)
+	pq.MaxFPS = m.maxFPS(pq.Level)
+	result := *pq
+	fn := m.onChange
+	m.mu.Unlock()
+
+	if result.Level != from {
+		ev := m.logger.Info()
+		if result.Level == LevelPoor {
+			ev = m.logger.Warn()
+		}
+		ev.Str("peer_id", peerID).
+			Str("from", string(from)).
+			Str("to", string(result.Level)).
+			Float64("score", result.Score).
+			Float64("loss", s.PacketLoss).
+			Float64("rtt_ms", s.RTTMs).
+			Float64("jitter_ms", s.JitterMs).
+			Int("freezes", s.Freezes).
+			Msg("Peer quality changed")
+		if fn != nil {
+			fn(Change{PeerQuality: result, From: from})
+		}
+	}
+
+	return result
+}
+
+// Remove forgets a peer
+func (m *Monitor) Remove(peerID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.peers, peerID)
+}
+
+// Get returns a peer's rating
+func (m *Monitor) Get(peerID string) (PeerQuality, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pq, ok := m.peers[peerID]
+	if !ok {
+		return PeerQuality{}, false
+	}
+	return *pq, true
+}
+
+// MaxTemporalLayer returns the highest temporal layer to send a peer, or -1
+// for no limit
+func (m *Monitor) MaxTemporalLayer(peerID string) int {
+	pq, ok := m.Get(peerID)
+	if !ok {
+		return -1
+	}
+	return pq.MaxTemporalLayer
+}
+
+// Limits returns the layer limits for a peer; unknown peers get every layer
+// at up to MaxFPS
+func (m *Monitor) Limits(peerID string) svc.Limits {
+	pq, ok := m.Get(peerID)
+	if !ok {
+		limits := svc.Unlimited
+		limits.MaxFPS = m.cfg.MaxFPS
+		return limits
+	}
+	return svc.Limits{MaxSpatial: pq.MaxSpatialLayer, MaxTemporal: pq.MaxTemporalLayer, MaxFPS: pq.MaxFPS}
+}
+
+// Snapshot returns every peer's rating, worst first
+func (m *Monitor) Snapshot() []PeerQuality {
+	m.mu.Lock()
+	peers := make([]PeerQuality, 0, len(m.peers))
+	for _, pq := range m.peers {
+		peers = append(peers, *pq)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Score < peers[j].Score })
+	return peers
+}
+
+// level applies thresholds with hysteresis: moving down happens at the
+// threshold, moving up requires clearing it by the hysteresis margin
+func (m *Monitor) level(current Level, score float64) Level {
+	switch current {
+	case LevelPoor:
+		switch {
+		case score >= m.cfg.FairBelow+m.cfg.Hysteresis:
+			return LevelGood
+		case score >= m.cfg.PoorBelow+m.cfg.Hysteresis:
+			return LevelFair
+		}
+		return LevelPoor
+	case LevelFair:
+		switch {
+		case score < m.cfg.PoorBelow:
+			return LevelPoor
+		case score >= m.cfg.FairBelow+m.cfg.Hysteresis:
+			return LevelGood
+		}
+		return LevelFair
+	default:
+		switch {
+		case score < m.cfg.PoorBelow:
+			return LevelPoor
+		case score < m.cfg.FairBelow:
+			return LevelFair
+		}
+		return LevelGood
+	}
+}
+
+// maxFPS returns the frame rate cap for a level: the lower of MaxFPS and,
+// below good, DegradedMaxFPS
+func (m *Monitor) maxFPS(level Level) float64 {
+	fps := m.cfg.MaxFPS
+	if level != LevelGood && m.cfg.DegradedMaxFPS > 0 && (fps == 0 || m.cfg.DegradedMaxFPS < fps) {
+		fps = m.cfg.DegradedMaxFPS
+	}
+	return fps
+}
+
+// maxLayers maps a level to temporal and spatial layer limits: fair peers
+// lose the top temporal layer of a three-layer stream, poor peers get the
+// base layers only (for H.264, reference frames only)
+func maxLayers(level Level) (temporal, spatial int) {
+	switch level {
+	case LevelFair:
+		return 1, -1
+	case LevelPoor:
+		return 0, 0
+	default:
+		return -1, -1
+	}
+}
@@ -0,0 +1,116 @@
+// Package quality scores each peer's connection from loss, jitter, RTT and
+// freeze counts, and turns scores into alerts and layer recommendations.
+package quality
+
+import (
+	"math"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Sample is one measurement interval for a peer
+type Sample struct {
+	PacketLoss float64       `json:"loss"` // Fraction of packets lost in the interval, 0-1
+	JitterMs   float64       `json:"jitter_ms"`
+	RTTMs      float64       `json:"rtt_ms"`
+	Freezes    int           `json:"freezes"` // Picture losses reported by the peer in the interval (PLI/FIR)
+	Interval   time.Duration `json:"-"`
+}
+
+// Score returns a MOS-like score from 1 (unusable) to 4.5 (excellent).
+//
+// It follows the shape of the ITU-T G.107 E-model. Delay and jitter reduce
+// the R-factor gently until ~100ms and steeply after; the knee is earlier
+// than the E-model's as interactive video tolerates less delay than voice.
+// Loss reduces it sharply at first with diminishing effect, and each freeze
+// per ten seconds costs a fixed amount. R is then mapped to MOS.
+func Score(s Sample) float64 {
+	// The receiver's jitter buffer adds roughly twice the jitter in delay
+	latency := s.RTTMs/2 + 2*s.JitterMs + 10
+
+	r := 93.2
+	if latency < 100 {
+		r -= latency / 40
+	} else {
+		r -= 2.5 + (latency-100)/5
+	}
+	r -= 30 * math.Log1p(15*s.PacketLoss)
+
+	if s.Freezes > 0 {
+		interval := s.Interval
+		if interval <= 0 {
+			interval = 10 * time.Second
+		}
+		perTenSeconds := float64(s.Freezes) * float64(10*time.Second) / float64(interval)
+		r -= 15 * perTenSeconds
+	}
+
+	r = math.Max(0, math.Min(100, r))
+	mos := 1 + 0.035*r + 7e-6*r*(r-60)*(100-r)
+	return math.Max(1, math.Min(4.5, mos))
+}
+
+// Collector turns a peer connection's cumulative stats into per-interval
+// Samples. Use one per peer.
+type Collector struct {
+	last     time.Time
+	sent     uint32
+	lost     int32
+	pictures uint32 // PLI + FIR received
+	primed   bool
+}
+
+// Collect computes a Sample from a stats report since the previous call. It
+// returns false on the first call, which only records the baseline.
+func (c *Collector) Collect(report webrtc.StatsReport, now time.Time) (Sample, bool) {
+	var (
+		sent, pictures uint32
+		lost           int32
+		s              Sample
+		rttSamples     int
+	)
+	for _, stat := range report {
+		switch st := stat.(type) {
+		case webrtc.OutboundRTPStreamStats:
+			if st.Kind != "video" {
+				continue
+			}
+			sent += st.PacketsSent
+			pictures += st.PLICount + st.FIRCount
+		case webrtc.RemoteInboundRTPStreamStats:
+			if st.Kind != "video" {
+				continue
+			}
+			lost += st.PacketsLost
+			s.JitterMs = math.Max(s.JitterMs, st.Jitter*1000)
+			if st.RoundTripTime > 0 {
+				s.RTTMs += st.RoundTripTime * 1000
+				rttSamples++
+			}
+		}
+	}
+	if rttSamples > 0 {
+		s.RTTMs /= float64(rttSamples)
+	}
+
+	primed := c.primed
+	prevSent, prevLost, prevPictures, prevAt := c.sent, c.lost, c.pictures, c.last
+	c.sent, c.lost, c.pictures, c.last, c.primed = sent, lost, pictures, now, true
+	if !primed {
+		return Sample{}, false
+	}
+
+	// Counters reset when tracks are renegotiated
+	if sent < prevSent || lost < prevLost || pictures < prevPictures {
+		return Sample{}, false
+	}
+
+	if dSent := sent - prevSent; dSent > 0 {
+		dLost := float64(lost - prevLost)
+		s.PacketLoss = math.Min(1, dLost/(float64(dSent)+dLost))
+	}
+	s.Freezes = int(pictures - prevPictures)
+	s.Interval = now.Sub(prevAt)
+	return s, true
+}
@@ -0,0 +1,193 @@
+// Package reaper closes zombie viewer sessions: connections whose ICE and
+// DTLS linger but whose viewer has stopped sending RTCP, so the media sent
+// to it goes nowhere. Closing them frees their track writers and keeps the
+// connected peer count accurate.
+//
+// Receivers report on a live stream every second or so. A peer is reaped
+// once none of its RTCP has arrived within the timeout while media was
+// being sent; while nothing is sent, viewers have nothing to report on and
+// no one is reaped.
+package reaper
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	"github.com/rs/zerolog"
+)
+
+// RTCPReporter is implemented by peer managers that pass on the RTCP each
+// viewer sends
+type RTCPReporter interface {
+	SetOnRTCP(fn func(peerID string, packets []rtcp.Packet))
+}
+
+// Peers looks up viewer connections so zombies can be closed.
+// The WebRTC peer manager satisfies it.
+type Peers interface {
+	PeerConnection(peerID string) (*webrtc.PeerConnection, bool)
+}
+
+// Config configures a reaper
+type Config struct {
+	// Timeout is how long a peer may go without RTCP before it is closed
+	Timeout time.Duration
+
+	// Interval is how often peers are checked, default Timeout/4
+	Interval time.Duration
+
+	// Sending reports whether media is being sent to peers; nil means
+	// always. Idle time does not accrue while it returns false.
+	Sending func() bool
+}
+
+// Stats are reaper counters
+type Stats struct {
+	TimeoutMs int64  `json:"timeout_ms"`
+	Tracked   int    `json:"tracked"`
+	Reaped    uint64 `json:"reaped"`
+}
+
+// Reaper tracks when each peer last sent RTCP and closes the silent ones
+type Reaper struct {
+	cfg    Config
+	peers  Peers
+	logger zerolog.Logger
+
+	mu       sync.Mutex
+	lastSeen map[string]time.Time // By peer ID
+	onReap   func(peerID string, idle time.Duration)
+
+	// Statistics
+	reaped atomic.Uint64
+}
+
+// New creates a reaper
+func New(cfg Config, peers Peers, logger zerolog.Logger) *Reaper {
+	// Apply defaults for zero values
+	if cfg.Interval <= 0 {
+		cfg.Interval = cfg.Timeout / 4
+	}
+	if cfg.Interval < time.Second {
+		cfg.Interval = time.Second
+	}
+	if cfg.Sending == nil {
+		cfg.Sending = func() bool { return true }
+	}
+
+	return &Reaper{
+		cfg:      cfg,
+		peers:    peers,
+		logger:   logger.With().Str("component", "reaper").Logger(),
+		lastSeen: make(map[string]time.Time),
+	}
+}
+
+// Attach observes the RTCP reported by a peer manager
+func (r *Reaper) Attach(reporter RTCPReporter) {
+	reporter.SetOnRTCP(func(peerID string, _ []rtcp.Packet) {
+		r.Observe(peerID)
+	})
+}
+
+// SetOnReap sets a callback invoked after a peer is closed for silence
+func (r *Reaper) SetOnReap(fn func(peerID string, idle time.Duration)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onReap = fn
+}
+
+// PeerConnected starts tracking a peer; it has a full timeout to send its
+// first RTCP
+func (r *Reaper) PeerConnected(peerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastSeen[peerID] = time.Now()
+}
+
+// PeerDisconnected stops tracking a peer
+func (r *Reaper) PeerDisconnected(peerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.lastSeen, peerID)
+}
+
+// Observe records RTCP from a peer
+func (r *Reaper) Observe(peerID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.lastSeen[peerID]; ok {
+		r.lastSeen[peerID] = time.Now()
+	}
+}
+
+// Run checks peers until ctx is done
+func (r *Reaper) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.Interval)
+	defer ticker.Stop()
+
+	r.logger.Info().Dur("timeout", r.cfg.Timeout).Msg("Reaping peers without RTCP")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.check(time.Now())
+		}
+	}
+}
+
+// Stats returns reaper counters
+func (r *Reaper) Stats() Stats {
+	r.mu.Lock()
+	tracked := len(r.lastSeen)
+	r.mu.Unlock()
+	return Stats{
+		TimeoutMs: r.cfg.Timeout.Milliseconds(),
+		Tracked:   tracked,
+		Reaped:    r.reaped.Load(),
+	}
+}
+
+// check closes peers silent for longer than the timeout
+func (r *Reaper) check(now time.Time) {
+	type zombie struct {
+		peerID string
+		idle   time.Duration
+	}
+
+	r.mu.Lock()
+	sending := r.cfg.Sending()
+	var zombies []zombie
+	for peerID, seen := range r.lastSeen {
+		switch {
+		case !sending:
+			// Nothing to report on; restart the clock once media resumes
+			r.lastSeen[peerID] = now
+		case now.Sub(seen) > r.cfg.Timeout:
+			zombies = append(zombies, zombie{peerID: peerID, idle: now.Sub(seen)})
+			delete(r.lastSeen, peerID)
+		}
+	}
+	onReap := r.onReap
+	r.mu.Unlock()
+
+	for _, z := range zombies {
+		pc, ok := r.peers.PeerConnection(z.peerID)
+		if !ok {
+			continue
+		}
+		r.logger.Warn().Str("peer_id", z.peerID).Dur("idle", z.idle).Msg("Closing peer that stopped sending RTCP")
+		if err := pc.Close(); err != nil {
+			r.logger.Warn().Err(err).Str("peer_id", z.peerID).Msg("Failed to close idle peer")
+		}
+		r.reaped.Add(1)
+		if onReap != nil {
+			onReap(z.peerID, z.idle)
+		}
+	}
+}
@@ -0,0 +1,857 @@
+// Package recording writes long recordings of the encoded stream to disk.
+// A recording is a directory of MP4 segments, each a complete file starting
+// on a keyframe, so a crash or a full disk loses at most the segment being
+// written, plus a JSON description: when it ran, which games were played
+// and which peers were watching. Recordings are started and stopped through
+// the admin API or on a schedule, and the oldest are deleted to keep the
+// directory under a disk budget.
+//
+// Like the replay buffer, recordings take the stream as encoded, so only
+// H.264 and HEVC are recorded.
+package recording
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/mp4"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/replay"
+)
+
+// Errors returned by Recorder
+var (
+	ErrNotFound  = errors.New("recording not found")
+	ErrActive    = errors.New("a recording is in progress")
+	ErrNotActive = errors.New("recording is not in progress")
+	ErrStopped   = errors.New("recorder is stopped")
+	ErrRefused   = errors.New("recording refused")
+)
+
+// Why a recording ended
+const (
+	StopRequested   = "requested"   // Stopped through the API
+	StopDuration    = "duration"    // Its duration ran out
+	StopShutdown    = "shutdown"    // The gateway shut down
+	StopInterrupted = "interrupted" // The gateway exited without finishing it
+	StopLowDisk     = "low_disk"    // Disk space ran critically low
+)
+
+// descriptionFile is the JSON description in each recording's directory
+const descriptionFile = "recording.json"
+
+// Config configures the recorder
+type Config struct {
+	// Dir holds a directory per recording; it is created if missing
+	Dir string
+
+	// SegmentDuration is how long each segment runs before it is cut at the
+	// next keyframe. Default 60s.
+	SegmentDuration time.Duration
+
+	// MaxSegmentBytes cuts a segment early at the next keyframe when a high
+	// bitrate would make it larger. Default 256 MiB.
+	MaxSegmentBytes int64
+
+	// MaxBytes is the disk budget for all recordings; the oldest finished
+	// recordings are deleted to stay under it. Zero is unlimited.
+	MaxBytes int64
+
+	// CheckInterval is how often schedules and durations are checked.
+	// Default 1s.
+	CheckInterval time.Duration
+}
+
+// Segment is one file of a recording
+type Segment struct {
+	Index       int     `json:"index"`
+	File        string  `json:"file"`
+	DurationSec float64 `json:"duration_sec"`
+	Frames      int     `json:"frames"`
+	Bytes       int64   `json:"bytes"`
+}
+
+// Recording describes a recording
+type Recording struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name,omitempty"`
+	ScheduleID string     `json:"schedule_id,omitempty"`
+	Active     bool       `json:"active"`
+	StartedAt  time.Time  `json:"started_at"`
+	EndsAt     *time.Time `json:"ends_at,omitempty"` // Set when started with a duration
+	EndedAt    *time.Time `json:"ended_at,omitempty"`
+	StopReason string     `json:"stop_reason,omitempty"`
+
+	DurationSec float64   `json:"duration_sec"` // Of the segments written
+	Bytes       int64     `json:"bytes"`
+	Codec       string    `json:"codec,omitempty"`
+	Segments    []Segment `json:"segments"`
+
+	// Games played and peers present at any point, in order of appearance
+	Games    []string `json:"games,omitempty"`
+	Peers    []string `json:"peers,omitempty"`
+	MaxPeers int      `json:"max_peers"`
+
+	// Markers dropped while recording, also written as segment chapters
+	Markers []Marker `json:"markers,omitempty"`
+}
+
+// Marker is a chapter of a recording
+type Marker struct {
+	Segment   int     `json:"segment"`
+	OffsetSec float64 `json:"offset_sec"` // From the start of the recording
+	Title     string  `json:"title"`
+}
+
+// Stats are recorder counters
+type Stats struct {
+	Active     bool   `json:"active"`
+	Recordings int    `json:"recordings"`
+	Bytes      int64  `json:"bytes"`
+	Segments   uint64 `json:"segments"`
+	Deleted    uint64 `json:"deleted"` // Recordings removed by retention
+	Errors     uint64 `json:"errors"`  // Segments lost to write errors or a full queue
+	Skipped    uint64 `json:"skipped"` // Scheduled recordings not started
+}
+
+// current is the recording being captured
+type current struct {
+	id      string
+	endsAt  time.Time
+	frames  []replay.Frame // Segment being buffered; starts on a keyframe
+	bytes   int64
+	codec   string
+	next    int  // Index of the next segment
+	waiting bool // A keyframe has been requested to start a segment
+}
+
+// job is a segment handed to the writer
+type job struct {
+	id     string
+	index  int
+	codec  string
+	frames []replay.Frame
+	end    int64 // Timestamp the segment runs until
+	final  bool  // Finish the recording after this segment
+}
+
+// Recorder captures recordings from a media.Distributor tap
+type Recorder struct {
+	cfg      Config
+	keyframe media.KeyframeRequester
+	logger   zerolog.Logger
+
+	mu        sync.Mutex
+	recs      map[string]*Recording
+	cur       *current
+	game      string
+	peers     map[string]struct{}
+	schedules []Schedule
+	onEvent   func(Recording)
+	onFile    func(id, file, path string)
+	chapters  replay.ChapterSource
+	admit     func() error
+	stopped   bool
+
+	jobs    chan job
+	sending sync.WaitGroup // Final jobs being queued outside the lock
+	closed  chan struct{}
+
+	// Statistics
+	segments atomic.Uint64
+	deleted  atomic.Uint64
+	errors   atomic.Uint64
+	skipped  atomic.Uint64
+}
+
+// New creates a recorder writing to cfg.Dir. keyframe, when not nil, is
+// asked for a keyframe so a recording starts without waiting for the next
+// scheduled one. Recordings left active by a crash are marked interrupted.
+func New(cfg Config, keyframe media.KeyframeRequester, logger zerolog.Logger) (*Recorder, error) {
+	// Apply defaults for zero values
+	if cfg.SegmentDuration <= 0 {
+		cfg.SegmentDuration = 60 * time.Second
+	}
+	if cfg.MaxSegmentBytes <= 0 {
+		cfg.MaxSegmentBytes = 256 << 20
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = time.Second
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	r := &Recorder{
+		cfg:      cfg,
+		keyframe: keyframe,
+		logger:   logger.With().Str("component", "recording").Logger(),
+		recs:     make(map[string]*Recording),
+		peers:    make(map[string]struct{}),
+		jobs:     make(chan job, 16),
+		closed:   make(chan struct{}),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	schedules, err := loadSchedules(r.schedulePath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read recording schedules: %w", err)
+	}
+	r.schedules = schedules
+
+	go r.write()
+	return r, nil
+}
+
+// load reads the recordings in the directory, finishing any a crash left
+// active
+func (r *Recorder) load() error {
+	entries, err := os.ReadDir(r.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read recording directory: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !validID(e.Name()) {
+			continue
+		}
+		dir := filepath.Join(r.cfg.Dir, e.Name())
+		data, err := os.ReadFile(filepath.Join(dir, descriptionFile))
+		if err != nil {
+			r.logger.Warn().Err(err).Str("recording_id", e.Name()).Msg("Skipping recording without a description")
+			continue
+		}
+		var rec Recording
+		if err := json.Unmarshal(data, &rec); err != nil || rec.ID != e.Name() {
+			r.logger.Warn().Err(err).Str("recording_id", e.Name()).Msg("Skipping recording with an invalid description")
+			continue
+		}
+
+		// Half-written segments are never listed
+		tmps, _ := filepath.Glob(filepath.Join(dir, ".segment-*.tmp"))
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+		if rec.Active {
+			end := rec.StartedAt.Add(time.Duration(rec.DurationSec * float64(time.Second)))
+			rec.Active = false
+			rec.EndedAt = &end
+			rec.StopReason = StopInterrupted
+			if err := r.save(rec); err != nil {
+				r.logger.Warn().Err(err).Str("recording_id", rec.ID).Msg("Failed to finish interrupted recording")
+			}
+			r.logger.Warn().Str("recording_id", rec.ID).Msg("Recording was interrupted")
+		}
+		r.recs[rec.ID] = &rec
+	}
+	return nil
+}
+
+// Start checks schedules and recording durations until ctx is cancelled
+func (r *Recorder) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(r.cfg.CheckInterval)
+		defer ticker.Stop()
+		for {
+			r.check(time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop finishes the active recording and waits for its last segment to be
+// written
+func (r *Recorder) Stop() {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return
+	}
+	r.stopped = true
+	j, ok := r.finish(StopShutdown)
+	r.mu.Unlock()
+
+	if ok {
+		r.jobs <- j
+	}
+	r.sending.Wait()
+	close(r.jobs)
+	<-r.closed
+}
+
+// SetAdmission sets a check run before each recording starts, manual or
+// scheduled. A recording is refused with ErrRefused when it returns an
+// error. It is called with the recorder's lock held and must not call back
+// into the recorder.
+func (r *Recorder) SetAdmission(fn func() error) {
+	r.mu.Lock()
+	r.admit = fn
+	r.mu.Unlock()
+}
+
+// SetOnEvent sets a callback for recordings starting and finishing. A
+// finished recording is reported once its last segment is written, with
+// Active false. It is called without locks held, from any goroutine.
+func (r *Recorder) SetOnEvent(fn func(Recording)) {
+	r.mu.Lock()
+	r.onEvent = fn
+	r.mu.Unlock()
+}
+
+// SetOnFile sets a callback for each file of a recording once it is
+// complete: every segment as it is written, and the description when the
+// recording finishes. It is called from the writer goroutine without locks
+// held, so it must not block for long.
+func (r *Recorder) SetOnFile(fn func(id, file, path string)) {
+	r.mu.Lock()
+	r.onFile = fn
+	r.mu.Unlock()
+}
+
+// SetChapters sets where segments get their chapters from
+func (r *Recorder) SetChapters(src replay.ChapterSource) {
+	r.mu.Lock()
+	r.chapters = src
+	r.mu.Unlock()
+}
+
+// StartRecording starts a recording named name. A positive d stops it after
+// that long.
+func (r *Recorder) StartRecording(name string, d time.Duration) (Recording, error) {
+	return r.start(name, "", d)
+}
+
+func (r *Recorder) start(name, scheduleID string, d time.Duration) (Recording, error) {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return Recording{}, ErrStopped
+	}
+	if r.cur != nil {
+		r.mu.Unlock()
+		return Recording{}, ErrActive
+	}
+	if r.admit != nil {
+		if err := r.admit(); err != nil {
+			r.mu.Unlock()
+			return Recording{}, fmt.Errorf("%w: %v", ErrRefused, err)
+		}
+	}
+
+	now := time.Now()
+	id := "rec-" + now.Format("20060102-150405")
+	for n := 2; r.exists(id); n++ {
+		id = fmt.Sprintf("rec-%s-%d", now.Format("20060102-150405"), n)
+	}
+	if err := os.Mkdir(filepath.Join(r.cfg.Dir, id), 0o755); err != nil {
+		r.mu.Unlock()
+		return Recording{}, fmt.Errorf("failed to create recording directory: %w", err)
+	}
+
+	rec := &Recording{
+		ID:         id,
+		Name:       name,
+		ScheduleID: scheduleID,
+		Active:     true,
+		StartedAt:  now.UTC(),
+		Segments:   []Segment{},
+	}
+	r.cur = &current{id: id, waiting: true}
+	if d > 0 {
+		end := rec.StartedAt.Add(d)
+		rec.EndsAt = &end
+		r.cur.endsAt = end
+	}
+	if r.game != "" {
+		rec.Games = []string{r.game}
+	}
+	for peer := range r.peers {
+		rec.Peers = append(rec.Peers, peer)
+	}
+	sort.Strings(rec.Peers)
+	rec.MaxPeers = len(rec.Peers)
+	r.recs[id] = rec
+	snapshot := clone(rec)
+	onEvent := r.onEvent
+	r.mu.Unlock()
+
+	if err := r.save(snapshot); err != nil {
+		r.logger.Warn().Err(err).Str("recording_id", id).Msg("Failed to write recording description")
+	}
+	if r.keyframe != nil {
+		r.keyframe.ForceKeyframe()
+	}
+	r.logger.Info().Str("recording_id", id).Str("name", name).Dur("duration", d).Msg("Recording started")
+	if onEvent != nil {
+		onEvent(snapshot)
+	}
+	return snapshot, nil
+}
+
+// StopRecording stops the active recording id. The recording is returned
+// as it stood; its last segment is still being written.
+func (r *Recorder) StopRecording(id string) (Recording, error) {
+	r.mu.Lock()
+	rec, ok := r.recs[id]
+	if !ok {
+		r.mu.Unlock()
+		return Recording{}, ErrNotFound
+	}
+	if r.cur == nil || r.cur.id != id {
+		r.mu.Unlock()
+		return Recording{}, ErrNotActive
+	}
+	j, _ := r.finish(StopRequested)
+	snapshot := clone(rec)
+	r.sending.Add(1)
+	r.mu.Unlock()
+
+	r.jobs <- j
+	r.sending.Done()
+	return snapshot, nil
+}
+
+// StopActive stops the recording in progress, if any, giving reason as why
+// it ended. It returns ErrNotActive when nothing is recording.
+func (r *Recorder) StopActive(reason string) (Recording, error) {
+	r.mu.Lock()
+	if r.cur == nil {
+		r.mu.Unlock()
+		return Recording{}, ErrNotActive
+	}
+	rec := r.recs[r.cur.id]
+	j, _ := r.finish(reason)
+	snapshot := clone(rec)
+	r.sending.Add(1)
+	r.mu.Unlock()
+
+	r.jobs <- j
+	r.sending.Done()
+	return snapshot, nil
+}
+
+// finish ends the current recording, returning the job that writes its
+// last segment. r.mu must be held.
+func (r *Recorder) finish(reason string) (job, bool) {
+	cur := r.cur
+	if cur == nil {
+		return job{}, false
+	}
+	r.cur = nil
+
+	rec := r.recs[cur.id]
+	now := time.Now().UTC()
+	rec.EndedAt = &now
+	rec.StopReason = reason
+	r.logger.Info().Str("recording_id", cur.id).Str("reason", reason).Msg("Recording stopping")
+
+	j := job{id: cur.id, index: cur.next, codec: cur.codec, frames: cur.frames, final: true}
+	if n := len(cur.frames); n > 0 {
+		j.end = cur.frames[n-1].TS
+	}
+	return j, true
+}
+
+// Observe records a frame when a recording is active. It is a
+// media.Distributor tap, so segments are handed to a writer goroutine
+// rather than written here.
+func (r *Recorder) Observe(f media.VideoFrame) {
+	if f.Codec != "h264" && f.Codec != "hevc" {
+		return
+	}
+	ts := f.PTS
+	if ts <= 0 {
+		ts = f.ReceivedAt.UnixNano()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cur := r.cur
+	if cur == nil {
+		return
+	}
+
+	// A codec change, a spliced timeline or timestamps jumping back end the
+	// segment, since its frames could not share one file
+	if n := len(cur.frames); n > 0 && (f.Codec != cur.codec || f.Discontinuity || ts < cur.frames[n-1].TS) {
+		r.cut(cur, cur.frames[n-1].TS)
+	}
+	if len(cur.frames) == 0 {
+		if !f.IsKeyframe {
+			if !cur.waiting && r.keyframe != nil {
+				r.keyframe.ForceKeyframe()
+			}
+			cur.waiting = true
+			return
+		}
+		cur.codec = f.Codec
+		cur.waiting = false
+	} else if f.IsKeyframe && (ts-cur.frames[0].TS >= int64(r.cfg.SegmentDuration) || cur.bytes >= r.cfg.MaxSegmentBytes) {
+		r.cut(cur, ts)
+		cur.codec = f.Codec
+	} else if cur.bytes >= 2*r.cfg.MaxSegmentBytes {
+		// The source is not producing keyframes; end the segment rather
+		// than buffer without bound, and wait for one
+		r.cut(cur, ts)
+		if r.keyframe != nil {
+			r.keyframe.ForceKeyframe()
+		}
+		cur.waiting = true
+		return
+	}
+	cur.frames = append(cur.frames, replay.Frame{VideoFrame: f, TS: ts})
+	cur.bytes += int64(len(f.Data))
+}
+
+// cut hands the buffered segment, running until end, to the writer.
+// r.mu must be held.
+func (r *Recorder) cut(cur *current, end int64) {
+	j := job{id: cur.id, index: cur.next, codec: cur.codec, frames: cur.frames, end: end}
+	cur.frames, cur.bytes = nil, 0
+	cur.next++
+	select {
+	case r.jobs <- j:
+	default:
+		r.errors.Add(1)
+		r.logger.Warn().Str("recording_id", cur.id).Int("segment", j.index).Msg("Recording writer is behind, dropping segment")
+	}
+}
+
+// write runs the writer goroutine until the job queue is closed
+func (r *Recorder) write() {
+	defer close(r.closed)
+	for j := range r.jobs {
+		r.writeJob(j)
+	}
+}
+
+func (r *Recorder) writeJob(j job) {
+	var seg *Segment
+	var chapters []mp4.Chapter
+	if len(j.frames) > 0 {
+		r.mu.Lock()
+		src := r.chapters
+		r.mu.Unlock()
+		if src != nil {
+			// The end belongs to the next segment, unless this is the last
+			to := j.end
+			if !j.final {
+				to--
+			}
+			chapters = src.Chapters(j.frames[0].TS, to)
+		}
+		s, err := r.writeSegment(j, chapters)
+		if err != nil {
+			r.errors.Add(1)
+			r.logger.Error().Err(err).Str("recording_id", j.id).Int("segment", j.index).Msg("Failed to write recording segment")
+		} else {
+			r.segments.Add(1)
+			seg = &s
+		}
+	}
+
+	r.mu.Lock()
+	rec, ok := r.recs[j.id]
+	if !ok {
+		r.mu.Unlock()
+		return
+	}
+	if seg != nil {
+		for _, c := range chapters {
+			rec.Markers = append(rec.Markers, Marker{Segment: seg.Index, OffsetSec: rec.DurationSec + c.Start.Seconds(), Title: c.Title})
+		}
+		rec.Segments = append(rec.Segments, *seg)
+		rec.DurationSec += seg.DurationSec
+		rec.Bytes += seg.Bytes
+		rec.Codec = j.codec
+	}
+	if j.final {
+		rec.Active = false
+	}
+	snapshot := clone(rec)
+	onEvent, onFile := r.onEvent, r.onFile
+	r.mu.Unlock()
+
+	saved := true
+	if err := r.save(snapshot); err != nil {
+		saved = false
+		r.errors.Add(1)
+		r.logger.Error().Err(err).Str("recording_id", j.id).Msg("Failed to write recording description")
+	}
+	if onFile != nil {
+		dir := filepath.Join(r.cfg.Dir, j.id)
+		if seg != nil {
+			onFile(j.id, seg.File, filepath.Join(dir, seg.File))
+		}
+		if j.final && saved {
+			onFile(j.id, descriptionFile, filepath.Join(dir, descriptionFile))
+		}
+	}
+	r.retain()
+
+	if j.final {
+		r.logger.Info().Str("recording_id", j.id).Float64("duration_sec", snapshot.DurationSec).
+			Int64("bytes", snapshot.Bytes).Int("segments", len(snapshot.Segments)).Msg("Recording finished")
+		if onEvent != nil {
+			onEvent(snapshot)
+		}
+	}
+}
+
+// writeSegment muxes a segment into the recording's directory
+func (r *Recorder) writeSegment(j job, chapters []mp4.Chapter) (Segment, error) {
+	dir := filepath.Join(r.cfg.Dir, j.id)
+	tmp, err := os.CreateTemp(dir, ".segment-*.tmp")
+	if err != nil {
+		return Segment{}, err
+	}
+	defer os.Remove(tmp.Name())
+	track := replay.NewTrack(j.codec, j.frames)
+	track.Chapters = chapters
+	if err := mp4.Write(tmp, track); err != nil {
+		tmp.Close()
+		return Segment{}, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return Segment{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Segment{}, err
+	}
+
+	file := segmentFile(j.index)
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, file)); err != nil {
+		return Segment{}, err
+	}
+	return Segment{
+		Index:       j.index,
+		File:        file,
+		DurationSec: time.Duration(j.end - j.frames[0].TS).Seconds(),
+		Frames:      len(j.frames),
+		Bytes:       info.Size(),
+	}, nil
+}
+
+// retain deletes the oldest finished recordings while all of them together
+// exceed the disk budget
+func (r *Recorder) retain() {
+	if r.cfg.MaxBytes <= 0 {
+		return
+	}
+	r.mu.Lock()
+	var total int64
+	finished := make([]*Recording, 0, len(r.recs))
+	for _, rec := range r.recs {
+		total += rec.Bytes
+		if !rec.Active {
+			finished = append(finished, rec)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].StartedAt.Before(finished[j].StartedAt) })
+	var remove []string
+	for _, rec := range finished {
+		if total <= r.cfg.MaxBytes {
+			break
+		}
+		total -= rec.Bytes
+		remove = append(remove, rec.ID)
+		delete(r.recs, rec.ID)
+	}
+	r.mu.Unlock()
+
+	for _, id := range remove {
+		if err := os.RemoveAll(filepath.Join(r.cfg.Dir, id)); err != nil {
+			r.logger.Warn().Err(err).Str("recording_id", id).Msg("Failed to delete old recording")
+			continue
+		}
+		r.deleted.Add(1)
+		r.logger.Info().Str("recording_id", id).Int64("max_bytes", r.cfg.MaxBytes).Msg("Deleted old recording to stay under the disk budget")
+	}
+}
+
+// save writes a recording's description, replacing it atomically
+func (r *Recorder) save(rec Recording) error {
+	data, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(r.cfg.Dir, rec.ID, descriptionFile), data)
+}
+
+// Recordings lists recordings, newest first
+func (r *Recorder) Recordings() []Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	recs := make([]Recording, 0, len(r.recs))
+	for _, rec := range r.recs {
+		recs = append(recs, clone(rec))
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].StartedAt.After(recs[j].StartedAt) })
+	return recs
+}
+
+// Get returns a recording
+func (r *Recorder) Get(id string) (Recording, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.recs[id]
+	if !ok {
+		return Recording{}, ErrNotFound
+	}
+	return clone(rec), nil
+}
+
+// Delete removes a finished recording
+func (r *Recorder) Delete(id string) error {
+	r.mu.Lock()
+	rec, ok := r.recs[id]
+	if !ok {
+		r.mu.Unlock()
+		return ErrNotFound
+	}
+	if rec.Active {
+		r.mu.Unlock()
+		return ErrActive
+	}
+	delete(r.recs, id)
+	r.mu.Unlock()
+	return os.RemoveAll(filepath.Join(r.cfg.Dir, id))
+}
+
+// SegmentPath returns the file of segment index of a recording
+func (r *Recorder) SegmentPath(id string, index int) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.recs[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+	for _, seg := range rec.Segments {
+		if seg.Index == index {
+			return filepath.Join(r.cfg.Dir, id, seg.File), nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// SetGame notes the game being played, adding it to the active recording
+func (r *Recorder) SetGame(game string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.game = game
+	if r.cur != nil && game != "" {
+		rec := r.recs[r.cur.id]
+		if !slices.Contains(rec.Games, game) {
+			rec.Games = append(rec.Games, game)
+		}
+	}
+}
+
+// PeerJoined notes a peer watching, adding it to the active recording
+func (r *Recorder) PeerJoined(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.peers[id] = struct{}{}
+	if r.cur != nil {
+		rec := r.recs[r.cur.id]
+		if !slices.Contains(rec.Peers, id) {
+			rec.Peers = append(rec.Peers, id)
+		}
+		rec.MaxPeers = max(rec.MaxPeers, len(r.peers))
+	}
+}
+
+// PeerLeft notes a peer no longer watching
+func (r *Recorder) PeerLeft(id string) {
+	r.mu.Lock()
+	delete(r.peers, id)
+	r.mu.Unlock()
+}
+
+// Stats returns recorder counters
+func (r *Recorder) Stats() Stats {
+	r.mu.Lock()
+	st := Stats{Active: r.cur != nil, Recordings: len(r.recs)}
+	for _, rec := range r.recs {
+		st.Bytes += rec.Bytes
+	}
+	r.mu.Unlock()
+	st.Segments = r.segments.Load()
+	st.Deleted = r.deleted.Load()
+	st.Errors = r.errors.Load()
+	st.Skipped = r.skipped.Load()
+	return st
+}
+
+// exists reports whether id is taken. r.mu must be held.
+func (r *Recorder) exists(id string) bool {
+	if _, ok := r.recs[id]; ok {
+		return true
+	}
+	_, err := os.Stat(filepath.Join(r.cfg.Dir, id))
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+func segmentFile(index int) string {
+	return fmt.Sprintf("segment-%04d.mp4", index+1)
+}
+
+// clone copies a recording so it can be used without the lock
+func clone(rec *Recording) Recording {
+	c := *rec
+	c.Segments = slices.Clone(rec.Segments)
+	c.Games = slices.Clone(rec.Games)
+	c.Peers = slices.Clone(rec.Peers)
+	c.Markers = slices.Clone(rec.Markers)
+	return c
+}
+
+// writeFile replaces path with data through a temporary file, so a crash
+// leaves either the old contents or the new
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// validID accepts the IDs StartRecording generates
+func validID(id string) bool {
+	if !strings.HasPrefix(id, "rec-") || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
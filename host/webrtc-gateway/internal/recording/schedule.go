@@ -0,0 +1,209 @@
+package recording
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Schedule repeats
+const (
+	RepeatNone   = ""
+	RepeatDaily  = "daily"
+	RepeatWeekly = "weekly"
+)
+
+// ErrInvalidSchedule is returned by AddSchedule for schedules that can
+// never run
+var ErrInvalidSchedule = errors.New("invalid schedule")
+
+// scheduleFile holds the schedules in the recording directory
+const scheduleFile = "schedules.json"
+
+// Schedule starts a recording at a set time. A one-off schedule is removed
+// once it fires; a repeating one moves to its next occurrence.
+type Schedule struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name,omitempty"`
+	Start       time.Time `json:"start"` // Next occurrence
+	DurationSec int       `json:"duration_sec"`
+	Repeat      string    `json:"repeat,omitempty"`
+}
+
+func (s Schedule) duration() time.Duration {
+	return time.Duration(s.DurationSec) * time.Second
+}
+
+// period returns the time between occurrences, zero for one-off schedules
+func (s Schedule) period() time.Duration {
+	switch s.Repeat {
+	case RepeatDaily:
+		return 24 * time.Hour
+	case RepeatWeekly:
+		return 7 * 24 * time.Hour
+	}
+	return 0
+}
+
+// Schedules lists schedules, soonest first
+func (r *Recorder) Schedules() []Schedule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Schedule(nil), r.schedules...)
+}
+
+// AddSchedule adds a schedule, returning it with its ID
+func (r *Recorder) AddSchedule(s Schedule) (Schedule, error) {
+	if s.DurationSec <= 0 {
+		return Schedule{}, fmt.Errorf("%w: duration must be positive", ErrInvalidSchedule)
+	}
+	if s.Start.IsZero() {
+		return Schedule{}, fmt.Errorf("%w: start is required", ErrInvalidSchedule)
+	}
+	switch s.Repeat {
+	case RepeatNone, RepeatDaily, RepeatWeekly:
+	default:
+		return Schedule{}, fmt.Errorf("%w: repeat must be %q or %q", ErrInvalidSchedule, RepeatDaily, RepeatWeekly)
+	}
+	if s.Repeat == RepeatNone && time.Now().After(s.Start.Add(s.duration())) {
+		return Schedule{}, fmt.Errorf("%w: it has already ended", ErrInvalidSchedule)
+	}
+	if p := s.period(); p > 0 && s.duration() > p {
+		return Schedule{}, fmt.Errorf("%w: duration is longer than the repeat", ErrInvalidSchedule)
+	}
+
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return Schedule{}, err
+	}
+	s.ID = "sched-" + hex.EncodeToString(b[:])
+	s.Start = s.Start.UTC()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schedules = append(r.schedules, s)
+	if err := r.saveSchedules(); err != nil {
+		r.schedules = r.schedules[:len(r.schedules)-1]
+		return Schedule{}, err
+	}
+	r.logger.Info().Str("schedule_id", s.ID).Time("start", s.Start).Int("duration_sec", s.DurationSec).
+		Str("repeat", s.Repeat).Msg("Recording scheduled")
+	return s, nil
+}
+
+// RemoveSchedule removes a schedule. A recording it already started keeps
+// running.
+func (r *Recorder) RemoveSchedule(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, s := range r.schedules {
+		if s.ID == id {
+			r.schedules = append(r.schedules[:i:i], r.schedules[i+1:]...)
+			return r.saveSchedules()
+		}
+	}
+	return ErrNotFound
+}
+
+// check stops a recording whose duration ran out and starts those due on
+// a schedule
+func (r *Recorder) check(now time.Time) {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return
+	}
+	var stop *job
+	if r.cur != nil && !r.cur.endsAt.IsZero() && !now.Before(r.cur.endsAt) {
+		if j, ok := r.finish(StopDuration); ok {
+			stop = &j
+			r.sending.Add(1)
+		}
+	}
+
+	// Take due occurrences, moving repeating schedules past now. An
+	// occurrence that has already ended, while the gateway was down, is
+	// skipped; one still running is recorded for the time left.
+	type due struct {
+		s    Schedule
+		left time.Duration
+	}
+	var start []due
+	changed := false
+	kept := r.schedules[:0]
+	for _, s := range r.schedules {
+		if now.Before(s.Start) {
+			kept = append(kept, s)
+			continue
+		}
+		changed = true
+		if left := s.Start.Add(s.duration()).Sub(now); left > 0 {
+			start = append(start, due{s, left})
+		} else {
+			r.skipped.Add(1)
+			r.logger.Warn().Str("schedule_id", s.ID).Time("start", s.Start).Msg("Missed scheduled recording")
+		}
+		if p := s.period(); p > 0 {
+			for !now.Before(s.Start) {
+				s.Start = s.Start.Add(p)
+			}
+			kept = append(kept, s)
+		}
+	}
+	r.schedules = kept
+	if changed {
+		sort.Slice(r.schedules, func(i, j int) bool { return r.schedules[i].Start.Before(r.schedules[j].Start) })
+		if err := r.saveSchedules(); err != nil {
+			r.logger.Error().Err(err).Msg("Failed to save recording schedules")
+		}
+	}
+	r.mu.Unlock()
+
+	if stop != nil {
+		r.jobs <- *stop
+		r.sending.Done()
+	}
+	for _, d := range start {
+		_, err := r.start(d.s.Name, d.s.ID, d.left)
+		if err != nil {
+			r.skipped.Add(1)
+			r.logger.Warn().Err(err).Str("schedule_id", d.s.ID).Msg("Skipped scheduled recording")
+		}
+	}
+}
+
+func (r *Recorder) schedulePath() string {
+	return filepath.Join(r.cfg.Dir, scheduleFile)
+}
+
+// saveSchedules persists the schedules. r.mu must be held.
+func (r *Recorder) saveSchedules() error {
+	data, err := json.MarshalIndent(r.schedules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(r.schedulePath(), data)
+}
+
+// loadSchedules reads the schedules saved at path, soonest first
+func loadSchedules(path string) ([]Schedule, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var schedules []Schedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return nil, err
+	}
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].Start.Before(schedules[j].Start) })
+	return schedules, nil
+}
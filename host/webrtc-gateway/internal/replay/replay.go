@@ -0,0 +1,616 @@
+// Package replay keeps the last stretch of the encoded stream in memory so
+// it can be saved as an MP4 clip after the fact ("clip that"). The buffer
+// holds whole GOPs, so every clip starts on a keyframe and is decodable
+// without re-encoding.
+//
+// With a spool directory the frame data lives in files instead, ideally on
+// a RAM disk, so the buffer can span gigabytes. What a crashed gateway left
+// there is saved as a clip by Recover on the next start.
+package replay
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/mp4"
+)
+
+// Errors returned by Buffer
+var (
+	ErrEmpty    = errors.New("replay buffer is empty")
+	ErrNotFound = errors.New("clip not found")
+)
+
+// Config configures the replay buffer
+type Config struct {
+	// Dir is where clips are written; it is created if missing
+	Dir string
+
+	// Window is how much of the stream is kept, default 60s. A little more
+	// is held so the oldest GOP can start before the window.
+	Window time.Duration
+
+	// MaxBytes caps buffered video, default 512 MiB; the oldest GOPs go
+	// first when a high bitrate would exceed it
+	MaxBytes int64
+
+	// SpoolDir, when set, holds the buffered frame data in segment files
+	// instead of memory. It should be a RAM disk such as /dev/shm, as
+	// frames are written from the distributor's goroutine.
+	SpoolDir string
+}
+
+// Clip is a saved clip
+type Clip struct {
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Bytes     int64     `json:"bytes"`
+
+	// Set only in the result of Save
+	DurationSec float64  `json:"duration_sec,omitempty"`
+	Frames      int      `json:"frames,omitempty"`
+	Markers     []Marker `json:"markers,omitempty"`
+}
+
+// Marker is a chapter of a clip
+type Marker struct {
+	OffsetSec float64 `json:"offset_sec"`
+	Title     string  `json:"title"`
+}
+
+// ChapterSource names points of the stream between two frame timestamps,
+// such as markers users dropped. markers.Store satisfies it.
+type ChapterSource interface {
+	Chapters(from, to int64) []mp4.Chapter
+}
+
+// Stats are buffer counters
+type Stats struct {
+	Codec       string  `json:"codec,omitempty"`
+	BufferedSec float64 `json:"buffered_sec"`
+	Frames      int     `json:"frames"`
+	Bytes       int64   `json:"bytes"`
+	Clips       uint64  `json:"clips"`
+	Errors      uint64  `json:"errors"`
+	Spool       string  `json:"spool_dir,omitempty"`
+	Recovered   uint64  `json:"recovered"`
+}
+
+// Frame is a buffered frame
+type Frame struct {
+	media.VideoFrame
+	TS int64 // PTS, or receive time for sources without one, in nanoseconds
+
+	// Where spooled data is; Data is nil while it is buffered
+	seg  *segment
+	off  int64
+	size int
+}
+
+// Buffer is a rolling buffer of the encoded stream
+type Buffer struct {
+	cfg      Config
+	logger   zerolog.Logger
+	warnings *logging.Summarizer // Rate-limits per-frame warnings
+
+	mu     sync.Mutex
+	frames []Frame // Starts on a keyframe
+	bytes  int64
+	codec  string
+	spool  *spool // Nil when frames are held in memory
+
+	onSave   func(Clip, string)
+	chapters ChapterSource
+
+	// Statistics
+	clips     atomic.Uint64
+	errors    atomic.Uint64
+	recovered atomic.Uint64
+}
+
+// NewBuffer creates an empty buffer writing clips to cfg.Dir
+func NewBuffer(cfg Config, logger zerolog.Logger) (*Buffer, error) {
+	// Apply defaults for zero values
+	if cfg.Window <= 0 {
+		cfg.Window = 60 * time.Second
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 512 << 20
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create clip directory: %w", err)
+	}
+
+	logger = logger.With().Str("component", "replay").Logger()
+	b := &Buffer{
+		cfg:      cfg,
+		logger:   logger,
+		warnings: logging.NewSummarizer(logger),
+	}
+	if cfg.SpoolDir != "" {
+		sp, err := openSpool(cfg.SpoolDir, logger)
+		if err != nil {
+			return nil, err
+		}
+		b.spool = sp
+	}
+	return b, nil
+}
+
+// Observe buffers a frame. It is a media.Distributor tap.
+func (b *Buffer) Observe(f media.VideoFrame) {
+	if f.Codec != "h264" && f.Codec != "hevc" {
+		return
+	}
+	ts := f.PTS
+	if ts <= 0 {
+		ts = f.ReceivedAt.UnixNano()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// A codec change, a spliced timeline or timestamps jumping back (a
+	// source restart) start the buffer over, since the frames could not
+	// share one clip
+	if n := len(b.frames); n > 0 && (f.Codec != b.codec || f.Discontinuity || ts < b.frames[n-1].TS) {
+		b.clear()
+	}
+	if len(b.frames) == 0 {
+		if !f.IsKeyframe {
+			return
+		}
+		b.codec = f.Codec
+	}
+	fr := Frame{VideoFrame: f, TS: ts, size: len(f.Data)}
+	if b.spool != nil {
+		seg, off, err := b.spool.append(fr)
+		if err != nil {
+			// The GOP is broken; start over from the next keyframe
+			b.errors.Add(1)
+			b.warnings.Warn("Failed to spool frame, replay buffer restarts", func(e *zerolog.Event) { e.Err(err) })
+			b.clear()
+			return
+		}
+		fr.seg, fr.off, fr.Data = seg, off, nil
+	}
+	b.frames = append(b.frames, fr)
+	b.bytes += int64(fr.size)
+
+	// Drop the oldest GOP while the next one still covers the window, or
+	// while over the byte cap and more than one GOP is held
+	for {
+		next := 0
+		for i := 1; i < len(b.frames); i++ {
+			if b.frames[i].IsKeyframe {
+				next = i
+				break
+			}
+		}
+		if next == 0 {
+			return
+		}
+		covered := ts-b.frames[next].TS >= int64(b.cfg.Window)
+		if !covered && b.bytes <= b.cfg.MaxBytes {
+			return
+		}
+		for _, fr := range b.frames[:next] {
+			b.bytes -= int64(fr.size)
+		}
+		b.frames = append([]Frame(nil), b.frames[next:]...)
+		if b.spool != nil {
+			b.spool.trim(b.frames[0].seg)
+		}
+	}
+}
+
+// clear empties the buffer; the lock must be held
+func (b *Buffer) clear() {
+	b.frames, b.bytes = nil, 0
+	if b.spool != nil {
+		b.spool.reset()
+	}
+}
+
+// Close discards the buffer, including its spool. A gateway that exits
+// without closing leaves the spool for Recover.
+func (b *Buffer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.clear()
+}
+
+// SetOnSave sets a callback for each clip saved, given its file. It is
+// called from Save without locks held.
+func (b *Buffer) SetOnSave(fn func(clip Clip, path string)) {
+	b.mu.Lock()
+	b.onSave = fn
+	b.mu.Unlock()
+}
+
+// SetChapters sets where clips get their chapters from
+func (b *Buffer) SetChapters(src ChapterSource) {
+	b.mu.Lock()
+	b.chapters = src
+	b.mu.Unlock()
+}
+
+// Save writes the last d of the stream (the whole buffer when d is zero or
+// longer) as an MP4 clip. The clip starts at the keyframe at or before the
+// requested start, so it may run slightly longer than d.
+func (b *Buffer) Save(d time.Duration) (Clip, error) {
+	b.mu.Lock()
+	if len(b.frames) == 0 {
+		b.mu.Unlock()
+		return Clip{}, ErrEmpty
+	}
+	start := 0
+	if d > 0 {
+		from := b.frames[len(b.frames)-1].TS - int64(d)
+		for i, f := range b.frames {
+			if f.TS > from {
+				break
+			}
+			if f.IsKeyframe {
+				start = i
+			}
+		}
+	}
+	frames := append([]Frame(nil), b.frames[start:]...)
+	codec := b.codec
+	// Keep spooled segments until their data is read
+	segments := b.hold(frames)
+	b.mu.Unlock()
+
+	_, err := b.load(frames)
+	b.mu.Lock()
+	for _, seg := range segments {
+		b.spool.release(seg)
+	}
+	b.mu.Unlock()
+	if err != nil {
+		b.errors.Add(1)
+		b.logger.Error().Err(err).Msg("Failed to read spooled frames for clip")
+		return Clip{}, err
+	}
+
+	return b.save(codec, frames, "")
+}
+
+// Recover saves what a crashed gateway left in the spool as a clip of at
+// most the buffer's window, named with a "-recovered" suffix, and deletes
+// it. It returns ErrEmpty when there is nothing to recover.
+func (b *Buffer) Recover() (Clip, error) {
+	if b.spool == nil || len(b.spool.leftover) == 0 {
+		return Clip{}, ErrEmpty
+	}
+	defer b.spool.removeLeftover()
+
+	frames := b.spool.recoverFrames()
+	if len(frames) == 0 {
+		return Clip{}, ErrEmpty
+	}
+	start := 0
+	from := frames[len(frames)-1].TS - int64(b.cfg.Window)
+	for i, f := range frames {
+		if f.TS > from {
+			break
+		}
+		if f.IsKeyframe {
+			start = i
+		}
+	}
+	frames = frames[start:]
+
+	clip, err := b.save(frames[0].Codec, frames, "-recovered")
+	if err != nil {
+		return Clip{}, err
+	}
+	b.recovered.Add(1)
+	return clip, nil
+}
+
+// save writes frames as a clip and reports it
+func (b *Buffer) save(codec string, frames []Frame, suffix string) (Clip, error) {
+	b.mu.Lock()
+	onSave, chapters := b.onSave, b.chapters
+	b.mu.Unlock()
+
+	track := NewTrack(codec, frames)
+	if chapters != nil {
+		track.Chapters = chapters.Chapters(frames[0].TS, frames[len(frames)-1].TS)
+	}
+
+	clip, err := b.write(track, suffix)
+	if err != nil {
+		b.errors.Add(1)
+		b.logger.Error().Err(err).Msg("Failed to save clip")
+		return Clip{}, err
+	}
+	clip.Frames = len(frames)
+	clip.Markers = toMarkers(track.Chapters)
+	clip.DurationSec = time.Duration(frames[len(frames)-1].TS - frames[0].TS).Seconds()
+	b.clips.Add(1)
+	b.logger.Info().Str("clip_id", clip.ID).Float64("duration_sec", clip.DurationSec).
+		Int64("bytes", clip.Bytes).Msg("Clip saved")
+	if onSave != nil {
+		onSave(clip, b.path(clip.ID))
+	}
+	return clip, nil
+}
+
+// hold references the segments frames are spooled in, so trimming does
+// not delete them while they are read; the lock must be held
+func (b *Buffer) hold(frames []Frame) []*segment {
+	var segments []*segment
+	for _, f := range frames {
+		if f.seg != nil && (len(segments) == 0 || segments[len(segments)-1] != f.seg) {
+			f.seg.refs++
+			segments = append(segments, f.seg)
+		}
+	}
+	return segments
+}
+
+// load reads the data of spooled frames, returning how many were read
+// before an error
+func (b *Buffer) load(frames []Frame) (int, error) {
+	for i := range frames {
+		if frames[i].seg == nil {
+			continue
+		}
+		data, err := b.spool.read(frames[i].seg, frames[i].off, frames[i].size)
+		if err != nil {
+			return i, err
+		}
+		frames[i].Data = data
+	}
+	return len(frames), nil
+}
+
+// loaded returns frames with their spooled data read, cut short at a frame
+// that cannot be read; the lock must be held
+func (b *Buffer) loaded(frames []Frame) []Frame {
+	n, err := b.load(frames)
+	if err != nil {
+		b.errors.Add(1)
+		b.warnings.Warn("Failed to read spooled frame", func(e *zerolog.Event) { e.Err(err) })
+	}
+	return frames[:n]
+}
+
+// Edge returns the timestamps of the oldest and newest buffered frames
+func (b *Buffer) Edge() (oldest, newest int64, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.frames) == 0 {
+		return 0, 0, false
+	}
+	return b.frames[0].TS, b.frames[len(b.frames)-1].TS, true
+}
+
+// From returns up to n frames starting at the last keyframe at or before
+// ts, or at the oldest frame when ts has already left the buffer
+func (b *Buffer) From(ts int64, n int) []Frame {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	start := 0
+	for i, f := range b.frames {
+		if f.TS > ts {
+			break
+		}
+		if f.IsKeyframe {
+			start = i
+		}
+	}
+	end := min(start+n, len(b.frames))
+	return b.loaded(append([]Frame(nil), b.frames[start:end]...))
+}
+
+// After returns up to n frames following the one at ts. ok is false when
+// that frame has left the buffer, and reading must start over with From.
+func (b *Buffer) After(ts int64, n int) (frames []Frame, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i := sort.Search(len(b.frames), func(i int) bool { return b.frames[i].TS >= ts })
+	if i == len(b.frames) || b.frames[i].TS != ts {
+		return nil, false
+	}
+	end := min(i+1+n, len(b.frames))
+	return b.loaded(append([]Frame(nil), b.frames[i+1:end]...)), true
+}
+
+// NewTrack returns an MP4 track of frames, which must start on a keyframe,
+// described with the color space, HDR metadata and rotation of the first
+func NewTrack(codec string, frames []Frame) mp4.Track {
+	track := mp4.Track{Codec: codec, Samples: make([]mp4.Sample, len(frames))}
+	if len(frames) > 0 {
+		setColor(&track, frames[0].VideoFrame)
+		track.Rotation = frames[0].Rotation
+	}
+	for i, f := range frames {
+		dts := f.DTS
+		if f.PTS <= 0 {
+			dts = 0 // Wall-clock timestamps have no decode order
+		}
+		track.Samples[i] = mp4.Sample{PTS: f.TS, DTS: dts, Keyframe: f.IsKeyframe, Data: f.Data}
+	}
+	return track
+}
+
+// setColor describes the clip's color space and HDR metadata as the first
+// keyframe declared them
+func setColor(t *mp4.Track, f media.VideoFrame) {
+	if f.Color != nil {
+		p, tr, m := f.Color.H273()
+		t.Color = &mp4.Color{Primaries: p, Transfer: tr, Matrix: m, FullRange: f.Color.FullRange}
+	}
+	if hdr := f.HDR; hdr != nil {
+		// mdcv lists green, blue, red
+		t.Mastering = &mp4.MasteringDisplay{
+			Primaries:    [3][2]uint16{media.Chromaticity(hdr.Primaries[1]), media.Chromaticity(hdr.Primaries[2]), media.Chromaticity(hdr.Primaries[0])},
+			WhitePoint:   media.Chromaticity(hdr.WhitePoint),
+			MaxLuminance: media.Luminance(hdr.MaxLuminance, 10000, math.MaxUint32),
+			MinLuminance: media.Luminance(hdr.MinLuminance, 10000, math.MaxUint32),
+		}
+		if hdr.MaxCLL > 0 || hdr.MaxFALL > 0 {
+			t.ContentLight = &mp4.ContentLight{
+				MaxCLL:  uint16(media.Luminance(float64(hdr.MaxCLL), 1, math.MaxUint16)),
+				MaxFALL: uint16(media.Luminance(float64(hdr.MaxFALL), 1, math.MaxUint16)),
+			}
+		}
+	}
+}
+
+// write muxes track into a new file, named after the current time and
+// suffix
+func (b *Buffer) write(track mp4.Track, suffix string) (Clip, error) {
+	tmp, err := os.CreateTemp(b.cfg.Dir, ".clip-*.tmp")
+	if err != nil {
+		return Clip{}, err
+	}
+	defer os.Remove(tmp.Name())
+	if err := mp4.Write(tmp, track); err != nil {
+		tmp.Close()
+		return Clip{}, err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return Clip{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Clip{}, err
+	}
+
+	now := time.Now()
+	id := "clip-" + now.Format("20060102-150405") + suffix
+	for n := 2; ; n++ {
+		if _, err := os.Stat(b.path(id)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		id = fmt.Sprintf("clip-%s%s-%d", now.Format("20060102-150405"), suffix, n)
+	}
+	if err := os.Rename(tmp.Name(), b.path(id)); err != nil {
+		return Clip{}, err
+	}
+	return Clip{ID: id, CreatedAt: now.UTC(), Bytes: info.Size()}, nil
+}
+
+// Clips lists saved clips, newest first
+func (b *Buffer) Clips() ([]Clip, error) {
+	entries, err := os.ReadDir(b.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	clips := make([]Clip, 0, len(entries))
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".mp4")
+		if !ok || !strings.HasPrefix(id, "clip-") || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		clips = append(clips, Clip{ID: id, CreatedAt: info.ModTime().UTC(), Bytes: info.Size()})
+	}
+	sort.Slice(clips, func(i, j int) bool { return clips[i].CreatedAt.After(clips[j].CreatedAt) })
+	return clips, nil
+}
+
+// Path returns the file of a saved clip
+func (b *Buffer) Path(id string) (string, error) {
+	if !validID(id) {
+		return "", ErrNotFound
+	}
+	path := b.path(id)
+	if _, err := os.Stat(path); err != nil {
+		return "", ErrNotFound
+	}
+	return path, nil
+}
+
+// Markers reads the chapters of a saved clip, including the one the MP4
+// writer adds at the start when the first marker comes later
+func (b *Buffer) Markers(id string) ([]Marker, error) {
+	path, err := b.Path(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	chapters, err := mp4.ReadChapters(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return toMarkers(chapters), nil
+}
+
+func toMarkers(chapters []mp4.Chapter) []Marker {
+	markers := make([]Marker, 0, len(chapters))
+	for _, c := range chapters {
+		markers = append(markers, Marker{OffsetSec: c.Start.Seconds(), Title: c.Title})
+	}
+	return markers
+}
+
+// Delete removes a saved clip
+func (b *Buffer) Delete(id string) error {
+	path, err := b.Path(id)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Stats returns buffer counters
+func (b *Buffer) Stats() Stats {
+	b.mu.Lock()
+	st := Stats{Codec: b.codec, Frames: len(b.frames), Bytes: b.bytes}
+	if n := len(b.frames); n > 0 {
+		st.BufferedSec = time.Duration(b.frames[n-1].TS - b.frames[0].TS).Seconds()
+	}
+	b.mu.Unlock()
+	st.Clips = b.clips.Load()
+	st.Errors = b.errors.Load()
+	st.Spool = b.cfg.SpoolDir
+	st.Recovered = b.recovered.Load()
+	return st
+}
+
+func (b *Buffer) path(id string) string {
+	return filepath.Join(b.cfg.Dir, id+".mp4")
+}
+
+// validID accepts the IDs Save generates
+func validID(id string) bool {
+	if !strings.HasPrefix(id, "clip-") || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,299 @@
+package replay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Spool layout: segment files of self-describing records, each a header
+// followed by the frame's data. A record is only trusted when its checksum
+// matches, so a torn write at the end of a segment is simply where
+// recovery stops reading.
+const (
+	segmentPrefix = "segment-"
+	segmentSuffix = ".spool"
+
+	// segmentBytes is the size after which the next keyframe opens a new
+	// segment, so old segments can be deleted as the buffer rolls
+	segmentBytes = 64 << 20
+
+	recordMagic  = "GCRF"
+	recordHeader = 48
+
+	flagKeyframe      = 1 << 0
+	flagDiscontinuity = 1 << 1
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	spoolCodecs = map[string]byte{"h264": 1, "hevc": 2}
+)
+
+// segment is one spool file. Its reference count and dropped flag are
+// guarded by the buffer's mutex.
+type segment struct {
+	seq  uint64
+	path string
+	f    *os.File
+	size int64
+
+	refs    int  // Saves reading it without the lock
+	dropped bool // Left the buffer; removed once unreferenced
+}
+
+// spool keeps frame data in files, so the replay buffer can hold far more
+// than memory allows. It is meant for a RAM disk such as /dev/shm, which
+// outlives a crashed gateway; segments left by a previous run are kept for
+// Recover.
+type spool struct {
+	dir      string
+	logger   zerolog.Logger
+	segments []*segment // Oldest first
+	next     uint64
+	leftover []string // Segment files of a previous run, oldest first
+	header   [recordHeader]byte
+}
+
+// openSpool opens dir, noting segments a previous run left behind
+func openSpool(dir string, logger zerolog.Logger) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %w", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, logger: logger}
+	for _, e := range entries {
+		var seq uint64
+		if _, err := fmt.Sscanf(e.Name(), segmentPrefix+"%d"+segmentSuffix, &seq); err != nil || e.IsDir() {
+			continue
+		}
+		s.leftover = append(s.leftover, filepath.Join(dir, e.Name()))
+		s.next = max(s.next, seq+1)
+	}
+	sort.Strings(s.leftover)
+	return s, nil
+}
+
+// append writes f's data and returns where it went. A keyframe opens a new
+// segment once the current one is full.
+func (s *spool) append(f Frame) (*segment, int64, error) {
+	cur := s.current()
+	if cur == nil || (f.IsKeyframe && cur.size >= segmentBytes) {
+		var err error
+		if cur, err = s.create(); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	h := s.header[:]
+	copy(h[0:], recordMagic)
+	binary.LittleEndian.PutUint32(h[4:], uint32(len(f.Data)))
+	var flags byte
+	if f.IsKeyframe {
+		flags |= flagKeyframe
+	}
+	if f.Discontinuity {
+		flags |= flagDiscontinuity
+	}
+	h[12] = flags
+	h[13] = spoolCodecs[f.Codec]
+	binary.LittleEndian.PutUint16(h[14:], uint16(f.Rotation))
+	binary.LittleEndian.PutUint64(h[16:], uint64(f.TS))
+	binary.LittleEndian.PutUint64(h[24:], uint64(f.PTS))
+	binary.LittleEndian.PutUint64(h[32:], uint64(f.DTS))
+	binary.LittleEndian.PutUint64(h[40:], uint64(f.ReceivedAt.UnixNano()))
+	crc := crc32.Update(crc32.Checksum(h[12:], crcTable), crcTable, f.Data)
+	binary.LittleEndian.PutUint32(h[8:], crc)
+
+	// A failed write leaves a torn record, which recovery stops at; the
+	// buffer starts over, dropping this segment
+	if _, err := cur.f.Write(h); err != nil {
+		return nil, 0, err
+	}
+	if _, err := cur.f.Write(f.Data); err != nil {
+		return nil, 0, err
+	}
+	off := cur.size + recordHeader
+	cur.size = off + int64(len(f.Data))
+	return cur, off, nil
+}
+
+func (s *spool) current() *segment {
+	if n := len(s.segments); n > 0 {
+		return s.segments[n-1]
+	}
+	return nil
+}
+
+func (s *spool) create() (*segment, error) {
+	path := filepath.Join(s.dir, fmt.Sprintf("%s%010d%s", segmentPrefix, s.next, segmentSuffix))
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	seg := &segment{seq: s.next, path: path, f: f}
+	s.next++
+	s.segments = append(s.segments, seg)
+	return seg, nil
+}
+
+// read returns n bytes of frame data at off
+func (s *spool) read(seg *segment, off int64, n int) ([]byte, error) {
+	data := make([]byte, n)
+	if _, err := seg.f.ReadAt(data, off); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// trim drops the segments before first, which holds the oldest frame
+func (s *spool) trim(first *segment) {
+	i := 0
+	for i < len(s.segments) && s.segments[i] != first {
+		s.drop(s.segments[i])
+		i++
+	}
+	s.segments = s.segments[i:]
+}
+
+// reset drops every segment
+func (s *spool) reset() {
+	for _, seg := range s.segments {
+		s.drop(seg)
+	}
+	s.segments = nil
+}
+
+// drop removes a segment, or marks it for removal once the last Save
+// reading it is done
+func (s *spool) drop(seg *segment) {
+	seg.dropped = true
+	if seg.refs == 0 {
+		s.remove(seg)
+	}
+}
+
+// release ends a Save's use of a segment
+func (s *spool) release(seg *segment) {
+	seg.refs--
+	if seg.dropped && seg.refs == 0 {
+		s.remove(seg)
+	}
+}
+
+func (s *spool) remove(seg *segment) {
+	seg.f.Close()
+	if err := os.Remove(seg.path); err != nil {
+		s.logger.Warn().Err(err).Str("path", seg.path).Msg("Failed to remove spool segment")
+	}
+}
+
+// recoverFrames reads the frames of leftover segments. It returns the last
+// run that could form one clip, as the buffer would have held it, with
+// torn or corrupt records ending a segment.
+func (s *spool) recoverFrames() []Frame {
+	var frames []Frame
+	for _, path := range s.leftover {
+		f, err := os.Open(path)
+		if err != nil {
+			s.logger.Warn().Err(err).Str("path", path).Msg("Failed to open spool segment")
+			continue
+		}
+		read, err := readSegment(f)
+		f.Close()
+		if err != nil {
+			s.logger.Warn().Err(err).Str("path", path).Int("frames", len(read)).Msg("Spool segment ends in a damaged record")
+		}
+		for _, fr := range read {
+			if n := len(frames); n > 0 && (fr.Codec != frames[n-1].Codec || fr.Discontinuity || fr.TS < frames[n-1].TS) {
+				frames = nil
+			}
+			if len(frames) == 0 && !fr.IsKeyframe {
+				continue
+			}
+			frames = append(frames, fr)
+		}
+	}
+	return frames
+}
+
+// removeLeftover deletes the segments of a previous run
+func (s *spool) removeLeftover() {
+	for _, path := range s.leftover {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger.Warn().Err(err).Str("path", path).Msg("Failed to remove spool segment")
+		}
+	}
+	s.leftover = nil
+}
+
+// readSegment reads records up to the end of a segment or the first one
+// that is incomplete or fails its checksum
+func readSegment(r io.Reader) ([]Frame, error) {
+	var (
+		frames []Frame
+		h      [recordHeader]byte
+	)
+	codecs := make(map[byte]string, len(spoolCodecs))
+	for name, id := range spoolCodecs {
+		codecs[id] = name
+	}
+	for {
+		if _, err := io.ReadFull(r, h[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return frames, nil
+			}
+			return frames, fmt.Errorf("truncated record header: %w", err)
+		}
+		if string(h[0:4]) != recordMagic {
+			return frames, errors.New("bad record magic")
+		}
+		n := binary.LittleEndian.Uint32(h[4:])
+		if n > maxSpoolFrame {
+			return frames, fmt.Errorf("record of %d bytes is too large", n)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return frames, fmt.Errorf("truncated record: %w", err)
+		}
+		if crc32.Update(crc32.Checksum(h[12:], crcTable), crcTable, data) != binary.LittleEndian.Uint32(h[8:]) {
+			return frames, errors.New("record checksum mismatch")
+		}
+		codec, ok := codecs[h[13]]
+		if !ok {
+			return frames, fmt.Errorf("unknown codec %d", h[13])
+		}
+		frames = append(frames, Frame{
+			VideoFrame: media.VideoFrame{
+				PTS:           int64(binary.LittleEndian.Uint64(h[24:])),
+				DTS:           int64(binary.LittleEndian.Uint64(h[32:])),
+				IsKeyframe:    h[12]&flagKeyframe != 0,
+				Discontinuity: h[12]&flagDiscontinuity != 0,
+				Codec:         codec,
+				Rotation:      int(binary.LittleEndian.Uint16(h[14:])),
+				ReceivedAt:    time.Unix(0, int64(binary.LittleEndian.Uint64(h[40:]))),
+				Data:          data,
+			},
+			TS:   int64(binary.LittleEndian.Uint64(h[16:])),
+			size: int(n),
+		})
+	}
+}
+
+// maxSpoolFrame bounds a record's length, so a corrupt header cannot make
+// recovery allocate without limit
+const maxSpoolFrame = 64 << 20
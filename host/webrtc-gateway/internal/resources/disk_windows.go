@@ -0,0 +1,18 @@
+//go:build windows
+
+package resources
+
+import "golang.org/x/sys/windows"
+
+// diskSpace returns the bytes available to the gateway's user and the size
+// of the volume holding path
+func diskSpace(path string) (free, total uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := windows.GetDiskFreeSpaceEx(p, &free, &total, nil); err != nil {
+		return 0, 0, err
+	}
+	return free, total, nil
+}
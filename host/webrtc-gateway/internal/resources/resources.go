@@ -0,0 +1,377 @@
+// Package resources watches disk space, memory and CPU so the gateway can
+// degrade before it runs out, rather than failing mid-session. Each reading
+// is rated ok, warning or critical against thresholds; changes are reported
+// so callers can stop recording when its disk is nearly full or drop
+// scalable video to its base layer when the host is overloaded.
+//
+// Memory and CPU are read from /proc and are only watched on Linux; disk
+// space is watched everywhere.
+package resources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrUnsupported is returned when a resource cannot be read on this platform
+var ErrUnsupported = errors.New("not supported on this platform")
+
+// Level rates a reading against its thresholds
+type Level string
+
+const (
+	LevelOK       Level = "ok"
+	LevelWarning  Level = "warning"
+	LevelCritical Level = "critical"
+)
+
+// severity orders levels, worst highest
+func (l Level) severity() int {
+	switch l {
+	case LevelWarning:
+		return 1
+	case LevelCritical:
+		return 2
+	}
+	return 0
+}
+
+// Kind is a watched resource
+type Kind string
+
+const (
+	KindDisk   Kind = "disk"
+	KindMemory Kind = "memory"
+	KindCPU    Kind = "cpu"
+)
+
+// Config configures a Monitor
+type Config struct {
+	// Interval between checks, default 5s
+	Interval time.Duration
+
+	// DiskPaths are directories whose free space is watched, e.g. the
+	// recording directory. Duplicates and empty entries are ignored.
+	DiskPaths []string
+
+	// DiskWarnBytes and DiskCriticalBytes rate free disk space; zero
+	// disables the threshold
+	DiskWarnBytes     uint64
+	DiskCriticalBytes uint64
+
+	// MemoryWarnPercent and MemoryCriticalPercent rate system memory in use,
+	// not counting reclaimable caches; zero disables the threshold
+	MemoryWarnPercent     float64
+	MemoryCriticalPercent float64
+
+	// CPUWarnPercent and CPUCriticalPercent rate CPU busy time across all
+	// cores, smoothed over a few checks so short bursts are ignored; zero
+	// disables the threshold
+	CPUWarnPercent     float64
+	CPUCriticalPercent float64
+}
+
+// Reading is the latest check of one resource
+type Reading struct {
+	Kind        Kind    `json:"kind"`
+	Path        string  `json:"path,omitempty"` // Disk readings only
+	Level       Level   `json:"level"`
+	UsedPercent float64 `json:"used_percent"`
+	FreeBytes   uint64  `json:"free_bytes,omitempty"` // Disk and memory
+	TotalBytes  uint64  `json:"total_bytes,omitempty"`
+	Error       string  `json:"error,omitempty"` // Why the last check failed; the level is kept
+}
+
+// Status is every reading and the worst level among them
+type Status struct {
+	Level     Level     `json:"level"`
+	Readings  []Reading `json:"readings"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+}
+
+// Change describes a resource moving between levels
+type Change struct {
+	Reading
+	From Level
+}
+
+// Hysteresis: a level is only left for a better one once the reading has
+// cleared the threshold by this margin, so a value hovering around it does
+// not flap
+const (
+	percentMargin = 5    // Percentage points
+	diskMargin    = 0.10 // Fraction of the threshold
+)
+
+// cpuSmoothing is the weight of each new CPU sample in the moving average
+const cpuSmoothing = 0.4
+
+// Monitor checks resources periodically and reports level changes
+type Monitor struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	cpu     cpuSampler
+	cpuAvg  float64
+	cpuSeen bool
+
+	mu        sync.Mutex
+	readings  []Reading // Disk paths in order, then memory, then CPU
+	checkedAt time.Time
+	onChange  func(Change)
+}
+
+// New creates a monitor. It does nothing until Start.
+func New(cfg Config, logger zerolog.Logger) *Monitor {
+	// Apply defaults for zero values
+	if cfg.Interval <= 0 {
+		cfg.Interval = 5 * time.Second
+	}
+	seen := make(map[string]bool)
+	var paths []string
+	for _, p := range cfg.DiskPaths {
+		if p == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(p); err == nil {
+			p = abs
+		}
+		if !seen[p] {
+			seen[p] = true
+			paths = append(paths, p)
+		}
+	}
+	cfg.DiskPaths = paths
+
+	return &Monitor{
+		cfg:    cfg,
+		logger: logger.With().Str("component", "resources").Logger(),
+	}
+}
+
+// SetOnChange sets a callback for resources changing level. It is called
+// from the monitor's goroutine without locks held.
+func (m *Monitor) SetOnChange(fn func(Change)) {
+	m.mu.Lock()
+	m.onChange = fn
+	m.mu.Unlock()
+}
+
+// Start checks resources until ctx is cancelled. The first check runs
+// before Start returns, so levels are known straight away.
+func (m *Monitor) Start(ctx context.Context) {
+	m.check()
+	go func() {
+		ticker := time.NewTicker(m.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.check()
+			}
+		}
+	}()
+}
+
+// check takes one reading of each resource
+func (m *Monitor) check() {
+	next := make([]Reading, 0, len(m.cfg.DiskPaths)+2)
+	for _, path := range m.cfg.DiskPaths {
+		r := Reading{Kind: KindDisk, Path: path}
+		free, total, err := diskSpace(path)
+		if err != nil {
+			r.Error = err.Error()
+		} else {
+			r.FreeBytes, r.TotalBytes = free, total
+			if total > 0 {
+				r.UsedPercent = 100 * float64(total-free) / float64(total)
+			}
+		}
+		next = append(next, r)
+	}
+
+	if free, total, err := memory(); !errors.Is(err, ErrUnsupported) {
+		r := Reading{Kind: KindMemory}
+		if err != nil {
+			r.Error = err.Error()
+		} else if total > 0 {
+			r.FreeBytes, r.TotalBytes = free, total
+			r.UsedPercent = 100 * float64(total-free) / float64(total)
+		}
+		next = append(next, r)
+	}
+
+	// CPU use is a rate, so the first sample only sets the baseline
+	if busy, err := m.cpu.sample(); !errors.Is(err, ErrUnsupported) {
+		r := Reading{Kind: KindCPU}
+		switch {
+		case err != nil:
+			r.Error = err.Error()
+		case busy >= 0:
+			if !m.cpuSeen {
+				m.cpuAvg, m.cpuSeen = busy, true
+			} else {
+				m.cpuAvg += cpuSmoothing * (busy - m.cpuAvg)
+			}
+		}
+		if m.cpuSeen {
+			r.UsedPercent = m.cpuAvg
+			next = append(next, r)
+		}
+	}
+
+	m.mu.Lock()
+	var changes []Change
+	for i := range next {
+		r := &next[i]
+		prev := LevelOK
+		for _, p := range m.readings {
+			if p.Kind == r.Kind && p.Path == r.Path {
+				prev = p.Level
+				break
+			}
+		}
+		if r.Error != "" {
+			r.Level = prev
+			continue
+		}
+		r.Level = m.rate(*r, prev)
+		if r.Level != prev {
+			changes = append(changes, Change{Reading: *r, From: prev})
+		}
+	}
+	m.readings = next
+	m.checkedAt = time.Now()
+	onChange := m.onChange
+	m.mu.Unlock()
+
+	for _, c := range changes {
+		event := m.logger.Info()
+		if c.Level.severity() > c.From.severity() {
+			event = m.logger.Warn()
+		}
+		event.Str("resource", string(c.Kind)).Str("path", c.Path).Str("level", string(c.Level)).
+			Str("from", string(c.From)).Float64("used_percent", c.UsedPercent).Uint64("free_bytes", c.FreeBytes).
+			Msg("Resource level changed")
+		if onChange != nil {
+			onChange(c)
+		}
+	}
+}
+
+// rate applies a reading's thresholds with hysteresis
+func (m *Monitor) rate(r Reading, current Level) Level {
+	if r.Kind == KindDisk {
+		return rateFree(current, r.FreeBytes, m.cfg.DiskWarnBytes, m.cfg.DiskCriticalBytes)
+	}
+	warn, crit := m.cfg.MemoryWarnPercent, m.cfg.MemoryCriticalPercent
+	if r.Kind == KindCPU {
+		warn, crit = m.cfg.CPUWarnPercent, m.cfg.CPUCriticalPercent
+	}
+	return ratePercent(current, r.UsedPercent, warn, crit)
+}
+
+// ratePercent rates a percentage in use, where higher is worse
+func ratePercent(current Level, used, warn, crit float64) Level {
+	above := func(threshold float64, level Level) bool {
+		if threshold <= 0 {
+			return false
+		}
+		// Staying at a level only needs the reading to remain within the
+		// margin below its threshold
+		if current.severity() >= level.severity() {
+			return used >= threshold-percentMargin
+		}
+		return used >= threshold
+	}
+	switch {
+	case above(crit, LevelCritical):
+		return LevelCritical
+	case above(warn, LevelWarning):
+		return LevelWarning
+	}
+	return LevelOK
+}
+
+// rateFree rates free space, where lower is worse
+func rateFree(current Level, free, warn, crit uint64) Level {
+	below := func(threshold uint64, level Level) bool {
+		if threshold == 0 {
+			return false
+		}
+		if current.severity() >= level.severity() {
+			return float64(free) < float64(threshold)*(1+diskMargin)
+		}
+		return free < threshold
+	}
+	switch {
+	case below(crit, LevelCritical):
+		return LevelCritical
+	case below(warn, LevelWarning):
+		return LevelWarning
+	}
+	return LevelOK
+}
+
+// Status returns the latest readings
+func (m *Monitor) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := Status{Level: LevelOK, Readings: append([]Reading{}, m.readings...), CheckedAt: m.checkedAt}
+	for _, r := range m.readings {
+		if r.Level.severity() > s.Level.severity() {
+			s.Level = r.Level
+		}
+	}
+	return s
+}
+
+// Level returns the latest level of a resource, LevelOK when it is not
+// watched. path selects a disk and is ignored for other kinds.
+func (m *Monitor) Level(kind Kind, path string) Level {
+	if kind == KindDisk {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	} else {
+		path = ""
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.readings {
+		if r.Kind == kind && r.Path == path {
+			return r.Level
+		}
+	}
+	return LevelOK
+}
+
+// Overloaded reports whether memory or CPU is critical, when work that can
+// be shed should be
+func (m *Monitor) Overloaded() bool {
+	return m.Level(KindMemory, "") == LevelCritical || m.Level(KindCPU, "") == LevelCritical
+}
+
+// CheckDisk returns an error when the disk holding path is critically low,
+// for refusing to start writing to it
+func (m *Monitor) CheckDisk(path string) error {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, r := range m.readings {
+		if r.Kind == KindDisk && r.Path == path && r.Level == LevelCritical {
+			return fmt.Errorf("disk space is critically low: %d MB free on %s", r.FreeBytes>>20, path)
+		}
+	}
+	return nil
+}
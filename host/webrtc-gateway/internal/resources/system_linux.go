@@ -0,0 +1,84 @@
+//go:build linux
+
+package resources
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// memory returns the memory available without swapping, which counts
+// reclaimable caches, and the total
+func memory() (available, total uint64, err error) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, 0, err
+	}
+	var haveAvailable bool
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total = kb << 10
+		case "MemAvailable:":
+			available, haveAvailable = kb<<10, true
+		}
+	}
+	if total == 0 || !haveAvailable {
+		return 0, 0, fmt.Errorf("/proc/meminfo lacks MemTotal or MemAvailable")
+	}
+	return available, total, nil
+}
+
+// cpuSampler turns the cumulative CPU times in /proc/stat into busy
+// percentages between samples
+type cpuSampler struct {
+	idle, total uint64
+}
+
+// sample returns the share of CPU time spent busy since the last sample, or
+// -1 on the first
+func (s *cpuSampler) sample() (float64, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	line, _, _ := bytes.Cut(data, []byte("\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, fmt.Errorf("unexpected /proc/stat format")
+	}
+	// user nice system idle iowait irq softirq steal; guest time is already
+	// counted in user and nice
+	var idle, total uint64
+	for i, f := range fields[1:min(len(fields), 9)] {
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected /proc/stat format: %w", err)
+		}
+		total += v
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+
+	prevIdle, prevTotal := s.idle, s.total
+	s.idle, s.total = idle, total
+	if prevTotal == 0 || total <= prevTotal || idle < prevIdle {
+		return -1, nil
+	}
+	dt := total - prevTotal
+	return 100 * float64(dt-min(idle-prevIdle, dt)) / float64(dt), nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package resources
+
+func memory() (available, total uint64, err error) {
+	return 0, 0, ErrUnsupported
+}
+
+type cpuSampler struct{}
+
+func (s *cpuSampler) sample() (float64, error) {
+	return 0, ErrUnsupported
+}
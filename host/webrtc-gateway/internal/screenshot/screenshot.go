@@ -0,0 +1,206 @@
+// Package screenshot returns the current game picture as an image. It keeps
+// the most recent keyframe of the stream and decodes it on request, asking
+// the source for a fresh one when the last is too old.
+package screenshot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/decoder"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/preview"
+)
+
+// ErrNoKeyframe is returned by Capture when no keyframe arrived in time
+var ErrNoKeyframe = errors.New("no keyframe available")
+
+// Config configures the screenshot service
+type Config struct {
+	// Decoder is the decoder backend, "" or "auto" for the best available
+	Decoder string
+
+	// KeyframeWait is how long Capture waits for a requested keyframe,
+	// default 2s
+	KeyframeWait time.Duration
+}
+
+// Screenshot is a decoded picture
+type Screenshot struct {
+	Image      image.Image
+	CapturedAt time.Time // When the keyframe was received
+}
+
+// Stats are service counters
+type Stats struct {
+	Codec       string  `json:"codec,omitempty"`
+	Decoder     string  `json:"decoder,omitempty"`
+	KeyframeAge float64 `json:"keyframe_age_sec,omitempty"`
+	Captures    uint64  `json:"captures"`
+	Decodes     uint64  `json:"decodes"`
+	Requests    uint64  `json:"keyframe_requests"`
+	Errors      uint64  `json:"errors"`
+}
+
+// Service keeps the latest keyframe and decodes it on demand
+type Service struct {
+	cfg       Config
+	requester media.KeyframeRequester
+	logger    zerolog.Logger
+
+	mu       sync.Mutex
+	keyframe media.VideoFrame
+	seq      uint64        // Bumped for every keyframe
+	arrived  chan struct{} // Closed and replaced when a keyframe arrives
+	decName  string        // Backend of the current decoder, for Stats
+
+	// decodeMu serializes decoding and guards the fields below it
+	decodeMu   sync.Mutex
+	dec        decoder.Decoder
+	decCodec   string
+	decodedSeq uint64
+	decoded    Screenshot
+
+	// Statistics
+	captures atomic.Uint64
+	decodes  atomic.Uint64
+	requests atomic.Uint64
+	errors   atomic.Uint64
+}
+
+// New creates a screenshot service. requester may be nil when the source
+// cannot produce keyframes on demand; Capture then waits for the next one.
+func New(cfg Config, requester media.KeyframeRequester, logger zerolog.Logger) *Service {
+	// Apply defaults for zero values
+	if cfg.KeyframeWait <= 0 {
+		cfg.KeyframeWait = 2 * time.Second
+	}
+
+	return &Service{
+		cfg:       cfg,
+		requester: requester,
+		logger:    logger.With().Str("component", "screenshot").Logger(),
+		arrived:   make(chan struct{}),
+	}
+}
+
+// Observe keeps keyframes. It is a media.Distributor tap.
+func (s *Service) Observe(f media.VideoFrame) {
+	if !f.IsKeyframe || (f.Codec != "h264" && f.Codec != "hevc") {
+		return
+	}
+	s.mu.Lock()
+	s.keyframe = f
+	s.seq++
+	close(s.arrived)
+	s.arrived = make(chan struct{})
+	s.mu.Unlock()
+}
+
+// Capture decodes the latest keyframe. When none has arrived within maxAge
+// (or at all) it requests one and waits up to KeyframeWait for it; a zero
+// maxAge accepts any keyframe already held.
+func (s *Service) Capture(ctx context.Context, maxAge time.Duration) (Screenshot, error) {
+	s.captures.Add(1)
+
+	s.mu.Lock()
+	kf, seq, arrived := s.keyframe, s.seq, s.arrived
+	s.mu.Unlock()
+
+	stale := seq == 0 || (maxAge > 0 && time.Since(kf.ReceivedAt) > maxAge)
+	if stale {
+		if s.requester != nil {
+			s.requests.Add(1)
+			s.requester.ForceKeyframe()
+		}
+		timer := time.NewTimer(s.cfg.KeyframeWait)
+		defer timer.Stop()
+		select {
+		case <-arrived:
+			s.mu.Lock()
+			kf, seq = s.keyframe, s.seq
+			s.mu.Unlock()
+		case <-timer.C:
+			// Fall back to the old keyframe rather than failing
+			if seq == 0 {
+				return Screenshot{}, ErrNoKeyframe
+			}
+		case <-ctx.Done():
+			return Screenshot{}, ctx.Err()
+		}
+	}
+
+	return s.decode(kf, seq)
+}
+
+// decode decodes kf, reusing the last result when seq was decoded already
+func (s *Service) decode(kf media.VideoFrame, seq uint64) (Screenshot, error) {
+	s.decodeMu.Lock()
+	defer s.decodeMu.Unlock()
+
+	if seq == s.decodedSeq && s.decoded.Image != nil {
+		return s.decoded, nil
+	}
+
+	if s.dec == nil || s.decCodec != kf.Codec {
+		if s.dec != nil {
+			s.dec.Close()
+			s.dec = nil
+		}
+		dec, err := decoder.New(decoder.Config{Backend: s.cfg.Decoder, Codec: kf.Codec})
+		if err != nil {
+			s.errors.Add(1)
+			return Screenshot{}, err
+		}
+		s.dec, s.decCodec = dec, kf.Codec
+		s.mu.Lock()
+		s.decName = dec.Name()
+		s.mu.Unlock()
+		s.logger.Info().Str("decoder", dec.Name()).Str("codec", kf.Codec).Msg("Screenshot decoder created")
+	}
+
+	img, err := s.dec.Decode(kf.Data)
+	if err != nil {
+		s.errors.Add(1)
+		return Screenshot{}, fmt.Errorf("failed to decode keyframe: %w", err)
+	}
+	s.decodes.Add(1)
+	s.decodedSeq = seq
+	s.decoded = Screenshot{Image: preview.Rotate(img, kf.Rotation), CapturedAt: kf.ReceivedAt}
+	return s.decoded, nil
+}
+
+// Close releases the decoder
+func (s *Service) Close() error {
+	s.decodeMu.Lock()
+	defer s.decodeMu.Unlock()
+	if s.dec == nil {
+		return nil
+	}
+	err := s.dec.Close()
+	s.dec = nil
+	return err
+}
+
+// Stats returns service counters
+func (s *Service) Stats() Stats {
+	s.mu.Lock()
+	st := Stats{Codec: s.keyframe.Codec, Decoder: s.decName}
+	if s.seq > 0 {
+		st.KeyframeAge = time.Since(s.keyframe.ReceivedAt).Seconds()
+	}
+	s.mu.Unlock()
+
+	st.Captures = s.captures.Load()
+	st.Decodes = s.decodes.Load()
+	st.Requests = s.requests.Load()
+	st.Errors = s.errors.Load()
+	return st
+}
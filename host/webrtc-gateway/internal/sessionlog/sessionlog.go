@@ -0,0 +1,336 @@
+// Package sessionlog records the signaling of each peer session to disk for
+// debugging: every offer, answer and ICE candidate exchanged, and the
+// connection state transitions that followed. Comparing a session that
+// connects with one that does not usually shows which side is missing
+// candidates or rejecting a codec.
+//
+// Each session is a JSON Lines file named after the peer ID, one Event per
+// line, so a crash loses at most the line being written.
+package sessionlog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ErrNotFound is returned by Get for unknown sessions
+var ErrNotFound = errors.New("session not found")
+
+// Kind is what an event records
+type Kind string
+
+// Event kinds
+const (
+	KindOffer           Kind = "offer"
+	KindAnswer          Kind = "answer"
+	KindCandidate       Kind = "candidate"        // Value is the candidate line; empty ends gathering
+	KindSignalingState  Kind = "signaling_state"  // pion SignalingState
+	KindGatheringState  Kind = "gathering_state"  // pion ICEGatheringState
+	KindICEState        Kind = "ice_state"        // pion ICEConnectionState
+	KindConnectionState Kind = "connection_state" // pion PeerConnectionState
+	KindPeer            Kind = "peer"             // Gateway lifecycle: connected, disconnected
+	KindError           Kind = "error"
+	KindTruncated       Kind = "truncated" // Later events were dropped
+)
+
+// Direction tells which side produced an offer, answer or candidate
+type Direction string
+
+// Directions
+const (
+	Local  Direction = "local"
+	Remote Direction = "remote"
+)
+
+// Event is one recorded step of a session
+type Event struct {
+	Time      time.Time `json:"time"`
+	Kind      Kind      `json:"kind"`
+	Direction Direction `json:"direction,omitempty"`
+	Value     string    `json:"value,omitempty"`
+}
+
+// Session is a recorded session
+type Session struct {
+	ID     string     `json:"id"`
+	Active bool       `json:"active"`
+	Start  time.Time  `json:"start"`
+	End    *time.Time `json:"end,omitempty"` // Time of the last event once ended
+	Events []Event    `json:"events"`
+}
+
+// Summary describes a recorded session without reading it
+type Summary struct {
+	ID       string    `json:"id"`
+	Active   bool      `json:"active"`
+	Modified time.Time `json:"modified"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// Config configures the recorder
+type Config struct {
+	// Dir holds the session files; it is created if missing
+	Dir string
+
+	// MaxSessions is how many session files are kept; the oldest are
+	// removed as new sessions start. Default 200.
+	MaxSessions int
+
+	// MaxEvents caps the events recorded per session, guarding against a
+	// peer that renegotiates or trickles forever. Default 2000.
+	MaxEvents int
+}
+
+// Stats are recorder counters
+type Stats struct {
+	Active   int    `json:"active"`
+	Sessions uint64 `json:"sessions"`
+	Events   uint64 `json:"events"`
+	Dropped  uint64 `json:"dropped"`
+	Errors   uint64 `json:"errors"`
+}
+
+// open is a session being recorded
+type open struct {
+	file   *os.File
+	events int
+}
+
+// Recorder writes session files
+type Recorder struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	mu   sync.Mutex
+	open map[string]*open
+
+	// Statistics
+	sessions atomic.Uint64
+	events   atomic.Uint64
+	dropped  atomic.Uint64
+	errors   atomic.Uint64
+}
+
+// New creates a recorder writing to cfg.Dir
+func New(cfg Config, logger zerolog.Logger) (*Recorder, error) {
+	// Apply defaults for zero values
+	if cfg.MaxSessions <= 0 {
+		cfg.MaxSessions = 200
+	}
+	if cfg.MaxEvents <= 0 {
+		cfg.MaxEvents = 2000
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create session log directory: %w", err)
+	}
+
+	return &Recorder{
+		cfg:    cfg,
+		logger: logger.With().Str("component", "session_log").Logger(),
+		open:   make(map[string]*open),
+	}, nil
+}
+
+// Record appends an event to a session, starting it if needed. Errors are
+// logged, not returned, so recording never fails signaling.
+func (r *Recorder) Record(id string, kind Kind, dir Direction, value string) {
+	if !validID(id) {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s, ok := r.open[id]
+	if !ok {
+		f, err := os.OpenFile(r.path(id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			r.errors.Add(1)
+			r.logger.Warn().Err(err).Str("session_id", id).Msg("Failed to open session log")
+			return
+		}
+		s = &open{file: f}
+		r.open[id] = s
+		r.sessions.Add(1)
+		r.prune()
+	}
+
+	switch {
+	case s.events > r.cfg.MaxEvents:
+		r.dropped.Add(1)
+		return
+	case s.events == r.cfg.MaxEvents:
+		kind, dir, value = KindTruncated, "", ""
+		r.dropped.Add(1)
+	}
+	s.events++
+
+	line, _ := json.Marshal(Event{Time: time.Now().UTC(), Kind: kind, Direction: dir, Value: value})
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		r.errors.Add(1)
+		r.logger.Warn().Err(err).Str("session_id", id).Msg("Failed to write session log")
+		return
+	}
+	r.events.Add(1)
+}
+
+// End closes a session's file; a later Record reopens it
+func (r *Recorder) End(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.open[id]; ok {
+		s.file.Close()
+		delete(r.open, id)
+	}
+}
+
+// Close ends every session
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, s := range r.open {
+		s.file.Close()
+		delete(r.open, id)
+	}
+	return nil
+}
+
+// Get reads a recorded session
+func (r *Recorder) Get(id string) (*Session, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(r.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sess := &Session{ID: id, Events: []Event{}}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 4*1024*1024) // SDP with many codecs runs long
+	for sc.Scan() {
+		var ev Event
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			continue // A line cut short by a crash
+		}
+		sess.Events = append(sess.Events, ev)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	_, sess.Active = r.open[id]
+	r.mu.Unlock()
+	if n := len(sess.Events); n > 0 {
+		sess.Start = sess.Events[0].Time
+		if !sess.Active {
+			sess.End = &sess.Events[n-1].Time
+		}
+	}
+	return sess, nil
+}
+
+// List returns recorded sessions, most recently written first
+func (r *Recorder) List() ([]Summary, error) {
+	entries, err := os.ReadDir(r.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]Summary, 0, len(entries))
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".jsonl")
+		if !ok || e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		_, active := r.open[id]
+		list = append(list, Summary{ID: id, Active: active, Modified: info.ModTime().UTC(), Bytes: info.Size()})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Modified.After(list[j].Modified) })
+	return list, nil
+}
+
+// Stats returns recorder counters
+func (r *Recorder) Stats() Stats {
+	r.mu.Lock()
+	active := len(r.open)
+	r.mu.Unlock()
+	return Stats{
+		Active:   active,
+		Sessions: r.sessions.Load(),
+		Events:   r.events.Load(),
+		Dropped:  r.dropped.Load(),
+		Errors:   r.errors.Load(),
+	}
+}
+
+// prune removes the oldest ended sessions beyond MaxSessions. Caller holds
+// mu.
+func (r *Recorder) prune() {
+	entries, err := os.ReadDir(r.cfg.Dir)
+	if err != nil {
+		return
+	}
+	type file struct {
+		id  string
+		mod time.Time
+	}
+	var files []file
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".jsonl")
+		if !ok || e.IsDir() {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			files = append(files, file{id: id, mod: info.ModTime()})
+		}
+	}
+	if len(files) <= r.cfg.MaxSessions {
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].mod.Before(files[j].mod) })
+	for _, f := range files[:len(files)-r.cfg.MaxSessions] {
+		if _, active := r.open[f.id]; !active {
+			os.Remove(r.path(f.id))
+		}
+	}
+}
+
+func (r *Recorder) path(id string) string {
+	return filepath.Join(r.cfg.Dir, id+".jsonl")
+}
+
+// validID accepts IDs that are safe as file names, such as UUIDs
+func validID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
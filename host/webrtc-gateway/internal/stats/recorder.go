@@ -0,0 +1,188 @@
+package stats
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Counters is a point-in-time reading of cumulative counters and gauges
+type Counters struct {
+	Frames   uint64  // Cumulative frames forwarded
+	Bytes    uint64  // Cumulative bytes forwarded
+	Dropped  uint64  // Cumulative frames dropped by the source
+	Withheld uint64  // Cumulative frames withheld by the distributor
+	Peers    int     // Connected peers now
+	RTTMs    float64 // Mean peer RTT now, 0 if unknown
+
+	// ProducerDropped is cumulative frames the producer dropped before
+	// sending, for producers that number their frames
+	ProducerDropped uint64
+
+	// Glass-to-glass latency percentiles over the tracker's recent window,
+	// 0 if unknown
+	LatencyP50Ms float64
+	LatencyP95Ms float64
+	LatencyP99Ms float64
+}
+
+// Probe reads the current counters
+type Probe func() Counters
+
+// Recorder samples a Probe every second and writes one Minute per minute
+type Recorder struct {
+	store  *Store
+	probe  Probe
+	logger zerolog.Logger
+
+	mu      sync.Mutex
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewRecorder creates a recorder writing to store
+func NewRecorder(store *Store, probe Probe, logger zerolog.Logger) *Recorder {
+	return &Recorder{
+		store:  store,
+		probe:  probe,
+		logger: logger.With().Str("component", "stats_recorder").Logger(),
+	}
+}
+
+// Start begins sampling; returns immediately
+func (r *Recorder) Start(ctx context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running {
+		return
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.running = true
+
+	go r.run(runCtx)
+}
+
+// Stop stops sampling and writes the partial current minute
+func (r *Recorder) Stop() {
+	r.mu.Lock()
+	if !r.running {
+		r.mu.Unlock()
+		return
+	}
+	r.running = false
+	r.cancel()
+	done := r.done
+	r.mu.Unlock()
+
+	<-done
+}
+
+// minuteAccumulator collects samples within one minute
+type minuteAccumulator struct {
+	start    time.Time
+	first    Counters // Counters at the start of the minute
+	last     Counters
+	samples  int
+	peersSum int
+	peersMin int
+	peersMax int
+	rttSum   float64
+	rttN     int
+}
+
+// run samples every second and flushes at minute boundaries
+func (r *Recorder) run(ctx context.Context) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	acc := r.newMinute(time.Now(), r.probe())
+
+	for {
+		select {
+		case <-ctx.Done():
+			r.flush(acc, time.Now())
+			return
+		case now := <-ticker.C:
+			c := r.probe()
+			if now.Truncate(time.Minute).After(acc.start) {
+				r.flush(acc, now)
+				acc = r.newMinute(now, acc.last)
+			}
+			acc.add(c)
+		}
+	}
+}
+
+// newMinute starts accumulating the minute containing now
+func (r *Recorder) newMinute(now time.Time, base Counters) *minuteAccumulator {
+	return &minuteAccumulator{
+		start:    now.UTC().Truncate(time.Minute),
+		first:    base,
+		last:     base,
+		peersMin: -1,
+	}
+}
+
+// add records one sample
+func (a *minuteAccumulator) add(c Counters) {
+	a.last = c
+	a.samples++
+	a.peersSum += c.Peers
+	if a.peersMin < 0 || c.Peers < a.peersMin {
+		a.peersMin = c.Peers
+	}
+	a.peersMax = max(a.peersMax, c.Peers)
+	if c.RTTMs > 0 {
+		a.rttSum += c.RTTMs
+		a.rttN++
+	}
+}
+
+// flush writes the accumulated minute. Rates use the time actually covered,
+// so partial minutes at startup and shutdown are not under-reported.
+func (r *Recorder) flush(a *minuteAccumulator, now time.Time) {
+	if a.samples == 0 {
+		return
+	}
+
+	elapsed := min(now.Sub(a.start), time.Minute).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	frames := a.last.Frames - a.first.Frames
+	m := Minute{
+		Time:        a.start,
+		FPS:         float64(frames) / elapsed,
+		BitrateKbps: float64(a.last.Bytes-a.first.Bytes) * 8 / 1000 / elapsed,
+		Frames:      frames,
+		Dropped:     a.last.Dropped - a.first.Dropped,
+		Withheld:    a.last.Withheld - a.first.Withheld,
+		PeersMin:    max(a.peersMin, 0),
+		PeersMax:    a.peersMax,
+		PeersAvg:    float64(a.peersSum) / float64(a.samples),
+	}
+	if a.rttN > 0 {
+		m.RTTMs = a.rttSum / float64(a.rttN)
+	}
+	m.ProducerDropped = a.last.ProducerDropped - a.first.ProducerDropped
+
+	// The tracker's window already spans recent frames, so the reading at
+	// the end of the minute is representative of it
+	m.LatencyP50Ms = a.last.LatencyP50Ms
+	m.LatencyP95Ms = a.last.LatencyP95Ms
+	m.LatencyP99Ms = a.last.LatencyP99Ms
+
+	if err := r.store.Put(m); err != nil {
+		r.logger.Warn().Err(err).Msg("Failed to write stats")
+	}
+}
@@ -0,0 +1,127 @@
+// Package stats records per-minute stream quality aggregates in an embedded
+// database, so quality can be reviewed after the fact.
+package stats
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// minutesBucket holds one Minute per key; keys are big-endian Unix seconds
+// so bucket order is time order
+var minutesBucket = []byte("minutes")
+
+// Minute is the aggregate for one wall-clock minute
+type Minute struct {
+	Time        time.Time `json:"time"` // Start of the minute, UTC
+	FPS         float64   `json:"fps"`
+	BitrateKbps float64   `json:"bitrate_kbps"`
+	Frames      uint64    `json:"frames"`   // Frames forwarded to peers
+	Dropped     uint64    `json:"dropped"`  // Frames dropped by the source
+	Withheld    uint64    `json:"withheld"` // Frames not forwarded (paused, offline, awaiting keyframe)
+	PeersMin    int       `json:"peers_min"`
+	PeersMax    int       `json:"peers_max"`
+	PeersAvg    float64   `json:"peers_avg"`
+	RTTMs       float64   `json:"rtt_ms,omitempty"` // Mean peer round-trip time, when known
+
+	// ProducerDropped is frames the producer dropped before sending, when
+	// it numbers them
+	ProducerDropped uint64 `json:"producer_dropped,omitempty"`
+
+	// Glass-to-glass latency percentiles, when clients report render times
+	LatencyP50Ms float64 `json:"latency_p50_ms,omitempty"`
+	LatencyP95Ms float64 `json:"latency_p95_ms,omitempty"`
+	LatencyP99Ms float64 `json:"latency_p99_ms,omitempty"`
+}
+
+// Store persists Minutes in a bbolt database
+type Store struct {
+	db        *bolt.DB
+	retention time.Duration
+}
+
+// OpenStore opens or creates the database at path. Minutes older than
+// retention are pruned as new ones are written.
+func OpenStore(path string, retention time.Duration) (*Store, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stats database: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(minutesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize stats database: %w", err)
+	}
+
+	return &Store{db: db, retention: retention}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Put writes a minute and prunes expired ones
+func (s *Store) Put(m Minute) error {
+	value, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(minutesBucket)
+		if err := b.Put(timeKey(m.Time), value); err != nil {
+			return err
+		}
+
+		// Keys are time-ordered, so expired entries are at the front.
+		// Collect first: deleting under a cursor skips entries.
+		cutoff := string(timeKey(m.Time.Add(-s.retention)))
+		var expired [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < cutoff; k, _ = c.Next() {
+			expired = append(expired, k)
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Range returns the minutes in [since, until), oldest first
+func (s *Store) Range(since, until time.Time) ([]Minute, error) {
+	minutes := []Minute{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(minutesBucket).Cursor()
+		end := string(timeKey(until))
+		for k, v := c.Seek(timeKey(since)); k != nil && string(k) < end; k, v = c.Next() {
+			var m Minute
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			minutes = append(minutes, m)
+		}
+		return nil
+	})
+
+	return minutes, err
+}
+
+// timeKey encodes t as a sortable key
+func timeKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.Unix()))
+	return key
+}
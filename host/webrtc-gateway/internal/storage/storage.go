@@ -0,0 +1,452 @@
+// Package storage uploads finished clips and recordings to object storage
+// so they outlive the gateway's disk. Files are queued as they are written
+// and uploaded in the background with retries; the queue is saved so
+// uploads interrupted by a restart resume. Uploaded objects can be expired
+// after a set age and fetched through short-lived signed URLs, so the
+// bucket itself stays private.
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Errors returned by Uploader
+var (
+	ErrNotFound    = errors.New("object not found")
+	ErrNotUploaded = errors.New("object is not uploaded yet")
+)
+
+// Backend stores objects. S3 satisfies it.
+type Backend interface {
+	Put(ctx context.Context, key string, body io.ReadSeeker, size int64, contentType string) error
+	Delete(ctx context.Context, key string) error
+	SignedURL(key string, ttl time.Duration) (string, error)
+}
+
+// Object states
+const (
+	StatePending  = "pending"
+	StateUploaded = "uploaded"
+	StateFailed   = "failed" // Retries ran out or the file is gone
+)
+
+// Object is a file queued for upload, or uploaded
+type Object struct {
+	Key         string     `json:"key"`
+	Path        string     `json:"path"` // Local file
+	ContentType string     `json:"content_type,omitempty"`
+	Bytes       int64      `json:"bytes,omitempty"`
+	State       string     `json:"state"`
+	Attempts    int        `json:"attempts,omitempty"`
+	Error       string     `json:"error,omitempty"` // Of the last attempt
+	QueuedAt    time.Time  `json:"queued_at"`
+	UploadedAt  *time.Time `json:"uploaded_at,omitempty"`
+
+	next time.Time // Earliest next attempt
+}
+
+// Config configures the uploader
+type Config struct {
+	Backend Backend
+
+	// Prefix is prepended to every object key, e.g. "gateway-1/"
+	Prefix string
+
+	// StatePath is the file the queue is saved to. Empty keeps it in
+	// memory, so pending uploads are lost on restart.
+	StatePath string
+
+	// ExpireAfter deletes uploaded objects once they are that old. Zero
+	// keeps them; a bucket lifecycle rule may still remove them.
+	ExpireAfter time.Duration
+
+	// MaxAttempts is how often an upload is tried before it is marked
+	// failed, default 5. Retries back off from RetryDelay, default 5s,
+	// doubling up to 5 minutes.
+	MaxAttempts int
+	RetryDelay  time.Duration
+
+	// CheckInterval is how often uploaded objects are checked for expiry,
+	// default 1h
+	CheckInterval time.Duration
+}
+
+// Stats are uploader counters
+type Stats struct {
+	Pending  int    `json:"pending"`
+	Uploaded uint64 `json:"uploaded"`
+	Failed   uint64 `json:"failed"`
+	Retries  uint64 `json:"retries"`
+	Bytes    uint64 `json:"bytes"`
+	Expired  uint64 `json:"expired"`
+}
+
+// Uploader uploads queued files to a Backend
+type Uploader struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	mu      sync.Mutex
+	objects map[string]*Object
+
+	wake chan struct{}
+	wg   sync.WaitGroup
+
+	// Statistics
+	uploaded atomic.Uint64
+	failed   atomic.Uint64
+	retries  atomic.Uint64
+	bytes    atomic.Uint64
+	expired  atomic.Uint64
+}
+
+// New creates an uploader, loading the queue saved at cfg.StatePath
+func New(cfg Config, logger zerolog.Logger) (*Uploader, error) {
+	// Apply defaults for zero values
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.RetryDelay <= 0 {
+		cfg.RetryDelay = 5 * time.Second
+	}
+	if cfg.CheckInterval <= 0 {
+		cfg.CheckInterval = time.Hour
+	}
+
+	u := &Uploader{
+		cfg:     cfg,
+		logger:  logger.With().Str("component", "storage").Logger(),
+		objects: make(map[string]*Object),
+		wake:    make(chan struct{}, 1),
+	}
+	if cfg.StatePath != "" {
+		data, err := os.ReadFile(cfg.StatePath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read upload queue: %w", err)
+		}
+		if err == nil {
+			var objects []*Object
+			if err := json.Unmarshal(data, &objects); err != nil {
+				return nil, fmt.Errorf("failed to parse upload queue: %w", err)
+			}
+			for _, o := range objects {
+				u.objects[o.Key] = o
+			}
+		}
+	}
+	return u, nil
+}
+
+// Start uploads queued files and expires old objects until ctx is
+// cancelled
+func (u *Uploader) Start(ctx context.Context) {
+	u.wg.Add(2)
+	go func() {
+		defer u.wg.Done()
+		u.uploadLoop(ctx)
+	}()
+	go func() {
+		defer u.wg.Done()
+		u.expireLoop(ctx)
+	}()
+}
+
+// Stop waits for the loops to end once the context given to Start is
+// cancelled. An upload in flight is abandoned and tried again on the next
+// start.
+func (u *Uploader) Stop() {
+	u.wg.Wait()
+}
+
+// Upload queues the file at path for upload as key. A key already queued
+// or uploaded is replaced, as when a recording's description is rewritten.
+func (u *Uploader) Upload(key, path, contentType string) {
+	u.mu.Lock()
+	u.objects[key] = &Object{
+		Key:         key,
+		Path:        path,
+		ContentType: contentType,
+		State:       StatePending,
+		QueuedAt:    time.Now().UTC(),
+	}
+	u.saveLocked()
+	u.mu.Unlock()
+
+	select {
+	case u.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Objects lists queued and uploaded objects, newest first
+func (u *Uploader) Objects() []Object {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	objects := make([]Object, 0, len(u.objects))
+	for _, o := range u.objects {
+		objects = append(objects, *o)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].QueuedAt.After(objects[j].QueuedAt) })
+	return objects
+}
+
+// Get returns an object
+func (u *Uploader) Get(key string) (Object, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	o, ok := u.objects[key]
+	if !ok {
+		return Object{}, ErrNotFound
+	}
+	return *o, nil
+}
+
+// SignedURL returns a URL an uploaded object can be downloaded from for
+// ttl without credentials
+func (u *Uploader) SignedURL(key string, ttl time.Duration) (string, error) {
+	o, err := u.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if o.State != StateUploaded {
+		return "", ErrNotUploaded
+	}
+	return u.cfg.Backend.SignedURL(u.cfg.Prefix+key, ttl)
+}
+
+// Delete removes an object from the bucket, or from the queue if it was
+// not uploaded yet. The local file is left alone.
+func (u *Uploader) Delete(ctx context.Context, key string) error {
+	o, err := u.Get(key)
+	if err != nil {
+		return err
+	}
+	if o.State == StateUploaded {
+		if err := u.cfg.Backend.Delete(ctx, u.cfg.Prefix+key); err != nil {
+			return err
+		}
+	}
+	u.mu.Lock()
+	delete(u.objects, key)
+	u.saveLocked()
+	u.mu.Unlock()
+	return nil
+}
+
+// Stats returns uploader counters
+func (u *Uploader) Stats() Stats {
+	u.mu.Lock()
+	pending := 0
+	for _, o := range u.objects {
+		if o.State == StatePending {
+			pending++
+		}
+	}
+	u.mu.Unlock()
+	return Stats{
+		Pending:  pending,
+		Uploaded: u.uploaded.Load(),
+		Failed:   u.failed.Load(),
+		Retries:  u.retries.Load(),
+		Bytes:    u.bytes.Load(),
+		Expired:  u.expired.Load(),
+	}
+}
+
+// uploadLoop uploads pending objects, oldest first, one at a time
+func (u *Uploader) uploadLoop(ctx context.Context) {
+	for {
+		o, wait := u.nextPending(time.Now())
+		if o != nil {
+			u.upload(ctx, o)
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-u.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// nextPending returns a copy of the oldest object due for an attempt, or
+// how long until one is
+func (u *Uploader) nextPending(now time.Time) (*Object, time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var next *Object
+	wait := time.Hour
+	for _, o := range u.objects {
+		if o.State != StatePending {
+			continue
+		}
+		if o.next.After(now) {
+			wait = min(wait, o.next.Sub(now))
+			continue
+		}
+		if next == nil || o.QueuedAt.Before(next.QueuedAt) {
+			next = o
+		}
+	}
+	if next == nil {
+		return nil, wait
+	}
+	c := *next
+	return &c, 0
+}
+
+// upload makes one attempt at an object, then records the outcome unless
+// the object was replaced or deleted meanwhile
+func (u *Uploader) upload(ctx context.Context, o *Object) {
+	size, err := u.put(ctx, o)
+	if ctx.Err() != nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	cur, ok := u.objects[o.Key]
+	if !ok || cur.QueuedAt != o.QueuedAt {
+		return
+	}
+	cur.Attempts++
+	log := u.logger.With().Str("key", o.Key).Int("attempt", cur.Attempts).Logger()
+	switch {
+	case err == nil:
+		now := time.Now().UTC()
+		cur.State = StateUploaded
+		cur.UploadedAt = &now
+		cur.Bytes = size
+		cur.Error = ""
+		u.uploaded.Add(1)
+		u.bytes.Add(uint64(size))
+		log.Info().Int64("bytes", size).Msg("Uploaded")
+	case errors.Is(err, os.ErrNotExist) || cur.Attempts >= u.cfg.MaxAttempts:
+		// A file deleted before its upload, by retention or by hand, is
+		// not coming back
+		cur.State = StateFailed
+		cur.Error = err.Error()
+		u.failed.Add(1)
+		log.Error().Err(err).Msg("Upload failed")
+	default:
+		delay := min(u.cfg.RetryDelay<<(cur.Attempts-1), 5*time.Minute)
+		cur.next = time.Now().Add(delay)
+		cur.Error = err.Error()
+		u.retries.Add(1)
+		log.Warn().Err(err).Dur("retry_in", delay).Msg("Upload failed, retrying")
+	}
+	u.saveLocked()
+}
+
+// put uploads an object's file, returning its size
+func (u *Uploader) put(ctx context.Context, o *Object) (int64, error) {
+	f, err := os.Open(o.Path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), u.cfg.Backend.Put(ctx, u.cfg.Prefix+o.Key, f, info.Size(), o.ContentType)
+}
+
+// expireLoop deletes uploaded objects past ExpireAfter
+func (u *Uploader) expireLoop(ctx context.Context) {
+	if u.cfg.ExpireAfter <= 0 {
+		return
+	}
+	ticker := time.NewTicker(u.cfg.CheckInterval)
+	defer ticker.Stop()
+	for {
+		u.expire(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (u *Uploader) expire(ctx context.Context, now time.Time) {
+	u.mu.Lock()
+	var keys []string
+	for key, o := range u.objects {
+		if o.State == StateUploaded && o.UploadedAt != nil && now.Sub(*o.UploadedAt) >= u.cfg.ExpireAfter {
+			keys = append(keys, key)
+		}
+	}
+	u.mu.Unlock()
+
+	for _, key := range keys {
+		if err := u.cfg.Backend.Delete(ctx, u.cfg.Prefix+key); err != nil {
+			u.logger.Warn().Err(err).Str("key", key).Msg("Failed to delete expired object")
+			continue
+		}
+		u.mu.Lock()
+		delete(u.objects, key)
+		u.mu.Unlock()
+		u.expired.Add(1)
+		u.logger.Info().Str("key", key).Msg("Deleted expired object")
+	}
+	if len(keys) > 0 {
+		u.mu.Lock()
+		u.saveLocked()
+		u.mu.Unlock()
+	}
+}
+
+// saveLocked writes the queue to StatePath, logging failures; the queue in
+// memory is what the uploader works from. u.mu must be held.
+func (u *Uploader) saveLocked() {
+	if u.cfg.StatePath == "" {
+		return
+	}
+	objects := make([]*Object, 0, len(u.objects))
+	for _, o := range u.objects {
+		objects = append(objects, o)
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].QueuedAt.Before(objects[j].QueuedAt) })
+	data, err := json.MarshalIndent(objects, "", "  ")
+	if err == nil {
+		err = writeFile(u.cfg.StatePath, data)
+	}
+	if err != nil {
+		u.logger.Error().Err(err).Msg("Failed to save upload queue")
+	}
+}
+
+// writeFile replaces path with data through a temporary file
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".uploads-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package supervisor
+
+import (
+	"os"
+	"syscall"
+)
+
+// sysProcAttr puts the capture service in its own process group, so stopping
+// it reaches any helpers it spawned, and makes the kernel stop it if the
+// gateway dies without running its shutdown path
+func sysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGTERM}
+}
+
+// signalGroup sends sig to the process group led by proc
+func signalGroup(proc *os.Process, sig syscall.Signal) error {
+	return syscall.Kill(-proc.Pid, sig)
+}
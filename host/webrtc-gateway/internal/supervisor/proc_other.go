@@ -0,0 +1,22 @@
+//go:build !unix
+
+package supervisor
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// sysProcAttr returns nil; process groups are a Unix feature
+func sysProcAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+// signalGroup can only kill the process itself on this platform
+func signalGroup(proc *os.Process, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return proc.Kill()
+	}
+	return errors.New("signals are not supported on this platform")
+}
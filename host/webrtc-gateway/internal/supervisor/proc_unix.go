@@ -0,0 +1,19 @@
+//go:build unix && !linux
+
+package supervisor
+
+import (
+	"os"
+	"syscall"
+)
+
+// sysProcAttr puts the capture service in its own process group, so stopping
+// it reaches any helpers it spawned
+func sysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalGroup sends sig to the process group led by proc
+func signalGroup(proc *os.Process, sig syscall.Signal) error {
+	return syscall.Kill(-proc.Pid, sig)
+}
@@ -0,0 +1,350 @@
+// Package supervisor runs the capture service, or another helper such as a
+// transcoding worker, as a child process of the gateway, restarting it with
+// backoff when it exits unexpectedly.
+package supervisor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Config configures a supervisor
+type Config struct {
+	Command string   // Executable path or name looked up in PATH
+	Args    []string // Arguments after the command
+	Env     []string // Extra KEY=value entries added to the gateway's environment
+	Dir     string   // Working directory; the gateway's when empty
+
+	// Name is how the process is called in logs, default "Capture service"
+	Name string
+
+	// Attach, when set, is called before each launch to connect the
+	// process's stdin or stdout, e.g. to pipes; output it leaves unset is
+	// logged. The function it returns runs once that process has exited
+	// or failed to start.
+	Attach func(cmd *exec.Cmd) (detach func())
+
+	// RestartDelay is the first wait before restarting after a crash,
+	// default 1s. It doubles on each consecutive crash up to MaxRestartDelay.
+	RestartDelay time.Duration
+
+	// MaxRestartDelay caps the backoff, default 30s
+	MaxRestartDelay time.Duration
+
+	// StableAfter is how long the process must run before a crash counts as
+	// a fresh failure and the backoff resets, default 30s
+	StableAfter time.Duration
+
+	// StopTimeout is how long to wait after SIGTERM before SIGKILL,
+	// default 5s
+	StopTimeout time.Duration
+}
+
+// EventType identifies a process lifecycle event
+type EventType string
+
+const (
+	EventStarted     EventType = "started"      // The process was launched
+	EventExited      EventType = "exited"       // The process exited on its own
+	EventStartFailed EventType = "start_failed" // The process could not be launched
+)
+
+// Event describes a process lifecycle change
+type Event struct {
+	Type     EventType
+	PID      int
+	ExitCode int           // -1 when killed by a signal or not started
+	Err      error         // Exit or launch error, nil on a clean exit
+	Uptime   time.Duration // How long the process ran, for EventExited
+	Restarts uint64        // Restarts so far
+	NextTry  time.Duration // Delay before the next launch, for failures
+}
+
+// Status is a snapshot of the supervised process
+type Status struct {
+	Command   string    `json:"command"`
+	Running   bool      `json:"running"`
+	PID       int       `json:"pid,omitempty"`
+	StartedAt time.Time `json:"started_at,omitempty"`
+	Restarts  uint64    `json:"restarts"`
+	LastExit  string    `json:"last_exit,omitempty"`
+}
+
+// Supervisor launches a process and keeps it running until Stop
+type Supervisor struct {
+	cfg    Config
+	logger zerolog.Logger
+
+	mu        sync.Mutex
+	running   bool
+	cancel    context.CancelFunc
+	done      chan struct{}
+	proc      *os.Process
+	startedAt time.Time
+	lastExit  string
+	onEvent   func(Event)
+
+	// Statistics
+	restarts atomic.Uint64
+}
+
+// New creates a supervisor; the process is launched on Start
+func New(cfg Config, logger zerolog.Logger) *Supervisor {
+	// Apply defaults for zero values
+	if cfg.RestartDelay <= 0 {
+		cfg.RestartDelay = time.Second
+	}
+	if cfg.MaxRestartDelay <= 0 {
+		cfg.MaxRestartDelay = 30 * time.Second
+	}
+	if cfg.StableAfter <= 0 {
+		cfg.StableAfter = 30 * time.Second
+	}
+	if cfg.StopTimeout <= 0 {
+		cfg.StopTimeout = 5 * time.Second
+	}
+	if cfg.Name == "" {
+		cfg.Name = "Capture service"
+	}
+
+	return &Supervisor{
+		cfg:    cfg,
+		logger: logger.With().Str("component", "supervisor").Str("command", cfg.Command).Logger(),
+	}
+}
+
+// SetOnEvent sets a callback for process lifecycle events. It runs on the
+// supervisor goroutine and must not block.
+func (s *Supervisor) SetOnEvent(fn func(Event)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onEvent = fn
+}
+
+// Start launches the process and begins supervising it. A command that
+// cannot be found fails immediately; later launch failures are retried.
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		return errors.New("supervisor already started")
+	}
+	if _, err := exec.LookPath(s.cfg.Command); err != nil {
+		return fmt.Errorf("%s command: %w", s.cfg.Name, err)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.running = true
+
+	go s.run(runCtx)
+
+	s.logger.Info().Strs("args", s.cfg.Args).Msg("Supervisor started")
+
+	return nil
+}
+
+// Stop terminates the process, escalating to SIGKILL after StopTimeout, and
+// waits for it to exit
+func (s *Supervisor) Stop() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	s.running = false
+	s.cancel()
+	done := s.done
+	s.mu.Unlock()
+
+	<-done
+
+	s.logger.Info().Uint64("restarts", s.restarts.Load()).Msg("Supervisor stopped")
+
+	return nil
+}
+
+// Status returns the state of the supervised process
+func (s *Supervisor) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st := Status{
+		Command:  s.cfg.Command,
+		Restarts: s.restarts.Load(),
+		LastExit: s.lastExit,
+	}
+	if s.proc != nil {
+		st.Running = true
+		st.PID = s.proc.Pid
+		st.StartedAt = s.startedAt
+	}
+	return st
+}
+
+// run launches the process and restarts it until the context is cancelled
+func (s *Supervisor) run(ctx context.Context) {
+	defer close(s.done)
+
+	delay := s.cfg.RestartDelay
+	for {
+		started := time.Now()
+		err := s.runOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A process that ran for a while was healthy; start backoff over
+		if time.Since(started) >= s.cfg.StableAfter {
+			delay = s.cfg.RestartDelay
+		}
+
+		s.logger.Warn().Err(err).Dur("restart_in", delay).Msg(s.cfg.Name + " exited, restarting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		s.restarts.Add(1)
+		delay = min(delay*2, s.cfg.MaxRestartDelay)
+	}
+}
+
+// runOnce launches the process and waits for it to exit or for ctx to end
+func (s *Supervisor) runOnce(ctx context.Context) error {
+	cmd := exec.Command(s.cfg.Command, s.cfg.Args...)
+	cmd.Dir = s.cfg.Dir
+	cmd.Env = append(os.Environ(), s.cfg.Env...)
+	cmd.SysProcAttr = sysProcAttr()
+	// Orphaned helpers holding the output pipes must not block Wait
+	cmd.WaitDelay = time.Second
+	if s.cfg.Attach != nil {
+		if detach := s.cfg.Attach(cmd); detach != nil {
+			defer detach()
+		}
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = &logWriter{logger: s.logger, level: zerolog.InfoLevel, msg: s.cfg.Name}
+	}
+	cmd.Stderr = &logWriter{logger: s.logger, level: zerolog.WarnLevel, msg: s.cfg.Name}
+
+	if err := cmd.Start(); err != nil {
+		s.emit(Event{Type: EventStartFailed, ExitCode: -1, Err: err, Restarts: s.restarts.Load()})
+		return fmt.Errorf("failed to start: %w", err)
+	}
+
+	started := time.Now()
+	s.mu.Lock()
+	s.proc = cmd.Process
+	s.startedAt = started
+	s.mu.Unlock()
+
+	s.logger.Info().Int("pid", cmd.Process.Pid).Msg(s.cfg.Name + " started")
+	s.emit(Event{Type: EventStarted, PID: cmd.Process.Pid, Restarts: s.restarts.Load()})
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	var err error
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		err = s.terminate(cmd.Process, exited)
+	}
+
+	s.mu.Lock()
+	s.proc = nil
+	s.lastExit = exitDescription(err)
+	s.mu.Unlock()
+
+	if ctx.Err() == nil {
+		s.emit(Event{
+			Type:     EventExited,
+			PID:      cmd.Process.Pid,
+			ExitCode: cmd.ProcessState.ExitCode(),
+			Err:      err,
+			Uptime:   time.Since(started),
+			Restarts: s.restarts.Load(),
+		})
+	} else {
+		s.logger.Info().Int("pid", cmd.Process.Pid).Str("exit", exitDescription(err)).Msg(s.cfg.Name + " stopped")
+	}
+	return err
+}
+
+// terminate asks the process to exit and kills it if it does not
+func (s *Supervisor) terminate(proc *os.Process, exited <-chan error) error {
+	if err := signalGroup(proc, syscall.SIGTERM); err != nil {
+		// Already gone, or signals are unsupported on this platform
+		signalGroup(proc, syscall.SIGKILL)
+	}
+
+	select {
+	case err := <-exited:
+		return err
+	case <-time.After(s.cfg.StopTimeout):
+		s.logger.Warn().Int("pid", proc.Pid).Msg(s.cfg.Name + " ignored SIGTERM, killing")
+		signalGroup(proc, syscall.SIGKILL)
+		return <-exited
+	}
+}
+
+// emit notifies the callback
+func (s *Supervisor) emit(event Event) {
+	s.mu.Lock()
+	fn := s.onEvent
+	s.mu.Unlock()
+	if fn != nil {
+		fn(event)
+	}
+}
+
+// exitDescription summarises a Wait result
+func exitDescription(err error) string {
+	if err == nil {
+		return "exit status 0"
+	}
+	return err.Error()
+}
+
+// logWriter forwards process output to the logger a line at a time
+type logWriter struct {
+	logger zerolog.Logger
+	level  zerolog.Level
+	msg    string
+	buf    []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if line := bytes.TrimRight(w.buf[:i], "\r"); len(line) > 0 {
+			w.logger.WithLevel(w.level).Str("output", string(line)).Msg(w.msg)
+		}
+		w.buf = w.buf[i+1:]
+	}
+
+	// Do not let a process that never writes a newline grow the buffer
+	if len(w.buf) > 4096 {
+		w.logger.WithLevel(w.level).Str("output", string(w.buf)).Msg(w.msg)
+		w.buf = w.buf[:0]
+	}
+	return len(p), nil
+}
@@ -0,0 +1,65 @@
+// Package systemd implements the parts of the systemd service protocol the
+// gateway uses: socket activation (LISTEN_FDS) and sd_notify readiness and
+// watchdog messages. Both are no-ops when not running under systemd.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// Listeners returns the sockets passed by systemd socket activation, keyed
+// by FileDescriptorName= (or "fd3", "fd4"... when unnamed). It returns an
+// empty map when the process was not socket-activated. The LISTEN_*
+// variables are unset so child processes do not inherit them.
+func Listeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	listeners := make(map[string]net.Listener)
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return listeners, nil
+	}
+
+	var names []string
+	if val := os.Getenv("LISTEN_FDNAMES"); val != "" {
+		names = strings.Split(val, ":")
+	}
+
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+
+		name := fmt.Sprintf("fd%d", fd)
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor (close-on-exec); drop the original
+		f.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("systemd: socket %s is not a listener: %w", name, err)
+		}
+		listeners[name] = l
+	}
+	return listeners, nil
+}
@@ -0,0 +1,83 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends a state string such as "READY=1" to the service manager. It
+// reports false without error when NOTIFY_SOCKET is not set.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	// A leading @ names a socket in the abstract namespace
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ready tells the service manager startup is complete, with a status line
+func Ready(status string) (bool, error) {
+	return Notify("READY=1\nSTATUS=" + status)
+}
+
+// Stopping tells the service manager shutdown has begun
+func Stopping() (bool, error) {
+	return Notify("STOPPING=1")
+}
+
+// WatchdogInterval returns the watchdog timeout configured with WatchdogSec=,
+// or false when the watchdog is disabled or meant for another process
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if val := os.Getenv("WATCHDOG_PID"); val != "" {
+		if pid, err := strconv.Atoi(val); err != nil || pid != os.Getpid() {
+			return 0, false
+		}
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// RunWatchdog sends WATCHDOG=1 at half the configured interval until ctx is
+// done. When healthy is set and returns false, the ping is skipped so
+// systemd restarts the service once the timeout passes. It returns
+// immediately when the watchdog is disabled.
+func RunWatchdog(ctx context.Context, healthy func() bool) {
+	interval, ok := WatchdogInterval()
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if healthy == nil || healthy() {
+				Notify("WATCHDOG=1")
+			}
+		}
+	}
+}
@@ -0,0 +1,341 @@
+// Package timeshift lets a viewer pause and rewind the stream. A viewer in
+// timeshift is detached from live distribution and fed from the replay
+// buffer by its own player, paced by a per-viewer playback clock; everyone
+// else keeps watching live.
+//
+// Viewers control it with data channel messages of type "timeshift":
+//
+//	{"type":"timeshift","action":"pause"}
+//	{"type":"timeshift","action":"resume"}
+//	{"type":"timeshift","action":"seek","offset_ms":30000}
+//	{"type":"timeshift","action":"live"}
+//	{"type":"timeshift","action":"status"}
+//
+// Each is answered with a "timeshift_state" message. Seeking is keyframe
+// accurate: playback starts at the keyframe at or before the target.
+package timeshift
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/replay"
+)
+
+// Message types
+const (
+	MessageType = "timeshift"
+	StateType   = "timeshift_state"
+)
+
+// Modes
+const (
+	ModeLive    = "live"
+	ModePaused  = "paused"
+	ModePlaying = "playing"
+)
+
+// Buffer is where played frames come from.
+// replay.Buffer satisfies it.
+type Buffer interface {
+	Edge() (oldest, newest int64, ok bool)
+	From(ts int64, n int) []replay.Frame
+	After(ts int64, n int) ([]replay.Frame, bool)
+}
+
+// Distributor detaches viewers from live video.
+// media.Distributor satisfies it.
+type Distributor interface {
+	DetachPeer(peerID string) error
+	AttachPeer(peerID string)
+}
+
+// PeerWriter writes video to one viewer.
+// The peer manager satisfies it.
+type PeerWriter interface {
+	WritePeerVideoSample(peerID string, sample media.Sample) error
+}
+
+// Command is a timeshift data channel message
+type Command struct {
+	Type     string `json:"type"`
+	Action   string `json:"action"`
+	OffsetMs int64  `json:"offset_ms,omitempty"` // seek: how far behind live
+}
+
+// State is the reply to every command
+type State struct {
+	Type        string `json:"type"`
+	Mode        string `json:"mode"`
+	BehindMs    int64  `json:"behind_ms"`    // How far the viewer is behind live
+	AvailableMs int64  `json:"available_ms"` // How far back the viewer can seek
+}
+
+// Stats are controller counters
+type Stats struct {
+	Shifted  int    `json:"shifted"` // Viewers not watching live
+	Commands uint64 `json:"commands"`
+	Frames   uint64 `json:"frames"`
+	Errors   uint64 `json:"errors"`
+}
+
+// batch is how many frames a player takes from the buffer at a time
+const batch = 64
+
+// session is one viewer's timeshift state
+type session struct {
+	mode string
+	pos  atomic.Int64 // TS of the frame last shown
+
+	cancel context.CancelFunc // Stops the player; nil unless playing
+	done   chan struct{}
+}
+
+// Controller runs timeshift sessions
+type Controller struct {
+	buffer      Buffer
+	distributor Distributor
+	writer      PeerWriter
+	logger      zerolog.Logger
+
+	mu       sync.Mutex
+	sessions map[string]*session
+
+	// Statistics
+	commands atomic.Uint64
+	frames   atomic.Uint64
+	errors   atomic.Uint64
+}
+
+// New creates a controller
+func New(buffer Buffer, distributor Distributor, writer PeerWriter, logger zerolog.Logger) *Controller {
+	return &Controller{
+		buffer:      buffer,
+		distributor: distributor,
+		writer:      writer,
+		logger:      logger.With().Str("component", "timeshift").Logger(),
+		sessions:    make(map[string]*session),
+	}
+}
+
+// HandleMessage handles a timeshift command. It is a commands.Handler.
+func (c *Controller) HandleMessage(peerID string, msg []byte) (any, error) {
+	var cmd Command
+	if err := json.Unmarshal(msg, &cmd); err != nil {
+		return nil, fmt.Errorf("invalid timeshift command: %w", err)
+	}
+	c.commands.Add(1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.sessions[peerID]
+	if !ok {
+		s = &session{mode: ModeLive}
+	}
+
+	oldest, newest, buffered := c.buffer.Edge()
+	switch cmd.Action {
+	case "status":
+	case "pause":
+		switch s.mode {
+		case ModeLive:
+			if !buffered {
+				return nil, errors.New("nothing buffered yet")
+			}
+			if err := c.distributor.DetachPeer(peerID); err != nil {
+				return nil, err
+			}
+			s.pos.Store(newest)
+		case ModePlaying:
+			s.stop()
+		}
+		s.mode = ModePaused
+	case "resume":
+		if s.mode == ModePaused {
+			c.play(peerID, s, s.pos.Load())
+		}
+	case "seek":
+		if cmd.OffsetMs < 0 {
+			return nil, errors.New("offset_ms must not be negative")
+		}
+		if cmd.OffsetMs == 0 {
+			c.goLive(peerID, s)
+			break
+		}
+		if !buffered {
+			return nil, errors.New("nothing buffered yet")
+		}
+		if s.mode == ModeLive {
+			if err := c.distributor.DetachPeer(peerID); err != nil {
+				return nil, err
+			}
+		}
+		s.stop()
+		c.play(peerID, s, max(newest-cmd.OffsetMs*int64(time.Millisecond), oldest))
+	case "live":
+		c.goLive(peerID, s)
+	default:
+		return nil, fmt.Errorf("unknown timeshift action %q", cmd.Action)
+	}
+
+	if s.mode == ModeLive {
+		delete(c.sessions, peerID)
+	} else {
+		c.sessions[peerID] = s
+	}
+
+	st := State{Type: StateType, Mode: s.mode}
+	if buffered {
+		st.AvailableMs = (newest - oldest) / int64(time.Millisecond)
+		if s.mode != ModeLive {
+			st.BehindMs = max(newest-s.pos.Load(), 0) / int64(time.Millisecond)
+		}
+	}
+	return st, nil
+}
+
+// goLive returns a viewer to live video. Caller holds mu.
+func (c *Controller) goLive(peerID string, s *session) {
+	if s.mode == ModeLive {
+		return
+	}
+	s.stop()
+	s.mode = ModeLive
+	c.distributor.AttachPeer(peerID)
+}
+
+// play starts a player for a viewer at ts. Caller holds mu.
+func (c *Controller) play(peerID string, s *session, ts int64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mode = ModePlaying
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	s.pos.Store(ts)
+	go c.run(ctx, peerID, s, ts)
+}
+
+// stop stops the player, if any, and waits for it to exit
+func (s *session) stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+	s.cancel = nil
+}
+
+// run plays the buffer to a viewer in real time from the keyframe at or
+// before ts until cancelled
+func (c *Controller) run(ctx context.Context, peerID string, s *session, ts int64) {
+	defer close(s.done)
+
+	frames := c.buffer.From(ts, batch)
+	var (
+		clockStart time.Time // Wall time at which baseTS is shown
+		baseTS     int64
+		lastTS     int64
+	)
+	for {
+		if len(frames) == 0 {
+			// At the live edge or waiting for the buffer to fill
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			if lastTS == 0 {
+				frames = c.buffer.From(ts, batch)
+				continue
+			}
+			next, ok := c.buffer.After(lastTS, batch)
+			if !ok {
+				// Paused past the end of the buffer; continue from the
+				// oldest frame still held
+				next = c.buffer.From(lastTS, batch)
+				clockStart = time.Time{}
+			}
+			frames = next
+			continue
+		}
+
+		f := frames[0]
+		frames = frames[1:]
+		if clockStart.IsZero() || f.TS < lastTS {
+			clockStart, baseTS = time.Now(), f.TS
+		}
+		if wait := time.Until(clockStart.Add(time.Duration(f.TS - baseTS))); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+
+		duration := time.Second / 30
+		if lastTS != 0 && f.TS > lastTS {
+			duration = time.Duration(f.TS - lastTS)
+		}
+		if err := c.writer.WritePeerVideoSample(peerID, media.Sample{Data: f.Data, Duration: duration}); err != nil {
+			c.errors.Add(1)
+			c.logger.Debug().Err(err).Str("peer_id", peerID).Msg("Error writing timeshift sample")
+		} else {
+			c.frames.Add(1)
+		}
+		lastTS = f.TS
+		s.pos.Store(f.TS)
+
+		if len(frames) == 0 {
+			next, ok := c.buffer.After(lastTS, batch)
+			if !ok {
+				next = c.buffer.From(lastTS, batch)
+				clockStart = time.Time{}
+			}
+			frames = next
+		}
+	}
+}
+
+// Remove ends a departed viewer's session
+func (c *Controller) Remove(peerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.sessions[peerID]; ok {
+		s.stop()
+		delete(c.sessions, peerID)
+	}
+}
+
+// Close stops every player
+func (c *Controller) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, s := range c.sessions {
+		s.stop()
+		delete(c.sessions, id)
+	}
+	return nil
+}
+
+// Stats returns controller counters
+func (c *Controller) Stats() Stats {
+	c.mu.Lock()
+	shifted := len(c.sessions)
+	c.mu.Unlock()
+	return Stats{
+		Shifted:  shifted,
+		Commands: c.commands.Load(),
+		Frames:   c.frames.Load(),
+		Errors:   c.errors.Load(),
+	}
+}
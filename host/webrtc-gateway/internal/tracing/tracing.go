@@ -0,0 +1,148 @@
+// Package tracing configures OpenTelemetry tracing for the gateway. When
+// tracing is disabled the global no-op provider is left in place, so
+// instrumented code pays almost nothing.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the gateway's tracers
+const instrumentationName = "github.com/zachmartin/gaming-capture/host/webrtc-gateway"
+
+// Config configures trace export
+type Config struct {
+	Endpoint    string  // OTLP/HTTP collector endpoint (host:port), required
+	Insecure    bool    // Use plain HTTP instead of HTTPS
+	SampleRatio float64 // Fraction of root traces kept, 0..1
+	ServiceName string
+}
+
+// Setup installs a global tracer provider exporting to cfg.Endpoint and
+// returns a function that flushes and shuts it down
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	ratio := sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, sdktrace.WithBatchTimeout(2*time.Second)),
+		sdktrace.WithResource(res),
+		// Per-frame spans are numerous; sample new traces by ratio and
+		// follow local parents. Remote parents are sampled by ratio too, so
+		// clients cannot raise the rate by setting the sampled flag.
+		sdktrace.WithSampler(sdktrace.ParentBased(ratio,
+			sdktrace.WithRemoteParentSampled(ratio),
+			sdktrace.WithRemoteParentNotSampled(ratio),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the gateway tracer for a component
+func Tracer(component string) trace.Tracer {
+	return otel.Tracer(instrumentationName + "/" + component)
+}
+
+// Middleware wraps an HTTP handler with a server span per request, continuing
+// any trace propagated by the client (traceparent header)
+func Middleware(component string, next http.Handler) http.Handler {
+	return middleware(component, false, next)
+}
+
+// PublicMiddleware is Middleware for requests from untrusted clients: every
+// request starts a new trace, linked to the client's, so clients cannot
+// choose trace IDs or join the gateway's spans to their traces
+func PublicMiddleware(component string, next http.Handler) http.Handler {
+	return middleware(component, true, next)
+}
+
+func middleware(component string, public bool, next http.Handler) http.Handler {
+	tracer := Tracer(component)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		opts := []trace.SpanStartOption{
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("client.address", r.RemoteAddr),
+			),
+		}
+		if public {
+			if remote := trace.SpanContextFromContext(ctx); remote.IsValid() {
+				opts = append(opts, trace.WithLinks(trace.Link{SpanContext: remote}))
+			}
+			opts = append(opts, trace.WithNewRoot())
+		}
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path, opts...)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// statusRecorder captures the response status for the span
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush passes through to the underlying writer for streaming responses
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController, which
+// long-lived responses use to lift the server write timeout
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
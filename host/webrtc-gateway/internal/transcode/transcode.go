@@ -0,0 +1,504 @@
+// Package transcode produces renditions of the gateway's stream in external
+// worker processes, such as ffmpeg or GStreamer, so heavy decoding and
+// encoding happen outside the gateway and can never stall its Go runtime.
+// Each rendition has its own worker, supervised and restarted with backoff
+// when it exits.
+//
+// # Worker protocol
+//
+// A worker is any command that:
+//
+//   - reads the stream as MPEG-TS on stdin: one program whose H.264 or
+//     H.265 video starts on a keyframe, with the PAT and PMT repeated, and
+//     no audio
+//   - writes its rendition as MPEG-TS on stdout, H.264 or H.265, keeping
+//     the input's timestamps so output frames can be matched to the
+//     frames they came from
+//   - logs to stderr and exits when stdin is closed
+//
+// Its environment carries the rendition's settings, with 0 meaning keep the
+// source's: GATEWAY_RENDITION_NAME, GATEWAY_RENDITION_WIDTH,
+// GATEWAY_RENDITION_HEIGHT, GATEWAY_RENDITION_BITRATE_KBPS and
+// GATEWAY_RENDITION_FPS. Keyframe requests reach the rendition through the
+// source, so workers should key on input keyframes. For example:
+//
+//	sh -c 'exec ffmpeg -loglevel error -f mpegts -i pipe:0 -copyts
+//	  -vf scale=$GATEWAY_RENDITION_WIDTH:-2 -c:v libx264 -preset veryfast
+//	  -tune zerolatency -b:v ${GATEWAY_RENDITION_BITRATE_KBPS}k
+//	  -force_key_frames source -f mpegts pipe:1'
+//
+//	gst-launch-1.0 -q fdsrc ! tsdemux ! h264parse ! avdec_h264 ! videoscale
+//	  ! video/x-raw,width=640,height=360 ! x264enc tune=zerolatency
+//	  ! mpegtsmux ! fdsink
+package transcode
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media/mpegts"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/supervisor"
+)
+
+// tickMask keeps the 33 bits of an MPEG-TS timestamp
+const tickMask = 1<<33 - 1
+
+// Config configures one rendition
+type Config struct {
+	Name    string
+	Command []string // Worker command line; the first entry is looked up in PATH
+
+	// Rendition settings passed to the worker; 0 keeps the source's
+	Width       int
+	Height      int
+	BitrateKbps int
+	FrameRate   int
+
+	QueueSize    int           // Frames queued for the worker, default 120
+	RestartDelay time.Duration // First wait before restarting a worker, default 1s
+}
+
+// Stats are rendition counters
+type Stats struct {
+	Name      string `json:"name"`
+	Running   bool   `json:"running"`
+	PID       int    `json:"pid,omitempty"`
+	Restarts  uint64 `json:"restarts"`
+	LastExit  string `json:"last_exit,omitempty"`
+	Codec     string `json:"codec,omitempty"`
+	FramesIn  uint64 `json:"frames_in"`
+	FramesOut uint64 `json:"frames_out"`
+	Dropped   uint64 `json:"dropped"` // Input frames dropped while the worker was behind or down
+	Unread    uint64 `json:"unread"`  // Output frames dropped because nothing read them
+	Errors    uint64 `json:"errors"`  // Failed writes to, and unreadable output from, the worker
+}
+
+// origin is what an input frame carried that the worker's output loses
+type origin struct {
+	ticks int64 // 33-bit presentation time the worker was given
+	frame media.VideoFrame
+}
+
+// Rendition feeds a worker from a media.Distributor tap and delivers its
+// output as a media.FrameSource
+type Rendition struct {
+	cfg       Config
+	requester media.KeyframeRequester
+	logger    zerolog.Logger
+	warnings  *logging.Summarizer
+	sup       *supervisor.Supervisor
+
+	queue  chan media.VideoFrame
+	frames chan media.VideoFrame
+	broken atomic.Bool // Frames were dropped; resume from a keyframe
+
+	mu       sync.Mutex
+	input    *os.File // The current worker's stdin; nil between workers
+	codec    string
+	inflight []origin // Frames given to the worker, oldest first
+	running  bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+	readers  sync.WaitGroup
+
+	// Statistics
+	framesIn  atomic.Uint64
+	framesOut atomic.Uint64
+	dropped   atomic.Uint64
+	unread    atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// New creates a rendition. requester, when not nil, is asked for a keyframe
+// whenever a worker starts or frames were dropped, so the worker need not
+// wait for the next scheduled one.
+func New(cfg Config, requester media.KeyframeRequester, logger zerolog.Logger) (*Rendition, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("transcode: rendition needs a name")
+	}
+	if len(cfg.Command) == 0 {
+		return nil, errors.New("transcode: worker command is empty")
+	}
+	// Apply defaults for zero values
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 120
+	}
+
+	r := &Rendition{
+		cfg:       cfg,
+		requester: requester,
+		logger:    logger.With().Str("component", "transcode").Str("rendition", cfg.Name).Logger(),
+		queue:     make(chan media.VideoFrame, cfg.QueueSize),
+		frames:    make(chan media.VideoFrame, 30),
+	}
+	r.warnings = logging.NewSummarizer(r.logger)
+	r.sup = supervisor.New(supervisor.Config{
+		Command: cfg.Command[0],
+		Args:    cfg.Command[1:],
+		Env: []string{
+			"GATEWAY_RENDITION_NAME=" + cfg.Name,
+			"GATEWAY_RENDITION_WIDTH=" + strconv.Itoa(cfg.Width),
+			"GATEWAY_RENDITION_HEIGHT=" + strconv.Itoa(cfg.Height),
+			"GATEWAY_RENDITION_BITRATE_KBPS=" + strconv.Itoa(cfg.BitrateKbps),
+			"GATEWAY_RENDITION_FPS=" + strconv.Itoa(cfg.FrameRate),
+		},
+		Name:         "Transcode worker",
+		Attach:       r.attach,
+		RestartDelay: cfg.RestartDelay,
+	}, r.logger)
+	return r, nil
+}
+
+// Start launches the worker; returns immediately. A worker command that
+// cannot be found fails here.
+func (r *Rendition) Start(ctx context.Context) error {
+	r.mu.Lock()
+	if r.running {
+		r.mu.Unlock()
+		return errors.New("rendition already started")
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	r.running = true
+	r.mu.Unlock()
+
+	go r.feed(runCtx)
+	if err := r.sup.Start(runCtx); err != nil {
+		cancel()
+		<-r.done
+		r.mu.Lock()
+		r.running = false
+		r.mu.Unlock()
+		return err
+	}
+	r.logger.Info().Int("width", r.cfg.Width).Int("height", r.cfg.Height).
+		Int("bitrate_kbps", r.cfg.BitrateKbps).Msg("Rendition started")
+	return nil
+}
+
+// Stop ends the worker and waits for its output to be read
+func (r *Rendition) Stop() error {
+	r.mu.Lock()
+	if !r.running {
+		r.mu.Unlock()
+		return nil
+	}
+	r.running = false
+	r.cancel()
+	done := r.done
+	r.mu.Unlock()
+
+	r.sup.Stop()
+	<-done
+	r.readers.Wait()
+
+	r.logger.Info().
+		Uint64("frames_in", r.framesIn.Load()).
+		Uint64("frames_out", r.framesOut.Load()).
+		Uint64("dropped", r.dropped.Load()).
+		Msg("Rendition stopped")
+	return nil
+}
+
+// VideoFrameChannel returns the channel the rendition's frames are
+// delivered on. Frames are dropped rather than queued when it is not read.
+func (r *Rendition) VideoFrameChannel() <-chan media.VideoFrame {
+	return r.frames
+}
+
+// ForceKeyframe asks the source for a keyframe, which a worker keying on
+// its input turns into one of its own
+func (r *Rendition) ForceKeyframe() {
+	if r.requester != nil {
+		r.requester.ForceKeyframe()
+	}
+}
+
+// Observe queues a frame for the worker. It is a media.Distributor tap.
+func (r *Rendition) Observe(f media.VideoFrame) {
+	if f.Codec != "h264" && f.Codec != "hevc" {
+		r.warnings.Warn("Transcode workers take H.264 and H.265 only, dropping frame", func(e *zerolog.Event) {
+			e.Str("codec", f.Codec)
+		})
+		return
+	}
+	select {
+	case r.queue <- f:
+	default:
+		r.dropped.Add(1)
+		r.broken.Store(true)
+		r.warnings.Warn("Transcode worker is behind, dropping frame", nil)
+	}
+}
+
+// Stats returns rendition counters
+func (r *Rendition) Stats() Stats {
+	st := r.sup.Status()
+	r.mu.Lock()
+	codec := r.codec
+	r.mu.Unlock()
+	return Stats{
+		Name:      r.cfg.Name,
+		Running:   st.Running,
+		PID:       st.PID,
+		Restarts:  st.Restarts,
+		LastExit:  st.LastExit,
+		Codec:     codec,
+		FramesIn:  r.framesIn.Load(),
+		FramesOut: r.framesOut.Load(),
+		Dropped:   r.dropped.Load(),
+		Unread:    r.unread.Load(),
+		Errors:    r.failed.Load(),
+	}
+}
+
+// attach connects a worker about to launch: pipes rather than the
+// process's own, so nothing in os/exec waits on them, and a worker that
+// dies only fails the write in progress
+func (r *Rendition) attach(cmd *exec.Cmd) func() {
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		r.logger.Error().Err(err).Msg("Failed to create worker pipe")
+		return nil
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		r.logger.Error().Err(err).Msg("Failed to create worker pipe")
+		return nil
+	}
+	cmd.Stdin = inR
+	cmd.Stdout = outW
+
+	r.mu.Lock()
+	r.input = inW
+	r.inflight = r.inflight[:0]
+	r.mu.Unlock()
+	r.ForceKeyframe()
+
+	r.readers.Add(1)
+	go r.read(outR)
+
+	return func() {
+		// The worker's ends close first, so the reader sees the end of its
+		// output and a blocked write fails
+		inR.Close()
+		outW.Close()
+		r.mu.Lock()
+		if r.input == inW {
+			r.input = nil
+		}
+		r.mu.Unlock()
+		inW.Close()
+	}
+}
+
+// feed writes queued frames to the current worker, starting each worker,
+// and resuming after drops, on a keyframe
+func (r *Rendition) feed(ctx context.Context) {
+	defer close(r.done)
+
+	var (
+		input   *os.File
+		buf     *bufio.Writer
+		mux     *mpegts.Muxer
+		waiting = true
+	)
+	for {
+		var f media.VideoFrame
+		select {
+		case <-ctx.Done():
+			return
+		case f = <-r.queue:
+		}
+
+		r.mu.Lock()
+		cur := r.input
+		r.mu.Unlock()
+		if cur != input {
+			input, waiting = cur, true
+			if input != nil {
+				buf = bufio.NewWriterSize(input, 64<<10)
+				mux = mpegts.NewMuxer(buf, 0)
+			}
+		}
+		if input == nil {
+			r.dropped.Add(1)
+			continue
+		}
+		if r.broken.Swap(false) && !waiting {
+			waiting = true
+			r.ForceKeyframe()
+		}
+		if waiting && !f.IsKeyframe {
+			continue
+		}
+		waiting = false
+
+		ts := f.PTS
+		if ts <= 0 {
+			ts = f.ReceivedAt.UnixNano()
+		}
+		r.remember(ts, f)
+		err := mux.WriteVideo(f.Codec, ts, f.IsKeyframe, f.Data)
+		if err == nil {
+			err = buf.Flush()
+		}
+		if err != nil {
+			// The worker is gone or going; wait for the next one
+			r.failed.Add(1)
+			r.warnings.Warn("Failed to write to transcode worker", func(e *zerolog.Event) { e.Err(err) })
+			input = nil
+			r.mu.Lock()
+			if r.input == cur {
+				r.input = nil
+			}
+			r.mu.Unlock()
+			continue
+		}
+		r.framesIn.Add(1)
+	}
+}
+
+// remember notes a frame given to the worker, for matching its output
+func (r *Rendition) remember(ts int64, f media.VideoFrame) {
+	f.Data = nil
+	r.mu.Lock()
+	if len(r.inflight) >= 2*r.cfg.QueueSize {
+		r.inflight = append(r.inflight[:0], r.inflight[1:]...)
+	}
+	r.inflight = append(r.inflight, origin{ticks: ticks(ts), frame: f})
+	r.mu.Unlock()
+}
+
+// match finds the input frame an output frame was made from, discarding
+// older inputs the worker skipped. Workers that retime their output match
+// nothing.
+func (r *Rendition) match(pts int64) (media.VideoFrame, bool) {
+	t := ticks(pts)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.inflight) > 0 {
+		o := r.inflight[0]
+		// Difference on the 33-bit clock, allowing a tick of rounding
+		d := (o.ticks-t+1<<32)&tickMask - 1<<32
+		switch {
+		case d < -1:
+			r.inflight = r.inflight[1:]
+		case d <= 1:
+			r.inflight = r.inflight[1:]
+			return o.frame, true
+		default:
+			return media.VideoFrame{}, false
+		}
+	}
+	return media.VideoFrame{}, false
+}
+
+// read delivers a worker's output until it ends
+func (r *Rendition) read(out *os.File) {
+	defer r.readers.Done()
+	defer out.Close()
+
+	dmx := mpegts.NewDemuxer(out)
+	for {
+		tf, err := dmx.ReadFrame()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrClosed) {
+				r.failed.Add(1)
+				r.logger.Warn().Err(err).Msg("Unreadable transcode worker output")
+				io.Copy(io.Discard, out)
+			}
+			return
+		}
+
+		f := media.VideoFrame{
+			PTS:        tf.PTS,
+			DTS:        tf.DTS,
+			IsKeyframe: tf.Keyframe,
+			Width:      r.cfg.Width,
+			Height:     r.cfg.Height,
+			Codec:      tf.Codec,
+			Data:       tf.Data,
+			ReceivedAt: time.Now(),
+		}
+		// Keep the source's clock, so the rendition lines up with it
+		if src, ok := r.match(tf.PTS); ok {
+			f.PTS, f.DTS, f.ReceivedAt = src.PTS, src.DTS, src.ReceivedAt
+			f.Discontinuity, f.Rotation, f.Trace = src.Discontinuity, src.Rotation, src.Trace
+		}
+
+		r.mu.Lock()
+		if r.codec != tf.Codec {
+			r.codec = tf.Codec
+			r.logger.Info().Str("codec", tf.Codec).Msg("Rendition codec")
+		}
+		r.mu.Unlock()
+
+		select {
+		case r.frames <- f:
+			r.framesOut.Add(1)
+		default:
+			r.unread.Add(1)
+		}
+	}
+}
+
+// ticks converts nanoseconds to the 33-bit 90 kHz clock the muxer writes
+func ticks(ns int64) int64 {
+	sec, frac := ns/int64(time.Second), ns%int64(time.Second)
+	return (sec*90000 + frac*90000/int64(time.Second)) & tickMask
+}
+
+// ParseRenditions parses "name=WIDTHxHEIGHT[@KBPS]" entries, e.g.
+// "360p=640x360@800"; a zero width or height keeps the source's
+func ParseRenditions(entries []string) ([]Config, error) {
+	configs := make([]Config, 0, len(entries))
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		name, spec, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("rendition %q must be name=WIDTHxHEIGHT[@KBPS]", entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("rendition %q is listed twice", name)
+		}
+		seen[name] = true
+
+		cfg := Config{Name: name}
+		size, rate, hasRate := strings.Cut(strings.TrimSpace(spec), "@")
+		w, h, ok := strings.Cut(size, "x")
+		var errW, errH error
+		cfg.Width, errW = strconv.Atoi(w)
+		cfg.Height, errH = strconv.Atoi(h)
+		if !ok || errW != nil || errH != nil || cfg.Width < 0 || cfg.Height < 0 || cfg.Width%2 != 0 || cfg.Height%2 != 0 {
+			return nil, fmt.Errorf("rendition %q: size must be even WIDTHxHEIGHT", name)
+		}
+		if hasRate {
+			kbps, err := strconv.Atoi(rate)
+			if err != nil || kbps <= 0 {
+				return nil, fmt.Errorf("rendition %q: bitrate must be positive kbps", name)
+			}
+			cfg.BitrateKbps = kbps
+		}
+		configs = append(configs, cfg)
+	}
+	return configs, nil
+}
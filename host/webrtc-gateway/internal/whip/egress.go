@@ -0,0 +1,495 @@
+// Package whip pushes the gateway's stream to a WHIP endpoint, such as
+// Cloudflare Stream or Dolby Millicast, so a CDN can carry it to a large
+// audience at WebRTC latency while local viewers keep their own sessions.
+package whip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+	pionmedia "github.com/pion/webrtc/v4/pkg/media"
+	"github.com/rs/zerolog"
+
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/logging"
+	"github.com/zachmartin/gaming-capture/host/webrtc-gateway/internal/media"
+)
+
+// Config configures a WHIP egress
+type Config struct {
+	URL            string             // WHIP endpoint, http:// or https://
+	Token          string             // Bearer token, as CDNs issue per stream
+	Timeout        time.Duration      // Signaling and connect timeout, default 10s
+	ReconnectDelay time.Duration      // Delay between reconnect attempts, default 2s
+	ICEServers     []webrtc.ICEServer // STUN/TURN servers for reaching the endpoint
+	Audio          bool               // Offer an Opus track fed by WriteAudio
+	BufferSize     int                // Frames queued for sending, default 60
+}
+
+// Stats are egress counters
+type Stats struct {
+	Connected bool   `json:"connected"`
+	Codec     string `json:"codec,omitempty"`
+	Sessions  uint64 `json:"sessions"`
+	Frames    uint64 `json:"frames"`
+	Dropped   uint64 `json:"dropped"`
+	Audio     uint64 `json:"audio_packets"`
+	Keyframes uint64 `json:"keyframe_requests"` // PLIs and FIRs from the endpoint
+}
+
+// errCodecChanged ends a session when the source switches codec
+var errCodecChanged = errors.New("video codec changed")
+
+// Egress publishes the stream to a WHIP endpoint, reconnecting
+// automatically. Frames are queued and sent from its own goroutine, so the
+// distributor never waits on the CDN.
+type Egress struct {
+	cfg       Config
+	requester media.KeyframeRequester
+	logger    zerolog.Logger
+	warnings  *logging.Summarizer // Rate-limits per-frame warnings
+	client    *http.Client
+
+	frames chan media.VideoFrame
+	audio  chan pionmedia.Sample
+	broken atomic.Bool // A frame was dropped; wait for a keyframe
+
+	mu      sync.Mutex
+	running bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+	codec   string
+
+	connected atomic.Bool
+
+	// Statistics
+	sessions  atomic.Uint64
+	sent      atomic.Uint64
+	dropped   atomic.Uint64
+	audioSent atomic.Uint64
+	keyframes atomic.Uint64
+}
+
+// New creates an egress; the connection is made on Start once video flows.
+// requester, which may be nil, is asked for keyframes the endpoint wants.
+func New(cfg Config, requester media.KeyframeRequester, logger zerolog.Logger) *Egress {
+	// Apply defaults for zero values
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.ReconnectDelay <= 0 {
+		cfg.ReconnectDelay = 2 * time.Second
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 60
+	}
+
+	logger = logger.With().Str("component", "whip_egress").Str("url", cfg.URL).Logger()
+	return &Egress{
+		cfg:       cfg,
+		requester: requester,
+		logger:    logger,
+		warnings:  logging.NewSummarizer(logger),
+		client:    &http.Client{Timeout: cfg.Timeout},
+		frames:    make(chan media.VideoFrame, cfg.BufferSize),
+		audio:     make(chan pionmedia.Sample, cfg.BufferSize),
+	}
+}
+
+// Start begins publishing in the background; returns immediately
+func (e *Egress) Start(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.running {
+		return errors.New("whip egress already started")
+	}
+	if u, err := url.Parse(e.cfg.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid WHIP URL %q", e.cfg.URL)
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	e.cancel = cancel
+	e.done = make(chan struct{})
+	e.running = true
+
+	go e.connectLoop(runCtx)
+
+	e.logger.Info().Bool("audio", e.cfg.Audio).Msg("WHIP egress started")
+
+	return nil
+}
+
+// Stop ends the session, deleting it at the endpoint, and waits
+func (e *Egress) Stop() error {
+	e.mu.Lock()
+	if !e.running {
+		e.mu.Unlock()
+		return nil
+	}
+	e.running = false
+	e.cancel()
+	done := e.done
+	e.mu.Unlock()
+
+	<-done
+
+	e.logger.Info().
+		Uint64("frames", e.sent.Load()).
+		Uint64("dropped", e.dropped.Load()).
+		Msg("WHIP egress stopped")
+
+	return nil
+}
+
+// Observe queues a frame for the endpoint. It is a media.Distributor tap.
+func (e *Egress) Observe(f media.VideoFrame) {
+	select {
+	case e.frames <- f:
+	default:
+		e.dropped.Add(1)
+		e.broken.Store(true)
+		e.warnings.Warn("WHIP egress queue full, dropping frame", nil)
+	}
+}
+
+// WriteAudio queues an Opus packet lasting duration. It is ignored unless
+// Config.Audio is set.
+func (e *Egress) WriteAudio(data []byte, duration time.Duration) {
+	if !e.cfg.Audio || !e.connected.Load() {
+		return
+	}
+	select {
+	case e.audio <- pionmedia.Sample{Data: data, Duration: duration}:
+	default:
+		e.warnings.Warn("WHIP egress audio queue full, dropping packet", nil)
+	}
+}
+
+// IsConnected returns true while a session is publishing
+func (e *Egress) IsConnected() bool {
+	return e.connected.Load()
+}
+
+// Stats returns egress counters
+func (e *Egress) Stats() Stats {
+	e.mu.Lock()
+	codec := e.codec
+	e.mu.Unlock()
+	return Stats{
+		Connected: e.connected.Load(),
+		Codec:     codec,
+		Sessions:  e.sessions.Load(),
+		Frames:    e.sent.Load(),
+		Dropped:   e.dropped.Load(),
+		Audio:     e.audioSent.Load(),
+		Keyframes: e.keyframes.Load(),
+	}
+}
+
+// connectLoop runs sessions until the context is cancelled
+func (e *Egress) connectLoop(ctx context.Context) {
+	defer close(e.done)
+
+	var unsupported string // Codec that cannot be sent, reported once
+	for {
+		// The codec to offer is only known once video flows
+		var codec string
+		select {
+		case <-ctx.Done():
+			return
+		case f := <-e.frames:
+			codec = f.Codec
+		}
+		capability, err := videoCapability(codec)
+		if err != nil {
+			if codec != unsupported {
+				unsupported = codec
+				e.logger.Error().Err(err).Msg("Not publishing until the video codec changes")
+			}
+			continue
+		}
+		unsupported = ""
+
+		err = e.session(ctx, codec, capability)
+		e.connected.Store(false)
+
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errCodecChanged) {
+			e.logger.Info().Str("from", codec).Msg("Video codec changed, renegotiating WHIP session")
+			continue
+		}
+		e.logger.Warn().Err(err).Dur("retry_in", e.cfg.ReconnectDelay).Msg("WHIP session ended")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.cfg.ReconnectDelay):
+		}
+	}
+}
+
+// session publishes to the endpoint until the connection fails
+func (e *Egress) session(ctx context.Context, codec string, capability webrtc.RTPCodecCapability) error {
+	e.mu.Lock()
+	e.codec = codec
+	e.mu.Unlock()
+
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{ICEServers: e.cfg.ICEServers})
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+
+	failed := make(chan struct{})
+	var once sync.Once
+	connected := make(chan struct{})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			select {
+			case <-connected:
+			default:
+				close(connected)
+			}
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateClosed:
+			once.Do(func() { close(failed) })
+		}
+	})
+
+	video, err := webrtc.NewTrackLocalStaticSample(capability, "video", "gateway")
+	if err != nil {
+		return err
+	}
+	sender, err := pc.AddTransceiverFromTrack(video, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly})
+	if err != nil {
+		return err
+	}
+	var audio *webrtc.TrackLocalStaticSample
+	if e.cfg.Audio {
+		audio, err = webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+			MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2,
+		}, "audio", "gateway")
+		if err != nil {
+			return err
+		}
+		if _, err := pc.AddTransceiverFromTrack(audio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+			return err
+		}
+	}
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	// Send every candidate in the offer rather than trickling them
+	select {
+	case <-gathered:
+	case <-time.After(e.cfg.Timeout):
+		return errors.New("ICE gathering timed out")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	answer, resource, err := e.post(ctx, pc.LocalDescription().SDP)
+	if err != nil {
+		return err
+	}
+	if resource != "" {
+		defer e.teardown(resource)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		return err
+	}
+
+	select {
+	case <-connected:
+	case <-failed:
+		return errors.New("WHIP connection failed")
+	case <-time.After(e.cfg.Timeout):
+		return errors.New("WHIP connection timed out")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	e.sessions.Add(1)
+	e.connected.Store(true)
+	e.logger.Info().Str("codec", codec).Msg("WHIP session publishing")
+
+	go e.readRTCP(sender.Sender())
+
+	return e.writeLoop(ctx, codec, video, audio, failed)
+}
+
+// writeLoop sends queued frames and audio until the session ends. Frames
+// queued while connecting are stale, so it starts from a fresh keyframe.
+func (e *Egress) writeLoop(ctx context.Context, codec string, video, audio *webrtc.TrackLocalStaticSample, failed <-chan struct{}) error {
+	for drained := false; !drained; {
+		select {
+		case <-e.frames:
+		default:
+			drained = true
+		}
+	}
+	e.broken.Store(false)
+	e.requestKeyframe()
+
+	waiting := true // For a keyframe
+	var lastTS int64
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-failed:
+			return errors.New("WHIP connection lost")
+		case s := <-e.audio:
+			if audio == nil {
+				continue
+			}
+			if err := audio.WriteSample(s); err != nil {
+				return err
+			}
+			e.audioSent.Add(1)
+		case f := <-e.frames:
+			if f.Codec != codec {
+				return errCodecChanged
+			}
+			if e.broken.Swap(false) {
+				waiting = true
+				e.requestKeyframe()
+			}
+			if waiting && !f.IsKeyframe {
+				continue
+			}
+			waiting = false
+
+			ts := f.PTS
+			if ts <= 0 {
+				ts = f.ReceivedAt.UnixNano()
+			}
+			duration := time.Second / 60
+			if lastTS != 0 && ts > lastTS {
+				duration = time.Duration(ts - lastTS)
+			}
+			lastTS = ts
+
+			if err := video.WriteSample(pionmedia.Sample{Data: f.Data, Duration: duration}); err != nil {
+				return err
+			}
+			e.sent.Add(1)
+		}
+	}
+}
+
+// readRTCP answers the endpoint's keyframe requests. It ends when the
+// session closes.
+func (e *Egress) readRTCP(sender *webrtc.RTPSender) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, p := range packets {
+			switch p.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				e.keyframes.Add(1)
+				e.requestKeyframe()
+			}
+		}
+	}
+}
+
+func (e *Egress) requestKeyframe() {
+	if e.requester != nil {
+		e.requester.ForceKeyframe()
+	}
+}
+
+// post sends the offer and returns the answer and the session resource URL
+func (e *Egress) post(ctx context.Context, offer string) (answer, resource string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.cfg.URL, strings.NewReader(offer))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+	if e.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.cfg.Token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("WHIP endpoint returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	if loc := resp.Header.Get("Location"); loc != "" {
+		if u, err := resp.Request.URL.Parse(loc); err == nil {
+			resource = u.String()
+		}
+	}
+	return string(body), resource, nil
+}
+
+// teardown deletes the session resource so the endpoint ends the broadcast
+// at once instead of waiting for ICE to time out
+func (e *Egress) teardown(resource string) {
+	ctx, cancel := context.WithTimeout(context.Background(), e.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, resource, nil)
+	if err != nil {
+		return
+	}
+	if e.cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.cfg.Token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		e.logger.Debug().Err(err).Msg("WHIP session teardown failed")
+		return
+	}
+	resp.Body.Close()
+}
+
+// videoCapability is the track offered for a frame codec. Pion has no
+// HEVC packetizer, and most WHIP services take H.264 only.
+func videoCapability(codec string) (webrtc.RTPCodecCapability, error) {
+	switch codec {
+	case "h264":
+		return webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeH264,
+			ClockRate:   90000,
+			SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+		}, nil
+	case "vp9":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0"}, nil
+	case "av1":
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000}, nil
+	}
+	return webrtc.RTPCodecCapability{}, fmt.Errorf("video codec %q cannot be sent over WHIP", codec)
+}